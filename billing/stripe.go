@@ -0,0 +1,201 @@
+// stripe.go - Stripe Checkout, customer portal and webhook verification over the REST API
+
+package billing // Declares the package name
+
+import ( // Import required packages
+	"context"       // For cancellation
+	"crypto/hmac"   // Webhook signatures
+	"crypto/sha256" // Webhook signatures
+	"encoding/hex"  // Signature encoding
+	"encoding/json" // API payloads
+	"errors"        // Signature errors
+	"fmt"           // For error formatting
+	"io"            // Reading responses
+	"net/http"      // Stripe API
+	"net/url"       // Form encoding
+	"strconv"       // Signature timestamps
+	"strings"       // Header parsing
+	"time"          // Client timeout, signature age
+)
+
+// ErrBadSignature is returned for webhook payloads that weren't signed with the endpoint's
+// secret or whose signature is too old.
+var ErrBadSignature = errors.New("stripe: invalid webhook signature")
+
+const signatureTolerance = 5 * time.Minute // Stripe's recommended replay window
+
+type Stripe struct { // Stripe talks to the Stripe API with a secret key
+	SecretKey     string       // sk_live_... or sk_test_...
+	WebhookSecret string       // whsec_... of the webhook endpoint
+	BaseURL       string       // API root (empty uses https://api.stripe.com)
+	Client        *http.Client // HTTP client (nil uses a 15s-timeout client)
+}
+
+type CheckoutParams struct { // What a subscription checkout is for
+	PriceID       string            // Recurring price to subscribe to
+	CustomerID    string            // Existing customer (empty creates one)
+	CustomerEmail string            // Prefilled email for a new customer
+	ReferenceID   string            // Our ID for the subscriber, echoed back as client_reference_id
+	SuccessURL    string            // Where Stripe sends the user after paying
+	CancelURL     string            // Where Stripe sends the user if they back out
+	Metadata      map[string]string // Copied to the subscription, so its webhooks carry it
+}
+
+type Session struct { // A hosted Stripe page to send the user to
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// CreateCheckoutSession starts a hosted checkout for a subscription.
+func (s *Stripe) CreateCheckoutSession(ctx context.Context, p CheckoutParams) (Session, error) {
+	form := url.Values{
+		"mode":                    {"subscription"},
+		"line_items[0][price]":    {p.PriceID},
+		"line_items[0][quantity]": {"1"},
+		"success_url":             {p.SuccessURL},
+		"cancel_url":              {p.CancelURL},
+		"client_reference_id":     {p.ReferenceID},
+	}
+	if p.CustomerID != "" {
+		form.Set("customer", p.CustomerID)
+	} else if p.CustomerEmail != "" {
+		form.Set("customer_email", p.CustomerEmail)
+	}
+	for k, v := range p.Metadata {
+		form.Set("subscription_data[metadata]["+k+"]", v)
+	}
+	var out Session
+	err := s.post(ctx, "/v1/checkout/sessions", form, &out)
+	return out, err
+}
+
+// CreatePortalSession opens the hosted customer portal, where a customer changes their
+// payment method, switches plans or cancels.
+func (s *Stripe) CreatePortalSession(ctx context.Context, customerID, returnURL string) (Session, error) {
+	var out Session
+	err := s.post(ctx, "/v1/billing_portal/sessions", url.Values{"customer": {customerID}, "return_url": {returnURL}}, &out)
+	return out, err
+}
+
+func (s *Stripe) post(ctx context.Context, path string, form url.Values, out any) error {
+	base, client := s.BaseURL, s.Client
+	if base == "" {
+		base = "https://api.stripe.com"
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 15 * time.Second}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.SecretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(data, &apiErr)
+		return fmt.Errorf("stripe: %s (%s, HTTP %d)", apiErr.Error.Message, apiErr.Error.Type, resp.StatusCode)
+	}
+	return json.Unmarshal(data, out)
+}
+
+type Event struct { // A webhook event; Data.Object depends on Type
+	ID      string `json:"id"`
+	Type    string `json:"type"`    // e.g. "customer.subscription.updated"
+	Created int64  `json:"created"` // Unix time, for ordering
+	Data    struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+type CheckoutSession struct { // data.object of checkout.session.completed
+	ID           string `json:"id"`
+	ReferenceID  string `json:"client_reference_id"`
+	Customer     string `json:"customer"`
+	Subscription string `json:"subscription"`
+}
+
+type Subscription struct { // data.object of customer.subscription.* events
+	ID       string            `json:"id"`
+	Customer string            `json:"customer"`
+	Status   string            `json:"status"` // active, trialing, past_due, unpaid, canceled, incomplete, ...
+	Metadata map[string]string `json:"metadata"`
+	Items    struct {
+		Data []struct {
+			Price struct {
+				ID string `json:"id"`
+			} `json:"price"`
+		} `json:"data"`
+	} `json:"items"`
+}
+
+// PriceID is the price of the subscription's first item.
+func (s Subscription) PriceID() string {
+	if len(s.Items.Data) == 0 {
+		return ""
+	}
+	return s.Items.Data[0].Price.ID
+}
+
+type Invoice struct { // data.object of invoice.* events
+	ID           string `json:"id"`
+	Customer     string `json:"customer"`
+	Subscription string `json:"subscription"`
+}
+
+// ParseWebhook checks the Stripe-Signature header of a webhook request against the
+// endpoint secret and decodes the event.
+func (s *Stripe) ParseWebhook(payload []byte, header string, now time.Time) (Event, error) {
+	var ev Event
+	var ts int64
+	var sigs []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts, _ = strconv.ParseInt(v, 10, 64)
+		case "v1":
+			sigs = append(sigs, v)
+		}
+	}
+	if ts == 0 || len(sigs) == 0 {
+		return ev, ErrBadSignature
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > signatureTolerance || age < -signatureTolerance {
+		return ev, ErrBadSignature
+	}
+	want := Sign(s.WebhookSecret, ts, payload)
+	ok := false
+	for _, sig := range sigs {
+		ok = ok || hmac.Equal([]byte(sig), []byte(want))
+	}
+	if !ok {
+		return ev, ErrBadSignature
+	}
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return ev, fmt.Errorf("stripe: bad event payload: %w", err)
+	}
+	return ev, nil
+}
+
+// Sign computes the v1 signature Stripe sends for payload at Unix time ts.
+func Sign(secret string, ts int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
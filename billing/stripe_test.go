@@ -0,0 +1,82 @@
+// stripe_test.go - Tests for the Stripe client and webhook verification
+// Run with: go test ./...
+
+package billing
+
+import (
+	"context"           // For cancellation
+	"fmt"               // Signature headers
+	"net/http"          // HTTP status codes
+	"net/http/httptest" // Fake Stripe API
+	"testing"           // Go's testing package
+	"time"              // Signature timestamps
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestCreateCheckoutSession checks the form sent to Stripe and API error reporting
+func TestCreateCheckoutSession(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, _, _ := r.BasicAuth(); key != "sk_test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"type":"invalid_request_error","message":"Invalid API Key provided"}}`))
+			return
+		}
+		assert.Equal(t, "/v1/checkout/sessions", r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "subscription", r.PostForm.Get("mode"))
+		assert.Equal(t, "price_pro", r.PostForm.Get("line_items[0][price]"))
+		assert.Equal(t, "7", r.PostForm.Get("client_reference_id"))
+		assert.Equal(t, "7", r.PostForm.Get("subscription_data[metadata][organization_id]"))
+		assert.Equal(t, "boss@example.com", r.PostForm.Get("customer_email"))
+		w.Write([]byte(`{"id":"cs_1","url":"https://checkout.stripe.com/c/pay/cs_1"}`))
+	}))
+	defer srv.Close()
+
+	params := CheckoutParams{
+		PriceID: "price_pro", CustomerEmail: "boss@example.com", ReferenceID: "7",
+		SuccessURL: "https://app/ok", CancelURL: "https://app/cancel",
+		Metadata: map[string]string{"organization_id": "7"},
+	}
+	s := &Stripe{SecretKey: "sk_test", BaseURL: srv.URL}
+	session, err := s.CreateCheckoutSession(context.Background(), params)
+	require.NoError(t, err)
+	assert.Equal(t, "cs_1", session.ID)
+	assert.Equal(t, "https://checkout.stripe.com/c/pay/cs_1", session.URL)
+
+	s.SecretKey = "sk_wrong"
+	_, err = s.CreateCheckoutSession(context.Background(), params)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid API Key provided")
+}
+
+// TestParseWebhook checks signature, timestamp tolerance and event decoding
+func TestParseWebhook(t *testing.T) {
+	s := &Stripe{WebhookSecret: "whsec_test"}
+	now := time.Unix(1_900_000_000, 0)
+	payload := []byte(`{"id":"evt_1","type":"customer.subscription.updated","created":1900000000,"data":{"object":{"id":"sub_1","status":"past_due","items":{"data":[{"price":{"id":"price_pro"}}]}}}}`)
+	header := func(ts int64, sig string) string { return fmt.Sprintf("t=%d,v1=%s", ts, sig) }
+
+	ev, err := s.ParseWebhook(payload, header(now.Unix(), Sign("whsec_test", now.Unix(), payload)), now)
+	require.NoError(t, err)
+	assert.Equal(t, "customer.subscription.updated", ev.Type)
+	assert.Contains(t, string(ev.Data.Object), `"sub_1"`)
+
+	// Stripe sends a v1 signature per active secret while one is being rolled
+	rolled := fmt.Sprintf("t=%d,v1=%s,v1=%s", now.Unix(), Sign("whsec_old", now.Unix(), payload), Sign("whsec_test", now.Unix(), payload))
+	_, err = s.ParseWebhook(payload, rolled, now)
+	assert.NoError(t, err)
+
+	for name, h := range map[string]string{
+		"wrong secret": header(now.Unix(), Sign("whsec_other", now.Unix(), payload)),
+		"too old":      header(now.Add(-10*time.Minute).Unix(), Sign("whsec_test", now.Add(-10*time.Minute).Unix(), payload)),
+		"no signature": fmt.Sprintf("t=%d", now.Unix()),
+		"empty":        "",
+	} {
+		_, err := s.ParseWebhook(payload, h, now)
+		assert.ErrorIs(t, err, ErrBadSignature, name)
+	}
+	_, err = s.ParseWebhook([]byte(`{"id":"evt_2"}x`), header(now.Unix(), Sign("whsec_test", now.Unix(), []byte(`{"id":"evt_2"}`))), now)
+	assert.ErrorIs(t, err, ErrBadSignature) // Tampered body
+}
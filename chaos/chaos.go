@@ -0,0 +1,89 @@
+// chaos.go - Failure injection for resilience testing
+//
+// With CHAOS_MODE on, MQTT publishes fail, motor status reports arrive late and database
+// calls fail at configured rates, so OFF retries, the ack watchdog and admin alerts can
+// be exercised end to end against a real broker and database. Production mode refuses
+// to start with it.
+
+package chaos // Declares the package name
+
+import ( // Import required packages
+	"errors"    // Injected errors
+	"fmt"       // Error context
+	"math/rand" // Which calls fail
+	"sync"      // For mutex (thread safety)
+	"time"      // Delays
+
+	"gorm.io/gorm" // Database callbacks
+)
+
+var ErrInjected = errors.New("chaos: injected failure") // Returned for every injected failure
+
+type Config struct { // Rates are shares from 0 (never) to 1 (always)
+	PublishFailRate float64       // MQTT publishes that fail
+	AckDelayRate    float64       // Motor status reports handled late
+	AckDelay        time.Duration // How late
+	DBErrorRate     float64       // Database calls that fail
+}
+
+// Injector decides which calls fail. A nil *Injector injects nothing, so callers can hold
+// one whether or not chaos mode is on.
+type Injector struct {
+	cfg Config
+
+	mu   sync.Mutex // rand.Rand isn't safe for concurrent use
+	rand *rand.Rand
+}
+
+func New(cfg Config) *Injector { // Creates an injector for cfg
+	return &Injector{cfg: cfg, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (i *Injector) hit(rate float64) bool { // Reports whether this call is one of rate
+	if rate <= 0 {
+		return false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rand.Float64() < rate
+}
+
+// PublishError returns an error for a publish to topic that should fail, nil otherwise.
+func (i *Injector) PublishError(topic string) error {
+	if i == nil || !i.hit(i.cfg.PublishFailRate) {
+		return nil
+	}
+	return fmt.Errorf("%w: publish to %s", ErrInjected, topic)
+}
+
+// AckDelay returns how long to hold back a motor status report (0: handle it now).
+func (i *Injector) AckDelay() time.Duration {
+	if i == nil || !i.hit(i.cfg.AckDelayRate) {
+		return 0
+	}
+	return i.cfg.AckDelay
+}
+
+// RegisterGORM makes db fail DBErrorRate of its creates, queries, updates, deletes and raw
+// statements with ErrInjected. Register it after migrations, or startup fails too.
+func (i *Injector) RegisterGORM(db *gorm.DB) error {
+	fail := func(tx *gorm.DB) {
+		if i.hit(i.cfg.DBErrorRate) {
+			tx.AddError(ErrInjected)
+		}
+	}
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("chaos:create", fail),
+		cb.Query().Before("gorm:query").Register("chaos:query", fail),
+		cb.Update().Before("gorm:update").Register("chaos:update", fail),
+		cb.Delete().Before("gorm:delete").Register("chaos:delete", fail),
+		cb.Row().Before("gorm:row").Register("chaos:row", fail),
+		cb.Raw().Before("gorm:raw").Register("chaos:raw", fail),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// chaos_test.go - Tests for failure injection
+// Run with: go test ./...
+
+package chaos
+
+import (
+	"testing" // Go's testing package
+	"time"    // Delays
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite" // In-memory database
+	"gorm.io/gorm"
+)
+
+// TestRates checks that failures are injected at roughly the configured rate and never by a nil injector
+func TestRates(t *testing.T) {
+	var off *Injector
+	assert.NoError(t, off.PublishError("motor/control"))
+	assert.Zero(t, off.AckDelay())
+
+	always := New(Config{PublishFailRate: 1, AckDelayRate: 1, AckDelay: time.Second})
+	assert.ErrorIs(t, always.PublishError("motor/control"), ErrInjected)
+	assert.Equal(t, time.Second, always.AckDelay())
+
+	half := New(Config{PublishFailRate: 0.5})
+	failed := 0
+	for range 1000 {
+		if half.PublishError("motor/control") != nil {
+			failed++
+		}
+		assert.Zero(t, half.AckDelay())
+	}
+	assert.InDelta(t, 500, failed, 100)
+}
+
+// TestRegisterGORM checks that database calls fail with ErrInjected
+func TestRegisterGORM(t *testing.T) {
+	type row struct{ ID uint }
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&row{}))
+
+	require.NoError(t, New(Config{DBErrorRate: 1}).RegisterGORM(db))
+	assert.ErrorIs(t, db.Create(&row{}).Error, ErrInjected)
+	var rows []row
+	assert.ErrorIs(t, db.Find(&rows).Error, ErrInjected)
+	assert.ErrorIs(t, db.Exec("DELETE FROM rows").Error, ErrInjected)
+}
@@ -0,0 +1,187 @@
+// commands.go - Maintenance subcommands (migrate, create-admin, gen-token, loadgen) and the startup admin bootstrap
+
+package main // Declares the package name
+
+import ( // Import required packages
+	"context"                  // Interrupting a load run
+	"errors"                   // For checking not-found errors
+	"flag"                     // Subcommand flags
+	"fmt"                      // Output
+	"go-mqtt-backend/database" // Database connection and setup
+	"go-mqtt-backend/handlers" // Token generation
+	"go-mqtt-backend/loadgen"  // Synthetic load
+	"go-mqtt-backend/models"   // User model
+	"go-mqtt-backend/mqtt"     // Publishing readings
+	"log"                      // Logging
+	"os"                       // Report output
+	"os/signal"                // Ctrl-C ends a load run early
+	"time"                     // Token lifetime
+
+	"golang.org/x/crypto/bcrypt" // Password hashing
+	"gorm.io/gorm"               // gorm.ErrRecordNotFound
+)
+
+func runMigrate(args []string) { // Applies database migrations and exits
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Parse(args)
+
+	cfg := loadConfig(false)                          // Load configuration
+	if err := database.Open(cfg.DBPath); err != nil { // Open the database
+		log.Fatal("DB connection error: ", err)
+	}
+	if err := database.Migrate(); err != nil { // Create/update tables
+		log.Fatal("migration error: ", err)
+	}
+	fmt.Println("migrations applied to", cfg.DBPath)
+}
+
+func runCreateAdmin(args []string) { // Creates an admin user or promotes an existing one
+	fs := flag.NewFlagSet("create-admin", flag.ExitOnError)
+	email := fs.String("email", "", "admin email (required)")
+	password := fs.String("password", "", "password (required for a new user; resets it for an existing one)")
+	fs.Parse(args)
+	if *email == "" {
+		fs.Usage()
+		log.Fatal("-email is required")
+	}
+
+	cfg := loadConfig(false)                             // Load configuration
+	if err := database.Connect(cfg.DBPath); err != nil { // Open and migrate so the role column exists
+		log.Fatal("DB connection error: ", err)
+	}
+
+	var user models.User
+	err := database.DB.Where("email = ?", *email).First(&user).Error // Look up existing user
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound): // New admin
+		if *password == "" {
+			log.Fatal("-password is required when creating a new user")
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost) // Hash password
+		if err != nil {
+			log.Fatal(err)
+		}
+		user = models.User{Email: *email, Password: string(hash), Role: models.RoleAdmin, OrganizationID: database.DefaultOrgID}
+		if err := database.DB.Create(&user).Error; err != nil {
+			log.Fatal("could not create user: ", err)
+		}
+		fmt.Printf("created admin %s (id %d)\n", user.Email, user.ID)
+	case err != nil:
+		log.Fatal("user lookup failed: ", err)
+	default: // Promote existing user
+		updates := map[string]interface{}{"role": models.RoleAdmin}
+		if *password != "" { // Optionally reset the password too
+			hash, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+			if err != nil {
+				log.Fatal(err)
+			}
+			updates["password"] = string(hash)
+		}
+		if err := database.DB.Model(&user).Updates(updates).Error; err != nil {
+			log.Fatal("could not promote user: ", err)
+		}
+		fmt.Printf("promoted %s (id %d) to admin\n", user.Email, user.ID)
+	}
+}
+
+// bootstrapAdmin gives a new deployment its first admin at startup (CREATE_ADMIN). Once
+// any admin exists it does nothing; otherwise the user with email is promoted, or created
+// with password and made to change it at first login. Replicas starting together are
+// safe: emails are unique.
+func bootstrapAdmin(email, password string) error {
+	var admins int64
+	if err := database.DB.Model(&models.User{}).Where("role = ?", models.RoleAdmin).Count(&admins).Error; err != nil {
+		return err
+	}
+	if admins > 0 {
+		return nil
+	}
+	var user models.User
+	if err := database.DB.Where("email = ?", email).Limit(1).Find(&user).Error; err != nil {
+		return err
+	}
+	if user.ID != 0 { // Promote, keeping their own password
+		if err := database.DB.Model(&user).Update("role", models.RoleAdmin).Error; err != nil {
+			return err
+		}
+		log.Printf("admin bootstrap: promoted %s (id %d) to admin", user.Email, user.ID)
+		return nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user = models.User{Email: email, Password: string(hash), Role: models.RoleAdmin, OrganizationID: database.DefaultOrgID, MustChangePassword: true}
+	if err := database.DB.Create(&user).Error; err != nil {
+		if database.DB.Where("email = ? AND role = ?", email, models.RoleAdmin).Limit(1).Find(&user); user.ID != 0 {
+			return nil // Created by another replica
+		}
+		return err
+	}
+	log.Printf("admin bootstrap: created admin %s (id %d); the password must be changed at first login", user.Email, user.ID)
+	return nil
+}
+
+func runGenToken(args []string) { // Mints a JWT for an existing user
+	fs := flag.NewFlagSet("gen-token", flag.ExitOnError)
+	email := fs.String("email", "", "email of the user the token is issued for (required)")
+	ttl := fs.Duration("ttl", 365*24*time.Hour, "token lifetime")
+	fs.Parse(args)
+	if *email == "" {
+		fs.Usage()
+		log.Fatal("-email is required")
+	}
+
+	cfg := loadConfig(false)                          // Load configuration (JWT secret)
+	if err := database.Open(cfg.DBPath); err != nil { // Open the database
+		log.Fatal("DB connection error: ", err)
+	}
+	var user models.User
+	if err := database.DB.Where("email = ?", *email).First(&user).Error; err != nil { // Token subject must exist
+		log.Fatal("user lookup failed: ", err)
+	}
+	token, err := handlers.GenerateToken(context.Background(), user, cfg.JWTSecret, *ttl) // Sign token
+	if err != nil {
+		log.Fatal("could not create token: ", err)
+	}
+	fmt.Println(token) // Print only the token so it can be piped
+}
+
+func runLoadgen(args []string) { // Drives synthetic traffic against a (staging) instance and reports throughput and latency
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	target := fs.String("url", "", "base URL of the instance under test (required)")
+	token := fs.String("token", os.Getenv("LOADGEN_TOKEN"), "admin JWT for the target (default $LOADGEN_TOKEN)")
+	duration := fs.Duration("duration", 30*time.Second, "how long to generate load")
+	concurrency := fs.Int("concurrency", 16, "requests in flight per stream at most")
+	enqueueRate := fs.Float64("enqueue-rate", 20, "dry-run motor requests per second (0: none)")
+	minutes := fs.Int("minutes", 1, "duration of each requested run in minutes")
+	telemetryRate := fs.Float64("telemetry-rate", 100, "sensor readings per second over MQTT (0: none)")
+	topic := fs.String("telemetry-topic", "", "topic readings are published to (default TELEMETRY_TOPIC_PREFIX + \"loadgen\")")
+	fs.Parse(args)
+	if *target == "" || *token == "" {
+		fs.Usage()
+		log.Fatal("-url and -token are required")
+	}
+
+	cfg := loadConfig(false) // Broker address and credentials, telemetry prefix
+	if *topic == "" {
+		*topic = cfg.TelemetryTopicPrefix + "loadgen"
+	}
+	if *telemetryRate > 0 {
+		if err := mqtt.Connect(cfg.MQTTBroker, mqttCredentials); err != nil {
+			log.Fatal("MQTT connection error: ", err)
+		}
+		defer mqtt.Disconnect()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := loadgen.Run(ctx, loadgen.Config{
+		BaseURL: *target, Token: *token, Duration: *duration, Concurrency: *concurrency,
+		EnqueueRate: *enqueueRate, RunMinutes: *minutes,
+		TelemetryRate: *telemetryRate, TelemetryTopic: *topic, Publish: mqtt.Publish,
+	})
+	if err != nil {
+		log.Fatal("load run failed: ", err)
+	}
+	report.Print(os.Stdout)
+}
@@ -3,23 +3,493 @@
 package config // Declares the package name
 
 import ( // Import required packages
+	"errors"   // For checking missing files
+	"fmt"      // For error formatting
+	"io/fs"    // fs.ErrNotExist
+	"log/slog" // Structured logging levels
+	"net"      // For validating proxy addresses
+	"os"       // For reading environment variables
+	"strconv"  // For parsing numeric env vars
+	"strings"  // For normalising string values
+	"time"     // For durations
 
-	"os" // For reading environment variables
-	// For loading .env files
+	"github.com/joho/godotenv" // For loading .env files
+)
+
+const ( // Insecure defaults that production mode refuses to start with
+	DefaultJWTSecret     = "supersecret"
+	DefaultAdminPassword = "admin123"
 )
 
 type Config struct { // Config struct holds all configuration values
-	DBPath     string // Path to the SQLite database file
-	MQTTBroker string // Address of the MQTT broker
-	JWTSecret  string // Secret key for JWT authentication
+	Env        string        // Deployment environment ("development" or "production")
+	DBPath     string        // Path to the SQLite database file
+	MQTTBroker string        // Address of the MQTT broker
+	JWTSecret  string        // Secret key for JWT authentication
+	JWTGrace   time.Duration // How long tokens signed with a rotated-out secret stay valid
+
+	AdminEmail        string // Email of the bootstrap admin
+	AdminPassword     string // Password of the bootstrap admin
+	CreateAdmin       bool   // Whether to create the bootstrap admin at startup
+	AllowRegistration bool   // Whether POST /register is open to anyone
+	AppURL            string // Public URL of the web app, used for links in emails (optional)
+
+	// HTTP server
+	HTTPAddr          string        // Listen address, e.g. ":8080"
+	ReadTimeout       time.Duration // Max time to read a full request
+	ReadHeaderTimeout time.Duration // Max time to read request headers
+	WriteTimeout      time.Duration // Max time to write a response
+	IdleTimeout       time.Duration // Max keep-alive idle time
+	MaxBodyBytes      int64         // Max request body size
+	GzipMinBytes      int           // Smallest response that is gzipped (0: no compression)
+	TrustedProxies    []string      // Reverse proxy IPs/CIDRs allowed to set client IP headers
+	ClientIPHeaders   []string      // Headers carrying the client IP, checked in order
+	ShutdownTimeout   time.Duration // Max time to wait for in-flight work on SIGINT/SIGTERM
+
+	// Per-route-group request timeouts (0 disables)
+	StatusTimeout  time.Duration // Quick status reads
+	RequestTimeout time.Duration // Regular API calls
+	AdminTimeout   time.Duration // Admin operations
+
+	// HTTPS (either a cert/key pair or an ACME domain; neither means plain HTTP)
+	TLSCertFile  string // Path to PEM certificate
+	TLSKeyFile   string // Path to PEM private key
+	ACMEDomain   string // Domain to obtain Let's Encrypt certificates for
+	ACMEEmail    string // Contact email for the ACME account
+	ACMECacheDir string // Where ACME certificates are stored
+	ACMEHTTPAddr string // Listener for HTTP-01 challenges and HTTP->HTTPS redirects
+
+	// Shared state (queue, quota, shutdown, rate limits)
+	StateBackend         string        // "memory" or "redis"
+	QueueBackend         string        // Backend of the motor queue alone (empty: redis with Redis state, else database)
+	QueueCapacity        int           // Max queued motor requests
+	QueueMaxDrain        time.Duration // Projected queue drain time above which per-user enqueue limits apply (0: never)
+	QueueUserLimit       int           // Requests per user per hour at QueueMaxDrain; fewer beyond it
+	MotorAckWait         time.Duration // How long the motor has to confirm ON/OFF on motor/status (0: it doesn't confirm)
+	MaxRuntime           time.Duration // Longest a motor may run continuously before it is forced OFF (0: no limit)
+	OffRetry             time.Duration // How often OFF is resent until the motor confirms it
+	OffTimeout           time.Duration // How long OFF is resent before the motor is faulted and admins alerted
+	RestartApproval      time.Duration // How long a second admin has to confirm a restart (0: one admin restarts)
+	SimulateMotor        bool          // Dry-run mode: motor commands go to the simulator, never to MQTT
+	CorrectiveOff        bool          // Send OFF after an unconfirmed ON
+	CommandSequence      bool          // Motor commands carry sequence numbers and timestamps for replay protection
+	HeartbeatTimeout     time.Duration // Silence from the shared motor's device mid-run that counts as a power outage (0: devices don't send heartbeats)
+	OutagePolicy         string        // "cancel" or "resume" a run whose device lost power
+	ResumeWindow         time.Duration // How long a run waits for its device to come back before it is cancelled after all
+	CrashRecovery        string        // "stop" or "resume" a run the process died in the middle of
+	ChaosMode            bool          // Failure injection for resilience tests; refused in production
+	ChaosPublishFailRate float64       // Share of MQTT publishes that fail in chaos mode (0-1)
+	ChaosAckDelayRate    float64       // Share of motor status reports handled late in chaos mode (0-1)
+	ChaosAckDelay        time.Duration // How late
+	ChaosDBErrorRate     float64       // Share of database calls that fail in chaos mode (0-1)
+	MotorMaxTempC        float64       // Shared motor temperature that trips a FAULT (0: no limit; devices have their own)
+	MotorMaxCurrentA     float64       // Shared motor current draw that trips a FAULT (0: no limit)
+	AnomalyUsageFactor   float64       // A user running this many times their daily average in a day is an anomaly (0: off)
+	AnomalyAckTimeouts   int           // Unconfirmed commands to one motor within an hour that are an anomaly (0: off)
+	AnomalyIdleCurrentA  float64       // Current drawn by a motor that is off with no session that is an anomaly (0: off)
+	RedisAddr            string        // Redis host:port
+	RedisPassword        string        // Redis password
+	RedisDB              int           // Redis database number
+	RedisPrefix          string        // Prefix for all Redis keys
+	AuthRateLimit        int           // Max /login and /register requests per IP per minute (0 disables)
+	UserCacheTTL         time.Duration // How long auth middleware trusts a cached role and organization (0 disables)
+	RealtimeBuffer       int           // Live updates a WebSocket client can fall behind by before it is dropped
+
+	// Leader election (only the leader runs the motor queue)
+	InstanceID  string        // This replica's ID
+	LeaderLease time.Duration // Lease TTL; a dead leader is replaced within this time
+
+	ErrorWebhookURL string // Where handler panics are reported (optional)
+
+	// Email notifications (disabled while SMTPHost is empty)
+	SMTPHost     string // SMTP server host
+	SMTPPort     int    // 587 (STARTTLS), 465 (implicit TLS) or 25
+	SMTPUsername string // SMTP login
+	SMTPPassword string // SMTP password
+	SMTPFrom     string // Sender address
+
+	// SMS notifications (disabled while SMSProvider is empty)
+	SMSProvider      string // "twilio"
+	TwilioAccountSID string // Twilio account SID
+	TwilioAuthToken  string // Twilio auth token
+	TwilioFrom       string // Sending number (E.164) or messaging service SID (MG...)
+
+	// WhatsApp Business Cloud API (disabled while WhatsAppToken is empty)
+	WhatsAppToken            string // System user access token
+	WhatsAppPhoneNumberID    string // Sending phone number ID
+	WhatsAppTemplate         string // Approved message template with one body parameter (empty sends plain text)
+	WhatsAppTemplateLanguage string // Template language code
+
+	// Telegram bot (disabled while TelegramBotToken is empty)
+	TelegramBotToken    string // Token from @BotFather
+	TelegramBotUsername string // Bot username, used for t.me link URLs (optional)
+
+	// Push notifications (disabled while FCMCredentialsFile is empty)
+	FCMCredentialsFile string   // Firebase service account JSON key file
+	PushEvents         []string // Events that are pushed (empty means all)
+
+	// Site and weather (rain skips are disabled while OpenWeatherAPIKey is empty)
+	SiteLocation      string        // "latitude,longitude" of the pump, e.g. "31.5204,74.3587"
+	OpenWeatherAPIKey string        // OpenWeatherMap API key
+	WeatherLookahead  time.Duration // How far past a run's start the forecast is checked for rain
+
+	// Control restrictions (off while both are unset; admins are never restricted)
+	ControlNetworks []string // IPs/CIDRs motor control is allowed from
+	ControlGeofence float64  // Meters from SiteLocation within which clients reporting their location may control motors (0: none)
+
+	// Billing (disabled while StripeSecretKey is empty)
+	StripeSecretKey     string        // Stripe API secret key
+	StripeWebhookSecret string        // Signing secret of the Stripe webhook endpoint
+	StripePriceStandard string        // Recurring Stripe price of the standard plan
+	StripePricePro      string        // Recurring Stripe price of the pro plan
+	BillingGracePeriod  time.Duration // How long a past-due subscription keeps its plan before dropping to free
+
+	TelemetryTopicPrefix   string        // Sensors publish readings under this MQTT topic prefix, e.g. "sensors/soil_moisture"
+	TelemetryBatchSize     int           // Readings written to the database at once
+	TelemetryFlushInterval time.Duration // Longest a reading waits in memory before it is written
+	TelemetryRetentionDays int           // How long readings are kept (0: forever)
+
+	QuotaWarnPercents []int         // Usage levels (percent of the daily quota) that trigger a quota warning
+	BrokerAlertAfter  time.Duration // Broker outage length that triggers an admin alert
+
+	// Background jobs
+	BackupDir      string // Directory for daily DB backups (empty disables backups)
+	BackupSchedule string // Cron spec for backups
+	BackupKeep     int    // Number of backups to keep
+	JobHistoryDays int    // How long job run history is kept
+	DigestSchedule string // Cron spec for the daily/weekly digest run
+
+	MQTTUsername       string // Broker username (optional)
+	MQTTPassword       string // Broker password (optional)
+	MQTTPublishWorkers int    // Goroutines publishing non-motor messages in the background
+	MQTTPublishQueue   int    // Messages each of them can have waiting
+
+	// Secrets backend (values fetched from it override the env vars above)
+	SecretsBackend  string        // "vault", "aws" or empty to disable
+	VaultAddr       string        // Vault server address
+	VaultToken      string        // Vault token
+	VaultSecretPath string        // Vault KV v2 path
+	AWSSecretID     string        // AWS Secrets Manager secret name or ARN
+	SecretsRefresh  time.Duration // How often secrets are re-fetched
+
+	// Reloadable settings (re-read on SIGHUP without restarting)
+	MotorQuota time.Duration // Max motor-on time allowed per 24h
+	UserQuota  time.Duration // Motor-on time each user may use per 24h unless their org admin set them a limit (0: none)
+	MaxRequest time.Duration // Longest run one request may ask for (0: no limit but the quota)
+	LogLevel   string        // Minimum log level (debug, info, warn, error)
 }
 
 func Load() *Config { // Load reads config from environment variables or uses defaults
 	return &Config{
-		DBPath:     getEnv("DB_PATH", "data.db"),                  // Get DB path or use default
-		MQTTBroker: getEnv("MQTT_BROKER", "tcp://localhost:1883"), // Get MQTT broker or use default
-		JWTSecret:  getEnv("JWT_SECRET", "supersecret"),           // Get JWT secret or use default
+		Env:                      getEnv("ENV", "development"),                                                  // Deployment environment
+		DBPath:                   getEnv("DB_PATH", "data.db"),                                                  // Get DB path or use default
+		MQTTBroker:               getEnv("MQTT_BROKER", "tcp://localhost:1883"),                                 // Get MQTT broker or use default
+		JWTSecret:                getEnv("JWT_SECRET", DefaultJWTSecret),                                        // Get JWT secret or use default
+		JWTGrace:                 time.Duration(getEnvInt("JWT_ROTATION_GRACE_HOURS", 72)) * time.Hour,          // As long as a login token lasts, so nobody is logged out
+		AdminEmail:               getEnv("ADMIN_EMAIL", "admin@example.com"),                                    // Bootstrap admin email
+		AdminPassword:            getEnv("ADMIN_PASSWORD", DefaultAdminPassword),                                // Bootstrap admin password
+		CreateAdmin:              getEnvBool("CREATE_ADMIN", false),                                             // Bootstrap admin disabled by default
+		AllowRegistration:        getEnvBool("ALLOW_REGISTRATION", true),                                        // Open registration by default
+		AppURL:                   strings.TrimSuffix(getEnv("APP_URL", ""), "/"),                                // Links in emails are relative when unset
+		HTTPAddr:                 getEnv("HTTP_ADDR", ":8080"),                                                  // Listen address
+		ReadTimeout:              time.Duration(getEnvInt("HTTP_READ_TIMEOUT_SECONDS", 15)) * time.Second,       // Read timeout
+		ReadHeaderTimeout:        time.Duration(getEnvInt("HTTP_READ_HEADER_TIMEOUT_SECONDS", 5)) * time.Second, // Header timeout
+		WriteTimeout:             time.Duration(getEnvInt("HTTP_WRITE_TIMEOUT_SECONDS", 30)) * time.Second,      // Write timeout
+		IdleTimeout:              time.Duration(getEnvInt("HTTP_IDLE_TIMEOUT_SECONDS", 60)) * time.Second,       // Idle timeout
+		MaxBodyBytes:             int64(getEnvInt("HTTP_MAX_BODY_BYTES", 1<<20)),                                // 1 MiB by default
+		GzipMinBytes:             getEnvInt("HTTP_GZIP_MIN_BYTES", 1024),                                        // Smaller responses aren't worth compressing
+		TrustedProxies:           getEnvList("TRUSTED_PROXIES", nil),                                            // Trust no proxy by default
+		ClientIPHeaders:          getEnvList("CLIENT_IP_HEADERS", []string{"X-Forwarded-For", "X-Real-IP"}),     // Standard proxy headers
+		ShutdownTimeout:          time.Duration(getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 15)) * time.Second,        // Graceful shutdown deadline
+		StatusTimeout:            time.Duration(getEnvInt("STATUS_TIMEOUT_SECONDS", 5)) * time.Second,           // Status reads
+		RequestTimeout:           time.Duration(getEnvInt("REQUEST_TIMEOUT_SECONDS", 15)) * time.Second,         // API calls
+		AdminTimeout:             time.Duration(getEnvInt("ADMIN_TIMEOUT_SECONDS", 30)) * time.Second,           // Admin operations
+		TLSCertFile:              getEnv("TLS_CERT_FILE", ""),                                                   // Certificate path
+		TLSKeyFile:               getEnv("TLS_KEY_FILE", ""),                                                    // Key path
+		ACMEDomain:               getEnv("ACME_DOMAIN", ""),                                                     // ACME disabled by default
+		ACMEEmail:                getEnv("ACME_EMAIL", ""),                                                      // ACME contact
+		ACMECacheDir:             getEnv("ACME_CACHE_DIR", "autocert-cache"),                                    // Certificate cache
+		ACMEHTTPAddr:             getEnv("ACME_HTTP_ADDR", ":80"),                                               // Challenge/redirect listener
+		StateBackend:             getEnv("STATE_BACKEND", "memory"),                                             // In-process state by default
+		QueueBackend:             getEnv("QUEUE_BACKEND", ""),                                                   // Chosen from the state backend
+		QueueCapacity:            getEnvInt("QUEUE_CAPACITY", 100),                                              // Queue size
+		QueueMaxDrain:            time.Duration(getEnvInt("QUEUE_MAX_DRAIN_MINUTES", 240)) * time.Minute,        // Limits once the backlog is 4 hours of runs
+		QueueUserLimit:           getEnvInt("QUEUE_USER_LIMIT", 4),                                              // Requests per user per hour at that point
+		MotorAckWait:             time.Duration(getEnvInt("MOTOR_ACK_TIMEOUT_SECONDS", 0)) * time.Second,        // Devices don't confirm by default
+		MaxRuntime:               time.Duration(getEnvLimit("MOTOR_MAX_RUNTIME_MINUTES", 30)) * time.Minute,     // Protects pumps from running dry
+		OffRetry:                 time.Duration(getEnvInt("MOTOR_OFF_RETRY_SECONDS", 5)) * time.Second,          // Resend OFF every 5 seconds
+		OffTimeout:               time.Duration(getEnvInt("MOTOR_OFF_TIMEOUT_SECONDS", 60)) * time.Second,       // Alert after a minute
+		RestartApproval:          time.Duration(getEnvInt("RESTART_APPROVAL_WINDOW_MINUTES", 0)) * time.Minute,  // Two-person restart off by default
+		SimulateMotor:            getEnvBool("MOTOR_SIMULATE", false),                                           // Real motor commands by default
+		CorrectiveOff:            getEnvBool("MOTOR_CORRECTIVE_OFF", true),                                      // A failed ON is followed by OFF
+		CommandSequence:          getEnvBool("MOTOR_COMMAND_SEQUENCE", false),                                   // Plain "on"/"off" for existing firmware
+		HeartbeatTimeout:         time.Duration(getEnvInt("MOTOR_HEARTBEAT_TIMEOUT_SECONDS", 0)) * time.Second,  // Boot announcements only by default
+		OutagePolicy:             getEnv("MOTOR_OUTAGE_POLICY", "cancel"),                                       // Refund rather than surprise anyone
+		ResumeWindow:             time.Duration(getEnvInt("MOTOR_OUTAGE_RESUME_MINUTES", 10)) * time.Minute,     // Give up on resuming after 10 minutes
+		CrashRecovery:            getEnv("MOTOR_CRASH_RECOVERY", "stop"),                                        // Never leave a motor running unmanaged
+		ChaosMode:                getEnvBool("CHAOS_MODE", false),                                               // Off outside resilience tests
+		ChaosPublishFailRate:     getEnvFloat("CHAOS_PUBLISH_FAIL_RATE", 0),                                     // No injected publish failures by default
+		ChaosAckDelayRate:        getEnvFloat("CHAOS_ACK_DELAY_RATE", 0),                                        // No delayed acks by default
+		ChaosAckDelay:            time.Duration(getEnvInt("CHAOS_ACK_DELAY_SECONDS", 10)) * time.Second,         // Longer than a typical ack timeout
+		ChaosDBErrorRate:         getEnvFloat("CHAOS_DB_ERROR_RATE", 0),                                         // No injected database errors by default
+		MotorMaxTempC:            getEnvFloat("MOTOR_MAX_TEMP_C", 0),                                            // No temperature limit by default
+		MotorMaxCurrentA:         getEnvFloat("MOTOR_MAX_CURRENT_A", 0),                                         // No current limit by default
+		AnomalyUsageFactor:       getEnvFloat("ANOMALY_USAGE_FACTOR", 5),                                        // Five times the usual
+		AnomalyAckTimeouts:       getEnvLimit("ANOMALY_ACK_TIMEOUTS", 3),                                        // Three in an hour
+		AnomalyIdleCurrentA:      getEnvFloat("ANOMALY_IDLE_CURRENT_A", 0.5),                                    // More than sensor noise
+		RedisAddr:                getEnv("REDIS_ADDR", "localhost:6379"),                                        // Redis address
+		RedisPassword:            getEnv("REDIS_PASSWORD", ""),                                                  // Redis password
+		RedisDB:                  getEnvInt("REDIS_DB", 0),                                                      // Redis DB
+		RedisPrefix:              getEnv("REDIS_PREFIX", "go-mqtt-backend:"),                                    // Redis key prefix
+		AuthRateLimit:            getEnvInt("AUTH_RATE_LIMIT", 10),                                              // Auth requests per minute
+		UserCacheTTL:             time.Duration(getEnvInt("USER_CACHE_TTL_SECONDS", 30)) * time.Second,          // Other replicas see role changes within 30 seconds
+		RealtimeBuffer:           getEnvInt("REALTIME_BUFFER", 64),                                              // Live updates buffered per client
+		InstanceID:               getEnv("INSTANCE_ID", defaultInstanceID()),                                    // Hostname and PID
+		LeaderLease:              time.Duration(getEnvInt("LEADER_LEASE_SECONDS", 15)) * time.Second,            // Lease TTL
+		ErrorWebhookURL:          getEnv("ERROR_WEBHOOK_URL", ""),                                               // Error tracker disabled by default
+		SMTPHost:                 getEnv("SMTP_HOST", ""),                                                       // Email disabled by default
+		SMTPPort:                 getEnvInt("SMTP_PORT", 587),                                                   // STARTTLS submission port
+		SMTPUsername:             getEnv("SMTP_USERNAME", ""),                                                   // SMTP login
+		SMTPPassword:             getEnv("SMTP_PASSWORD", ""),                                                   // SMTP password
+		SMTPFrom:                 getEnv("SMTP_FROM", "go-mqtt-backend@localhost"),                              // Sender address
+		SMSProvider:              getEnv("SMS_PROVIDER", ""),                                                    // SMS disabled by default
+		TwilioAccountSID:         getEnv("TWILIO_ACCOUNT_SID", ""),                                              // Twilio account
+		TwilioAuthToken:          getEnv("TWILIO_AUTH_TOKEN", ""),                                               // Twilio auth token
+		TwilioFrom:               getEnv("TWILIO_FROM", ""),                                                     // Twilio sender
+		WhatsAppToken:            getEnv("WHATSAPP_TOKEN", ""),                                                  // WhatsApp disabled by default
+		WhatsAppPhoneNumberID:    getEnv("WHATSAPP_PHONE_NUMBER_ID", ""),                                        // Sending number
+		WhatsAppTemplate:         getEnv("WHATSAPP_TEMPLATE", ""),                                               // Plain text by default
+		WhatsAppTemplateLanguage: getEnv("WHATSAPP_TEMPLATE_LANGUAGE", "en"),                                    // Template language
+		TelegramBotToken:         getEnv("TELEGRAM_BOT_TOKEN", ""),                                              // Telegram disabled by default
+		TelegramBotUsername:      getEnv("TELEGRAM_BOT_USERNAME", ""),                                           // For deep links
+		FCMCredentialsFile:       getEnv("FCM_CREDENTIALS_FILE", ""),                                            // Push disabled by default
+		PushEvents:               getEnvList("PUSH_EVENTS", nil),                                                // Every event
+		SiteLocation:             getEnv("SITE_LOCATION", ""),                                                   // No site location by default
+		OpenWeatherAPIKey:        getEnv("OPENWEATHER_API_KEY", ""),                                             // Weather disabled by default
+		WeatherLookahead:         time.Duration(getEnvInt("WEATHER_LOOKAHEAD_HOURS", 12)) * time.Hour,           // Rain in the next 12 hours
+		ControlNetworks:          getEnvList("CONTROL_ALLOWED_NETWORKS", nil),                                   // Control from anywhere by default
+		ControlGeofence:          getEnvFloat("CONTROL_GEOFENCE_METERS", 0),                                     // No geofence by default
+		StripeSecretKey:          getEnv("STRIPE_SECRET_KEY", ""),                                               // Billing disabled by default
+		StripeWebhookSecret:      getEnv("STRIPE_WEBHOOK_SECRET", ""),                                           // Webhook signing secret
+		StripePriceStandard:      getEnv("STRIPE_PRICE_STANDARD", ""),                                           // Standard plan price ID
+		StripePricePro:           getEnv("STRIPE_PRICE_PRO", ""),                                                // Pro plan price ID
+		BillingGracePeriod:       time.Duration(getEnvInt("BILLING_GRACE_DAYS", 7)) * 24 * time.Hour,            // A week to fix a failed payment
+		TelemetryTopicPrefix:     getEnv("TELEMETRY_TOPIC_PREFIX", "sensors/"),                                  // Sensor readings for rules
+		TelemetryBatchSize:       getEnvInt("TELEMETRY_BATCH_SIZE", 500),                                        // One INSERT per 500 readings
+		TelemetryFlushInterval:   time.Duration(getEnvInt("TELEMETRY_FLUSH_SECONDS", 2)) * time.Second,          // Readings are stored within 2 seconds
+		TelemetryRetentionDays:   getEnvInt("TELEMETRY_RETENTION_DAYS", 90),                                     // Keep a season of readings
+		BackupDir:                getEnv("BACKUP_DIR", ""),                                                      // Backups disabled by default
+		BackupSchedule:           getEnv("BACKUP_SCHEDULE", "0 3 * * *"),                                        // 03:00 every day
+		BackupKeep:               getEnvInt("BACKUP_KEEP", 7),                                                   // Keep a week of backups
+		JobHistoryDays:           getEnvInt("JOB_HISTORY_DAYS", 30),                                             // Keep a month of job history
+		DigestSchedule:           getEnv("DIGEST_SCHEDULE", "0 7 * * *"),                                        // 07:00 every day (weekly digests on Mondays)
+		MQTTUsername:             getEnv("MQTT_USERNAME", ""),                                                   // Broker username
+		MQTTPassword:             getEnv("MQTT_PASSWORD", ""),                                                   // Broker password
+		MQTTPublishWorkers:       getEnvInt("MQTT_PUBLISH_WORKERS", 4),                                          // Publish workers
+		MQTTPublishQueue:         getEnvInt("MQTT_PUBLISH_QUEUE", 256),                                          // Queued messages per worker
+		SecretsBackend:           getEnv("SECRETS_BACKEND", ""),                                                 // Secrets backend (disabled by default)
+		VaultAddr:                getEnv("VAULT_ADDR", ""),                                                      // Vault address
+		VaultToken:               getEnv("VAULT_TOKEN", ""),                                                     // Vault token
+		VaultSecretPath:          getEnv("VAULT_SECRET_PATH", "secret/data/go-mqtt-backend"),                    // Vault secret path
+		AWSSecretID:              getEnv("AWS_SECRET_ID", ""),                                                   // AWS secret ID
+		SecretsRefresh:           time.Duration(getEnvInt("SECRETS_REFRESH_MINUTES", 15)) * time.Minute,         // Refresh every 15 minutes by default
+		MotorQuota:               time.Duration(getEnvInt("MOTOR_QUOTA_MINUTES", 60)) * time.Minute,             // Get daily quota or use default (1 hour)
+		UserQuota:                userQuota(),                                                                   // A share of the motor quota
+		MaxRequest:               maxRunDuration(),                                                              // MAX_RUN_SECONDS or MAX_REQUEST_MINUTES
+		LogLevel:                 getEnv("LOG_LEVEL", "info"),                                                   // Get log level or use default
+	}
+}
+
+// LoadEnvFile reads KEY=VALUE pairs from the file named by ENV_FILE (default ".env")
+// into the process environment. Real env vars take precedence. A missing file is not an
+// error.
+func LoadEnvFile() error {
+	err := godotenv.Load(getEnv("ENV_FILE", ".env")) // Only fill in unset values
+	if errors.Is(err, fs.ErrNotExist) {              // No env file is fine
+		return nil
+	}
+	return err
+}
+
+// ReloadEnvFile reads the env file again for a reload, replacing the values already in
+// the environment except those keep reports, such as keys the secrets backend set, which
+// the file must not overwrite. A missing file is not an error.
+func ReloadEnvFile(keep func(key string) bool) error {
+	values, err := godotenv.Read(getEnv("ENV_FILE", ".env"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		if keep(key) {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) IsProduction() bool { // Reports whether ENV=production
+	return strings.EqualFold(c.Env, "production")
+}
+
+// Validate checks for inconsistent settings and, in production mode, refuses insecure
+// defaults. Outside production the defaults are accepted so local development keeps working.
+func (c *Config) Validate() error {
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.ACMEDomain != "" && c.TLSCertFile != "" {
+		return fmt.Errorf("set either ACME_DOMAIN or TLS_CERT_FILE/TLS_KEY_FILE, not both")
+	}
+	for _, proxy := range c.TrustedProxies {
+		if !validProxy(proxy) {
+			return fmt.Errorf("TRUSTED_PROXIES: %q is not an IP address or CIDR", proxy)
+		}
+	}
+	if c.WhatsAppToken != "" && c.WhatsAppPhoneNumberID == "" {
+		return fmt.Errorf("WHATSAPP_PHONE_NUMBER_ID is required with WHATSAPP_TOKEN")
+	}
+	if c.StripeSecretKey != "" && c.StripeWebhookSecret == "" {
+		return fmt.Errorf("STRIPE_WEBHOOK_SECRET is required with STRIPE_SECRET_KEY")
+	}
+	if c.StripeSecretKey != "" && c.StripePriceStandard == "" && c.StripePricePro == "" {
+		return fmt.Errorf("STRIPE_PRICE_STANDARD or STRIPE_PRICE_PRO is required with STRIPE_SECRET_KEY")
+	}
+	if _, _, ok, err := c.SiteCoordinates(); err != nil {
+		return err
+	} else if c.OpenWeatherAPIKey != "" && !ok {
+		return fmt.Errorf("SITE_LOCATION is required with OPENWEATHER_API_KEY")
+	}
+	for _, network := range c.ControlNetworks {
+		if !validProxy(network) {
+			return fmt.Errorf("CONTROL_ALLOWED_NETWORKS: %q is not an IP address or CIDR", network)
+		}
+	}
+	if _, _, ok, _ := c.SiteCoordinates(); c.ControlGeofence > 0 && !ok {
+		return fmt.Errorf("SITE_LOCATION is required with CONTROL_GEOFENCE_METERS")
+	}
+	if c.OutagePolicy != "" && c.OutagePolicy != "cancel" && c.OutagePolicy != "resume" {
+		return fmt.Errorf("MOTOR_OUTAGE_POLICY: %q is not cancel or resume", c.OutagePolicy)
+	}
+	if c.CrashRecovery != "" && c.CrashRecovery != "stop" && c.CrashRecovery != "resume" {
+		return fmt.Errorf("MOTOR_CRASH_RECOVERY: %q is not stop or resume", c.CrashRecovery)
+	}
+	for name, rate := range map[string]float64{"CHAOS_PUBLISH_FAIL_RATE": c.ChaosPublishFailRate, "CHAOS_ACK_DELAY_RATE": c.ChaosAckDelayRate, "CHAOS_DB_ERROR_RATE": c.ChaosDBErrorRate} {
+		if rate > 1 {
+			return fmt.Errorf("%s: %g is above 1", name, rate)
+		}
+	}
+	if c.MaxRequest < 0 {
+		return fmt.Errorf("MAX_RUN_SECONDS: %d is negative", int(c.MaxRequest.Seconds()))
+	}
+	if c.MaxRequest > 0 && c.MaxRequest < time.Minute { // Runs are asked for in whole minutes
+		return fmt.Errorf("MAX_RUN_SECONDS: %d is under a minute, the shortest run", int(c.MaxRequest.Seconds()))
+	}
+	for _, pct := range c.QuotaWarnPercents {
+		if pct > 100 {
+			return fmt.Errorf("QUOTA_WARN_PERCENT: %d is above 100", pct)
+		}
+	}
+	if !c.IsProduction() {
+		return nil
+	}
+	var problems []string
+	if c.JWTSecret == DefaultJWTSecret {
+		problems = append(problems, "JWT_SECRET is the default value")
 	}
+	if c.CreateAdmin && c.AdminPassword == DefaultAdminPassword {
+		problems = append(problems, "ADMIN_PASSWORD is the default value")
+	}
+	if !brokerUsesTLS(c.MQTTBroker) {
+		problems = append(problems, "MQTT_BROKER does not use TLS (use ssl://, tls://, mqtts:// or wss://)")
+	}
+	if c.AllowRegistration {
+		problems = append(problems, "ALLOW_REGISTRATION is enabled")
+	}
+	if c.ChaosMode {
+		problems = append(problems, "CHAOS_MODE is enabled")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("refusing to start in production mode: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// SiteCoordinates parses SiteLocation. ok is false when it isn't set.
+func (c *Config) SiteCoordinates() (lat, lon float64, ok bool, err error) {
+	if c.SiteLocation == "" {
+		return 0, 0, false, nil
+	}
+	lat, lon, ok = ParseCoordinates(c.SiteLocation)
+	if !ok {
+		return 0, 0, false, fmt.Errorf("SITE_LOCATION: %q is not \"latitude,longitude\"", c.SiteLocation)
+	}
+	return lat, lon, true, nil
+}
+
+// ParseCoordinates parses "latitude,longitude" in degrees, e.g. "31.5204,74.3587". ok is
+// false unless both are numbers in range.
+func ParseCoordinates(s string) (lat, lon float64, ok bool) {
+	latStr, lonStr, found := strings.Cut(s, ",")
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	lon, err2 := strconv.ParseFloat(strings.TrimSpace(lonStr), 64)
+	if !found || err1 != nil || err2 != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// ControlRestricted reports whether motor control is limited to ControlNetworks or the
+// geofence.
+func (c *Config) ControlRestricted() bool {
+	return len(c.ControlNetworks) > 0 || c.ControlGeofence > 0
+}
+
+func (c *Config) TLSEnabled() bool { // Reports whether the API is served over HTTPS
+	return c.ACMEDomain != "" || (c.TLSCertFile != "" && c.TLSKeyFile != "")
+}
+
+func brokerUsesTLS(broker string) bool { // Checks the broker URL scheme
+	scheme, _, _ := strings.Cut(strings.ToLower(broker), "://")
+	switch scheme {
+	case "ssl", "tls", "mqtts", "wss":
+		return true
+	}
+	return false
+}
+
+func validProxy(proxy string) bool { // Accepts a single IP or a CIDR range
+	if strings.Contains(proxy, "/") {
+		_, _, err := net.ParseCIDR(proxy)
+		return err == nil
+	}
+	return net.ParseIP(proxy) != nil
+}
+
+func ParseLogLevel(level string) slog.Level { // Converts a LOG_LEVEL string to a slog level
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo // Unknown values fall back to info
+	}
+}
+
+func defaultInstanceID() string { // Unique enough to tell replicas apart in logs and status
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
 }
 
 func getEnv(key, fallback string) string { // Helper to get env var or fallback
@@ -28,3 +498,76 @@ func getEnv(key, fallback string) string { // Helper to get env var or fallback
 	}
 	return fallback // Otherwise, use fallback value
 }
+
+func getEnvBool(key string, fallback bool) bool { // Helper to get boolean env var or fallback
+	if value := os.Getenv(key); value != "" { // If env var is set, try to parse it
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return fallback // Otherwise (or if invalid), use fallback value
+}
+
+func getEnvInt(key string, fallback int) int { // Helper to get integer env var or fallback
+	if value := os.Getenv(key); value != "" { // If env var is set, try to parse it
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+	}
+	return fallback // Otherwise (or if invalid), use fallback value
+}
+
+func userQuota() time.Duration { // USER_QUOTA_MINUTES (0 turns it off), or else a quarter of MOTOR_QUOTA_MINUTES
+	return time.Duration(getEnvLimit("USER_QUOTA_MINUTES", getEnvInt("MOTOR_QUOTA_MINUTES", 60)/4)) * time.Minute
+}
+
+func maxRunDuration() time.Duration { // MAX_RUN_SECONDS, or else MAX_REQUEST_MINUTES (0: no per-request limit)
+	return time.Duration(getEnvInt("MAX_RUN_SECONDS", 60*getEnvInt("MAX_REQUEST_MINUTES", 0))) * time.Second
+}
+
+func getEnvLimit(key string, fallback int) int { // Like getEnvInt, but 0 is valid and turns the limit off
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return fallback
+}
+
+func getEnvFloat(key string, fallback float64) float64 { // Helper to get a non-negative number env var or fallback
+	if value := os.Getenv(key); value != "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil && f >= 0 {
+			return f
+		}
+	}
+	return fallback
+}
+
+func getEnvIntList(key string, fallback []int) []int { // Helper to get comma-separated positive integers or fallback
+	var items []int
+	for _, item := range getEnvList(key, nil) {
+		n, err := strconv.Atoi(item)
+		if err != nil || n <= 0 {
+			return fallback // Invalid entry: use fallback value
+		}
+		items = append(items, n)
+	}
+	if items == nil {
+		return fallback
+	}
+	return items
+}
+
+func getEnvList(key string, fallback []string) []string { // Helper to get comma-separated env var or fallback
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" { // Ignore blanks and stray commas
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,175 @@
+// config_test.go - Tests for production-mode validation
+// Run with: go test ./...
+
+package config
+
+import (
+	"os"            // Env file
+	"path/filepath" // Env file path
+	"testing"       // Go's testing package
+	"time"          // Durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// secureConfig returns a production config that passes every check
+func secureConfig() *Config {
+	return &Config{
+		Env:        "production",
+		JWTSecret:  "a-long-random-secret",
+		MQTTBroker: "ssl://broker.example.com:8883",
+	}
+}
+
+// TestValidateProduction checks that each insecure default is refused in production
+func TestValidateProduction(t *testing.T) {
+	assert.NoError(t, secureConfig().Validate()) // Secure config starts
+
+	cfg := secureConfig()
+	cfg.JWTSecret = DefaultJWTSecret
+	assert.ErrorContains(t, cfg.Validate(), "JWT_SECRET")
+
+	cfg = secureConfig()
+	cfg.CreateAdmin = true
+	cfg.AdminPassword = DefaultAdminPassword
+	assert.ErrorContains(t, cfg.Validate(), "ADMIN_PASSWORD")
+
+	cfg = secureConfig()
+	cfg.MQTTBroker = "tcp://broker.example.com:1883"
+	assert.ErrorContains(t, cfg.Validate(), "MQTT_BROKER")
+
+	cfg = secureConfig()
+	cfg.AllowRegistration = true
+	assert.ErrorContains(t, cfg.Validate(), "ALLOW_REGISTRATION")
+
+	cfg = secureConfig()
+	cfg.ChaosMode = true
+	assert.ErrorContains(t, cfg.Validate(), "CHAOS_MODE")
+}
+
+// TestValidateDevelopment checks that defaults are accepted outside production
+func TestValidateDevelopment(t *testing.T) {
+	cfg := secureConfig()
+	cfg.Env = "development"
+	cfg.JWTSecret = DefaultJWTSecret
+	cfg.AllowRegistration = true
+	assert.NoError(t, cfg.Validate())
+}
+
+// TestValidateTLS checks that partial or conflicting TLS settings are refused in any mode
+func TestValidateTLS(t *testing.T) {
+	cfg := &Config{Env: "development", TLSCertFile: "cert.pem"}
+	assert.Error(t, cfg.Validate()) // Key missing
+
+	cfg.TLSKeyFile = "key.pem"
+	assert.NoError(t, cfg.Validate())
+	assert.True(t, cfg.TLSEnabled())
+
+	cfg.ACMEDomain = "farm.example.com"
+	assert.Error(t, cfg.Validate()) // Both configured
+}
+
+// TestTrustedProxies checks list parsing and that malformed proxy entries are refused
+func TestTrustedProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", " 10.0.0.0/8, ,127.0.0.1 ")
+	cfg := Load()
+	assert.Equal(t, []string{"10.0.0.0/8", "127.0.0.1"}, cfg.TrustedProxies)
+	assert.Equal(t, []string{"X-Forwarded-For", "X-Real-IP"}, cfg.ClientIPHeaders)
+	assert.NoError(t, cfg.Validate())
+
+	cfg.TrustedProxies = append(cfg.TrustedProxies, "nginx")
+	assert.ErrorContains(t, cfg.Validate(), "TRUSTED_PROXIES")
+}
+
+// TestSiteLocation checks coordinate parsing and that weather needs a location
+func TestSiteLocation(t *testing.T) {
+	cfg := &Config{SiteLocation: "31.5204, 74.3587"}
+	lat, lon, ok, err := cfg.SiteCoordinates()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 31.5204, lat)
+	assert.Equal(t, 74.3587, lon)
+
+	cfg.SiteLocation = "95,10" // Latitude out of range
+	assert.ErrorContains(t, cfg.Validate(), "SITE_LOCATION")
+	cfg.SiteLocation = ""
+	cfg.OpenWeatherAPIKey = "key"
+	assert.ErrorContains(t, cfg.Validate(), "SITE_LOCATION is required")
+}
+
+// TestControlRestrictions checks that control networks must be IPs or CIDRs and a
+// geofence needs the site's location
+func TestControlRestrictions(t *testing.T) {
+	cfg := &Config{}
+	assert.False(t, cfg.ControlRestricted())
+	cfg.ControlNetworks = []string{"203.0.113.0/24", "198.51.100.7"}
+	assert.True(t, cfg.ControlRestricted())
+	assert.NoError(t, cfg.Validate())
+	cfg.ControlNetworks = append(cfg.ControlNetworks, "farm wifi")
+	assert.ErrorContains(t, cfg.Validate(), "CONTROL_ALLOWED_NETWORKS")
+
+	cfg.ControlNetworks, cfg.ControlGeofence = nil, 500
+	assert.ErrorContains(t, cfg.Validate(), "SITE_LOCATION is required")
+	cfg.SiteLocation = "31.5204,74.3587"
+	assert.NoError(t, cfg.Validate())
+}
+
+// TestValidateOutagePolicy checks that only known power-outage and crash policies are accepted
+func TestValidateOutagePolicy(t *testing.T) {
+	cfg := Load()
+	assert.Equal(t, "cancel", cfg.OutagePolicy)
+	assert.Equal(t, "stop", cfg.CrashRecovery)
+	assert.NoError(t, cfg.Validate())
+	cfg.OutagePolicy = "retry"
+	assert.ErrorContains(t, cfg.Validate(), "MOTOR_OUTAGE_POLICY")
+	cfg.OutagePolicy, cfg.CrashRecovery = "resume", "ignore"
+	assert.ErrorContains(t, cfg.Validate(), "MOTOR_CRASH_RECOVERY")
+}
+
+// TestValidateChaosRates checks that failure rates are shares of at most 1
+func TestValidateChaosRates(t *testing.T) {
+	cfg := Load()
+	cfg.ChaosMode, cfg.ChaosPublishFailRate, cfg.ChaosDBErrorRate = true, 0.2, 1
+	assert.NoError(t, cfg.Validate())
+	cfg.ChaosDBErrorRate = 5
+	assert.ErrorContains(t, cfg.Validate(), "CHAOS_DB_ERROR_RATE")
+}
+
+// TestMaxRunSeconds checks that MAX_RUN_SECONDS sets the per-request limit in place of
+// MAX_REQUEST_MINUTES and can't be shorter than the shortest run
+func TestMaxRunSeconds(t *testing.T) {
+	t.Setenv("MAX_REQUEST_MINUTES", "20")
+	assert.Equal(t, 20*time.Minute, Load().MaxRequest)
+	t.Setenv("MAX_RUN_SECONDS", "900")
+	cfg := Load()
+	assert.Equal(t, 15*time.Minute, cfg.MaxRequest)
+	assert.NoError(t, cfg.Validate())
+	cfg.MaxRequest = 30 * time.Second
+	assert.ErrorContains(t, cfg.Validate(), "MAX_RUN_SECONDS")
+}
+
+// TestReloadEnvFile checks that a reload replaces values already set, except the keys kept
+func TestReloadEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	require.NoError(t, os.WriteFile(path, []byte("LOG_LEVEL=debug\nJWT_SECRET=from-the-file\n"), 0o600))
+	t.Setenv("ENV_FILE", path)
+	t.Setenv("LOG_LEVEL", "info")
+	t.Setenv("JWT_SECRET", "from-vault")
+	require.NoError(t, ReloadEnvFile(func(key string) bool { return key == "JWT_SECRET" }))
+	assert.Equal(t, "debug", os.Getenv("LOG_LEVEL"))
+	assert.Equal(t, "from-vault", os.Getenv("JWT_SECRET"))
+	t.Setenv("ENV_FILE", filepath.Join(t.TempDir(), "missing"))
+	assert.NoError(t, ReloadEnvFile(func(string) bool { return false }))
+}
+
+// TestUserQuota checks that each user gets a share of the motor quota unless
+// USER_QUOTA_MINUTES sets another, and that 0 turns the per-user limit off
+func TestUserQuota(t *testing.T) {
+	t.Setenv("MOTOR_QUOTA_MINUTES", "120")
+	assert.Equal(t, 30*time.Minute, Load().UserQuota)
+	t.Setenv("USER_QUOTA_MINUTES", "45")
+	assert.Equal(t, 45*time.Minute, Load().UserQuota)
+	t.Setenv("USER_QUOTA_MINUTES", "0")
+	assert.Zero(t, Load().UserQuota)
+}
@@ -0,0 +1,44 @@
+// backup.go - Online SQLite backups
+
+package database // Declares the package name
+
+import ( // Import required packages
+	"context"       // For cancellation
+	"fmt"           // For file names
+	"os"            // For directory handling
+	"path/filepath" // For building paths
+	"sort"          // For finding the oldest backups
+	"strings"       // For filtering backup files
+	"time"          // For timestamps
+)
+
+// Backup writes a consistent copy of the database into dir using VACUUM INTO and
+// keeps only the newest keep copies.
+func Backup(ctx context.Context, dir string, keep int) error {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("backup-%s.db", time.Now().Format("20060102-150405")))
+	if err := DB.WithContext(ctx).Exec("VACUUM INTO ?", name).Error; err != nil { // Safe while the DB is in use
+		return err
+	}
+
+	entries, err := os.ReadDir(dir) // Rotate old backups
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "backup-") && strings.HasSuffix(e.Name(), ".db") {
+			backups = append(backups, e.Name())
+		}
+	}
+	sort.Strings(backups) // Timestamped names sort oldest first
+	for len(backups) > keep && keep > 0 {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -3,6 +3,7 @@
 package database // Declares the package name
 
 import ( // Import required packages
+	"context"                // For ping deadlines
 	"go-mqtt-backend/models" // User model
 
 	"gorm.io/driver/sqlite" // SQLite driver for GORM
@@ -11,11 +12,116 @@ import ( // Import required packages
 
 var DB *gorm.DB // Global variable to hold the database connection (pointer to gorm.DB)
 
+var DefaultOrgID uint // Organization new users join unless invited elsewhere (set by Migrate)
+
 func Connect(dbPath string) error { // Connect opens the database and runs migrations
-	var err error                                            // Declare error variable
-	DB, err = gorm.Open(sqlite.Open(dbPath), &gorm.Config{}) // Open SQLite DB
-	if err != nil {                                          // If error, return it
+	if err := Open(dbPath); err != nil { // Open the DB
+		return err
+	}
+	return Migrate() // Create/update tables
+}
+
+func Open(dbPath string) error { // Open opens the database without migrating
+	var err error                                                        // Declare error variable
+	DB, err = gorm.Open(sqlite.Open(dsn(dbPath, false)), &gorm.Config{}) // Open SQLite DB (WAL, see sqlite.go)
+	if err != nil {
+		return err
+	}
+	return usePools(DB, dbPath) // One writer, a pool of readers
+}
+
+func Migrate() error { // Migrate creates or updates tables for all models
+	err := DB.AutoMigrate( // Auto-migrate the models (create table if needed)
+		&models.User{},
+		&models.DeviceActivation{},
+		&models.MotorQueueItem{},
+		&models.ShutdownState{},
+		&models.QueuePause{},
+		&models.RunningSession{},
+		&models.Settings{},
+		&models.JobRun{},
+		&models.TelegramLink{},
+		&models.PushToken{},
+		&models.NotificationPrefs{},
+		&models.SessionLog{},
+		&models.RejectedRequest{},
+		&models.Schedule{},
+		&models.ScheduleRun{},
+		&models.ScheduledRequest{},
+		&models.Rule{},
+		&models.RuleRun{},
+		&models.MaintenanceWindow{},
+		&models.Organization{},
+		&models.Device{},
+		&models.Invitation{},
+		&models.UsageRecord{},
+		&models.Plan{},
+		&models.MotorFault{},
+		&models.AuditLog{},
+		&models.Anomaly{},
+		&models.TelemetryReading{},
+		&models.DailyTotal{},
+		&models.QuotaOverride{},
+		&models.SigningKey{},
+		&models.ControlOverride{},
+	)
+	if err != nil {
+		return err
+	}
+	if err := migrateDefaultOrganization(); err != nil {
+		return err
+	}
+	if err := migratePlans(); err != nil {
+		return err
+	}
+	return migrateDailyTotals()
+}
+
+// migratePlans creates the built-in plans and puts organizations from before plans
+// existed on pro, so upgrading doesn't take anything away from them.
+func migratePlans() error {
+	var pro models.Plan
+	for _, p := range models.DefaultPlans {
+		if err := DB.Where("name = ?", p.Name).Attrs(p).FirstOrCreate(&p).Error; err != nil {
+			return err
+		}
+		if p.Name == models.PlanPro {
+			pro = p
+		}
+	}
+	return DB.Model(&models.Organization{}).Where("plan_id = 0 OR plan_id IS NULL").Update("plan_id", pro.ID).Error
+}
+
+// migrateDefaultOrganization creates the default organization and moves users from before
+// multi-tenancy into it.
+func migrateDefaultOrganization() error {
+	org := models.Organization{Name: "Default", Slug: models.DefaultOrganizationSlug}
+	if err := DB.Where("slug = ?", org.Slug).FirstOrCreate(&org).Error; err != nil {
+		return err
+	}
+	DefaultOrgID = org.ID
+	return DB.Model(&models.User{}).Where("organization_id = 0 OR organization_id IS NULL").Update("organization_id", org.ID).Error
+}
+
+func Close() error { // Close closes the underlying database connections
+	if reader != nil {
+		reader.Close()
+		reader = nil
+	}
+	sqlDB, err := DB.DB() // Get the database/sql handle
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+func Ping(ctx context.Context) error { // Ping checks the database is reachable (used by /readyz)
+	if reader != nil { // Not stuck behind a long write
+		return reader.PingContext(ctx)
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
 		return err
 	}
-	return DB.AutoMigrate(&models.User{}, &models.DeviceActivation{}) // Auto-migrate the User model (create table if needed)
+	return sqlDB.PingContext(ctx)
 }
@@ -0,0 +1,84 @@
+// sqlite.go - SQLite journaling and connection pools for concurrent use
+//
+// The database runs in WAL mode, where readers don't block the writer or each other, but
+// SQLite still allows one writer at a time, and a second one gets SQLITE_BUSY. So every
+// write goes through a pool of a single connection: writers queue for it in Go instead of
+// racing for the file lock, and transactions start with BEGIN IMMEDIATE so they never have
+// to upgrade a read lock mid-way. Queries outside transactions use a separate read-only
+// pool. busy_timeout covers whatever still contends, e.g. another process with the file
+// open, such as a migrate run.
+
+package database // Declares the package name
+
+import ( // Import required packages
+	"database/sql" // Read pool
+	"strconv"      // DSN building
+	"strings"      // DSN building
+
+	"gorm.io/gorm" // GORM ORM
+)
+
+const (
+	busyTimeoutMS = 5000 // How long a connection waits for a lock before SQLITE_BUSY
+	readConns     = 4    // Connections in the read pool
+)
+
+var reader *sql.DB // Read-only pool for queries outside transactions (nil: everything uses the writer)
+
+func isMemory(dbPath string) bool { // In-memory databases exist per connection pool, so they can't be split
+	return dbPath == ":memory:" || strings.Contains(dbPath, "mode=memory")
+}
+
+// dsn adds the connection pragmas to dbPath: WAL and immediate transactions for the
+// writer, query_only for readers, and the busy timeout for both.
+func dsn(dbPath string, readOnly bool) string {
+	params := "_busy_timeout=" + strconv.Itoa(busyTimeoutMS)
+	if readOnly {
+		params += "&_query_only=1"
+	} else if !isMemory(dbPath) {
+		params += "&_journal_mode=WAL&_synchronous=NORMAL&_txlock=immediate"
+	}
+	if strings.Contains(dbPath, "?") {
+		return dbPath + "&" + params
+	}
+	return dbPath + "?" + params
+}
+
+// usePools limits the writer to one connection and, for file databases, opens the read
+// pool and routes queries outside transactions to it.
+func usePools(db *gorm.DB, dbPath string) error {
+	writer, err := db.DB()
+	if err != nil {
+		return err
+	}
+	writer.SetMaxOpenConns(1)
+	if isMemory(dbPath) {
+		return nil
+	}
+	if err := writer.Ping(); err != nil { // Switches the file to WAL before readers open it
+		return err
+	}
+	if reader != nil { // Reopened, e.g. in tests
+		reader.Close()
+	}
+	reader, err = sql.Open("sqlite3", dsn(dbPath, true))
+	if err != nil {
+		return err
+	}
+	reader.SetMaxOpenConns(readConns)
+	toReader := func(tx *gorm.DB) {
+		if _, inTx := tx.Statement.ConnPool.(gorm.TxCommitter); !inTx { // Reads in a transaction see its writes
+			tx.Statement.ConnPool = reader
+		}
+	}
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Query().Before("gorm:query").Register("database:reader", toReader),
+		cb.Row().Before("gorm:row").Register("database:reader", toReader),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// sqlite_test.go - Tests for WAL mode and the read/write pools
+// Run with: go test ./...
+
+package database
+
+import (
+	"context"                // For pings
+	"go-mqtt-backend/models" // Telemetry model
+	"path/filepath"          // Temp DB path
+	"sync"                   // Concurrent writers
+	"testing"                // Go's testing package
+	"time"                   // Reading times
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm" // Transactions
+)
+
+// TestConcurrentAccess checks that the file is in WAL mode and that concurrent writers,
+// transactions and readers all succeed instead of failing with SQLITE_BUSY
+func TestConcurrentAccess(t *testing.T) {
+	require.NoError(t, Connect(filepath.Join(t.TempDir(), "test.db")))
+	defer Close()
+	var mode string
+	require.NoError(t, DB.Raw("PRAGMA journal_mode").Scan(&mode).Error)
+	assert.Equal(t, "wal", mode)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 600)
+	for w := 0; w < 8; w++ {
+		wg.Add(2)
+		go func() { // Writer: single inserts and transactions
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				errs <- DB.Create(&models.TelemetryReading{Metric: "level", Value: float64(i), At: time.Now()}).Error
+				errs <- DB.Transaction(func(tx *gorm.DB) error {
+					var n int64
+					if err := tx.Model(&models.TelemetryReading{}).Count(&n).Error; err != nil {
+						return err
+					}
+					return tx.Create(&models.TelemetryReading{Metric: "count", Value: float64(n), At: time.Now()}).Error
+				})
+			}
+		}()
+		go func() { // Reader
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				var n int64
+				errs <- DB.Model(&models.TelemetryReading{}).Count(&n).Error
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	var n int64
+	require.NoError(t, DB.Model(&models.TelemetryReading{}).Count(&n).Error)
+	assert.Equal(t, int64(400), n)
+	assert.NoError(t, Ping(context.Background()))
+}
@@ -0,0 +1,296 @@
+// admin.go - Admin-only handlers: system status, emergency shutdown and stopping sessions
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"cmp"                       // Defaults
+	"context"                   // For background jobs
+	"errors"                    // For checking service errors
+	"fmt"                       // Audit details
+	"go-mqtt-backend/database"  // Database connection
+	"go-mqtt-backend/models"    // Motor faults
+	"go-mqtt-backend/mqtt"      // MQTT client
+	"go-mqtt-backend/scheduler" // Background jobs
+	"go-mqtt-backend/services"  // Motor service errors
+	"go-mqtt-backend/store"     // Shutdown state
+	"io"                        // Empty bodies
+	"log"                       // Logging
+	"log/slog"                  // Leveled logging
+	"net/http"                  // HTTP status codes
+	"time"                      // Maintenance window checks
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+var jobs *scheduler.Scheduler // Background job scheduler (set by UseScheduler)
+
+func UseScheduler(s *scheduler.Scheduler) { // Makes the scheduler visible to admin endpoints
+	jobs = s
+}
+
+func GetJobs(c *gin.Context) { // Handler listing background jobs with next run and recent history
+	if jobs == nil {
+		c.JSON(http.StatusOK, gin.H{"jobs": []scheduler.JobStatus{}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": jobs.Status(10)})
+}
+
+type ShutdownInput struct { // Struct for shutdown input
+	Category   string     `json:"category" binding:"required,oneof=maintenance safety weather electrical"` // Why, in a word
+	Notes      string     `json:"notes" binding:"max=255"`                                                 // Details (optional)
+	Reason     string     `json:"reason" binding:"max=255"`                                                // Older name of notes
+	TTLMinutes int        `json:"ttl_minutes" binding:"omitempty,min=1"`                                   // Restart automatically after this long
+	Until      *time.Time `json:"until"`                                                                   // Or at this time (RFC 3339)
+}
+
+func GetSystemStatus(c *gin.Context) { // Handler returning queue, quota, motor and shutdown state
+	st, err := motorService.Status(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read system state"})
+		return
+	}
+
+	status := gin.H{
+		"queue_length":   st.QueueLength,
+		"queue_capacity": st.QueueCapacity,
+		"backpressure": gin.H{ // Rates over the last hour and the per-user limit they lead to
+			"enqueued_per_hour":  st.Backpressure.EnqueueRate,
+			"processed_per_hour": st.Backpressure.ProcessRate,
+			"drain_minutes":      st.Backpressure.Drain.Minutes(),
+			"user_limit":         st.Backpressure.UserLimit,
+		},
+		"quota": gin.H{
+			"used_minutes":  st.Used.Minutes(),
+			"limit_minutes": st.Quota.Minutes(),
+			"resets_at":     st.ResetAt,
+		},
+		"motor": gin.H{"running": false, "state": st.Motor.State, "since": st.Motor.Since, "reason": st.Motor.Reason, "interlock": st.Interlock},
+		"device": gin.H{
+			"mqtt_connected": mqtt.IsConnected(),
+		},
+		"shutdown":   gin.H{"active": false},
+		"simulation": st.Simulating, // Dry-run mode: no motor command reaches MQTT
+	}
+	if devices := motorService.MotorStates(); len(devices) > 0 { // Every motor commanded or heard from, tenant devices included
+		status["motors"] = devices
+	}
+	if locks := motorService.Interlocks(c.Request.Context()); len(locks) > 0 { // Sessions holding a motor, on any replica
+		status["interlocks"] = locks
+	}
+	if tasks != nil { // Supervised background goroutines
+		status["tasks"] = tasks.Status()
+	}
+	if elector != nil { // Which replica drives the motor
+		if ls, err := elector.Status(c.Request.Context()); err == nil {
+			status["leader"] = ls
+		}
+	}
+	if run := st.Current; run != nil { // Include details of the running session
+		status["motor"] = gin.H{
+			"running":      true,
+			"user_id":      run.Request.UserID,
+			"started_at":   run.StartedAt,
+			"ends_at":      time.Now().Add(run.Left), // Later than started_at + duration after a power outage
+			"duration_min": run.Request.Duration.Minutes(),
+			"left_min":     run.Left.Minutes(),
+			"state":        st.Motor.State,
+			"since":        st.Motor.Since,
+			"reason":       st.Motor.Reason,
+			"interlock":    st.Interlock,
+			"simulated":    run.Request.Simulate,
+			"note":         run.Request.Note,
+		}
+	}
+	queued := make([]gin.H, len(st.Queued)) // Waiting requests, next first
+	for i, req := range st.Queued {
+		queued[i] = gin.H{"id": req.ID, "user_id": req.UserID, "request_at": req.RequestAt, "duration_min": req.Duration.Minutes(), "simulated": req.Simulate, "note": req.Note, "priority": cmp.Or(req.Priority, store.PriorityNormal)}
+		if !req.ExpiresAt.IsZero() {
+			queued[i]["expires_at"] = req.ExpiresAt
+		}
+	}
+	status["queue"] = queued
+	if p, err := queuePause(c.Request.Context()); err == nil && p.Paused { // Dispatching paused by an admin
+		status["paused"] = gin.H{"since": p.Since, "by": p.By, "reason": p.Reason}
+	}
+	now := time.Now()
+	if windows, err := upcomingMaintenance(c.Request.Context(), now); err == nil { // Current and planned maintenance, soonest first
+		out := make([]MaintenanceResponse, len(windows))
+		for i, w := range windows {
+			out[i] = maintenanceResponse(w, now)
+		}
+		status["maintenance"] = gin.H{"active": len(out) > 0 && out[0].Active, "windows": out} // The earliest is active if any is
+	}
+	if devices, err := shutDownDevices(c.Request.Context(), now); err == nil && len(devices) > 0 { // Devices shut down on their own
+		status["device_shutdowns"] = devices
+	}
+	if sd := st.Shutdown; sd.Active { // Include shutdown details
+		status["shutdown"] = gin.H{"active": true, "category": sd.Category, "reason": sd.Reason, "since": sd.Since}
+		if !sd.Until.IsZero() {
+			status["shutdown"].(gin.H)["until"] = sd.Until
+		}
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// AdminForceShutdown switches the motor off, drops every queued request and rejects
+// new ones until AdminRestart is called, or until ttl_minutes or until if given.
+func AdminForceShutdown(c *gin.Context) {
+	var input ShutdownInput
+	if err := c.ShouldBindJSON(&input); err != nil { // Parse JSON input
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}) // Return error if invalid
+		return
+	}
+	until, msg := shutdownEnd(input.TTLMinutes, input.Until, time.Now())
+	if msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	notes := input.notes()
+	dropped, err := motorService.ForceShutdown(c.Request.Context(), input.Category, notes, until)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record shutdown"})
+		return
+	}
+	sd := store.Shutdown{Active: true, Category: input.Category, Reason: notes, Until: until}
+	log.Printf("emergency shutdown by user %v: %s (%d queued requests dropped)", c.MustGet("userID"), sd.Summary(), dropped)
+	recordAuditEntry(c.Request.Context(), models.AuditLog{UserID: c.MustGet("userID").(uint), Action: "shutdown", Category: input.Category, Detail: notes})
+	notifyShutdown(c.Request.Context(), sd, userEmail(c.Request.Context(), c.MustGet("userID")), dropped)
+	resp := gin.H{"message": "system shut down", "category": input.Category, "dropped_requests": dropped}
+	if !until.IsZero() {
+		resp["until"] = until
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (in ShutdownInput) notes() string { // Notes, or reason from older clients
+	if in.Notes != "" {
+		return in.Notes
+	}
+	return in.Reason
+}
+
+type StopSessionInput struct { // Struct for stopping one running session
+	Reason string `json:"reason" binding:"required,max=255"` // Told to the session's owner, e.g. "you left the south pump running"
+}
+
+// AdminStopSession switches off the motor of one running session, queued or manual, without
+// shutting the system down: id is the session's interlock ID from GET /admin/status. The
+// session ends as stopped, its owner is told the reason and the stop is audited.
+func AdminStopSession(c *gin.Context) {
+	var input StopSessionInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	motor, l, err := motorService.StopSession(ctx, c.Param("id"), input.Reason)
+	if errors.Is(err, services.ErrNoSession) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if l.Source == services.InterlockManual { // Queued sessions are recorded and reported by the queue
+		endManualSession(ctx, l, services.SessionStopped, input.Reason)
+	}
+	slog.Warn("motor session stopped by admin", "motor", motor, "user_id", l.UserID, "by", c.MustGet("userID"), "reason", input.Reason)
+	recordAudit(ctx, c.MustGet("userID").(uint), "session_stop", fmt.Sprintf("%s session of user %d on %s since %s: %s", l.Source, l.UserID, motor, l.Since.UTC().Format(time.RFC3339), input.Reason))
+	c.JSON(http.StatusOK, gin.H{"message": "session stopped", "motor": motor, "session": l})
+}
+
+// shutdownEnd returns when a shutdown given ttl_minutes or until ends (zero: only by
+// restart), or a message saying why the input is invalid.
+func shutdownEnd(ttlMinutes int, until *time.Time, now time.Time) (time.Time, string) {
+	switch {
+	case ttlMinutes > 0 && until != nil:
+		return time.Time{}, "give either ttl_minutes or until, not both"
+	case ttlMinutes > 0:
+		return now.Add(time.Duration(ttlMinutes) * time.Minute), ""
+	case until != nil && !until.After(now):
+		return time.Time{}, "until must be in the future"
+	case until != nil:
+		return *until, ""
+	}
+	return time.Time{}, ""
+}
+
+// ExpireShutdown restarts the system, and any shut-down device, once a scheduled
+// shutdown's end time has passed and tells admins and users. It runs as a leader-only
+// background job.
+func ExpireShutdown(ctx context.Context) error {
+	if err := expireDeviceShutdowns(ctx); err != nil {
+		return err
+	}
+	sd, expired, err := motorService.ExpireShutdown(ctx)
+	if err != nil || !expired {
+		return err
+	}
+	log.Printf("scheduled shutdown ended: %s (since %s)", sd.Summary(), sd.Since.Format(time.RFC3339))
+	recordAuditEntry(ctx, models.AuditLog{Action: "restart", Category: sd.Category, Detail: "scheduled shutdown ended: " + sd.Summary()})
+	notifyShutdownExpired(ctx, sd)
+	return nil
+}
+
+// AdminRestart clears an emergency shutdown. With RESTART_APPROVAL_WINDOW_MINUTES set,
+// the first admin's call is recorded as an approval (202) and a different admin must call
+// it within the window to restart.
+func AdminRestart(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	approval, err := motorService.RequestRestart(c.Request.Context(), userID)
+	switch {
+	case errors.Is(err, services.ErrNotShutDown):
+		c.JSON(http.StatusConflict, gin.H{"error": "system is not shut down"})
+		return
+	case errors.Is(err, services.ErrSecondApprover):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to clear shutdown"})
+		return
+	}
+	if !approval.Restarted { // First of two approvals
+		log.Printf("restart approved by user %v, waiting for a second admin until %s", userID, approval.ExpiresAt.Format(time.RFC3339))
+		recordAudit(c.Request.Context(), userID, "restart_approved", "first approval, expires "+approval.ExpiresAt.Format(time.RFC3339))
+		c.JSON(http.StatusAccepted, gin.H{"message": "restart approved; a second admin must confirm it", "expires_at": approval.ExpiresAt})
+		return
+	}
+	detail := ""
+	if approval.FirstBy != userID {
+		detail = fmt.Sprintf("confirmed restart approved by user %d", approval.FirstBy)
+	}
+	log.Printf("system restarted by user %v %s", userID, detail)
+	recordAudit(c.Request.Context(), userID, "restart", detail)
+	notifyShutdown(c.Request.Context(), store.Shutdown{}, userEmail(c.Request.Context(), userID), 0)
+	c.JSON(http.StatusOK, gin.H{"message": "system restarted"})
+}
+
+type ClearFaultInput struct { // Struct for clearing a motor fault
+	Motor string `json:"motor"` // "{org}/{device}" of a tenant device; empty for the shared motor
+}
+
+// AdminClearFault returns a motor in FAULT to OFF once it has been checked, so it can be
+// switched on again.
+func AdminClearFault(c *gin.Context) {
+	var input ClearFaultInput
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) { // The body is optional
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Motor == "" {
+		input.Motor = services.SharedMotor
+	}
+	st := motorService.MotorState(input.Motor)
+	var terr *services.TransitionError
+	if err := motorService.ClearFault(input.Motor); errors.As(err, &terr) {
+		c.JSON(http.StatusConflict, gin.H{"error": "motor is not in FAULT", "motor": st})
+		return
+	}
+	now, by := time.Now(), c.MustGet("userID").(uint)
+	err := database.DB.WithContext(c.Request.Context()).Model(&models.MotorFault{}).
+		Where("motor = ? AND cleared_at IS NULL", input.Motor).
+		Updates(map[string]any{"cleared_at": now, "cleared_by": by}).Error
+	if err != nil {
+		slog.Error("record fault clear failed", "motor", input.Motor, "error", err)
+	}
+	log.Printf("motor %s fault cleared by user %v (was: %s)", input.Motor, by, st.Reason)
+	c.JSON(http.StatusOK, gin.H{"message": "fault cleared", "motor": motorService.MotorState(input.Motor)})
+}
@@ -0,0 +1,52 @@
+// alerts.go - Watches for conditions admins must hear about straight away
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"              // For cancellation
+	"go-mqtt-backend/mqtt" // Broker connection state
+	"time"                 // Outage timing
+)
+
+var ( // Swapped in tests
+	brokerConnected  = mqtt.IsConnected
+	brokerCheckEvery = 5 * time.Second
+)
+
+// WatchBroker alerts admins once the broker connection has been down for longer than
+// after, and again when it comes back. Every replica watches its own connection, so the
+// alert names the instance. It fits supervisor.Task.Run.
+func WatchBroker(broker, instance string, after time.Duration) func(ctx context.Context, beat func()) error {
+	return func(ctx context.Context, beat func()) error {
+		ticker := time.NewTicker(brokerCheckEvery)
+		defer ticker.Stop()
+		var downSince time.Time // Zero while connected
+		alerted := false
+		for {
+			beat()
+			select {
+			case <-ctx.Done():
+				return nil
+			case now := <-ticker.C:
+				if brokerConnected() {
+					if alerted {
+						AlertAdmins(ctx, "broker_up", map[string]any{
+							"Instance": instance, "Broker": broker, "For": now.Sub(downSince).Round(time.Second),
+						})
+					}
+					downSince, alerted = time.Time{}, false
+					continue
+				}
+				if downSince.IsZero() {
+					downSince = now
+				}
+				if !alerted && now.Sub(downSince) >= after {
+					alerted = true
+					AlertAdmins(ctx, "broker_down", map[string]any{
+						"Instance": instance, "Broker": broker, "Since": downSince, "For": now.Sub(downSince).Round(time.Second),
+					})
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// alerts_test.go - Tests for admin alerts
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"context"                  // For cancellation
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User model
+	"go-mqtt-backend/notify"   // SMS sender
+	"sync/atomic"              // Fake broker state
+	"testing"                  // Go's testing package
+	"time"                     // For durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+)
+
+type fakeSMS chan string // Records texts as "to: body"
+
+func (f fakeSMS) Name() string { return "fake" }
+func (f fakeSMS) SendSMS(ctx context.Context, to, body string) error {
+	f <- to + ": " + body
+	return nil
+}
+
+// TestWatchBrokerAlertsAdmins checks the outage and recovery alerts reach admins only
+func TestWatchBrokerAlertsAdmins(t *testing.T) {
+	setupTestDB()
+	database.DB.Create(&models.User{Email: "admin@example.com", Password: "x", Role: models.RoleAdmin, Phone: "+15550000001"})
+	database.DB.Create(&models.User{Email: "user@example.com", Password: "x", Role: models.RoleUser, Phone: "+15550000002"})
+	texts := make(fakeSMS, 10)
+	sender := notify.NewSMSSender(texts, 10)
+	UseNotifier(sender)
+	defer delete(notifiers, notify.ChannelSMS)
+
+	var up atomic.Bool
+	oldConnected, oldEvery := brokerConnected, brokerCheckEvery
+	brokerConnected, brokerCheckEvery = up.Load, 5*time.Millisecond
+	defer func() { brokerConnected, brokerCheckEvery = oldConnected, oldEvery }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watched := make(chan struct{})
+	defer func() { // Before the cleanups above, which WatchBroker reads
+		cancel()
+		<-watched
+	}()
+	go sender.Run(ctx, func() {})
+	go func() {
+		WatchBroker("tcp://broker:1883", "pi-1", 30*time.Millisecond)(ctx, func() {})
+		close(watched)
+	}()
+
+	select {
+	case text := <-texts:
+		assert.Contains(t, text, "+15550000001: pi-1 has been disconnected from tcp://broker:1883")
+	case <-time.After(time.Second):
+		t.Fatal("no outage alert")
+	}
+	up.Store(true)
+	select {
+	case text := <-texts:
+		assert.Contains(t, text, "+15550000001: pi-1 reconnected")
+	case <-time.After(time.Second):
+		t.Fatal("no recovery alert")
+	}
+	assert.Empty(t, texts) // One alert each, and none for the regular user
+}
@@ -0,0 +1,197 @@
+// analytics.go - Admin analytics: aggregations of runs and telemetry by chosen dimensions
+//
+// Custom reports shouldn't need a raw export, so GET /admin/analytics sums, counts or
+// averages one metric grouped by any of the dimensions its table has. Runs and runtime
+// count what the motor actually ran, from the activations' outcomes. The estimates (energy,
+// water, cost) are of accepted requests, read from the daily totals whenever the
+// dimensions asked for allow it, and from the activations only when they don't (e.g.
+// grouped by device).
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Aggregated models
+	"net/http"                 // HTTP status codes
+	"slices"                   // Dimension lists
+	"sort"                     // Error messages
+	"strings"                  // Query parsing
+	"time"                     // Ranges
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+const analyticsMaxRows = 10000 // Groups one response holds; the rest are cut off
+
+var analyticsDimensions = []string{"organization", "user", "device", "sensor", "day", "month"} // What group_by can name
+
+type analyticsSource struct { // A table analytics can aggregate
+	model any
+	at    string            // Column the from/to range applies to
+	days  bool              // at holds days ("2006-01-02") rather than times
+	dims  map[string]string // Dimensions it can be grouped and filtered by: name → SQL expression
+	where string            // Condition every query gets ("" for none)
+}
+
+var ( // Sources in the order they are preferred
+	totalsSource = &analyticsSource{&models.DailyTotal{}, "day", true, map[string]string{
+		"organization": "organization_id", "user": "user_id", "day": "day", "month": "SUBSTR(day, 1, 7)",
+	}, ""}
+	activationsSource = &analyticsSource{&models.DeviceActivation{}, "request_at", false, map[string]string{
+		"organization": "organization_id", "user": "user_id", "device": "device_id", "day": "DATE(request_at)", "month": "STRFTIME('%Y-%m', request_at)",
+	}, "simulated = false"}
+	telemetrySource = &analyticsSource{&models.TelemetryReading{}, "at", false, map[string]string{
+		"organization": "organization_id", "device": "device_id", "sensor": "metric", "day": "DATE(at)", "month": "STRFTIME('%Y-%m', at)",
+	}, ""}
+)
+
+type analyticsQuery struct { // How a metric is computed from one source
+	source *analyticsSource
+	expr   string // Aggregate
+}
+
+type analyticsMetric struct { // Something analytics can report
+	unit    string
+	queries []analyticsQuery // The first whose source has every dimension asked for is used
+	sensor  bool             // Only meaningful for one sensor: needs a sensor filter or grouping
+}
+
+// analyticsMetrics are the values of ?metric=. Run metrics leave out dry runs.
+var analyticsMetrics = map[string]analyticsMetric{
+	"runs":        {"runs", []analyticsQuery{{activationsSource, "COUNT(CASE WHEN ran > 0 THEN 1 END)"}}, false}, // Requests the motor ran for, not cancelled, rejected or expired ones
+	"runtime":     {"minutes", []analyticsQuery{{activationsSource, "SUM(ran) / 60e9"}}, false},                  // Time the motor actually ran
+	"energy":      {"kWh", []analyticsQuery{{totalsSource, "SUM(energy_kwh)"}, {activationsSource, "SUM(energy_kwh)"}}, false},
+	"water":       {"liters", []analyticsQuery{{totalsSource, "SUM(liters)"}, {activationsSource, "SUM(liters)"}}, false},
+	"cost":        {"currency", []analyticsQuery{{totalsSource, "SUM(cost)"}, {activationsSource, "SUM(cost)"}}, false},
+	"readings":    {"readings", []analyticsQuery{{telemetrySource, "COUNT(*)"}}, false},
+	"reading_avg": {"sensor units", []analyticsQuery{{telemetrySource, "AVG(value)"}}, true},
+	"reading_min": {"sensor units", []analyticsQuery{{telemetrySource, "MIN(value)"}}, true},
+	"reading_max": {"sensor units", []analyticsQuery{{telemetrySource, "MAX(value)"}}, true},
+}
+
+// Analytics reports one metric (runs, runtime, energy, water, cost, readings or
+// reading_avg/min/max) between the UTC days from and to (as for DailyUsage), grouped by
+// the comma-separated dimensions in group_by (organization, user, device, sensor, day,
+// month; none for a single total). Any dimension can also filter, e.g. device=3 or
+// sensor=pump-1/level. Groups come sorted by their dimensions, at most analyticsMaxRows.
+func Analytics(c *gin.Context) {
+	name := c.Query("metric")
+	metric, ok := analyticsMetrics[name]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "metric must be one of " + strings.Join(sortedKeys(analyticsMetrics), ", ")})
+		return
+	}
+	from, to, ok := dayRange(c)
+	if !ok {
+		return
+	}
+	groupBy := []string{}
+	if v := c.Query("group_by"); v != "" {
+		groupBy = strings.Split(v, ",")
+	}
+	for i, dim := range groupBy {
+		if !slices.Contains(analyticsDimensions, dim) || slices.Contains(groupBy[:i], dim) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "group_by takes distinct dimensions out of " + strings.Join(analyticsDimensions, ", ")})
+			return
+		}
+	}
+	filters := map[string]string{}
+	for _, dim := range analyticsDimensions {
+		if v := c.Query(dim); v != "" {
+			filters[dim] = v
+		}
+	}
+	if metric.sensor && filters["sensor"] == "" && !slices.Contains(groupBy, "sensor") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " needs one sensor: pass sensor= or group by sensor"})
+		return
+	}
+	var query *analyticsQuery
+	for _, q := range metric.queries {
+		if q.source.has(groupBy) && q.source.has(mapKeys(filters)) {
+			query = &q
+			break
+		}
+	}
+	if query == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " can be grouped and filtered by " + strings.Join(metric.dimensions(), ", ")})
+		return
+	}
+
+	src := query.source
+	db := database.DB.WithContext(c.Request.Context()).Model(src.model)
+	if src.days {
+		db = db.Where(src.at+" BETWEEN ? AND ?", from.Format(models.DailyTotalLayout), to.Format(models.DailyTotalLayout))
+	} else {
+		db = db.Where(src.at+" >= ? AND "+src.at+" < ?", from, to.Add(24*time.Hour))
+	}
+	if src.where != "" {
+		db = db.Where(src.where)
+	}
+	for dim, v := range filters {
+		db = db.Where(src.dims[dim]+" = ?", v)
+	}
+	selects := make([]string, 0, len(groupBy)+1)
+	for _, dim := range groupBy {
+		selects = append(selects, src.dims[dim]+" AS "+dim)
+		db = db.Group(src.dims[dim]).Order(dim)
+	}
+	selects = append(selects, query.expr+" AS value")
+	var rows []map[string]any
+	if err := db.Select(strings.Join(selects, ", ")).Limit(analyticsMaxRows + 1).Find(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not compute analytics"})
+		return
+	}
+	truncated := len(rows) > analyticsMaxRows
+	if truncated {
+		rows = rows[:analyticsMaxRows]
+	}
+	for _, row := range rows {
+		for k, v := range row {
+			if b, ok := v.([]byte); ok { // Text the driver returns as bytes
+				row[k] = string(b)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"metric":    name,
+		"unit":      metric.unit,
+		"group_by":  groupBy,
+		"from":      from.Format(models.DailyTotalLayout),
+		"to":        to.Format(models.DailyTotalLayout),
+		"rows":      rows,
+		"truncated": truncated,
+	})
+}
+
+func (s *analyticsSource) has(dims []string) bool { // Reports whether s has every dimension in dims
+	for _, d := range dims {
+		if _, ok := s.dims[d]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (m analyticsMetric) dimensions() []string { // Every dimension some source of m has
+	all := map[string]bool{}
+	for _, q := range m.queries {
+		for d := range q.source.dims {
+			all[d] = true
+		}
+	}
+	return sortedKeys(all)
+}
+
+func mapKeys[V any](m map[string]V) []string { // m's keys, in no particular order
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func sortedKeys[V any](m map[string]V) []string { // m's keys, sorted
+	keys := mapKeys(m)
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,83 @@
+// analytics_test.go - Tests for the admin analytics endpoint
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"context"                  // For logging activations
+	"encoding/json"            // Response decoding
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Activation, device and telemetry models
+	"go-mqtt-backend/services" // Activation repository
+	"net/http"                 // Requests
+	"net/http/httptest"        // Recorders
+	"strconv"                  // IDs in queries
+	"testing"                  // Go's testing package
+	"time"                     // Request times
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestAnalytics checks grouping and filtering of run and telemetry metrics, from the daily
+// totals or the raw rows, and the validation of metrics and dimensions
+func TestAnalytics(t *testing.T) {
+	setupTestDB()
+	user := models.User{Email: "farmer@example.com", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&user).Error)
+	pump := models.Device{OrganizationID: database.DefaultOrgID, Name: "pump-1"}
+	require.NoError(t, database.DB.Create(&pump).Error)
+	repo := services.NewGormMotorRepository(database.DB)
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	for _, a := range []models.DeviceActivation{
+		{UserID: user.ID, OrganizationID: database.DefaultOrgID, DeviceID: &pump.ID, RequestAt: day.Add(6 * time.Hour), Duration: 10 * time.Minute, EnergyKWh: 1, Outcome: services.SessionFinished, Ran: 10 * time.Minute},
+		{UserID: user.ID, OrganizationID: database.DefaultOrgID, DeviceID: &pump.ID, RequestAt: day.Add(30 * time.Hour), Duration: 20 * time.Minute, EnergyKWh: 2, Outcome: services.SessionFinished, Ran: 20 * time.Minute},
+		{UserID: user.ID, OrganizationID: database.DefaultOrgID, RequestAt: day.Add(31 * time.Hour), Duration: 5 * time.Minute, Outcome: services.SessionFinished, Ran: 5 * time.Minute},
+		{UserID: user.ID, OrganizationID: database.DefaultOrgID, RequestAt: day.Add(7 * time.Hour), Duration: time.Hour, Simulated: true, Outcome: services.SessionFinished, Ran: time.Hour}, // Dry run
+		{UserID: user.ID, OrganizationID: database.DefaultOrgID, DeviceID: &pump.ID, RequestAt: day.Add(8 * time.Hour), Duration: 15 * time.Minute, Outcome: services.SessionCancelled},      // Never switched on
+		{UserID: user.ID, OrganizationID: database.DefaultOrgID, RequestAt: day.Add(32 * time.Hour), Duration: 40 * time.Minute, Outcome: services.SessionExpired},
+	} {
+		require.NoError(t, repo.LogActivation(context.Background(), &a))
+	}
+	for i, v := range []float64{10, 20, 30} {
+		require.NoError(t, database.DB.Create(&models.TelemetryReading{OrganizationID: database.DefaultOrgID, DeviceID: pump.ID, Metric: "pump-1/level", Value: v, At: day.Add(time.Duration(i) * time.Hour)}).Error)
+	}
+
+	r := gin.New()
+	r.GET("/admin/analytics", Analytics)
+	get := func(query string) (int, []map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin/analytics?"+query, nil)
+		r.ServeHTTP(w, req)
+		var out struct{ Rows []map[string]any }
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out.Rows
+	}
+	d1, d2 := day.Format(models.DailyTotalLayout), day.AddDate(0, 0, 1).Format(models.DailyTotalLayout)
+
+	code, rows := get("metric=runtime&group_by=day")
+	require.Equal(t, 200, code)
+	assert.Equal(t, []map[string]any{{"day": d1, "value": 10.0}, {"day": d2, "value": 25.0}}, rows)
+
+	_, rows = get("metric=runtime&group_by=device,day") // Only the activations have devices
+	require.Len(t, rows, 3)
+	assert.Nil(t, rows[0]["device"])
+	assert.Equal(t, map[string]any{"device": float64(pump.ID), "day": d1, "value": 10.0}, rows[1])
+	assert.Equal(t, map[string]any{"device": float64(pump.ID), "day": d2, "value": 20.0}, rows[2])
+
+	_, rows = get("metric=energy&device=" + strconv.Itoa(int(pump.ID)))
+	assert.Equal(t, []map[string]any{{"value": 3.0}}, rows)
+	_, rows = get("metric=runs&group_by=user&from=" + d2 + "&to=" + d2)
+	assert.Equal(t, []map[string]any{{"user": float64(user.ID), "value": 2.0}}, rows)
+
+	_, rows = get("metric=reading_avg&group_by=sensor,device")
+	assert.Equal(t, []map[string]any{{"sensor": "pump-1/level", "device": float64(pump.ID), "value": 20.0}}, rows)
+	_, rows = get("metric=reading_max&sensor=pump-1/level")
+	assert.Equal(t, []map[string]any{{"value": 30.0}}, rows)
+
+	for _, bad := range []string{"metric=nonsense", "metric=reading_avg", "metric=runtime&group_by=sensor", "metric=runs&group_by=day,day", "metric=readings&group_by=user", "metric=runs&from=yesterday"} {
+		code, _ := get(bad)
+		assert.Equal(t, 400, code, bad)
+	}
+}
@@ -0,0 +1,156 @@
+// anomalies.go - Flags unusual usage for admins: usage spikes, idle current draw and repeated ack timeouts
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"fmt"                      // Details
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Anomaly, session log and fault models
+	"go-mqtt-backend/services" // Motor interlocks and states
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"strconv"                  // Query parsing
+	"time"                     // Periods
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+const (
+	anomalyHistoryDays = 14               // Days a user's usual usage is averaged over
+	anomalyMinSpike    = 30 * time.Minute // Less than this in a day is never a spike
+	anomalyCooldown    = 24 * time.Hour   // The same anomaly isn't flagged again within this
+)
+
+// DetectAnomalies flags users who ran the motor for more than ANOMALY_USAGE_FACTOR times
+// their daily average over the last 24 hours, and motors whose device failed to confirm
+// ANOMALY_ACK_TIMEOUTS commands within the last hour. It runs as a job on the leader;
+// idle current draw is flagged as readings arrive (see checkIdleDraw).
+func DetectAnomalies(ctx context.Context) error {
+	if err := detectUsageSpikes(ctx, time.Now()); err != nil {
+		return err
+	}
+	return detectAckTimeouts(ctx, time.Now())
+}
+
+func detectUsageSpikes(ctx context.Context, now time.Time) error {
+	factor := appConfig.AnomalyUsageFactor
+	if factor <= 0 {
+		return nil
+	}
+	from := now.Add(-(anomalyHistoryDays + 1) * 24 * time.Hour)
+	dayAgo := now.Add(-24 * time.Hour)
+	var rows []struct {
+		UserID  uint
+		Recent  int64 // Nanoseconds run in the last day
+		Earlier int64 // Nanoseconds run in the days before it
+	}
+	err := database.DB.WithContext(ctx).Model(&models.SessionLog{}).
+		Select("user_id, SUM(CASE WHEN ended_at >= ? THEN ran ELSE 0 END) AS recent, SUM(CASE WHEN ended_at < ? THEN ran ELSE 0 END) AS earlier", dayAgo, dayAgo).
+		Where("ended_at >= ? AND ran > 0 AND simulated = ?", from, false).
+		Group("user_id").Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		recent, usual := time.Duration(r.Recent), time.Duration(r.Earlier)/anomalyHistoryDays
+		if usual <= 0 || recent < anomalyMinSpike || float64(recent) < factor*float64(usual) {
+			continue // No history to compare with, or nothing unusual
+		}
+		flagAnomaly(ctx, models.Anomaly{
+			Kind:   models.AnomalyUsageSpike,
+			UserID: r.UserID,
+			Detail: fmt.Sprintf("%d min in the last 24h, usually %d min a day", int(recent.Minutes()), int(usual.Minutes())),
+		})
+	}
+	return nil
+}
+
+func detectAckTimeouts(ctx context.Context, now time.Time) error {
+	limit := appConfig.AnomalyAckTimeouts
+	if limit <= 0 {
+		return nil
+	}
+	var rows []struct {
+		Motor string
+		Count int
+	}
+	err := database.DB.WithContext(ctx).Model(&models.MotorFault{}).
+		Select("motor, COUNT(*) AS count").
+		Where("at >= ? AND reason LIKE ?", now.Add(-time.Hour), "%did not confirm%").
+		Group("motor").Having("COUNT(*) >= ?", limit).Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		flagAnomaly(ctx, models.Anomaly{
+			Kind:   models.AnomalyAckTimeouts,
+			Motor:  r.Motor,
+			Detail: fmt.Sprintf("%d commands not confirmed in the last hour", r.Count),
+		})
+	}
+	return nil
+}
+
+// checkIdleDraw flags motor when a motor_current reading is over ANOMALY_IDLE_CURRENT_A
+// while it is off and no session holds it: something switched it on outside the backend.
+func checkIdleDraw(ctx context.Context, motor, metric string, value float64) {
+	threshold := appConfig.AnomalyIdleCurrentA
+	if metric != MetricMotorCurrent || threshold <= 0 || value <= threshold {
+		return
+	}
+	if motorService.MotorState(motor).State != services.MotorOff {
+		return
+	}
+	if l, err := motorService.Interlock(ctx, motor); err != nil || l != nil {
+		return
+	}
+	flagAnomaly(ctx, models.Anomaly{
+		Kind:   models.AnomalyIdleDraw,
+		Motor:  motor,
+		Detail: fmt.Sprintf("drawing %g A while off with no session", value),
+	})
+}
+
+// flagAnomaly records a and alerts the admins, unless the same anomaly was flagged within
+// the cooldown.
+func flagAnomaly(ctx context.Context, a models.Anomaly) {
+	a.At = time.Now()
+	var seen int64
+	err := database.DB.WithContext(ctx).Model(&models.Anomaly{}).
+		Where("kind = ? AND user_id = ? AND motor = ? AND at > ?", a.Kind, a.UserID, a.Motor, a.At.Add(-anomalyCooldown)).
+		Count(&seen).Error
+	if err != nil || seen > 0 {
+		return
+	}
+	if err := database.DB.WithContext(ctx).Create(&a).Error; err != nil {
+		slog.Error("record anomaly failed", "kind", a.Kind, "error", err)
+		return
+	}
+	slog.Warn("anomaly", "kind", a.Kind, "user_id", a.UserID, "motor", a.Motor, "detail", a.Detail)
+	data := map[string]any{"Kind": a.Kind, "Motor": a.Motor, "Detail": a.Detail, "At": a.At}
+	if a.UserID != 0 {
+		data["User"] = userEmail(ctx, a.UserID)
+	}
+	AlertAdmins(ctx, "anomaly", data)
+}
+
+// ListAnomalies returns the most recent anomalies, newest first (limit, default 50, at
+// most 500; kind filters by kind).
+func ListAnomalies(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be 1-500"})
+		return
+	}
+	q := database.DB.WithContext(c.Request.Context()).Order("at DESC, id DESC").Limit(limit)
+	if kind := c.Query("kind"); kind != "" {
+		q = q.Where("kind = ?", kind)
+	}
+	var anomalies []models.Anomaly
+	if err := q.Find(&anomalies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load anomalies"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"anomalies": anomalies})
+}
@@ -0,0 +1,68 @@
+// anomalies_test.go - Tests for anomaly detection
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"context"                  // For detection runs
+	"encoding/json"            // Response bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Anomaly, session log and fault models
+	"go-mqtt-backend/services" // Shared motor
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"testing"                  // Go's testing package
+	"time"                     // Session times
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestDetectAnomalies checks usage spikes, repeated ack timeouts and idle draw, each flagged once
+func TestDetectAnomalies(t *testing.T) {
+	setupTestDB()
+	svc := useTestMotor(5)
+	ctx := context.Background()
+	now := time.Now()
+	var logs []models.SessionLog
+	for day := 1; day <= 14; day++ { // Both users usually run 20 minutes a day
+		for _, user := range []uint{1, 2} {
+			logs = append(logs, models.SessionLog{UserID: user, Outcome: services.SessionFinished, Ran: 20 * time.Minute, EndedAt: now.Add(-time.Duration(day)*24*time.Hour - time.Hour)})
+		}
+	}
+	logs = append(logs,
+		models.SessionLog{UserID: 1, Outcome: services.SessionFinished, Ran: 2 * time.Hour, EndedAt: now.Add(-time.Hour)},    // Six times the usual
+		models.SessionLog{UserID: 2, Outcome: services.SessionFinished, Ran: 40 * time.Minute, EndedAt: now.Add(-time.Hour)}, // Twice
+	)
+	require.NoError(t, database.DB.Create(&logs).Error)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, database.DB.Create(&models.MotorFault{Motor: services.SharedMotor, Reason: "device did not confirm ON (watchdog)", At: now.Add(-10 * time.Minute)}).Error)
+	}
+	require.NoError(t, database.DB.Create(&models.MotorFault{Motor: "green-acres/pump-1", Reason: "motor_temperature 92 over the 80 limit", At: now}).Error)
+
+	require.NoError(t, DetectAnomalies(ctx))
+	require.NoError(t, DetectAnomalies(ctx))                          // Not flagged twice
+	checkIdleDraw(ctx, services.SharedMotor, MetricMotorCurrent, 0.2) // Sensor noise
+	checkIdleDraw(ctx, "green-acres/pump-1", MetricMotorCurrent, 4.5)
+	require.NoError(t, svc.LockMotor(ctx, "green-acres/pump-2", 1))
+	checkIdleDraw(ctx, "green-acres/pump-2", MetricMotorCurrent, 4.5) // Someone's session
+
+	r := gin.New()
+	r.GET("/admin/anomalies", ListAnomalies)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/anomalies", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var out struct{ Anomalies []models.Anomaly }
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+	kinds := map[string]models.Anomaly{}
+	for _, a := range out.Anomalies {
+		kinds[a.Kind] = a
+	}
+	require.Len(t, out.Anomalies, 3)
+	assert.Equal(t, uint(1), kinds[models.AnomalyUsageSpike].UserID)
+	assert.Equal(t, "120 min in the last 24h, usually 20 min a day", kinds[models.AnomalyUsageSpike].Detail)
+	assert.Equal(t, services.SharedMotor, kinds[models.AnomalyAckTimeouts].Motor)
+	assert.Equal(t, "green-acres/pump-1", kinds[models.AnomalyIdleDraw].Motor)
+}
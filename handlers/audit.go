@@ -0,0 +1,134 @@
+// audit.go - Audit trail of admin actions such as shutdowns and restarts
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB writes
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Audit log model
+	"go-mqtt-backend/services" // Shutdown categories
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"strconv"                  // Query parsing
+	"time"                     // Timestamps
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+// recordAudit adds an entry to the audit trail. userID is the acting user (0 for the
+// system itself). A failed write is logged, never returned: the action has happened.
+func recordAudit(ctx context.Context, userID uint, action, detail string) {
+	recordAuditEntry(ctx, models.AuditLog{UserID: userID, Action: action, Detail: detail})
+}
+
+// recordAuditEntry is recordAudit for entries with more than a detail, e.g. a category.
+func recordAuditEntry(ctx context.Context, entry models.AuditLog) {
+	if err := database.AppendAudit(ctx, &entry); err != nil {
+		slog.Error("record audit entry failed", "action", entry.Action, "user_id", entry.UserID, "error", err)
+	}
+}
+
+// ListAuditLog returns the most recent audit entries, newest first (limit, default 100,
+// at most 500; action filters by action, category by shutdown category, route by the
+// route of recorded requests).
+func ListAuditLog(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be 1-500"})
+		return
+	}
+	q := database.DB.WithContext(c.Request.Context()).Order("at DESC, id DESC").Limit(limit)
+	if action := c.Query("action"); action != "" {
+		q = q.Where("action = ?", action)
+	}
+	if category := c.Query("category"); category != "" {
+		q = q.Where("category = ?", category)
+	}
+	if route := c.Query("route"); route != "" {
+		q = q.Where("route = ?", route)
+	}
+	var entries []models.AuditLog
+	if err := q.Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// VerifyAuditLog recomputes the audit log's hash chain and reports whether it is intact,
+// and if not the first entry that was changed, inserted or follows a deleted one.
+func VerifyAuditLog(c *gin.Context) {
+	check, err := database.VerifyAudit(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not verify audit log"})
+		return
+	}
+	if !check.OK {
+		slog.Error("audit log chain broken", "entry_id", check.BrokenAt, "problem", check.Problem)
+	}
+	c.JSON(http.StatusOK, check)
+}
+
+const shutdownStatsDefaultRange = 30 * 24 * time.Hour // Period ShutdownStats covers without from
+
+type ShutdownStat struct { // Shutdowns of one category in a period
+	Category string `json:"category"`
+	System   int64  `json:"system"`  // Emergency shutdowns of the whole system
+	Devices  int64  `json:"devices"` // Shutdowns of single devices or groups
+}
+
+// ShutdownStats counts the shutdowns in the audit log per category between from and to
+// (RFC 3339; default the last 30 days up to now). Every category is listed, also with
+// no shutdowns; shutdowns recorded before categories existed are left out.
+func ShutdownStats(c *gin.Context) {
+	from, to := time.Time{}, time.Now()
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.Query(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be an RFC 3339 time"})
+				return
+			}
+			*t = parsed
+		}
+	}
+	if from.IsZero() {
+		from = to.Add(-shutdownStatsDefaultRange)
+	}
+	if !to.After(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be after from"})
+		return
+	}
+	var rows []struct {
+		Category string
+		Action   string
+		Count    int64
+	}
+	err := database.DB.WithContext(c.Request.Context()).Model(&models.AuditLog{}).
+		Select("category, action, COUNT(*) AS count").
+		Where("action IN ? AND category <> '' AND at >= ? AND at < ?", []string{"shutdown", "device_shutdown"}, from, to).
+		Group("category, action").Scan(&rows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load shutdown statistics"})
+		return
+	}
+	stats := make([]ShutdownStat, len(services.ShutdownCategories))
+	index := map[string]int{}
+	for i, category := range services.ShutdownCategories {
+		stats[i].Category, index[category] = category, i
+	}
+	var total int64
+	for _, row := range rows {
+		i, ok := index[row.Category]
+		if !ok {
+			continue
+		}
+		if row.Action == "shutdown" {
+			stats[i].System += row.Count
+		} else {
+			stats[i].Devices += row.Count
+		}
+		total += row.Count
+	}
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "categories": stats, "total": total})
+}
@@ -0,0 +1,332 @@
+// billing.go - Stripe subscriptions: checkout, customer portal and webhook sync of plans
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"encoding/json"            // Webhook objects
+	"errors"                   // Signature errors
+	"go-mqtt-backend/billing"  // Stripe client
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Organization and plan models
+	"go-mqtt-backend/notify"   // Billing notices
+	"log"                      // Logging
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"strconv"                  // Organization IDs in Stripe
+	"time"                     // Grace periods
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+const ( // Stripe subscription statuses the sync acts on
+	subscriptionActive            = "active"
+	subscriptionTrialing          = "trialing"
+	subscriptionPastDue           = "past_due"
+	subscriptionUnpaid            = "unpaid"
+	subscriptionCanceled          = "canceled"
+	subscriptionIncompleteExpired = "incomplete_expired"
+	subscriptionPaused            = "paused"
+)
+
+var stripe *billing.Stripe // Stripe API client (nil disables billing; set by UseBilling)
+
+func UseBilling(s *billing.Stripe) { // Enables self-service subscriptions
+	stripe = s
+}
+
+// subscriptionEnded reports whether a subscription in status no longer pays for a plan.
+func subscriptionEnded(status string) bool {
+	switch status {
+	case subscriptionUnpaid, subscriptionCanceled, subscriptionIncompleteExpired, subscriptionPaused:
+		return true
+	}
+	return false
+}
+
+// graceEnds is when a past-due organization drops to the free plan, or the zero time
+// while its payments are up to date.
+func graceEnds(org models.Organization) time.Time {
+	if org.SubscriptionStatus != subscriptionPastDue || org.PastDueSince == nil {
+		return time.Time{}
+	}
+	grace := 7 * 24 * time.Hour
+	if appConfig != nil {
+		grace = appConfig.BillingGracePeriod
+	}
+	return org.PastDueSince.Add(grace)
+}
+
+// billingLapsed reports whether an organization's payments have been failing for longer
+// than the grace period, so it is held to the free plan until they succeed. Nothing is
+// deleted; the paid plan comes back with the next successful payment.
+func billingLapsed(org models.Organization, now time.Time) bool {
+	ends := graceEnds(org)
+	return !ends.IsZero() && now.After(ends)
+}
+
+func planPrices() map[string]string { // Stripe price of each plan that can be bought
+	prices := map[string]string{}
+	if appConfig != nil {
+		if appConfig.StripePriceStandard != "" {
+			prices[models.PlanStandard] = appConfig.StripePriceStandard
+		}
+		if appConfig.StripePricePro != "" {
+			prices[models.PlanPro] = appConfig.StripePricePro
+		}
+	}
+	return prices
+}
+
+func planForPrice(ctx context.Context, priceID string) (models.Plan, error) { // Plan a Stripe price buys (ID 0 if none)
+	var plan models.Plan
+	for name, price := range planPrices() {
+		if price == priceID {
+			return plan, database.DB.WithContext(ctx).Where("name = ?", name).Limit(1).Find(&plan).Error
+		}
+	}
+	return plan, nil
+}
+
+func billingOrg(c *gin.Context) (models.Organization, bool) { // Loads the caller's organization, or responds 500
+	var org models.Organization
+	if err := database.DB.WithContext(c.Request.Context()).Limit(1).Find(&org, orgOf(c)).Error; err != nil || org.ID == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load organization"})
+		return org, false
+	}
+	return org, true
+}
+
+// GetBilling returns the caller's organization's plan and subscription state.
+func GetBilling(c *gin.Context) {
+	org, ok := billingOrg(c)
+	if !ok {
+		return
+	}
+	plan, err := planOf(c.Request.Context(), org)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load plan"})
+		return
+	}
+	out := gin.H{
+		"enabled":             stripe != nil,
+		"plan":                planResponse(plan),
+		"subscription_status": org.SubscriptionStatus,
+		"has_billing_account": org.BillingCustomerID != "",
+	}
+	if ends := graceEnds(org); !ends.IsZero() {
+		out["past_due_since"], out["grace_ends"] = org.PastDueSince, ends
+	}
+	buyable := []string{}
+	for _, name := range []string{models.PlanStandard, models.PlanPro} {
+		if planPrices()[name] != "" {
+			buyable = append(buyable, name)
+		}
+	}
+	out["plans_for_sale"] = buyable
+	c.JSON(http.StatusOK, out)
+}
+
+// CreateCheckout starts a Stripe Checkout for a plan and returns the page to send the
+// org admin to. The plan changes when Stripe reports the subscription, not here.
+func CreateCheckout(c *gin.Context) {
+	if stripe == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "billing is not enabled"})
+		return
+	}
+	var input struct {
+		Plan string `json:"plan" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	price := planPrices()[input.Plan]
+	if price == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "plan is not for sale"})
+		return
+	}
+	org, ok := billingOrg(c)
+	if !ok {
+		return
+	}
+	if org.SubscriptionID != "" && !subscriptionEnded(org.SubscriptionStatus) {
+		c.JSON(http.StatusConflict, gin.H{"error": "organization already has a subscription; change it in the billing portal"})
+		return
+	}
+	ref := strconv.Itoa(int(org.ID))
+	session, err := stripe.CreateCheckoutSession(c.Request.Context(), billing.CheckoutParams{
+		PriceID:       price,
+		CustomerID:    org.BillingCustomerID,
+		CustomerEmail: userEmail(c.Request.Context(), c.MustGet("userID")),
+		ReferenceID:   ref,
+		SuccessURL:    appConfig.AppURL + "/billing?checkout=success",
+		CancelURL:     appConfig.AppURL + "/billing?checkout=cancelled",
+		Metadata:      map[string]string{"organization_id": ref},
+	})
+	if err != nil {
+		slog.Error("stripe checkout failed", "organization_id", org.ID, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "could not start checkout"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"checkout_url": session.URL})
+}
+
+// CreateBillingPortal returns a Stripe customer portal page, where org admins update the
+// payment method, switch plans or cancel.
+func CreateBillingPortal(c *gin.Context) {
+	if stripe == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "billing is not enabled"})
+		return
+	}
+	org, ok := billingOrg(c)
+	if !ok {
+		return
+	}
+	if org.BillingCustomerID == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "organization has no billing account yet; subscribe first"})
+		return
+	}
+	session, err := stripe.CreatePortalSession(c.Request.Context(), org.BillingCustomerID, appConfig.AppURL+"/billing")
+	if err != nil {
+		slog.Error("stripe portal failed", "organization_id", org.ID, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "could not open the billing portal"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"portal_url": session.URL})
+}
+
+// StripeWebhook receives Stripe events. Requests must carry a valid Stripe-Signature;
+// failures to apply an event return 500 so Stripe retries it.
+func StripeWebhook(c *gin.Context) {
+	if stripe == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "billing is not enabled"})
+		return
+	}
+	payload, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "could not read body"})
+		return
+	}
+	ev, err := stripe.ParseWebhook(payload, c.GetHeader("Stripe-Signature"), time.Now())
+	if err != nil {
+		if !errors.Is(err, billing.ErrBadSignature) {
+			slog.Warn("stripe webhook rejected", "error", err)
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook"})
+		return
+	}
+	if err := applyBillingEvent(c.Request.Context(), ev); err != nil {
+		slog.Error("stripe webhook failed", "event_id", ev.ID, "type", ev.Type, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not apply event"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+func applyBillingEvent(ctx context.Context, ev billing.Event) error {
+	switch ev.Type {
+	case "checkout.session.completed":
+		var s billing.CheckoutSession
+		if err := json.Unmarshal(ev.Data.Object, &s); err != nil {
+			return err
+		}
+		return database.DB.WithContext(ctx).Model(&models.Organization{}).Where("id = ?", s.ReferenceID).
+			Updates(map[string]any{"billing_customer_id": s.Customer, "subscription_id": s.Subscription}).Error
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		var sub billing.Subscription
+		if err := json.Unmarshal(ev.Data.Object, &sub); err != nil {
+			return err
+		}
+		return syncSubscription(ctx, sub, time.Unix(ev.Created, 0))
+	}
+	return nil // Other events aren't needed
+}
+
+// syncSubscription applies a subscription's state as of at to its organization: paid
+// statuses set the plan of its price, past_due keeps the plan through the grace period,
+// and ended subscriptions drop to free. Events older than the last one applied are
+// ignored, since Stripe doesn't deliver in order.
+func syncSubscription(ctx context.Context, sub billing.Subscription, at time.Time) error {
+	db := database.DB.WithContext(ctx)
+	var org models.Organization
+	q := db.Limit(1)
+	if id := sub.Metadata["organization_id"]; id != "" {
+		q = q.Where("id = ?", id)
+	} else {
+		q = q.Where("subscription_id = ? OR billing_customer_id = ?", sub.ID, sub.Customer)
+	}
+	if err := q.Find(&org).Error; err != nil {
+		return err
+	}
+	if org.ID == 0 {
+		slog.Warn("stripe subscription for unknown organization", "subscription_id", sub.ID, "customer", sub.Customer)
+		return nil
+	}
+	if at.Before(org.BillingSyncedAt) {
+		return nil
+	}
+	if org.SubscriptionID != "" && org.SubscriptionID != sub.ID && subscriptionEnded(sub.Status) {
+		return nil // An old subscription ending doesn't affect the current one
+	}
+	before, err := planOf(ctx, org)
+	if err != nil {
+		return err
+	}
+	updates := map[string]any{
+		"billing_customer_id": sub.Customer,
+		"subscription_id":     sub.ID,
+		"subscription_status": sub.Status,
+		"billing_synced_at":   at,
+	}
+	var plan models.Plan
+	if !subscriptionEnded(sub.Status) {
+		if plan, err = planForPrice(ctx, sub.PriceID()); err != nil {
+			return err
+		}
+		if plan.ID == 0 && (sub.Status == subscriptionActive || sub.Status == subscriptionTrialing) {
+			slog.Warn("stripe subscription has an unknown price; plan unchanged", "organization_id", org.ID, "price", sub.PriceID())
+		}
+	}
+	pastDueStarted, downgraded := false, false
+	switch {
+	case sub.Status == subscriptionActive || sub.Status == subscriptionTrialing:
+		if plan.ID != 0 {
+			updates["plan_id"] = plan.ID
+		}
+		updates["past_due_since"] = nil
+	case sub.Status == subscriptionPastDue:
+		if plan.ID != 0 {
+			updates["plan_id"] = plan.ID
+		}
+		if org.PastDueSince == nil {
+			updates["past_due_since"], pastDueStarted = at, true
+		}
+	case subscriptionEnded(sub.Status):
+		var free models.Plan
+		if err := db.Where("name = ?", models.PlanFree).Limit(1).Find(&free).Error; err != nil {
+			return err
+		}
+		updates["plan_id"], updates["past_due_since"] = free.ID, nil
+		downgraded = org.PlanID != 0 && org.PlanID != free.ID
+	} // incomplete: first payment still pending, nothing changes yet
+	if err := db.Model(&org).Updates(updates).Error; err != nil {
+		return err
+	}
+	log.Printf("organization %q subscription %s is %s", org.Slug, sub.ID, sub.Status)
+
+	data := map[string]any{"Organization": org.Name, "Plan": before.Name, "Status": sub.Status}
+	if plan.ID != 0 {
+		data["Plan"] = plan.Name
+	}
+	switch {
+	case pastDueStarted:
+		org.SubscriptionStatus, org.PastDueSince = sub.Status, &at
+		data["GraceEnds"] = graceEnds(org)
+		notifyUsers(ctx, orgAdminsOf(org.ID), notify.EventBilling, "billing", data)
+	case downgraded:
+		data["Downgraded"] = true
+		notifyUsers(ctx, orgAdminsOf(org.ID), notify.EventBilling, "billing", data)
+	}
+	return nil
+}
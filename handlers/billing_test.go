@@ -0,0 +1,108 @@
+// billing_test.go - Tests for Stripe checkout and subscription webhooks
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"encoding/json"            // Response bodies
+	"fmt"                      // Webhook payloads
+	"go-mqtt-backend/billing"  // Stripe client and signatures
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Organization and plan models
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"testing"                  // Go's testing package
+	"time"                     // Event times
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestBilling checks checkout, plan sync from webhooks and the downgrade after failed payments
+func TestBilling(t *testing.T) {
+	setupTestDB()
+	appConfig.StripePriceStandard, appConfig.StripePricePro = "price_std", "price_pro"
+	defer func() { appConfig.StripePriceStandard, appConfig.StripePricePro = "", "" }()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		assert.Contains(t, []string{"price_std", "price_pro"}, r.PostForm.Get("line_items[0][price]"))
+		w.Write([]byte(`{"id":"cs_1","url":"https://checkout.stripe.com/c/pay/cs_1"}`))
+	}))
+	defer srv.Close()
+	UseBilling(&billing.Stripe{SecretKey: "sk_test", WebhookSecret: "whsec_test", BaseURL: srv.URL})
+	defer UseBilling(nil)
+
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres", PlanID: planNamed(t, models.PlanFree)}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	admin := models.User{Email: "boss@example.com", Password: "x", Role: models.RoleOrgAdmin, OrganizationID: farm.ID}
+	require.NoError(t, database.DB.Create(&admin).Error)
+
+	r := gin.New()
+	setCaller := func(c *gin.Context) { c.Set("userID", admin.ID); c.Set("orgID", farm.ID) }
+	r.GET("/api/org/billing", setCaller, GetBilling)
+	r.POST("/api/org/billing/checkout", setCaller, CreateCheckout)
+	r.POST("/webhooks/stripe", StripeWebhook)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	now := time.Now()
+	webhook := func(created time.Time, status, price string) int {
+		payload := []byte(fmt.Sprintf(`{"id":"evt_%d","type":"customer.subscription.updated","created":%d,"data":{"object":{"id":"sub_1","customer":"cus_1","status":%q,"metadata":{"organization_id":"%d"},"items":{"data":[{"price":{"id":%q}}]}}}}`,
+			created.UnixNano(), created.Unix(), status, farm.ID, price))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/webhooks/stripe", bytes.NewReader(payload))
+		req.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), billing.Sign("whsec_test", now.Unix(), payload)))
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	planName := func() string {
+		var org models.Organization
+		require.NoError(t, database.DB.First(&org, farm.ID).Error)
+		plan, err := planOf(t.Context(), org)
+		require.NoError(t, err)
+		return plan.Name
+	}
+
+	code, _ := call("POST", "/api/org/billing/checkout", `{"plan":"free"}`)
+	assert.Equal(t, 400, code)
+	code, out := call("POST", "/api/org/billing/checkout", `{"plan":"pro"}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, "https://checkout.stripe.com/c/pay/cs_1", out["checkout_url"])
+
+	w := httptest.NewRecorder() // Unsigned
+	req, _ := http.NewRequest("POST", "/webhooks/stripe", bytes.NewBufferString(`{"type":"customer.subscription.updated"}`))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	require.Equal(t, 200, webhook(now.Add(-time.Hour), "active", "price_pro"))
+	assert.Equal(t, models.PlanPro, planName())
+	code, _ = call("POST", "/api/org/billing/checkout", `{"plan":"standard"}`)
+	assert.Equal(t, 409, code) // Already subscribed
+
+	// A failed renewal keeps the plan through the grace period, then drops to free
+	require.Equal(t, 200, webhook(now.Add(-30*time.Minute), "past_due", "price_pro"))
+	assert.Equal(t, models.PlanPro, planName())
+	code, out = call("GET", "/api/org/billing", "")
+	require.Equal(t, 200, code)
+	assert.Equal(t, "past_due", out["subscription_status"])
+	assert.NotEmpty(t, out["grace_ends"])
+	require.NoError(t, database.DB.Model(&models.Organization{}).Where("id = ?", farm.ID).Update("past_due_since", now.AddDate(0, 0, -8)).Error)
+	assert.Equal(t, models.PlanFree, planName())
+
+	assert.Equal(t, 200, webhook(now.Add(-2*time.Hour), "canceled", "price_pro")) // Stale: ignored
+	require.Equal(t, 200, webhook(now.Add(-10*time.Minute), "active", "price_pro"))
+	assert.Equal(t, models.PlanPro, planName()) // Paid again
+
+	require.Equal(t, 200, webhook(now, "canceled", "price_pro"))
+	assert.Equal(t, models.PlanFree, planName())
+	code, _ = call("POST", "/api/org/billing/checkout", `{"plan":"standard"}`)
+	assert.Equal(t, 200, code, "resubscribing after a cancellation is allowed")
+}
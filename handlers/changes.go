@@ -0,0 +1,164 @@
+// changes.go - Long-poll for changes: a battery-friendly alternative to the WebSocket
+//
+// GET /api/changes answers with what changed for the caller since their cursor, waiting up
+// to ?wait= for something to change first. State is split into sections (the caller's
+// queue positions, the session holding the shared motor, the shared motor's state, the
+// organization's devices and the shutdown) and the cursor is a short hash of each, so it
+// works on every replica and the answer only holds the sections that changed. The wait
+// wakes on live updates and otherwise looks again every changesPoll, for changes made on
+// other replicas or without a live update (e.g. someone else queueing a run).
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For lookups
+	"encoding/hex"             // Cursors
+	"encoding/json"            // Section hashing
+	"fmt"                      // Cursors
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Organization and device models
+	"hash/fnv"                 // Section hashing
+	"net/http"                 // HTTP status codes
+	"strconv"                  // Wait parsing
+	"strings"                  // Cursors
+	"time"                     // Waits
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+const (
+	changesDefaultWait = 30 * time.Second // Wait when ?wait= is left out
+	changesMaxWait     = 60 * time.Second // Longest wait a client can ask for
+)
+
+var changesPoll = 5 * time.Second // How often a waiting request looks again without a live update
+
+var changesSections = []string{"queue", "session", "motor", "devices", "shutdown"} // In cursor order
+
+type changesSession struct { // The session holding the shared motor, as /api/changes shows it
+	Mine      bool       `json:"mine"` // Started by the caller
+	StartedAt time.Time  `json:"started_at"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"` // Unknown on replicas not running the queue
+}
+
+type changesDevice struct { // A device's motor, as /api/changes shows it
+	State    string `json:"state"`
+	ShutDown bool   `json:"shut_down,omitempty"`
+}
+
+// Changes returns the sections of the caller's state (queue, session, motor, devices,
+// shutdown) that differ from the cursor in ?since=, and the cursor to pass next time.
+// Without since every section is returned. If nothing has changed it waits up to ?wait=
+// ("30s" or seconds, at most 60s; default 30s) and answers 204 if nothing changes.
+func Changes(c *gin.Context) {
+	wait := changesDefaultWait
+	if v := c.Query("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if n, nerr := strconv.Atoi(v); nerr == nil { // Bare seconds
+			d, err = time.Duration(n)*time.Second, nil
+		}
+		if err != nil || d < 0 || d > changesMaxWait {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("wait must be a duration up to %s, e.g. 30s", changesMaxWait)})
+			return
+		}
+		wait = d
+	}
+	since := strings.Split(c.Query("since"), ".")
+	ctx := c.Request.Context()
+	deadline := time.Now().Add(wait)
+	http.NewResponseController(c.Writer).SetWriteDeadline(deadline.Add(10 * time.Second)) // Longer than the server's, for long waits
+
+	var wake <-chan []byte
+	if hub != nil {
+		client := hub.Register(orgOf(c), false, realtimeTopics...)
+		defer hub.Unregister(client)
+		wake = client.Send()
+	}
+	for {
+		sections, err := changesState(ctx, c.MustGet("userID").(uint), orgOf(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load state"})
+			return
+		}
+		hashes := make([]string, len(changesSections))
+		out := gin.H{}
+		for i, name := range changesSections {
+			data, _ := json.Marshal(sections[name])
+			h := fnv.New32a()
+			h.Write(data)
+			hashes[i] = hex.EncodeToString(h.Sum(nil))
+			if i >= len(since) || since[i] != hashes[i] {
+				out[name] = sections[name]
+			}
+		}
+		if len(out) > 0 {
+			out["cursor"] = strings.Join(hashes, ".")
+			c.JSON(http.StatusOK, out)
+			return
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		timer := time.NewTimer(min(left, changesPoll))
+		select {
+		case <-wake:
+		case <-timer.C:
+		case <-ctx.Done(): // Client gone
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// changesState returns each section of userID's state, in organization orgID.
+func changesState(ctx context.Context, userID, orgID uint) (map[string]any, error) {
+	st, err := motorService.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	positions := []int{} // 1-based places of the caller's queued runs
+	for i, req := range st.Queued {
+		if req.UserID == userID {
+			positions = append(positions, i+1)
+		}
+	}
+	var session *changesSession
+	switch {
+	case st.Current != nil:
+		ends := st.Current.StartedAt.Add(st.Current.Request.Duration)
+		session = &changesSession{Mine: st.Current.Request.UserID == userID, StartedAt: st.Current.StartedAt, EndsAt: &ends}
+	case st.Interlock != nil:
+		session = &changesSession{Mine: st.Interlock.UserID == userID, StartedAt: st.Interlock.Since}
+	}
+	db := database.DB.WithContext(ctx)
+	var org models.Organization
+	if err := db.Select("id", "slug").Limit(1).Find(&org, orgID).Error; err != nil {
+		return nil, err
+	}
+	var devices []models.Device
+	if err := db.Where("organization_id = ?", orgID).Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	states := make(map[string]changesDevice, len(devices))
+	for _, d := range devices {
+		states[d.Name] = changesDevice{State: motorService.MotorState(motorKey(org.Slug, d.Name)).State, ShutDown: d.ShutDown(now)}
+	}
+	shutdown := gin.H{"active": st.Shutdown.Active}
+	if st.Shutdown.Active {
+		shutdown["reason"] = st.Shutdown.Summary()
+		if !st.Shutdown.Until.IsZero() {
+			shutdown["until"] = st.Shutdown.Until
+		}
+	}
+	return map[string]any{
+		"queue":    gin.H{"length": st.QueueLength, "positions": positions},
+		"session":  session,
+		"motor":    st.Motor.State,
+		"devices":  states,
+		"shutdown": shutdown,
+	}, nil
+}
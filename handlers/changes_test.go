@@ -0,0 +1,80 @@
+// changes_test.go - Tests for the long-poll changes endpoint
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"context"                  // For the motor service
+	"encoding/json"            // Response bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User and device models
+	"go-mqtt-backend/realtime" // Live updates that wake a waiting poll
+	"go-mqtt-backend/services" // Enqueue options
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"testing"                  // Go's testing package
+	"time"                     // Waits
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestChanges checks that the first poll returns every section, later ones only what
+// changed since their cursor, and that a waiting poll wakes on a live update
+func TestChanges(t *testing.T) {
+	setupTestDB()
+	svc := useTestMotor(5)
+	user := models.User{Email: "gateway@example.com", Password: "x", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&user).Error)
+	require.NoError(t, database.DB.Create(&models.Device{OrganizationID: database.DefaultOrgID, Name: "pump-1"}).Error)
+	r := gin.New()
+	r.GET("/api/changes", func(c *gin.Context) { c.Set("userID", user.ID); c.Set("orgID", database.DefaultOrgID) }, Changes)
+	poll := func(query string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/changes?"+query, nil)
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	code, out := poll("")
+	require.Equal(t, http.StatusOK, code)
+	for _, section := range changesSections {
+		assert.Contains(t, out, section)
+	}
+	assert.Nil(t, out["session"])
+	assert.Equal(t, map[string]any{"pump-1": map[string]any{"state": services.MotorOff}}, out["devices"])
+	cursor := out["cursor"].(string)
+
+	code, _ = poll("since=" + cursor + "&wait=0")
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = poll("since=" + cursor + "&wait=2m")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	_, err := svc.EnqueueWith(context.Background(), user.ID, 5*time.Minute, services.EnqueueOptions{})
+	require.NoError(t, err)
+	code, out = poll("since=" + cursor + "&wait=0")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]any{"length": 1.0, "positions": []any{1.0}}, out["queue"])
+	assert.NotContains(t, out, "motor")
+	assert.NotEqual(t, cursor, out["cursor"])
+	cursor = out["cursor"].(string)
+
+	UseHub(realtime.NewHub(8))
+	defer UseHub(nil)
+	changesPoll = time.Hour // Only the live update can wake it
+	defer func() { changesPoll = 5 * time.Second }()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		svc.Commanded("default/pump-1", services.CommandOn)
+		publishEvent(TopicMotor, database.DefaultOrgID, gin.H{"motor": "default/pump-1"})
+	}()
+	start := time.Now()
+	code, out = poll("since=" + cursor + "&wait=10")
+	require.Equal(t, http.StatusOK, code)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, map[string]any{"pump-1": map[string]any{"state": services.MotorRunning}}, out["devices"])
+	assert.NotContains(t, out, "queue")
+}
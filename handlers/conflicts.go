@@ -0,0 +1,159 @@
+// conflicts.go - Checks a schedule against the daily quota and other planned runs
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"fmt"                      // For messages
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Schedule models
+	"sort"                     // Ordering occurrences
+	"time"                     // Occurrence times
+)
+
+const ( // Kinds of schedule conflict
+	ConflictUserQuota  = "user_quota"  // The caller's own planned runs exceed the quota in some 24h
+	ConflictMotorQuota = "motor_quota" // Everyone's planned runs exceed the motor's quota in some 24h
+	ConflictOverlap    = "overlap"     // A run would start while another planned run is still going
+)
+
+// conflictHorizon is how far ahead runs are projected. A week covers weekday patterns.
+var conflictHorizon = 7 * 24 * time.Hour
+
+const conflictMaxRuns = 20000 // Occurrences projected at most (an every-minute schedule is ~10k a week)
+
+type ScheduleConflict struct { // One problem found with a schedule
+	Kind             string    `json:"kind"`
+	Message          string    `json:"message"`
+	At               time.Time `json:"at"`                          // Start of the overloaded 24 hours, or the overlapping run
+	ProjectedMinutes int       `json:"projected_minutes,omitempty"` // Quota kinds: planned runtime in those 24 hours
+	LimitMinutes     int       `json:"limit_minutes,omitempty"`     // Quota kinds: the daily quota
+	ScheduleID       uint      `json:"schedule_id,omitempty"`       // Overlap with one of the caller's own schedules
+	ScheduleName     string    `json:"schedule_name,omitempty"`     // Its name, or "one-time" for a booked run
+}
+
+type occurrence struct { // One planned run
+	At        time.Time
+	Duration  time.Duration
+	UserID    uint
+	Schedule  models.Schedule // Zero for one-time runs
+	Candidate bool            // A run of the schedule being checked
+}
+
+// scheduleConflicts projects every enabled schedule and pending one-time run over the next
+// conflictHorizon with s in place of its saved version. Quota conflicts are 24-hour windows
+// containing a run of s where the caller's runs, or everyone's, add up to more than the
+// daily quota (the quota period can start at any time, so every window counts). Overlaps
+// are runs of s that start while another planned run is going; the queue would delay them.
+func scheduleConflicts(ctx context.Context, s models.Schedule) (quota, overlaps []ScheduleConflict, err error) {
+	if !s.Enabled {
+		return nil, nil, nil
+	}
+	db := database.DB.WithContext(ctx)
+	var others []models.Schedule
+	if err := db.Where("enabled = ? AND id <> ?", true, s.ID).Find(&others).Error; err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	to := now.Add(conflictHorizon)
+	var oneTime []models.ScheduledRequest
+	if err := db.Where("status = ? AND start_at >= ? AND start_at < ?", models.ScheduledPending, now, to.Add(24*time.Hour)).Find(&oneTime).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var runs []occurrence
+	for _, r := range upcomingRuns(append(others, s), now, to.Add(24*time.Hour), conflictMaxRuns) {
+		runs = append(runs, occurrence{At: r.At, Duration: r.Schedule.Duration, UserID: r.Schedule.UserID, Schedule: r.Schedule, Candidate: r.Schedule.ID == s.ID})
+	}
+	for _, r := range oneTime {
+		runs = append(runs, occurrence{At: r.StartAt, Duration: r.Duration, UserID: r.UserID})
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].At.Before(runs[j].At) })
+
+	limit := motorService.Quota()
+	worstUser, worstMotor := quotaWindow{}, quotaWindow{}
+	for i, r := range runs {
+		if !r.At.Before(to) {
+			break
+		}
+		w := quotaWindow{At: r.At}
+		var user time.Duration
+		for _, o := range runs[i:] {
+			if !o.At.Before(r.At.Add(24 * time.Hour)) {
+				break
+			}
+			w.Total += o.Duration
+			w.HasCandidate = w.HasCandidate || o.Candidate
+			if o.UserID == s.UserID {
+				user += o.Duration
+			}
+		}
+		if !w.HasCandidate {
+			continue
+		}
+		if user > worstUser.Total {
+			worstUser = quotaWindow{At: r.At, Total: user}
+		}
+		if w.Total > worstMotor.Total {
+			worstMotor = w
+		}
+	}
+	if worstUser.Total > limit {
+		quota = append(quota, ScheduleConflict{
+			Kind:             ConflictUserQuota,
+			Message:          fmt.Sprintf("your runs add up to %d minutes in the 24 hours from %s; the daily quota is %d", int(worstUser.Total.Minutes()), worstUser.At.Format(time.RFC3339), int(limit.Minutes())),
+			At:               worstUser.At,
+			ProjectedMinutes: int(worstUser.Total.Minutes()),
+			LimitMinutes:     int(limit.Minutes()),
+		})
+	}
+	if worstMotor.Total > limit {
+		quota = append(quota, ScheduleConflict{
+			Kind:             ConflictMotorQuota,
+			Message:          fmt.Sprintf("all planned runs add up to %d minutes in the 24 hours from %s; the motor's daily quota is %d", int(worstMotor.Total.Minutes()), worstMotor.At.Format(time.RFC3339), int(limit.Minutes())),
+			At:               worstMotor.At,
+			ProjectedMinutes: int(worstMotor.Total.Minutes()),
+			LimitMinutes:     int(limit.Minutes()),
+		})
+	}
+
+	var longest time.Duration // Bounds how far back an overlapping run can start
+	for _, r := range runs {
+		longest = max(longest, r.Duration)
+	}
+	seen := make(map[uint]bool) // Report each schedule once; one-time runs every time
+	for _, r := range runs {
+		if !r.Candidate || !r.At.Before(to) {
+			continue
+		}
+		first := sort.Search(len(runs), func(i int) bool { return runs[i].At.After(r.At.Add(-longest)) })
+		for _, o := range runs[first:] {
+			if !o.At.Before(r.At.Add(r.Duration)) {
+				break
+			}
+			if o.Candidate || !o.At.Add(o.Duration).After(r.At) || (o.Schedule.ID != 0 && seen[o.Schedule.ID]) {
+				continue
+			}
+			seen[o.Schedule.ID] = true
+			c := ScheduleConflict{Kind: ConflictOverlap, At: r.At}
+			switch {
+			case o.UserID != s.UserID:
+				c.Message = fmt.Sprintf("the run at %s overlaps another user's run and will wait in the queue", r.At.Format(time.RFC3339))
+			case o.Schedule.ID == 0:
+				c.ScheduleName = "one-time"
+				c.Message = fmt.Sprintf("the run at %s overlaps your one-time run at %s", r.At.Format(time.RFC3339), o.At.Format(time.RFC3339))
+			default:
+				c.ScheduleID, c.ScheduleName = o.Schedule.ID, o.Schedule.Name
+				c.Message = fmt.Sprintf("the run at %s overlaps your schedule %q", r.At.Format(time.RFC3339), o.Schedule.Name)
+			}
+			overlaps = append(overlaps, c)
+		}
+	}
+	return quota, overlaps, nil
+}
+
+type quotaWindow struct { // Planned runtime in the 24 hours from At
+	At           time.Time
+	Total        time.Duration
+	HasCandidate bool
+}
@@ -0,0 +1,203 @@
+// control.go - Where motors may be controlled from: allowed networks and a geofence
+//
+// With CONTROL_ALLOWED_NETWORKS or CONTROL_GEOFENCE_METERS set, running the motor, sending
+// device commands and changing what runs later (schedules, rules) is only accepted from a
+// client IP in one of the networks, or from a client reporting coordinates within the
+// geofence around SITE_LOCATION, so a stolen phone can't run the pump from another city.
+// Switching a motor off is allowed from anywhere. Admins are never restricted and can
+// exempt a user for a while with a control override. The location is what the app
+// reports, so it stops someone using a stolen phone's app, not someone forging requests;
+// networks are the stronger check.
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"fmt"                        // Messages and audit details
+	"go-mqtt-backend/config"     // Coordinate parsing
+	"go-mqtt-backend/database"   // Database connection
+	"go-mqtt-backend/middleware" // User lookups
+	"go-mqtt-backend/models"     // Override and user models
+	"log/slog"                   // Leveled logging
+	"math"                       // Distances
+	"net"                        // Networks
+	"net/http"                   // HTTP status codes
+	"strings"                    // Messages
+	"time"                       // Expiry
+
+	"github.com/gin-gonic/gin" // Gin web framework
+	"gorm.io/gorm/clause"      // Upserts
+)
+
+const ClientLocationHeader = "X-Client-Location" // "latitude,longitude" of the client, for the geofence
+
+const earthRadius = 6371000.0 // Mean radius of the Earth in meters
+
+type ControlOverrideInput struct { // Struct for exempting a user from the control restrictions
+	ExpiresAt *time.Time `json:"expires_at"`                        // RFC 3339, in the future (omit for no expiry)
+	Reason    string     `json:"reason" binding:"required,max=255"` // Recorded in the audit log
+}
+
+type ControlOverrideResponse struct { // A control override as returned by the API
+	UserID    uint       `json:"user_id"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Reason    string     `json:"reason"`
+	SetBy     uint       `json:"set_by"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// ControlGuard refuses the request with a 403 unless the caller may control motors from
+// where they are. Use it on routes that run motors or plan runs.
+func ControlGuard(c *gin.Context) {
+	if !controlAllowed(c) {
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// controlAllowed reports whether the caller may control motors from where they are. If
+// not, it has responded and recorded the attempt in the audit log.
+func controlAllowed(c *gin.Context) bool {
+	reason, err := controlRefusal(c)
+	if err != nil {
+		slog.Error("control restriction check failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not check where the request comes from"})
+		return false
+	}
+	if reason == "" {
+		return true
+	}
+	userID := c.MustGet("userID").(uint)
+	location := c.GetHeader(ClientLocationHeader)
+	if location == "" {
+		location = "unknown"
+	}
+	slog.Warn("motor control refused", "user_id", userID, "ip", c.ClientIP(), "location", location, "route", c.FullPath())
+	recordAudit(c.Request.Context(), userID, "control_refused", fmt.Sprintf("%s %s from %s, location %s", c.Request.Method, c.FullPath(), c.ClientIP(), location))
+	c.JSON(http.StatusForbidden, gin.H{"error": reason})
+	return false
+}
+
+// controlRefusal returns why the caller may not control motors from where they are ("" if
+// they may): their IP is outside the allowed networks and their reported location outside
+// the geofence, and they are neither an admin nor exempted by a control override.
+func controlRefusal(c *gin.Context) (string, error) {
+	cfg := appConfig
+	if cfg == nil || !cfg.ControlRestricted() {
+		return "", nil
+	}
+	ip := net.ParseIP(c.ClientIP())
+	for _, network := range cfg.ControlNetworks {
+		if inNetwork(ip, network) {
+			return "", nil
+		}
+	}
+	if cfg.ControlGeofence > 0 {
+		siteLat, siteLon, _, _ := cfg.SiteCoordinates() // Checked by Validate
+		if lat, lon, ok := config.ParseCoordinates(c.GetHeader(ClientLocationHeader)); ok && distance(lat, lon, siteLat, siteLon) <= cfg.ControlGeofence {
+			return "", nil
+		}
+	}
+	ctx := c.Request.Context()
+	userID := c.MustGet("userID").(uint)
+	user, err := middleware.LookupUser(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if user.Role == models.RoleAdmin {
+		return "", nil
+	}
+	var o models.ControlOverride
+	if err := database.DB.WithContext(ctx).Limit(1).Find(&o, "user_id = ?", userID).Error; err != nil {
+		return "", err
+	}
+	if o.Active(time.Now()) {
+		return "", nil
+	}
+	var where []string
+	if len(cfg.ControlNetworks) > 0 {
+		where = append(where, "from the farm's network")
+	}
+	if cfg.ControlGeofence > 0 {
+		where = append(where, fmt.Sprintf("within %g m of the farm with location sharing on", cfg.ControlGeofence))
+	}
+	return "motor control is only allowed " + strings.Join(where, " or "), nil
+}
+
+func inNetwork(ip net.IP, network string) bool { // Reports whether ip is network (an IP or a CIDR)
+	if ip == nil {
+		return false
+	}
+	if _, n, err := net.ParseCIDR(network); err == nil {
+		return n.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(network))
+}
+
+// distance returns the great-circle distance in meters between two points given in degrees.
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func controlOverrideAudit(o models.ControlOverride, email string) string { // Audit detail of an override
+	until := "until removed"
+	if o.ExpiresAt != nil {
+		until = "until " + o.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("user %d (%s) may control motors from anywhere %s: %s", o.UserID, email, until, o.Reason)
+}
+
+// SetControlOverride lets a user control motors from outside the allowed networks and the
+// geofence until expires_at or until removed. It replaces any override the user already
+// has and is recorded in the audit log.
+func SetControlOverride(c *gin.Context) {
+	var input ControlOverrideInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var user models.User
+	if err := db.Select("id", "email").Limit(1).Find(&user, c.Param("id")).Error; err != nil || user.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	o := models.ControlOverride{UserID: user.ID, ExpiresAt: input.ExpiresAt, Reason: input.Reason, SetBy: c.MustGet("userID").(uint), UpdatedAt: now}
+	if err := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&o).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save control override"})
+		return
+	}
+	recordAudit(c.Request.Context(), o.SetBy, "control_override", controlOverrideAudit(o, user.Email))
+	c.JSON(http.StatusOK, ControlOverrideResponse{o.UserID, o.ExpiresAt, o.Reason, o.SetBy, o.UpdatedAt})
+}
+
+// DeleteControlOverride removes a user's control override, so the restrictions apply to
+// them again.
+func DeleteControlOverride(c *gin.Context) {
+	db := database.DB.WithContext(c.Request.Context())
+	var o models.ControlOverride
+	if err := db.Limit(1).Find(&o, "user_id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not remove control override"})
+		return
+	}
+	if o.UserID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user has no control override"})
+		return
+	}
+	if err := db.Delete(&o).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not remove control override"})
+		return
+	}
+	var user models.User
+	db.Select("id", "email").Limit(1).Find(&user, o.UserID)
+	recordAudit(c.Request.Context(), c.MustGet("userID").(uint), "control_override_removed", controlOverrideAudit(o, user.Email))
+	c.JSON(http.StatusOK, gin.H{"message": "control override removed"})
+}
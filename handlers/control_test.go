@@ -0,0 +1,83 @@
+// control_test.go - Tests for the control restrictions and control overrides
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"go-mqtt-backend/config"   // Restrictions
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User, override and audit models
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"strconv"                  // User IDs in paths
+	"testing"                  // Go's testing package
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestControlRestrictions checks that motor control is only accepted from the allowed
+// networks or within the geofence, unless the caller is an admin or has an override
+func TestControlRestrictions(t *testing.T) {
+	setupTestDB()
+	admin := models.User{Email: "admin@example.com", Password: "x", Role: models.RoleAdmin, OrganizationID: database.DefaultOrgID}
+	member := models.User{Email: "member@example.com", Password: "x", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&[]*models.User{&admin, &member}).Error)
+	cfg := config.Load()
+	UseConfig(cfg)
+	defer UseConfig(config.Load())
+
+	r := gin.New()
+	as := func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.GetHeader("X-Test-User"))
+		c.Set("userID", uint(id))
+	}
+	r.POST("/motor", as, ControlGuard, func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.PUT("/admin/users/:id/control", as, SetControlOverride)
+	r.DELETE("/admin/users/:id/control", as, DeleteControlOverride)
+	call := func(method, path string, user models.User, ip, location, body string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.RemoteAddr = ip + ":40000"
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Test-User", strconv.Itoa(int(user.ID)))
+		if location != "" {
+			req.Header.Set(ClientLocationHeader, location)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	run := func(user models.User, ip, location string) int { return call("POST", "/motor", user, ip, location, "") }
+
+	assert.Equal(t, 200, run(member, "198.51.100.9", "")) // No restrictions configured
+
+	cfg.ControlNetworks = []string{"203.0.113.0/24", "192.0.2.7"}
+	cfg.ControlGeofence, cfg.SiteLocation = 500, "31.5204,74.3587"
+	assert.Equal(t, 200, run(member, "203.0.113.40", ""))
+	assert.Equal(t, 200, run(member, "192.0.2.7", ""))
+	assert.Equal(t, 200, run(member, "198.51.100.9", "31.5230,74.3600")) // About 300 m away
+	assert.Equal(t, 403, run(member, "198.51.100.9", "31.5820,74.3290")) // Across the city
+	assert.Equal(t, 403, run(member, "198.51.100.9", "somewhere"))
+	assert.Equal(t, 403, run(member, "198.51.100.9", ""))
+	assert.Equal(t, 200, run(admin, "198.51.100.9", ""))
+	var refused int64
+	database.DB.Model(&models.AuditLog{}).Where("action = ? AND user_id = ?", "control_refused", member.ID).Count(&refused)
+	assert.EqualValues(t, 3, refused)
+
+	path := "/admin/users/" + strconv.Itoa(int(member.ID)) + "/control"
+	assert.Equal(t, 400, call("PUT", path, admin, "192.0.2.7", "", `{}`)) // No reason
+	assert.Equal(t, 400, call("PUT", path, admin, "192.0.2.7", "", `{"reason":"travelling","expires_at":"2020-01-01T00:00:00Z"}`))
+	assert.Equal(t, 200, call("PUT", path, admin, "192.0.2.7", "", `{"reason":"travelling","expires_at":"2999-01-01T00:00:00Z"}`))
+	assert.Equal(t, 200, run(member, "198.51.100.9", ""))
+	require.NoError(t, database.DB.Model(&models.ControlOverride{}).Where("user_id = ?", member.ID).Update("expires_at", "2020-01-01 00:00:00").Error)
+	assert.Equal(t, 403, run(member, "198.51.100.9", "")) // Lapsed
+	assert.Equal(t, 200, call("DELETE", path, admin, "192.0.2.7", "", ""))
+	assert.Equal(t, 404, call("DELETE", path, admin, "192.0.2.7", "", ""))
+	var audited int64
+	database.DB.Model(&models.AuditLog{}).Where("action IN ?", []string{"control_override", "control_override_removed"}).Count(&audited)
+	assert.EqualValues(t, 2, audited)
+
+	assert.InDelta(t, 111195, distance(0, 0, 1, 0), 1) // One degree of latitude
+}
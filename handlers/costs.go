@@ -0,0 +1,96 @@
+// costs.go - Energy, water and cost estimates for motor runs from pump ratings and tariffs
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Device, user and activation models
+	"log/slog"                 // Leveled logging
+	"time"                     // Months
+)
+
+// pumpOf returns the device whose ratings cost an organization's runs: its first device
+// with a power rating or flow rate. ID is 0 when it has none.
+func pumpOf(ctx context.Context, orgID uint) (models.Device, error) {
+	var d models.Device
+	err := database.DB.WithContext(ctx).Where("organization_id = ? AND (power_kw > 0 OR flow_lpm > 0)", orgID).Order("id").Limit(1).Find(&d).Error
+	return d, err
+}
+
+// estimateRun is the energy (kWh), water (liters) and cost of running pump for d.
+func estimateRun(pump models.Device, d time.Duration) (kwh, liters, cost float64) {
+	kwh = pump.PowerKW * d.Hours()
+	liters = pump.FlowLPM * d.Minutes()
+	return kwh, liters, kwh*pump.EnergyTariff + liters/1000*pump.WaterTariff
+}
+
+// EstimateActivation attributes an accepted motor request to the requester's
+// organization and fills in the estimates for its requested duration from the
+// organization's pump. It is the MotorService Estimate hook; a failed lookup leaves the
+// estimates empty rather than refusing the request.
+func EstimateActivation(ctx context.Context, a *models.DeviceActivation) {
+	var user models.User
+	if err := database.DB.WithContext(ctx).Select("id", "organization_id").Limit(1).Find(&user, a.UserID).Error; err != nil || user.ID == 0 {
+		slog.Error("cost estimate failed: user not found", "user_id", a.UserID, "error", err)
+		return
+	}
+	a.OrganizationID = user.OrganizationID
+	pump, err := pumpOf(ctx, user.OrganizationID)
+	if err != nil {
+		slog.Error("cost estimate failed", "organization_id", user.OrganizationID, "error", err)
+		return
+	}
+	if pump.ID == 0 {
+		return
+	}
+	a.DeviceID = &pump.ID
+	a.EnergyKWh, a.Liters, a.Cost = estimateRun(pump, a.Duration)
+}
+
+type runTotals struct { // Summed estimates of an organization's runs in a month
+	EnergyKWh float64
+	Liters    float64
+	Cost      float64
+}
+
+type orgMonth struct {
+	OrganizationID uint
+	Month          string
+}
+
+// activationTotals sums the estimates of activations requested in the months from..to
+// (inclusive, "2006-01"), by organization and month. It reads the precomputed daily
+// totals, not the activations themselves.
+func activationTotals(ctx context.Context, from, to string, orgID string) (map[orgMonth]runTotals, error) {
+	start, err := time.Parse(usageMonthLayout, from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := time.Parse(usageMonthLayout, to)
+	if err != nil {
+		return nil, err
+	}
+	q := database.DB.WithContext(ctx).Model(&models.DailyTotal{}).
+		Where("day >= ? AND day < ?", start.Format(models.DailyTotalLayout), end.AddDate(0, 1, 0).Format(models.DailyTotalLayout))
+	if orgID != "" {
+		q = q.Where("organization_id = ?", orgID)
+	}
+	var rows []struct {
+		OrganizationID uint
+		Month          string
+		EnergyKWh      float64 `gorm:"column:energy_kwh"`
+		Liters         float64
+		Cost           float64
+	}
+	err = q.Select("organization_id, SUBSTR(day, 1, 7) AS month, SUM(energy_kwh) AS energy_kwh, SUM(liters) AS liters, SUM(cost) AS cost").
+		Group("organization_id, SUBSTR(day, 1, 7)").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[orgMonth]runTotals, len(rows))
+	for _, r := range rows {
+		totals[orgMonth{r.OrganizationID, r.Month}] = runTotals{r.EnergyKWh, r.Liters, r.Cost}
+	}
+	return totals, nil
+}
@@ -0,0 +1,218 @@
+// devices.go - Device registry and the per-tenant "{org}/{device}/..." MQTT namespace
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                    // For DB lookups
+	"errors"                     // Namespace errors
+	"go-mqtt-backend/database"   // Database connection
+	"go-mqtt-backend/middleware" // Cached user roles
+	"go-mqtt-backend/models"     // Device and organization models
+	"go-mqtt-backend/services"   // Motor states
+	"log"                        // Logging
+	"net/http"                   // HTTP status codes
+	"strings"                    // Topic parsing
+	"time"                       // Last seen times
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+var errUnknownDevice = errors.New("topic is not under a registered device") // Topic outside every tenant namespace
+
+type PumpRatings struct { // Pump ratings and tariffs of a device, used for cost estimates (0 when unknown)
+	PowerKW      float64 `json:"power_kw" binding:"min=0"`      // Power draw in kW
+	FlowLPM      float64 `json:"flow_lpm" binding:"min=0"`      // Liters per minute
+	EnergyTariff float64 `json:"energy_tariff" binding:"min=0"` // Price of a kWh
+	WaterTariff  float64 `json:"water_tariff" binding:"min=0"`  // Price of a cubic meter of water
+}
+
+type SafetyLimits struct { // Readings that stop a device's motor and put it in FAULT (0 for no limit)
+	MaxTempC    float64 `json:"max_temp_c" binding:"min=0"`    // On {org}/{device}/sensors/motor_temperature
+	MaxCurrentA float64 `json:"max_current_a" binding:"min=0"` // On {org}/{device}/sensors/motor_current
+}
+
+type DeviceSettings struct { // Struct for updating a device
+	Group string `json:"group" binding:"omitempty,max=64"` // Optional group, e.g. "north-field"
+	PumpRatings
+	SafetyLimits
+}
+
+type DeviceInput struct { // Struct for registering a device
+	Name string `json:"name" binding:"required"` // Topic segment: lowercase letters, digits and dashes
+	DeviceSettings
+}
+
+type DeviceResponse struct { // A device as returned by the API
+	ID         uint                     `json:"id"`
+	Name       string                   `json:"name"`
+	Topic      string                   `json:"topic"` // Namespace the device publishes and listens under
+	LastSeenAt *time.Time               `json:"last_seen_at,omitempty"`
+	CreatedAt  time.Time                `json:"created_at"`
+	Group      string                   `json:"group,omitempty"`
+	Motor      *services.MotorStateInfo `json:"motor,omitempty"`    // State of the device's motor
+	Shutdown   *DeviceShutdown          `json:"shutdown,omitempty"` // Set while the device is shut down
+	PumpRatings
+	SafetyLimits
+}
+
+func deviceResponse(org models.Organization, d models.Device) DeviceResponse {
+	resp := DeviceResponse{
+		ID: d.ID, Name: d.Name, Topic: DeviceTopic(org.Slug, d.Name, "#"), LastSeenAt: d.LastSeenAt, CreatedAt: d.CreatedAt, Group: d.Group,
+		PumpRatings:  PumpRatings{PowerKW: d.PowerKW, FlowLPM: d.FlowLPM, EnergyTariff: d.EnergyTariff, WaterTariff: d.WaterTariff},
+		SafetyLimits: SafetyLimits{MaxTempC: d.MaxTempC, MaxCurrentA: d.MaxCurrentA},
+	}
+	if motorService != nil {
+		st := motorService.MotorState(motorKey(org.Slug, d.Name))
+		resp.Motor = &st
+	}
+	if d.ShutDown(time.Now()) {
+		sd := deviceShutdown(org, d)
+		resp.Shutdown = &sd
+	}
+	return resp
+}
+
+func isGlobalAdmin(c *gin.Context) bool { // Whether the caller has the deployment-wide admin role
+	user, err := middleware.LookupUser(c.Request.Context(), c.MustGet("userID").(uint))
+	return err == nil && user.Role == models.RoleAdmin
+}
+
+// DeviceTopic builds a topic in a device's namespace, e.g. "green-acres/pump-1/motor".
+func DeviceTopic(orgSlug, device, suffix string) string {
+	return orgSlug + "/" + device + "/" + suffix
+}
+
+// resolveDevice splits a "{org}/{device}/rest" topic and looks the device up in the
+// registry. It returns errUnknownDevice unless the organization exists and owns the device.
+func resolveDevice(ctx context.Context, topic string) (models.Organization, models.Device, string, error) {
+	var org models.Organization
+	var dev models.Device
+	parts := strings.SplitN(topic, "/", 3)
+	if len(parts) < 3 || parts[2] == "" {
+		return org, dev, "", errUnknownDevice
+	}
+	db := database.DB.WithContext(ctx)
+	if err := db.Where("slug = ?", parts[0]).Limit(1).Find(&org).Error; err != nil {
+		return org, dev, "", err
+	}
+	if org.ID == 0 {
+		return org, dev, "", errUnknownDevice
+	}
+	if err := db.Where("organization_id = ? AND name = ?", org.ID, parts[1]).Limit(1).Find(&dev).Error; err != nil {
+		return org, dev, "", err
+	}
+	if dev.ID == 0 {
+		return org, dev, "", errUnknownDevice
+	}
+	return org, dev, parts[2], nil
+}
+
+func ListDevices(c *gin.Context) { // Handler listing the caller's organization's devices
+	db := database.DB.WithContext(c.Request.Context())
+	var org models.Organization
+	if err := db.First(&org, orgOf(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+		return
+	}
+	var devices []models.Device
+	if err := db.Where("organization_id = ?", org.ID).Order("name").Find(&devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load devices"})
+		return
+	}
+	out := make([]DeviceResponse, len(devices))
+	for i, d := range devices {
+		out[i] = deviceResponse(org, d)
+	}
+	c.JSON(http.StatusOK, gin.H{"devices": out})
+}
+
+func CreateDevice(c *gin.Context) { // Org admin handler registering a device in the caller's organization
+	var input DeviceInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !slugPattern.MatchString(input.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name must be 2-64 lowercase letters, digits or dashes"})
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var org models.Organization
+	if err := db.First(&org, orgOf(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+		return
+	}
+	var taken int64
+	if err := db.Model(&models.Device{}).Where("organization_id = ? AND name = ?", org.ID, input.Name).Count(&taken).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save device"})
+		return
+	}
+	if taken > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a device with that name already exists"})
+		return
+	}
+	var count int64
+	if err := db.Model(&models.Device{}).Where("organization_id = ?", org.ID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save device"})
+		return
+	}
+	if !requireRoom(c, "devices", count, maxDevices) {
+		return
+	}
+	d := models.Device{
+		OrganizationID: org.ID, Name: input.Name, Group: input.Group,
+		PowerKW: input.PowerKW, FlowLPM: input.FlowLPM, EnergyTariff: input.EnergyTariff, WaterTariff: input.WaterTariff,
+		MaxTempC: input.MaxTempC, MaxCurrentA: input.MaxCurrentA,
+	}
+	if err := db.Create(&d).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save device"})
+		return
+	}
+	log.Printf("device %q registered in organization %q by user %v", d.Name, org.Slug, c.MustGet("userID"))
+	meterDevices(c.Request.Context(), org.ID, d.CreatedAt, count+1)
+	c.JSON(http.StatusCreated, deviceResponse(org, d))
+}
+
+// UpdateDevice replaces a device's group, pump ratings, tariffs and safety limits. Runs already
+// logged keep the estimates they were given.
+func UpdateDevice(c *gin.Context) {
+	var input DeviceSettings
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var org models.Organization
+	if err := db.First(&org, orgOf(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+		return
+	}
+	var d models.Device
+	if err := db.Where("id = ? AND organization_id = ?", c.Param("id"), org.ID).Limit(1).Find(&d).Error; err != nil || d.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	d.PowerKW, d.FlowLPM, d.EnergyTariff, d.WaterTariff = input.PowerKW, input.FlowLPM, input.EnergyTariff, input.WaterTariff
+	d.MaxTempC, d.MaxCurrentA = input.MaxTempC, input.MaxCurrentA
+	d.Group = input.Group
+	if err := db.Model(&d).Select("group_name", "power_kw", "flow_lpm", "energy_tariff", "water_tariff", "max_temp_c", "max_current_a").Updates(&d).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save device"})
+		return
+	}
+	log.Printf("device %q settings updated by user %v", d.Name, c.MustGet("userID"))
+	c.JSON(http.StatusOK, deviceResponse(org, d))
+}
+
+func DeleteDevice(c *gin.Context) { // Org admin handler removing a device; its topics stop being accepted
+	res := database.DB.WithContext(c.Request.Context()).Where("id = ? AND organization_id = ?", c.Param("id"), orgOf(c)).Delete(&models.Device{})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete device"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	log.Printf("device %s deleted by user %v", c.Param("id"), c.MustGet("userID"))
+	c.JSON(http.StatusOK, gin.H{"message": "device deleted"})
+}
@@ -0,0 +1,184 @@
+// devices_test.go - Tests for the device registry and tenant topic namespaces
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"context"                  // For lookups
+	"encoding/json"            // Response bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Device and organization models
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"strconv"                  // IDs in paths
+	"testing"                  // Go's testing package
+	"time"                     // Shutdown ends
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestDevices checks registering devices and that commands can't cross tenant namespaces
+func TestDevices(t *testing.T) {
+	setupTestDB()
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres"}
+	other := models.Organization{Name: "Other Farm", Slug: "other-farm"}
+	require.NoError(t, database.DB.Create(&[]*models.Organization{&farm, &other}).Error)
+	admin := models.User{Email: "boss@example.com", Password: "x", Role: models.RoleOrgAdmin, OrganizationID: farm.ID}
+	require.NoError(t, database.DB.Create(&admin).Error)
+	theirs := models.Device{OrganizationID: other.ID, Name: "pump-1"}
+	require.NoError(t, database.DB.Create(&theirs).Error)
+
+	r := gin.New()
+	setCaller := func(c *gin.Context) { c.Set("userID", admin.ID); c.Set("orgID", farm.ID) }
+	r.GET("/api/org/devices", setCaller, ListDevices)
+	r.POST("/api/org/devices", setCaller, CreateDevice)
+	r.DELETE("/api/org/devices/:id", setCaller, DeleteDevice)
+	r.POST("/api/send", setCaller, SendCommand)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	code, _ := call("POST", "/api/org/devices", `{"name":"Pump 1"}`)
+	assert.Equal(t, 400, code)
+	code, out := call("POST", "/api/org/devices", `{"name":"pump-1"}`) // Same name as another tenant's device is fine
+	require.Equal(t, 201, code)
+	assert.Equal(t, "green-acres/pump-1/#", out["topic"])
+	mine := strconv.Itoa(int(out["id"].(float64)))
+	code, _ = call("POST", "/api/org/devices", `{"name":"pump-1"}`)
+	assert.Equal(t, 409, code)
+	code, out = call("GET", "/api/org/devices", "")
+	require.Equal(t, 200, code)
+	assert.Len(t, out["devices"], 1)
+
+	org, dev, rest, err := resolveDevice(context.Background(), "green-acres/pump-1/motor")
+	require.NoError(t, err)
+	assert.Equal(t, farm.ID, org.ID)
+	assert.Equal(t, "pump-1", dev.Name)
+	assert.Equal(t, "motor", rest)
+	_, _, _, err = resolveDevice(context.Background(), "green-acres/pump-2/motor")
+	assert.ErrorIs(t, err, errUnknownDevice)
+
+	for _, topic := range []string{"esp32/command", "other-farm/pump-1/motor", "green-acres/pump-2/motor"} {
+		code, _ = call("POST", "/api/send", `{"topic":"`+topic+`","payload":"on"}`)
+		assert.Equal(t, 403, code, topic)
+	}
+
+	// A device's motor reports its state; ON is refused while it is in FAULT
+	useTestMotor(5)
+	MotorStatusUpdate("green-acres/pump-1/motor/status", []byte("fault: overheated"))
+	code, out = call("POST", "/api/send", `{"topic":"green-acres/pump-1/motor/control","payload":"on"}`)
+	assert.Equal(t, 409, code)
+	code, out = call("GET", "/api/org/devices", "")
+	require.Equal(t, 200, code)
+	motor := out["devices"].([]any)[0].(map[string]any)["motor"].(map[string]any)
+	assert.Equal(t, "FAULT", motor["state"])
+	assert.Equal(t, "overheated", motor["reason"])
+	r.POST("/admin/motor/clear-fault", setCaller, AdminClearFault)
+	code, _ = call("POST", "/admin/motor/clear-fault", `{"motor":"green-acres/pump-1"}`)
+	assert.Equal(t, 200, code)
+	code, _ = call("POST", "/admin/motor/clear-fault", "") // The shared motor isn't faulted
+	assert.Equal(t, 409, code)
+	require.NoError(t, motorService.LockMotor(context.Background(), "green-acres/pump-1", admin.ID+1)) // Someone else's run
+	code, out = call("POST", "/api/send", `{"topic":"green-acres/pump-1/motor/control","payload":"on"}`)
+	assert.Equal(t, 409, code)
+	assert.Equal(t, "manual", out["interlock"].(map[string]any)["source"])
+
+	code, _ = call("DELETE", "/api/org/devices/"+strconv.Itoa(int(theirs.ID)), "")
+	assert.Equal(t, 404, code)
+	code, _ = call("DELETE", "/api/org/devices/"+mine, "")
+	assert.Equal(t, 200, code)
+	_, _, _, err = resolveDevice(context.Background(), "green-acres/pump-1/motor")
+	assert.ErrorIs(t, err, errUnknownDevice)
+}
+
+// TestDeviceShutdown checks shutting down a device group while other devices keep running
+func TestDeviceShutdown(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres"}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	admin := models.User{Email: "root@example.com", Password: "x", Role: models.RoleAdmin, OrganizationID: farm.ID}
+	require.NoError(t, database.DB.Create(&admin).Error)
+	require.NoError(t, database.DB.Create(&[]models.Device{
+		{OrganizationID: farm.ID, Name: "pump-1", Group: "north"},
+		{OrganizationID: farm.ID, Name: "pump-2", Group: "north"},
+		{OrganizationID: farm.ID, Name: "pump-3", Group: "south"},
+	}).Error)
+
+	r := gin.New()
+	setCaller := func(c *gin.Context) { c.Set("userID", admin.ID); c.Set("orgID", farm.ID) }
+	r.POST("/admin/devices/shutdown", setCaller, AdminShutdownDevices)
+	r.POST("/admin/devices/restart", setCaller, AdminRestartDevices)
+	r.GET("/admin/audit", ListAuditLog)
+	r.GET("/admin/audit/shutdowns", ShutdownStats)
+	r.POST("/api/send", setCaller, SendCommand)
+	r.GET("/api/org/devices", setCaller, ListDevices)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	on := func(device string) int {
+		code, _ := call("POST", "/api/send", `{"topic":"green-acres/`+device+`/motor/control","payload":"on"}`)
+		return code
+	}
+
+	code, _ := call("POST", "/admin/devices/shutdown", `{"org":"green-acres","group":"north"}`)
+	assert.Equal(t, 400, code) // No category
+	code, _ = call("POST", "/admin/devices/shutdown", `{"org":"green-acres","device":"pump-1","group":"north","category":"electrical","reason":"x"}`)
+	assert.Equal(t, 400, code)
+	code, _ = call("POST", "/admin/devices/shutdown", `{"org":"green-acres","group":"west","category":"electrical","reason":"x"}`)
+	assert.Equal(t, 404, code)
+	code, out := call("POST", "/admin/devices/shutdown", `{"org":"green-acres","group":"north","category":"electrical","reason":"faulty wiring","ttl_minutes":60}`)
+	require.Equal(t, 200, code)
+	assert.Len(t, out["devices"], 2)
+	for _, device := range []string{"pump-1", "pump-2", "pump-3"} { // Someone else's runs: an ON past the shutdown check stops at the interlock (409)
+		require.NoError(t, motorService.LockMotor(context.Background(), "green-acres/"+device, admin.ID+1))
+	}
+
+	assert.Equal(t, 503, on("pump-1"))
+	assert.Equal(t, 503, on("pump-2"))
+	assert.Equal(t, 409, on("pump-3")) // The rest of the fleet keeps running
+	_, out = call("GET", "/api/org/devices", "")
+	devices := out["devices"].([]any)
+	assert.Equal(t, "faulty wiring", devices[0].(map[string]any)["shutdown"].(map[string]any)["reason"])
+	assert.Equal(t, "electrical", devices[0].(map[string]any)["shutdown"].(map[string]any)["category"])
+	assert.Nil(t, devices[2].(map[string]any)["shutdown"])
+
+	code, _ = call("POST", "/admin/devices/restart", `{"org":"green-acres","device":"pump-1"}`)
+	assert.Equal(t, 200, code)
+	code, _ = call("POST", "/admin/devices/restart", `{"org":"green-acres","device":"pump-1"}`)
+	assert.Equal(t, 409, code)
+	assert.Equal(t, 409, on("pump-1"))
+
+	database.DB.Model(&models.Device{}).Where("name = ?", "pump-2").Update("shutdown_until", time.Now().Add(-time.Minute)) // Scheduled end passed
+	require.NoError(t, expireDeviceShutdowns(context.Background()))
+	var pump2 models.Device
+	database.DB.Where("name = ?", "pump-2").First(&pump2)
+	assert.Nil(t, pump2.ShutdownSince)
+	assert.Empty(t, pump2.ShutdownCategory)
+
+	_, out = call("GET", "/admin/audit?category=electrical", "") // The shutdown and the scheduled restart
+	assert.Len(t, out["entries"], 2)
+	code, out = call("GET", "/admin/audit/shutdowns", "")
+	require.Equal(t, 200, code)
+	assert.Equal(t, float64(1), out["total"])
+	stats := out["categories"].([]any)
+	require.Len(t, stats, 4) // Every category, also with no shutdowns
+	assert.Equal(t, map[string]any{"category": "electrical", "system": float64(0), "devices": float64(1)}, stats[3])
+	code, _ = call("GET", "/admin/audit/shutdowns?from=yesterday", "")
+	assert.Equal(t, 400, code)
+}
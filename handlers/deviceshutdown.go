@@ -0,0 +1,225 @@
+// deviceshutdown.go - Shutting down one device or a device group while the rest of the fleet keeps running
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Device model
+	"go-mqtt-backend/notify"   // Notification events
+	"go-mqtt-backend/store"    // Shutdown summaries
+	"log"                      // Logging
+	"net/http"                 // HTTP status codes
+	"strings"                  // Device lists
+	"time"                     // Shutdown times
+
+	"github.com/gin-gonic/gin" // Gin web framework
+	"gorm.io/gorm"             // Recipient scopes
+)
+
+type DeviceShutdownInput struct { // Struct for shutting down or restarting devices
+	Org        string     `json:"org" binding:"required"`                                                   // Organization slug
+	Device     string     `json:"device"`                                                                   // One device by name
+	Group      string     `json:"group"`                                                                    // Or every device in a group
+	Category   string     `json:"category" binding:"omitempty,oneof=maintenance safety weather electrical"` // Why, in a word (required to shut down)
+	Reason     string     `json:"reason" binding:"max=255"`                                                 // Details (optional)
+	TTLMinutes int        `json:"ttl_minutes" binding:"omitempty,min=1"`                                    // Restart automatically after this long
+	Until      *time.Time `json:"until"`                                                                    // Or at this time (RFC 3339)
+}
+
+type DeviceShutdown struct { // A device shut down on its own
+	Motor    string     `json:"motor"` // "{org}/{device}"
+	Category string     `json:"category"`
+	Reason   string     `json:"reason,omitempty"`
+	Since    time.Time  `json:"since"`
+	Until    *time.Time `json:"until,omitempty"` // Restarts by itself then
+}
+
+func deviceShutdown(org models.Organization, d models.Device) DeviceShutdown {
+	sd := DeviceShutdown{Motor: motorKey(org.Slug, d.Name), Category: d.ShutdownCategory, Reason: d.ShutdownReason, Until: d.ShutdownUntil}
+	if d.ShutdownSince != nil {
+		sd.Since = *d.ShutdownSince
+	}
+	return sd
+}
+
+// targetDevices loads the devices input names: one device, or every device in a group.
+// It writes the error response and returns false if there are none.
+func targetDevices(c *gin.Context, input DeviceShutdownInput) (models.Organization, []models.Device, bool) {
+	var org models.Organization
+	var devices []models.Device
+	if (input.Device == "") == (input.Group == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "give either device or group"})
+		return org, nil, false
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	if err := db.Where("slug = ?", input.Org).Limit(1).Find(&org).Error; err != nil || org.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+		return org, nil, false
+	}
+	q := db.Where("organization_id = ?", org.ID).Order("name")
+	if input.Device != "" {
+		q = q.Where("name = ?", input.Device)
+	} else {
+		q = q.Where("group_name = ?", input.Group)
+	}
+	if err := q.Find(&devices).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load devices"})
+		return org, nil, false
+	}
+	if len(devices) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no matching devices"})
+		return org, nil, false
+	}
+	return org, devices, true
+}
+
+// AdminShutdownDevices switches off the motors of one device or a device group and
+// refuses ON for them until AdminRestartDevices is called, or until ttl_minutes or until
+// if given. Other devices and the shared motor keep running.
+func AdminShutdownDevices(c *gin.Context) {
+	var input DeviceShutdownInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Category == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "category is required"})
+		return
+	}
+	now := time.Now()
+	until, msg := shutdownEnd(input.TTLMinutes, input.Until, now)
+	if msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	org, devices, ok := targetDevices(c, input)
+	if !ok {
+		return
+	}
+	updates := map[string]any{"shutdown_category": input.Category, "shutdown_reason": input.Reason, "shutdown_since": now, "shutdown_until": nil}
+	if !until.IsZero() {
+		updates["shutdown_until"] = until
+	}
+	ids := make([]uint, len(devices))
+	for i, d := range devices {
+		ids[i] = d.ID
+	}
+	if err := database.DB.WithContext(c.Request.Context()).Model(&models.Device{}).Where("id IN ?", ids).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record shutdown"})
+		return
+	}
+	out := make([]DeviceShutdown, len(devices))
+	names := make([]string, len(devices))
+	for i, d := range devices { // Recorded first, so no ON gets through while the motors stop
+		motorService.StopMotor(c.Request.Context(), motorKey(org.Slug, d.Name))
+		d.ShutdownCategory, d.ShutdownReason, d.ShutdownSince = input.Category, input.Reason, &now
+		if !until.IsZero() {
+			d.ShutdownUntil = &until
+		}
+		out[i], names[i] = deviceShutdown(org, d), d.Name
+	}
+	why := store.Shutdown{Category: input.Category, Reason: input.Reason}.Summary()
+	log.Printf("devices %s of organization %q shut down by user %v: %s", strings.Join(names, ", "), org.Slug, c.MustGet("userID"), why)
+	recordAuditEntry(c.Request.Context(), models.AuditLog{UserID: c.MustGet("userID").(uint), Action: "device_shutdown", Category: input.Category, Detail: org.Slug + ": " + strings.Join(names, ", ") + ": " + why})
+	notifyDeviceShutdown(c.Request.Context(), org, names, map[string]any{"Active": true, "By": userEmail(c.Request.Context(), c.MustGet("userID")), "Category": input.Category, "Reason": why, "Until": until})
+	c.JSON(http.StatusOK, gin.H{"message": "devices shut down", "devices": out})
+}
+
+// AdminRestartDevices ends the shutdown of one device or a device group.
+func AdminRestartDevices(c *gin.Context) {
+	var input DeviceShutdownInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	org, devices, ok := targetDevices(c, input)
+	if !ok {
+		return
+	}
+	var ids []uint
+	var names []string
+	for _, d := range devices {
+		if d.ShutdownSince != nil {
+			ids, names = append(ids, d.ID), append(names, d.Name)
+		}
+	}
+	if len(ids) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "no matching device is shut down"})
+		return
+	}
+	if err := clearDeviceShutdowns(c.Request.Context(), ids); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to clear shutdown"})
+		return
+	}
+	log.Printf("devices %s of organization %q restarted by user %v", strings.Join(names, ", "), org.Slug, c.MustGet("userID"))
+	recordAudit(c.Request.Context(), c.MustGet("userID").(uint), "device_restart", org.Slug+": "+strings.Join(names, ", "))
+	notifyDeviceShutdown(c.Request.Context(), org, names, map[string]any{"Active": false, "By": userEmail(c.Request.Context(), c.MustGet("userID"))})
+	c.JSON(http.StatusOK, gin.H{"message": "devices restarted", "devices": names})
+}
+
+func clearDeviceShutdowns(ctx context.Context, ids []uint) error {
+	return database.DB.WithContext(ctx).Model(&models.Device{}).Where("id IN ?", ids).
+		Updates(map[string]any{"shutdown_category": "", "shutdown_reason": "", "shutdown_since": nil, "shutdown_until": nil}).Error
+}
+
+// shutDownDevices returns every device shut down at now, across organizations.
+func shutDownDevices(ctx context.Context, now time.Time) ([]DeviceShutdown, error) {
+	var devices []models.Device
+	err := database.DB.WithContext(ctx).Where("shutdown_since IS NOT NULL AND (shutdown_until IS NULL OR shutdown_until > ?)", now).Order("organization_id, name").Find(&devices).Error
+	if err != nil {
+		return nil, err
+	}
+	orgs := map[uint]models.Organization{}
+	out := make([]DeviceShutdown, 0, len(devices))
+	for _, d := range devices {
+		org, ok := orgs[d.OrganizationID]
+		if !ok {
+			database.DB.WithContext(ctx).Limit(1).Find(&org, d.OrganizationID)
+			orgs[d.OrganizationID] = org
+		}
+		out = append(out, deviceShutdown(org, d))
+	}
+	return out, nil
+}
+
+// expireDeviceShutdowns restarts devices whose scheduled shutdown has ended and tells
+// the admins and each organization's users.
+func expireDeviceShutdowns(ctx context.Context) error {
+	var devices []models.Device
+	err := database.DB.WithContext(ctx).Where("shutdown_since IS NOT NULL AND shutdown_until <= ?", time.Now()).Order("name").Find(&devices).Error
+	if err != nil || len(devices) == 0 {
+		return err
+	}
+	byOrg := map[uint][]models.Device{}
+	for _, d := range devices {
+		byOrg[d.OrganizationID] = append(byOrg[d.OrganizationID], d)
+	}
+	for orgID, devices := range byOrg {
+		var org models.Organization
+		database.DB.WithContext(ctx).Limit(1).Find(&org, orgID)
+		ids := make([]uint, len(devices))
+		names := make([]string, len(devices))
+		for i, d := range devices {
+			ids[i], names[i] = d.ID, d.Name
+		}
+		if err := clearDeviceShutdowns(ctx, ids); err != nil {
+			return err
+		}
+		why := store.Shutdown{Category: devices[0].ShutdownCategory, Reason: devices[0].ShutdownReason}.Summary()
+		log.Printf("scheduled shutdown of devices %s of organization %q ended: %s", strings.Join(names, ", "), org.Slug, why)
+		recordAuditEntry(ctx, models.AuditLog{Action: "device_restart", Category: devices[0].ShutdownCategory, Detail: org.Slug + ": " + strings.Join(names, ", ") + ": scheduled shutdown ended"})
+		notifyDeviceShutdown(ctx, org, names, map[string]any{"Active": false, "Expired": true, "Category": devices[0].ShutdownCategory, "Reason": why})
+	}
+	return nil
+}
+
+// notifyDeviceShutdown tells the organization's users and every admin that devices were
+// shut down or restarted. data carries Active, Category, Reason, Until, By or Expired.
+func notifyDeviceShutdown(ctx context.Context, org models.Organization, devices []string, data map[string]any) {
+	publishEvent(TopicShutdown, org.ID, gin.H{"organization": org.Slug, "devices": devices, "active": data["Active"], "category": data["Category"], "reason": data["Reason"]})
+	data["Organization"], data["Devices"], data["At"] = org.Name, strings.Join(devices, ", "), time.Now()
+	members := func(db *gorm.DB) *gorm.DB { return usersWithoutRole(models.RoleAdmin)(usersInOrg(org.ID)(db)) } // Admins get the alert instead
+	notifyUsers(ctx, members, notify.EventShutdown, "device_shutdown", data)
+	AlertAdmins(ctx, "device_shutdown", data)
+}
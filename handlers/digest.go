@@ -0,0 +1,135 @@
+// digest.go - Opt-in daily and weekly activity digests
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For cancellation
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Preferences and session log
+	"go-mqtt-backend/notify"   // Event names
+	"go-mqtt-backend/services" // Session outcomes
+	"sort"                     // Merging scheduled runs
+	"time"                     // Digest periods
+)
+
+var digestWeekday = time.Monday // Weekly digests go out on this day
+
+const ( // Digest list lengths
+	digestMaxRejected = 10 // Rejected requests listed individually; the rest are only counted
+	digestMaxUpcoming = 10 // Scheduled runs listed
+)
+
+// SendDigests sends each user who opted in a summary of their motor activity: runs and
+// runtime, runs cut short, requests that were rejected or dropped, and scheduled runs
+// coming up. Daily digests cover the last and next 24 hours, weekly ones 7 days. Users with
+// nothing to report get nothing. It is the "send-digests" job.
+func SendDigests(ctx context.Context) error {
+	var prefs []models.NotificationPrefs
+	if err := database.DB.WithContext(ctx).Where("digest <> ''").Find(&prefs).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, p := range prefs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		period := 24 * time.Hour
+		if p.Digest == models.DigestWeekly {
+			if now.Weekday() != digestWeekday {
+				continue
+			}
+			period = 7 * 24 * time.Hour
+		}
+		data, ok, err := digestFor(ctx, p.UserID, now.Add(-period), now)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		data["Period"] = p.Digest
+		notifyUsers(ctx, usersWithIDs(p.UserID), notify.EventDigest, "digest", data)
+	}
+	return nil
+}
+
+// digestFor collects a user's activity between from and to, and their scheduled runs for
+// the same length of time after to, as template data. ok is false when there is neither.
+func digestFor(ctx context.Context, userID uint, from, to time.Time) (data map[string]any, ok bool, err error) {
+	db := database.DB.WithContext(ctx)
+	var logs []models.SessionLog
+	err = db.Where("user_id = ? AND ended_at >= ? AND ended_at < ?", userID, from, to).Order("ended_at").Find(&logs).Error
+	if err != nil {
+		return nil, false, err
+	}
+	var skipped []struct { // Scheduled runs that never reached the queue
+		At       time.Time
+		Reason   string
+		Duration time.Duration
+	}
+	err = db.Table("schedule_runs").Select("schedule_runs.at, schedule_runs.reason, schedules.duration").
+		Joins("JOIN schedules ON schedules.id = schedule_runs.schedule_id").
+		Where("schedules.user_id = ? AND schedule_runs.status = ? AND schedule_runs.at >= ? AND schedule_runs.at < ?", userID, models.ScheduleRunSkipped, from, to).
+		Order("schedule_runs.at").Scan(&skipped).Error
+	if err != nil {
+		return nil, false, err
+	}
+	for _, s := range skipped { // Reported with the rejected requests
+		logs = append(logs, models.SessionLog{Outcome: services.SessionRejected, Requested: s.Duration, Reason: "scheduled run skipped: " + s.Reason, EndedAt: s.At})
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].EndedAt.Before(logs[j].EndedAt) })
+	var schedules []models.Schedule
+	if err := db.Where("user_id = ? AND enabled = ?", userID, true).Find(&schedules).Error; err != nil {
+		return nil, false, err
+	}
+	until := to.Add(to.Sub(from))
+	var oneTime []models.ScheduledRequest
+	err = db.Where("user_id = ? AND status = ? AND start_at >= ? AND start_at < ?", userID, models.ScheduledPending, to, until).Find(&oneTime).Error
+	if err != nil {
+		return nil, false, err
+	}
+	next := upcomingRuns(schedules, to, until, digestMaxUpcoming)
+	for _, r := range oneTime {
+		next = append(next, upcomingRun{At: r.StartAt, Schedule: models.Schedule{Name: "one-time", Duration: r.Duration}})
+	}
+	sort.SliceStable(next, func(i, j int) bool { return next[i].At.Before(next[j].At) })
+	var upcoming []map[string]any
+	for i, r := range next {
+		if i == digestMaxUpcoming {
+			break
+		}
+		upcoming = append(upcoming, map[string]any{"At": r.At, "Name": r.Schedule.Name, "Minutes": int(r.Schedule.Duration.Minutes())})
+	}
+	if len(logs) == 0 && len(upcoming) == 0 {
+		return nil, false, nil
+	}
+	var runs, interrupted int
+	var runtime time.Duration
+	var rejected []map[string]any
+	rejectedCount := 0
+	for _, l := range logs {
+		switch l.Outcome {
+		case services.SessionInterrupted, services.SessionSafetyStopped, services.SessionPowerLost, services.SessionStopped:
+			interrupted++
+			fallthrough
+		case services.SessionFinished:
+			runs++
+			runtime += l.Ran
+		case services.SessionRejected, services.SessionExpired:
+			rejectedCount++
+			if len(rejected) < digestMaxRejected {
+				rejected = append(rejected, map[string]any{"At": l.EndedAt, "Minutes": int(l.Requested.Minutes()), "Reason": l.Reason})
+			}
+		}
+	}
+	return map[string]any{
+		"From":           from,
+		"To":             to,
+		"Runs":           runs,
+		"Interrupted":    interrupted,
+		"RuntimeMinutes": int(runtime.Minutes()),
+		"Rejected":       rejected,
+		"RejectedCount":  rejectedCount,
+		"Upcoming":       upcoming,
+	}, true, nil
+}
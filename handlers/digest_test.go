@@ -0,0 +1,87 @@
+// digest_test.go - Tests for activity digests
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"context"                  // For the job context
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User, preferences and session log
+	"go-mqtt-backend/notify"   // Recipients and messages
+	"go-mqtt-backend/services" // Session outcomes
+	"testing"                  // Go's testing package
+	"time"                     // For durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+type fakeNotifier struct { // Records messages per user on one channel
+	channel string
+	sent    map[uint][]notify.Message
+}
+
+func (f *fakeNotifier) Channel() string { return f.channel }
+func (f *fakeNotifier) Notify(to notify.Recipient, msg notify.Message) error {
+	f.sent[to.UserID] = append(f.sent[to.UserID], msg)
+	return nil
+}
+
+// TestSendDigests checks that only opted-in users with activity get a digest covering their period
+func TestSendDigests(t *testing.T) {
+	setupTestDB()
+	email := &fakeNotifier{channel: notify.ChannelEmail, sent: map[uint][]notify.Message{}}
+	UseNotifier(email)
+	defer delete(notifiers, notify.ChannelEmail)
+
+	users := []models.User{{Email: "daily@example.com", Password: "x"}, {Email: "weekly@example.com", Password: "x"}, {Email: "none@example.com", Password: "x"}, {Email: "quiet@example.com", Password: "x"}}
+	require.NoError(t, database.DB.Create(&users).Error)
+	daily, weekly, none, idle := users[0].ID, users[1].ID, users[2].ID, users[3].ID
+	database.DB.Create(&[]models.NotificationPrefs{
+		{UserID: daily, Digest: models.DigestDaily},
+		{UserID: weekly, Digest: models.DigestWeekly},
+		{UserID: idle, Digest: models.DigestDaily},
+	})
+	now := time.Now()
+	database.DB.Create(&[]models.SessionLog{
+		{UserID: daily, Outcome: services.SessionFinished, Requested: 20 * time.Minute, Ran: 20 * time.Minute, EndedAt: now.Add(-time.Hour)},
+		{UserID: daily, Outcome: services.SessionInterrupted, Requested: 30 * time.Minute, Ran: 5 * time.Minute, EndedAt: now.Add(-2 * time.Hour)},
+		{UserID: daily, Outcome: services.SessionRejected, Requested: 15 * time.Minute, Reason: "daily quota reached", EndedAt: now.Add(-3 * time.Hour)},
+		{UserID: daily, Outcome: services.SessionFinished, Requested: time.Hour, Ran: time.Hour, EndedAt: now.Add(-48 * time.Hour)}, // Outside the day
+		{UserID: weekly, Outcome: services.SessionFinished, Requested: 10 * time.Minute, Ran: 10 * time.Minute, EndedAt: now.Add(-72 * time.Hour)},
+		{UserID: none, Outcome: services.SessionFinished, Requested: 10 * time.Minute, Ran: 10 * time.Minute, EndedAt: now.Add(-time.Hour)},
+	})
+
+	skippedBy := models.Schedule{UserID: daily, Cron: "0 6 * * *", Duration: 10 * time.Minute}
+	database.DB.Create(&skippedBy) // Disabled, so nothing upcoming
+	database.DB.Create(&models.ScheduleRun{ScheduleID: skippedBy.ID, At: now.Add(-4 * time.Hour), Status: models.ScheduleRunSkipped, Reason: "motor queue is full"})
+
+	old := digestWeekday
+	digestWeekday = now.Weekday() // Today is digest day
+	defer func() { digestWeekday = old }()
+	require.NoError(t, SendDigests(context.Background()))
+
+	require.Len(t, email.sent[daily], 1)
+	msg := email.sent[daily][0]
+	assert.Equal(t, notify.EventDigest, msg.Event)
+	assert.Equal(t, "Daily motor digest", msg.Title)
+	assert.Equal(t, "2 runs, 25 min in total (1 cut short). 2 requests rejected.", msg.Body)
+	assert.Contains(t, msg.EmailBody, "15 min: daily quota reached")
+	assert.Contains(t, msg.EmailBody, "10 min: scheduled run skipped: motor queue is full")
+	require.Len(t, email.sent[weekly], 1)
+	assert.Equal(t, "Weekly motor digest", email.sent[weekly][0].Title)
+	assert.Empty(t, email.sent[none]) // Not opted in
+	assert.Empty(t, email.sent[idle]) // Nothing to report
+
+	database.DB.Create(&models.Schedule{UserID: idle, Name: "Morning", Cron: "0 6 * * *", Duration: 20 * time.Minute, Enabled: true})
+	email.sent = map[uint][]notify.Message{}
+	require.NoError(t, SendDigests(context.Background()))
+	require.Len(t, email.sent[idle], 1) // Upcoming runs are worth a digest
+	assert.Contains(t, email.sent[idle][0].EmailBody, "06:00, 20 min (Morning)")
+
+	digestWeekday = now.Add(24 * time.Hour).Weekday() // Not digest day: weekly users are skipped
+	email.sent = map[uint][]notify.Message{}
+	require.NoError(t, SendDigests(context.Background()))
+	assert.Len(t, email.sent[daily], 1)
+	assert.Empty(t, email.sent[weekly])
+}
@@ -0,0 +1,161 @@
+// entitlements.go - What an organization's subscription plan lets its members use
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                   // For DB lookups
+	"fmt"                       // For messages
+	"go-mqtt-backend/database"  // Database connection
+	"go-mqtt-backend/models"    // Plan and organization models
+	"go-mqtt-backend/scheduler" // Sunrise/sunset specs
+	"log"                       // Logging
+	"net/http"                  // HTTP status codes
+	"time"                      // Quota durations
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+// planOf returns the plan of an organization; organizations without one, and those whose
+// subscription payments have failed past the grace period, are on free.
+func planOf(ctx context.Context, org models.Organization) (models.Plan, error) {
+	var plan models.Plan
+	q := database.DB.WithContext(ctx).Limit(1)
+	if org.PlanID == 0 || billingLapsed(org, time.Now()) {
+		q = q.Where("name = ?", models.PlanFree)
+	} else {
+		q = q.Where("id = ?", org.PlanID)
+	}
+	if err := q.Find(&plan).Error; err != nil {
+		return plan, err
+	}
+	if plan.ID == 0 { // Plans table emptied by hand: fall back to the built-in free limits
+		plan = models.DefaultPlans[0]
+	}
+	return plan, nil
+}
+
+// poolOf is the motor time an organization's members share per quota period: the smaller
+// of the pool an admin set and the plan's cap, or 0 when neither applies.
+func poolOf(org models.Organization, plan models.Plan) time.Duration {
+	switch {
+	case org.DailyQuota == 0:
+		return plan.DailyQuota
+	case plan.DailyQuota == 0 || org.DailyQuota < plan.DailyQuota:
+		return org.DailyQuota
+	}
+	return plan.DailyQuota
+}
+
+// callerPlan loads the plan of the caller's organization, or responds 500.
+func callerPlan(c *gin.Context) (models.Plan, bool) {
+	var org models.Organization
+	err := database.DB.WithContext(c.Request.Context()).Limit(1).Find(&org, orgOf(c)).Error
+	if err == nil {
+		var plan models.Plan
+		if plan, err = planOf(c.Request.Context(), org); err == nil {
+			return plan, true
+		}
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load plan"})
+	return models.Plan{}, false
+}
+
+// requireFeature responds 402 unless the caller's organization's plan includes feature.
+func requireFeature(c *gin.Context, feature string) bool {
+	plan, ok := callerPlan(c)
+	if !ok {
+		return false
+	}
+	if !plan.Has(feature) {
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": fmt.Sprintf("the %s plan doesn't include %s; upgrade to use it", plan.Name, feature), "plan": plan.Name})
+		return false
+	}
+	return true
+}
+
+// requireRoom responds 402 when the caller's organization already has as many of what
+// (e.g. "devices") as its plan allows. count is how many it has now.
+func requireRoom(c *gin.Context, what string, count int64, limit func(models.Plan) int) bool {
+	plan, ok := callerPlan(c)
+	if !ok {
+		return false
+	}
+	if max := limit(plan); max > 0 && count >= int64(max) {
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": fmt.Sprintf("the %s plan allows %d %s; upgrade for more", plan.Name, max, what), "plan": plan.Name})
+		return false
+	}
+	return true
+}
+
+func maxDevices(p models.Plan) int   { return p.MaxDevices }
+func maxSchedules(p models.Plan) int { return p.MaxSchedules }
+
+// requireScheduleFeatures responds 402 if a schedule uses a premium feature (rain skips,
+// sunrise/sunset times) the caller's organization's plan doesn't include.
+func requireScheduleFeatures(c *gin.Context, input ScheduleInput) bool {
+	if input.SkipIfRainAbove > 0 && !requireFeature(c, models.FeatureWeather) {
+		return false
+	}
+	return !scheduler.IsSolarSpec(input.Cron) || requireFeature(c, models.FeatureSunSchedules)
+}
+
+type PlanResponse struct { // A plan as returned by the API
+	Name         string   `json:"name"`
+	DailyQuota   int      `json:"daily_quota"`   // Minutes (0: only the motor's quota)
+	MaxDevices   int      `json:"max_devices"`   // 0 for unlimited
+	MaxSchedules int      `json:"max_schedules"` // 0 for unlimited
+	Features     []string `json:"features"`
+}
+
+func planResponse(p models.Plan) PlanResponse {
+	features := []string{}
+	for _, f := range []string{models.FeatureWeather, models.FeatureSunSchedules, models.FeatureRules} {
+		if p.Has(f) {
+			features = append(features, f)
+		}
+	}
+	return PlanResponse{Name: p.Name, DailyQuota: int(p.DailyQuota.Minutes()), MaxDevices: p.MaxDevices, MaxSchedules: p.MaxSchedules, Features: features}
+}
+
+func ListPlans(c *gin.Context) { // Admin handler listing the plans
+	var plans []models.Plan
+	if err := database.DB.WithContext(c.Request.Context()).Order("id").Find(&plans).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load plans"})
+		return
+	}
+	out := make([]PlanResponse, len(plans))
+	for i, p := range plans {
+		out[i] = planResponse(p)
+	}
+	c.JSON(http.StatusOK, gin.H{"plans": out})
+}
+
+// SetOrganizationPlan moves an organization to another plan. Existing devices and
+// schedules over the new plan's limits are kept, but no more can be added; rules stop
+// firing if the plan doesn't include them.
+func SetOrganizationPlan(c *gin.Context) {
+	var input struct {
+		Plan string `json:"plan" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var plan models.Plan
+	if err := db.Where("name = ?", input.Plan).Limit(1).Find(&plan).Error; err != nil || plan.ID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown plan"})
+		return
+	}
+	var org models.Organization
+	if err := db.Limit(1).Find(&org, c.Param("id")).Error; err != nil || org.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+		return
+	}
+	if err := db.Model(&org).Update("plan_id", plan.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save plan"})
+		return
+	}
+	log.Printf("organization %q moved to plan %s by user %v", org.Slug, plan.Name, c.MustGet("userID"))
+	c.JSON(http.StatusOK, gin.H{"organization_id": org.ID, "plan": planResponse(plan)})
+}
@@ -0,0 +1,97 @@
+// entitlements_test.go - Tests for subscription plan limits and features
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"context"                  // For quota checks
+	"encoding/json"            // Response bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Plan and organization models
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"strconv"                  // IDs in paths
+	"testing"                  // Go's testing package
+	"time"                     // Durations
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+func planNamed(t *testing.T, name string) uint { // ID of a built-in plan
+	var p models.Plan
+	require.NoError(t, database.DB.Where("name = ?", name).First(&p).Error)
+	return p.ID
+}
+
+// TestEntitlements checks that a free organization hits its plan's limits and an upgrade lifts them
+func TestEntitlements(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	ctx := context.Background()
+	appConfig.SiteLocation = "31.5204,74.3587"
+	defer func() { appConfig.SiteLocation = "" }()
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres", PlanID: planNamed(t, models.PlanFree)}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	admin := models.User{Email: "boss@example.com", Password: "x", Role: models.RoleOrgAdmin, OrganizationID: farm.ID}
+	require.NoError(t, database.DB.Create(&admin).Error)
+
+	r := gin.New()
+	setCaller := func(c *gin.Context) { c.Set("userID", admin.ID); c.Set("orgID", farm.ID) }
+	r.POST("/api/org/devices", setCaller, CreateDevice)
+	r.POST("/api/schedules", setCaller, CreateSchedule)
+	r.POST("/api/rules", setCaller, CreateRule)
+	r.GET("/admin/plans", ListPlans)
+	r.PUT("/admin/organizations/:id/plan", setCaller, SetOrganizationPlan)
+	r.PUT("/admin/organizations/:id/quota", setCaller, SetOrganizationQuota)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	orgPath := "/admin/organizations/" + strconv.Itoa(int(farm.ID))
+
+	code, out := call("GET", "/admin/plans", "")
+	require.Equal(t, 200, code)
+	assert.Len(t, out["plans"], 3)
+
+	code, _ = call("POST", "/api/org/devices", `{"name":"pump-1"}`)
+	assert.Equal(t, 201, code)
+	code, out = call("POST", "/api/org/devices", `{"name":"pump-2"}`)
+	assert.Equal(t, 402, code)
+	assert.Equal(t, "free", out["plan"])
+	for i := 0; i < 3; i++ {
+		code, _ = call("POST", "/api/schedules", `{"cron":"0 6 * * *","duration":5}`)
+		assert.Equal(t, 201, code)
+	}
+	code, _ = call("POST", "/api/schedules", `{"cron":"0 7 * * *","duration":5}`)
+	assert.Equal(t, 402, code) // Fourth schedule
+	code, _ = call("POST", "/api/rules", `{"name":"Dry","metric":"soil","operator":"<","threshold":20,"for":10,"duration":5}`)
+	assert.Equal(t, 402, code)
+	reason, err := quotaRejection(ctx, admin.ID, 40*time.Minute) // Free caps the pool at 30 minutes
+	require.NoError(t, err)
+	assert.Contains(t, reason, "shared daily quota")
+	code, _ = call("PUT", orgPath+"/quota", `{"daily_quota":45}`)
+	assert.Equal(t, 400, code)
+
+	code, _ = call("PUT", orgPath+"/plan", `{"plan":"platinum"}`)
+	assert.Equal(t, 400, code)
+	code, out = call("PUT", orgPath+"/plan", `{"plan":"pro"}`)
+	require.Equal(t, 200, code)
+	assert.Contains(t, out["plan"].(map[string]any)["features"], models.FeatureRules)
+	code, _ = call("POST", "/api/org/devices", `{"name":"pump-2"}`)
+	assert.Equal(t, 201, code)
+	code, _ = call("POST", "/api/schedules", `{"cron":"@sunrise","duration":5}`)
+	assert.Equal(t, 201, code)
+	code, _ = call("POST", "/api/rules", `{"name":"Dry","metric":"soil","operator":"<","threshold":20,"for":10,"duration":5}`)
+	assert.Equal(t, 201, code)
+	reason, err = quotaRejection(ctx, admin.ID, 40*time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, reason)
+}
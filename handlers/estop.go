@@ -0,0 +1,34 @@
+// estop.go - Shutdowns from the emergency stop button on site
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For the shutdown
+	"go-mqtt-backend/models"   // Audit log model
+	"go-mqtt-backend/services" // Motor service
+	"go-mqtt-backend/store"    // Shutdown state
+	"log"                      // Logging
+	"log/slog"                 // Leveled logging
+	"time"                     // Timeouts
+)
+
+// EmergencyStopButton handles a message on services.EStopTopic: a press shuts the system
+// down like AdminForceShutdown, recorded in the audit trail as done by the hardware
+// (user 0), and alerts the admins. Only an admin restart ends it.
+func EmergencyStopButton(topic string, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	handled, dropped, err := motorService.EmergencyStop(ctx, string(payload))
+	if err != nil {
+		slog.Error("emergency stop button: shutdown failed", "topic", topic, "error", err) // The OFF was still sent
+		return
+	}
+	if !handled {
+		slog.Info("emergency stop button message ignored", "topic", topic, "payload", string(payload))
+		return
+	}
+	sd := store.Shutdown{Active: true, Category: services.ShutdownSafety, Reason: services.EStopReason}
+	log.Printf("emergency shutdown by the emergency stop button: %s (%d queued requests dropped)", sd.Summary(), dropped)
+	recordAuditEntry(ctx, models.AuditLog{Action: "shutdown", Category: sd.Category, Detail: sd.Reason + " (from hardware, " + topic + ")"})
+	notifyShutdown(ctx, sd, "the emergency stop button", dropped)
+}
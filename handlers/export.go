@@ -0,0 +1,271 @@
+// export.go - Org admin export of all of an organization's data as JSON or a zip of CSVs
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"archive/zip"              // CSV archive
+	"bufio"                    // JSON export buffering
+	"encoding/csv"             // CSV files
+	"encoding/json"            // JSON export
+	"fmt"                      // Cell formatting
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Exported models
+	"log"                      // Logging
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"time"                     // Timestamps
+
+	"github.com/gin-gonic/gin" // Gin web framework
+	"gorm.io/gorm"             // Query scopes
+)
+
+type exportTable struct { // One table of a tenant export
+	name    string                                 // JSON key and CSV file name
+	model   any                                    // Table
+	columns []string                               // Columns to export (nil for all)
+	scope   func(db *gorm.DB, orgID uint) *gorm.DB // The organization's rows
+}
+
+func ownedByOrg(db *gorm.DB, orgID uint) *gorm.DB { return db.Where("organization_id = ?", orgID) }
+
+func ownedByMembers(db *gorm.DB, orgID uint) *gorm.DB { // Rows of the organization's current members
+	return db.Where("user_id IN (?)", database.DB.Model(&models.User{}).Select("id").Where("organization_id = ?", orgID))
+}
+
+func runsOf(parent any, column string) func(*gorm.DB, uint) *gorm.DB { // Runs of the members' schedules or rules
+	return func(db *gorm.DB, orgID uint) *gorm.DB {
+		return db.Where(column+" IN (?)", ownedByMembers(database.DB.Model(parent).Select("id"), orgID))
+	}
+}
+
+// exportTables is what a tenant export contains. Rows are exported as stored, so an
+// import into another instance needs no conversion: durations are nanoseconds and times
+// are in the database's format. Password hashes and secrets are left out.
+var exportTables = []exportTable{
+	{"organization", &models.Organization{}, nil, func(db *gorm.DB, orgID uint) *gorm.DB { return db.Where("id = ?", orgID) }},
+	{"users", &models.User{}, []string{"id", "email", "role", "phone", "timezone", "organization_id", "daily_quota"}, ownedByOrg},
+	{"devices", &models.Device{}, nil, ownedByOrg},
+	{"activations", &models.DeviceActivation{}, nil, ownedByMembers},
+	{"session_logs", &models.SessionLog{}, nil, ownedByMembers},
+	{"rejected_requests", &models.RejectedRequest{}, nil, ownedByMembers},
+	{"schedules", &models.Schedule{}, nil, ownedByMembers},
+	{"schedule_runs", &models.ScheduleRun{}, nil, runsOf(&models.Schedule{}, "schedule_id")},
+	{"scheduled_requests", &models.ScheduledRequest{}, nil, ownedByMembers},
+	{"rules", &models.Rule{}, nil, ownedByMembers},
+	{"rule_runs", &models.RuleRun{}, nil, runsOf(&models.Rule{}, "rule_id")},
+	{"notification_prefs", &models.NotificationPrefs{}, nil, ownedByMembers},
+	{"usage", &models.UsageRecord{}, nil, ownedByOrg},
+	{"motor_faults", &models.MotorFault{}, nil, ownedByOrg},
+}
+
+// exportBatch reads the organization's rows of one table after the primary key after (nil:
+// from the first), at most streamBatch of them in key order: its column names, the rows and
+// the key of the last one.
+func exportBatch(db *gorm.DB, t exportTable, orgID uint, after any) ([]string, [][]any, any, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(t.model); err != nil {
+		return nil, nil, nil, err
+	}
+	key := stmt.Schema.PrioritizedPrimaryField.DBName
+	q := t.scope(db.Model(t.model), orgID)
+	if t.columns != nil {
+		q = q.Select(t.columns)
+	}
+	if after != nil {
+		q = q.Where(key+" > ?", after)
+	}
+	rows, err := q.Order(key).Limit(streamBatch).Rows()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var out [][]any
+	var last any
+	for rows.Next() {
+		vals := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, nil, nil, err
+		}
+		for i, v := range vals {
+			if b, ok := v.([]byte); ok { // Text the driver returns as bytes
+				vals[i] = string(b)
+			}
+			if cols[i] == key {
+				last = vals[i]
+			}
+		}
+		out = append(out, vals)
+	}
+	return cols, out, last, rows.Err()
+}
+
+type exportWriter interface { // Writes a tenant export as it is read
+	table(name string, cols []string) error // Starts a table, ending the one before
+	row(cols []string, vals []any) error
+	flush() error // Hands what has been written so far to the response
+	close() error // Ends the export
+}
+
+type jsonExport struct { // One JSON document: {"exported_at": ..., "<table>": [{column: value}, ...], ...}
+	w      *bufio.Writer
+	inRows bool // A table has been started
+	first  bool // No row of the current table written yet
+}
+
+func (e *jsonExport) table(name string, _ []string) error {
+	if e.inRows {
+		e.w.WriteString("\n]")
+	}
+	e.inRows, e.first = true, true
+	_, err := fmt.Fprintf(e.w, ",\n%q: [", name)
+	return err
+}
+
+func (e *jsonExport) row(cols []string, vals []any) error {
+	record := make(map[string]any, len(cols))
+	for i, col := range cols {
+		record[col] = vals[i]
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if !e.first {
+		e.w.WriteByte(',')
+	}
+	e.first = false
+	e.w.WriteString("\n  ")
+	_, err = e.w.Write(b)
+	return err
+}
+
+func (e *jsonExport) flush() error { return e.w.Flush() }
+
+func (e *jsonExport) close() error {
+	if e.inRows {
+		e.w.WriteString("\n]")
+	}
+	e.w.WriteString("}\n")
+	return e.w.Flush()
+}
+
+type csvExport struct { // A zip archive with a CSV file per table
+	zw *zip.Writer
+	w  *csv.Writer // Current table's file
+}
+
+func (e *csvExport) table(name string, cols []string) error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	f, err := e.zw.Create(name + ".csv")
+	if err != nil {
+		return err
+	}
+	e.w = csv.NewWriter(f)
+	return e.w.Write(cols)
+}
+
+func (e *csvExport) row(_ []string, vals []any) error {
+	cells := make([]string, len(vals))
+	for i, v := range vals {
+		cells[i] = exportCell(v)
+	}
+	return e.w.Write(cells)
+}
+
+func (e *csvExport) flush() error {
+	if e.w != nil {
+		if e.w.Flush(); e.w.Error() != nil {
+			return e.w.Error()
+		}
+	}
+	return e.zw.Flush()
+}
+
+func (e *csvExport) close() error {
+	if err := e.flush(); err != nil {
+		return err
+	}
+	return e.zw.Close()
+}
+
+func exportCell(v any) string { // A value as CSV text
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// ExportOrganization downloads everything stored for the caller's organization: with
+// format=json (default) one JSON document of tables, with format=csv a zip archive with a
+// CSV file per table. Meant for compliance requests and moving to a self-hosted instance.
+// The export is streamed a batch of rows at a time; a failure part way through leaves a
+// truncated file that doesn't parse.
+func ExportOrganization(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+	var org models.Organization
+	if err := database.DB.WithContext(c.Request.Context()).Limit(1).Find(&org, orgOf(c)).Error; err != nil || org.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+		return
+	}
+	log.Printf("organization %q exported as %s by user %v", org.Slug, format, c.MustGet("userID"))
+
+	name := fmt.Sprintf("%s-export-%s", org.Slug, time.Now().UTC().Format("20060102"))
+	var s *stream
+	var out exportWriter
+	if format == "json" {
+		s = newStream(c, name+".json", "application/json")
+		w := bufio.NewWriter(c.Writer) // Nothing is sent before the first batch is read, so a failing one is still a clean 500
+		fmt.Fprintf(w, `{"exported_at": %q, "organization_id": %d`, time.Now().UTC().Format(time.RFC3339Nano), org.ID)
+		out = &jsonExport{w: w}
+	} else {
+		s = newStream(c, name+".zip", "application/zip")
+		out = &csvExport{zw: zip.NewWriter(c.Writer)}
+	}
+	for _, t := range exportTables {
+		var after any
+		for first := true; first || after != nil; first = false {
+			db, cancel := s.batch()
+			cols, rows, last, err := exportBatch(db, t, org.ID, after)
+			cancel()
+			if err != nil {
+				s.fail("export", err, "organization_id", org.ID, "table", t.name)
+				return
+			}
+			if first && out.table(t.name, cols) != nil {
+				return // The client went away
+			}
+			for _, row := range rows {
+				if out.row(cols, row) != nil {
+					return
+				}
+			}
+			if out.flush() != nil || s.flush() != nil {
+				return
+			}
+			after = nil
+			if len(rows) == streamBatch {
+				after = last
+			}
+		}
+	}
+	if err := out.close(); err != nil {
+		slog.Warn("tenant export not completed", "organization_id", org.ID, "error", err)
+	}
+}
@@ -0,0 +1,87 @@
+// export_test.go - Tests for the tenant data export
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"archive/zip"              // CSV archive
+	"bytes"                    // Archive reader
+	"encoding/csv"             // CSV files
+	"encoding/json"            // JSON export
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Exported models
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"testing"                  // Go's testing package
+	"time"                     // Durations
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestExportOrganization checks that an export holds the organization's data and nobody else's
+func TestExportOrganization(t *testing.T) {
+	setupTestDB()
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres"}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	admin := models.User{Email: "boss@example.com", Password: "secret-hash", Role: models.RoleOrgAdmin, OrganizationID: farm.ID}
+	outsider := models.User{Email: "other@example.com", Password: "x", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&admin).Error)
+	require.NoError(t, database.DB.Create(&outsider).Error)
+	require.NoError(t, database.DB.Create(&models.Device{OrganizationID: farm.ID, Name: "pump-1"}).Error)
+	mine := models.Schedule{UserID: admin.ID, Cron: "0 6 * * *", Duration: 5 * time.Minute, Enabled: true}
+	theirs := models.Schedule{UserID: outsider.ID, Cron: "0 7 * * *", Duration: 5 * time.Minute, Enabled: true}
+	require.NoError(t, database.DB.Create(&mine).Error)
+	require.NoError(t, database.DB.Create(&theirs).Error)
+	require.NoError(t, database.DB.Create(&models.ScheduleRun{ScheduleID: mine.ID, At: time.Now(), Status: models.ScheduleRunQueued}).Error)
+	require.NoError(t, database.DB.Create(&models.ScheduleRun{ScheduleID: theirs.ID, At: time.Now(), Status: models.ScheduleRunQueued}).Error)
+	activations := make([]models.DeviceActivation, streamBatch+1) // More than one batch
+	for i := range activations {
+		activations[i] = models.DeviceActivation{UserID: admin.ID, RequestAt: time.Now(), Duration: time.Minute}
+	}
+	require.NoError(t, database.DB.CreateInBatches(activations, 200).Error)
+
+	r := gin.New()
+	r.GET("/api/org/export", func(c *gin.Context) { c.Set("userID", admin.ID); c.Set("orgID", farm.ID) }, ExportOrganization)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/org/export"+query, nil)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, 400, get("?format=xml").Code)
+
+	w := get("")
+	require.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "secret-hash")
+	require.True(t, json.Valid(w.Body.Bytes()))
+	var out map[string][]map[string]any
+	json.Unmarshal(w.Body.Bytes(), &out) // exported_at and organization_id aren't tables
+	require.Len(t, out["users"], 1)
+	assert.Equal(t, "boss@example.com", out["users"][0]["email"])
+	assert.Len(t, out["organization"], 1)
+	assert.Len(t, out["devices"], 1)
+	assert.Len(t, out["schedules"], 1)
+	assert.Len(t, out["schedule_runs"], 1)
+	assert.Len(t, out["activations"], streamBatch+1)
+	assert.Equal(t, float64(time.Minute), out["activations"][0]["duration"])
+
+	w = get("?format=csv")
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	require.NoError(t, err)
+	assert.Len(t, zr.File, len(exportTables))
+	f, err := zr.Open("schedules.csv")
+	require.NoError(t, err)
+	records, err := csv.NewReader(f).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 2) // Header and the member's schedule
+	assert.Equal(t, "id", records[0][0])
+	f, err = zr.Open("activations.csv")
+	require.NoError(t, err)
+	records, err = csv.NewReader(f).ReadAll()
+	require.NoError(t, err)
+	assert.Len(t, records, streamBatch+2)
+}
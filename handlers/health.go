@@ -0,0 +1,95 @@
+// health.go - Liveness, readiness and metrics endpoints
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"fmt"                        // Metrics output
+	"go-mqtt-backend/database"   // DB connectivity
+	"go-mqtt-backend/leader"     // Leader election
+	"go-mqtt-backend/mqtt"       // Broker connectivity
+	"go-mqtt-backend/supervisor" // Background goroutine health
+	"net/http"                   // HTTP status codes
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+var ( // Set at startup by UseSupervisor and UseElector
+	tasks   *supervisor.Supervisor // Supervised background goroutines
+	elector *leader.Elector        // Motor queue leader election
+)
+
+func UseSupervisor(s *supervisor.Supervisor) { // Makes task health visible to health and admin endpoints
+	tasks = s
+}
+
+func UseElector(e *leader.Elector) { // Makes leadership visible to status and metrics endpoints
+	elector = e
+}
+
+func Healthz(c *gin.Context) { // Liveness: the process is up and serving HTTP
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz reports whether this instance can do useful work: the database answers, the
+// broker is connected and every supervised goroutine is healthy. Load balancers should
+// stop routing to it while it returns 503.
+func Readyz(c *gin.Context) {
+	ready := true
+	checks := gin.H{"database": "ok", "mqtt": "ok"}
+	if err := database.Ping(c.Request.Context()); err != nil {
+		checks["database"], ready = err.Error(), false
+	}
+	if !mqtt.IsConnected() {
+		checks["mqtt"], ready = "disconnected", false
+	}
+	if tasks != nil {
+		checks["tasks"] = tasks.Status()
+		ready = ready && tasks.Healthy()
+	}
+
+	code, status := http.StatusOK, "ready"
+	if !ready {
+		code, status = http.StatusServiceUnavailable, "not ready"
+	}
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
+
+func Metrics(c *gin.Context) { // Prometheus text metrics for supervised goroutines, leadership, background publishes, live update clients and the telemetry buffer
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	c.Status(http.StatusOK)
+	if tasks != nil {
+		tasks.WriteMetrics(c.Writer)
+	}
+	if elector != nil {
+		leading := 0
+		if elector.IsLeader() {
+			leading = 1
+		}
+		fmt.Fprintln(c.Writer, "# HELP leader_is_leader Whether this replica runs the motor queue (1) or follows (0).")
+		fmt.Fprintln(c.Writer, "# TYPE leader_is_leader gauge")
+		fmt.Fprintf(c.Writer, "leader_is_leader %d\n", leading)
+	}
+	queued, failed := mqtt.PublishQueueStats()
+	fmt.Fprintln(c.Writer, "# HELP mqtt_publish_queued Messages waiting to be published in the background.")
+	fmt.Fprintln(c.Writer, "# TYPE mqtt_publish_queued gauge")
+	fmt.Fprintf(c.Writer, "mqtt_publish_queued %d\n", queued)
+	fmt.Fprintln(c.Writer, "# HELP mqtt_publish_failures_total Background publishes that failed.")
+	fmt.Fprintln(c.Writer, "# TYPE mqtt_publish_failures_total counter")
+	fmt.Fprintf(c.Writer, "mqtt_publish_failures_total %d\n", failed)
+	if hub != nil {
+		clients, evicted := hub.Stats()
+		fmt.Fprintln(c.Writer, "# HELP realtime_clients Connected live update clients.")
+		fmt.Fprintln(c.Writer, "# TYPE realtime_clients gauge")
+		fmt.Fprintf(c.Writer, "realtime_clients %d\n", clients)
+		fmt.Fprintln(c.Writer, "# HELP realtime_evicted_total Live update clients dropped for falling behind.")
+		fmt.Fprintln(c.Writer, "# TYPE realtime_evicted_total counter")
+		fmt.Fprintf(c.Writer, "realtime_evicted_total %d\n", evicted)
+	}
+	buffered, dropped := telemetry.stats()
+	fmt.Fprintln(c.Writer, "# HELP telemetry_buffered_readings Sensor readings waiting to be written.")
+	fmt.Fprintln(c.Writer, "# TYPE telemetry_buffered_readings gauge")
+	fmt.Fprintf(c.Writer, "telemetry_buffered_readings %d\n", buffered)
+	fmt.Fprintln(c.Writer, "# HELP telemetry_dropped_readings_total Sensor readings lost to failed writes.")
+	fmt.Fprintln(c.Writer, "# TYPE telemetry_dropped_readings_total counter")
+	fmt.Fprintf(c.Writer, "telemetry_dropped_readings_total %d\n", dropped)
+}
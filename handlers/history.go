@@ -0,0 +1,244 @@
+// history.go - Paged run history, rejected requests and daily usage reports
+//
+// History and telemetry grow by the million, so their lists are paged with a cursor (the
+// time and ID of the last item returned) instead of an offset: each page is an index range
+// scan that costs the same however deep it is. Reports read the daily totals kept as
+// requests are logged rather than summing activations.
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"encoding/base64"          // Opaque cursors
+	"fmt"                      // Cursor encoding
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Activation, rejected request and daily total models
+	"net/http"                 // HTTP status codes
+	"strconv"                  // Query parsing
+	"time"                     // Days and cursors
+
+	"github.com/gin-gonic/gin" // Gin web framework
+	"gorm.io/gorm"             // Query building
+)
+
+type pageCursor struct { // Where a page ended: newer items than this were returned
+	At time.Time
+	ID uint
+}
+
+func (p pageCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, "%d.%d", p.At.UnixNano(), p.ID))
+}
+
+// page reads ?limit= (default 50, at most 500) and ?cursor=, or responds 400.
+func page(c *gin.Context) (limit int, after *pageCursor, ok bool) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be 1-500"})
+		return 0, nil, false
+	}
+	if v := c.Query("cursor"); v != "" {
+		var nanos int64
+		var id uint
+		raw, err := base64.RawURLEncoding.DecodeString(v)
+		if err == nil {
+			_, err = fmt.Sscanf(string(raw), "%d.%d", &nanos, &id)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return 0, nil, false
+		}
+		after = &pageCursor{time.Unix(0, nanos), id}
+	}
+	return limit, after, true
+}
+
+// olderThan limits q, ordered newest first by column and ID, to the items after cursor.
+func olderThan(q *gorm.DB, column string, cursor *pageCursor) *gorm.DB {
+	if cursor == nil {
+		return q
+	}
+	return q.Where(column+" < ? OR ("+column+" = ? AND id < ?)", cursor.At, cursor.At, cursor.ID)
+}
+
+func nextCursor(n, limit int, last pageCursor) string { // Cursor of the next page, "" after the last one
+	if n < limit {
+		return ""
+	}
+	return last.String()
+}
+
+type ActivationResponse struct { // An accepted motor request as listed in the history
+	ID        uint      `json:"id"`
+	RequestAt time.Time `json:"request_at"`
+	Duration  string    `json:"duration"`
+	Simulated bool      `json:"simulated"`
+	EnergyKWh float64   `json:"energy_kwh"`
+	Liters    float64   `json:"liters"`
+	Cost      float64   `json:"cost"`
+	Note      string    `json:"note,omitempty"`    // The requester's label for the run
+	Outcome   string    `json:"outcome,omitempty"` // How the run ended, once it has ("" while queued or running)
+	Ran       string    `json:"ran,omitempty"`     // How long the motor actually ran, once it has ended
+}
+
+// History returns the caller's accepted motor requests, newest first, a page at a time
+// (limit, default 50, at most 500; pass next_cursor back as cursor for the next page). With
+// format=csv it downloads all of them as a CSV instead.
+func History(c *gin.Context) {
+	userID := c.MustGet("userID")
+	activations := func(db *gorm.DB, cursor *pageCursor, limit int) ([]models.DeviceActivation, error) {
+		var out []models.DeviceActivation
+		err := olderThan(db.Where("user_id = ?", userID), "request_at", cursor).
+			Select("id", "request_at", "duration", "simulated", "energy_kwh", "liters", "cost", "note", "outcome", "ran").
+			Order("request_at DESC, id DESC").Limit(limit).Find(&out).Error
+		return out, err
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+	if format == "csv" {
+		header := []string{"id", "request_at", "duration", "simulated", "energy_kwh", "liters", "cost", "note", "outcome", "ran"}
+		streamCSV(c, "history", "history.csv", header, func(db *gorm.DB, after *pageCursor) ([][]string, pageCursor, error) {
+			batch, err := activations(db, after, streamBatch)
+			rows := make([][]string, len(batch))
+			var last pageCursor
+			for i, a := range batch {
+				rows[i] = []string{fmt.Sprint(a.ID), exportCell(a.RequestAt), a.Duration.String(), fmt.Sprint(a.Simulated), fmt.Sprint(a.EnergyKWh), fmt.Sprint(a.Liters), fmt.Sprint(a.Cost), a.Note, a.Outcome, ranCell(a)}
+				last = pageCursor{a.RequestAt, a.ID}
+			}
+			return rows, last, err
+		})
+		return
+	}
+	limit, cursor, ok := page(c)
+	if !ok {
+		return
+	}
+	batch, err := activations(database.DB.WithContext(c.Request.Context()), cursor, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load history"})
+		return
+	}
+	out := make([]ActivationResponse, len(batch))
+	var last pageCursor
+	for i, a := range batch {
+		out[i] = ActivationResponse{a.ID, a.RequestAt, a.Duration.String(), a.Simulated, a.EnergyKWh, a.Liters, a.Cost, a.Note, a.Outcome, ranCell(a)}
+		last = pageCursor{a.RequestAt, a.ID}
+	}
+	c.JSON(http.StatusOK, gin.H{"activations": out, "next_cursor": nextCursor(len(out), limit, last)})
+}
+
+type RejectedRequestResponse struct { // A queued motor request that was dropped instead of run
+	ID         uint       `json:"id"`
+	QueueID    string     `json:"queue_id,omitempty"` // The id POST /api/motor returned
+	RequestAt  time.Time  `json:"request_at"`
+	Duration   string     `json:"duration"`
+	Simulated  bool       `json:"simulated"`
+	Note       string     `json:"note,omitempty"`
+	Priority   string     `json:"priority,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Outcome    string     `json:"outcome"` // rejected or expired
+	Reason     string     `json:"reason"`
+	RejectedAt time.Time  `json:"rejected_at"`
+}
+
+// ListRejectedRequests returns the caller's queued motor requests that never ran, with why
+// (the quota, a shutdown, expiry...), newest first, a page at a time like History.
+func ListRejectedRequests(c *gin.Context) {
+	limit, cursor, ok := page(c)
+	if !ok {
+		return
+	}
+	var batch []models.RejectedRequest
+	err := olderThan(database.DB.WithContext(c.Request.Context()).Where("user_id = ?", c.MustGet("userID")), "rejected_at", cursor).
+		Order("rejected_at DESC, id DESC").Limit(limit).Find(&batch).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load rejected requests"})
+		return
+	}
+	out := make([]RejectedRequestResponse, len(batch))
+	var last pageCursor
+	for i, r := range batch {
+		out[i] = RejectedRequestResponse{ID: r.ID, QueueID: r.QueueID, RequestAt: r.RequestAt, Duration: r.Duration.String(), Simulated: r.Simulated, Note: r.Note, Priority: r.Priority, Outcome: r.Outcome, Reason: r.Reason, RejectedAt: r.RejectedAt}
+		if !r.ExpiresAt.IsZero() {
+			out[i].ExpiresAt = &r.ExpiresAt
+		}
+		last = pageCursor{r.RejectedAt, r.ID}
+	}
+	c.JSON(http.StatusOK, gin.H{"rejected": out, "next_cursor": nextCursor(len(out), limit, last)})
+}
+
+func ranCell(a models.DeviceActivation) string { // How long the motor ran for a, "" until the run has ended
+	if a.Outcome == "" {
+		return ""
+	}
+	return a.Ran.String()
+}
+
+type DailyUsageResponse struct { // A day's accepted motor requests
+	Day              string  `json:"day"`
+	Runs             int64   `json:"runs"`
+	RequestedMinutes float64 `json:"requested_minutes"`
+	EnergyKWh        float64 `json:"energy_kwh"`
+	Liters           float64 `json:"liters"`
+	Cost             float64 `json:"cost"`
+}
+
+const dailyUsageMaxDays = 366 // Longest range one report covers
+
+// dayRange reads the UTC days ?from= and ?to= (inclusive, "2006-01-02"; default the last
+// 30 days), at most dailyUsageMaxDays apart, or responds 400.
+func dayRange(c *gin.Context) (from, to time.Time, ok bool) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from, to = today.AddDate(0, 0, -29), today
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.Query(name); v != "" {
+			parsed, err := time.Parse(models.DailyTotalLayout, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be a day like 2024-06-01"})
+				return from, to, false
+			}
+			*t = parsed
+		}
+	}
+	if to.Before(from) || to.Sub(from) >= dailyUsageMaxDays*24*time.Hour {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("from must not be after to, and at most %d days before it", dailyUsageMaxDays-1)})
+		return from, to, false
+	}
+	return from, to, true
+}
+
+// DailyUsage reports the caller's organization's accepted motor requests per day (UTC)
+// from "from" to "to" (inclusive, "2006-01-02"; default the last 30 days), optionally for
+// one member (user_id). Days without runs are left out. Dry runs are not counted.
+func DailyUsage(c *gin.Context) {
+	from, to, ok := dayRange(c)
+	if !ok {
+		return
+	}
+	q := database.DB.WithContext(c.Request.Context()).Model(&models.DailyTotal{}).
+		Where("organization_id = ? AND day BETWEEN ? AND ?", orgOf(c), from.Format(models.DailyTotalLayout), to.Format(models.DailyTotalLayout))
+	if user := c.Query("user_id"); user != "" {
+		q = q.Where("user_id = ?", user)
+	}
+	var rows []struct {
+		Day              string
+		Runs             int64
+		RequestedSeconds int64
+		EnergyKWh        float64 `gorm:"column:energy_kwh"`
+		Liters           float64
+		Cost             float64
+	}
+	err := q.Select("day, SUM(runs) AS runs, SUM(requested_seconds) AS requested_seconds, SUM(energy_kwh) AS energy_kwh, SUM(liters) AS liters, SUM(cost) AS cost").
+		Group("day").Order("day").Scan(&rows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load usage"})
+		return
+	}
+	out := make([]DailyUsageResponse, len(rows))
+	for i, r := range rows {
+		out[i] = DailyUsageResponse{r.Day, r.Runs, float64(r.RequestedSeconds) / 60, r.EnergyKWh, r.Liters, r.Cost}
+	}
+	c.JSON(http.StatusOK, gin.H{"days": out})
+}
@@ -0,0 +1,335 @@
+// history_test.go - Tests for the paged history and daily usage reports
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"context"                  // For logging activations
+	"encoding/csv"             // CSV downloads
+	"encoding/json"            // Response decoding
+	"fmt"                      // Cancel reasons
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Activation and user models
+	"go-mqtt-backend/services" // Activation repository
+	"net/http"                 // Requests
+	"net/http/httptest"        // Recorders
+	"net/url"                  // Cursors in queries
+	"strconv"                  // IDs in queries
+	"strings"                  // Request bodies
+	"testing"                  // Go's testing package
+	"time"                     // Request times
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestHistoryPages checks that the history is listed newest first across pages without
+// gaps or repeats, also when requests share a time, and only for the caller
+func TestHistoryPages(t *testing.T) {
+	setupTestDB()
+	user := models.User{Email: "farmer@example.com", OrganizationID: database.DefaultOrgID}
+	other := models.User{Email: "other@example.com", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&user).Error)
+	require.NoError(t, database.DB.Create(&other).Error)
+	repo := services.NewGormMotorRepository(database.DB)
+	start := time.Now().Add(-time.Hour)
+	for i, at := range []time.Time{start, start.Add(time.Minute), start.Add(time.Minute), start.Add(2 * time.Minute), start.Add(3 * time.Minute)} {
+		require.NoError(t, repo.LogActivation(context.Background(), &models.DeviceActivation{UserID: user.ID, RequestAt: at, Duration: time.Duration(i+1) * time.Minute}))
+	}
+	require.NoError(t, repo.LogActivation(context.Background(), &models.DeviceActivation{UserID: other.ID, RequestAt: start, Duration: time.Minute}))
+
+	r := gin.New()
+	r.GET("/api/me/history", func(c *gin.Context) { c.Set("userID", user.ID) }, History)
+	get := func(query string) (int, []ActivationResponse, string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/me/history?"+query, nil)
+		r.ServeHTTP(w, req)
+		var out struct {
+			Activations []ActivationResponse
+			NextCursor  string `json:"next_cursor"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out.Activations, out.NextCursor
+	}
+
+	var durations []string
+	cursor, pages := "", 0
+	for {
+		code, page, next := get("limit=2&cursor=" + url.QueryEscape(cursor))
+		require.Equal(t, 200, code)
+		pages++
+		for _, a := range page {
+			durations = append(durations, a.Duration)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, []string{"5m0s", "4m0s", "3m0s", "2m0s", "1m0s"}, durations)
+	assert.Equal(t, 3, pages)
+
+	code, _, _ := get("limit=0")
+	assert.Equal(t, 400, code)
+	code, _, _ = get("cursor=nonsense")
+	assert.Equal(t, 400, code)
+}
+
+// TestMotorRequestNote checks that a request's note is kept with its activation and shown
+// in the history and the admin queue, and that a high priority request jumps the queue
+func TestMotorRequestNote(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	user := models.User{Email: "farmer@example.com", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&user).Error)
+
+	r := gin.New()
+	setUser := func(c *gin.Context) { c.Set("userID", user.ID) }
+	r.POST("/api/motor", setUser, EnqueueMotorRequest)
+	r.GET("/api/me/history", setUser, History)
+	r.GET("/admin/status", GetSystemStatus)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	code, _ := call("POST", "/api/motor", `{"duration":5,"note":"`+strings.Repeat("x", 141)+`"}`)
+	assert.Equal(t, 400, code)
+	code, _ = call("POST", "/api/motor", `{"duration":5,"note":"  filling tank for seedlings "}`)
+	require.Equal(t, 200, code)
+
+	_, out := call("GET", "/api/me/history", "")
+	require.Len(t, out["activations"], 1)
+	assert.Equal(t, "filling tank for seedlings", out["activations"].([]any)[0].(map[string]any)["note"])
+	_, out = call("GET", "/admin/status", "")
+	require.Len(t, out["queue"], 1)
+	assert.Equal(t, "filling tank for seedlings", out["queue"].([]any)[0].(map[string]any)["note"])
+	assert.Equal(t, "normal", out["queue"].([]any)[0].(map[string]any)["priority"])
+
+	code, _ = call("POST", "/api/motor", `{"duration":5,"priority":"urgent"}`)
+	assert.Equal(t, 400, code)
+	code, _ = call("POST", "/api/motor", `{"duration":5,"priority":"high","note":"livestock"}`)
+	require.Equal(t, 200, code)
+	_, out = call("GET", "/admin/status", "")
+	require.Len(t, out["queue"], 2)
+	assert.Equal(t, "livestock", out["queue"].([]any)[0].(map[string]any)["note"]) // Ahead of the routine run
+	assert.Equal(t, "high", out["queue"].([]any)[0].(map[string]any)["priority"])
+}
+
+// TestCancelMotorRequest checks that a user can look up and withdraw their queued request
+// by the ID POST /api/motor returns, but not someone else's, that an admin can withdraw
+// any and that a request still looks up once it has left the queue
+func TestCancelMotorRequest(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	farmer := models.User{Email: "farmer@example.com", OrganizationID: database.DefaultOrgID}
+	other := models.User{Email: "other@example.com", OrganizationID: database.DefaultOrgID}
+	admin := models.User{Email: "admin@example.com", Role: models.RoleAdmin, OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&[]*models.User{&farmer, &other, &admin}).Error)
+
+	r := gin.New()
+	r.POST("/api/motor", func(c *gin.Context) { c.Set("userID", farmer.ID) }, EnqueueMotorRequest)
+	setUser := func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.GetHeader("X-User"))
+		c.Set("userID", uint(id))
+	}
+	r.GET("/api/motor/:id", setUser, GetMotorRequest)
+	r.DELETE("/api/motor/:id", setUser, CancelMotorRequest)
+	call := func(method, path string, userID uint, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", strconv.Itoa(int(userID)))
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	_, out := call("POST", "/api/motor", farmer.ID, `{"duration":5}`)
+	first, _ := out["id"].(string)
+	require.NotEmpty(t, first)
+	code, _ := call("POST", "/api/motor", farmer.ID, `{"duration":5,"expires_at":"2020-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusBadRequest, code) // Already expired
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	_, out = call("POST", "/api/motor", farmer.ID, `{"duration":5,"expires_at":"`+expiresAt.Format(time.RFC3339)+`"}`)
+	second, _ := out["id"].(string)
+	code, out = call("GET", "/api/motor/"+second, farmer.ID, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "queued", out["status"])
+	assert.Equal(t, 2.0, out["position"])
+	assert.Equal(t, 5.0, out["ahead_minutes"])
+	assert.Equal(t, expiresAt.Format(time.RFC3339), out["expires_at"])
+	code, _ = call("GET", "/api/motor/"+second, other.ID, "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = call("DELETE", "/api/motor/"+first, other.ID, "") // Not theirs
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = call("DELETE", "/api/motor/"+first, farmer.ID, "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call("DELETE", "/api/motor/"+first, farmer.ID, "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, out = call("GET", "/api/motor/"+first, farmer.ID, "") // How it ended
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, services.SessionCancelled, out["status"])
+	assert.Equal(t, fmt.Sprintf("cancelled by user %d", farmer.ID), out["reason"])
+	code, _ = call("GET", "/api/motor/"+first, other.ID, "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = call("DELETE", "/api/motor/"+second, admin.ID, "")
+	assert.Equal(t, http.StatusOK, code)
+
+	var logs []models.SessionLog
+	database.DB.Find(&logs)
+	require.Len(t, logs, 2)
+	assert.Equal(t, services.SessionCancelled, logs[0].Outcome)
+	var activations []models.DeviceActivation
+	database.DB.Order("id").Find(&activations)
+	require.Len(t, activations, 2)
+	assert.Equal(t, services.SessionCancelled, activations[0].Outcome) // How each ended is kept with the request too
+	assert.Equal(t, second, activations[1].QueueID)
+	var audits int64
+	database.DB.Model(&models.AuditLog{}).Where("action = ?", "motor_request_cancelled").Count(&audits)
+	assert.Equal(t, int64(2), audits)
+}
+
+// TestListRejectedRequests checks that queued requests dropped by a shutdown are listed
+// for their owner, newest first and a page at a time, with why they never ran
+func TestListRejectedRequests(t *testing.T) {
+	setupTestDB()
+	svc := useTestMotor(5)
+	ctx := context.Background()
+	user := models.User{Email: "farmer@example.com", OrganizationID: database.DefaultOrgID}
+	other := models.User{Email: "other@example.com", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&[]*models.User{&user, &other}).Error)
+	id, err := svc.EnqueueWith(ctx, user.ID, 5*time.Minute, services.EnqueueOptions{Note: "seedlings", Priority: "high"})
+	require.NoError(t, err)
+	require.NoError(t, svc.Enqueue(ctx, user.ID, 10*time.Minute))
+	require.NoError(t, svc.Enqueue(ctx, other.ID, 10*time.Minute))
+	_, err = svc.ForceShutdown(ctx, services.ShutdownWeather, "flooding", time.Time{})
+	require.NoError(t, err)
+
+	r := gin.New()
+	r.GET("/api/motor/rejected", func(c *gin.Context) { c.Set("userID", user.ID) }, ListRejectedRequests)
+	get := func(query string) (int, []RejectedRequestResponse, string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/motor/rejected?"+query, nil)
+		r.ServeHTTP(w, req)
+		var out struct {
+			Rejected   []RejectedRequestResponse
+			NextCursor string `json:"next_cursor"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out.Rejected, out.NextCursor
+	}
+
+	code, first, next := get("limit=1")
+	require.Equal(t, 200, code)
+	require.Len(t, first, 1)
+	require.NotEmpty(t, next)
+	code, second, next := get("limit=1&cursor=" + url.QueryEscape(next))
+	require.Equal(t, 200, code)
+	require.Len(t, second, 1)
+	_, rest, _ := get("limit=1&cursor=" + url.QueryEscape(next))
+	assert.Empty(t, rest) // The other user's isn't listed
+
+	assert.Equal(t, "10m0s", first[0].Duration) // Newest first
+	got := second[0]
+	assert.Equal(t, id, got.QueueID)
+	assert.Equal(t, "5m0s", got.Duration)
+	assert.Equal(t, "seedlings", got.Note)
+	assert.Equal(t, "high", got.Priority)
+	assert.Equal(t, services.SessionRejected, got.Outcome)
+	assert.Equal(t, "dropped by emergency shutdown: weather: flooding", got.Reason)
+}
+
+// TestHistoryCSV checks that the CSV download has every request, newest first, across
+// more than one batch
+func TestHistoryCSV(t *testing.T) {
+	setupTestDB()
+	user := models.User{Email: "farmer@example.com", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&user).Error)
+	start := time.Now().Add(-48 * time.Hour)
+	activations := make([]models.DeviceActivation, streamBatch+5)
+	for i := range activations {
+		activations[i] = models.DeviceActivation{UserID: user.ID, RequestAt: start.Add(time.Duration(i/2) * time.Minute), Duration: time.Minute}
+	}
+	require.NoError(t, database.DB.CreateInBatches(activations, 200).Error)
+
+	r := gin.New()
+	r.GET("/api/me/history", func(c *gin.Context) { c.Set("userID", user.ID) }, History)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/me/history?format=csv", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, len(activations)+1) // Header and every request
+	assert.Equal(t, "request_at", records[0][1])
+	seen := map[string]bool{}
+	for i, rec := range records[1:] {
+		assert.False(t, seen[rec[0]], "request %s listed twice", rec[0])
+		seen[rec[0]] = true
+		if i > 0 {
+			assert.LessOrEqual(t, rec[1], records[i][1]) // Newest first
+		}
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/me/history?format=xml", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+}
+
+// TestDailyUsage checks that the daily totals kept as requests are logged add up per day,
+// leave out dry runs and can be narrowed to one member
+func TestDailyUsage(t *testing.T) {
+	setupTestDB()
+	user := models.User{Email: "farmer@example.com", OrganizationID: database.DefaultOrgID}
+	other := models.User{Email: "other@example.com", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&user).Error)
+	require.NoError(t, database.DB.Create(&other).Error)
+	repo := services.NewGormMotorRepository(database.DB)
+	day := time.Date(2024, 6, 1, 6, 0, 0, 0, time.UTC)
+	for _, a := range []models.DeviceActivation{
+		{UserID: user.ID, RequestAt: day, Duration: 30 * time.Minute, Cost: 2},
+		{UserID: other.ID, RequestAt: day.Add(time.Hour), Duration: 15 * time.Minute, Cost: 1},
+		{UserID: user.ID, RequestAt: day.Add(time.Hour), Duration: time.Hour, Simulated: true},
+		{UserID: user.ID, RequestAt: day.AddDate(0, 0, 1), Duration: 10 * time.Minute, Cost: 0.5},
+	} {
+		a.OrganizationID = database.DefaultOrgID
+		require.NoError(t, repo.LogActivation(context.Background(), &a))
+	}
+
+	r := gin.New()
+	r.GET("/api/org/usage/daily", func(c *gin.Context) { c.Set("orgID", database.DefaultOrgID) }, DailyUsage)
+	get := func(query string) (int, []DailyUsageResponse) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/org/usage/daily?"+query, nil)
+		r.ServeHTTP(w, req)
+		var out struct{ Days []DailyUsageResponse }
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out.Days
+	}
+
+	code, days := get("from=2024-06-01&to=2024-06-30")
+	require.Equal(t, 200, code)
+	require.Len(t, days, 2)
+	assert.Equal(t, DailyUsageResponse{Day: "2024-06-01", Runs: 2, RequestedMinutes: 45, Cost: 3}, days[0])
+	assert.Equal(t, "2024-06-02", days[1].Day)
+
+	_, days = get("from=2024-06-01&to=2024-06-01&user_id=" + strconv.Itoa(int(other.ID)))
+	require.Len(t, days, 1)
+	assert.Equal(t, int64(1), days[0].Runs)
+
+	code, _ = get("from=2024-06-02&to=2024-06-01")
+	assert.Equal(t, 400, code)
+	code, _ = get("from=2023-01-01&to=2024-06-01")
+	assert.Equal(t, 400, code)
+}
@@ -0,0 +1,325 @@
+// invitations.go - Org admin invitations and the link-based join flow
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"crypto/rand"                // Link tokens
+	"crypto/sha256"              // Stored token hashes
+	"encoding/base64"            // Token alphabet
+	"encoding/hex"               // Hash encoding
+	"errors"                     // Join errors
+	"go-mqtt-backend/database"   // Database connection
+	"go-mqtt-backend/middleware" // Cached user roles
+	"go-mqtt-backend/models"     // Invitation, organization and user models
+	"log"                        // Logging
+	"log/slog"                   // Leveled logging
+	"net/http"                   // HTTP status codes
+	"strings"                    // Email normalisation
+	"time"                       // Expiry
+
+	"github.com/gin-gonic/gin"   // Gin web framework
+	"golang.org/x/crypto/bcrypt" // Password hashing
+	"gorm.io/gorm"               // Transactions
+)
+
+const invitationTTL = 7 * 24 * time.Hour // How long an invitation link works
+
+var errInvitationUsed = errors.New("invitation was already accepted") // Lost a race with another accept
+
+type accountMailer interface { // Sends built-in account emails (notify.Mailer)
+	SendTemplate(name string, to []string, data any) error
+}
+
+var mailer accountMailer // Account email sender (nil when email is disabled)
+
+func UseMailer(m accountMailer) { // Enables invitation emails
+	mailer = m
+}
+
+type InvitationInput struct { // Struct for inviting someone to the caller's organization
+	Email string `json:"email" binding:"required,email"`
+	Role  string `json:"role" binding:"omitempty,oneof=user org_admin"` // Defaults to user
+}
+
+type AcceptInvitationInput struct { // Struct for joining without an account
+	Password string `json:"password" binding:"required"` // Password for the new account
+}
+
+type InvitationResponse struct { // An invitation as returned to org admins
+	ID        uint      `json:"id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy uint      `json:"invited_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func invitationResponse(inv models.Invitation) InvitationResponse {
+	return InvitationResponse{ID: inv.ID, Email: inv.Email, Role: inv.Role, InvitedBy: inv.InvitedBy, ExpiresAt: inv.ExpiresAt, CreatedAt: inv.CreatedAt}
+}
+
+func hashInvitationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func invitationLink(token string) string { // Where the invitee accepts; relative to the API when APP_URL is unset
+	base := ""
+	if appConfig != nil {
+		base = appConfig.AppURL
+	}
+	return base + "/invitations/" + token
+}
+
+// findInvitation loads the pending invitation for the :token path parameter, or responds
+// 404 (unknown, revoked or used) or 410 (expired).
+func findInvitation(c *gin.Context) (models.Invitation, bool) {
+	var inv models.Invitation
+	err := database.DB.WithContext(c.Request.Context()).Where("token_hash = ? AND accepted_at IS NULL", hashInvitationToken(c.Param("token"))).Limit(1).Find(&inv).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load invitation"})
+		return inv, false
+	}
+	if inv.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invitation not found"})
+		return inv, false
+	}
+	if !inv.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusGone, gin.H{"error": "invitation has expired; ask for a new one"})
+		return inv, false
+	}
+	return inv, true
+}
+
+func ListInvitations(c *gin.Context) { // Org admin handler listing pending invitations
+	var invitations []models.Invitation
+	err := database.DB.WithContext(c.Request.Context()).
+		Where("organization_id = ? AND accepted_at IS NULL AND expires_at > ?", orgOf(c), time.Now()).
+		Order("created_at DESC").Find(&invitations).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load invitations"})
+		return
+	}
+	out := make([]InvitationResponse, len(invitations))
+	for i, inv := range invitations {
+		out[i] = invitationResponse(inv)
+	}
+	c.JSON(http.StatusOK, gin.H{"invitations": out})
+}
+
+// CreateInvitation invites an email address to the caller's organization and emails them
+// a link. Inviting the same address again replaces their pending invitation. The link is
+// also returned so it can be shared another way when email is disabled.
+func CreateInvitation(c *gin.Context) {
+	var input InvitationInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(input.Email))
+	if input.Role == "" {
+		input.Role = models.RoleUser
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var org models.Organization
+	if err := db.First(&org, orgOf(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+		return
+	}
+	var members int64
+	if err := db.Model(&models.User{}).Where("organization_id = ? AND LOWER(email) = ?", org.ID, email).Count(&members).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create invitation"})
+		return
+	}
+	if members > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "that user is already a member"})
+		return
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create invitation"})
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	inv := models.Invitation{
+		OrganizationID: org.ID,
+		Email:          email,
+		Role:           input.Role,
+		TokenHash:      hashInvitationToken(token),
+		InvitedBy:      c.MustGet("userID").(uint),
+		ExpiresAt:      time.Now().Add(invitationTTL),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("organization_id = ? AND email = ? AND accepted_at IS NULL", org.ID, email).Delete(&models.Invitation{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&inv).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create invitation"})
+		return
+	}
+	log.Printf("user %d invited %s to organization %q as %s", inv.InvitedBy, email, org.Slug, inv.Role)
+	link := invitationLink(token)
+	emailed := false
+	if mailer != nil {
+		err := mailer.SendTemplate("invitation", []string{email}, map[string]any{
+			"Organization": org.Name,
+			"InvitedBy":    userEmail(c.Request.Context(), inv.InvitedBy),
+			"Role":         inv.Role,
+			"Link":         link,
+			"ExpiresIn":    "7 days",
+		})
+		if err != nil {
+			slog.Error("invitation email failed", "invitation", inv.ID, "error", err)
+		}
+		emailed = err == nil
+	}
+	c.JSON(http.StatusCreated, gin.H{"invitation": invitationResponse(inv), "link": link, "emailed": emailed})
+}
+
+func DeleteInvitation(c *gin.Context) { // Org admin handler revoking a pending invitation
+	res := database.DB.WithContext(c.Request.Context()).
+		Where("id = ? AND organization_id = ? AND accepted_at IS NULL", c.Param("id"), orgOf(c)).Delete(&models.Invitation{})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not revoke invitation"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invitation not found"})
+		return
+	}
+	log.Printf("invitation %s revoked by user %v", c.Param("id"), c.MustGet("userID"))
+	c.JSON(http.StatusOK, gin.H{"message": "invitation revoked"})
+}
+
+// GetInvitation is the public landing for an invitation link. It tells the app which
+// organization it is for and whether to ask the invitee to log in or to pick a password.
+func GetInvitation(c *gin.Context) {
+	inv, ok := findInvitation(c)
+	if !ok {
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var org models.Organization
+	if err := db.First(&org, inv.OrganizationID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invitation not found"})
+		return
+	}
+	var accounts int64
+	if err := db.Model(&models.User{}).Where("LOWER(email) = ?", inv.Email).Count(&accounts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load invitation"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"organization": gin.H{"name": org.Name, "slug": org.Slug},
+		"email":        inv.Email,
+		"role":         inv.Role,
+		"expires_at":   inv.ExpiresAt,
+		"has_account":  accounts > 0,
+	})
+}
+
+func markAccepted(tx *gorm.DB, inv models.Invitation) error { // Uses up an invitation exactly once
+	res := tx.Model(&models.Invitation{}).Where("id = ? AND accepted_at IS NULL", inv.ID).Update("accepted_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errInvitationUsed
+	}
+	return nil
+}
+
+// AcceptInvitationSignup accepts an invitation for someone without an account: it creates
+// one with the invited email in the organization and logs them in. It works even when
+// open registration is disabled.
+func AcceptInvitationSignup(c *gin.Context) {
+	var input AcceptInvitationInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	inv, ok := findInvitation(c)
+	if !ok {
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var accounts int64
+	if err := db.Model(&models.User{}).Where("LOWER(email) = ?", inv.Email).Count(&accounts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not accept invitation"})
+		return
+	}
+	if accounts > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "an account with this email exists; log in and accept with POST /api/invitations/:token/accept"})
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not accept invitation"})
+		return
+	}
+	user := models.User{Email: inv.Email, Password: string(hash), Role: inv.Role, OrganizationID: inv.OrganizationID}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := markAccepted(tx, inv); err != nil {
+			return err
+		}
+		return tx.Create(&user).Error
+	})
+	if errors.Is(err, errInvitationUsed) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invitation not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not accept invitation"})
+		return
+	}
+	log.Printf("user %d joined organization %d by invitation %d", user.ID, inv.OrganizationID, inv.ID)
+	token, err := GenerateToken(c.Request.Context(), user, appConfig.JWTSecret, 72*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "account created, but could not create token; log in"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"token": token, "organization_id": inv.OrganizationID})
+}
+
+// AcceptInvitation accepts an invitation for the logged-in user, whose email must match
+// it. They move to the organization with the invited role (global admins stay admins) and
+// without a daily limit of their own; their schedules and history go with them.
+func AcceptInvitation(c *gin.Context) {
+	inv, ok := findInvitation(c)
+	if !ok {
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var user models.User
+	if err := db.First(&user, c.MustGet("userID")).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+		return
+	}
+	if !strings.EqualFold(strings.TrimSpace(user.Email), inv.Email) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "this invitation is for a different email address"})
+		return
+	}
+	role := inv.Role
+	if user.Role == models.RoleAdmin {
+		role = models.RoleAdmin
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := markAccepted(tx, inv); err != nil {
+			return err
+		}
+		return tx.Model(&user).Updates(map[string]any{"organization_id": inv.OrganizationID, "role": role, "daily_quota": 0}).Error
+	})
+	if errors.Is(err, errInvitationUsed) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invitation not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not accept invitation"})
+		return
+	}
+	middleware.InvalidateUser(user.ID)
+	log.Printf("user %d moved from organization %d to %d by invitation %d", user.ID, orgOf(c), inv.OrganizationID, inv.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "joined organization", "organization_id": inv.OrganizationID, "role": role})
+}
@@ -0,0 +1,131 @@
+// invitations_test.go - Tests for organization invitations
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"encoding/json"            // Response bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Invitation, organization and user models
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"strconv"                  // IDs in paths
+	"strings"                  // Tokens from links
+	"testing"                  // Go's testing package
+	"time"                     // Expiry
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+type sentMail struct { // An account email captured by fakeMailer
+	name string
+	to   []string
+	data any
+}
+
+type fakeMailer struct{ sent []sentMail } // Records account emails instead of sending them
+
+func (m *fakeMailer) SendTemplate(name string, to []string, data any) error {
+	m.sent = append(m.sent, sentMail{name, to, data})
+	return nil
+}
+
+// TestInvitations checks inviting, joining with and without an account, and revoking
+func TestInvitations(t *testing.T) {
+	setupTestDB()
+	mail := &fakeMailer{}
+	UseMailer(mail)
+	defer UseMailer(nil)
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres"}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	admin := models.User{Email: "boss@example.com", Password: "x", Role: models.RoleOrgAdmin, OrganizationID: farm.ID}
+	existing := models.User{Email: "Friend@example.com", Password: "x", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&[]*models.User{&admin, &existing}).Error)
+
+	caller := admin
+	r := gin.New()
+	setCaller := func(c *gin.Context) { c.Set("userID", caller.ID); c.Set("orgID", caller.OrganizationID) }
+	r.GET("/api/org/invitations", setCaller, ListInvitations)
+	r.POST("/api/org/invitations", setCaller, CreateInvitation)
+	r.DELETE("/api/org/invitations/:id", setCaller, DeleteInvitation)
+	r.POST("/api/invitations/:token/accept", setCaller, AcceptInvitation)
+	r.GET("/invitations/:token", GetInvitation)
+	r.POST("/invitations/:token/accept", AcceptInvitationSignup)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	invite := func(body string) string { // Returns the token from the link
+		code, out := call("POST", "/api/org/invitations", body)
+		require.Equal(t, 201, code, out)
+		assert.Equal(t, true, out["emailed"])
+		link := out["link"].(string)
+		return link[strings.LastIndex(link, "/")+1:]
+	}
+
+	code, _ := call("POST", "/api/org/invitations", `{"email":"boss@example.com"}`)
+	assert.Equal(t, 409, code) // Already a member
+	code, _ = call("POST", "/api/org/invitations", `{"email":"x@example.com","role":"admin"}`)
+	assert.Equal(t, 400, code)
+
+	// Someone without an account signs up through the link
+	stale := invite(`{"email":"New@Example.com"}`)
+	token := invite(`{"email":"new@example.com","role":"org_admin"}`) // Replaces the first one
+	require.Len(t, mail.sent, 2)
+	assert.Equal(t, "invitation", mail.sent[1].name)
+	assert.Equal(t, []string{"new@example.com"}, mail.sent[1].to)
+	code, _ = call("GET", "/invitations/"+stale, "")
+	assert.Equal(t, 404, code)
+	code, out := call("GET", "/invitations/"+token, "")
+	require.Equal(t, 200, code)
+	assert.Equal(t, false, out["has_account"])
+	assert.Equal(t, "Green Acres", out["organization"].(map[string]any)["name"])
+	code, out = call("POST", "/invitations/"+token+"/accept", `{"password":"secret123"}`)
+	require.Equal(t, 201, code, out)
+	assert.NotEmpty(t, out["token"])
+	var joined models.User
+	require.NoError(t, database.DB.Where("email = ?", "new@example.com").First(&joined).Error)
+	assert.Equal(t, farm.ID, joined.OrganizationID)
+	assert.Equal(t, models.RoleOrgAdmin, joined.Role)
+	code, _ = call("POST", "/invitations/"+token+"/accept", `{"password":"secret123"}`)
+	assert.Equal(t, 404, code) // Used up
+
+	// Someone with an account has to log in and accept as themselves
+	token = invite(`{"email":"friend@example.com"}`)
+	code, out = call("GET", "/invitations/"+token, "")
+	require.Equal(t, 200, code)
+	assert.Equal(t, true, out["has_account"])
+	code, _ = call("POST", "/invitations/"+token+"/accept", `{"password":"secret123"}`)
+	assert.Equal(t, 409, code)
+	code, _ = call("POST", "/api/invitations/"+token+"/accept", "") // The admin isn't the invitee
+	assert.Equal(t, 403, code)
+	caller = existing
+	code, _ = call("POST", "/api/invitations/"+token+"/accept", "")
+	assert.Equal(t, 200, code)
+	database.DB.First(&existing, existing.ID)
+	assert.Equal(t, farm.ID, existing.OrganizationID)
+	assert.Equal(t, models.RoleUser, existing.Role)
+
+	// Revoked and expired links stop working
+	caller = admin
+	token = invite(`{"email":"late@example.com"}`)
+	code, out = call("GET", "/api/org/invitations", "")
+	require.Equal(t, 200, code)
+	require.Len(t, out["invitations"], 1)
+	id := strconv.Itoa(int(out["invitations"].([]any)[0].(map[string]any)["id"].(float64)))
+	database.DB.Model(&models.Invitation{}).Where("id = ?", id).Update("expires_at", time.Now().Add(-time.Minute))
+	code, _ = call("GET", "/invitations/"+token, "")
+	assert.Equal(t, 410, code)
+	code, _ = call("DELETE", "/api/org/invitations/"+id, "")
+	assert.Equal(t, 200, code)
+	code, _ = call("GET", "/invitations/"+token, "")
+	assert.Equal(t, 404, code)
+}
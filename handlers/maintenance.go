@@ -0,0 +1,159 @@
+// maintenance.go - Admin-planned maintenance windows: no motor runs while one is active
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"fmt"                      // For messages
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Maintenance window model
+	"go-mqtt-backend/notify"   // Announcements
+	"log"                      // Logging
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"time"                     // Window times
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+const maxMaintenanceLength = 14 * 24 * time.Hour // Longer outages should use an emergency shutdown
+
+type MaintenanceInput struct { // Struct for planning a maintenance window
+	StartsAt time.Time `json:"starts_at" binding:"required"`      // RFC 3339
+	EndsAt   time.Time `json:"ends_at" binding:"required"`        // RFC 3339, after starts_at
+	Reason   string    `json:"reason" binding:"required,max=255"` // Shown to users
+}
+
+type MaintenanceResponse struct { // A maintenance window as returned by the API
+	ID        uint      `json:"id"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Reason    string    `json:"reason"`
+	CreatedBy uint      `json:"created_by"`
+	Active    bool      `json:"active"` // Going on now
+}
+
+func maintenanceResponse(w models.MaintenanceWindow, now time.Time) MaintenanceResponse {
+	return MaintenanceResponse{
+		ID:        w.ID,
+		StartsAt:  w.StartsAt,
+		EndsAt:    w.EndsAt,
+		Reason:    w.Reason,
+		CreatedBy: w.CreatedBy,
+		Active:    !w.StartsAt.After(now) && w.EndsAt.After(now),
+	}
+}
+
+// activeMaintenance returns the window covering at, or nil. When windows overlap it is
+// the one that ends last.
+func activeMaintenance(ctx context.Context, at time.Time) (*models.MaintenanceWindow, error) {
+	var w models.MaintenanceWindow
+	err := database.DB.WithContext(ctx).Where("starts_at <= ? AND ends_at > ?", at, at).Order("ends_at DESC").Limit(1).Find(&w).Error
+	if err != nil || w.ID == 0 {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func maintenanceMessage(w *models.MaintenanceWindow) string { // Why the motor is unavailable
+	return fmt.Sprintf("the motor is down for maintenance until %s: %s", w.EndsAt.Format(time.RFC3339), w.Reason)
+}
+
+// MaintenanceHold tells the motor queue to hold requests during a maintenance window. It
+// is the MotorDeps.Hold hook; lookup errors don't hold the queue.
+func MaintenanceHold(ctx context.Context) string {
+	w, err := activeMaintenance(ctx, time.Now())
+	if err != nil {
+		slog.Error("maintenance lookup failed", "error", err)
+		return ""
+	}
+	if w == nil {
+		return ""
+	}
+	return maintenanceMessage(w)
+}
+
+func upcomingMaintenance(ctx context.Context, now time.Time) ([]models.MaintenanceWindow, error) { // Windows that haven't ended, soonest first
+	var windows []models.MaintenanceWindow
+	err := database.DB.WithContext(ctx).Where("ends_at > ?", now).Order("starts_at").Find(&windows).Error
+	return windows, err
+}
+
+func ListMaintenance(c *gin.Context) { // Handler listing current and planned maintenance windows
+	now := time.Now()
+	windows, err := upcomingMaintenance(c.Request.Context(), now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load maintenance windows"})
+		return
+	}
+	out := make([]MaintenanceResponse, len(windows))
+	for i, w := range windows {
+		out[i] = maintenanceResponse(w, now)
+	}
+	c.JSON(http.StatusOK, gin.H{"maintenance": out})
+}
+
+// CreateMaintenance plans a maintenance window and announces it to every user. From
+// starts_at motor requests are rejected, the queue is held and scheduled runs wait until
+// ends_at.
+func CreateMaintenance(c *gin.Context) {
+	var input MaintenanceInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	switch {
+	case !input.EndsAt.After(input.StartsAt):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ends_at must be after starts_at"})
+		return
+	case !input.EndsAt.After(now):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ends_at must be in the future"})
+		return
+	case input.EndsAt.Sub(input.StartsAt) > maxMaintenanceLength:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("a maintenance window can last at most %d days (use an emergency shutdown instead)", int(maxMaintenanceLength.Hours()/24))})
+		return
+	}
+	w := models.MaintenanceWindow{StartsAt: input.StartsAt, EndsAt: input.EndsAt, Reason: input.Reason, CreatedBy: c.MustGet("userID").(uint)}
+	if err := database.DB.WithContext(c.Request.Context()).Create(&w).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save maintenance window"})
+		return
+	}
+	log.Printf("maintenance planned by user %v: %s to %s: %s", w.CreatedBy, w.StartsAt.Format(time.RFC3339), w.EndsAt.Format(time.RFC3339), w.Reason)
+	notifyMaintenance(c.Request.Context(), w, false)
+	c.JSON(http.StatusCreated, maintenanceResponse(w, now))
+}
+
+// DeleteMaintenance cancels a planned window, or ends an active one early, and tells users.
+func DeleteMaintenance(c *gin.Context) {
+	db := database.DB.WithContext(c.Request.Context())
+	var w models.MaintenanceWindow
+	if err := db.Where("id = ?", c.Param("id")).Limit(1).Find(&w).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not cancel maintenance window"})
+		return
+	}
+	if w.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "maintenance window not found"})
+		return
+	}
+	if !w.EndsAt.After(time.Now()) {
+		c.JSON(http.StatusConflict, gin.H{"error": "maintenance window is already over"})
+		return
+	}
+	if err := db.Delete(&w).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not cancel maintenance window"})
+		return
+	}
+	log.Printf("maintenance %d cancelled by user %v", w.ID, c.MustGet("userID"))
+	notifyMaintenance(c.Request.Context(), w, true)
+	c.JSON(http.StatusOK, gin.H{"message": "maintenance window cancelled"})
+}
+
+func notifyMaintenance(ctx context.Context, w models.MaintenanceWindow, cancelled bool) { // Announces a window to every user
+	notifyUsers(ctx, allUsers, notify.EventMaintenance, "maintenance", map[string]any{
+		"Cancelled": cancelled,
+		"StartsAt":  w.StartsAt,
+		"EndsAt":    w.EndsAt,
+		"Reason":    w.Reason,
+	})
+}
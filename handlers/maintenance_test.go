@@ -0,0 +1,103 @@
+// maintenance_test.go - Tests for admin-planned maintenance windows
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"context"                  // For the job context
+	"encoding/json"            // Response bodies
+	"fmt"                      // Request bodies with times
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Window and schedule models
+	"go-mqtt-backend/notify"   // Announcements
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"strconv"                  // Window IDs in paths
+	"testing"                  // Go's testing package
+	"time"                     // Window times
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestMaintenance checks planning, announcing, rejecting requests and cancelling windows
+func TestMaintenance(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	push := &fakeNotifier{channel: notify.ChannelPush, sent: map[uint][]notify.Message{}}
+	UseNotifier(push)
+	defer delete(notifiers, notify.ChannelPush)
+	user := models.User{Email: "user@example.com", Password: "x"}
+	require.NoError(t, database.DB.Create(&user).Error)
+
+	r := gin.New()
+	setUser := func(c *gin.Context) { c.Set("userID", user.ID) }
+	r.POST("/api/motor", setUser, EnqueueMotorRequest)
+	r.GET("/admin/status", GetSystemStatus)
+	r.GET("/admin/maintenance", setUser, ListMaintenance)
+	r.POST("/admin/maintenance", setUser, CreateMaintenance)
+	r.DELETE("/admin/maintenance/:id", setUser, DeleteMaintenance)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	window := func(from, to time.Time) string {
+		return fmt.Sprintf(`{"starts_at":%q,"ends_at":%q,"reason":"pump replacement"}`, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	now := time.Now()
+	code, _ := call("POST", "/admin/maintenance", window(now.Add(2*time.Hour), now.Add(time.Hour)))
+	assert.Equal(t, 400, code)
+	code, _ = call("POST", "/admin/maintenance", window(now.Add(-3*time.Hour), now.Add(-time.Hour)))
+	assert.Equal(t, 400, code) // Already over
+	code, out := call("POST", "/admin/maintenance", window(now.Add(-time.Minute), now.Add(time.Hour)))
+	require.Equal(t, 201, code)
+	assert.Equal(t, true, out["active"])
+	path := "/admin/maintenance/" + strconv.Itoa(int(out["id"].(float64)))
+	require.Len(t, push.sent[user.ID], 1)
+	assert.Equal(t, "Planned maintenance", push.sent[user.ID][0].Title)
+
+	code, out = call("POST", "/api/motor", `{"duration":5}`)
+	assert.Equal(t, 503, code)
+	assert.Contains(t, out["error"], "maintenance")
+	assert.Equal(t, "pump replacement", out["reason"])
+	code, out = call("GET", "/admin/status", "")
+	require.Equal(t, 200, code)
+	assert.Equal(t, true, out["maintenance"].(map[string]any)["active"])
+
+	checked := now.Add(-90 * time.Second).Truncate(time.Second)
+	s := models.Schedule{UserID: user.ID, Cron: "* * * * *", Duration: 5 * time.Minute, Enabled: true, CheckedAt: checked}
+	require.NoError(t, database.DB.Create(&s).Error)
+	require.NoError(t, RunSchedules(context.Background())) // Deferred: nothing recorded, nothing consumed
+	var runs []models.ScheduleRun
+	database.DB.Where("schedule_id = ?", s.ID).Find(&runs)
+	assert.Empty(t, runs)
+	var after models.Schedule
+	database.DB.First(&after, s.ID)
+	assert.True(t, after.CheckedAt.Equal(checked))
+
+	code, _ = call("DELETE", path, "") // Ends it early
+	assert.Equal(t, 200, code)
+	require.Len(t, push.sent[user.ID], 2)
+	assert.Equal(t, "Maintenance cancelled", push.sent[user.ID][1].Title)
+	code, _ = call("DELETE", path, "")
+	assert.Equal(t, 404, code)
+
+	// A run that fell in a window is due when the window ends, so it isn't missed
+	database.DB.Create(&models.MaintenanceWindow{StartsAt: now.Add(-3 * time.Hour), EndsAt: now.Add(-time.Minute), Reason: "done"})
+	database.DB.Model(&s).UpdateColumn("checked_at", now.Add(-2*time.Hour))
+	require.NoError(t, RunSchedules(context.Background()))
+	database.DB.Where("schedule_id = ?", s.ID).Find(&runs)
+	require.Len(t, runs, 1)
+	assert.Equal(t, models.ScheduleRunQueued, runs[0].Status)
+	code, out = call("GET", "/admin/maintenance", "")
+	assert.Equal(t, 200, code)
+	assert.Empty(t, out["maintenance"]) // Past windows aren't listed
+}
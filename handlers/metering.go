@@ -0,0 +1,202 @@
+// metering.go - Per-organization monthly usage records for billing and their export
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB writes
+	"encoding/csv"             // CSV export
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Usage, organization and device models
+	"go-mqtt-backend/services" // Session outcomes
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"strconv"                  // CSV fields
+	"time"                     // Months
+
+	"github.com/gin-gonic/gin" // Gin web framework
+	"gorm.io/gorm"             // Update expressions
+	"gorm.io/gorm/clause"      // Upserts
+)
+
+const usageMonthLayout = "2006-01" // Months are metered in UTC
+
+func usageMonth(at time.Time) string { return at.UTC().Format(usageMonthLayout) }
+
+// upsertUsage creates an organization's record for a month with values, or applies set
+// to the existing one. Metering never fails the request it is counting; errors are logged.
+func upsertUsage(ctx context.Context, orgID uint, at time.Time, values map[string]any, set map[string]any) {
+	now := time.Now()
+	values["organization_id"], values["month"], values["updated_at"] = orgID, usageMonth(at), now
+	set["updated_at"] = now
+	err := database.DB.WithContext(ctx).Model(&models.UsageRecord{}).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "organization_id"}, {Name: "month"}},
+		DoUpdates: clause.Assignments(set),
+	}).Create(values).Error
+	if err != nil {
+		slog.Error("usage metering failed", "organization_id", orgID, "error", err)
+	}
+}
+
+func meterUsage(ctx context.Context, orgID uint, at time.Time, counters map[string]int64) { // Adds to an organization's monthly counters
+	values, set := map[string]any{}, map[string]any{}
+	for col, n := range counters {
+		values[col], set[col] = n, gorm.Expr(col+" + ?", n)
+	}
+	upsertUsage(ctx, orgID, at, values, set)
+}
+
+func meterDevices(ctx context.Context, orgID uint, at time.Time, n int64) { // Raises the month's peak device count to n
+	upsertUsage(ctx, orgID, at, map[string]any{"devices": n}, map[string]any{"devices": gorm.Expr("MAX(devices, ?)", n)})
+}
+
+// MeterSession adds a finished, interrupted, safety-stopped, power-lost or stopped session's runtime to the monthly usage of
+// the organization the user belongs to when it ends. It is part of the MotorService
+// OnSession hook.
+func MeterSession(ev services.SessionEvent) {
+	if ev.Kind != services.SessionFinished && ev.Kind != services.SessionInterrupted && ev.Kind != services.SessionSafetyStopped && ev.Kind != services.SessionPowerLost && ev.Kind != services.SessionStopped {
+		return
+	}
+	if ev.Request.Simulate { // Dry runs are never billed
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var user models.User
+	if err := database.DB.WithContext(ctx).Select("id", "organization_id").Limit(1).Find(&user, ev.Request.UserID).Error; err != nil || user.ID == 0 {
+		slog.Error("usage metering failed: user not found", "user_id", ev.Request.UserID, "error", err)
+		return
+	}
+	meterUsage(ctx, user.OrganizationID, ev.At, map[string]int64{"runtime_seconds": int64(ev.Ran.Seconds()), "sessions": 1})
+}
+
+// MeterDevices records every organization's registered device count in this month's
+// usage, so each tenant has a record even in a month without activity. It runs as a job.
+func MeterDevices(ctx context.Context) error {
+	db := database.DB.WithContext(ctx)
+	var orgs []models.Organization
+	if err := db.Select("id").Find(&orgs).Error; err != nil {
+		return err
+	}
+	var counts []struct {
+		OrganizationID uint
+		N              int64
+	}
+	if err := db.Model(&models.Device{}).Select("organization_id, COUNT(*) AS n").Group("organization_id").Scan(&counts).Error; err != nil {
+		return err
+	}
+	byOrg := make(map[uint]int64, len(counts))
+	for _, c := range counts {
+		byOrg[c.OrganizationID] = c.N
+	}
+	now := time.Now()
+	for _, o := range orgs {
+		meterDevices(ctx, o.ID, now, byOrg[o.ID])
+	}
+	return nil
+}
+
+type UsageResponse struct { // A monthly usage record as exported
+	OrganizationID   uint      `json:"organization_id"`
+	OrganizationSlug string    `json:"organization_slug"`
+	Month            string    `json:"month"`
+	RuntimeMinutes   float64   `json:"runtime_minutes"`
+	Sessions         int64     `json:"sessions"`
+	MessagesIn       int64     `json:"messages_in"`
+	MessagesOut      int64     `json:"messages_out"`
+	Devices          int64     `json:"devices"`
+	EnergyKWh        float64   `json:"energy_kwh"` // Estimated from the organization's pump ratings
+	Liters           float64   `json:"liters"`     // Estimated water pumped
+	Cost             float64   `json:"cost"`       // Estimated energy and water cost at the pump's tariffs
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+func usageResponses(ctx context.Context, records []models.UsageRecord, totals map[orgMonth]runTotals) ([]UsageResponse, error) {
+	var orgs []models.Organization
+	if err := database.DB.WithContext(ctx).Select("id", "slug").Find(&orgs).Error; err != nil {
+		return nil, err
+	}
+	slugs := make(map[uint]string, len(orgs))
+	for _, o := range orgs {
+		slugs[o.ID] = o.Slug
+	}
+	out := make([]UsageResponse, len(records))
+	for i, r := range records {
+		t := totals[orgMonth{r.OrganizationID, r.Month}]
+		out[i] = UsageResponse{
+			OrganizationID:   r.OrganizationID,
+			OrganizationSlug: slugs[r.OrganizationID],
+			Month:            r.Month,
+			RuntimeMinutes:   float64(r.RuntimeSeconds) / 60,
+			Sessions:         r.Sessions,
+			MessagesIn:       r.MessagesIn,
+			MessagesOut:      r.MessagesOut,
+			Devices:          r.Devices,
+			EnergyKWh:        t.EnergyKWh,
+			Liters:           t.Liters,
+			Cost:             t.Cost,
+			UpdatedAt:        r.UpdatedAt,
+		}
+	}
+	return out, nil
+}
+
+// ExportUsage returns metering records for a range of months ("from" and "to", default
+// the current month), optionally for one organization, as JSON or, with format=csv, as a
+// CSV download, with the estimated energy, water and cost of the runs requested in each
+// month. The current month's figures keep growing until it ends.
+func ExportUsage(c *gin.Context) {
+	current := usageMonth(time.Now())
+	from, to := c.DefaultQuery("from", current), c.DefaultQuery("to", current)
+	for _, m := range []string{from, to} {
+		if _, err := time.Parse(usageMonthLayout, m); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must be months like 2024-06"})
+			return
+		}
+	}
+	if from > to {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must not be after to"})
+		return
+	}
+	q := database.DB.WithContext(c.Request.Context()).Where("month BETWEEN ? AND ?", from, to)
+	org := c.Query("organization_id")
+	if org != "" {
+		q = q.Where("organization_id = ?", org)
+	}
+	var records []models.UsageRecord
+	if err := q.Order("month, organization_id").Find(&records).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load usage"})
+		return
+	}
+	totals, err := activationTotals(c.Request.Context(), from, to, org)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load usage"})
+		return
+	}
+	out, err := usageResponses(c.Request.Context(), records, totals)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load usage"})
+		return
+	}
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, gin.H{"usage": out})
+	case "csv":
+		c.Header("Content-Disposition", `attachment; filename="usage-`+from+`-`+to+`.csv"`)
+		c.Header("Content-Type", "text/csv")
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"organization_id", "organization_slug", "month", "runtime_minutes", "sessions", "messages_in", "messages_out", "devices", "energy_kwh", "liters", "cost"})
+		for _, u := range out {
+			w.Write([]string{
+				strconv.Itoa(int(u.OrganizationID)), u.OrganizationSlug, u.Month,
+				strconv.FormatFloat(u.RuntimeMinutes, 'f', 2, 64),
+				strconv.FormatInt(u.Sessions, 10), strconv.FormatInt(u.MessagesIn, 10),
+				strconv.FormatInt(u.MessagesOut, 10), strconv.FormatInt(u.Devices, 10),
+				strconv.FormatFloat(u.EnergyKWh, 'f', 2, 64), strconv.FormatFloat(u.Liters, 'f', 0, 64),
+				strconv.FormatFloat(u.Cost, 'f', 2, 64),
+			})
+		}
+		w.Flush()
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+	}
+}
@@ -0,0 +1,145 @@
+// metering_test.go - Tests for per-organization usage metering
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"context"                  // For the job context
+	"encoding/json"            // Response bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Usage, organization and device models
+	"go-mqtt-backend/services" // Session events
+	"go-mqtt-backend/store"    // Motor requests
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"strconv"                  // IDs in queries
+	"strings"                  // CSV lines
+	"testing"                  // Go's testing package
+	"time"                     // Durations
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestUsageMetering checks that runtime, messages and devices add up per organization and month
+func TestUsageMetering(t *testing.T) {
+	setupTestDB()
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres"}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	user := models.User{Email: "user@example.com", Password: "x", OrganizationID: farm.ID}
+	require.NoError(t, database.DB.Create(&user).Error)
+	require.NoError(t, database.DB.Create(&models.Device{OrganizationID: farm.ID, Name: "pump-1"}).Error)
+
+	now := time.Now()
+	req := store.MotorRequest{UserID: user.ID, Duration: 10 * time.Minute}
+	MeterSession(services.SessionEvent{Kind: services.SessionStarted, Request: req, At: now})
+	MeterSession(services.SessionEvent{Kind: services.SessionFinished, Request: req, At: now, Ran: 10 * time.Minute})
+	MeterSession(services.SessionEvent{Kind: services.SessionInterrupted, Request: req, At: now, Ran: 90 * time.Second})
+	MeterSession(services.SessionEvent{Kind: services.SessionFinished, Request: req, At: now.AddDate(0, -1, 0), Ran: time.Minute})
+	handle := Telemetry("sensors/", func() bool { return false })
+	handle("green-acres/pump-1/sensors/soil_moisture", []byte("18"))
+	handle("green-acres/pump-1/sensors/soil_moisture", []byte("19"))
+	handle("green-acres/pump-9/sensors/soil_moisture", []byte("19")) // Unregistered: not counted
+	require.NoError(t, FlushTelemetry(context.Background()))
+	require.NoError(t, MeterDevices(context.Background()))
+
+	var rec models.UsageRecord
+	require.NoError(t, database.DB.Where("organization_id = ? AND month = ?", farm.ID, usageMonth(now)).First(&rec).Error)
+	assert.Equal(t, int64(690), rec.RuntimeSeconds)
+	assert.Equal(t, int64(2), rec.Sessions)
+	assert.Equal(t, int64(2), rec.MessagesIn)
+	assert.Equal(t, int64(1), rec.Devices)
+	var idle models.UsageRecord // Every tenant gets a record from the device job
+	require.NoError(t, database.DB.Where("organization_id = ? AND month = ?", database.DefaultOrgID, usageMonth(now)).First(&idle).Error)
+	assert.Zero(t, idle.Devices)
+
+	r := gin.New()
+	r.GET("/admin/usage", ExportUsage)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin/usage"+query, nil)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, 400, get("?from=2024-13").Code)
+	assert.Equal(t, 400, get("?from=2024-06&to=2024-05").Code)
+	assert.Equal(t, 400, get("?format=xml").Code)
+
+	w := get("?organization_id=" + strconv.Itoa(int(farm.ID)) + "&from=" + usageMonth(now.AddDate(0, -1, 0)))
+	require.Equal(t, 200, w.Code)
+	var out struct{ Usage []UsageResponse }
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+	require.Len(t, out.Usage, 2)
+	assert.Equal(t, 1.0, out.Usage[0].RuntimeMinutes) // Last month first
+	assert.Equal(t, "green-acres", out.Usage[1].OrganizationSlug)
+	assert.Equal(t, 11.5, out.Usage[1].RuntimeMinutes)
+
+	w = get("?format=csv")
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(t, lines, 3) // Header and both organizations
+	assert.True(t, strings.HasPrefix(lines[0], "organization_id,organization_slug,month,runtime_minutes"))
+}
+
+// TestActivationCosts checks estimates from pump ratings and their totals in usage exports
+func TestActivationCosts(t *testing.T) {
+	setupTestDB()
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres"}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	admin := models.User{Email: "boss@example.com", Password: "x", Role: models.RoleOrgAdmin, OrganizationID: farm.ID}
+	require.NoError(t, database.DB.Create(&admin).Error)
+	gateway := models.Device{OrganizationID: farm.ID, Name: "gateway"} // Not a pump
+	pump := models.Device{OrganizationID: farm.ID, Name: "pump-1"}
+	require.NoError(t, database.DB.Create(&gateway).Error)
+	require.NoError(t, database.DB.Create(&pump).Error)
+
+	r := gin.New()
+	setCaller := func(c *gin.Context) { c.Set("userID", admin.ID); c.Set("orgID", farm.ID) }
+	r.PUT("/api/org/devices/:id", setCaller, UpdateDevice)
+	r.GET("/admin/usage", ExportUsage)
+	put := func(id uint, body string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/api/org/devices/"+strconv.Itoa(int(id)), strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, 400, put(pump.ID, `{"power_kw":-1}`))
+	assert.Equal(t, 404, put(9999, `{"power_kw":1}`))
+
+	ctx := context.Background()
+	unrated := &models.DeviceActivation{UserID: admin.ID, RequestAt: time.Now(), Duration: time.Hour}
+	EstimateActivation(ctx, unrated)
+	assert.Equal(t, farm.ID, unrated.OrganizationID)
+	assert.Nil(t, unrated.DeviceID)
+
+	// 2.2 kW, 120 L/min, 50 per kWh and 30 per cubic meter
+	require.Equal(t, 200, put(pump.ID, `{"power_kw":2.2,"flow_lpm":120,"energy_tariff":50,"water_tariff":30}`))
+	now := time.Now()
+	for _, d := range []time.Duration{30 * time.Minute, 15 * time.Minute} {
+		a := &models.DeviceActivation{UserID: admin.ID, RequestAt: now, Duration: d}
+		EstimateActivation(ctx, a)
+		require.NoError(t, services.NewGormMotorRepository(database.DB).LogActivation(ctx, a))
+	}
+	var first models.DeviceActivation
+	require.NoError(t, database.DB.Order("id").First(&first).Error)
+	require.NotNil(t, first.DeviceID)
+	assert.Equal(t, pump.ID, *first.DeviceID)
+	assert.InDelta(t, 1.1, first.EnergyKWh, 1e-9)
+	assert.InDelta(t, 3600, first.Liters, 1e-9)
+	assert.InDelta(t, 1.1*50+3.6*30, first.Cost, 1e-9)
+
+	meterUsage(ctx, farm.ID, now, map[string]int64{"sessions": 2})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/usage?organization_id="+strconv.Itoa(int(farm.ID)), nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var out struct{ Usage []UsageResponse }
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+	require.Len(t, out.Usage, 1)
+	assert.InDelta(t, 1.65, out.Usage[0].EnergyKWh, 1e-9)
+	assert.InDelta(t, 5400, out.Usage[0].Liters, 1e-9)
+	assert.InDelta(t, 1.65*50+5.4*30, out.Usage[0].Cost, 1e-9)
+}
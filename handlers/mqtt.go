@@ -3,32 +3,128 @@
 package handlers // Declares the package name
 
 import ( // Import required packages
-	"go-mqtt-backend/database"
-	"go-mqtt-backend/models"
-	"go-mqtt-backend/mqtt" // MQTT client
-	"net/http"             // HTTP status codes
-	"sync"                 // For mutex (thread safety)
-	"time"                 // For time operations
+	"bytes"                    // Delayed payloads
+	"cmp"                      // Defaults
+	"context"                  // For status lookups
+	"errors"                   // For checking service errors
+	"fmt"                      // Audit details
+	"go-mqtt-backend/chaos"    // Delayed acks
+	"go-mqtt-backend/database" // Default organization
+	"go-mqtt-backend/models"   // Session log
+	"go-mqtt-backend/mqtt"     // MQTT client
+	"go-mqtt-backend/services" // Motor queue and quota logic
+	"go-mqtt-backend/store"    // Queue errors
+	"io"                       // Empty bodies
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"strconv"                  // Retry-After
+	"strings"                  // Note trimming
+	"time"                     // For time operations
 
 	"github.com/gin-gonic/gin" // Gin web framework
 )
 
 type CommandInput struct { // Struct for command input
-	Topic   string      `json:"topic" binding:"required"`   // MQTT topic (required)
-	Payload interface{} `json:"payload" binding:"required"` // Payload (required)
+	Topic    string      `json:"topic" binding:"required"`   // MQTT topic (required)
+	Payload  interface{} `json:"payload" binding:"required"` // Payload (required)
+	Simulate bool        `json:"simulate"`                   // Dry run of a motor "on"/"off": nothing is published
 }
 
-func SendCommand(c *gin.Context) { // Handler to send MQTT command
+// SendCommand publishes to a topic under one of the caller's organization's registered
+// devices ("{org}/{device}/..."); global admins can address any registered device. Only
+// a motor "off" is exempt from the control restrictions (see ControlGuard).
+func SendCommand(c *gin.Context) {
 	var input CommandInput                           // Declare input variable
 	if err := c.ShouldBindJSON(&input); err != nil { // Parse JSON input
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}) // Return error if invalid
 		return
 	}
-	if err := mqtt.Publish(input.Topic, input.Payload); err != nil { // Publish to MQTT
+	org, dev, rest, err := resolveDevice(c.Request.Context(), input.Topic)
+	if err != nil && !errors.Is(err, errUnknownDevice) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not check topic"})
+		return
+	}
+	if err != nil || (org.ID != orgOf(c) && !isGlobalAdmin(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "topic must be under one of your organization's devices: {org}/{device}/..."})
+		return
+	}
+	cmd, _ := input.Payload.(string)
+	motor := motorKey(org.Slug, dev.Name)
+	isMotor := motorService != nil && rest == services.MotorTopic && (cmd == services.CommandOn || cmd == services.CommandOff)
+	if (!isMotor || cmd != services.CommandOff) && !controlAllowed(c) { // OFF is allowed from anywhere
+		return
+	}
+	if isMotor { // Refuse what the motor's state doesn't allow, e.g. ON during a fault
+		if err := motorService.CheckCommand(motor, cmd); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "motor": motorService.MotorState(motor)})
+			return
+		}
+	}
+	if input.Simulate && !isMotor {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "simulate only applies to motor on/off commands"})
+		return
+	}
+	simulated := isMotor && (input.Simulate || motorService.Simulating())
+	if isMotor && cmd == services.CommandOn && dev.ShutDown(time.Now()) { // Shut down on its own; the rest of the fleet runs
+		sd := deviceShutdown(org, dev)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "device is shut down", "shutdown": sd})
+		return
+	}
+	if isMotor && cmd == services.CommandOn { // One session per motor, whichever replica started it
+		var ierr *services.InterlockError
+		if err := motorService.LockMotor(c.Request.Context(), motor, c.MustGet("userID").(uint)); errors.As(err, &ierr) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "interlock": ierr.Holder})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not check motor interlock"})
+			return
+		}
+	}
+	if simulated { // The simulator plays the device; nothing reaches MQTT or the bill
+		motorService.SimulateCommand(c.Request.Context(), motor, cmd)
+		motorService.Commanded(motor, cmd)
+		if cmd == services.CommandOff {
+			motorService.UnlockMotor(c.Request.Context(), motor)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "command simulated", "simulated": true})
+		return
+	}
+	payload := input.Payload
+	if isMotor { // Sequenced when firmware checks for replays
+		if payload, err = motorService.CommandPayload(c.Request.Context(), motor, cmd); err != nil {
+			if cmd == services.CommandOn {
+				motorService.UnlockMotor(c.Request.Context(), motor)
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not number motor command"})
+			return
+		}
+	}
+	if !isMotor { // Nothing depends on the broker having it yet, so don't make the caller wait
+		if err := mqtt.PublishAsync(input.Topic, payload); errors.Is(err, mqtt.ErrPublishQueueFull) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "too many commands waiting to be sent, try again shortly"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		meterUsage(c.Request.Context(), org.ID, time.Now(), map[string]int64{"messages_out": 1})
+		c.JSON(http.StatusAccepted, gin.H{"message": "command queued"})
+		return
+	}
+	if err := mqtt.PublishContext(c.Request.Context(), input.Topic, payload); err != nil { // Publish to MQTT
+		if cmd == services.CommandOn {
+			motorService.UnlockMotor(c.Request.Context(), motor)
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()}) // Return error if publish fails
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "command sent"}) // Success response
+	motorService.Commanded(motor, cmd)
+	slog.Info("motor command sent", "motor", motor, "command", cmd, "user_id", c.MustGet("userID"), "request_id", c.GetString("requestID"))
+	if cmd == services.CommandOff {
+		motorService.UnlockMotor(c.Request.Context(), motor)
+	}
+	meterUsage(c.Request.Context(), org.ID, time.Now(), map[string]int64{"messages_out": 1}) // Billed to the device's tenant
+	c.JSON(http.StatusOK, gin.H{"message": "command sent"})                                  // Success response
 }
 
 // For demonstration, this endpoint just returns a placeholder
@@ -36,88 +132,262 @@ func GetDeviceData(c *gin.Context) { // Handler to get device data (placeholder)
 	c.JSON(http.StatusOK, gin.H{"data": "device data would be here"}) // Return placeholder data
 }
 
-type MotorRequest struct { // Struct for motor-on request
-	UserID    uint          // User ID (not used in this example)
-	RequestAt time.Time     // Time of request
-	Duration  time.Duration // How long to turn on
-}
-
-var ( // Variables for motor queue and quota
-	motorQueue      = make(chan *MotorRequest, 100) // Channel for queued requests
-	motorQuotaMutex sync.Mutex                      // Mutex for thread safety
-	totalMotorTime  time.Duration                   // Total motor-on time in 24h
-	quotaResetTime  time.Time                       // When quota resets
-	motorQuota      = 1 * time.Hour                 // Max allowed per 24h
-)
+func motorKey(orgSlug, device string) string { return orgSlug + "/" + device } // State key of a tenant device's motor
 
-func init() { // Initialize quota reset and start queue processor
-	quotaResetTime = time.Now().Add(24 * time.Hour) // Set initial reset time
-	go processMotorQueue()                          // Start queue processor goroutine
+// MotorStatusUpdate applies a motor's report ("on", "off" or "fault[: detail]") to its
+// state: on MotorStatusTopic for the shared motor, on {org}/{device}/motor/status for a
+// tenant device. In chaos mode some reports are handled late.
+func MotorStatusUpdate(topic string, payload []byte) {
+	if d := chaosInjector.AckDelay(); d > 0 {
+		payload = bytes.Clone(payload)
+		time.AfterFunc(d, func() { motorStatusUpdate(topic, payload) })
+		return
+	}
+	motorStatusUpdate(topic, payload)
 }
 
-func processMotorQueue() { // Goroutine to process motor queue
-	for req := range motorQueue { // For each request in queue
-		motorQuotaMutex.Lock()                // Lock for thread safety
-		if time.Now().After(quotaResetTime) { // If quota period expired
-			totalMotorTime = 0                              // Reset total time
-			quotaResetTime = time.Now().Add(24 * time.Hour) // Set next reset
+func motorStatusUpdate(topic string, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	motor, orgID := services.SharedMotor, database.DefaultOrgID
+	if topic != services.MotorStatusTopic {
+		org, dev, rest, err := resolveDevice(ctx, topic)
+		if err == nil && rest != services.MotorStatusTopic {
+			err = errUnknownDevice
 		}
-		if totalMotorTime+req.Duration > motorQuota { // If quota exceeded
-			motorQuotaMutex.Unlock() // Unlock
-			// Quota exceeded, skip this request
-			continue
+		if err != nil {
+			slog.Warn("ignoring motor status", "topic", topic, "error", err)
+			return
 		}
-		totalMotorTime += req.Duration // Add to total time
-		motorQuotaMutex.Unlock()       // Unlock
-
-		// --- Motor control logic (commented out) ---
-		mqtt.Publish("motor/control", "on")  // Send ON command
-		time.Sleep(req.Duration)             // Wait for duration
-		mqtt.Publish("motor/control", "off") // Send OFF command
+		motor, orgID = motorKey(org.Slug, dev.Name), org.ID
+	}
+	if _, err := motorService.Ack(motor, payload); err != nil { // Faults are recorded by RecordFault
+		slog.Warn("ignoring motor status", "topic", topic, "error", err)
+		return
 	}
+	publishEvent(TopicMotor, orgID, gin.H{"motor": motor, "state": motorService.MotorState(motor)})
+}
+
+var motorService *services.MotorService // Motor queue, quota and shutdown logic (set by UseMotorService)
+
+var chaosInjector *chaos.Injector // Delays motor status reports in chaos mode (nil: never)
+
+func UseChaos(i *chaos.Injector) { // Delays motor status reports at i's rate
+	chaosInjector = i
+}
+
+func UseMotorService(svc *services.MotorService) { // Injects the motor service; call before serving requests
+	motorService = svc
 }
 
 // Handler to enqueue motor-on requests
 func EnqueueMotorRequest(c *gin.Context) {
 	var input struct {
-		Duration int `json:"duration" binding:"required"` // Duration in minutes
+		Duration  int       `json:"duration" binding:"required,min=1"`                  // Duration in minutes
+		Simulate  bool      `json:"simulate"`                                           // Dry run: queued and logged as usual, the motor is never switched
+		Note      string    `json:"note" binding:"max=140"`                             // Label shown in history and the admin queue, e.g. "filling tank for seedlings"
+		Priority  string    `json:"priority" binding:"omitempty,oneof=low normal high"` // Urgent runs (high) jump ahead of routine ones; default normal
+		ExpiresAt time.Time `json:"expires_at"`                                         // RFC 3339; skipped rather than run if it hasn't started by then (omit: never)
 	}
 	if err := c.ShouldBindJSON(&input); err != nil { // Parse JSON input
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}) // Return error if invalid
 		return
 	}
-	motorQuotaMutex.Lock()                // Lock for thread safety
-	if time.Now().After(quotaResetTime) { // If quota period expired
-		totalMotorTime = 0                              // Reset total time
-		quotaResetTime = time.Now().Add(24 * time.Hour) // Set next reset
-	}
-	if totalMotorTime+time.Duration(input.Duration)*time.Minute > motorQuota { // If quota exceeded
-		motorQuotaMutex.Unlock()                                                                                      // Unlock
-		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Daily motor-on quota reached. Try again after 24 hours."}) // Return error
-		return
-	}
-	motorQuotaMutex.Unlock()          // Unlock
 	userID, exists := c.Get("userID") // Get user ID from context
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "user ID not found in token"})
 		return
 	}
-	// Log to DB
-	logEntry := models.DeviceActivation{
-		UserID:    userID.(uint),
-		RequestAt: time.Now(),
-		Duration:  time.Duration(input.Duration) * time.Minute,
+	if max := motorService.MaxDuration(); max > 0 && time.Duration(input.Duration)*time.Minute > max { // Before the quota, which it may exceed
+		tooLong(c, max)
+		return
+	}
+	if w, err := activeMaintenance(c.Request.Context(), time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to queue request"})
+		return
+	} else if w != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": maintenanceMessage(w), "reason": w.Reason, "until": w.EndsAt})
+		return
+	}
+	if reason, err := quotaRejection(c.Request.Context(), userID.(uint), time.Duration(input.Duration)*time.Minute); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to queue request"})
+		return
+	} else if reason != "" {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": reason})
+		return
+	}
+	opts := services.EnqueueOptions{DryRun: input.Simulate, Note: strings.TrimSpace(input.Note), Priority: input.Priority, ExpiresAt: input.ExpiresAt}
+	id, err := motorService.EnqueueWith(c.Request.Context(), userID.(uint), time.Duration(input.Duration)*time.Minute, opts)
+	var shutdown *services.ShutdownError
+	var backlog *services.BackpressureError
+	switch {
+	case err == nil && (input.Simulate || motorService.Simulating()):
+		c.JSON(http.StatusOK, gin.H{"message": "Request queued (simulation)", "id": id, "simulated": true})
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Request queued", "id": id}) // Success response; the ID cancels it
+	case errors.As(err, &shutdown):
+		resp := gin.H{"error": "system is shut down", "category": shutdown.Category, "reason": shutdown.Reason}
+		if !shutdown.Until.IsZero() {
+			resp["until"] = shutdown.Until
+		}
+		c.JSON(http.StatusServiceUnavailable, resp)
+	case errors.Is(err, services.ErrTooLong): // The limit changed since the check above
+		tooLong(c, motorService.MaxDuration())
+	case errors.Is(err, services.ErrDuration):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "duration must be at least one minute"})
+	case errors.Is(err, services.ErrExpiry):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+	case errors.Is(err, services.ErrQuotaExceeded):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Daily motor-on quota reached. Try again after 24 hours."})
+	case errors.As(err, &backlog):
+		c.Header("Retry-After", strconv.Itoa(int(backlog.RetryAfter.Seconds())))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": backlog.Error(), "drain_minutes": int(backlog.Drain.Minutes()), "limit_per_hour": backlog.Limit})
+	case errors.Is(err, store.ErrQueueFull):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "motor queue is full, try again later"})
+	default:
+		slog.Error("enqueue motor request failed", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to queue request"})
+	}
+}
+
+func tooLong(c *gin.Context, max time.Duration) { // 422 with the per-request limit (MAX_RUN_SECONDS) and the longest duration within it
+	secs, mins := int(max.Seconds()), int(max/time.Minute) // Durations are whole minutes, so the longest allowed is rounded down
+	c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("duration is over the %d s limit per request, at most %d min", secs, mins), "max_duration": mins, "max_seconds": secs})
+}
+
+// GetMotorRequest tells the caller where their request (admins: anyone's) stands: its
+// place in the queue, the runtime asked for ahead of it and when it should start and
+// finish, or when it started if the motor is already on for it. Estimates assume every
+// run takes what was asked for; "held" says why nothing is dispatched right now. Once it
+// has left the queue, the status is how it ended (e.g. "finished" or "expired").
+func GetMotorRequest(c *gin.Context) {
+	owner := c.MustGet("userID").(uint)
+	if isGlobalAdmin(c) {
+		owner = 0 // Any user's
+	}
+	ctx := c.Request.Context()
+	est, err := motorService.Estimate(ctx, c.Param("id"), owner)
+	switch {
+	case errors.Is(err, services.ErrNotQueued):
+		ended, err := endedRequest(ctx, c.Param("id"), owner)
+		switch {
+		case err != nil:
+			slog.Error("look up ended motor request failed", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to look up request"})
+		case ended.ID == 0:
+			c.JSON(http.StatusNotFound, gin.H{"error": "no queued request with that ID"})
+		default:
+			resp := gin.H{"id": ended.QueueID, "status": ended.Outcome, "duration_min": ended.Requested.Minutes(), "ran_minutes": ended.Ran.Minutes(), "ended_at": ended.EndedAt}
+			if ended.Reason != "" {
+				resp["reason"] = ended.Reason
+			}
+			c.JSON(http.StatusOK, resp)
+		}
+		return
+	case err != nil:
+		slog.Error("estimate motor request failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to look up request"})
+		return
+	}
+	resp := gin.H{
+		"id":               est.Request.ID,
+		"status":           "queued",
+		"duration_min":     est.Request.Duration.Minutes(),
+		"priority":         cmp.Or(est.Request.Priority, store.PriorityNormal),
+		"estimated_start":  est.StartAt,
+		"estimated_finish": est.FinishAt,
+	}
+	if est.Running {
+		resp["status"] = "running"
+		resp["started_at"] = est.StartAt
+		delete(resp, "estimated_start")
+	} else {
+		resp["position"] = est.Position
+		resp["ahead_minutes"] = est.Ahead.Minutes()
+		resp["current_minutes_left"] = est.Current.Minutes()
 	}
-	if err := database.DB.Create(&logEntry).Error; err != nil {
-		// Optionally handle/log DB error
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to log request"})
+	if !est.Request.ExpiresAt.IsZero() {
+		resp["expires_at"] = est.Request.ExpiresAt
+		if !est.Running && est.StartAt.After(est.Request.ExpiresAt) {
+			resp["expires_before_start"] = true // Unless the queue moves faster than estimated
+		}
+	}
+	if est.Held != "" {
+		resp["held"] = est.Held
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type StopRunInput struct { // Struct for stopping the running motor session
+	Reason string `json:"reason" binding:"max=255"` // Told to the owner when an admin stops someone else's run
+}
+
+// StopMotorRun switches off the run the motor is on for now if it is the caller's (admins:
+// anyone's), without waiting for its time to be up. The run ends as stopped, only what it
+// ran counts against the quota, and the stop is audited.
+func StopMotorRun(c *gin.Context) {
+	var input StopRunInput
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) { // The body is optional
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	userID := c.MustGet("userID").(uint)
+	admin := isGlobalAdmin(c)
+	reason := services.OwnerStopReason // Users can only stop their own runs
+	if admin {
+		reason = cmp.Or(strings.TrimSpace(input.Reason), fmt.Sprintf("stopped by admin %d", userID))
+	}
+	l, err := motorService.StopRun(ctx, userID, admin, reason)
+	switch {
+	case errors.Is(err, services.ErrNoSession):
+		c.JSON(http.StatusNotFound, gin.H{"error": "no run of yours is on"})
 		return
+	case err != nil:
+		slog.Error("stop motor run failed", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to stop run"})
+		return
+	}
+	ran := time.Since(l.Since)
+	slog.Info("motor run stopped", "user_id", l.UserID, "by", userID, "ran", ran)
+	recordAudit(ctx, userID, "motor_run_stopped", fmt.Sprintf("run of user %d since %s, after %d min", l.UserID, l.Since.UTC().Format(time.RFC3339), int(ran.Minutes())))
+	c.JSON(http.StatusOK, gin.H{"message": "Run stopped", "user_id": l.UserID, "started_at": l.Since, "ran_minutes": ran.Minutes()})
+}
+
+// endedRequest returns how the request id ended, from the session log (ID 0 if it never
+// left the queue). Only owner's are found, unless owner is 0.
+func endedRequest(ctx context.Context, id string, owner uint) (models.SessionLog, error) {
+	var entry models.SessionLog
+	q := database.DB.WithContext(ctx).Where("queue_id = ?", id)
+	if owner != 0 {
+		q = q.Where("user_id = ?", owner)
+	}
+	err := q.Order("id DESC").Limit(1).Find(&entry).Error
+	return entry, err
+}
+
+// CancelMotorRequest withdraws one of the caller's queued requests (admins: anyone's) by
+// the ID POST /api/motor returned. A request the motor is already on for can't be
+// cancelled (409); an admin stops its session instead.
+func CancelMotorRequest(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	owner := userID
+	if isGlobalAdmin(c) {
+		owner = 0 // Any user's
 	}
-	// In a real app, get user ID from JWT claims
-	motorQueue <- &MotorRequest{ // Add request to queue
-		UserID:    0,
-		RequestAt: time.Now(),
-		Duration:  time.Duration(input.Duration) * time.Minute,
+	req, err := motorService.Cancel(c.Request.Context(), c.Param("id"), owner, fmt.Sprintf("cancelled by user %d", userID))
+	switch {
+	case errors.Is(err, services.ErrNotQueued):
+		c.JSON(http.StatusNotFound, gin.H{"error": "no queued request with that ID"})
+		return
+	case errors.Is(err, services.ErrRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": "request is already running"})
+		return
+	case err != nil:
+		slog.Error("cancel motor request failed", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to cancel request"})
+		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Request queued"}) // Success response
+	recordAudit(c.Request.Context(), userID, "motor_request_cancelled", fmt.Sprintf("request %s of user %d for %d min", req.ID, req.UserID, int(req.Duration.Minutes())))
+	c.JSON(http.StatusOK, gin.H{"message": "Request cancelled", "id": req.ID})
 }
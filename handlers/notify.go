@@ -0,0 +1,203 @@
+// notify.go - Sends notifications about admin actions and motor sessions
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"errors"                   // Missing-address checks
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User model
+	"go-mqtt-backend/notify"   // Email, SMS, Telegram and push delivery
+	"go-mqtt-backend/services" // Session events
+	"go-mqtt-backend/store"    // Shutdown state
+	"log/slog"                 // Leveled logging
+	"time"                     // Timestamps
+
+	"gorm.io/gorm" // Recipient scopes
+)
+
+var notifiers = map[string]notify.Notifier{} // Enabled channels by name (set at startup by UseNotifier)
+
+func UseNotifier(n notify.Notifier) { // Enables a notification channel
+	notifiers[n.Channel()] = n
+}
+
+func allUsers(db *gorm.DB) *gorm.DB { return db } // Recipient scope: everyone
+
+func usersWithIDs(ids ...uint) func(*gorm.DB) *gorm.DB { // Recipient scope: these users
+	return func(db *gorm.DB) *gorm.DB { return db.Where("id IN ?", ids) }
+}
+
+func usersWithRole(role string) func(*gorm.DB) *gorm.DB { // Recipient scope: every user with role
+	return func(db *gorm.DB) *gorm.DB { return db.Where("role = ?", role) }
+}
+
+func orgAdminsOf(orgID uint) func(*gorm.DB) *gorm.DB { // Recipient scope: the admins of an organization
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("organization_id = ? AND role IN ?", orgID, []string{models.RoleOrgAdmin, models.RoleAdmin})
+	}
+}
+
+func usersWithoutRole(role string) func(*gorm.DB) *gorm.DB { // Recipient scope: every user without role
+	return func(db *gorm.DB) *gorm.DB { return db.Where("role <> ?", role) }
+}
+
+func userEmail(ctx context.Context, userID any) string { // Email of a user for messages, or a placeholder
+	var user models.User
+	if err := database.DB.WithContext(ctx).First(&user, userID).Error; err != nil {
+		return "an admin"
+	}
+	return user.Email
+}
+
+// AlertAdmins sends an admin_alert rendered from template to every admin on their chosen
+// channels (email, SMS, Telegram and push by default), ignoring quiet hours. data should
+// carry enough context to act on without opening the dashboard.
+func AlertAdmins(ctx context.Context, template string, data map[string]any) {
+	slog.Warn("admin alert", "template", template, "context", data)
+	notifyUsers(ctx, usersWithRole(models.RoleAdmin), notify.EventAdminAlert, template, data)
+}
+
+// notifyShutdown alerts every admin and notifies every other user (by their preferences)
+// when the system is shut down (sd.Active) or restarted. Messages are queued, so this never
+// delays the response. by names who did it, e.g. an admin's email.
+func notifyShutdown(ctx context.Context, sd store.Shutdown, by string, dropped int) {
+	publishEvent(TopicShutdown, 0, sd)
+	notifyUsers(ctx, usersWithoutRole(models.RoleAdmin), notify.EventShutdown, "shutdown", map[string]any{"Active": sd.Active, "Category": sd.Category, "Reason": sd.Summary(), "Until": sd.Until})
+	AlertAdmins(ctx, "shutdown_alert", map[string]any{
+		"Active":   sd.Active,
+		"By":       by,
+		"At":       time.Now(),
+		"Category": sd.Category,
+		"Reason":   sd.Summary(),
+		"Dropped":  dropped,
+		"Until":    sd.Until,
+	})
+}
+
+// notifyShutdownExpired tells everyone that a scheduled shutdown has ended by itself.
+func notifyShutdownExpired(ctx context.Context, sd store.Shutdown) {
+	publishEvent(TopicShutdown, 0, store.Shutdown{})
+	notifyUsers(ctx, usersWithoutRole(models.RoleAdmin), notify.EventShutdown, "shutdown", map[string]any{"Active": false})
+	AlertAdmins(ctx, "shutdown_alert", map[string]any{
+		"Active":  false,
+		"Expired": true,
+		"At":      time.Now(),
+		"Since":   sd.Since,
+		"Reason":  sd.Summary(),
+	})
+}
+
+// NotifySession tells the requesting user when their motor session starts, finishes, is
+// cut short (including by the safety cutoff, a power outage or an admin) or is rejected at dispatch. It is the MotorService OnSession hook, so it only
+// queues messages.
+func NotifySession(ev services.SessionEvent) {
+	var event, template string
+	switch ev.Kind {
+	case services.SessionStarted:
+		event = notify.EventSessionStarted
+	case services.SessionFinished:
+		event = notify.EventSessionFinished
+	case services.SessionInterrupted:
+		event = notify.EventSessionInterrupted
+	case services.SessionSafetyStopped:
+		event, template = notify.EventSessionInterrupted, "session_safety_stopped"
+	case services.SessionPowerLost:
+		event, template = notify.EventSessionInterrupted, "session_power_lost"
+	case services.SessionStopped:
+		if ev.Reason == services.OwnerStopReason { // They know
+			return
+		}
+		event, template = notify.EventSessionInterrupted, "session_stopped"
+	case services.SessionRejected:
+		event = notify.EventRequestRejected
+	case services.SessionExpired:
+		event, template = notify.EventRequestRejected, "request_expired"
+	default:
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if template == "" {
+		template = event
+	}
+	data := map[string]any{"Minutes": int(ev.Request.Duration.Minutes()), "RanMinutes": int(ev.Ran.Minutes()), "Reason": ev.Reason, "At": ev.At, "Simulated": ev.Request.Simulate, "Outages": ev.Outages}
+	notifyUsers(ctx, usersWithIDs(ev.Request.UserID), event, template, data)
+}
+
+// NotifyQuota warns every user when the shared daily quota crosses a warning level, so
+// nobody finds out from a 429 when they need the pump. It is the MotorService OnQuota hook.
+func NotifyQuota(ev services.QuotaEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	notifyUsers(ctx, allUsers, notify.EventQuotaWarning, "quota_warning", map[string]any{
+		"Percent":      ev.Percent,
+		"UsedMinutes":  int(ev.Used.Minutes()),
+		"LimitMinutes": int(ev.Quota.Minutes()),
+		"ResetsAt":     ev.ResetAt,
+	})
+}
+
+var critical = map[string]bool{notify.EventShutdown: true, notify.EventAdminAlert: true} // Events that ignore quiet hours
+
+// notifyUsers renders template in each selected user's locale and queues it on the
+// channels they chose for event. During a user's quiet hours only email goes out, except
+// for critical events.
+func notifyUsers(ctx context.Context, scope func(*gorm.DB) *gorm.DB, event, template string, data map[string]any) {
+	if len(notifiers) == 0 {
+		return
+	}
+	db := database.DB.WithContext(ctx)
+	var users []models.User
+	if err := db.Scopes(scope).Select("id", "email", "phone", "telegram_chat_id").Find(&users).Error; err != nil {
+		slog.Error("notification: user lookup failed", "event", event, "error", err)
+		return
+	}
+	if len(users) == 0 {
+		return
+	}
+	ids := make([]uint, len(users))
+	for i, u := range users {
+		ids[i] = u.ID
+	}
+	var rows []models.NotificationPrefs
+	db.Where("user_id IN ?", ids).Find(&rows) // Users without a row get the defaults
+	prefs := make(map[uint]models.NotificationPrefs, len(rows))
+	for _, p := range rows {
+		prefs[p.UserID] = p
+	}
+	tokens := make(map[uint][]string)
+	if notifiers[notify.ChannelPush] != nil {
+		var pts []models.PushToken
+		db.Where("user_id IN ?", ids).Find(&pts)
+		for _, pt := range pts {
+			tokens[pt.UserID] = append(tokens[pt.UserID], pt.Token)
+		}
+	}
+
+	rendered := make(map[string]notify.Message) // By locale
+	now := time.Now()
+	for _, u := range users {
+		p := prefs[u.ID]
+		msg, ok := rendered[p.Locale]
+		if !ok {
+			var err error
+			if msg, err = notify.DefaultTemplates.Render(event, template, p.Locale, data); err != nil {
+				slog.Error("notification: render failed", "template", template, "locale", p.Locale, "error", err)
+				return
+			}
+			rendered[p.Locale] = msg
+		}
+		to := notify.Recipient{UserID: u.ID, Email: u.Email, Phone: u.Phone, TelegramChatID: u.TelegramChatID, PushTokens: tokens[u.ID]}
+		quiet := !critical[event] && inQuietHours(p, now)
+		for _, ch := range channelsFor(p, event) {
+			n := notifiers[ch]
+			if n == nil || (quiet && ch != notify.ChannelEmail) {
+				continue
+			}
+			if err := n.Notify(to, msg); err != nil && !errors.Is(err, notify.ErrNoAddress) {
+				slog.Error("notification not queued", "event", event, "channel", ch, "user_id", u.ID, "error", err)
+			}
+		}
+	}
+}
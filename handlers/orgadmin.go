@@ -0,0 +1,199 @@
+// orgadmin.go - Org admin handlers: members and schedules of the caller's organization only
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"fmt"                        // For messages
+	"go-mqtt-backend/database"   // Database connection
+	"go-mqtt-backend/middleware" // Cached user roles
+	"go-mqtt-backend/models"     // User and schedule models
+	"log"                        // Logging
+	"net/http"                   // HTTP status codes
+	"time"                       // Quota durations
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+type MemberInput struct { // Struct for PUT /api/org/users/:id; omitted fields are left alone
+	Role       string `json:"role" binding:"omitempty,oneof=user org_admin"` // Global admins are made with create-admin
+	DailyQuota *int   `json:"daily_quota" binding:"omitempty,min=0"`         // Minutes per quota period (0 removes the limit)
+}
+
+func findMember(c *gin.Context) (models.User, bool) { // Loads :id if they are in the caller's organization, else responds 404
+	var u models.User
+	err := database.DB.WithContext(c.Request.Context()).Where("id = ? AND organization_id = ?", c.Param("id"), orgOf(c)).Limit(1).Find(&u).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load user"})
+		return u, false
+	}
+	if u.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return u, false
+	}
+	return u, true
+}
+
+// UpdateMember changes a member's role or own daily limit. The limit can't exceed the
+// organization's pool, or the motor's quota when there is no pool.
+func UpdateMember(c *gin.Context) {
+	var input MemberInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u, ok := findMember(c)
+	if !ok {
+		return
+	}
+	before := u
+	if input.Role != "" && input.Role != u.Role {
+		switch {
+		case u.Role == models.RoleAdmin:
+			c.JSON(http.StatusForbidden, gin.H{"error": "global admins can't be changed by an organization admin"})
+			return
+		case u.ID == c.MustGet("userID").(uint):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "you can't change your own role"})
+			return
+		}
+		u.Role = input.Role
+	}
+	if input.DailyQuota != nil {
+		limit := motorService.Quota()
+		var org models.Organization
+		if err := database.DB.WithContext(c.Request.Context()).First(&org, orgOf(c)).Error; err == nil {
+			if plan, err := planOf(c.Request.Context(), org); err == nil && poolOf(org, plan) > 0 {
+				limit = poolOf(org, plan)
+			}
+		}
+		quota := time.Duration(*input.DailyQuota) * time.Minute
+		if quota > limit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("daily_quota can't be more than %d minutes", int(limit.Minutes()))})
+			return
+		}
+		u.DailyQuota = quota
+	}
+	if u != before {
+		if err := database.DB.WithContext(c.Request.Context()).Model(&u).Select("role", "daily_quota").Updates(&u).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not update user"})
+			return
+		}
+		middleware.InvalidateUser(u.ID)
+		log.Printf("org admin %v updated user %d: role %s, daily quota %s", c.MustGet("userID"), u.ID, u.Role, u.DailyQuota)
+	}
+	c.JSON(http.StatusOK, memberResponse(u))
+}
+
+// RemoveMember moves a member back to the default organization as a regular user without
+// a limit of their own. Their schedules and history go with them.
+func RemoveMember(c *gin.Context) {
+	u, ok := findMember(c)
+	if !ok {
+		return
+	}
+	switch {
+	case u.ID == c.MustGet("userID").(uint):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "you can't remove yourself"})
+		return
+	case u.Role == models.RoleAdmin:
+		c.JSON(http.StatusForbidden, gin.H{"error": "global admins can't be removed by an organization admin"})
+		return
+	case u.OrganizationID == database.DefaultOrgID:
+		c.JSON(http.StatusConflict, gin.H{"error": "members of the default organization can't be removed"})
+		return
+	}
+	updates := map[string]any{"organization_id": database.DefaultOrgID, "role": models.RoleUser, "daily_quota": 0}
+	if err := database.DB.WithContext(c.Request.Context()).Model(&u).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not remove user"})
+		return
+	}
+	middleware.InvalidateUser(u.ID)
+	log.Printf("org admin %v removed user %d from organization %d", c.MustGet("userID"), u.ID, orgOf(c))
+	c.JSON(http.StatusOK, gin.H{"message": "user removed from organization"})
+}
+
+type OrgScheduleResponse struct { // A member's schedule as seen by an org admin
+	ScheduleResponse
+	UserID uint   `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+func ListOrgSchedules(c *gin.Context) { // Handler listing every member's schedules
+	db := database.DB.WithContext(c.Request.Context())
+	var users []models.User
+	if err := db.Scopes(usersInOrg(orgOf(c))).Select("id", "email").Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load schedules"})
+		return
+	}
+	emails := make(map[uint]string, len(users))
+	ids := make([]uint, len(users))
+	for i, u := range users {
+		emails[u.ID], ids[i] = u.Email, u.ID
+	}
+	var schedules []models.Schedule
+	if err := db.Where("user_id IN ?", ids).Order("id").Find(&schedules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load schedules"})
+		return
+	}
+	out := make([]OrgScheduleResponse, len(schedules))
+	for i, s := range schedules {
+		out[i] = OrgScheduleResponse{ScheduleResponse: scheduleResponse(s), UserID: s.UserID, Email: emails[s.UserID]}
+	}
+	c.JSON(http.StatusOK, gin.H{"schedules": out})
+}
+
+func findOrgSchedule(c *gin.Context) (models.Schedule, bool) { // Loads :id if a member owns it, else responds 404
+	var s models.Schedule
+	members := database.DB.Model(&models.User{}).Select("id").Where("organization_id = ?", orgOf(c))
+	err := database.DB.WithContext(c.Request.Context()).Where("id = ? AND user_id IN (?)", c.Param("id"), members).Limit(1).Find(&s).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load schedule"})
+		return s, false
+	}
+	if s.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
+		return s, false
+	}
+	return s, true
+}
+
+func SetOrgScheduleEnabled(c *gin.Context) { // Handler enabling or disabling a member's schedule
+	var input struct {
+		Enabled *bool `json:"enabled" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s, ok := findOrgSchedule(c)
+	if !ok {
+		return
+	}
+	if *input.Enabled && !s.Enabled {
+		s.CheckedAt = time.Now() // Don't report runs from while it was disabled as missed
+	}
+	s.Enabled = *input.Enabled
+	if err := database.DB.WithContext(c.Request.Context()).Model(&s).Select("enabled", "checked_at").Updates(&s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save schedule"})
+		return
+	}
+	log.Printf("org admin %v set schedule %d enabled=%v", c.MustGet("userID"), s.ID, *input.Enabled)
+	c.JSON(http.StatusOK, OrgScheduleResponse{ScheduleResponse: scheduleResponse(s), UserID: s.UserID})
+}
+
+func DeleteOrgSchedule(c *gin.Context) { // Handler removing a member's schedule and its history
+	s, ok := findOrgSchedule(c)
+	if !ok {
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	if err := db.Where("schedule_id = ?", s.ID).Delete(&models.ScheduleRun{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete schedule"})
+		return
+	}
+	if err := db.Delete(&s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete schedule"})
+		return
+	}
+	log.Printf("org admin %v deleted schedule %d of user %d", c.MustGet("userID"), s.ID, s.UserID)
+	c.JSON(http.StatusOK, gin.H{"message": "schedule deleted"})
+}
@@ -0,0 +1,105 @@
+// orgadmin_test.go - Tests for organization admin handlers
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"context"                  // For quota checks
+	"encoding/json"            // Response bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User and schedule models
+	"go-mqtt-backend/services" // Session outcomes
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"strconv"                  // IDs in paths
+	"testing"                  // Go's testing package
+	"time"                     // Durations
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestOrgAdmin checks that org admins manage members and schedules of their own organization only
+func TestOrgAdmin(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	ctx := context.Background()
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres", PlanID: planNamed(t, models.PlanPro)}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	admin := models.User{Email: "boss@example.com", Password: "x", Role: models.RoleOrgAdmin, OrganizationID: farm.ID}
+	member := models.User{Email: "member@example.com", Password: "x", OrganizationID: farm.ID}
+	global := models.User{Email: "root@example.com", Password: "x", Role: models.RoleAdmin, OrganizationID: farm.ID}
+	outsider := models.User{Email: "other@example.com", Password: "x", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&[]*models.User{&admin, &member, &global, &outsider}).Error)
+	mine := models.Schedule{UserID: member.ID, Cron: "0 6 * * *", Duration: 10 * time.Minute, Enabled: true}
+	theirs := models.Schedule{UserID: outsider.ID, Cron: "0 7 * * *", Duration: 10 * time.Minute, Enabled: true}
+	require.NoError(t, database.DB.Create(&[]*models.Schedule{&mine, &theirs}).Error)
+
+	r := gin.New()
+	setCaller := func(c *gin.Context) { c.Set("userID", admin.ID); c.Set("orgID", farm.ID) }
+	r.PUT("/api/org/users/:id", setCaller, UpdateMember)
+	r.DELETE("/api/org/users/:id", setCaller, RemoveMember)
+	r.GET("/api/org/schedules", setCaller, ListOrgSchedules)
+	r.PUT("/api/org/schedules/:id/enabled", setCaller, SetOrgScheduleEnabled)
+	r.DELETE("/api/org/schedules/:id", setCaller, DeleteOrgSchedule)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	userPath := func(u models.User) string { return "/api/org/users/" + strconv.Itoa(int(u.ID)) }
+	schedulePath := func(s models.Schedule) string { return "/api/org/schedules/" + strconv.Itoa(int(s.ID)) }
+
+	code, _ := call("PUT", userPath(outsider), `{"role":"org_admin"}`)
+	assert.Equal(t, 404, code)
+	code, _ = call("PUT", userPath(global), `{"role":"user"}`)
+	assert.Equal(t, 403, code)
+	code, _ = call("PUT", userPath(admin), `{"role":"user"}`)
+	assert.Equal(t, 400, code)
+	code, _ = call("PUT", userPath(member), `{"role":"admin"}`)
+	assert.Equal(t, 400, code)
+	code, _ = call("PUT", userPath(member), `{"daily_quota":90}`) // More than the motor's hour
+	assert.Equal(t, 400, code)
+	code, out := call("PUT", userPath(member), `{"daily_quota":30}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, 30.0, out["daily_quota"])
+	assert.Equal(t, models.RoleUser, out["role"])
+
+	database.DB.Create(&models.SessionLog{UserID: member.ID, Outcome: services.SessionFinished, Requested: 25 * time.Minute, Ran: 25 * time.Minute, EndedAt: time.Now()})
+	reason, err := quotaRejection(ctx, member.ID, 10*time.Minute)
+	require.NoError(t, err)
+	assert.Contains(t, reason, "your daily limit")
+	reason, err = quotaRejection(ctx, admin.ID, 10*time.Minute) // No limit of their own
+	require.NoError(t, err)
+	assert.Empty(t, reason)
+
+	code, out = call("GET", "/api/org/schedules", "")
+	require.Equal(t, 200, code)
+	schedules := out["schedules"].([]any)
+	require.Len(t, schedules, 1)
+	assert.Equal(t, "member@example.com", schedules[0].(map[string]any)["email"])
+	code, _ = call("PUT", schedulePath(theirs)+"/enabled", `{"enabled":false}`)
+	assert.Equal(t, 404, code)
+	code, out = call("PUT", schedulePath(mine)+"/enabled", `{"enabled":false}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, false, out["enabled"])
+	code, _ = call("DELETE", schedulePath(theirs), "")
+	assert.Equal(t, 404, code)
+	code, _ = call("DELETE", schedulePath(mine), "")
+	assert.Equal(t, 200, code)
+
+	code, _ = call("DELETE", userPath(admin), "")
+	assert.Equal(t, 400, code)
+	code, _ = call("DELETE", userPath(member), "")
+	require.Equal(t, 200, code)
+	var moved models.User
+	database.DB.First(&moved, member.ID)
+	assert.Equal(t, database.DefaultOrgID, moved.OrganizationID)
+	assert.Zero(t, moved.DailyQuota)
+}
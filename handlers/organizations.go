@@ -0,0 +1,361 @@
+// organizations.go - Tenants: the caller's organization and global admin management
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                    // For DB lookups
+	"fmt"                        // For messages
+	"go-mqtt-backend/database"   // Database connection
+	"go-mqtt-backend/middleware" // Cached user roles
+	"go-mqtt-backend/models"     // Organization and user models
+	"go-mqtt-backend/services"   // Session outcomes
+	"go-mqtt-backend/store"      // Queued requests
+	"log"                        // Logging
+	"log/slog"                   // Leveled logging
+	"net/http"                   // HTTP status codes
+	"regexp"                     // Slug validation
+	"strconv"                    // User IDs
+	"sync/atomic"                // Default per-user limit
+	"time"                       // Creation times and quota periods
+
+	"github.com/gin-gonic/gin" // Gin web framework
+	"gorm.io/gorm"             // Query scopes
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,63}$`) // e.g. "green-acres"
+
+type OrganizationInput struct { // Struct for creating an organization
+	Name string `json:"name" binding:"required,max=128"`
+	Slug string `json:"slug" binding:"required"` // Lowercase letters, digits and dashes
+	Plan string `json:"plan"`                    // Defaults to free
+}
+
+type OrganizationResponse struct { // An organization as returned by the API
+	ID         uint      `json:"id"`
+	Name       string    `json:"name"`
+	Slug       string    `json:"slug"`
+	Members    int64     `json:"members"`
+	DailyQuota int       `json:"daily_quota"` // Shared pool in minutes (0 for none)
+	PlanID     uint      `json:"plan_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func organizationResponse(o models.Organization, members int64) OrganizationResponse {
+	return OrganizationResponse{ID: o.ID, Name: o.Name, Slug: o.Slug, Members: members, DailyQuota: int(o.DailyQuota.Minutes()), PlanID: o.PlanID, CreatedAt: o.CreatedAt}
+}
+
+type PoolStatus struct { // An organization's shared quota over the rolling quota window
+	UsedMinutes  float64   `json:"used_minutes"`
+	LimitMinutes float64   `json:"limit_minutes"` // 0 when the organization has no pool
+	ResetsAt     time.Time `json:"resets_at"`     // When some of the used time is next given back (zero: none used)
+}
+
+type MemberResponse struct { // A user as seen by others in their organization
+	ID         uint   `json:"id"`
+	Email      string `json:"email"`
+	Role       string `json:"role"`
+	DailyQuota int    `json:"daily_quota,omitempty"` // Own limit in minutes
+}
+
+func memberResponse(u models.User) MemberResponse {
+	return MemberResponse{ID: u.ID, Email: u.Email, Role: u.Role, DailyQuota: int(u.DailyQuota.Minutes())}
+}
+
+func orgOf(c *gin.Context) uint { // The caller's organization (set by middleware.TenantMiddleware)
+	return c.MustGet("orgID").(uint)
+}
+
+func usersInOrg(orgID uint) func(*gorm.DB) *gorm.DB { // Recipient scope: every user in an organization
+	return func(db *gorm.DB) *gorm.DB { return db.Where("organization_id = ?", orgID) }
+}
+
+func GetOrganization(c *gin.Context) { // Handler returning the caller's organization and its members
+	db := database.DB.WithContext(c.Request.Context())
+	var org models.Organization
+	if err := db.First(&org, orgOf(c)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+		return
+	}
+	var users []models.User
+	if err := db.Scopes(usersInOrg(org.ID)).Select("id", "email", "role", "daily_quota").Order("id").Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load members"})
+		return
+	}
+	members := make([]MemberResponse, len(users))
+	for i, u := range users {
+		members[i] = memberResponse(u)
+	}
+	used, resetAt, err := orgUsage(c.Request.Context(), org.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not read quota"})
+		return
+	}
+	plan, err := planOf(c.Request.Context(), org)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load plan"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"organization": organizationResponse(org, int64(len(users))),
+		"members":      members,
+		"quota":        PoolStatus{UsedMinutes: used.Minutes(), LimitMinutes: poolOf(org, plan).Minutes(), ResetsAt: resetAt},
+		"plan":         planResponse(plan),
+	})
+}
+
+func ListOrganizations(c *gin.Context) { // Admin handler listing every organization with its member count
+	db := database.DB.WithContext(c.Request.Context())
+	var orgs []models.Organization
+	if err := db.Order("id").Find(&orgs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load organizations"})
+		return
+	}
+	var counts []struct {
+		OrganizationID uint
+		N              int64
+	}
+	db.Model(&models.User{}).Select("organization_id, COUNT(*) AS n").Group("organization_id").Scan(&counts)
+	members := make(map[uint]int64, len(counts))
+	for _, n := range counts {
+		members[n.OrganizationID] = n.N
+	}
+	out := make([]OrganizationResponse, len(orgs))
+	for i, o := range orgs {
+		out[i] = organizationResponse(o, members[o.ID])
+	}
+	c.JSON(http.StatusOK, gin.H{"organizations": out})
+}
+
+func CreateOrganization(c *gin.Context) { // Admin handler adding an organization
+	var input OrganizationInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !slugPattern.MatchString(input.Slug) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "slug must be 2-64 lowercase letters, digits or dashes"})
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var taken int64
+	if err := db.Model(&models.Organization{}).Where("slug = ?", input.Slug).Count(&taken).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save organization"})
+		return
+	}
+	if taken > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "slug is already taken"})
+		return
+	}
+	if input.Plan == "" {
+		input.Plan = models.PlanFree
+	}
+	var plan models.Plan
+	if err := db.Where("name = ?", input.Plan).Limit(1).Find(&plan).Error; err != nil || plan.ID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown plan"})
+		return
+	}
+	org := models.Organization{Name: input.Name, Slug: input.Slug, PlanID: plan.ID}
+	if err := db.Create(&org).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save organization"})
+		return
+	}
+	log.Printf("organization %q created by user %v", org.Slug, c.MustGet("userID"))
+	c.JSON(http.StatusCreated, organizationResponse(org, 0))
+}
+
+// MoveUser puts a user in another organization. Their schedules, rules and history move
+// with them because those are scoped through their owner; an org admin role and a limit
+// set by the old organization's admin don't.
+func MoveUser(c *gin.Context) {
+	var input struct {
+		OrganizationID uint `json:"organization_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var org models.Organization
+	if err := db.Limit(1).Find(&org, input.OrganizationID).Error; err != nil || org.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+		return
+	}
+	res := db.Model(&models.User{}).Where("id = ?", c.Param("id")).Updates(map[string]any{
+		"organization_id": org.ID,
+		"role":            gorm.Expr("CASE WHEN role = ? THEN ? ELSE role END", models.RoleOrgAdmin, models.RoleUser),
+		"daily_quota":     0,
+	})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not move user"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if id, err := strconv.ParseUint(c.Param("id"), 10, 0); err == nil {
+		middleware.InvalidateUser(uint(id))
+	}
+	log.Printf("user %s moved to organization %q by user %v", c.Param("id"), org.Slug, c.MustGet("userID"))
+	c.JSON(http.StatusOK, gin.H{"message": "user moved", "organization_id": org.ID})
+}
+
+// SetOrganizationQuota sets the motor time an organization's members share per quota
+// period; 0 removes the pool so only the motor's own quota applies.
+func SetOrganizationQuota(c *gin.Context) {
+	var input struct {
+		DailyQuota *int `json:"daily_quota" binding:"required,min=0"` // Minutes
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	pool := time.Duration(*input.DailyQuota) * time.Minute
+	if pool > motorService.Quota() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("daily_quota can't be more than the motor's quota (%d minutes)", int(motorService.Quota().Minutes()))})
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var org models.Organization
+	if err := db.Limit(1).Find(&org, c.Param("id")).Error; err != nil || org.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "organization not found"})
+		return
+	}
+	plan, err := planOf(c.Request.Context(), org)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load plan"})
+		return
+	}
+	if plan.DailyQuota > 0 && pool > plan.DailyQuota {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("daily_quota can't be more than the %s plan's %d minutes", plan.Name, int(plan.DailyQuota.Minutes()))})
+		return
+	}
+	if err := db.Model(&org).Update("daily_quota", pool).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save quota"})
+		return
+	}
+	log.Printf("organization %q pool set to %s by user %v", org.Slug, pool, c.MustGet("userID"))
+	var members int64
+	db.Model(&models.User{}).Scopes(usersInOrg(org.ID)).Count(&members)
+	org.DailyQuota = pool
+	c.JSON(http.StatusOK, organizationResponse(org, members))
+}
+
+// orgUsage returns the motor time an organization's members used in the rolling quota
+// window, counted the way the motor's quota counts it.
+func orgUsage(ctx context.Context, orgID uint) (used time.Duration, resetAt time.Time, err error) {
+	return periodUsage(ctx, database.DB.Model(&models.User{}).Select("id").Where("organization_id = ?", orgID))
+}
+
+// periodUsage returns the motor time the users selected by members (a subquery of user IDs)
+// used in the last services.QuotaWindow, and when some of it is next given back (zero if
+// none is used). Like the motor quota a run counts what it ran once it has ended, and the
+// one running now counts in full.
+func periodUsage(ctx context.Context, members *gorm.DB) (used time.Duration, resetAt time.Time, err error) {
+	st, err := motorService.Status(ctx)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	db := database.DB.WithContext(ctx)
+	var runs []models.SessionLog
+	err = db.Select("ran", "ended_at").
+		Where("user_id IN (?) AND requested > 0 AND ran > 0 AND ended_at >= ?", members, time.Now().Add(-services.QuotaWindow)).
+		Order("ended_at").Find(&runs).Error
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	for _, run := range runs {
+		used += run.Ran
+	}
+	if len(runs) > 0 {
+		resetAt = runs[0].EndedAt.Add(services.QuotaWindow)
+	}
+	if cur := st.Current; cur != nil {
+		var n int64
+		db.Model(&models.User{}).Where("id = ? AND id IN (?)", cur.Request.UserID, members).Count(&n)
+		if n > 0 {
+			used += cur.Request.Duration
+			if resetAt.IsZero() {
+				resetAt = cur.StartedAt.Add(cur.Request.Duration + services.QuotaWindow)
+			}
+		}
+	}
+	return used, resetAt, nil
+}
+
+// userLimitRejection explains why a run of d doesn't fit in userID's own limit, or
+// returns "" when it fits.
+func userLimitRejection(ctx context.Context, userID uint, d, limit time.Duration) (string, error) {
+	used, _, err := periodUsage(ctx, database.DB.Model(&models.User{}).Select("id").Where("id = ?", userID))
+	if err != nil {
+		return "", err
+	}
+	if used+d > limit {
+		return fmt.Sprintf("your daily limit is reached (%d of %d minutes used)", int(used.Minutes()), int(limit.Minutes())), nil
+	}
+	return "", nil
+}
+
+var userQuota atomic.Int64 // Default limit of users without one of their own, as a time.Duration (0: none)
+
+// UseUserQuota sets the daily limit of users their org admin set none for (USER_QUOTA_MINUTES;
+// 0 for none). It is safe to call while serving, e.g. on a config reload.
+func UseUserQuota(d time.Duration) { userQuota.Store(int64(d)) }
+
+// quotaRejection explains why a run of d for userID doesn't fit the limit their org admin
+// set for them (or the default per-user limit) or their organization's pool, or returns ""
+// when it fits both. A quota override an admin gave the user replaces both.
+func quotaRejection(ctx context.Context, userID uint, d time.Duration) (string, error) {
+	db := database.DB.WithContext(ctx)
+	var override models.QuotaOverride
+	if err := db.Limit(1).Find(&override, "user_id = ?", userID).Error; err != nil {
+		return "", err
+	}
+	if override.Active(time.Now()) {
+		return userLimitRejection(ctx, userID, d, override.Quota)
+	}
+	var user models.User
+	if err := db.Select("id", "organization_id", "daily_quota").Limit(1).Find(&user, userID).Error; err != nil {
+		return "", err
+	}
+	limit := user.DailyQuota
+	if limit == 0 {
+		limit = time.Duration(userQuota.Load())
+	}
+	if limit > 0 {
+		if reason, err := userLimitRejection(ctx, userID, d, limit); err != nil || reason != "" {
+			return reason, err
+		}
+	}
+	var org models.Organization
+	if err := db.Limit(1).Find(&org, user.OrganizationID).Error; err != nil || org.ID == 0 {
+		return "", err
+	}
+	plan, err := planOf(ctx, org)
+	if err != nil {
+		return "", err
+	}
+	pool := poolOf(org, plan)
+	if pool == 0 {
+		return "", nil
+	}
+	used, _, err := orgUsage(ctx, org.ID)
+	if err != nil {
+		return "", err
+	}
+	if used+d > pool {
+		return fmt.Sprintf("%s's shared daily quota is reached (%d of %d minutes used)", org.Name, int(used.Minutes()), int(pool.Minutes())), nil
+	}
+	return "", nil
+}
+
+// TenantQuotaAdmit is the MotorDeps.Admit hook enforcing member limits and organization
+// pools at dispatch. A failed lookup rejects the request, as a failed motor quota check does.
+func TenantQuotaAdmit(ctx context.Context, req store.MotorRequest) string {
+	reason, err := quotaRejection(ctx, req.UserID, req.Duration)
+	if err != nil {
+		slog.Error("organization quota check failed", "user_id", req.UserID, "error", err)
+		return "quota check failed"
+	}
+	return reason
+}
@@ -0,0 +1,172 @@
+// organizations_test.go - Tests for organizations (tenants)
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"context"                  // For quota checks
+	"encoding/json"            // Response bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Organization and user models
+	"go-mqtt-backend/services" // Session outcomes
+	"go-mqtt-backend/store"    // Queued requests
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"strconv"                  // IDs in paths
+	"testing"                  // Go's testing package
+	"time"                     // Quota durations
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestOrganizations checks the default organization, creating organizations and moving users
+func TestOrganizations(t *testing.T) {
+	setupTestDB()
+	require.NotZero(t, database.DefaultOrgID)
+	legacy := models.User{Email: "legacy@example.com", Password: "x"} // From before organizations
+	require.NoError(t, database.DB.Create(&legacy).Error)
+	require.NoError(t, database.Migrate())
+	database.DB.First(&legacy, legacy.ID)
+	assert.Equal(t, database.DefaultOrgID, legacy.OrganizationID)
+
+	r := gin.New()
+	var orgID uint
+	setCaller := func(c *gin.Context) { c.Set("userID", legacy.ID); c.Set("orgID", orgID) }
+	r.POST("/register", Register)
+	r.GET("/api/org", setCaller, GetOrganization)
+	r.GET("/admin/organizations", setCaller, ListOrganizations)
+	r.POST("/admin/organizations", setCaller, CreateOrganization)
+	r.PUT("/admin/users/:id/organization", setCaller, MoveUser)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	code, _ := call("POST", "/register", `{"email":"new@example.com","password":"pw"}`)
+	require.Equal(t, 200, code)
+	var joined models.User
+	database.DB.Where("email = ?", "new@example.com").First(&joined)
+	assert.Equal(t, database.DefaultOrgID, joined.OrganizationID)
+
+	code, _ = call("POST", "/admin/organizations", `{"name":"Green Acres","slug":"Green Acres"}`)
+	assert.Equal(t, 400, code)
+	code, _ = call("POST", "/admin/organizations", `{"name":"Default again","slug":"default"}`)
+	assert.Equal(t, 409, code)
+	code, out := call("POST", "/admin/organizations", `{"name":"Green Acres","slug":"green-acres"}`)
+	require.Equal(t, 201, code)
+	farm := uint(out["id"].(float64))
+
+	code, _ = call("PUT", "/admin/users/"+strconv.Itoa(int(legacy.ID))+"/organization", `{"organization_id":999}`)
+	assert.Equal(t, 404, code)
+	code, _ = call("PUT", "/admin/users/"+strconv.Itoa(int(legacy.ID))+"/organization", `{"organization_id":`+strconv.Itoa(int(farm))+`}`)
+	assert.Equal(t, 200, code)
+
+	orgID = farm
+	code, out = call("GET", "/api/org", "")
+	require.Equal(t, 200, code)
+	assert.Equal(t, "green-acres", out["organization"].(map[string]any)["slug"])
+	members := out["members"].([]any)
+	require.Len(t, members, 1) // Only the moved user
+	assert.Equal(t, "legacy@example.com", members[0].(map[string]any)["email"])
+
+	code, out = call("GET", "/admin/organizations", "")
+	require.Equal(t, 200, code)
+	orgs := out["organizations"].([]any)
+	require.Len(t, orgs, 2)
+	assert.Equal(t, 1.0, orgs[0].(map[string]any)["members"]) // The registered user
+	assert.Equal(t, 1.0, orgs[1].(map[string]any)["members"])
+}
+
+// TestOrganizationPool checks that members share their organization's pool and others don't
+func TestOrganizationPool(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	ctx := context.Background()
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres", DailyQuota: 20 * time.Minute}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	member := models.User{Email: "member@example.com", Password: "x", OrganizationID: farm.ID}
+	other := models.User{Email: "other@example.com", Password: "x", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&[]*models.User{&member, &other}).Error)
+	now := time.Now()
+	database.DB.Create(&[]models.SessionLog{
+		{UserID: member.ID, Outcome: services.SessionFinished, Requested: 15 * time.Minute, Ran: 15 * time.Minute, EndedAt: now},
+		{UserID: member.ID, Outcome: services.SessionRejected, Requested: 30 * time.Minute, EndedAt: now},                                             // Never ran
+		{UserID: member.ID, Outcome: services.SessionFinished, Requested: 30 * time.Minute, Ran: 30 * time.Minute, EndedAt: now.Add(-25 * time.Hour)}, // Last period
+		{UserID: other.ID, Outcome: services.SessionFinished, Requested: 30 * time.Minute, Ran: 30 * time.Minute, EndedAt: now},
+	})
+
+	assert.Contains(t, TenantQuotaAdmit(ctx, store.MotorRequest{UserID: member.ID, Duration: 10 * time.Minute}), "Green Acres")
+	assert.Empty(t, TenantQuotaAdmit(ctx, store.MotorRequest{UserID: member.ID, Duration: 5 * time.Minute}))
+	assert.Empty(t, TenantQuotaAdmit(ctx, store.MotorRequest{UserID: other.ID, Duration: 10 * time.Minute})) // No pool
+
+	r := gin.New()
+	setCaller := func(c *gin.Context) { c.Set("userID", member.ID); c.Set("orgID", farm.ID) }
+	r.POST("/api/motor", setCaller, EnqueueMotorRequest)
+	r.GET("/api/org", setCaller, GetOrganization)
+	r.PUT("/admin/organizations/:id/quota", setCaller, SetOrganizationQuota)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	code, _ := call("POST", "/api/motor", `{"duration":10}`)
+	assert.Equal(t, 429, code)
+	code, out := call("GET", "/api/org", "")
+	require.Equal(t, 200, code)
+	quota := out["quota"].(map[string]any)
+	assert.Equal(t, 15.0, quota["used_minutes"])
+	assert.Equal(t, 20.0, quota["limit_minutes"])
+
+	path := "/admin/organizations/" + strconv.Itoa(int(farm.ID)) + "/quota"
+	code, _ = call("PUT", path, `{"daily_quota":90}`) // More than the motor's hour
+	assert.Equal(t, 400, code)
+	code, out = call("PUT", path, `{"daily_quota":0}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, 0.0, out["daily_quota"])
+	code, _ = call("POST", "/api/motor", `{"duration":10}`)
+	assert.Equal(t, 200, code)
+}
+
+// TestDefaultUserQuota checks that USER_QUOTA_MINUTES limits users without a limit of
+// their own, at enqueue and at dispatch, and that a member limit replaces it
+func TestDefaultUserQuota(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	ctx := context.Background()
+	UseUserQuota(20 * time.Minute)
+	defer UseUserQuota(0)
+	user := models.User{Email: "user@example.com", Password: "x", OrganizationID: database.DefaultOrgID}
+	limited := models.User{Email: "limited@example.com", Password: "x", OrganizationID: database.DefaultOrgID, DailyQuota: 30 * time.Minute}
+	require.NoError(t, database.DB.Create(&[]*models.User{&user, &limited}).Error)
+	for _, u := range []models.User{user, limited} {
+		require.NoError(t, database.DB.Create(&models.SessionLog{UserID: u.ID, Outcome: services.SessionFinished, Requested: 15 * time.Minute, Ran: 15 * time.Minute, EndedAt: time.Now()}).Error)
+	}
+
+	r := gin.New()
+	r.POST("/api/motor", func(c *gin.Context) { c.Set("userID", user.ID) }, EnqueueMotorRequest)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/motor", bytes.NewBufferString(`{"duration":10}`))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "15 of 20 minutes used")
+
+	assert.Contains(t, TenantQuotaAdmit(ctx, store.MotorRequest{UserID: user.ID, Duration: 10 * time.Minute}), "of 20 minutes")
+	assert.Empty(t, TenantQuotaAdmit(ctx, store.MotorRequest{UserID: user.ID, Duration: 5 * time.Minute}))
+	assert.Empty(t, TenantQuotaAdmit(ctx, store.MotorRequest{UserID: limited.ID, Duration: 10 * time.Minute})) // Their own 30 minutes
+	UseUserQuota(0)
+	assert.Empty(t, TenantQuotaAdmit(ctx, store.MotorRequest{UserID: user.ID, Duration: 10 * time.Minute}))
+}
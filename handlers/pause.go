@@ -0,0 +1,116 @@
+// pause.go - Admin pause of queue dispatching that keeps requests queued
+//
+// An emergency shutdown drops every queued request. A pause only stops the queue from
+// starting new runs: the run on now finishes, requests are still accepted and wait, and
+// everything queued is dispatched in order once an admin resumes. The pause is kept in
+// the database, so it outlasts restarts and holds the queue whichever replica runs it.
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"cmp"                      // Defaults
+	"context"                  // For DB lookups
+	"errors"                   // Optional bodies
+	"fmt"                      // Audit details
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Queue pause model
+	"io"                       // Empty bodies
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"strings"                  // Reason trimming
+	"time"                     // Pause times
+
+	"github.com/gin-gonic/gin" // Gin web framework
+	"gorm.io/gorm"             // Transactions
+	"gorm.io/gorm/clause"      // Insert if missing
+)
+
+var errNotPaused = errors.New("queue is not paused")
+
+type QueuePauseInput struct { // Struct for pausing the queue
+	Reason string `json:"reason" binding:"max=255"` // Shown to users waiting, e.g. "swapping the pressure switch"
+}
+
+func queuePause(ctx context.Context) (models.QueuePause, error) { // The pause row (not Paused if none)
+	var p models.QueuePause
+	err := database.DB.WithContext(ctx).Limit(1).Find(&p, 1).Error
+	return p, err
+}
+
+func pauseMessage(p models.QueuePause) string { // Why queued requests wait
+	if p.Reason == "" {
+		return "queue paused by an admin"
+	}
+	return "queue paused by an admin: " + p.Reason
+}
+
+// QueueHold tells the motor queue to hold requests while an admin has paused it or
+// during a maintenance window. It is the MotorDeps.Hold hook; lookup errors don't hold
+// the queue.
+func QueueHold(ctx context.Context) string {
+	p, err := queuePause(ctx)
+	if err != nil {
+		slog.Error("queue pause lookup failed", "error", err)
+	} else if p.Paused {
+		return pauseMessage(p)
+	}
+	return MaintenanceHold(ctx)
+}
+
+// PauseQueue stops the queue from dispatching new runs until ResumeQueue, keeping every
+// request queued. The run on now is left to finish. It is recorded in the audit log.
+func PauseQueue(c *gin.Context) {
+	var input QueuePauseInput
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) { // The body is optional
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	db := database.DB.WithContext(ctx)
+	userID := c.MustGet("userID").(uint)
+	p := models.QueuePause{ID: 1, Paused: true, Reason: strings.TrimSpace(input.Reason), By: userID, Since: time.Now()}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.QueuePause{ID: 1}).Error; err != nil { // The single row, for the update to claim
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not pause queue"})
+		return
+	}
+	res := db.Model(&models.QueuePause{ID: 1}).Where("paused = ?", false).Updates(map[string]any{"paused": true, "reason": p.Reason, "by": p.By, "since": p.Since}) // Only one of concurrent pauses wins
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not pause queue"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		cur, _ := queuePause(ctx)
+		c.JSON(http.StatusConflict, gin.H{"error": "queue is already paused", "since": cur.Since})
+		return
+	}
+	recordAudit(ctx, userID, "queue_pause", cmp.Or(p.Reason, "no reason given"))
+	c.JSON(http.StatusOK, gin.H{"message": "queue paused", "since": p.Since, "reason": p.Reason})
+}
+
+// ResumeQueue lets the queue dispatch again after PauseQueue, in the order requests were
+// queued. It is recorded in the audit log.
+func ResumeQueue(c *gin.Context) {
+	ctx := c.Request.Context()
+	var p models.QueuePause
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&models.QueuePause{ID: 1}).Where("paused = ?", true).Update("paused", false) // Only one of concurrent resumes wins
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errNotPaused
+		}
+		return tx.First(&p, 1).Error // Who paused it and since when, for the audit log
+	})
+	if errors.Is(err, errNotPaused) {
+		c.JSON(http.StatusConflict, gin.H{"error": "queue is not paused"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not resume queue"})
+		return
+	}
+	paused := time.Since(p.Since).Round(time.Second)
+	recordAudit(ctx, c.MustGet("userID").(uint), "queue_resume", fmt.Sprintf("paused by user %d for %s", p.By, paused))
+	c.JSON(http.StatusOK, gin.H{"message": "queue resumed", "paused_for": paused.String()})
+}
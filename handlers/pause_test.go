@@ -0,0 +1,110 @@
+// pause_test.go - Tests for pausing and resuming queue dispatching
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"context"                  // For the hold hook
+	"encoding/json"            // Response bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User and audit models
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"sync"                     // Concurrent calls
+	"testing"                  // Go's testing package
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestQueuePause checks that a pause holds the queue but keeps accepting requests, and
+// that resuming lets it dispatch again
+func TestQueuePause(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	ctx := context.Background()
+	admin := models.User{Email: "admin@example.com", Role: models.RoleAdmin, OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&admin).Error)
+
+	r := gin.New()
+	setUser := func(c *gin.Context) { c.Set("userID", admin.ID) }
+	r.POST("/admin/queue/pause", setUser, PauseQueue)
+	r.POST("/admin/queue/resume", setUser, ResumeQueue)
+	r.POST("/api/motor", setUser, EnqueueMotorRequest)
+	r.GET("/admin/status", GetSystemStatus)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	assert.Empty(t, QueueHold(ctx))
+	code, _ := call("POST", "/admin/queue/resume", "")
+	assert.Equal(t, http.StatusConflict, code) // Not paused
+	code, _ = call("POST", "/admin/queue/pause", `{"reason":"swapping the pressure switch"}`)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = call("POST", "/admin/queue/pause", "")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, "queue paused by an admin: swapping the pressure switch", QueueHold(ctx))
+
+	code, _ = call("POST", "/api/motor", `{"duration":5}`)
+	assert.Equal(t, http.StatusOK, code) // Still queued, for later
+	_, out := call("GET", "/admin/status", "")
+	require.Contains(t, out, "paused")
+	assert.Equal(t, "swapping the pressure switch", out["paused"].(map[string]any)["reason"])
+	assert.Len(t, out["queue"], 1)
+
+	code, _ = call("POST", "/admin/queue/resume", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, QueueHold(ctx))
+	_, out = call("GET", "/admin/status", "")
+	assert.NotContains(t, out, "paused")
+
+	var audits []models.AuditLog
+	database.DB.Where("action IN ?", []string{"queue_pause", "queue_resume"}).Order("id").Find(&audits)
+	require.Len(t, audits, 2)
+	assert.Equal(t, "swapping the pressure switch", audits[0].Detail)
+}
+
+// TestQueuePauseConcurrent checks that of pauses, and then resumes, sent at once exactly
+// one succeeds and the others get 409
+func TestQueuePauseConcurrent(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	r := gin.New()
+	setUser := func(c *gin.Context) { c.Set("userID", uint(1)) }
+	r.POST("/admin/queue/pause", setUser, PauseQueue)
+	r.POST("/admin/queue/resume", setUser, ResumeQueue)
+
+	race := func(path string) map[int]int { // Status codes of 8 concurrent calls
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		codes := map[int]int{}
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				code, _ := callPath(r, "POST", path, "")
+				mu.Lock()
+				codes[code]++
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		return codes
+	}
+	assert.Equal(t, map[int]int{http.StatusOK: 1, http.StatusConflict: 7}, race("/admin/queue/pause"))
+	assert.NotEmpty(t, QueueHold(context.Background()))
+	assert.Equal(t, map[int]int{http.StatusOK: 1, http.StatusConflict: 7}, race("/admin/queue/resume"))
+	assert.Empty(t, QueueHold(context.Background()))
+
+	var audits int64
+	database.DB.Model(&models.AuditLog{}).Where("action IN ?", []string{"queue_pause", "queue_resume"}).Count(&audits)
+	assert.Equal(t, int64(2), audits)
+}
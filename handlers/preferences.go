@@ -0,0 +1,140 @@
+// preferences.go - Per-user notification preferences and quiet hours
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"fmt"                      // For error messages
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Preferences model
+	"go-mqtt-backend/notify"   // Event and channel names
+	"net/http"                 // HTTP status codes
+	"time"                     // Quiet hours
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+// defaultChannels is where each event goes for users who haven't chosen. Email is opt-in
+// except for admin alerts, which go everywhere.
+var defaultChannels = map[string][]string{
+	notify.EventSessionStarted:     {notify.ChannelSMS, notify.ChannelTelegram, notify.ChannelPush},
+	notify.EventSessionFinished:    {notify.ChannelSMS, notify.ChannelTelegram, notify.ChannelPush},
+	notify.EventSessionInterrupted: {notify.ChannelSMS, notify.ChannelTelegram, notify.ChannelPush},
+	notify.EventRequestRejected:    {notify.ChannelSMS, notify.ChannelTelegram, notify.ChannelPush},
+	notify.EventQuotaWarning:       {notify.ChannelTelegram, notify.ChannelPush},
+	notify.EventDeviceOffline:      {notify.ChannelPush},
+	notify.EventShutdown:           {notify.ChannelPush},
+	notify.EventMaintenance:        {notify.ChannelEmail, notify.ChannelPush},
+	notify.EventAdminAlert:         {notify.ChannelEmail, notify.ChannelSMS, notify.ChannelWhatsApp, notify.ChannelTelegram, notify.ChannelPush},
+	notify.EventDigest:             {notify.ChannelEmail},
+	notify.EventBilling:            {notify.ChannelEmail, notify.ChannelPush},
+}
+
+type QuietHours struct { // Quiet hours in a user's timezone
+	Start    string `json:"start"`    // "HH:MM" (empty disables quiet hours)
+	End      string `json:"end"`      // "HH:MM"
+	Timezone string `json:"timezone"` // IANA name, e.g. "Asia/Karachi" (empty means UTC)
+}
+
+type NotificationPrefsInput struct { // Struct for PUT /api/me/notifications (also the GET response)
+	Channels   map[string][]string `json:"channels"`                                      // Event -> channels; omitted events use the defaults
+	QuietHours QuietHours          `json:"quiet_hours"`                                   // SMS, Telegram and push are held back during these hours
+	Locale     string              `json:"locale"`                                        // Message language (empty means notify.DefaultLocale)
+	Digest     string              `json:"digest" binding:"omitempty,oneof=daily weekly"` // Activity digest frequency (empty for none)
+}
+
+func channelsFor(p models.NotificationPrefs, event string) []string { // Channels chosen for event, or the defaults
+	if chans, ok := p.Channels[event]; ok {
+		return chans
+	}
+	return defaultChannels[event]
+}
+
+// inQuietHours reports whether t falls in the user's quiet hours. A window whose end is
+// before its start runs overnight (22:00-06:00).
+func inQuietHours(p models.NotificationPrefs, t time.Time) bool {
+	if p.QuietStart == "" || p.QuietEnd == "" {
+		return false
+	}
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	now := t.In(loc).Format("15:04") // Zero-padded, so strings compare like times
+	if p.QuietStart <= p.QuietEnd {
+		return now >= p.QuietStart && now < p.QuietEnd
+	}
+	return now >= p.QuietStart || now < p.QuietEnd
+}
+
+func prefsResponse(p models.NotificationPrefs) NotificationPrefsInput { // Effective preferences with defaults filled in
+	chans := make(map[string][]string, len(notify.Events))
+	for _, event := range notify.Events {
+		chans[event] = channelsFor(p, event)
+	}
+	locale := p.Locale
+	if locale == "" {
+		locale = notify.DefaultLocale
+	}
+	return NotificationPrefsInput{Channels: chans, QuietHours: QuietHours{Start: p.QuietStart, End: p.QuietEnd, Timezone: p.Timezone}, Locale: locale, Digest: p.Digest}
+}
+
+func GetNotificationPrefs(c *gin.Context) { // Handler returning the caller's effective notification preferences
+	var prefs models.NotificationPrefs
+	database.DB.WithContext(c.Request.Context()).Limit(1).Find(&prefs, "user_id = ?", c.MustGet("userID")) // No row: defaults
+	c.JSON(http.StatusOK, prefsResponse(prefs))
+}
+
+func UpdateNotificationPrefs(c *gin.Context) { // Handler replacing the caller's notification preferences
+	var input NotificationPrefsInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePrefs(input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	prefs := models.NotificationPrefs{
+		UserID:     c.MustGet("userID").(uint),
+		Channels:   input.Channels,
+		QuietStart: input.QuietHours.Start,
+		QuietEnd:   input.QuietHours.End,
+		Timezone:   input.QuietHours.Timezone,
+		Locale:     input.Locale,
+		Digest:     input.Digest,
+	}
+	if err := database.DB.WithContext(c.Request.Context()).Save(&prefs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save preferences"})
+		return
+	}
+	c.JSON(http.StatusOK, prefsResponse(prefs))
+}
+
+func validatePrefs(input NotificationPrefsInput) error { // Checks event/channel names, times, timezone and locale
+	for event, chans := range input.Channels {
+		if !notify.IsEvent(event) {
+			return fmt.Errorf("unknown event %q", event)
+		}
+		for _, ch := range chans {
+			if !notify.IsChannel(ch) {
+				return fmt.Errorf("unknown channel %q for %s", ch, event)
+			}
+		}
+	}
+	q := input.QuietHours
+	if (q.Start == "") != (q.End == "") {
+		return fmt.Errorf("quiet_hours needs both start and end")
+	}
+	for _, v := range []string{q.Start, q.End} {
+		if _, err := time.Parse("15:04", v); v != "" && (err != nil || len(v) != 5) {
+			return fmt.Errorf("quiet_hours times must be HH:MM, got %q", v)
+		}
+	}
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", q.Timezone)
+	}
+	if input.Locale != "" && !notify.DefaultTemplates.HasLocale(input.Locale) {
+		return fmt.Errorf("unsupported locale %q (have %v)", input.Locale, notify.DefaultTemplates.Locales())
+	}
+	return nil
+}
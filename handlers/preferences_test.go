@@ -0,0 +1,77 @@
+// preferences_test.go - Tests for notification preferences and quiet hours
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                  // For building request bodies
+	"encoding/json"          // For decoding responses
+	"go-mqtt-backend/models" // Preferences model
+	"go-mqtt-backend/notify" // Event and channel names
+	"net/http"               // HTTP status codes
+	"net/http/httptest"      // HTTP test helpers
+	"testing"                // Go's testing package
+	"time"                   // Quiet hours
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+)
+
+// TestNotificationPrefs checks validation, defaults and saving
+func TestNotificationPrefs(t *testing.T) {
+	setupTestDB()
+	r := gin.New()
+	setUser := func(c *gin.Context) { c.Set("userID", uint(7)) }
+	r.GET("/api/me/notifications", setUser, GetNotificationPrefs)
+	r.PUT("/api/me/notifications", setUser, UpdateNotificationPrefs)
+	call := func(method, body string) (int, NotificationPrefsInput) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/api/me/notifications", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out NotificationPrefsInput
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	code, prefs := call("GET", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, defaultChannels[notify.EventShutdown], prefs.Channels[notify.EventShutdown])
+	assert.Equal(t, notify.DefaultLocale, prefs.Locale)
+
+	code, _ = call("PUT", `{"channels":{"session_started":["pigeon"]}}`)
+	assert.Equal(t, 400, code)
+	code, _ = call("PUT", `{"quiet_hours":{"start":"22:00","end":"6:00"}}`)
+	assert.Equal(t, 400, code)
+	code, _ = call("PUT", `{"quiet_hours":{"start":"22:00","end":"06:00","timezone":"Mars/Olympus"}}`)
+	assert.Equal(t, 400, code)
+	code, _ = call("PUT", `{"locale":"xx"}`)
+	assert.Equal(t, 400, code)
+	code, _ = call("PUT", `{"digest":"hourly"}`)
+	assert.Equal(t, 400, code)
+
+	code, _ = call("PUT", `{"channels":{"session_started":["email"],"shutdown":[]},"quiet_hours":{"start":"22:00","end":"06:00","timezone":"Asia/Karachi"},"locale":"en","digest":"weekly"}`)
+	assert.Equal(t, 200, code)
+	_, prefs = call("GET", "")
+	assert.Equal(t, []string{"email"}, prefs.Channels[notify.EventSessionStarted])
+	assert.Empty(t, prefs.Channels[notify.EventShutdown])
+	assert.Equal(t, defaultChannels[notify.EventSessionFinished], prefs.Channels[notify.EventSessionFinished])
+	assert.Equal(t, "Asia/Karachi", prefs.QuietHours.Timezone)
+	assert.Equal(t, "en", prefs.Locale)
+	assert.Equal(t, "weekly", prefs.Digest)
+}
+
+// TestInQuietHours checks same-day and overnight windows in the user's timezone
+func TestInQuietHours(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2026, 3, 1, h, m, 0, 0, time.UTC) }
+	night := models.NotificationPrefs{QuietStart: "22:00", QuietEnd: "06:00"}
+	assert.True(t, inQuietHours(night, at(23, 0)))
+	assert.True(t, inQuietHours(night, at(5, 59)))
+	assert.False(t, inQuietHours(night, at(6, 0)))
+	assert.False(t, inQuietHours(night, at(12, 0)))
+
+	lunch := models.NotificationPrefs{QuietStart: "12:00", QuietEnd: "13:00", Timezone: "Asia/Karachi"} // UTC+5
+	assert.True(t, inQuietHours(lunch, at(7, 30)))
+	assert.False(t, inQuietHours(lunch, at(12, 30)))
+	assert.False(t, inQuietHours(models.NotificationPrefs{}, at(12, 30)))
+}
@@ -0,0 +1,54 @@
+// push.go - Push token registration
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Push token model
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"time"                     // Re-registration time
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+type PushTokenInput struct { // Struct for registering an app install
+	Token    string `json:"token" binding:"required"`                           // FCM registration token
+	Platform string `json:"platform" binding:"omitempty,oneof=android ios web"` // Optional platform
+}
+
+func RegisterPushToken(c *gin.Context) { // Handler saving an FCM token for the caller
+	var input PushTokenInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+	db := database.DB.WithContext(c.Request.Context())
+	var token models.PushToken
+	err := db.Where(models.PushToken{Token: input.Token}).
+		Assign(models.PushToken{UserID: userID, Platform: input.Platform, CreatedAt: time.Now()}). // A reinstalled app may switch accounts
+		FirstOrCreate(&token).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save push token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "push token registered"})
+}
+
+func DeletePushToken(c *gin.Context) { // Handler removing one of the caller's FCM tokens (e.g. on logout)
+	err := database.DB.WithContext(c.Request.Context()).
+		Where("user_id = ? AND token = ?", c.MustGet("userID"), c.Param("token")).
+		Delete(&models.PushToken{}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete push token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "push token deleted"})
+}
+
+func ForgetPushToken(token string) { // Deletes a token FCM rejected; the Pusher's onInvalid hook
+	if err := database.DB.Where("token = ?", token).Delete(&models.PushToken{}).Error; err != nil {
+		slog.Error("delete invalid push token failed", "error", err)
+	}
+}
@@ -0,0 +1,94 @@
+// quotaoverride.go - Admin quota overrides for individual users
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"fmt"                      // Audit details
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Override and user models
+	"net/http"                 // HTTP status codes
+	"time"                     // Quotas and expiry
+
+	"github.com/gin-gonic/gin" // Gin web framework
+	"gorm.io/gorm/clause"      // Upserts
+)
+
+type QuotaOverrideInput struct { // Struct for setting a user's quota override
+	DailyQuota *int       `json:"daily_quota" binding:"required,min=0"` // Minutes per quota period (0 stops the user's runs)
+	ExpiresAt  *time.Time `json:"expires_at"`                           // RFC 3339, in the future (omit for no expiry)
+	Reason     string     `json:"reason" binding:"required,max=255"`    // Recorded in the audit log
+}
+
+type QuotaOverrideResponse struct { // A quota override as returned by the API
+	UserID     uint       `json:"user_id"`
+	DailyQuota int        `json:"daily_quota"` // Minutes
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Reason     string     `json:"reason"`
+	SetBy      uint       `json:"set_by"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+func quotaOverrideAudit(o models.QuotaOverride, email string) string { // Audit detail of an override
+	until := "until removed"
+	if o.ExpiresAt != nil {
+		until = "until " + o.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("user %d (%s): %d minutes per quota period %s: %s", o.UserID, email, int(o.Quota.Minutes()), until, o.Reason)
+}
+
+// SetQuotaOverride gives a user more (or less) motor time per quota period than their
+// org admin's limit and their organization's pool allow, until expires_at or until
+// removed. It replaces any override the user already has and is recorded in the audit log.
+func SetQuotaOverride(c *gin.Context) {
+	var input QuotaOverrideInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	quota := time.Duration(*input.DailyQuota) * time.Minute
+	if quota > motorService.Quota() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("daily_quota can't be more than the motor's quota (%d minutes)", int(motorService.Quota().Minutes()))})
+		return
+	}
+	now := time.Now()
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(now) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var user models.User
+	if err := db.Select("id", "email").Limit(1).Find(&user, c.Param("id")).Error; err != nil || user.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	o := models.QuotaOverride{UserID: user.ID, Quota: quota, ExpiresAt: input.ExpiresAt, Reason: input.Reason, SetBy: c.MustGet("userID").(uint), UpdatedAt: now}
+	if err := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&o).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save quota override"})
+		return
+	}
+	recordAudit(c.Request.Context(), o.SetBy, "quota_override", quotaOverrideAudit(o, user.Email))
+	c.JSON(http.StatusOK, QuotaOverrideResponse{o.UserID, int(o.Quota.Minutes()), o.ExpiresAt, o.Reason, o.SetBy, o.UpdatedAt})
+}
+
+// DeleteQuotaOverride removes a user's quota override, so their org admin's limit and
+// their organization's pool apply again.
+func DeleteQuotaOverride(c *gin.Context) {
+	db := database.DB.WithContext(c.Request.Context())
+	var o models.QuotaOverride
+	if err := db.Limit(1).Find(&o, "user_id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not remove quota override"})
+		return
+	}
+	if o.UserID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user has no quota override"})
+		return
+	}
+	if err := db.Delete(&o).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not remove quota override"})
+		return
+	}
+	var user models.User
+	db.Select("id", "email").Limit(1).Find(&user, o.UserID)
+	recordAudit(c.Request.Context(), c.MustGet("userID").(uint), "quota_override_removed", quotaOverrideAudit(o, user.Email))
+	c.JSON(http.StatusOK, gin.H{"message": "quota override removed"})
+}
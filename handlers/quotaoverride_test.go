@@ -0,0 +1,90 @@
+// quotaoverride_test.go - Tests for admin quota overrides
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"context"                  // For the admission hook
+	"encoding/json"            // Response bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User, session and audit models
+	"go-mqtt-backend/services" // Session outcomes
+	"go-mqtt-backend/store"    // Motor requests
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"strconv"                  // User IDs in paths
+	"testing"                  // Go's testing package
+	"time"                     // Quotas and expiry
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestQuotaOverride checks that an override replaces the member limit and the pool in
+// both directions, lapses when it expires and is recorded in the audit log
+func TestQuotaOverride(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	ctx := context.Background()
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres", DailyQuota: 20 * time.Minute}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	admin := models.User{Email: "admin@example.com", Password: "x", Role: models.RoleAdmin, OrganizationID: database.DefaultOrgID}
+	member := models.User{Email: "member@example.com", Password: "x", OrganizationID: farm.ID, DailyQuota: 15 * time.Minute}
+	require.NoError(t, database.DB.Create(&[]*models.User{&admin, &member}).Error)
+	require.NoError(t, database.DB.Create(&models.SessionLog{UserID: member.ID, Outcome: services.SessionFinished, Requested: 15 * time.Minute, Ran: 15 * time.Minute, EndedAt: time.Now()}).Error)
+	admit := func(d time.Duration) string {
+		return TenantQuotaAdmit(ctx, store.MotorRequest{UserID: member.ID, Duration: d})
+	}
+
+	r := gin.New()
+	r.PUT("/admin/users/:id/quota", func(c *gin.Context) { c.Set("userID", admin.ID) }, SetQuotaOverride)
+	r.DELETE("/admin/users/:id/quota", func(c *gin.Context) { c.Set("userID", admin.ID) }, DeleteQuotaOverride)
+	call := func(method, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/admin/users/"+strconv.Itoa(int(member.ID))+"/quota", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	assert.Contains(t, admit(5*time.Minute), "your daily limit")
+	code, _ := call("PUT", `{"daily_quota":40}`)
+	assert.Equal(t, 400, code) // No reason
+	code, _ = call("PUT", `{"daily_quota":90,"reason":"planting week"}`)
+	assert.Equal(t, 400, code) // More than the motor's hour
+	code, _ = call("PUT", `{"daily_quota":40,"reason":"planting week","expires_at":"2001-01-01T00:00:00Z"}`)
+	assert.Equal(t, 400, code) // Already expired
+
+	expires := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	code, out := call("PUT", `{"daily_quota":40,"reason":"planting week","expires_at":"`+expires.Format(time.RFC3339)+`"}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, 40.0, out["daily_quota"])
+	assert.Empty(t, admit(20*time.Minute)) // Past the member limit and the pool
+	assert.Contains(t, admit(30*time.Minute), "your daily limit is reached (15 of 40 minutes used)")
+
+	code, _ = call("PUT", `{"daily_quota":10,"reason":"used too much"}`) // Reduction, no expiry
+	require.Equal(t, 200, code)
+	assert.Contains(t, admit(time.Minute), "of 10 minutes")
+
+	var entries []models.AuditLog
+	database.DB.Where("action = ?", "quota_override").Order("id").Find(&entries)
+	require.Len(t, entries, 2)
+	assert.Equal(t, admin.ID, entries[0].UserID)
+	assert.Contains(t, entries[0].Detail, "40 minutes per quota period until "+expires.Format(time.RFC3339)+": planting week")
+	assert.Contains(t, entries[1].Detail, "10 minutes per quota period until removed: used too much")
+
+	database.DB.Model(&models.QuotaOverride{}).Where("user_id = ?", member.ID).Update("expires_at", time.Now().Add(-time.Minute))
+	assert.Contains(t, admit(5*time.Minute), "of 15 minutes") // Lapsed: the member limit is back
+
+	code, _ = call("DELETE", "")
+	assert.Equal(t, 200, code)
+	code, _ = call("DELETE", "")
+	assert.Equal(t, 404, code)
+	var removed int64
+	database.DB.Model(&models.AuditLog{}).Where("action = ?", "quota_override_removed").Count(&removed)
+	assert.Equal(t, int64(1), removed)
+}
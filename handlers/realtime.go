@@ -0,0 +1,85 @@
+// realtime.go - Live updates over WebSocket: motor states, sessions and shutdowns
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User model
+	"go-mqtt-backend/realtime" // Event hub
+	"go-mqtt-backend/services" // Session events
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"strings"                  // Topic lists
+	"time"                     // Timeouts
+
+	"github.com/gin-gonic/gin"     // Gin web framework
+	"github.com/gorilla/websocket" // WebSocket upgrades
+)
+
+const ( // Live update topics
+	TopicMotor    = "motor"    // A motor's state changed (device reports)
+	TopicSessions = "sessions" // A run started, ended or was rejected
+	TopicShutdown = "shutdown" // The system was shut down
+)
+
+var realtimeTopics = []string{TopicMotor, TopicSessions, TopicShutdown}
+
+var hub *realtime.Hub // Live update fan-out (nil: no live updates)
+
+func UseHub(h *realtime.Hub) { // Makes handlers publish live updates to h
+	hub = h
+}
+
+var upgrader = websocket.Upgrader{Subprotocols: []string{"bearer"}} // Same-origin only; echoes the auth subprotocol
+
+func publishEvent(topic string, orgID uint, data any) { // Sends a live update, if the hub is on
+	if hub != nil {
+		hub.Publish(realtime.Event{Topic: topic, OrgID: orgID, Data: data})
+	}
+}
+
+// Realtime upgrades to a WebSocket that streams live updates on the topics in ?topics=
+// (comma-separated, default all) for the caller's organization; global admins get every
+// organization's. The client can change topics by sending {"subscribe": [...]} or
+// {"unsubscribe": [...]}.
+func Realtime(c *gin.Context) {
+	if hub == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "live updates are off"})
+		return
+	}
+	topics := realtimeTopics
+	if q := c.Query("topics"); q != "" {
+		topics = strings.Split(q, ",")
+	}
+	all := isGlobalAdmin(c)
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return // The upgrader has answered
+	}
+	hub.Serve(conn, hub.Register(orgOf(c), all, topics...))
+}
+
+// PublishSession sends a session event to the user's organization. It is part of the
+// MotorService OnSession hook.
+func PublishSession(ev services.SessionEvent) {
+	if hub == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var user models.User
+	if err := database.DB.WithContext(ctx).Select("id", "organization_id").Limit(1).Find(&user, ev.Request.UserID).Error; err != nil || user.ID == 0 {
+		slog.Warn("live session update not sent: user not found", "user_id", ev.Request.UserID, "error", err)
+		return
+	}
+	publishEvent(TopicSessions, user.OrganizationID, gin.H{
+		"kind":     ev.Kind,
+		"user_id":  ev.Request.UserID,
+		"duration": ev.Request.Duration.String(),
+		"ran":      ev.Ran.String(),
+		"reason":   ev.Reason,
+		"simulate": ev.Request.Simulate,
+		"note":     ev.Request.Note,
+	})
+}
@@ -0,0 +1,59 @@
+// reload.go - Admin reload of the settings that can change while serving
+//
+// SIGHUP and POST /admin/config/reload run the same reload (set by UseReload): the env file
+// is read again and the quota limits, log level, auth rate limit, quota warning levels and
+// pushed events are applied without dropping the MQTT connection or restarting the queue
+// processor. Only the replica that gets the signal or the call reloads.
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                // For the reload hook
+	"go-mqtt-backend/notify" // Push channel
+	"log/slog"               // Leveled logging
+	"net/http"               // HTTP status codes
+	"sync/atomic"            // Limits change at runtime
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+var (
+	reloadConfig  func(ctx context.Context) (string, error) // Re-reads and applies the config, returning what it applied (set by UseReload)
+	authRateLimit atomic.Int64                              // Auth requests per client IP per minute (0: no limit)
+)
+
+// UseReload sets the reload ReloadConfig runs; the summary it returns is shown to the admin.
+func UseReload(fn func(ctx context.Context) (string, error)) { reloadConfig = fn }
+
+// UseAuthRateLimit sets AUTH_RATE_LIMIT. It is safe to call while serving.
+func UseAuthRateLimit(n int) { authRateLimit.Store(int64(n)) }
+
+// AuthRateLimit is the limit of the login and registration rate limiter.
+func AuthRateLimit() int { return int(authRateLimit.Load()) }
+
+// UseNotifySettings sets the quota warning levels (QUOTA_WARN_PERCENT) and the events pushed
+// (PUSH_EVENTS; nil for all). It is safe to call while serving, after UseMotorService.
+func UseNotifySettings(quotaWarn []int, pushEvents map[string]bool) {
+	motorService.SetQuotaWarn(quotaWarn)
+	if p, ok := notifiers[notify.ChannelPush].(*notify.Pusher); ok { // Only when push is enabled
+		p.SetEvents(pushEvents)
+	}
+}
+
+// ReloadConfig reads the env file again and applies the settings that can change while
+// serving, as SIGHUP does, on this replica. It is recorded in the audit log.
+func ReloadConfig(c *gin.Context) {
+	if reloadConfig == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "config reload is not available"})
+		return
+	}
+	ctx := c.Request.Context()
+	summary, err := reloadConfig(ctx)
+	if err != nil {
+		slog.Error("config reload failed", "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "config reload failed, old settings kept: " + err.Error()})
+		return
+	}
+	recordAudit(ctx, c.MustGet("userID").(uint), "config_reload", summary)
+	c.JSON(http.StatusOK, gin.H{"message": "config reloaded", "applied": summary})
+}
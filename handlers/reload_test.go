@@ -0,0 +1,67 @@
+// reload_test.go - Tests for the admin config reload
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"context"                    // For the reload hook
+	"errors"                     // Failing reloads
+	"go-mqtt-backend/database"   // Database connection
+	"go-mqtt-backend/middleware" // Auth rate limiter
+	"go-mqtt-backend/models"     // Audit model
+	"go-mqtt-backend/store"      // Rate limit counters
+	"net/http"                   // HTTP methods
+	"testing"                    // Go's testing package
+	"time"                       // Rate limit window
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestReloadConfig checks that the admin reload runs the reload hook and audits it, keeps
+// the old settings when it fails, and that the auth rate limit follows a reload
+func TestReloadConfig(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	t.Cleanup(func() { UseReload(nil) })
+
+	r := gin.New()
+	r.POST("/admin/config/reload", func(c *gin.Context) { c.Set("userID", uint(1)) }, ReloadConfig)
+	code, _ := callPath(r, "POST", "/admin/config/reload", "")
+	assert.Equal(t, http.StatusServiceUnavailable, code) // No hook
+
+	UseAuthRateLimit(1)
+	limited := gin.New()
+	limited.POST("/login", middleware.RateLimit(store.NewMemoryState(), "auth", AuthRateLimit, time.Minute), func(c *gin.Context) {})
+	code, _ = callPath(limited, "POST", "/login", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = callPath(limited, "POST", "/login", "")
+	assert.Equal(t, http.StatusTooManyRequests, code)
+
+	fail := false
+	UseReload(func(ctx context.Context) (string, error) {
+		if fail {
+			return "", errors.New("QUOTA_WARN_PERCENT: 120 is above 100")
+		}
+		UseAuthRateLimit(5)
+		UseNotifySettings([]int{50}, nil)
+		return "auth rate limit=5", nil
+	})
+	code, out := callPath(r, "POST", "/admin/config/reload", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "auth rate limit=5", out["applied"])
+	assert.Equal(t, 5, AuthRateLimit())
+	code, _ = callPath(limited, "POST", "/login", "")
+	assert.Equal(t, http.StatusOK, code) // The new limit, within the same window
+
+	fail = true
+	code, out = callPath(r, "POST", "/admin/config/reload", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, out["error"], "QUOTA_WARN_PERCENT")
+
+	var audits []models.AuditLog
+	database.DB.Where("action = ?", "config_reload").Find(&audits)
+	require.Len(t, audits, 1)
+	assert.Equal(t, "auth rate limit=5", audits[0].Detail)
+}
@@ -0,0 +1,348 @@
+// rules.go - Sensor-driven automation rules: CRUD API and telemetry evaluation
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"encoding/json"            // JSON telemetry payloads
+	"fmt"                      // For messages
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Rule models
+	"go-mqtt-backend/services" // Shared motor key
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"strconv"                  // Plain-number telemetry payloads
+	"strings"                  // Topic parsing
+	"sync"                     // Condition tracking
+	"time"                     // Condition windows
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+// telemetryGap is the longest silence from a sensor that still counts as the condition
+// holding. After a longer gap the rule's window starts again.
+var telemetryGap = 15 * time.Minute
+
+type RuleInput struct { // Struct for creating or replacing a rule
+	Name      string   `json:"name" binding:"max=64"`                        // Optional label
+	Metric    string   `json:"metric" binding:"required,max=64"`             // Sensor name, e.g. "soil_moisture"
+	Operator  string   `json:"operator" binding:"required,oneof=< <= > >="`  // Comparison
+	Threshold *float64 `json:"threshold" binding:"required"`                 // e.g. 20 for "below 20%"
+	For       int      `json:"for" binding:"min=0,max=1440"`                 // Minutes the condition must hold
+	Duration  int      `json:"duration" binding:"required,min=1"`            // Run length in minutes
+	MaxPerDay int      `json:"max_per_day" binding:"omitempty,min=1,max=24"` // Defaults to 1
+	Enabled   *bool    `json:"enabled"`                                      // Defaults to true
+}
+
+type RuleResponse struct { // A rule as returned by the API
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Metric    string    `json:"metric"`
+	Operator  string    `json:"operator"`
+	Threshold float64   `json:"threshold"`
+	For       int       `json:"for"`      // Minutes
+	Duration  int       `json:"duration"` // Minutes
+	MaxPerDay int       `json:"max_per_day"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func ruleResponse(r models.Rule) RuleResponse {
+	return RuleResponse{
+		ID:        r.ID,
+		Name:      r.Name,
+		Metric:    r.Metric,
+		Operator:  r.Operator,
+		Threshold: r.Threshold,
+		For:       int(r.For.Minutes()),
+		Duration:  int(r.Duration.Minutes()),
+		MaxPerDay: r.MaxPerDay,
+		Enabled:   r.Enabled,
+		CreatedAt: r.CreatedAt,
+	}
+}
+
+func ListRules(c *gin.Context) { // Handler listing the caller's rules
+	var rules []models.Rule
+	if err := database.DB.WithContext(c.Request.Context()).Where("user_id = ?", c.MustGet("userID")).Order("id").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load rules"})
+		return
+	}
+	out := make([]RuleResponse, len(rules))
+	for i, r := range rules {
+		out[i] = ruleResponse(r)
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": out})
+}
+
+func CreateRule(c *gin.Context) { // Handler adding a rule for the caller
+	var input RuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if quota := motorService.Quota(); time.Duration(input.Duration)*time.Minute > quota {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duration is longer than the daily quota (%d minutes)", int(quota.Minutes()))})
+		return
+	}
+	if !requireFeature(c, models.FeatureRules) {
+		return
+	}
+	r := models.Rule{UserID: c.MustGet("userID").(uint)}
+	applyRuleInput(&r, input)
+	if err := database.DB.WithContext(c.Request.Context()).Create(&r).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save rule"})
+		return
+	}
+	c.JSON(http.StatusCreated, ruleResponse(r))
+}
+
+func UpdateRule(c *gin.Context) { // Handler replacing one of the caller's rules
+	r, ok := findRule(c)
+	if !ok {
+		return
+	}
+	var input RuleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if quota := motorService.Quota(); time.Duration(input.Duration)*time.Minute > quota {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duration is longer than the daily quota (%d minutes)", int(quota.Minutes()))})
+		return
+	}
+	if !requireFeature(c, models.FeatureRules) {
+		return
+	}
+	applyRuleInput(&r, input)
+	if err := database.DB.WithContext(c.Request.Context()).Save(&r).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save rule"})
+		return
+	}
+	conditions.forget(r.ID) // Start watching the new condition from scratch
+	c.JSON(http.StatusOK, ruleResponse(r))
+}
+
+func DeleteRule(c *gin.Context) { // Handler removing one of the caller's rules and its history
+	r, ok := findRule(c)
+	if !ok {
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	if err := db.Where("rule_id = ?", r.ID).Delete(&models.RuleRun{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete rule"})
+		return
+	}
+	if err := db.Delete(&r).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete rule"})
+		return
+	}
+	conditions.forget(r.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "rule deleted"})
+}
+
+func ListRuleRuns(c *gin.Context) { // Handler returning the times a rule fired, newest first
+	r, ok := findRule(c)
+	if !ok {
+		return
+	}
+	var runs []models.RuleRun
+	if err := database.DB.WithContext(c.Request.Context()).Where("rule_id = ?", r.ID).Order("at DESC").Limit(100).Find(&runs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load runs"})
+		return
+	}
+	out := make([]gin.H, len(runs))
+	for i, run := range runs {
+		out[i] = gin.H{"at": run.At, "value": run.Value, "status": run.Status, "reason": run.Reason}
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": out})
+}
+
+func applyRuleInput(r *models.Rule, input RuleInput) {
+	r.Name, r.Metric, r.Operator, r.Threshold = input.Name, input.Metric, input.Operator, *input.Threshold
+	r.For, r.Duration = time.Duration(input.For)*time.Minute, time.Duration(input.Duration)*time.Minute
+	r.MaxPerDay = max(input.MaxPerDay, 1)
+	r.Enabled = input.Enabled == nil || *input.Enabled
+}
+
+func findRule(c *gin.Context) (models.Rule, bool) { // Loads :id if it belongs to the caller, else responds 404
+	var r models.Rule
+	err := database.DB.WithContext(c.Request.Context()).Where("id = ? AND user_id = ?", c.Param("id"), c.MustGet("userID")).Limit(1).Find(&r).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load rule"})
+		return r, false
+	}
+	if r.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return r, false
+	}
+	return r, true
+}
+
+type condition struct { // How long a rule's condition has held
+	since    time.Time // Start of the current window
+	lastSeen time.Time // Last reading that met the condition
+	limited  bool      // The daily limit was already recorded for this episode
+}
+
+type conditionTracker struct { // Per-rule condition state, in memory on every replica
+	mu    sync.Mutex
+	rules map[uint]*condition
+}
+
+var conditions = &conditionTracker{rules: make(map[uint]*condition)}
+
+func (t *conditionTracker) forget(ruleID uint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.rules, ruleID)
+}
+
+// Telemetry returns the MQTT callback for sensor readings published under prefix, e.g.
+// "sensors/soil_moisture" with a plain number or {"value": 18.5} as payload. Readings there
+// belong to the default organization. A registered device publishes under its own
+// namespace instead, "{org}/{device}/sensors/soil_moisture", which only reaches its
+// organization's rules as metric "{device}/soil_moisture"; anything under an unknown
+// organization or device is dropped. Every replica tracks rule conditions, so a new leader
+// can take over; only while isLeader reports true are runs queued and readings stored
+// (in batches, see telemetry.go).
+func Telemetry(prefix string, isLeader func() bool) func(topic string, payload []byte) {
+	return func(topic string, payload []byte) {
+		value, err := parseReading(payload)
+		if err != nil {
+			slog.Warn("ignoring telemetry", "topic", topic, "error", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		now := time.Now()
+		reading := models.TelemetryReading{OrganizationID: database.DefaultOrgID, Metric: strings.TrimPrefix(topic, prefix), Value: value, At: now}
+		if !strings.HasPrefix(topic, prefix) { // Device namespace
+			org, dev, rest, err := resolveDevice(ctx, topic)
+			if err == nil && !strings.HasPrefix(rest, prefix) {
+				err = errUnknownDevice
+			}
+			if err != nil {
+				slog.Warn("ignoring telemetry", "topic", topic, "error", err)
+				return
+			}
+			reading.OrganizationID, reading.DeviceID, reading.Metric = org.ID, dev.ID, dev.Name+"/"+strings.TrimPrefix(rest, prefix)
+			checkSafetyLimits(ctx, motorKey(org.Slug, dev.Name), strings.TrimPrefix(rest, prefix), value, dev.MaxTempC, dev.MaxCurrentA)
+			if isLeader() { // Flagged once
+				checkIdleDraw(ctx, motorKey(org.Slug, dev.Name), strings.TrimPrefix(rest, prefix), value)
+			}
+		} else {
+			checkSafetyLimits(ctx, services.SharedMotor, reading.Metric, value, appConfig.MotorMaxTempC, appConfig.MotorMaxCurrentA)
+			if isLeader() {
+				checkIdleDraw(ctx, services.SharedMotor, reading.Metric, value)
+			}
+		}
+		telemetry.add(ctx, reading, isLeader()) // Stored by the leader only
+		if err := EvaluateRules(ctx, reading.OrganizationID, reading.Metric, value, now, isLeader()); err != nil {
+			slog.Error("rule evaluation failed", "metric", reading.Metric, "error", err)
+		}
+	}
+}
+
+func parseReading(payload []byte) (float64, error) { // Plain number or {"value": n}
+	if v, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64); err == nil {
+		return v, nil
+	}
+	var body struct {
+		Value *float64 `json:"value"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil || body.Value == nil {
+		return 0, fmt.Errorf("payload is neither a number nor {\"value\": number}")
+	}
+	return *body.Value, nil
+}
+
+// EvaluateRules updates every enabled rule on metric owned by a member of orgID with a
+// reading taken at now. A rule fires once its condition has held for its For window; it
+// then waits for the run to finish before counting again, and is limited to MaxPerDay
+// queued runs in any 24 hours.
+// With act false (not the leader) conditions are tracked but nothing is queued.
+func EvaluateRules(ctx context.Context, orgID uint, metric string, value float64, now time.Time, act bool) error {
+	db := database.DB.WithContext(ctx)
+	var org models.Organization
+	if err := db.Limit(1).Find(&org, orgID).Error; err != nil {
+		return err
+	}
+	if plan, err := planOf(ctx, org); err != nil || !plan.Has(models.FeatureRules) {
+		return err // Rules don't fire on plans without them
+	}
+	var rules []models.Rule
+	members := database.DB.Model(&models.User{}).Select("id").Where("organization_id = ?", orgID)
+	if err := db.Where("metric = ? AND enabled = ? AND user_id IN (?)", metric, true, members).Find(&rules).Error; err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if !conditions.observe(r, value, now) || !act {
+			continue
+		}
+		run := models.RuleRun{RuleID: r.ID, At: now, Value: value}
+		var queued int64
+		if err := db.Model(&models.RuleRun{}).Where("rule_id = ? AND status = ? AND at > ?", r.ID, models.ScheduleRunQueued, now.Add(-24*time.Hour)).Count(&queued).Error; err != nil {
+			return err
+		}
+		if int(queued) >= r.MaxPerDay {
+			if !conditions.limit(r.ID) {
+				continue // Already recorded while the condition has held
+			}
+			run.Status, run.Reason = models.ScheduleRunSkipped, fmt.Sprintf("daily limit reached (%d runs in 24 hours)", r.MaxPerDay)
+		} else {
+			run.Status, run.Reason = queueScheduled(ctx, r.UserID, r.Duration, now, now)
+		}
+		if err := db.Create(&run).Error; err != nil {
+			return err
+		}
+		slog.Info("rule fired", "rule_id", r.ID, "user_id", r.UserID, "metric", metric, "value", value, "status", run.Status, "reason", run.Reason)
+	}
+	return nil
+}
+
+// observe records a reading for r and reports whether the rule should fire now.
+func (t *conditionTracker) observe(r models.Rule, value float64, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !compare(value, r.Operator, r.Threshold) {
+		delete(t.rules, r.ID)
+		return false
+	}
+	c := t.rules[r.ID]
+	if c == nil || now.Sub(c.lastSeen) > telemetryGap { // New episode, or the sensor went quiet
+		c = &condition{since: now}
+		t.rules[r.ID] = c
+	}
+	c.lastSeen = now
+	if now.Before(c.since.Add(r.For)) {
+		return false
+	}
+	c.since = now.Add(r.Duration) // Give the run time to take effect before counting again
+	return true
+}
+
+func (t *conditionTracker) limit(ruleID uint) bool { // Marks the daily limit as recorded; false if it already was
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.rules[ruleID]
+	if c == nil || c.limited {
+		return false
+	}
+	c.limited = true
+	return true
+}
+
+func compare(value float64, operator string, threshold float64) bool {
+	switch operator {
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	}
+	return false
+}
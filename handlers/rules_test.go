@@ -0,0 +1,172 @@
+// rules_test.go - Tests for sensor automation rules
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"context"                  // For evaluation
+	"encoding/json"            // Response bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Rule models
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"strconv"                  // Rule IDs in paths
+	"testing"                  // Go's testing package
+	"time"                     // Condition windows
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestRuleAPI checks validation, defaults and ownership
+func TestRuleAPI(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	r := gin.New()
+	var caller uint = 1
+	setUser := func(c *gin.Context) { c.Set("userID", caller); c.Set("orgID", database.DefaultOrgID) }
+	r.GET("/api/rules", setUser, ListRules)
+	r.POST("/api/rules", setUser, CreateRule)
+	r.PUT("/api/rules/:id", setUser, UpdateRule)
+	r.DELETE("/api/rules/:id", setUser, DeleteRule)
+	r.GET("/api/rules/:id/runs", setUser, ListRuleRuns)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	code, _ := call("POST", "/api/rules", `{"metric":"soil_moisture","operator":"<","duration":15}`) // No threshold
+	assert.Equal(t, 400, code)
+	code, _ = call("POST", "/api/rules", `{"metric":"soil_moisture","operator":"!=","threshold":20,"duration":15}`)
+	assert.Equal(t, 400, code)
+	code, _ = call("POST", "/api/rules", `{"metric":"soil_moisture","operator":"<","threshold":20,"duration":90}`) // Over the quota
+	assert.Equal(t, 400, code)
+	code, out := call("POST", "/api/rules", `{"name":"Dry soil","metric":"soil_moisture","operator":"<","threshold":0,"for":10,"duration":15}`)
+	require.Equal(t, 201, code)
+	assert.Equal(t, 1.0, out["max_per_day"])
+	assert.Equal(t, 0.0, out["threshold"]) // Zero is a real threshold
+	path := "/api/rules/" + strconv.Itoa(int(out["id"].(float64)))
+
+	caller = 2
+	code, _ = call("GET", path+"/runs", "")
+	assert.Equal(t, 404, code)
+	code, out = call("GET", "/api/rules", "")
+	assert.Equal(t, 200, code)
+	assert.Empty(t, out["rules"])
+
+	caller = 1
+	code, out = call("PUT", path, `{"metric":"soil_moisture","operator":"<=","threshold":20,"duration":15,"max_per_day":2,"enabled":false}`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, false, out["enabled"])
+	assert.Equal(t, 2.0, out["max_per_day"])
+	code, _ = call("DELETE", path, "")
+	assert.Equal(t, 200, code)
+	code, _ = call("GET", path+"/runs", "")
+	assert.Equal(t, 404, code)
+}
+
+// TestEvaluateRules checks the hold window, the wait after a run and the daily limit
+func TestEvaluateRules(t *testing.T) {
+	setupTestDB()
+	svc := useTestMotor(10)
+	conditions = &conditionTracker{rules: make(map[uint]*condition)}
+	owner := models.User{Email: "owner@example.com", Password: "x", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&owner).Error)
+	rule := models.Rule{UserID: owner.ID, Metric: "soil_moisture", Operator: "<", Threshold: 20, For: 10 * time.Minute, Duration: 5 * time.Minute, MaxPerDay: 2, Enabled: true}
+	require.NoError(t, database.DB.Create(&rule).Error)
+	t0 := time.Now()
+	read := func(minute int, value float64) {
+		require.NoError(t, EvaluateRules(context.Background(), database.DefaultOrgID, "soil_moisture", value, t0.Add(time.Duration(minute)*time.Minute), true))
+	}
+	runs := func() (runs []models.RuleRun) {
+		database.DB.Where("rule_id = ?", rule.ID).Order("id").Find(&runs)
+		return runs
+	}
+
+	read(0, 18)
+	read(5, 25) // Wet again: the window restarts
+	read(6, 18)
+	read(15, 18)
+	assert.Empty(t, runs())
+	read(16, 17) // Dry for 10 minutes
+	require.Len(t, runs(), 1)
+	assert.Equal(t, models.ScheduleRunQueued, runs()[0].Status)
+	assert.Equal(t, 17.0, runs()[0].Value)
+	read(25, 18) // The run needs time to take effect
+	assert.Len(t, runs(), 1)
+	read(31, 18)
+	read(41, 18)
+	assert.Len(t, runs(), 2)
+	read(56, 18) // Third time in a day
+	require.Len(t, runs(), 3)
+	assert.Equal(t, models.ScheduleRunSkipped, runs()[2].Status)
+	assert.Contains(t, runs()[2].Reason, "daily limit")
+	read(66, 18)
+	read(76, 18)
+	assert.Len(t, runs(), 3) // The limit is recorded once per dry spell
+
+	st, err := svc.Status(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, st.QueueLength)
+
+	require.NoError(t, EvaluateRules(context.Background(), database.DefaultOrgID, "soil_moisture", 25, t0, false))
+	database.DB.Model(&rule).Update("max_per_day", 10)
+	for minute := 100; minute <= 130; minute += 5 { // Not the leader: tracked, never queued
+		require.NoError(t, EvaluateRules(context.Background(), database.DefaultOrgID, "soil_moisture", 10, t0.Add(time.Duration(minute)*time.Minute), false))
+	}
+	assert.Len(t, runs(), 3)
+}
+
+// TestTelemetry checks topic and payload parsing
+func TestTelemetry(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	conditions = &conditionTracker{rules: make(map[uint]*condition)}
+	owner := models.User{Email: "owner@example.com", Password: "x", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&owner).Error)
+	rule := models.Rule{UserID: owner.ID, Metric: "field1/soil_moisture", Operator: "<", Threshold: 20, Duration: 5 * time.Minute, MaxPerDay: 1, Enabled: true}
+	require.NoError(t, database.DB.Create(&rule).Error)
+	handle := Telemetry("sensors/", func() bool { return true })
+
+	handle("sensors/field1/soil_moisture", []byte("not a number"))
+	handle("sensors/field2/soil_moisture", []byte("5"))
+	var count int64
+	database.DB.Model(&models.RuleRun{}).Count(&count)
+	assert.Zero(t, count)
+	handle("sensors/field1/soil_moisture", []byte(`{"value": 12.5}`))
+	var run models.RuleRun
+	require.NoError(t, database.DB.Where("rule_id = ?", rule.ID).First(&run).Error)
+	assert.Equal(t, 12.5, run.Value)
+	assert.Equal(t, models.ScheduleRunQueued, run.Status)
+
+	// A device's readings only reach its own organization's rules
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres", PlanID: planNamed(t, models.PlanPro)}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	farmer := models.User{Email: "farmer@example.com", Password: "x", OrganizationID: farm.ID}
+	require.NoError(t, database.DB.Create(&farmer).Error)
+	dev := models.Device{OrganizationID: farm.ID, Name: "pump-1"}
+	require.NoError(t, database.DB.Create(&dev).Error)
+	farmRule := models.Rule{UserID: farmer.ID, Metric: "pump-1/soil_moisture", Operator: "<", Threshold: 20, Duration: 5 * time.Minute, MaxPerDay: 1, Enabled: true}
+	stray := models.Rule{UserID: owner.ID, Metric: "pump-1/soil_moisture", Operator: "<", Threshold: 20, Duration: 5 * time.Minute, MaxPerDay: 1, Enabled: true}
+	require.NoError(t, database.DB.Create(&[]*models.Rule{&farmRule, &stray}).Error)
+	handle("green-acres/pump-2/sensors/soil_moisture", []byte("5")) // Not registered
+	handle("other-farm/pump-1/sensors/soil_moisture", []byte("5"))
+	handle("green-acres/pump-1/motor", []byte("5")) // Not telemetry
+	database.DB.Model(&models.RuleRun{}).Where("rule_id IN ?", []uint{farmRule.ID, stray.ID}).Count(&count)
+	assert.Zero(t, count)
+	handle("green-acres/pump-1/sensors/soil_moisture", []byte("5"))
+	var fired []models.RuleRun
+	database.DB.Where("rule_id IN ?", []uint{farmRule.ID, stray.ID}).Find(&fired)
+	require.Len(t, fired, 1)
+	assert.Equal(t, farmRule.ID, fired[0].RuleID)
+	require.NoError(t, FlushTelemetry(context.Background()))
+	database.DB.First(&dev, dev.ID)
+	assert.NotNil(t, dev.LastSeenAt)
+}
@@ -0,0 +1,136 @@
+// safety.go - Safety cutoffs: runtime limits for manual runs and sensor limits, and motor faults
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"fmt"                      // Reasons
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Device and session log models
+	"go-mqtt-backend/services" // Motor interlocks
+	"go-mqtt-backend/store"    // Session events
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"strings"                  // Motor keys
+	"time"                     // Runtimes
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+const ( // Telemetry metrics checked against a motor's safety limits
+	MetricMotorTemperature = "motor_temperature" // °C, e.g. on sensors/motor_temperature or {org}/{device}/sensors/motor_temperature
+	MetricMotorCurrent     = "motor_current"     // Amps
+)
+
+// CutoffManualRuns forces OFF every tenant device motor that was switched on through
+// POST /api/send and has run for max, records the run as safety-stopped and tells the
+// user who switched it on. Queued runs are cut off by the queue itself. It runs as a job
+// on the leader; max 0 disables it.
+func CutoffManualRuns(ctx context.Context, max time.Duration) error {
+	if max <= 0 {
+		return nil
+	}
+	var devices []struct {
+		Slug string
+		Name string
+	}
+	err := database.DB.WithContext(ctx).Model(&models.Device{}).
+		Select("organizations.slug, devices.name").
+		Joins("JOIN organizations ON organizations.id = devices.organization_id").
+		Scan(&devices).Error
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		motor := motorKey(d.Slug, d.Name)
+		l, err := motorService.CutoffManual(ctx, motor, max)
+		if err != nil {
+			slog.Error("motor safety cutoff failed", "motor", motor, "error", err) // Retried on the next run
+			continue
+		}
+		if l == nil {
+			continue
+		}
+		slog.Warn("motor safety cutoff", "motor", motor, "user_id", l.UserID, "ran", time.Since(l.Since))
+		endManualSession(ctx, *l, services.SessionSafetyStopped, fmt.Sprintf("safety cutoff: %s ran %s continuously", motor, max))
+	}
+	return nil
+}
+
+// endManualSession records how a manual session that was switched off ended and tells the
+// user who switched it on. The queue does both for its own sessions.
+func endManualSession(ctx context.Context, l services.Interlock, kind, reason string) {
+	now := time.Now()
+	ev := services.SessionEvent{Kind: kind, Request: store.MotorRequest{UserID: l.UserID, RequestAt: l.Since}, At: now, Reason: reason, Ran: now.Sub(l.Since)}
+	entry := models.SessionLog{UserID: l.UserID, Outcome: ev.Kind, Ran: ev.Ran, Reason: ev.Reason, EndedAt: now}
+	if err := database.DB.WithContext(ctx).Create(&entry).Error; err != nil {
+		slog.Error("log motor session failed", "user_id", l.UserID, "outcome", ev.Kind, "error", err)
+	}
+	NotifySession(ev)
+}
+
+// checkSafetyLimits trips motor into FAULT when a temperature or current reading is
+// over its limit (0 for none). Other metrics are ignored.
+func checkSafetyLimits(ctx context.Context, motor, metric string, value, maxTempC, maxCurrentA float64) {
+	var limit float64
+	switch metric {
+	case MetricMotorTemperature:
+		limit = maxTempC
+	case MetricMotorCurrent:
+		limit = maxCurrentA
+	}
+	if limit <= 0 || value <= limit {
+		return
+	}
+	reason := fmt.Sprintf("%s %g over the %g limit", metric, value, limit)
+	motorService.Trip(ctx, motor, reason)
+}
+
+// RecordFault stores a motor going into FAULT and alerts the admins, who must clear it
+// before the motor runs again. It is the MotorService OnFault hook.
+func RecordFault(motor string, st services.MotorStateInfo) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	slog.Error("motor fault", "motor", motor, "reason", st.Reason)
+	fault := models.MotorFault{OrganizationID: database.DefaultOrgID, Motor: motor, Reason: st.Reason, At: st.Since}
+	if slug, _, ok := strings.Cut(motor, "/"); ok { // Tenant device
+		var org models.Organization
+		database.DB.WithContext(ctx).Select("id").Where("slug = ?", slug).Limit(1).Find(&org)
+		fault.OrganizationID = org.ID
+	}
+	if err := database.DB.WithContext(ctx).Create(&fault).Error; err != nil {
+		slog.Error("record motor fault failed", "motor", motor, "error", err)
+	}
+	AlertAdmins(ctx, "motor_fault", map[string]any{"Motor": motor, "Reason": st.Reason, "At": st.Since})
+}
+
+// ListPendingCommands returns the motor commands still waiting for the device to confirm
+// them; overdue ones are failed by the command watchdog on its next sweep.
+func ListPendingCommands(c *gin.Context) {
+	pending := motorService.PendingCommands()
+	if pending == nil {
+		pending = []services.PendingCommand{}
+	}
+	stuck := 0
+	for _, p := range pending {
+		if p.Overdue {
+			stuck++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"commands": pending, "stuck": stuck})
+}
+
+// ListFaults returns the 50 most recent motor faults, newest first; active=true limits
+// them to faults not cleared yet.
+func ListFaults(c *gin.Context) {
+	q := database.DB.WithContext(c.Request.Context()).Order("at DESC").Limit(50)
+	if c.Query("active") == "true" {
+		q = q.Where("cleared_at IS NULL")
+	}
+	var faults []models.MotorFault
+	if err := q.Find(&faults).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load faults"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"faults": faults})
+}
@@ -0,0 +1,161 @@
+// safety_test.go - Tests for safety cutoffs and motor faults
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"context"                  // For service calls
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Device and session log models
+	"go-mqtt-backend/services" // Session outcomes
+	"go-mqtt-backend/store"    // In-memory backends
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"testing"                  // Go's testing package
+	"time"                     // Runtimes
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestCutoffManualRuns checks that a manual run past the limit is stopped and recorded
+func TestCutoffManualRuns(t *testing.T) {
+	setupTestDB()
+	svc := useTestMotor(5)
+	ctx := context.Background()
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres"}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	require.NoError(t, database.DB.Create(&[]models.Device{{OrganizationID: farm.ID, Name: "pump-1"}, {OrganizationID: farm.ID, Name: "pump-2"}}).Error)
+	require.NoError(t, svc.LockMotor(ctx, "green-acres/pump-1", 7))
+
+	require.NoError(t, CutoffManualRuns(ctx, time.Hour))
+	l, _ := svc.Interlock(ctx, "green-acres/pump-1")
+	assert.NotNil(t, l, "still within the limit")
+
+	require.NoError(t, CutoffManualRuns(ctx, time.Nanosecond))
+	l, _ = svc.Interlock(ctx, "green-acres/pump-1")
+	assert.Nil(t, l)
+	var logs []models.SessionLog
+	require.NoError(t, database.DB.Find(&logs).Error)
+	require.Len(t, logs, 1)
+	assert.Equal(t, uint(7), logs[0].UserID)
+	assert.Equal(t, services.SessionSafetyStopped, logs[0].Outcome)
+	assert.Contains(t, logs[0].Reason, "green-acres/pump-1")
+}
+
+// TestSafetyLimits checks that a reading over a device's limit faults its motor until an admin clears it
+func TestSafetyLimits(t *testing.T) {
+	setupTestDB()
+	UseMotorService(services.NewMotorService(services.MotorDeps{
+		Queue:     store.NewMemoryQueue(5),
+		State:     store.NewMemoryState(),
+		Publisher: services.PublisherFunc(func(string, interface{}) error { return nil }),
+		Repo:      services.NewGormMotorRepository(database.DB),
+		Quota:     time.Hour,
+		OnFault:   RecordFault,
+	}))
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres"}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	require.NoError(t, database.DB.Create(&models.Device{OrganizationID: farm.ID, Name: "pump-1", MaxTempC: 80}).Error)
+	handle := Telemetry("sensors/", func() bool { return false })
+
+	handle("green-acres/pump-1/sensors/motor_temperature", []byte("79.5"))
+	handle("green-acres/pump-1/sensors/motor_current", []byte("40")) // No current limit
+	assert.Equal(t, services.MotorOff, motorService.MotorState("green-acres/pump-1").State)
+	handle("green-acres/pump-1/sensors/motor_temperature", []byte("85"))
+	st := motorService.MotorState("green-acres/pump-1")
+	assert.Equal(t, services.MotorFault, st.State)
+	assert.Equal(t, "motor_temperature 85 over the 80 limit", st.Reason)
+	assert.Error(t, motorService.CheckCommand("green-acres/pump-1", services.CommandOn))
+
+	var fault models.MotorFault
+	require.NoError(t, database.DB.First(&fault).Error)
+	assert.Equal(t, farm.ID, fault.OrganizationID)
+	assert.Equal(t, "green-acres/pump-1", fault.Motor)
+	assert.Nil(t, fault.ClearedAt)
+
+	r := gin.New()
+	r.POST("/admin/motor/clear-fault", func(c *gin.Context) { c.Set("userID", uint(1)) }, AdminClearFault)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/admin/motor/clear-fault", bytes.NewBufferString(`{"motor":"green-acres/pump-1"}`))
+	r.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	require.NoError(t, database.DB.First(&fault, fault.ID).Error)
+	assert.NotNil(t, fault.ClearedAt)
+	assert.Equal(t, services.MotorOff, motorService.MotorState("green-acres/pump-1").State)
+}
+
+// TestAdminStopSession checks that an admin can stop one manual run by its session ID
+func TestAdminStopSession(t *testing.T) {
+	setupTestDB()
+	svc := useTestMotor(5)
+	ctx := context.Background()
+	require.NoError(t, svc.LockMotor(ctx, "green-acres/pump-1", 7))
+	svc.Commanded("green-acres/pump-1", services.CommandOn)
+	id := svc.Interlocks(ctx)["green-acres/pump-1"].ID
+
+	r := gin.New()
+	r.POST("/admin/sessions/:id/stop", func(c *gin.Context) { c.Set("userID", uint(1)) }, AdminStopSession)
+	stop := func(id, body string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/admin/sessions/"+id+"/stop", bytes.NewBufferString(body))
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, 400, stop(id, `{}`)) // A reason is required
+	assert.Equal(t, 404, stop("nope", `{"reason":"left running"}`))
+	require.Equal(t, 200, stop(id, `{"reason":"you left the south pump running"}`))
+
+	l, _ := svc.Interlock(ctx, "green-acres/pump-1")
+	assert.Nil(t, l)
+	var logs []models.SessionLog
+	require.NoError(t, database.DB.Find(&logs).Error)
+	require.Len(t, logs, 1)
+	assert.Equal(t, uint(7), logs[0].UserID)
+	assert.Equal(t, services.SessionStopped, logs[0].Outcome)
+	assert.Equal(t, "you left the south pump running", logs[0].Reason)
+	var audit models.AuditLog
+	require.NoError(t, database.DB.Where("action = ?", "session_stop").First(&audit).Error)
+	assert.Contains(t, audit.Detail, "manual session of user 7 on green-acres/pump-1")
+	assert.Equal(t, 404, stop(id, `{"reason":"again"}`), "already stopped")
+}
+
+// TestStopMotorRun checks that a user can stop their own queued run, but not someone
+// else's, and that it is recorded as stopped
+func TestStopMotorRun(t *testing.T) {
+	setupTestDB()
+	svc := useTestMotor(5)
+	farmer := models.User{Email: "farmer@example.com", OrganizationID: database.DefaultOrgID}
+	other := models.User{Email: "other@example.com", OrganizationID: database.DefaultOrgID}
+	require.NoError(t, database.DB.Create(&[]*models.User{&farmer, &other}).Error)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, svc.Enqueue(ctx, farmer.ID, 30*time.Minute))
+	go svc.Run(ctx, func() {})
+	require.Eventually(t, func() bool { l, _ := svc.Interlock(ctx, services.SharedMotor); return l != nil }, time.Second, 5*time.Millisecond)
+
+	r := gin.New()
+	var caller uint
+	r.POST("/api/motor/stop", func(c *gin.Context) { c.Set("userID", caller) }, StopMotorRun)
+	stop := func(userID uint) int {
+		caller = userID
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/motor/stop", bytes.NewBufferString(""))
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, 404, stop(other.ID))
+	require.Equal(t, 200, stop(farmer.ID))
+
+	var logs []models.SessionLog
+	require.Eventually(t, func() bool { database.DB.Find(&logs); return len(logs) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, services.SessionStopped, logs[0].Outcome)
+	assert.Equal(t, services.OwnerStopReason, logs[0].Reason)
+	assert.Less(t, logs[0].Ran, time.Minute) // The rest is given back
+	var audits int64
+	database.DB.Model(&models.AuditLog{}).Where("action = ?", "motor_run_stopped").Count(&audits)
+	assert.Equal(t, int64(1), audits)
+	assert.Equal(t, 404, stop(farmer.ID), "already stopped")
+}
@@ -0,0 +1,695 @@
+// schedules.go - Recurring motor runs: CRUD API and the job that queues due runs
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                   // For DB lookups
+	"errors"                    // Empty body checks, missing location
+	"fmt"                       // For error messages
+	"go-mqtt-backend/database"  // Database connection
+	"go-mqtt-backend/models"    // Schedule models
+	"go-mqtt-backend/scheduler" // Cron parsing
+	"io"                        // Empty body checks
+	"log/slog"                  // Leveled logging
+	"net/http"                  // HTTP status codes
+	"sort"                      // Ordering occurrences
+	"time"                      // Occurrence times
+
+	"github.com/gin-gonic/gin"  // Gin web framework
+	"github.com/robfig/cron/v3" // Schedule type
+	"gorm.io/gorm"              // Transactions
+)
+
+// scheduleGrace is how late an occurrence may be picked up and still run. Anything older
+// (the backend was down) is recorded as skipped rather than run hours late.
+var scheduleGrace = 10 * time.Minute
+
+type ScheduleInput struct { // Struct for creating or replacing a schedule
+	Name            string `json:"name" binding:"max=64"`                     // Optional label
+	Cron            string `json:"cron" binding:"required"`                   // e.g. "0 6 * * *" for 06:00 every day, or "@sunset-30m"
+	Timezone        string `json:"timezone"`                                  // IANA zone; defaults to the profile time zone, then UTC
+	Duration        int    `json:"duration" binding:"required,min=1"`         // Run length in minutes
+	Enabled         *bool  `json:"enabled"`                                   // Defaults to true
+	SkipIfRainAbove int    `json:"skip_if_rain_above" binding:"min=0,max=99"` // Rain chance in percent (0 never skips)
+}
+
+type ScheduleResponse struct { // A schedule as returned by the API
+	ID              uint       `json:"id"`
+	Name            string     `json:"name"`
+	Cron            string     `json:"cron"`
+	Timezone        string     `json:"timezone"`
+	Duration        int        `json:"duration"` // Minutes
+	Enabled         bool       `json:"enabled"`
+	SkipIfRainAbove int        `json:"skip_if_rain_above,omitempty"`
+	NextRun         *time.Time `json:"next_run,omitempty"` // Omitted while disabled
+	CreatedAt       time.Time  `json:"created_at"`
+	PausedUntil     *time.Time `json:"paused_until,omitempty"`
+	SkipAt          *time.Time `json:"skip_at,omitempty"` // Skipped occurrence
+
+	Warnings []ScheduleConflict `json:"warnings,omitempty"` // Overlaps found when saving
+}
+
+func scheduleResponse(s models.Schedule) ScheduleResponse {
+	out := ScheduleResponse{ID: s.ID, Name: s.Name, Cron: s.Cron, Timezone: s.Timezone, Duration: int(s.Duration.Minutes()), Enabled: s.Enabled, SkipIfRainAbove: s.RainSkipPercent, CreatedAt: s.CreatedAt}
+	now := time.Now()
+	if s.PausedUntil != nil && s.PausedUntil.After(now) {
+		out.PausedUntil = s.PausedUntil
+	}
+	if s.SkipAt != nil && s.SkipAt.After(now) {
+		out.SkipAt = s.SkipAt
+	}
+	if sched, err := scheduleOf(s); err == nil && s.Enabled {
+		next := sched.Next(now)
+		for skipped(s, next) {
+			next = sched.Next(next)
+		}
+		out.NextRun = &next
+	}
+	return out
+}
+
+// skipped reports whether the occurrence at is paused or was skipped by the user.
+func skipped(s models.Schedule, at time.Time) bool {
+	return (s.PausedUntil != nil && at.Before(*s.PausedUntil)) || (s.SkipAt != nil && at.Equal(*s.SkipAt))
+}
+
+// scheduleOf parses a schedule's cron expression in its time zone. Times skipped or
+// repeated by DST changes run exactly once (see scheduler.ParseSpecIn). Sunrise/sunset
+// specs are computed for the site location.
+func scheduleOf(s models.Schedule) (cron.Schedule, error) {
+	if scheduler.IsSolarSpec(s.Cron) {
+		var lat, lon float64
+		var ok bool
+		if appConfig != nil {
+			lat, lon, ok, _ = appConfig.SiteCoordinates()
+		}
+		if !ok {
+			return nil, errors.New("sunrise and sunset times need SITE_LOCATION to be configured")
+		}
+		return scheduler.ParseSolarSpec(s.Cron, lat, lon)
+	}
+	loc := time.Local
+	if s.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	return scheduler.ParseSpecIn(s.Cron, loc)
+}
+
+// validateSchedule checks the cron expression, time zone and duration, filling in the
+// caller's profile time zone when none is given.
+func validateSchedule(ctx context.Context, userID uint, input *ScheduleInput) error {
+	if input.Timezone == "" {
+		var user models.User
+		database.DB.WithContext(ctx).Select("timezone").Limit(1).Find(&user, userID)
+		input.Timezone = user.Timezone
+	}
+	if input.Timezone == "" {
+		input.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(input.Timezone); err != nil || input.Timezone == "Local" {
+		return fmt.Errorf("unknown timezone %q", input.Timezone)
+	}
+	if _, err := scheduleOf(models.Schedule{Cron: input.Cron, Timezone: input.Timezone}); err != nil {
+		return fmt.Errorf("invalid schedule %q: %v", input.Cron, err)
+	}
+	if input.SkipIfRainAbove > 0 && forecaster == nil {
+		return fmt.Errorf("skip_if_rain_above needs weather forecasts, which aren't configured")
+	}
+	if quota := motorService.Quota(); time.Duration(input.Duration)*time.Minute > quota {
+		return fmt.Errorf("duration is longer than the daily quota (%d minutes)", int(quota.Minutes()))
+	}
+	return nil
+}
+
+func ListSchedules(c *gin.Context) { // Handler listing the caller's schedules
+	var schedules []models.Schedule
+	if err := database.DB.WithContext(c.Request.Context()).Where("user_id = ?", c.MustGet("userID")).Order("id").Find(&schedules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load schedules"})
+		return
+	}
+	out := make([]ScheduleResponse, len(schedules))
+	for i, s := range schedules {
+		out[i] = scheduleResponse(s)
+	}
+	c.JSON(http.StatusOK, gin.H{"schedules": out})
+}
+
+func CreateSchedule(c *gin.Context) { // Handler adding a recurring run for the caller
+	var input ScheduleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+	if err := validateSchedule(c.Request.Context(), userID, &input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !requireScheduleFeatures(c, input) {
+		return
+	}
+	var count int64
+	members := database.DB.Model(&models.User{}).Select("id").Where("organization_id = ?", orgOf(c))
+	if err := database.DB.WithContext(c.Request.Context()).Model(&models.Schedule{}).Where("user_id IN (?)", members).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save schedule"})
+		return
+	}
+	if !requireRoom(c, "schedules", count, maxSchedules) {
+		return
+	}
+	s := models.Schedule{UserID: userID, CheckedAt: time.Now()}
+	applyScheduleInput(&s, input)
+	warnings, ok := checkConflicts(c, s)
+	if !ok {
+		return
+	}
+	if err := database.DB.WithContext(c.Request.Context()).Create(&s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save schedule"})
+		return
+	}
+	out := scheduleResponse(s)
+	out.Warnings = warnings
+	c.JSON(http.StatusCreated, out)
+}
+
+func UpdateSchedule(c *gin.Context) { // Handler replacing one of the caller's schedules
+	s, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+	var input ScheduleInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Timezone == "" {
+		input.Timezone = s.Timezone // Keep the zone unless it changes
+	}
+	if err := validateSchedule(c.Request.Context(), s.UserID, &input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !requireScheduleFeatures(c, input) {
+		return
+	}
+	applyScheduleInput(&s, input)
+	s.SkipAt = nil // May not be an occurrence any more
+	warnings, ok := checkConflicts(c, s)
+	if !ok {
+		return
+	}
+	s.CheckedAt = time.Now() // Don't report occurrences under the old settings as missed
+	db := database.DB.WithContext(c.Request.Context())
+	if err := db.Where("schedule_id = ? AND at > ?", s.ID, s.CheckedAt).Delete(&models.ScheduleRun{}).Error; err != nil { // The recorded skip
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save schedule"})
+		return
+	}
+	if err := db.Save(&s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save schedule"})
+		return
+	}
+	out := scheduleResponse(s)
+	out.Warnings = warnings
+	c.JSON(http.StatusOK, out)
+}
+
+func DeleteSchedule(c *gin.Context) { // Handler removing one of the caller's schedules and its history
+	s, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	if err := db.Where("schedule_id = ?", s.ID).Delete(&models.ScheduleRun{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete schedule"})
+		return
+	}
+	if err := db.Delete(&s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not delete schedule"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "schedule deleted"})
+}
+
+func ListScheduleRuns(c *gin.Context) { // Handler returning a schedule's recent runs, newest first
+	s, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+	var runs []models.ScheduleRun
+	if err := database.DB.WithContext(c.Request.Context()).Where("schedule_id = ?", s.ID).Order("at DESC").Limit(100).Find(&runs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load runs"})
+		return
+	}
+	out := make([]gin.H, len(runs))
+	for i, r := range runs {
+		out[i] = gin.H{"at": r.At, "status": r.Status, "reason": r.Reason}
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": out})
+}
+
+const ( // Limits on the upcoming-runs calendar
+	upcomingDefaultRange = 7 * 24 * time.Hour  // When to is omitted
+	upcomingMaxRange     = 62 * 24 * time.Hour // Two months, enough for a month view with spill-over
+	upcomingMaxRuns      = 1000                // Occurrences per response
+)
+
+type UpcomingRunResponse struct { // One planned run in the calendar
+	At          time.Time `json:"at"`
+	EndsAt      time.Time `json:"ends_at"`
+	Duration    int       `json:"duration"` // Minutes
+	Kind        string    `json:"kind"`     // "recurring" or "one_time"
+	ScheduleID  uint      `json:"schedule_id,omitempty"`
+	ScheduledID uint      `json:"scheduled_id,omitempty"` // One-time run ID
+	Name        string    `json:"name,omitempty"`
+}
+
+// ListUpcomingRuns returns the caller's planned runs in [from, to): every recurring
+// occurrence (paused and skipped ones left out) and every pending one-time run, soonest
+// first. from defaults to now and to to a week after from.
+func ListUpcomingRuns(c *gin.Context) {
+	from, to := time.Now(), time.Time{}
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.Query(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be an RFC 3339 time"})
+				return
+			}
+			*t = parsed
+		}
+	}
+	if to.IsZero() {
+		to = from.Add(upcomingDefaultRange)
+	}
+	if !to.After(from) || to.Sub(from) > upcomingMaxRange {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("to must be after from and at most %d days later", int(upcomingMaxRange.Hours()/24))})
+		return
+	}
+	userID := c.MustGet("userID")
+	db := database.DB.WithContext(c.Request.Context())
+	var schedules []models.Schedule
+	if err := db.Where("user_id = ? AND enabled = ?", userID, true).Find(&schedules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load schedules"})
+		return
+	}
+	var oneTime []models.ScheduledRequest
+	err := db.Where("user_id = ? AND status = ? AND start_at >= ? AND start_at < ?", userID, models.ScheduledPending, from, to).
+		Order("start_at").Limit(upcomingMaxRuns + 1).Find(&oneTime).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load scheduled runs"})
+		return
+	}
+
+	var out []UpcomingRunResponse
+	for _, r := range upcomingRuns(schedules, from, to, upcomingMaxRuns+1) {
+		out = append(out, UpcomingRunResponse{At: r.At, EndsAt: r.At.Add(r.Schedule.Duration), Duration: int(r.Schedule.Duration.Minutes()), Kind: "recurring", ScheduleID: r.Schedule.ID, Name: r.Schedule.Name})
+	}
+	for _, r := range oneTime {
+		out = append(out, UpcomingRunResponse{At: r.StartAt, EndsAt: r.StartAt.Add(r.Duration), Duration: int(r.Duration.Minutes()), Kind: "one_time", ScheduledID: r.ID})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].At.Before(out[j].At) })
+	truncated := len(out) > upcomingMaxRuns
+	if truncated {
+		out = out[:upcomingMaxRuns]
+	}
+	if out == nil {
+		out = []UpcomingRunResponse{}
+	}
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "runs": out, "truncated": truncated})
+}
+
+type PauseInput struct { // Struct for pausing a schedule
+	Until time.Time `json:"until" binding:"required"` // RFC 3339; runs before this are skipped
+}
+
+func PauseSchedule(c *gin.Context) { // Handler skipping a schedule's runs until a given time
+	s, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+	var input PauseInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !input.Until.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "until must be in the future"})
+		return
+	}
+	until := input.Until.Truncate(time.Second)
+	if err := database.DB.WithContext(c.Request.Context()).Model(&s).Update("paused_until", until).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not pause schedule"})
+		return
+	}
+	s.PausedUntil = &until
+	c.JSON(http.StatusOK, scheduleResponse(s))
+}
+
+func ResumeSchedule(c *gin.Context) { // Handler ending a pause early
+	s, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+	if err := database.DB.WithContext(c.Request.Context()).Model(&s).Update("paused_until", nil).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not resume schedule"})
+		return
+	}
+	s.PausedUntil = nil
+	c.JSON(http.StatusOK, scheduleResponse(s))
+}
+
+type SkipInput struct { // Struct for skipping a schedule's next run
+	Reason string `json:"reason" binding:"max=200"` // Optional, e.g. "it rained today"
+}
+
+// SkipNextRun skips the schedule's next occurrence and records it in the run history
+// straight away, so the skip shows up before the time comes.
+func SkipNextRun(c *gin.Context) {
+	s, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+	var input SkipInput
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) { // The body is optional
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp := scheduleResponse(s)
+	if resp.NextRun == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "schedule is disabled"})
+		return
+	}
+	if resp.SkipAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "a run is already skipped; undo it first"})
+		return
+	}
+	next := *resp.NextRun
+	reason := "skipped by user"
+	if input.Reason != "" {
+		reason += ": " + input.Reason
+	}
+	err := database.DB.WithContext(c.Request.Context()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&models.ScheduleRun{ScheduleID: s.ID, At: next, Status: models.ScheduleRunSkipped, Reason: reason}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&s).Update("skip_at", next).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not skip run"})
+		return
+	}
+	s.SkipAt = &next
+	c.JSON(http.StatusOK, scheduleResponse(s))
+}
+
+func UndoSkip(c *gin.Context) { // Handler restoring a skipped run that hasn't happened yet
+	s, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+	if s.SkipAt == nil || !s.SkipAt.After(time.Now()) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no skipped run to restore"})
+		return
+	}
+	err := database.DB.WithContext(c.Request.Context()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("schedule_id = ? AND at = ?", s.ID, *s.SkipAt).Delete(&models.ScheduleRun{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&s).Update("skip_at", nil).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not restore run"})
+		return
+	}
+	s.SkipAt = nil
+	c.JSON(http.StatusOK, scheduleResponse(s))
+}
+
+func applyScheduleInput(s *models.Schedule, input ScheduleInput) {
+	s.Name, s.Cron, s.Timezone, s.Duration = input.Name, input.Cron, input.Timezone, time.Duration(input.Duration)*time.Minute
+	s.Enabled = input.Enabled == nil || *input.Enabled
+	s.RainSkipPercent = input.SkipIfRainAbove
+}
+
+// checkConflicts responds 409 with the details if s would push planned runtime over the
+// daily quota. Otherwise it returns the overlaps to pass back as warnings.
+func checkConflicts(c *gin.Context, s models.Schedule) ([]ScheduleConflict, bool) {
+	quota, overlaps, err := scheduleConflicts(c.Request.Context(), s)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not check schedule conflicts"})
+		return nil, false
+	}
+	if len(quota) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "schedule would exceed the daily quota", "conflicts": quota})
+		return nil, false
+	}
+	return overlaps, true
+}
+
+func findSchedule(c *gin.Context) (models.Schedule, bool) { // Loads :id if it belongs to the caller, else responds 404
+	var s models.Schedule
+	err := database.DB.WithContext(c.Request.Context()).Where("id = ? AND user_id = ?", c.Param("id"), c.MustGet("userID")).Limit(1).Find(&s).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load schedule"})
+		return s, false
+	}
+	if s.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
+		return s, false
+	}
+	return s, true
+}
+
+const ( // Limits on one-time scheduled requests
+	maxScheduleAhead   = 30 * 24 * time.Hour // How far ahead a run can be booked
+	maxPendingRequests = 20                  // Pending one-time runs per user
+)
+
+type ScheduleMotorInput struct { // Struct for booking a one-time run
+	StartAt  time.Time `json:"start_at" binding:"required"`       // RFC 3339, e.g. "2024-06-01T05:30:00+05:00"
+	Duration int       `json:"duration" binding:"required,min=1"` // Run length in minutes
+}
+
+type ScheduledRequestResponse struct { // A one-time run as returned by the API
+	ID       uint      `json:"id"`
+	StartAt  time.Time `json:"start_at"`
+	Duration int       `json:"duration"` // Minutes
+	Status   string    `json:"status"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+func scheduledRequestResponse(r models.ScheduledRequest) ScheduledRequestResponse {
+	return ScheduledRequestResponse{ID: r.ID, StartAt: r.StartAt, Duration: int(r.Duration.Minutes()), Status: r.Status, Reason: r.Reason}
+}
+
+// ScheduleMotorRequest books a one-time run. The duration and start time are checked now;
+// shutdown, quota and queue capacity are checked when the run is queued at start_at.
+func ScheduleMotorRequest(c *gin.Context) {
+	var input ScheduleMotorInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	switch {
+	case !input.StartAt.After(now):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start_at must be in the future (use POST /api/motor to run now)"})
+		return
+	case input.StartAt.After(now.Add(maxScheduleAhead)):
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("start_at must be within %d days", int(maxScheduleAhead.Hours()/24))})
+		return
+	case time.Duration(input.Duration)*time.Minute > motorService.Quota():
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duration is longer than the daily quota (%d minutes)", int(motorService.Quota().Minutes()))})
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+	db := database.DB.WithContext(c.Request.Context())
+	var pending int64
+	if err := db.Model(&models.ScheduledRequest{}).Where("user_id = ? AND status = ?", userID, models.ScheduledPending).Count(&pending).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save scheduled run"})
+		return
+	}
+	if pending >= maxPendingRequests {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("at most %d pending scheduled runs", maxPendingRequests)})
+		return
+	}
+	r := models.ScheduledRequest{UserID: userID, StartAt: input.StartAt, Duration: time.Duration(input.Duration) * time.Minute, Status: models.ScheduledPending}
+	if err := db.Create(&r).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save scheduled run"})
+		return
+	}
+	c.JSON(http.StatusCreated, scheduledRequestResponse(r))
+}
+
+func ListScheduledRequests(c *gin.Context) { // Handler listing the caller's pending one-time runs, soonest first
+	var requests []models.ScheduledRequest
+	err := database.DB.WithContext(c.Request.Context()).
+		Where("user_id = ? AND status = ?", c.MustGet("userID"), models.ScheduledPending).
+		Order("start_at").Find(&requests).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load scheduled runs"})
+		return
+	}
+	out := make([]ScheduledRequestResponse, len(requests))
+	for i, r := range requests {
+		out[i] = scheduledRequestResponse(r)
+	}
+	c.JSON(http.StatusOK, gin.H{"scheduled": out})
+}
+
+func CancelScheduledRequest(c *gin.Context) { // Handler withdrawing one of the caller's pending one-time runs
+	db := database.DB.WithContext(c.Request.Context())
+	var r models.ScheduledRequest
+	if err := db.Where("id = ? AND user_id = ?", c.Param("id"), c.MustGet("userID")).Limit(1).Find(&r).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not cancel scheduled run"})
+		return
+	}
+	if r.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "scheduled run not found"})
+		return
+	}
+	res := db.Model(&r).Where("status = ?", models.ScheduledPending).Update("status", models.ScheduledCancelled)
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not cancel scheduled run"})
+		return
+	}
+	if res.RowsAffected == 0 { // Already queued, skipped or cancelled
+		c.JSON(http.StatusConflict, gin.H{"error": "scheduled run is no longer pending", "status": r.Status})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "scheduled run cancelled"})
+}
+
+// RunSchedules queues every enabled schedule whose next occurrence has arrived and every
+// one-time request whose start time has, through the same quota, shutdown and capacity
+// checks as POST /api/motor, and records the outcome. Runs more than scheduleGrace late are
+// recorded as skipped; several missed occurrences of a schedule collapse into one record.
+// During a maintenance window nothing is checked, so runs due in it are queued once it ends.
+// It is the "run-schedules" job and should run every minute on one replica.
+func RunSchedules(ctx context.Context) error {
+	now := time.Now()
+	if w, err := activeMaintenance(ctx, now); err != nil {
+		return err
+	} else if w != nil {
+		slog.Debug("scheduled runs deferred for maintenance", "until", w.EndsAt)
+		return nil
+	}
+	db := database.DB.WithContext(ctx)
+	var schedules []models.Schedule
+	if err := db.Where("enabled = ?", true).Find(&schedules).Error; err != nil {
+		return err
+	}
+	for _, s := range schedules {
+		sched, err := scheduleOf(s)
+		if err != nil {
+			slog.Error("schedule has an invalid cron expression or time zone", "schedule_id", s.ID, "cron", s.Cron, "error", err)
+			continue
+		}
+		next := sched.Next(s.CheckedAt)
+		if next.After(now) {
+			continue
+		}
+		run := models.ScheduleRun{ScheduleID: s.ID, At: next}
+		switch {
+		case s.SkipAt != nil && next.Equal(*s.SkipAt): // Recorded when the user skipped it
+			run.Status, run.Reason = models.ScheduleRunSkipped, "skipped by user"
+		case s.PausedUntil != nil && next.Before(*s.PausedUntil):
+			run.Status, run.Reason = models.ScheduleRunSkipped, "paused until "+s.PausedUntil.Format(time.RFC3339)
+			err = db.Create(&run).Error
+		default:
+			if reason := rainSkip(ctx, s, next, now); reason != "" {
+				run.Status, run.Reason = models.ScheduleRunSkipped, reason
+			} else {
+				run.Status, run.Reason = queueScheduled(ctx, s.UserID, s.Duration, next, now)
+			}
+			err = db.Create(&run).Error
+		}
+		if err != nil {
+			return err
+		}
+		if err := db.Model(&s).UpdateColumn("checked_at", now).Error; err != nil {
+			return err
+		}
+		slog.Info("scheduled motor run", "schedule_id", s.ID, "user_id", s.UserID, "status", run.Status, "reason", run.Reason)
+	}
+
+	var requests []models.ScheduledRequest
+	if err := db.Where("status = ? AND start_at <= ?", models.ScheduledPending, now).Order("start_at").Find(&requests).Error; err != nil {
+		return err
+	}
+	for _, r := range requests {
+		claim := db.Model(&r).Where("status = ?", models.ScheduledPending).Update("status", models.ScheduleRunQueued) // Loses to a concurrent cancel
+		if claim.Error != nil {
+			return claim.Error
+		}
+		if claim.RowsAffected == 0 {
+			continue
+		}
+		status, reason := queueScheduled(ctx, r.UserID, r.Duration, r.StartAt, now)
+		if status != models.ScheduleRunQueued {
+			if err := db.Model(&r).Updates(map[string]any{"status": status, "reason": reason}).Error; err != nil {
+				return err
+			}
+		}
+		slog.Info("one-time motor run", "request_id", r.ID, "user_id", r.UserID, "status", status, "reason", reason)
+	}
+	return nil
+}
+
+// queueScheduled enqueues a run due at at, or explains why it was skipped. A run that fell
+// in a maintenance window is due when the window ends.
+func queueScheduled(ctx context.Context, userID uint, duration time.Duration, at, now time.Time) (status, reason string) {
+	w, err := activeMaintenance(ctx, now)
+	if err != nil {
+		return models.ScheduleRunSkipped, err.Error()
+	}
+	if w != nil {
+		return models.ScheduleRunSkipped, maintenanceMessage(w)
+	}
+	due := at
+	if w, err := activeMaintenance(ctx, at); err == nil && w != nil {
+		due = w.EndsAt
+	}
+	if late := now.Sub(due); late > scheduleGrace {
+		return models.ScheduleRunSkipped, fmt.Sprintf("missed: picked up %s late", late.Round(time.Minute))
+	}
+	if reason, err := quotaRejection(ctx, userID, duration); err != nil {
+		return models.ScheduleRunSkipped, err.Error()
+	} else if reason != "" {
+		return models.ScheduleRunSkipped, reason
+	}
+	if err := motorService.Enqueue(ctx, userID, duration); err != nil {
+		return models.ScheduleRunSkipped, err.Error()
+	}
+	return models.ScheduleRunQueued, ""
+}
+
+type upcomingRun struct { // One future occurrence of a schedule
+	At       time.Time
+	Schedule models.Schedule
+}
+
+// upcomingRuns expands schedules into their occurrences in [from, to), oldest first, up to
+// max in total.
+func upcomingRuns(schedules []models.Schedule, from, to time.Time, max int) []upcomingRun {
+	var runs []upcomingRun
+	for _, s := range schedules {
+		sched, err := scheduleOf(s)
+		if err != nil || !s.Enabled {
+			continue
+		}
+		for at, n := sched.Next(from.Add(-time.Second)), 0; at.Before(to) && n < max; at, n = sched.Next(at), n+1 {
+			if !skipped(s, at) {
+				runs = append(runs, upcomingRun{At: at, Schedule: s})
+			}
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].At.Before(runs[j].At) })
+	if len(runs) > max {
+		runs = runs[:max]
+	}
+	return runs
+}
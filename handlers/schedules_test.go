@@ -0,0 +1,474 @@
+// schedules_test.go - Tests for recurring motor schedules
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"context"                  // For the job context
+	"encoding/json"            // Response bodies
+	"errors"                   // Forecast failures
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Schedule models
+	"go-mqtt-backend/services" // Motor service
+	"go-mqtt-backend/store"    // In-memory backends
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"strconv"                  // Schedule IDs in paths
+	"testing"                  // Go's testing package
+	"time"                     // For durations
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// useTestMotor installs a motor service on in-memory backends with a one-hour quota
+func useTestMotor(queueSize int) *services.MotorService {
+	svc := services.NewMotorService(services.MotorDeps{
+		Queue:     store.NewMemoryQueue(queueSize),
+		State:     store.NewMemoryState(),
+		Publisher: services.PublisherFunc(func(string, interface{}) error { return nil }),
+		Repo:      services.NewGormMotorRepository(database.DB),
+		Quota:     time.Hour,
+	})
+	UseMotorService(svc)
+	return svc
+}
+
+// TestScheduleAPI checks validation, ownership and the next run in responses
+func TestScheduleAPI(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	r := gin.New()
+	var caller uint = 1
+	setUser := func(c *gin.Context) { c.Set("userID", caller); c.Set("orgID", database.DefaultOrgID) }
+	r.GET("/api/schedules", setUser, ListSchedules)
+	r.POST("/api/schedules", setUser, CreateSchedule)
+	r.PUT("/api/schedules/:id", setUser, UpdateSchedule)
+	r.DELETE("/api/schedules/:id", setUser, DeleteSchedule)
+	r.GET("/api/schedules/:id/runs", setUser, ListScheduleRuns)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	code, _ := call("POST", "/api/schedules", `{"cron":"not cron","duration":20}`)
+	assert.Equal(t, 400, code)
+	code, _ = call("POST", "/api/schedules", `{"cron":"0 6 * * *","duration":90}`) // Over the quota
+	assert.Equal(t, 400, code)
+	code, _ = call("POST", "/api/schedules", `{"cron":"0 6 * * *","duration":20,"skip_if_rain_above":50}`) // No forecasts
+	assert.Equal(t, 400, code)
+	code, out := call("POST", "/api/schedules", `{"name":"Morning","cron":"0 6 * * *","duration":20}`)
+	require.Equal(t, 201, code)
+	assert.Equal(t, true, out["enabled"])
+	next, err := time.Parse(time.RFC3339, out["next_run"].(string))
+	require.NoError(t, err)
+	assert.Equal(t, 6, next.Hour())
+	path := "/api/schedules/" + strconv.Itoa(int(out["id"].(float64)))
+	assert.Equal(t, "UTC", out["timezone"]) // No profile time zone
+
+	require.NoError(t, database.DB.Create(&models.User{ID: 1, Email: "tz@example.com", Password: "x", Timezone: "Asia/Karachi"}).Error)
+	code, out = call("POST", "/api/schedules", `{"cron":"0 6 * * *","duration":20}`)
+	require.Equal(t, 201, code)
+	assert.Equal(t, "Asia/Karachi", out["timezone"]) // Profile default
+	next, err = time.Parse(time.RFC3339, out["next_run"].(string))
+	require.NoError(t, err)
+	assert.Equal(t, 1, next.UTC().Hour()) // 06:00 PKT
+	code, out = call("POST", "/api/schedules", `{"cron":"0 6 * * *","timezone":"America/New_York","duration":20}`)
+	require.Equal(t, 201, code)
+	assert.Equal(t, "America/New_York", out["timezone"])
+	code, _ = call("POST", "/api/schedules", `{"cron":"0 6 * * *","timezone":"Nowhere/Land","duration":20}`)
+	assert.Equal(t, 400, code)
+
+	caller = 2 // Someone else's schedule is invisible
+	code, _ = call("PUT", path, `{"cron":"0 7 * * *","duration":20}`)
+	assert.Equal(t, 404, code)
+	code, out = call("GET", "/api/schedules", "")
+	assert.Equal(t, 200, code)
+	assert.Empty(t, out["schedules"])
+
+	caller = 1
+	code, out = call("PUT", path, `{"cron":"30 7 * * *","duration":15,"enabled":false}`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, false, out["enabled"])
+	assert.Nil(t, out["next_run"])
+	code, out = call("GET", path+"/runs", "")
+	assert.Equal(t, 200, code)
+	assert.Empty(t, out["runs"])
+	code, _ = call("DELETE", path, "")
+	assert.Equal(t, 200, code)
+	code, _ = call("GET", path+"/runs", "")
+	assert.Equal(t, 404, code)
+}
+
+// TestRunSchedules checks that due schedules are queued and late or refused ones recorded as skipped
+func TestRunSchedules(t *testing.T) {
+	setupTestDB()
+	svc := useTestMotor(2)
+	now := time.Now()
+	due := models.Schedule{UserID: 1, Cron: "* * * * *", Duration: 40 * time.Minute, Enabled: true, CheckedAt: now.Add(-90 * time.Second)}
+	crowded := models.Schedule{UserID: 2, Cron: "* * * * *", Duration: 30 * time.Minute, Enabled: true, CheckedAt: now.Add(-90 * time.Second)}
+	missed := models.Schedule{UserID: 1, Cron: "* * * * *", Duration: 5 * time.Minute, Enabled: true, CheckedAt: now.Add(-time.Hour)}
+	paused := models.Schedule{UserID: 1, Cron: "* * * * *", Duration: 5 * time.Minute, Enabled: false, CheckedAt: now.Add(-90 * time.Second)}
+	for _, s := range []*models.Schedule{&due, &crowded, &missed, &paused} {
+		require.NoError(t, database.DB.Create(s).Error)
+	}
+
+	require.NoError(t, svc.Enqueue(context.Background(), 3, 5*time.Minute)) // Leaves room in the queue for one run
+	require.NoError(t, RunSchedules(context.Background()))
+
+	runsOf := func(s models.Schedule) []models.ScheduleRun {
+		var runs []models.ScheduleRun
+		database.DB.Where("schedule_id = ?", s.ID).Find(&runs)
+		return runs
+	}
+	require.Len(t, runsOf(due), 1)
+	assert.Equal(t, models.ScheduleRunQueued, runsOf(due)[0].Status)
+	require.Len(t, runsOf(crowded), 1)
+	assert.Equal(t, models.ScheduleRunSkipped, runsOf(crowded)[0].Status)
+	assert.Equal(t, store.ErrQueueFull.Error(), runsOf(crowded)[0].Reason)
+	require.Len(t, runsOf(missed), 1)
+	assert.Equal(t, models.ScheduleRunSkipped, runsOf(missed)[0].Status)
+	assert.Contains(t, runsOf(missed)[0].Reason, "missed")
+	assert.Empty(t, runsOf(paused))
+
+	st, err := svc.Status(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, st.QueueLength)
+
+	require.NoError(t, RunSchedules(context.Background())) // Nothing new is due within the same minute
+	assert.Len(t, runsOf(due), 1)
+}
+
+// TestScheduledRequests checks booking, listing, cancelling and queueing one-time runs
+func TestScheduledRequests(t *testing.T) {
+	setupTestDB()
+	svc := useTestMotor(5)
+	r := gin.New()
+	setUser := func(c *gin.Context) { c.Set("userID", uint(1)); c.Set("orgID", database.DefaultOrgID) }
+	r.POST("/api/motor/schedule", setUser, ScheduleMotorRequest)
+	r.GET("/api/motor/schedule", setUser, ListScheduledRequests)
+	r.DELETE("/api/motor/schedule/:id", setUser, CancelScheduledRequest)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	at := func(d time.Duration) string { return time.Now().Add(d).Format(time.RFC3339) }
+
+	code, _ := call("POST", "/api/motor/schedule", `{"start_at":"`+at(-time.Minute)+`","duration":10}`)
+	assert.Equal(t, 400, code) // In the past
+	code, _ = call("POST", "/api/motor/schedule", `{"start_at":"`+at(40*24*time.Hour)+`","duration":10}`)
+	assert.Equal(t, 400, code) // Too far ahead
+	code, _ = call("POST", "/api/motor/schedule", `{"start_at":"`+at(time.Hour)+`","duration":90}`)
+	assert.Equal(t, 400, code) // Over the quota
+	code, out := call("POST", "/api/motor/schedule", `{"start_at":"`+at(time.Hour)+`","duration":10}`)
+	require.Equal(t, 201, code)
+	assert.Equal(t, models.ScheduledPending, out["status"])
+	later := "/api/motor/schedule/" + strconv.Itoa(int(out["id"].(float64)))
+	code, out = call("POST", "/api/motor/schedule", `{"start_at":"`+at(2*time.Hour)+`","duration":15}`)
+	require.Equal(t, 201, code)
+	soon := uint(out["id"].(float64))
+
+	code, out = call("GET", "/api/motor/schedule", "")
+	assert.Equal(t, 200, code)
+	assert.Len(t, out["scheduled"], 2)
+	code, _ = call("DELETE", later, "")
+	assert.Equal(t, 200, code)
+	code, _ = call("DELETE", later, "")
+	assert.Equal(t, 409, code) // Already cancelled
+	code, _ = call("DELETE", "/api/motor/schedule/999", "")
+	assert.Equal(t, 404, code)
+
+	database.DB.Model(&models.ScheduledRequest{}).Where("1 = 1").Update("start_at", time.Now().Add(-time.Minute)) // Both due now
+	require.NoError(t, RunSchedules(context.Background()))
+	var run models.ScheduledRequest
+	database.DB.First(&run, soon)
+	assert.Equal(t, models.ScheduleRunQueued, run.Status)
+	st, err := svc.Status(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, st.QueueLength) // The cancelled one never runs
+	code, out = call("GET", "/api/motor/schedule", "")
+	assert.Equal(t, 200, code)
+	assert.Empty(t, out["scheduled"])
+}
+
+// TestScheduleConflicts checks that over-quota schedules are refused and overlaps reported
+func TestScheduleConflicts(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	r := gin.New()
+	var caller uint = 1
+	setUser := func(c *gin.Context) { c.Set("userID", caller); c.Set("orgID", database.DefaultOrgID) }
+	r.POST("/api/schedules", setUser, CreateSchedule)
+	r.PUT("/api/schedules/:id", setUser, UpdateSchedule)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	kinds := func(out map[string]any, key string) []string {
+		var kinds []string
+		list, _ := out[key].([]any)
+		for _, c := range list {
+			kinds = append(kinds, c.(map[string]any)["kind"].(string))
+		}
+		return kinds
+	}
+
+	code, out := call("POST", "/api/schedules", `{"name":"Morning","cron":"0 6 * * *","duration":40}`)
+	require.Equal(t, 201, code)
+	assert.Empty(t, out["warnings"])
+	first := out["id"].(float64)
+
+	code, out = call("POST", "/api/schedules", `{"cron":"0 18 * * *","duration":30}`) // 70 of 60 minutes
+	require.Equal(t, 409, code)
+	assert.Equal(t, []string{ConflictUserQuota, ConflictMotorQuota}, kinds(out, "conflicts"))
+	conflict := out["conflicts"].([]any)[0].(map[string]any)
+	assert.Equal(t, 70.0, conflict["projected_minutes"])
+	assert.Equal(t, 60.0, conflict["limit_minutes"])
+
+	code, out = call("POST", "/api/schedules", `{"cron":"20 6 * * *","duration":10}`)
+	require.Equal(t, 201, code)
+	assert.Equal(t, []string{ConflictOverlap}, kinds(out, "warnings"))
+	warning := out["warnings"].([]any)[0].(map[string]any)
+	assert.Equal(t, first, warning["schedule_id"])
+	assert.Equal(t, "Morning", warning["schedule_name"])
+
+	caller = 2 // Fits the caller's share but not the motor's
+	code, out = call("POST", "/api/schedules", `{"cron":"0 18 * * *","duration":15}`)
+	require.Equal(t, 409, code)
+	assert.Equal(t, []string{ConflictMotorQuota}, kinds(out, "conflicts"))
+	code, _ = call("POST", "/api/schedules", `{"cron":"0 18 * * *","duration":15,"enabled":false}`)
+	assert.Equal(t, 201, code) // Disabled schedules never run
+
+	caller = 1
+	code, out = call("PUT", "/api/schedules/"+strconv.Itoa(int(first)), `{"cron":"0 6 * * *","duration":25}`)
+	assert.Equal(t, 200, code) // Its old version isn't counted twice
+	assert.Equal(t, []string{ConflictOverlap}, kinds(out, "warnings"))
+}
+
+// TestPauseAndSkip checks pausing, skipping the next run and how RunSchedules treats both
+func TestPauseAndSkip(t *testing.T) {
+	setupTestDB()
+	svc := useTestMotor(5)
+	s := models.Schedule{UserID: 1, Cron: "0 6 * * *", Timezone: "UTC", Duration: 20 * time.Minute, Enabled: true, CheckedAt: time.Now()}
+	require.NoError(t, database.DB.Create(&s).Error)
+	r := gin.New()
+	setUser := func(c *gin.Context) { c.Set("userID", uint(1)); c.Set("orgID", database.DefaultOrgID) }
+	r.GET("/api/schedules/:id/runs", setUser, ListScheduleRuns)
+	r.POST("/api/schedules/:id/pause", setUser, PauseSchedule)
+	r.DELETE("/api/schedules/:id/pause", setUser, ResumeSchedule)
+	r.POST("/api/schedules/:id/skip", setUser, SkipNextRun)
+	r.DELETE("/api/schedules/:id/skip", setUser, UndoSkip)
+	call := func(method, path, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+	path := "/api/schedules/" + strconv.Itoa(int(s.ID))
+	next := scheduleResponse(s).NextRun.Format(time.RFC3339)
+
+	code, out := call("POST", path+"/skip", `{"reason":"it rained today"}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, next, out["skip_at"])
+	assert.NotEqual(t, next, out["next_run"]) // The day after
+	code, _ = call("POST", path+"/skip", "")
+	assert.Equal(t, 409, code)
+	code, out = call("GET", path+"/runs", "")
+	assert.Equal(t, 200, code)
+	require.Len(t, out["runs"], 1) // Visible straight away
+	run := out["runs"].([]any)[0].(map[string]any)
+	assert.Equal(t, models.ScheduleRunSkipped, run["status"])
+	assert.Equal(t, "skipped by user: it rained today", run["reason"])
+	code, out = call("DELETE", path+"/skip", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, next, out["next_run"])
+	code, _ = call("DELETE", path+"/skip", "")
+	assert.Equal(t, 404, code)
+	code, out = call("GET", path+"/runs", "")
+	assert.Empty(t, out["runs"])
+
+	code, _ = call("POST", path+"/pause", `{"until":"`+time.Now().Add(-time.Hour).Format(time.RFC3339)+`"}`)
+	assert.Equal(t, 400, code)
+	until := time.Now().Add(72 * time.Hour)
+	code, out = call("POST", path+"/pause", `{"until":"`+until.Format(time.RFC3339)+`"}`)
+	require.Equal(t, 200, code)
+	resumes, err := time.Parse(time.RFC3339, out["next_run"].(string))
+	require.NoError(t, err)
+	assert.False(t, resumes.Before(until.Truncate(time.Second)))
+	code, out = call("DELETE", path+"/pause", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, next, out["next_run"])
+	assert.Nil(t, out["paused_until"])
+
+	// Due occurrences: the paused one is recorded as skipped, the skipped one isn't recorded twice
+	checked := time.Now().Add(-90 * time.Second)
+	pausedUntil := time.Now().Add(time.Hour)
+	paused := models.Schedule{UserID: 1, Cron: "* * * * *", Duration: 5 * time.Minute, Enabled: true, CheckedAt: checked, PausedUntil: &pausedUntil}
+	skip := models.Schedule{UserID: 1, Cron: "* * * * *", Duration: 5 * time.Minute, Enabled: true, CheckedAt: checked}
+	sched, err := scheduleOf(skip)
+	require.NoError(t, err)
+	due := sched.Next(checked)
+	skip.SkipAt = &due
+	require.NoError(t, database.DB.Create(&paused).Error)
+	require.NoError(t, database.DB.Create(&skip).Error)
+	require.NoError(t, RunSchedules(context.Background()))
+	var runs []models.ScheduleRun
+	database.DB.Where("schedule_id = ?", paused.ID).Find(&runs)
+	require.Len(t, runs, 1)
+	assert.Contains(t, runs[0].Reason, "paused until")
+	var skips int64
+	database.DB.Model(&models.ScheduleRun{}).Where("schedule_id = ?", skip.ID).Count(&skips)
+	assert.Zero(t, skips)
+	st, err := svc.Status(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, st.QueueLength)
+}
+
+// TestListUpcomingRuns checks the calendar merges recurring and one-time runs in order
+func TestListUpcomingRuns(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	day := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, s := range []models.Schedule{
+		{UserID: 1, Name: "Morning", Cron: "0 6 * * *", Timezone: "UTC", Duration: 20 * time.Minute, Enabled: true},
+		{UserID: 1, Name: "Off", Cron: "0 7 * * *", Timezone: "UTC", Duration: 20 * time.Minute, Enabled: false},
+		{UserID: 2, Name: "Theirs", Cron: "0 8 * * *", Timezone: "UTC", Duration: 20 * time.Minute, Enabled: true},
+	} {
+		require.NoError(t, database.DB.Create(&s).Error)
+	}
+	oneTime := models.ScheduledRequest{UserID: 1, StartAt: day.Add(30 * time.Hour), Duration: 10 * time.Minute, Status: models.ScheduledPending}
+	require.NoError(t, database.DB.Create(&oneTime).Error)
+	r := gin.New()
+	r.GET("/api/schedules/upcoming", func(c *gin.Context) { c.Set("userID", uint(1)); c.Set("orgID", database.DefaultOrgID) }, ListUpcomingRuns)
+	get := func(query string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/schedules/upcoming?"+query, nil)
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	code, out := get("from=2030-01-01T00:00:00Z&to=2030-01-04T00:00:00Z")
+	require.Equal(t, 200, code)
+	runs := out["runs"].([]any)
+	var got []string
+	for _, run := range runs {
+		run := run.(map[string]any)
+		got = append(got, run["at"].(string)+" "+run["kind"].(string))
+	}
+	assert.Equal(t, []string{
+		"2030-01-01T06:00:00Z recurring",
+		"2030-01-02T06:00:00Z recurring",
+		"2030-01-02T06:00:00Z one_time",
+		"2030-01-03T06:00:00Z recurring",
+	}, got)
+	first := runs[0].(map[string]any)
+	assert.Equal(t, "Morning", first["name"])
+	assert.Equal(t, "2030-01-01T06:20:00Z", first["ends_at"])
+	assert.Equal(t, false, out["truncated"])
+
+	code, _ = get("from=yesterday")
+	assert.Equal(t, 400, code)
+	code, _ = get("from=2030-01-01T00:00:00Z&to=2030-06-01T00:00:00Z") // Too long
+	assert.Equal(t, 400, code)
+	code, out = get("")
+	assert.Equal(t, 200, code)
+	assert.Len(t, out["runs"], 7) // The next week of mornings
+}
+
+type fakeForecast struct { // Fixed rain chance, or an error
+	chance int
+	err    error
+}
+
+func (f fakeForecast) RainChance(ctx context.Context, from, to time.Time) (int, error) {
+	return f.chance, f.err
+}
+
+// TestRunSchedulesRainSkip checks that rain-sensitive schedules are skipped above their threshold
+func TestRunSchedulesRainSkip(t *testing.T) {
+	setupTestDB()
+	svc := useTestMotor(5)
+	defer UseWeather(nil, 12*time.Hour)
+	checked := time.Now().Add(-90 * time.Second)
+	wet := models.Schedule{UserID: 1, Cron: "* * * * *", Duration: 5 * time.Minute, Enabled: true, RainSkipPercent: 60, CheckedAt: checked}
+	hardy := models.Schedule{UserID: 1, Cron: "* * * * *", Duration: 5 * time.Minute, Enabled: true, RainSkipPercent: 80, CheckedAt: checked}
+	always := models.Schedule{UserID: 1, Cron: "* * * * *", Duration: 5 * time.Minute, Enabled: true, CheckedAt: checked}
+	for _, s := range []*models.Schedule{&wet, &hardy, &always} {
+		require.NoError(t, database.DB.Create(s).Error)
+	}
+
+	UseWeather(fakeForecast{chance: 70}, 12*time.Hour)
+	require.NoError(t, RunSchedules(context.Background()))
+	runOf := func(s models.Schedule) (run models.ScheduleRun) {
+		database.DB.Where("schedule_id = ?", s.ID).First(&run)
+		return run
+	}
+	assert.Equal(t, models.ScheduleRunSkipped, runOf(wet).Status)
+	assert.Equal(t, "rain forecast: 70% chance in the next 12 hours (skips above 60%)", runOf(wet).Reason)
+	assert.Equal(t, models.ScheduleRunQueued, runOf(hardy).Status)
+	assert.Equal(t, models.ScheduleRunQueued, runOf(always).Status)
+
+	database.DB.Model(&models.Schedule{}).Where("id = ?", wet.ID).Update("checked_at", checked)
+	UseWeather(fakeForecast{err: errors.New("API down")}, 12*time.Hour) // Runs anyway
+	require.NoError(t, RunSchedules(context.Background()))
+	var runs []models.ScheduleRun
+	database.DB.Where("schedule_id = ?", wet.ID).Order("id").Find(&runs)
+	require.Len(t, runs, 2)
+	assert.Equal(t, models.ScheduleRunQueued, runs[1].Status)
+	st, err := svc.Status(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, st.QueueLength)
+}
+
+// TestSolarSchedules checks that sunrise/sunset schedules need the site location
+func TestSolarSchedules(t *testing.T) {
+	setupTestDB()
+	useTestMotor(5)
+	r := gin.New()
+	r.POST("/api/schedules", func(c *gin.Context) { c.Set("userID", uint(1)); c.Set("orgID", database.DefaultOrgID) }, CreateSchedule)
+	create := func(body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/schedules", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	appConfig.SiteLocation = ""
+	code, out := create(`{"name":"Evening","cron":"@sunset-30m","duration":20}`)
+	assert.Equal(t, 400, code)
+	assert.Contains(t, out["error"], "SITE_LOCATION")
+
+	appConfig.SiteLocation = "31.5204,74.3587"
+	code, out = create(`{"name":"Evening","cron":"@sunset-30m","duration":20}`)
+	require.Equal(t, 201, code)
+	next, err := time.Parse(time.RFC3339, out["next_run"].(string))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(12*time.Hour), next, 12*time.Hour) // Within a day
+	code, _ = create(`{"cron":"@sunset-20h","duration":20}`)
+	assert.Equal(t, 400, code)
+}
@@ -0,0 +1,194 @@
+// settings.go - Quota limits admins change at runtime
+//
+// MOTOR_QUOTA_MINUTES, QUEUE_CAPACITY and MAX_RUN_SECONDS set the motor quota, how many
+// requests may wait at once and the longest run one request may ask for. Admins can
+// replace each with PUT /admin/config/quota without a redeploy. What they set is kept in
+// the single settings row, so it survives restarts, and every replica applies it at
+// startup, on SIGHUP and every settingsPoll, so the replica running the queue follows a
+// change made through another one within that time.
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For lookups
+	"fmt"                      // Audit details
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Settings model
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"strings"                  // Audit details
+	"sync"                     // Guards the environment's limits
+	"time"                     // Durations
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+var settingsPoll = time.Minute // How often WatchSettings applies the saved settings again
+
+type Limits struct { // Quota limits from the environment, until an admin sets others
+	MotorQuota    time.Duration // Max motor-on time per 24h
+	QueueCapacity int           // Max queued requests
+	MaxDuration   time.Duration // Longest run one request may ask for (0: no limit but the quota)
+}
+
+var (
+	envLimits Limits     // Set by UseLimits
+	limitsMu  sync.Mutex // Guards envLimits, so limits are applied one at a time
+)
+
+type QuotaConfigInput struct { // Struct for changing the quota limits; a field left out is kept, 0 goes back to the environment's value
+	DailyQuota    *int `json:"daily_quota" binding:"omitempty,min=0,max=1440"`  // Minutes per 24h
+	QueueCapacity *int `json:"queue_capacity" binding:"omitempty,min=0"`        // Requests that may wait at once
+	MaxDuration   *int `json:"max_duration" binding:"omitempty,min=0,max=1440"` // Minutes one request may ask for
+}
+
+type QuotaConfigResponse struct { // The quota limits in effect, as returned by the API
+	DailyQuota    int        `json:"daily_quota"` // Minutes per 24h
+	QueueCapacity int        `json:"queue_capacity"`
+	MaxDuration   int        `json:"max_duration"` // Minutes (0: no limit but the quota)
+	Overridden    []string   `json:"overridden"`   // Fields set by an admin rather than the environment
+	UpdatedBy     uint       `json:"updated_by,omitempty"`
+	UpdatedAt     *time.Time `json:"updated_at,omitempty"`
+}
+
+// UseLimits records the limits the environment sets and applies them, with the ones an
+// admin saved in their place. Call it after UseMotorService, and again on config reload.
+func UseLimits(ctx context.Context, l Limits) error {
+	limitsMu.Lock()
+	envLimits = l
+	limitsMu.Unlock()
+	_, err := applyLimits(ctx)
+	return err
+}
+
+// applyLimits hands the limits in effect to the motor service and returns the saved
+// settings (ID 0 if none).
+func applyLimits(ctx context.Context) (models.Settings, error) {
+	var row models.Settings
+	if err := database.DB.WithContext(ctx).Limit(1).Find(&row, 1).Error; err != nil { // Missing row is not an error
+		return row, err
+	}
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	l := effectiveLimits(row)
+	motorService.SetQuota(l.MotorQuota)
+	motorService.SetQueueCapacity(l.QueueCapacity)
+	motorService.SetMaxDuration(l.MaxDuration)
+	return row, nil
+}
+
+func effectiveLimits(row models.Settings) Limits { // The environment's limits with row's in their place; caller holds limitsMu
+	l := envLimits
+	if row.MotorQuota > 0 {
+		l.MotorQuota = row.MotorQuota
+	}
+	if row.QueueCapacity > 0 {
+		l.QueueCapacity = row.QueueCapacity
+	}
+	if row.MaxDuration > 0 {
+		l.MaxDuration = row.MaxDuration
+	}
+	return l
+}
+
+// WatchSettings applies the saved settings every settingsPoll, for changes made through
+// other replicas. Run it as a supervised task.
+func WatchSettings(ctx context.Context, beat func()) error {
+	ticker := time.NewTicker(settingsPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			beat()
+			if _, err := applyLimits(ctx); err != nil {
+				slog.Error("apply saved settings failed", "error", err) // Keep the limits in effect
+			}
+		}
+	}
+}
+
+func quotaConfigResponse(row models.Settings) QuotaConfigResponse {
+	limitsMu.Lock()
+	l := effectiveLimits(row)
+	limitsMu.Unlock()
+	resp := QuotaConfigResponse{DailyQuota: int(l.MotorQuota.Minutes()), QueueCapacity: l.QueueCapacity, MaxDuration: int(l.MaxDuration.Minutes()), Overridden: []string{}}
+	if row.MotorQuota > 0 {
+		resp.Overridden = append(resp.Overridden, "daily_quota")
+	}
+	if row.QueueCapacity > 0 {
+		resp.Overridden = append(resp.Overridden, "queue_capacity")
+	}
+	if row.MaxDuration > 0 {
+		resp.Overridden = append(resp.Overridden, "max_duration")
+	}
+	if row.ID != 0 {
+		resp.UpdatedBy, resp.UpdatedAt = row.UpdatedBy, &row.UpdatedAt
+	}
+	return resp
+}
+
+// GetQuotaConfig returns the motor quota, queue capacity and per-request limit in effect
+// and which of them an admin set.
+func GetQuotaConfig(c *gin.Context) {
+	row, err := applyLimits(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load settings"})
+		return
+	}
+	c.JSON(http.StatusOK, quotaConfigResponse(row))
+}
+
+// SetQuotaConfig changes the motor quota, queue capacity or per-request limit, saves them
+// and applies them at once. It is recorded in the audit log.
+func SetQuotaConfig(c *gin.Context) {
+	var input QuotaConfigInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	db := database.DB.WithContext(ctx)
+	var row models.Settings
+	if err := db.Limit(1).Find(&row, 1).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load settings"})
+		return
+	}
+	var changes []string
+	change := func(name string, v int, unit string) { // Audit detail of one field
+		if v == 0 {
+			changes = append(changes, name+" back to the environment's")
+		} else {
+			changes = append(changes, fmt.Sprintf("%s %d%s", name, v, unit))
+		}
+	}
+	if input.DailyQuota != nil {
+		row.MotorQuota = time.Duration(*input.DailyQuota) * time.Minute
+		change("daily quota", *input.DailyQuota, " min")
+	}
+	if input.QueueCapacity != nil {
+		row.QueueCapacity = *input.QueueCapacity
+		change("queue capacity", *input.QueueCapacity, "")
+	}
+	if input.MaxDuration != nil {
+		row.MaxDuration = time.Duration(*input.MaxDuration) * time.Minute
+		change("max duration", *input.MaxDuration, " min")
+	}
+	if len(changes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "give daily_quota, queue_capacity or max_duration"})
+		return
+	}
+	row.ID, row.UpdatedBy, row.UpdatedAt = 1, c.MustGet("userID").(uint), time.Now()
+	if err := db.Save(&row).Error; err != nil { // Upsert the single row
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save settings"})
+		return
+	}
+	row, err := applyLimits(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not apply settings"})
+		return
+	}
+	recordAudit(ctx, row.UpdatedBy, "quota_config", strings.Join(changes, ", "))
+	c.JSON(http.StatusOK, quotaConfigResponse(row))
+}
@@ -0,0 +1,116 @@
+// settings_test.go - Tests for the quota limits admins change at runtime
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"bytes"                    // Request bodies
+	"context"                  // For the service
+	"encoding/json"            // Response bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Audit model
+	"go-mqtt-backend/services" // Motor errors
+	"net/http"                 // HTTP methods
+	"net/http/httptest"        // HTTP test utilities
+	"testing"                  // Go's testing package
+	"time"                     // Limits
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestQuotaConfig checks that admins can change the quota, the queue capacity and the
+// per-request limit, that their values outlast a config reload and that 0 goes back to the
+// environment's
+func TestQuotaConfig(t *testing.T) {
+	setupTestDB()
+	svc := useTestMotor(5)
+	ctx := context.Background()
+	require.NoError(t, UseLimits(ctx, Limits{MotorQuota: time.Hour, QueueCapacity: 5}))
+
+	r := gin.New()
+	setAdmin := func(c *gin.Context) { c.Set("userID", uint(1)) }
+	r.GET("/admin/config/quota", setAdmin, GetQuotaConfig)
+	r.PUT("/admin/config/quota", setAdmin, SetQuotaConfig)
+	r.POST("/api/motor", setAdmin, EnqueueMotorRequest)
+	call := func(method, body string) (int, map[string]any) {
+		return callPath(r, method, "/admin/config/quota", body)
+	}
+	enqueue := func(body string) (int, map[string]any) {
+		return callPath(r, "POST", "/api/motor", body)
+	}
+
+	code, out := call("GET", "")
+	require.Equal(t, 200, code)
+	assert.Equal(t, 60.0, out["daily_quota"])
+	assert.Equal(t, 5.0, out["queue_capacity"])
+	assert.Equal(t, 0.0, out["max_duration"])
+	assert.Empty(t, out["overridden"])
+
+	code, _ = call("PUT", `{}`)
+	assert.Equal(t, 400, code) // Nothing to change
+	code, _ = call("PUT", `{"daily_quota":2000}`)
+	assert.Equal(t, 400, code) // More than a day
+
+	code, out = call("PUT", `{"daily_quota":90,"max_duration":30}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, 90.0, out["daily_quota"])
+	assert.Equal(t, []any{"daily_quota", "max_duration"}, out["overridden"])
+	assert.Equal(t, 90*time.Minute, svc.Quota())
+	assert.ErrorIs(t, svc.Enqueue(ctx, 1, 40*time.Minute), services.ErrTooLong)
+	require.NoError(t, svc.Enqueue(ctx, 1, 30*time.Minute))
+	code, out = enqueue(`{"duration":100}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code) // Not 429: over the limit before the quota
+	assert.Equal(t, 30.0, out["max_duration"])
+	assert.Equal(t, 1800.0, out["max_seconds"])
+
+	st, err := svc.Status(ctx)
+	require.NoError(t, err)
+	code, _ = enqueue(`{"duration":-30}`)
+	assert.Equal(t, http.StatusBadRequest, code) // Would give quota back
+	after, err := svc.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, st.Used, after.Used)
+
+	svc.SetMaxDuration(90 * time.Second) // Not whole minutes, as MAX_RUN_SECONDS=90
+	code, out = enqueue(`{"duration":2}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.Equal(t, "duration is over the 90 s limit per request, at most 1 min", out["error"])
+	assert.Equal(t, 1.0, out["max_duration"])
+	assert.Equal(t, 90.0, out["max_seconds"])
+	svc.SetMaxDuration(30 * time.Minute)
+
+	code, _ = call("PUT", `{"queue_capacity":1}`)
+	require.Equal(t, 200, code)
+	st, err = svc.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, st.QueueCapacity)
+
+	require.NoError(t, UseLimits(ctx, Limits{MotorQuota: 2 * time.Hour, QueueCapacity: 5, MaxDuration: 10 * time.Minute})) // A config reload
+	assert.Equal(t, 90*time.Minute, svc.Quota())
+	assert.Equal(t, 30*time.Minute, svc.MaxDuration())
+
+	code, out = call("PUT", `{"daily_quota":0,"queue_capacity":0}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, 120.0, out["daily_quota"])
+	assert.Equal(t, 5.0, out["queue_capacity"])
+	assert.Equal(t, []any{"max_duration"}, out["overridden"])
+	assert.Equal(t, 2*time.Hour, svc.Quota())
+
+	var entries []models.AuditLog
+	database.DB.Where("action = ?", "quota_config").Order("id").Find(&entries)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "daily quota 90 min, max duration 30 min", entries[0].Detail)
+	assert.Equal(t, "daily quota back to the environment's, queue capacity back to the environment's", entries[2].Detail)
+}
+
+func callPath(r *gin.Engine, method, path, body string) (int, map[string]any) { // Serves a JSON request and decodes the reply
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	var out map[string]any
+	json.Unmarshal(w.Body.Bytes(), &out)
+	return w.Code, out
+}
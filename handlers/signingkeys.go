@@ -0,0 +1,43 @@
+// signingkeys.go - Admin rotation of the JWT signing secret
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"errors"                     // For checking empty bodies
+	"fmt"                        // Audit details
+	"go-mqtt-backend/middleware" // Signing keys
+	"io"                         // Empty bodies
+	"log/slog"                   // Leveled logging
+	"net/http"                   // HTTP status codes
+	"time"                       // Grace periods
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+type RotateSigningKeyInput struct { // Struct for rotating the JWT secret
+	GraceHours *int `json:"grace_hours" binding:"omitempty,min=0"` // How long tokens signed before stay valid (default JWT_ROTATION_GRACE_HOURS; 0 ends them at once)
+}
+
+// RotateSigningKey generates a new JWT signing secret. Tokens signed with the previous
+// one stay valid for the grace period, so users are logged out gradually as their tokens
+// expire rather than all at once; a grace of 0 ends every session, e.g. after a leak.
+// The new secret is never returned.
+func RotateSigningKey(c *gin.Context) {
+	var input RotateSigningKeyInput
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) { // The body is optional
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	grace := appConfig.JWTGrace
+	if input.GraceHours != nil {
+		grace = time.Duration(*input.GraceHours) * time.Hour
+	}
+	key, retires, err := middleware.RotateSigningKey(c.Request.Context(), grace)
+	if err != nil {
+		slog.Error("JWT secret rotation failed", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not rotate the signing secret"})
+		return
+	}
+	recordAudit(c.Request.Context(), c.MustGet("userID").(uint), "jwt_rotate", fmt.Sprintf("signing key %d; previous keys accepted until %s", key.ID, retires.UTC().Format(time.RFC3339)))
+	c.JSON(http.StatusOK, gin.H{"message": "signing secret rotated", "kid": fmt.Sprint(key.ID), "previous_valid_until": retires})
+}
@@ -0,0 +1,81 @@
+// stream.go - Downloads written a batch at a time
+//
+// Exports and CSV dumps can run to millions of rows: more than the Pi should hold in memory,
+// and more than fits in a request timeout. They are streamed instead. Each batch is a short
+// query of its own, written out and flushed before the next one is read, so memory stays at
+// one batch, no read connection is held while a slow client catches up, and the deadlines
+// are pushed back as long as the client keeps reading.
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // Batch deadlines
+	"encoding/csv"             // CSV downloads
+	"go-mqtt-backend/database" // Database connection
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"time"                     // Deadlines
+
+	"github.com/gin-gonic/gin" // Gin web framework
+	"gorm.io/gorm"             // Batch queries
+)
+
+const (
+	streamBatch     = 1000             // Rows read per query
+	streamBatchWait = 30 * time.Second // Longest reading and sending one batch may take
+)
+
+type stream struct { // A download in progress
+	c   *gin.Context
+	ctx context.Context // The request's, without its deadline: a download may outlast the request timeout
+	rc  *http.ResponseController
+}
+
+func newStream(c *gin.Context, filename, contentType string) *stream { // Starts a download of filename
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Header("Content-Type", contentType)
+	return &stream{c, context.WithoutCancel(c.Request.Context()), http.NewResponseController(c.Writer)}
+}
+
+// batch returns the DB to read the next batch with and gives the client streamBatchWait
+// more to receive it. Call cancel once the batch is read.
+func (s *stream) batch() (db *gorm.DB, cancel context.CancelFunc) {
+	s.rc.SetWriteDeadline(time.Now().Add(streamBatchWait)) // Not every writer supports it (tests); then the server's timeout stands
+	ctx, cancel := context.WithTimeout(s.ctx, streamBatchWait)
+	return database.DB.WithContext(ctx), cancel
+}
+
+func (s *stream) flush() error { return s.rc.Flush() } // Sends what has been written so far
+
+// fail ends the download after a read error: with a 500 if nothing has been sent yet,
+// otherwise by stopping, which leaves the client a truncated file.
+func (s *stream) fail(what string, err error, args ...any) {
+	slog.Error(what+" download failed", append(args, "error", err)...)
+	if !s.c.Writer.Written() {
+		s.c.Header("Content-Disposition", "")
+		s.c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load " + what})
+	}
+}
+
+// streamCSV sends filename, a CSV of header and the rows next reads, newest first. next
+// reads the batch after cursor (nil: from the newest) and returns it as cells with the
+// cursor of its last row; a batch shorter than streamBatch is the last one.
+func streamCSV(c *gin.Context, what, filename string, header []string, next func(db *gorm.DB, after *pageCursor) ([][]string, pageCursor, error)) {
+	s := newStream(c, filename, "text/csv")
+	w := csv.NewWriter(c.Writer)
+	w.Write(header)
+	var after *pageCursor
+	for {
+		db, cancel := s.batch()
+		rows, last, err := next(db, after)
+		cancel()
+		if err != nil {
+			s.fail(what, err)
+			return
+		}
+		if w.WriteAll(rows) != nil || s.flush() != nil || len(rows) < streamBatch {
+			return // Done, or the client went away
+		}
+		after = &last
+	}
+}
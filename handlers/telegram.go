@@ -0,0 +1,204 @@
+// telegram.go - Telegram account linking and bot commands
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"crypto/rand"              // Link codes
+	"encoding/base32"          // Link code alphabet
+	"errors"                   // For checking service errors
+	"fmt"                      // Reply text
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User and link models
+	"go-mqtt-backend/notify"   // Telegram bot
+	"go-mqtt-backend/services" // Motor service errors
+	"go-mqtt-backend/store"    // Queue errors
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"slices"                   // Category lookup
+	"strconv"                  // Bare minute counts
+	"strings"                  // Command parsing
+	"time"                     // Code expiry, durations
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+const telegramLinkTTL = 10 * time.Minute // How long a link code stays valid
+
+var telegram *notify.TelegramBot // Telegram bot (nil when no token is configured)
+
+func UseTelegram(b *notify.TelegramBot) { // Enables Telegram account linking (notifications go through UseNotifier)
+	telegram = b
+}
+
+func LinkTelegram(c *gin.Context) { // Handler issuing a one-time code to link the caller's Telegram chat
+	if telegram == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "telegram is not enabled"})
+		return
+	}
+	buf := make([]byte, 5)
+	if _, err := rand.Read(buf); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create link code"})
+		return
+	}
+	link := models.TelegramLink{
+		Code:      base32.StdEncoding.EncodeToString(buf), // 8 characters, no padding
+		UserID:    c.MustGet("userID").(uint),
+		ExpiresAt: time.Now().Add(telegramLinkTTL),
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	db.Where("user_id = ? OR expires_at < ?", link.UserID, time.Now()).Delete(&models.TelegramLink{}) // One live code per user
+	if err := db.Create(&link).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create link code"})
+		return
+	}
+	resp := gin.H{"code": link.Code, "expires_at": link.ExpiresAt, "instructions": "send /start " + link.Code + " to the bot"}
+	if appConfig != nil && appConfig.TelegramBotUsername != "" {
+		resp["url"] = "https://t.me/" + appConfig.TelegramBotUsername + "?start=" + link.Code // Opens the bot with the code filled in
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func UnlinkTelegram(c *gin.Context) { // Handler removing the caller's linked Telegram chat
+	err := database.DB.WithContext(c.Request.Context()).Model(&models.User{}).Where("id = ?", c.MustGet("userID")).Update("telegram_chat_id", 0).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not unlink telegram"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "telegram unlinked"})
+}
+
+const telegramHelp = "Commands:\n/status - queue, quota and motor state\n/motor 10m - queue a motor run\n/stop [category] [notes] - emergency shutdown (admins)\n/unlink - stop using this chat"
+
+// TelegramCommand answers a message sent to the bot. Commands other than /start and /help
+// need a linked account and go through the same MotorService checks as the REST API.
+func TelegramCommand(ctx context.Context, chatID int64, text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return ""
+	}
+	cmd, _, _ := strings.Cut(fields[0], "@") // "/status@MyBot" in group chats
+	args := fields[1:]
+
+	if cmd == "/start" || cmd == "/link" {
+		if len(args) == 0 {
+			return "Hi! Link this chat from the app (POST /api/me/telegram), then send /start <code>."
+		}
+		return linkTelegramChat(ctx, chatID, strings.ToUpper(args[0]))
+	}
+	if cmd == "/help" {
+		return telegramHelp
+	}
+
+	var user models.User
+	if err := database.DB.WithContext(ctx).Where("telegram_chat_id = ?", chatID).First(&user).Error; err != nil {
+		return "This chat isn't linked to an account. Get a code from the app and send /start <code>."
+	}
+	switch cmd {
+	case "/status":
+		return telegramStatus(ctx, user)
+	case "/motor":
+		if len(args) == 0 {
+			return "Usage: /motor 10m"
+		}
+		return telegramMotor(ctx, user, args[0])
+	case "/stop":
+		if user.Role != models.RoleAdmin {
+			return "Only admins can stop the motor."
+		}
+		sd := store.Shutdown{Active: true, Category: services.ShutdownSafety, Reason: "stopped from Telegram"} // An emergency unless said otherwise
+		if len(args) > 0 && slices.Contains(services.ShutdownCategories, strings.ToLower(args[0])) {
+			sd.Category, args = strings.ToLower(args[0]), args[1:]
+		}
+		if len(args) > 0 {
+			sd.Reason = strings.Join(args, " ")
+		}
+		dropped, err := motorService.ForceShutdown(ctx, sd.Category, sd.Reason, time.Time{})
+		if err != nil {
+			slog.Error("telegram shutdown failed", "user_id", user.ID, "error", err)
+			return "Shutdown failed, try the admin API."
+		}
+		slog.Warn("emergency shutdown from telegram", "user_id", user.ID, "category", sd.Category, "reason", sd.Reason, "dropped", dropped)
+		recordAuditEntry(ctx, models.AuditLog{UserID: user.ID, Action: "shutdown", Category: sd.Category, Detail: sd.Reason + " (from Telegram)"})
+		notifyShutdown(ctx, sd, user.Email, dropped)
+		return fmt.Sprintf("System shut down. %d queued requests dropped.", dropped)
+	case "/unlink":
+		database.DB.WithContext(ctx).Model(&user).Update("telegram_chat_id", 0)
+		return "Chat unlinked. You won't get notifications here any more."
+	default:
+		return telegramHelp
+	}
+}
+
+func linkTelegramChat(ctx context.Context, chatID int64, code string) string { // Redeems a link code for this chat
+	db := database.DB.WithContext(ctx)
+	var link models.TelegramLink
+	if err := db.Where("code = ? AND expires_at > ?", code, time.Now()).First(&link).Error; err != nil {
+		return "That code is invalid or expired. Request a new one from the app."
+	}
+	db.Delete(&link)                                                                             // Codes are single-use
+	db.Model(&models.User{}).Where("telegram_chat_id = ?", chatID).Update("telegram_chat_id", 0) // A chat belongs to one account
+	if err := db.Model(&models.User{}).Where("id = ?", link.UserID).Update("telegram_chat_id", chatID).Error; err != nil {
+		return "Linking failed, please try again."
+	}
+	return "Linked! You'll get motor notifications here.\n\n" + telegramHelp
+}
+
+func telegramStatus(ctx context.Context, user models.User) string { // Summary similar to GET /admin/status
+	st, err := motorService.Status(ctx)
+	if err != nil {
+		return "Status is unavailable right now."
+	}
+	var b strings.Builder
+	if st.Shutdown.Active {
+		fmt.Fprintf(&b, "System is SHUT DOWN: %s\n", st.Shutdown.Summary())
+		if !st.Shutdown.Until.IsZero() {
+			fmt.Fprintf(&b, "Restarts automatically at %s\n", st.Shutdown.Until.Format("15:04 Jan 2"))
+		}
+	}
+	switch {
+	case st.Current == nil:
+		b.WriteString("Motor: off\n")
+	case st.Current.Request.UserID == user.ID:
+		fmt.Fprintf(&b, "Motor: on for you, %d min left\n", int(time.Until(st.Current.StartedAt.Add(st.Current.Request.Duration)).Minutes()))
+	default:
+		b.WriteString("Motor: on for another user\n")
+	}
+	fmt.Fprintf(&b, "Queue: %d/%d\n", st.QueueLength, st.QueueCapacity)
+	fmt.Fprintf(&b, "Quota: %d of %d min used in the last 24h", int(st.Used.Minutes()), int(st.Quota.Minutes()))
+	if !st.ResetAt.IsZero() {
+		fmt.Fprintf(&b, ", time given back from %s", st.ResetAt.Format("15:04 Jan 2"))
+	}
+	return b.String()
+}
+
+func telegramMotor(ctx context.Context, user models.User, arg string) string { // Queues a run like POST /api/motor
+	if n, err := strconv.Atoi(arg); err == nil { // Bare number means minutes, as in the REST API
+		arg = strconv.Itoa(n) + "m"
+	}
+	d, err := time.ParseDuration(arg)
+	if err != nil || d < time.Minute {
+		return "Give a duration of at least one minute, e.g. /motor 10m or /motor 1h"
+	}
+	d = d.Truncate(time.Minute) // The REST API works in whole minutes
+	err = motorService.Enqueue(ctx, user.ID, d)
+	var shutdown *services.ShutdownError
+	var backlog *services.BackpressureError
+	switch {
+	case err == nil:
+		return fmt.Sprintf("Queued a %d min run. You'll get a message when it starts.", int(d.Minutes()))
+	case errors.As(err, &shutdown):
+		return "System is shut down: " + store.Shutdown{Category: shutdown.Category, Reason: shutdown.Reason}.Summary()
+	case errors.Is(err, services.ErrQuotaExceeded):
+		return "Daily motor-on quota reached. Try again once earlier runs are more than 24 hours old."
+	case errors.Is(err, services.ErrTooLong):
+		return fmt.Sprintf("A run can be at most %d min long.", int(motorService.MaxDuration().Minutes()))
+	case errors.As(err, &backlog):
+		return fmt.Sprintf("The motor queue is backed up: each user may queue %d runs per hour until it clears. Try again in %d min.", backlog.Limit, int(backlog.RetryAfter.Minutes()))
+	case errors.Is(err, store.ErrQueueFull):
+		return "Motor queue is full, try again later."
+	default:
+		slog.Error("telegram motor request failed", "user_id", user.ID, "error", err)
+		return "Failed to queue the request."
+	}
+}
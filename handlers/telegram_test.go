@@ -0,0 +1,42 @@
+// telegram_test.go - Tests for Telegram account linking and bot commands
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"context"                  // For service calls
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User and link models
+	"go-mqtt-backend/services" // Motor service
+	"go-mqtt-backend/store"    // In-memory backends
+	"testing"                  // Go's testing package
+	"time"                     // For durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+)
+
+// TestTelegramCommands checks linking with a code and that commands need a linked account
+func TestTelegramCommands(t *testing.T) {
+	setupTestDB()
+	UseMotorService(services.NewMotorService(services.MotorDeps{
+		Queue:     store.NewMemoryQueue(5),
+		State:     store.NewMemoryState(),
+		Publisher: services.PublisherFunc(func(string, interface{}) error { return nil }),
+		Repo:      services.NewGormMotorRepository(database.DB),
+		Quota:     time.Hour,
+	}))
+	user := models.User{Email: "tg@example.com", Password: "x", Role: models.RoleUser}
+	database.DB.Create(&user)
+	database.DB.Create(&models.TelegramLink{Code: "ABCDEFGH", UserID: user.ID, ExpiresAt: time.Now().Add(time.Minute)})
+	ctx := context.Background()
+
+	assert.Contains(t, TelegramCommand(ctx, 42, "/status"), "isn't linked")
+	assert.Contains(t, TelegramCommand(ctx, 42, "/start abcdefgh"), "Linked")
+	assert.Contains(t, TelegramCommand(ctx, 99, "/start ABCDEFGH"), "invalid or expired") // Single use
+
+	assert.Contains(t, TelegramCommand(ctx, 42, "/motor 10m"), "Queued a 10 min run")
+	assert.Contains(t, TelegramCommand(ctx, 42, "/motor@MotorBot 61"), "quota")
+	assert.Contains(t, TelegramCommand(ctx, 42, "/motor soon"), "at least one minute")
+	assert.Contains(t, TelegramCommand(ctx, 42, "/status"), "Queue: 1/5")
+	assert.Contains(t, TelegramCommand(ctx, 42, "/stop"), "Only admins")
+}
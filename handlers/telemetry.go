@@ -0,0 +1,219 @@
+// telemetry.go - Batched writes of sensor readings
+//
+// SQLite can't take an INSERT, a device update and a usage upsert for every MQTT message
+// at sensor rates, so Telemetry hands each reading to a buffer that writes them in batches
+// of TELEMETRY_BATCH_SIZE or every TELEMETRY_FLUSH_SECONDS, whichever comes first. The
+// reading that fills a batch is written before its MQTT callback returns, so a database
+// that falls behind slows the subscription down instead of growing the buffer.
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB writes
+	"fmt"                      // Error context
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Telemetry and device models
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP status codes
+	"sync"                     // For mutex (thread safety)
+	"time"                     // Flush interval and retention
+
+	"github.com/gin-gonic/gin" // Gin web framework
+	"gorm.io/gorm"             // Query filters
+)
+
+type usageKey struct { // An organization's month
+	orgID uint
+	month string
+}
+
+type telemetryBuffer struct { // Readings and their side effects waiting to be written
+	mu       sync.Mutex
+	readings []models.TelemetryReading
+	seen     map[uint]time.Time // Devices' latest readings
+	messages map[usageKey]int64 // Accepted messages per organization and month
+	dropped  int64              // Readings lost to failed writes
+
+	flushMu sync.Mutex // One write at a time; callers that fill a batch wait here
+}
+
+var telemetry = newTelemetryBuffer()
+
+func newTelemetryBuffer() *telemetryBuffer {
+	return &telemetryBuffer{seen: map[uint]time.Time{}, messages: map[usageKey]int64{}}
+}
+
+func telemetryBatchSize() int { // TELEMETRY_BATCH_SIZE, at least 1
+	return max(appConfig.TelemetryBatchSize, 1)
+}
+
+// add buffers r, counting it towards its organization's usage and device's last-seen
+// time. Only readings with store set are kept, so replicas don't each save the same one.
+func (b *telemetryBuffer) add(ctx context.Context, r models.TelemetryReading, store bool) {
+	b.mu.Lock()
+	if store {
+		b.readings = append(b.readings, r)
+	}
+	if r.DeviceID != 0 {
+		b.seen[r.DeviceID] = r.At
+	}
+	b.messages[usageKey{r.OrganizationID, usageMonth(r.At)}]++
+	full := len(b.readings) >= telemetryBatchSize()
+	b.mu.Unlock()
+	if full {
+		if err := b.flush(ctx); err != nil {
+			slog.Error("telemetry write failed", "error", err)
+		}
+	}
+}
+
+// flush writes everything buffered. Readings that can't be written are dropped; the
+// usage counters and last-seen times are written either way.
+func (b *telemetryBuffer) flush(ctx context.Context) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	readings, seen, messages := b.readings, b.seen, b.messages
+	b.readings, b.seen, b.messages = nil, map[uint]time.Time{}, map[usageKey]int64{}
+	b.mu.Unlock()
+
+	db := database.DB.WithContext(ctx)
+	for id, at := range seen {
+		db.Model(&models.Device{}).Where("id = ?", id).UpdateColumn("last_seen_at", at)
+	}
+	for key, n := range messages {
+		at, _ := time.Parse(usageMonthLayout, key.month)
+		meterUsage(ctx, key.orgID, at, map[string]int64{"messages_in": n})
+	}
+	if len(readings) == 0 {
+		return nil
+	}
+	if err := db.CreateInBatches(readings, telemetryBatchSize()).Error; err != nil {
+		b.mu.Lock()
+		b.dropped += int64(len(readings))
+		b.mu.Unlock()
+		return fmt.Errorf("%d readings dropped: %w", len(readings), err)
+	}
+	return nil
+}
+
+func (b *telemetryBuffer) stats() (buffered int, dropped int64) { // For metrics
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.readings), b.dropped
+}
+
+// FlushTelemetry writes the buffered readings now, e.g. on shutdown once MQTT is closed.
+func FlushTelemetry(ctx context.Context) error {
+	return telemetry.flush(ctx)
+}
+
+// WriteTelemetry is the supervised task that writes buffered readings every
+// TELEMETRY_FLUSH_SECONDS, and whatever is left when it stops.
+func WriteTelemetry(ctx context.Context, beat func()) error {
+	interval := appConfig.TelemetryFlushInterval
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := FlushTelemetry(final); err != nil {
+				slog.Error("telemetry write failed", "error", err)
+			}
+			return nil
+		case <-ticker.C:
+			beat()
+			if err := FlushTelemetry(ctx); err != nil {
+				slog.Error("telemetry write failed", "error", err)
+			}
+		}
+	}
+}
+
+// PruneTelemetry deletes readings older than TELEMETRY_RETENTION_DAYS (0 keeps them all).
+// It runs as a job.
+func PruneTelemetry(ctx context.Context) error {
+	days := appConfig.TelemetryRetentionDays
+	if days <= 0 {
+		return nil
+	}
+	res := database.DB.WithContext(ctx).Where("at < ?", time.Now().AddDate(0, 0, -days)).Delete(&models.TelemetryReading{})
+	if res.Error == nil && res.RowsAffected > 0 {
+		slog.Info("pruned telemetry", "readings", res.RowsAffected)
+	}
+	return res.Error
+}
+
+// DeviceTelemetry returns the stored readings of one of the caller's organization's
+// devices, newest first, a page at a time (limit and cursor as for History), optionally
+// of one metric and between from and to (RFC 3339). With format=csv it downloads all the
+// matching readings as a CSV instead.
+func DeviceTelemetry(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+	var limit int
+	var cursor *pageCursor
+	if format == "json" {
+		var ok bool
+		if limit, cursor, ok = page(c); !ok {
+			return
+		}
+	}
+	var d models.Device
+	if err := database.DB.WithContext(c.Request.Context()).Where("id = ? AND organization_id = ?", c.Param("id"), orgOf(c)).Limit(1).Find(&d).Error; err != nil || d.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+		return
+	}
+	var where []func(*gorm.DB) *gorm.DB // Filters, applied to every query
+	for name, op := range map[string]string{"from": ">=", "to": "<"} {
+		if v := c.Query(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be an RFC 3339 time"})
+				return
+			}
+			where = append(where, func(db *gorm.DB) *gorm.DB { return db.Where("at "+op+" ?", t) })
+		}
+	}
+	if metric := c.Query("metric"); metric != "" {
+		where = append(where, func(db *gorm.DB) *gorm.DB { return db.Where("metric = ?", metric) })
+	}
+	readings := func(db *gorm.DB, cursor *pageCursor, limit int) ([]models.TelemetryReading, error) {
+		var out []models.TelemetryReading
+		err := olderThan(db.Where("device_id = ?", d.ID).Scopes(where...), "at", cursor).Order("at DESC, id DESC").Limit(limit).Find(&out).Error
+		return out, err
+	}
+	if format == "csv" {
+		streamCSV(c, "telemetry", fmt.Sprintf("device-%d-telemetry.csv", d.ID), []string{"metric", "value", "at"}, func(db *gorm.DB, after *pageCursor) ([][]string, pageCursor, error) {
+			batch, err := readings(db, after, streamBatch)
+			rows := make([][]string, len(batch))
+			var last pageCursor
+			for i, r := range batch {
+				rows[i] = []string{r.Metric, fmt.Sprint(r.Value), exportCell(r.At)}
+				last = pageCursor{r.At, r.ID}
+			}
+			return rows, last, err
+		})
+		return
+	}
+	batch, err := readings(database.DB.WithContext(c.Request.Context()), cursor, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load telemetry"})
+		return
+	}
+	out := make([]gin.H, len(batch))
+	var last pageCursor
+	for i, r := range batch {
+		out[i] = gin.H{"metric": r.Metric, "value": r.Value, "at": r.At}
+		last = pageCursor{r.At, r.ID}
+	}
+	c.JSON(http.StatusOK, gin.H{"readings": out, "next_cursor": nextCursor(len(out), limit, last)})
+}
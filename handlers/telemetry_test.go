@@ -0,0 +1,118 @@
+// telemetry_test.go - Tests for batched telemetry writes and reading them back
+// Run with: go test ./...
+
+package handlers
+
+import (
+	"context"                  // For flushes
+	"encoding/json"            // Response decoding
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Telemetry and device models
+	"net/http"                 // Requests
+	"net/http/httptest"        // Recorders
+	"net/url"                  // Times in queries
+	"strconv"                  // IDs in paths
+	"testing"                  // Go's testing package
+	"time"                     // Retention
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestTelemetryBatches checks that readings are written once a batch fills or on a flush,
+// only by the leader, and pruned after the retention period
+func TestTelemetryBatches(t *testing.T) {
+	setupTestDB()
+	appConfig.TelemetryBatchSize = 3
+	useTestMotor(5)
+	farm := models.Organization{Name: "Green Acres", Slug: "green-acres"}
+	require.NoError(t, database.DB.Create(&farm).Error)
+	dev := models.Device{OrganizationID: farm.ID, Name: "pump-1"}
+	require.NoError(t, database.DB.Create(&dev).Error)
+	leader := Telemetry("sensors/", func() bool { return true })
+	follower := Telemetry("sensors/", func() bool { return false })
+	stored := func() int64 {
+		var n int64
+		database.DB.Model(&models.TelemetryReading{}).Count(&n)
+		return n
+	}
+
+	leader("green-acres/pump-1/sensors/soil_moisture", []byte("18"))
+	leader("sensors/soil_moisture", []byte("21"))
+	follower("sensors/soil_moisture", []byte("21")) // Counted, not stored
+	assert.Zero(t, stored(), "batch not full yet")
+	leader("green-acres/pump-1/sensors/soil_moisture", []byte("17"))
+	assert.Equal(t, int64(3), stored())
+	leader("green-acres/pump-1/sensors/soil_moisture", []byte("16"))
+	require.NoError(t, FlushTelemetry(context.Background()))
+	assert.Equal(t, int64(4), stored())
+
+	var readings []models.TelemetryReading
+	require.NoError(t, database.DB.Where("device_id = ?", dev.ID).Order("id").Find(&readings).Error)
+	require.Len(t, readings, 3)
+	assert.Equal(t, farm.ID, readings[0].OrganizationID)
+	assert.Equal(t, "pump-1/soil_moisture", readings[0].Metric)
+	assert.Equal(t, 18.0, readings[0].Value)
+	var usage models.UsageRecord
+	require.NoError(t, database.DB.Where("organization_id = ?", database.DefaultOrgID).First(&usage).Error)
+	assert.Equal(t, int64(2), usage.MessagesIn)
+	require.NoError(t, database.DB.First(&dev, dev.ID).Error)
+	assert.NotNil(t, dev.LastSeenAt)
+
+	require.NoError(t, database.DB.Model(&readings[0]).Update("at", time.Now().AddDate(0, 0, -appConfig.TelemetryRetentionDays-1)).Error)
+	require.NoError(t, PruneTelemetry(context.Background()))
+	assert.Equal(t, int64(3), stored())
+}
+
+// TestDeviceTelemetryPages checks that a device's readings are listed newest first a page
+// at a time, filtered by metric, and only for the caller's organization
+func TestDeviceTelemetryPages(t *testing.T) {
+	setupTestDB()
+	dev := models.Device{OrganizationID: database.DefaultOrgID, Name: "pump-1"}
+	require.NoError(t, database.DB.Create(&dev).Error)
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, database.DB.Create(&models.TelemetryReading{OrganizationID: dev.OrganizationID, DeviceID: dev.ID, Metric: "pump-1/soil_moisture", Value: float64(i), At: start.Add(time.Duration(i) * time.Minute)}).Error)
+	}
+	require.NoError(t, database.DB.Create(&models.TelemetryReading{OrganizationID: dev.OrganizationID, DeviceID: dev.ID, Metric: "pump-1/level", Value: 9, At: start}).Error)
+
+	r := gin.New()
+	org := database.DefaultOrgID
+	r.GET("/api/org/devices/:id/telemetry", func(c *gin.Context) { c.Set("orgID", org) }, DeviceTelemetry)
+	get := func(query string) (int, []float64, string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/org/devices/"+strconv.Itoa(int(dev.ID))+"/telemetry?"+query, nil)
+		r.ServeHTTP(w, req)
+		var out struct {
+			Readings   []struct{ Value float64 }
+			NextCursor string `json:"next_cursor"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &out)
+		values := make([]float64, len(out.Readings))
+		for i, rd := range out.Readings {
+			values[i] = rd.Value
+		}
+		return w.Code, values, out.NextCursor
+	}
+
+	code, values, next := get("metric=pump-1/soil_moisture&limit=3")
+	require.Equal(t, 200, code)
+	assert.Equal(t, []float64{4, 3, 2}, values)
+	require.NotEmpty(t, next)
+	_, values, next = get("metric=pump-1/soil_moisture&limit=3&cursor=" + next)
+	assert.Equal(t, []float64{1, 0}, values)
+	assert.Empty(t, next)
+	_, values, _ = get("from=" + url.QueryEscape(start.Add(3*time.Minute).Format(time.RFC3339)))
+	assert.Len(t, values, 2)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/org/devices/"+strconv.Itoa(int(dev.ID))+"/telemetry?format=csv&metric=pump-1/level", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "metric,value,at\npump-1/level,9,"+start.UTC().Format(time.RFC3339Nano)+"\n", w.Body.String())
+
+	org = 9999
+	code, _, _ = get("")
+	assert.Equal(t, 404, code)
+}
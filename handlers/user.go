@@ -3,22 +3,37 @@
 package handlers // Declares the package name
 
 import ( // Import required packages
-	"go-mqtt-backend/config"   // Project config
-	"go-mqtt-backend/database" // Database connection
-	"go-mqtt-backend/models"   // User model
-	"net/http"                 // HTTP status codes
-	"time"                     // For token expiration
+	"context"                    // Signing key lookups
+	"go-mqtt-backend/config"     // Project config
+	"go-mqtt-backend/database"   // Database connection
+	"go-mqtt-backend/middleware" // Signing keys
+	"go-mqtt-backend/models"     // User model
+	"net/http"                   // HTTP status codes
+	"regexp"                     // Phone number validation
+	"time"                       // For token expiration
 
 	"github.com/gin-gonic/gin"     // Gin web framework
 	"github.com/golang-jwt/jwt/v5" // JWT library
 	"golang.org/x/crypto/bcrypt"   // Password hashing
 )
 
+var appConfig *config.Config // Configuration loaded once at startup (set by UseConfig)
+
+func UseConfig(cfg *config.Config) { // Injects the startup config; call before serving requests
+	appConfig = cfg
+}
+
 type RegisterInput struct { // Struct for registration input
 	Email    string `json:"email" binding:"required"`    // Email (required)
 	Password string `json:"password" binding:"required"` // Password (required)
 }
 
+type PhoneInput struct { // Struct for setting the SMS number
+	Phone string `json:"phone"` // E.164 number, or empty to stop texts
+}
+
+var e164 = regexp.MustCompile(`^\+[1-9]\d{6,14}$`) // International format, e.g. +14155550123
+
 type LoginInput struct { // Struct for login input
 	Email    string `json:"email" binding:"required"`    // Email (required)
 	Password string `json:"password" binding:"required"` // Password (required)
@@ -30,9 +45,9 @@ func Register(c *gin.Context) { // Handler for user registration
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}) // Return error if invalid
 		return
 	}
-	hash, _ := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost) // Hash password
-	user := models.User{Email: input.Email, Password: string(hash)}                    // Create user struct
-	if err := database.DB.Create(&user).Error; err != nil {                            // Save user to DB
+	hash, _ := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)                     // Hash password
+	user := models.User{Email: input.Email, Password: string(hash), OrganizationID: database.DefaultOrgID} // Create user struct in the default organization
+	if err := database.DB.WithContext(c.Request.Context()).Create(&user).Error; err != nil {               // Save user to DB
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}) // Return error if DB fails
 		return
 	}
@@ -45,8 +60,8 @@ func Login(c *gin.Context) { // Handler for user login
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()}) // Return error if invalid
 		return
 	}
-	var user models.User                                                                   // Declare user variable
-	if err := database.DB.Where("email = ?", input.Email).First(&user).Error; err != nil { // Find user by email
+	var user models.User                                                                                                    // Declare user variable
+	if err := database.DB.WithContext(c.Request.Context()).Where("email = ?", input.Email).First(&user).Error; err != nil { // Find user by email
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"}) // Return error if not found
 		return
 	}
@@ -55,19 +70,123 @@ func Login(c *gin.Context) { // Handler for user login
 		return
 	}
 	// JWT generation
-	cfg := config.Load()                                              // Load config for JWT secret
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{ // Create JWT token
-		"sub":   user.ID,                               // Add subject (user ID)
-		"exp":   time.Now().Add(time.Hour * 72).Unix(), // Set expiration (72 hours)
-		"iat":   time.Now().Unix(),                     // Issued at time
-		"iss":   "go-mqtt-backend",                     // Issuer (application name)
-		"email": user.Email,                            // Include user email in token
-	})
-	tokenString, err := token.SignedString([]byte(cfg.JWTSecret)) // Sign token
-	if err != nil {                                               // Check for signing error
+	tokenString, err := GenerateToken(c.Request.Context(), user, appConfig.JWTSecret, 72*time.Hour) // Sign token (72 hours)
+	if err != nil {                                                                                 // Check for signing error
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create token"}) // Return error if signing fails
 		return
 	}
 	// Return token in response
-	c.JSON(http.StatusOK, gin.H{"token": tokenString}) // Return token
+	resp := gin.H{"token": tokenString} // Return token
+	if user.MustChangePassword {
+		resp["password_change_required"] = true // The token only works for PUT /api/me/password
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+type PasswordInput struct { // Struct for changing the caller's password
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=8,max=72"` // bcrypt reads at most 72 bytes
+}
+
+// ChangePassword replaces the caller's password after checking the current one, and
+// returns a new token. It is how the bootstrap admin gets past the forced change.
+func ChangePassword(c *gin.Context) {
+	var input PasswordInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db := database.DB.WithContext(c.Request.Context())
+	var user models.User
+	if err := db.First(&user, c.MustGet("userID")).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.CurrentPassword)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "current password is wrong"})
+		return
+	}
+	if input.NewPassword == input.CurrentPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "new password must differ from the current one"})
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(input.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not change password"})
+		return
+	}
+	user.Password, user.MustChangePassword = string(hash), false
+	if err := db.Model(&user).Select("password", "must_change_password").Updates(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not change password"})
+		return
+	}
+	token, err := GenerateToken(c.Request.Context(), user, appConfig.JWTSecret, 72*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not create token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "password changed", "token": token})
+}
+
+func SetPhone(c *gin.Context) { // Handler for setting or clearing the caller's SMS number
+	var input PhoneInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Phone != "" && !e164.MatchString(input.Phone) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "phone must be in E.164 format, e.g. +14155550123"})
+		return
+	}
+	userID, _ := c.Get("userID")
+	err := database.DB.WithContext(c.Request.Context()).Model(&models.User{}).Where("id = ?", userID).Update("phone", input.Phone).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save phone"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"phone": input.Phone})
+}
+
+type TimezoneInput struct { // Struct for setting the profile time zone
+	Timezone string `json:"timezone"` // IANA name, e.g. "Asia/Karachi", or empty for UTC
+}
+
+func SetTimezone(c *gin.Context) { // Handler for setting the caller's default time zone for schedules
+	var input TimezoneInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := time.LoadLocation(input.Timezone); err != nil || input.Timezone == "Local" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "timezone must be an IANA name, e.g. Asia/Karachi"})
+		return
+	}
+	userID, _ := c.Get("userID")
+	err := database.DB.WithContext(c.Request.Context()).Model(&models.User{}).Where("id = ?", userID).Update("timezone", input.Timezone).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not save timezone"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"timezone": input.Timezone})
+}
+
+// GenerateToken creates a JWT for user valid for ttl, signed with the current signing key
+// (secret, the JWT_SECRET, until it is first rotated).
+func GenerateToken(ctx context.Context, user models.User, secret string, ttl time.Duration) (string, error) {
+	kid, key := middleware.SigningKey(ctx, secret)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{ // Create JWT token
+		"sub":   user.ID,                    // Add subject (user ID)
+		"exp":   time.Now().Add(ttl).Unix(), // Set expiration
+		"iat":   time.Now().Unix(),          // Issued at time
+		"iss":   "go-mqtt-backend",          // Issuer (application name)
+		"email": user.Email,                 // Include user email in token
+		"role":  user.Role,                  // Include user role in token
+	})
+	if kid != "" {
+		token.Header["kid"] = kid // Which key verifies it
+	}
+	if user.MustChangePassword {
+		token.Claims.(jwt.MapClaims)["pwd_change"] = true // Only good for changing the password
+	}
+	return token.SignedString(key) // Sign token
 }
@@ -4,25 +4,36 @@
 package handlers
 
 import (
-	"bytes"                    // For building request bodies
-	"encoding/json"            // For encoding/decoding JSON
-	"go-mqtt-backend/config"   // Project config
-	"go-mqtt-backend/database" // Database connection
-	"net/http"                 // HTTP status codes
-	"net/http/httptest"        // HTTP test helpers
-	"os"                       // For file operations
-	"testing"                  // Go's testing package
+	"bytes"                      // For building request bodies
+	"encoding/json"              // For encoding/decoding JSON
+	"go-mqtt-backend/config"     // Project config
+	"go-mqtt-backend/database"   // Database connection
+	"go-mqtt-backend/middleware" // Auth middleware
+	"go-mqtt-backend/models"     // User model
+	"net/http"                   // HTTP status codes
+	"net/http/httptest"          // HTTP test helpers
+	"os"                         // For file operations
+	"testing"                    // Go's testing package
 
 	"github.com/gin-gonic/gin"           // Gin web framework
 	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt" // Password hashing
 )
 
 // setupTestDB removes any existing test DB and creates a new one for each test run
 func setupTestDB() {
-	_ = os.Remove("test.db")     // Remove old test DB if exists
-	cfg := config.Load()         // Load config
-	cfg.DBPath = "test.db"       // Use a separate test DB
-	database.Connect(cfg.DBPath) // Connect and migrate
+	if database.DB != nil {
+		database.Close() // Let go of the previous test's file
+	}
+	for _, f := range []string{"test.db", "test.db-wal", "test.db-shm"} {
+		_ = os.Remove(f) // Remove old test DB and its WAL if they exist
+	}
+	cfg := config.Load()             // Load config
+	cfg.DBPath = "test.db"           // Use a separate test DB
+	UseConfig(cfg)                   // Handlers use the injected config, not the environment
+	database.Connect(cfg.DBPath)     // Connect and migrate
+	telemetry = newTelemetryBuffer() // Nothing buffered by an earlier test
 }
 
 // setupRouter returns a Gin engine with the user routes for testing
@@ -71,3 +82,94 @@ func TestRegisterAndLogin(t *testing.T) {
 	router.ServeHTTP(w, req)
 	assert.Equal(t, 401, w.Code) // Should be unauthorized
 }
+
+// TestForcedPasswordChange checks that a user who must change their password can do nothing
+// else until they have
+func TestForcedPasswordChange(t *testing.T) {
+	setupTestDB()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.MinCost)
+	user := models.User{Email: "admin@example.com", Password: string(hash), Role: models.RoleAdmin, MustChangePassword: true}
+	require.NoError(t, database.DB.Create(&user).Error)
+	r := setupRouter()
+	r.PUT("/api/me/password", middleware.PasswordChangeAuth(appConfig), ChangePassword)
+	r.GET("/api/me", middleware.AuthMiddleware(appConfig), func(c *gin.Context) { c.Status(http.StatusOK) })
+	call := func(method, path, token, body string) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		var out map[string]any
+		json.Unmarshal(w.Body.Bytes(), &out)
+		return w.Code, out
+	}
+
+	code, out := call("POST", "/login", "", `{"email":"admin@example.com","password":"admin123"}`)
+	require.Equal(t, 200, code)
+	assert.Equal(t, true, out["password_change_required"])
+	token := out["token"].(string)
+	code, _ = call("GET", "/api/me", token, "")
+	assert.Equal(t, 403, code)
+
+	code, _ = call("PUT", "/api/me/password", token, `{"current_password":"wrong","new_password":"a-better-one"}`)
+	assert.Equal(t, 401, code)
+	code, _ = call("PUT", "/api/me/password", token, `{"current_password":"admin123","new_password":"admin123"}`)
+	assert.Equal(t, 400, code)
+	code, out = call("PUT", "/api/me/password", token, `{"current_password":"admin123","new_password":"a-better-one"}`)
+	require.Equal(t, 200, code)
+	code, _ = call("GET", "/api/me", out["token"].(string), "")
+	assert.Equal(t, 200, code)
+	require.NoError(t, database.DB.First(&user, user.ID).Error)
+	assert.False(t, user.MustChangePassword)
+
+	code, out = call("POST", "/login", "", `{"email":"admin@example.com","password":"a-better-one"}`)
+	require.Equal(t, 200, code)
+	assert.Nil(t, out["password_change_required"])
+}
+
+// TestSetPhone checks E.164 validation and clearing the number
+func TestSetPhone(t *testing.T) {
+	setupTestDB()
+	user := models.User{Email: "phone@example.com", Password: "x"}
+	database.DB.Create(&user)
+	r := gin.New()
+	r.PUT("/api/me/phone", func(c *gin.Context) { c.Set("userID", user.ID) }, SetPhone)
+
+	put := func(phone string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/api/me/phone", bytes.NewBufferString(`{"phone":"`+phone+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, 400, put("555-1234"))
+	assert.Equal(t, 200, put("+14155550123"))
+	database.DB.First(&user, user.ID)
+	assert.Equal(t, "+14155550123", user.Phone)
+	assert.Equal(t, 200, put("")) // Clears it
+	database.DB.First(&user, user.ID)
+	assert.Empty(t, user.Phone)
+}
+
+// TestSetTimezone checks that only IANA zone names are accepted
+func TestSetTimezone(t *testing.T) {
+	setupTestDB()
+	user := models.User{Email: "tz@example.com", Password: "x"}
+	database.DB.Create(&user)
+	r := gin.New()
+	r.PUT("/api/me/timezone", func(c *gin.Context) { c.Set("userID", user.ID) }, SetTimezone)
+
+	put := func(tz string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/api/me/timezone", bytes.NewBufferString(`{"timezone":"`+tz+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, 400, put("Mars/Olympus"))
+	assert.Equal(t, 400, put("Local")) // Server-dependent
+	assert.Equal(t, 200, put("Asia/Karachi"))
+	database.DB.First(&user, user.ID)
+	assert.Equal(t, "Asia/Karachi", user.Timezone)
+}
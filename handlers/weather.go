@@ -0,0 +1,38 @@
+// weather.go - Skips scheduled runs when rain is forecast
+
+package handlers // Declares the package name
+
+import ( // Import required packages
+	"context"                 // For the forecast call
+	"fmt"                     // For skip reasons
+	"go-mqtt-backend/models"  // Schedule model
+	"go-mqtt-backend/weather" // Rain forecasts
+	"log/slog"                // Leveled logging
+	"time"                    // Forecast window
+)
+
+var forecaster weather.Forecaster // Rain forecasts for the site (nil disables rain skips; set by UseWeather)
+
+var weatherLookahead = 12 * time.Hour // How far past a run's start rain counts
+
+func UseWeather(f weather.Forecaster, lookahead time.Duration) { // Enables rain skips
+	forecaster, weatherLookahead = f, lookahead
+}
+
+// rainSkip returns why the occurrence at should be skipped for rain, or "" to run it.
+// Late occurrences are left to queueScheduled, and the run goes ahead if the forecast
+// can't be read: a dry field is worse than a wasted watering.
+func rainSkip(ctx context.Context, s models.Schedule, at, now time.Time) string {
+	if s.RainSkipPercent == 0 || forecaster == nil || now.Sub(at) > scheduleGrace {
+		return ""
+	}
+	chance, err := forecaster.RainChance(ctx, at, at.Add(weatherLookahead))
+	if err != nil {
+		slog.Warn("rain forecast unavailable; running schedule anyway", "schedule_id", s.ID, "error", err)
+		return ""
+	}
+	if chance <= s.RainSkipPercent {
+		return ""
+	}
+	return fmt.Sprintf("rain forecast: %d%% chance in the next %d hours (skips above %d%%)", chance, int(weatherLookahead.Hours()), s.RainSkipPercent)
+}
@@ -0,0 +1,128 @@
+// leader.go - Lease-based leader election so only one replica drives the motor
+
+package leader // Declares the package name
+
+import ( // Import required packages
+	"context"               // For cancellation
+	"go-mqtt-backend/store" // Lease storage (memory or Redis)
+	"log/slog"              // Leveled logging
+	"sync"                  // For mutex (thread safety)
+	"time"                  // For time operations
+)
+
+type Status struct { // Status is a snapshot for status endpoints
+	InstanceID string    `json:"instance_id"` // This replica
+	Leader     bool      `json:"leader"`      // Whether this replica holds the lease
+	Since      time.Time `json:"since"`       // When this replica became leader (zero while following)
+	Holder     string    `json:"holder"`      // Replica currently holding the lease ("" if none)
+}
+
+// Elector campaigns for a named lease in the shared store. With the memory backend there
+// is only one instance, so it always wins; with Redis exactly one replica holds the lease
+// and another takes over within the lease TTL if it dies.
+type Elector struct {
+	state store.State   // Where the lease lives
+	name  string        // Lease name
+	id    string        // This replica's ID
+	ttl   time.Duration // Lease lifetime; renewed every ttl/3
+
+	mu     sync.Mutex // Mutex for thread safety
+	leader bool
+	since  time.Time
+}
+
+func New(state store.State, name, id string, ttl time.Duration) *Elector { // Creates an elector for lease name
+	return &Elector{state: state, name: name, id: id, ttl: ttl}
+}
+
+// Lead wraps work so it only runs while this replica holds the lease. The returned
+// function fits supervisor.Task.Run: work is started on winning the lease and its ctx is
+// cancelled as soon as the lease is lost or can't be renewed (e.g. Redis unreachable),
+// since we can no longer be sure no other replica has taken over.
+func (e *Elector) Lead(work func(ctx context.Context, beat func()) error) func(ctx context.Context, beat func()) error {
+	return func(ctx context.Context, beat func()) error {
+		defer e.release()
+		ticker := time.NewTicker(e.ttl / 3)
+		defer ticker.Stop()
+
+		var (
+			cancelWork context.CancelFunc
+			done       chan error // Non-nil while work is running
+		)
+		stopWork := func() {
+			e.setLeader(false) // Not leader any more while work winds down
+			cancelWork()
+			<-done
+			done = nil
+		}
+		for {
+			ok, err := e.state.AcquireLease(ctx, e.name, e.id, e.ttl) // Take or renew
+			if err != nil && ctx.Err() == nil {
+				slog.Error("leader lease renewal failed", "lease", e.name, "error", err)
+			}
+			switch {
+			case ok && done == nil: // Won the lease
+				slog.Info("became leader", "lease", e.name, "instance", e.id)
+				e.setLeader(true)
+				done, cancelWork = startWork(ctx, work, beat)
+			case !ok && done != nil: // Lost it
+				slog.Warn("lost leadership, stopping", "lease", e.name, "instance", e.id)
+				stopWork()
+			}
+			if done == nil {
+				beat() // Following is healthy; while leading, work reports its own progress
+			}
+
+			select {
+			case <-ctx.Done():
+				if done != nil {
+					stopWork()
+				}
+				return nil
+			case err := <-done: // Work ended on its own (crash); hand the lease over
+				e.setLeader(false)
+				cancelWork()
+				return err
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+func startWork(ctx context.Context, work func(ctx context.Context, beat func()) error, beat func()) (chan error, context.CancelFunc) { // Runs work until cancelled; its result arrives on the channel
+	workCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- work(workCtx, beat) }()
+	return done, cancel
+}
+
+func (e *Elector) release() { // Gives up the lease so a follower can take over without waiting for the TTL
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.state.ReleaseLease(ctx, e.name, e.id); err != nil {
+		slog.Error("leader lease release failed", "lease", e.name, "error", err)
+	}
+}
+
+func (e *Elector) setLeader(leader bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leader = leader
+	e.since = time.Time{}
+	if leader {
+		e.since = time.Now()
+	}
+}
+
+func (e *Elector) IsLeader() bool { // Reports whether this replica currently holds the lease
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+func (e *Elector) Status(ctx context.Context) (Status, error) { // Snapshot including the current holder
+	holder, err := e.state.LeaseHolder(ctx, e.name)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return Status{InstanceID: e.id, Leader: e.leader, Since: e.since, Holder: holder}, err
+}
@@ -0,0 +1,78 @@
+// leader_test.go - Tests for lease-based leader election
+// Run with: go test ./...
+
+package leader
+
+import (
+	"context"               // For cancellation
+	"go-mqtt-backend/store" // In-memory lease storage
+	"sync/atomic"           // For tracking running work
+	"testing"               // Go's testing package
+	"time"                  // For durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestSingleLeaderAndFailover checks that only one of two replicas runs the work and the
+// other takes over once the leader stops
+func TestSingleLeaderAndFailover(t *testing.T) {
+	state := store.NewMemoryState() // Shared by both "replicas"
+	var running int32
+	work := func(ctx context.Context, beat func()) error {
+		atomic.AddInt32(&running, 1)
+		<-ctx.Done()
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+	a := New(state, "motor", "a", 60*time.Millisecond)
+	b := New(state, "motor", "b", 60*time.Millisecond)
+
+	ctxA, stopA := context.WithCancel(context.Background())
+	doneA := make(chan error)
+	go func() { doneA <- a.Lead(work)(ctxA, func() {}) }()
+	require.Eventually(t, a.IsLeader, time.Second, 5*time.Millisecond)
+
+	ctxB, stopB := context.WithCancel(context.Background())
+	defer stopB()
+	go b.Lead(work)(ctxB, func() {})
+	time.Sleep(100 * time.Millisecond) // Several renewal rounds
+	assert.False(t, b.IsLeader())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&running))
+	st, err := b.Status(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "a", st.Holder)
+
+	stopA() // Leader goes away and releases the lease
+	require.NoError(t, <-doneA)
+	assert.False(t, a.IsLeader())
+	require.Eventually(t, b.IsLeader, time.Second, 5*time.Millisecond)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&running) == 1 }, time.Second, 5*time.Millisecond)
+}
+
+// TestStepsDownWhenLeaseLost checks that work is cancelled when another holder takes the lease
+func TestStepsDownWhenLeaseLost(t *testing.T) {
+	state := store.NewMemoryState()
+	stopped := make(chan struct{})
+	e := New(state, "motor", "a", 60*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Lead(func(ctx context.Context, beat func()) error {
+		<-ctx.Done()
+		close(stopped)
+		return nil
+	})(ctx, func() {})
+	require.Eventually(t, e.IsLeader, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, state.ReleaseLease(ctx, "motor", "a")) // Simulate expiry and a takeover
+	ok, err := state.AcquireLease(ctx, "motor", "b", time.Minute)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("work kept running after the lease was lost")
+	}
+	assert.False(t, e.IsLeader())
+}
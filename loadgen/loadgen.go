@@ -0,0 +1,255 @@
+// loadgen.go - Synthetic load against a staging instance
+//
+// Run drives two open-loop streams at fixed rates: motor requests through the HTTP API
+// (always dry runs, so no motor is switched) and sensor readings published over MQTT,
+// which exercise the queue and the telemetry writes respectively. Each stream is paced by
+// a ticker and served by a fixed number of workers; a tick that finds every worker busy is
+// counted as missed rather than queued, so a saturated target shows up as missed sends and
+// rising latencies instead of the generator quietly slowing down to match it.
+
+package loadgen // Declares the package name
+
+import ( // Import required packages
+	"bytes"         // Request bodies
+	"context"       // Run length and cancellation
+	"encoding/json" // Request bodies
+	"errors"        // Preflight errors
+	"fmt"           // Report formatting and payloads
+	"io"            // Report output and draining responses
+	"math/rand"     // Sensor values
+	"net/http"      // API requests
+	"slices"        // Percentiles
+	"strings"       // URL joining
+	"sync"          // Workers and results
+	"sync/atomic"   // Missed ticks
+	"time"          // Pacing and latencies
+)
+
+var ErrNotAdmin = errors.New("the token must belong to an admin") // Preflight refused the token
+
+// Config describes a load run.
+type Config struct {
+	BaseURL     string        // Target instance, e.g. "https://staging.example.com"
+	Token       string        // Admin JWT for the target
+	Duration    time.Duration // How long to generate load
+	Concurrency int           // Workers per stream, i.e. requests in flight at most
+
+	EnqueueRate    float64 // Motor requests per second (0: none)
+	RunMinutes     int     // Duration of each requested run
+	TelemetryRate  float64 // Sensor readings per second (0: none)
+	TelemetryTopic string  // Topic the readings are published to, e.g. "sensors/loadgen"
+
+	Publish func(topic string, payload interface{}) error // Publishes a reading; required with a telemetry rate
+	Client  *http.Client                                  // HTTP client (default: 10 second timeout)
+}
+
+// Stats summarizes one stream.
+type Stats struct {
+	Name       string
+	Sent       int64         // Requests or publishes completed
+	Failed     int64         // Transport errors and publish failures
+	Missed     int64         // Ticks skipped because every worker was busy
+	Status     map[int]int64 // HTTP responses by status code
+	Throughput float64       // Completed per second
+	P50        time.Duration
+	P95        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+}
+
+// Report is the outcome of a run.
+type Report struct {
+	Elapsed time.Duration
+	Streams []Stats
+}
+
+// Run checks that the token is an admin's and then generates load until cfg.Duration has
+// passed or ctx is done. Requests still in flight at the end are waited for.
+func Run(ctx context.Context, cfg Config) (Report, error) {
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cfg.TelemetryRate > 0 && cfg.Publish == nil {
+		return Report{}, errors.New("a telemetry rate needs a publisher")
+	}
+	if err := preflight(ctx, cfg); err != nil {
+		return Report{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	body, _ := json.Marshal(map[string]any{"duration": max(cfg.RunMinutes, 1), "simulate": true})
+	var streams []*stream
+	if cfg.EnqueueRate > 0 {
+		streams = append(streams, newStream("enqueue", cfg.EnqueueRate, func(ctx context.Context) (int, error) {
+			return send(ctx, cfg, http.MethodPost, "/api/motor", body)
+		}))
+	}
+	if cfg.TelemetryRate > 0 {
+		streams = append(streams, newStream("telemetry", cfg.TelemetryRate, func(context.Context) (int, error) {
+			return 0, cfg.Publish(cfg.TelemetryTopic, fmt.Sprintf("%.1f", 10+rand.Float64()*30))
+		}))
+	}
+	if len(streams) == 0 {
+		return Report{}, errors.New("nothing to do: both rates are 0")
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.run(ctx, max(cfg.Concurrency, 1))
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	report := Report{Elapsed: elapsed}
+	for _, s := range streams {
+		report.Streams = append(report.Streams, s.stats(elapsed))
+	}
+	return report, nil
+}
+
+func preflight(ctx context.Context, cfg Config) error { // Refuses tokens that can't reach the admin API
+	status, err := send(ctx, cfg, http.MethodGet, "/admin/status", nil)
+	switch {
+	case err != nil:
+		return fmt.Errorf("target not reachable: %w", err)
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrNotAdmin
+	case status != http.StatusOK:
+		return fmt.Errorf("target answered /admin/status with %d", status)
+	}
+	return nil
+}
+
+func send(ctx context.Context, cfg Config, method, path string, body []byte) (int, error) { // One API request; returns its status
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(cfg.BaseURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := cfg.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) // Lets the connection be reused
+	return resp.StatusCode, nil
+}
+
+type stream struct { // One kind of traffic and what came of it
+	name   string
+	rate   float64
+	call   func(context.Context) (status int, err error)
+	missed atomic.Int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	failed    int64
+	status    map[int]int64
+}
+
+func newStream(name string, rate float64, call func(context.Context) (int, error)) *stream {
+	return &stream{name: name, rate: rate, call: call, status: map[int]int64{}}
+}
+
+func (s *stream) run(ctx context.Context, workers int) { // Paces calls until ctx is done
+	ticks := make(chan struct{})
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range ticks {
+				s.do(context.WithoutCancel(ctx)) // The run ending doesn't cut off calls in flight
+			}
+		}()
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / s.rate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			close(ticks)
+			wg.Wait()
+			return
+		case <-ticker.C:
+			select {
+			case ticks <- struct{}{}:
+			default:
+				s.missed.Add(1)
+			}
+		}
+	}
+}
+
+func (s *stream) do(ctx context.Context) { // Makes one call and records it
+	start := time.Now()
+	status, err := s.call(ctx)
+	took := time.Since(start)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.failed++
+		return
+	}
+	s.latencies = append(s.latencies, took)
+	if status != 0 {
+		s.status[status]++
+	}
+}
+
+func (s *stream) stats(elapsed time.Duration) Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lat := slices.Clone(s.latencies)
+	slices.Sort(lat)
+	st := Stats{Name: s.name, Sent: int64(len(lat)), Failed: s.failed, Missed: s.missed.Load(), Status: s.status}
+	if elapsed > 0 {
+		st.Throughput = float64(st.Sent) / elapsed.Seconds()
+	}
+	st.P50, st.P95, st.P99 = percentile(lat, 50), percentile(lat, 95), percentile(lat, 99)
+	if len(lat) > 0 {
+		st.Max = lat[len(lat)-1]
+	}
+	return st
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration { // Nearest-rank percentile of sorted latencies
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// Print writes the report as a table, one row per stream, with the HTTP status counts
+// below it.
+func (r Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "load generated for %s\n\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "%-10s %8s %8s %8s %10s %9s %9s %9s %9s\n", "stream", "sent", "failed", "missed", "per sec", "p50", "p95", "p99", "max")
+	for _, s := range r.Streams {
+		fmt.Fprintf(w, "%-10s %8d %8d %8d %10.1f %9s %9s %9s %9s\n", s.Name, s.Sent, s.Failed, s.Missed, s.Throughput,
+			s.P50.Round(time.Microsecond*100), s.P95.Round(time.Microsecond*100), s.P99.Round(time.Microsecond*100), s.Max.Round(time.Microsecond*100))
+	}
+	for _, s := range r.Streams {
+		if len(s.Status) == 0 {
+			continue
+		}
+		codes := make([]int, 0, len(s.Status))
+		for code := range s.Status {
+			codes = append(codes, code)
+		}
+		slices.Sort(codes)
+		fmt.Fprintf(w, "\n%s responses:", s.Name)
+		for _, code := range codes {
+			fmt.Fprintf(w, " %d=%d", code, s.Status[code])
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,89 @@
+// loadgen_test.go - Tests for the load generator
+// Run with: go test ./...
+
+package loadgen
+
+import (
+	"bytes"             // Report output
+	"context"           // Runs
+	"encoding/json"     // Request bodies
+	"net/http"          // Handlers
+	"net/http/httptest" // Fake target
+	"sync/atomic"       // Counters
+	"testing"           // Go's testing package
+	"time"              // Run lengths
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+func target(t *testing.T, admin bool, enqueued *atomic.Int64) *httptest.Server { // A fake instance that answers like the API
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/status", func(w http.ResponseWriter, r *http.Request) {
+		if !admin || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+	mux.HandleFunc("POST /api/motor", func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Simulate bool }
+		json.NewDecoder(r.Body).Decode(&body)
+		assert.True(t, body.Simulate, "load runs must be dry runs")
+		if enqueued.Add(1)%2 == 0 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// TestRunReportsStreams checks that both streams are driven, dry runs only, and that the
+// report counts responses by status
+func TestRunReportsStreams(t *testing.T) {
+	var enqueued, published atomic.Int64
+	srv := target(t, true, &enqueued)
+	report, err := Run(context.Background(), Config{
+		BaseURL: srv.URL, Token: "secret", Duration: 300 * time.Millisecond, Concurrency: 4,
+		EnqueueRate: 50, TelemetryRate: 100, TelemetryTopic: "sensors/loadgen",
+		Publish: func(topic string, payload interface{}) error {
+			assert.Equal(t, "sensors/loadgen", topic)
+			published.Add(1)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, report.Streams, 2)
+	enqueue, telemetry := report.Streams[0], report.Streams[1]
+	assert.Equal(t, enqueued.Load(), enqueue.Sent)
+	assert.Positive(t, enqueue.Sent)
+	assert.Equal(t, enqueue.Sent, enqueue.Status[200]+enqueue.Status[429])
+	assert.Positive(t, enqueue.Status[429])
+	assert.Equal(t, published.Load(), telemetry.Sent)
+	assert.Positive(t, telemetry.Throughput)
+	assert.LessOrEqual(t, enqueue.P50, enqueue.Max)
+
+	var out bytes.Buffer
+	report.Print(&out)
+	assert.Contains(t, out.String(), "enqueue responses: 200=")
+}
+
+// TestRunNeedsAdmin checks that nothing is sent with a token that can't use the admin API
+func TestRunNeedsAdmin(t *testing.T) {
+	var enqueued atomic.Int64
+	srv := target(t, false, &enqueued)
+	_, err := Run(context.Background(), Config{BaseURL: srv.URL, Token: "secret", Duration: 100 * time.Millisecond, EnqueueRate: 50})
+	assert.ErrorIs(t, err, ErrNotAdmin)
+	assert.Zero(t, enqueued.Load())
+}
+
+// TestPercentile checks nearest-rank percentiles
+func TestPercentile(t *testing.T) {
+	var lat []time.Duration
+	for i := 1; i <= 100; i++ {
+		lat = append(lat, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, percentile(lat, 50))
+	assert.Equal(t, 99*time.Millisecond, percentile(lat, 99))
+	assert.Equal(t, time.Millisecond, percentile(lat[:1], 95))
+	assert.Zero(t, percentile(nil, 50))
+}
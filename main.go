@@ -3,38 +3,799 @@
 package main // Declares the package name
 
 import ( // Import required packages
+	"context"                    // Background context for secret refresh
+	"errors"                     // For checking server close errors
+	"flag"                       // Subcommand flags
+	"fmt"                        // Usage output
+	"go-mqtt-backend/billing"    // Stripe subscriptions
+	"go-mqtt-backend/chaos"      // Failure injection for resilience tests
 	"go-mqtt-backend/config"     // Project config management
 	"go-mqtt-backend/database"   // Database connection and setup
 	"go-mqtt-backend/handlers"   // HTTP handlers for API endpoints
+	"go-mqtt-backend/leader"     // Leader election across replicas
 	"go-mqtt-backend/middleware" // Middleware (e.g., authentication)
 	"go-mqtt-backend/mqtt"       // MQTT client logic
+	"go-mqtt-backend/notify"     // Email notifications
+	"go-mqtt-backend/realtime"   // Live updates over WebSocket
+	"go-mqtt-backend/scheduler"  // Background jobs
+	"go-mqtt-backend/secrets"    // External secrets backend
+	"go-mqtt-backend/services"   // Motor queue and quota logic
+	"go-mqtt-backend/store"      // Shared state backends
+	"go-mqtt-backend/supervisor" // Background goroutine supervision
+	"go-mqtt-backend/weather"    // Rain forecasts
+	"go-mqtt-backend/web"        // Embedded admin UI
 	"log"                        // Logging
+	"log/slog"                   // Leveled logging
+	"net/http"                   // HTTP server
+	"os"                         // Signal types
+	"os/signal"                  // Signal notifications
+	"strings"                    // Argument parsing
+	"syscall"                    // SIGHUP, SIGINT, SIGTERM
+	"time"                       // Shutdown timeout
 
-	"github.com/gin-gonic/gin" // Gin web framework
+	"github.com/gin-gonic/gin"          // Gin web framework
+	"golang.org/x/crypto/acme/autocert" // Let's Encrypt certificates
 )
 
 func main() { // Main function, program entry point
-	cfg := config.Load() // Load configuration (DB path, MQTT broker, JWT secret)
+	cmd, args := "serve", os.Args[1:]                      // Default to serving when no subcommand is given
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") { // First non-flag argument is the subcommand
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "serve":
+		runServe(args) // Run the HTTP server and queue processor
+	case "migrate":
+		runMigrate(args) // Create/update DB tables and exit
+	case "create-admin":
+		runCreateAdmin(args) // Create or promote an admin user
+	case "gen-token":
+		runGenToken(args) // Mint a long-lived service token
+	case "loadgen":
+		runLoadgen(args) // Load test a staging instance
+	case "help", "-h", "--help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() { // Prints the list of subcommands
+	fmt.Fprintln(os.Stderr, `usage: go-mqtt-backend <command> [flags]
+
+commands:
+  serve         run the API server (default)
+  migrate       create or update database tables
+  create-admin  create an admin user, or promote an existing one
+  gen-token     mint a JWT for an existing user (e.g. a service account)
+  loadgen       drive dry-run motor requests and telemetry at a staging instance
+
+Run "go-mqtt-backend <command> -h" for command flags.`)
+}
+
+// loadConfig reads the env file and secrets backend and returns the resulting config.
+// refresh starts the background secret refresh, which only long-running commands need.
+func loadConfig(refresh bool) *config.Config {
+	if err := config.LoadEnvFile(); err != nil { // Read .env if present
+		log.Fatal("env file error: ", err) // If error, log and exit
+	}
+	cfg := config.Load()             // Load configuration (DB path, MQTT broker, JWT secret)
+	return loadSecrets(cfg, refresh) // Overlay values from Vault / AWS Secrets Manager if configured
+}
+
+func runServe(args []string) { // Runs the API server
+	fs := flag.NewFlagSet("serve", flag.ExitOnError) // No serve flags yet, but reject unknown ones
+	fs.Parse(args)
+
+	cfg := loadConfig(true)                // Load configuration with secret refresh
+	if err := cfg.Validate(); err != nil { // Refuse insecure defaults in production
+		log.Fatal(err)
+	}
+	if cfg.IsProduction() && !cfg.TLSEnabled() { // Allowed (e.g. behind a TLS proxy) but worth flagging
+		log.Println("warning: serving plain HTTP in production; JWTs and passwords are not encrypted in transit")
+	}
+	slog.SetLogLoggerLevel(config.ParseLogLevel(cfg.LogLevel)) // Apply log level before anything logs
+	handlers.UseConfig(cfg)                                    // Handlers use this config instead of re-reading the environment
+	handlers.UseUserQuota(cfg.UserQuota)                       // Default per-user daily limit
+	handlers.UseAuthRateLimit(cfg.AuthRateLimit)               // Login and registration requests per client IP per minute
+	handlers.UseReload(reload)                                 // POST /admin/config/reload, as SIGHUP
+	middleware.UseUserCache(cfg.UserCacheTTL)                  // Roles and organizations checked on every request
+	handlers.UseHub(realtime.NewHub(cfg.RealtimeBuffer))       // Live updates for dashboards
 
 	if err := database.Connect(cfg.DBPath); err != nil { // Connect to the database
 		log.Fatal("DB connection error: ", err) // If error, log and exit
 	}
-	if err := mqtt.Connect(cfg.MQTTBroker); err != nil { // Connect to the MQTT broker
+	if cfg.CreateAdmin { // First admin from ADMIN_EMAIL and ADMIN_PASSWORD
+		if err := bootstrapAdmin(cfg.AdminEmail, cfg.AdminPassword); err != nil {
+			log.Fatal("admin bootstrap error: ", err)
+		}
+	}
+	if err := mqtt.Connect(cfg.MQTTBroker, mqttCredentials); err != nil { // Connect to the MQTT broker
 		log.Fatal("MQTT connection error: ", err) // If error, log and exit
 	}
+	mqtt.StartPublishers(cfg.MQTTPublishWorkers, cfg.MQTTPublishQueue) // Background publishes off the request path
+	state, queue, err := store.New(store.Options{                      // Queue and shutdown state (memory, Redis or the database)
+		Backend:       cfg.StateBackend,
+		QueueBackend:  cfg.QueueBackend,
+		QueueCapacity: cfg.QueueCapacity,
+		DB:            database.DB,
+		RedisAddr:     cfg.RedisAddr,
+		RedisPassword: cfg.RedisPassword,
+		RedisDB:       cfg.RedisDB,
+		RedisPrefix:   cfg.RedisPrefix,
+	})
+	if err != nil {
+		log.Fatal("state backend error: ", err)
+	}
+	motor := services.NewMotorService(services.MotorDeps{ // Queue, quota and shutdown logic
+		Queue:       queue,
+		State:       state,
+		Publisher:   mqtt.Publisher{}, // OFF goes out with QoS 1
+		Repo:        services.NewGormMotorRepository(database.DB),
+		Quota:       cfg.MotorQuota,
+		MaxDuration: cfg.MaxRequest, // Longest run one request may ask for
+		OnSession: func(ev services.SessionEvent) { // Tells the user when their run starts/ends, meters it and updates dashboards
+			handlers.MeterSession(ev)
+			handlers.NotifySession(ev)
+			handlers.PublishSession(ev)
+		},
+		OnQuota:          handlers.NotifyQuota, // Warns users as the daily quota runs out
+		QuotaWarn:        cfg.QuotaWarnPercents,
+		Hold:             handlers.QueueHold,          // Holds the queue while paused and during maintenance windows
+		Admit:            handlers.TenantQuotaAdmit,   // Enforces member limits and organization pools
+		Estimate:         handlers.EstimateActivation, // Energy, water and cost of each accepted request
+		AckWait:          cfg.MotorAckWait,            // How long the motor has to confirm ON/OFF
+		MaxRuntime:       cfg.MaxRuntime,              // Safety cutoff, independent of the quota
+		OnFault:          handlers.RecordFault,        // Logs faults and alerts admins
+		OffRetry:         cfg.OffRetry,                // OFF is resent until confirmed...
+		OffTimeout:       cfg.OffTimeout,              // ...then the motor is faulted
+		RestartApproval:  cfg.RestartApproval,         // Second admin needed to restart after a shutdown
+		Simulate:         cfg.SimulateMotor,           // Dry-run mode for staging and demos
+		CorrectiveOff:    cfg.CorrectiveOff,           // Watchdog follows a failed ON with OFF
+		Sequence:         cfg.CommandSequence,         // Replay protection, for firmware that checks it
+		HeartbeatTimeout: cfg.HeartbeatTimeout,        // Heartbeat gap that means the power went
+		OutagePolicy:     cfg.OutagePolicy,            // Cancel or resume a run after a power outage
+		ResumeWindow:     cfg.ResumeWindow,            // How long a run waits to resume
+		CrashPolicy:      cfg.CrashRecovery,           // Stop or resume a run the process died in
+		Backpressure: services.BackpressureConfig{ // Per-user limits while the queue is backed up
+			MaxDrain:  cfg.QueueMaxDrain,
+			UserLimit: cfg.QueueUserLimit,
+		},
+	})
+	handlers.UseMotorService(motor)
+	if err := handlers.UseLimits(context.Background(), limitsOf(cfg)); err != nil { // Quota limits an admin saved take the place of the environment's
+		log.Fatal("settings error: ", err)
+	}
+	if cfg.SimulateMotor {
+		log.Printf("dry-run mode: motor commands are simulated and never published to MQTT")
+	}
+	if n, err := motor.Restore(context.Background()); err != nil { // Re-queue requests saved at last shutdown
+		log.Fatal("restore motor queue error: ", err)
+	} else if n > 0 {
+		log.Printf("restored %d queued motor requests", n)
+	}
+	if sd, err := motor.RestoreShutdown(context.Background()); err != nil { // Never start up as if a shutdown had been cleared
+		log.Fatal("restore emergency shutdown error: ", err)
+	} else if sd.Active {
+		log.Printf("emergency shutdown still active since %s: %s (clear it with POST /admin/restart)", sd.Since.Format(time.RFC3339), sd.Summary())
+		if !sd.Until.IsZero() {
+			log.Printf("emergency shutdown is scheduled to end at %s", sd.Until.Format(time.RFC3339))
+		}
+	} else {
+		log.Printf("no emergency shutdown active")
+	}
+	if run, err := motor.RecoverSession(context.Background()); err != nil { // A run the last process died in the middle of
+		log.Fatal("recover running motor session error: ", err)
+	} else if run != nil && run.Resumed {
+		log.Printf("resumed the motor run of user %d started at %s: %s left", run.Request.UserID, run.StartedAt.Format(time.RFC3339), run.Remaining.Round(time.Second))
+	} else if run != nil {
+		log.Printf("stopped the motor run of user %d started at %s: %s", run.Request.UserID, run.StartedAt.Format(time.RFC3339), run.Reason)
+	}
 
-	r := gin.Default() // Create a new Gin router (web server)
+	elector := leader.New(state, "motor-queue", cfg.InstanceID, cfg.LeaderLease) // Only one replica drives the motor
+	handlers.UseElector(elector)
+	notifiers, err := newNotifiers(cfg, state) // Email, SMS, Telegram and push (each optional)
+	if err != nil {
+		log.Fatal("notifications error: ", err)
+	}
+	tasks, err := newSupervisor(motor, elector, notifiers) // Queue processor and other long-lived goroutines, restarted if they crash or stall
+	if err != nil {
+		log.Fatal("supervisor error: ", err)
+	}
+	handlers.UseSupervisor(tasks)
+	tasks.Start()
 
-	r.POST("/register", handlers.Register) // Public route: user registration
-	r.POST("/login", handlers.Login)       // Public route: user login
+	telemetry := handlers.Telemetry(cfg.TelemetryTopicPrefix, elector.IsLeader) // Sensor readings drive automation rules
+	if err := mqtt.Subscribe(cfg.TelemetryTopicPrefix+"#", telemetry); err != nil {
+		log.Fatal("MQTT subscribe error: ", err)
+	}
+	if err := mqtt.Subscribe("+/+/"+cfg.TelemetryTopicPrefix+"#", telemetry); err != nil { // Tenant devices: {org}/{device}/...
+		log.Fatal("MQTT subscribe error: ", err)
+	}
+	if err := mqtt.Subscribe(services.MotorStatusTopic, handlers.MotorStatusUpdate); err != nil { // Motor acks and faults
+		log.Fatal("MQTT subscribe error: ", err)
+	}
+	if err := mqtt.Subscribe("+/+/"+services.MotorStatusTopic, handlers.MotorStatusUpdate); err != nil { // Tenant devices' motors
+		log.Fatal("MQTT subscribe error: ", err)
+	}
+	if err := mqtt.Subscribe(services.EStopTopic, handlers.EmergencyStopButton); err != nil { // The emergency stop button on site
+		log.Fatal("MQTT subscribe error: ", err)
+	}
+	if cfg.ChaosMode { // Failure injection for resilience tests, once startup is done
+		injector := chaos.New(chaos.Config{PublishFailRate: cfg.ChaosPublishFailRate, AckDelayRate: cfg.ChaosAckDelayRate, AckDelay: cfg.ChaosAckDelay, DBErrorRate: cfg.ChaosDBErrorRate})
+		if err := injector.RegisterGORM(database.DB); err != nil {
+			log.Fatal("chaos mode error: ", err)
+		}
+		mqtt.UseChaos(injector)
+		handlers.UseChaos(injector)
+		log.Printf("CHAOS MODE: failing %g of MQTT publishes and %g of database calls, delaying %g of motor acks by %s",
+			cfg.ChaosPublishFailRate, cfg.ChaosDBErrorRate, cfg.ChaosAckDelayRate, cfg.ChaosAckDelay)
+	}
+	if cfg.OpenWeatherAPIKey != "" { // Rain forecasts for schedules that skip on rain
+		lat, lon, _, _ := cfg.SiteCoordinates() // Checked by Validate
+		handlers.UseWeather(&weather.OpenWeatherMap{APIKey: cfg.OpenWeatherAPIKey, Lat: lat, Lon: lon}, cfg.WeatherLookahead)
+	}
+	if cfg.StripeSecretKey != "" { // Self-service plan subscriptions
+		handlers.UseBilling(&billing.Stripe{SecretKey: cfg.StripeSecretKey, WebhookSecret: cfg.StripeWebhookSecret})
+	}
+
+	jobs, err := newScheduler(cfg, elector) // Background jobs (backups, history pruning, digests, ...)
+	if err != nil {
+		log.Fatal("scheduler error: ", err)
+	}
+	handlers.UseScheduler(jobs)
+	jobs.Start()
+
+	var reporter middleware.ErrorReporter // Error tracker for panics (optional)
+	if cfg.ErrorWebhookURL != "" {
+		reporter = &middleware.WebhookReporter{URL: cfg.ErrorWebhookURL}
+	}
+	r := gin.New()                                                  // Create a new Gin router (web server)
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil { // Only these may set X-Forwarded-For (none by default)
+		log.Fatal("trusted proxies error: ", err)
+	}
+	r.RemoteIPHeaders = cfg.ClientIPHeaders                   // Where ClientIP() looks when the peer is a trusted proxy
+	r.Use(middleware.RequestID())                             // X-Request-ID, carried into motor commands
+	r.Use(middleware.Logger(), middleware.Recovery(reporter)) // Request logging and panic recovery with error IDs
+	r.Use(middleware.BodyLimit(cfg.MaxBodyBytes))             // Cap request body size
+	r.Use(middleware.Gzip(cfg.GzipMinBytes))                  // Compress larger responses
+
+	authLimit := middleware.RateLimit(state, "auth", handlers.AuthRateLimit, time.Minute) // Slow down credential guessing
+	requestTimeout := middleware.Timeout(cfg.RequestTimeout)                              // Regular API calls
+	statusTimeout := middleware.Timeout(cfg.StatusTimeout)                                // Cheap reads should fail fast
+	control := handlers.ControlGuard                                                      // Running motors only from allowed networks or the geofence
+	if cfg.AllowRegistration {                                                            // Registration can be closed (always closed in production)
+		r.POST("/register", requestTimeout, authLimit, handlers.Register) // Public route: user registration
+	}
+	r.POST("/login", requestTimeout, authLimit, handlers.Login)                                      // Public route: user login
+	r.GET("/invitations/:token", requestTimeout, authLimit, handlers.GetInvitation)                  // Public route: who an invitation link is for
+	r.POST("/invitations/:token/accept", requestTimeout, authLimit, handlers.AcceptInvitationSignup) // Public route: join with a new account
+	r.POST("/webhooks/stripe", requestTimeout, handlers.StripeWebhook)                               // Public route: Stripe events (signature-verified)
+	r.GET("/healthz", handlers.Healthz)                                                              // Liveness probe
+	r.GET("/readyz", statusTimeout, handlers.Readyz)                                                 // Readiness probe (DB, broker, background goroutines)
+	r.GET("/metrics", handlers.Metrics)                                                              // Prometheus metrics
+
+	// Outside the api group, whose auth refuses tokens that must change their password first
+	r.PUT("/api/me/password", requestTimeout, authLimit, middleware.PasswordChangeAuth(cfg), middleware.Audit(), handlers.ChangePassword) // Protected: change the caller's password
 
-	api := r.Group("/api")               // Create a route group for protected endpoints
-	api.Use(middleware.AuthMiddleware()) // Apply JWT authentication middleware
+	// Outside the api group too: a long poll outlasts its request timeout
+	r.GET("/api/changes", middleware.AuthMiddleware(cfg), middleware.TenantMiddleware(), handlers.Changes) // Protected: long-poll for queue, session and device changes
+
+	api := r.Group("/api")                                                                                     // Create a route group for protected endpoints
+	api.Use(requestTimeout, middleware.AuthMiddleware(cfg), middleware.TenantMiddleware(), middleware.Audit()) // Apply request timeout, JWT authentication, the caller's organization and the audit trail
 	{
-		api.POST("/send", handlers.SendCommand)          // Protected: send MQTT command
-		api.GET("/device", handlers.GetDeviceData)       // Protected: get device data
-		api.POST("/motor", handlers.EnqueueMotorRequest) // Protected: enqueue motor request
+		api.POST("/send", handlers.SendCommand)                              // Protected: send MQTT command
+		api.GET("/device", statusTimeout, handlers.GetDeviceData)            // Protected: get device data
+		api.GET("/live", handlers.Realtime)                                  // Protected: live updates over WebSocket
+		api.POST("/motor", control, handlers.EnqueueMotorRequest)            // Protected: enqueue motor request
+		api.GET("/motor/rejected", handlers.ListRejectedRequests)            // Protected: the caller's requests that were dropped instead of run
+		api.GET("/motor/:id", handlers.GetMotorRequest)                      // Protected: queue position and estimated start of a request
+		api.DELETE("/motor/:id", handlers.CancelMotorRequest)                // Protected: withdraw a queued request (allowed from anywhere)
+		api.POST("/motor/stop", handlers.StopMotorRun)                       // Protected: switch off the caller's running session (allowed from anywhere)
+		api.POST("/motor/schedule", control, handlers.ScheduleMotorRequest)  // Protected: book a one-time run
+		api.GET("/motor/schedule", handlers.ListScheduledRequests)           // Protected: pending one-time runs
+		api.DELETE("/motor/schedule/:id", handlers.CancelScheduledRequest)   // Protected: cancel a pending one-time run
+		api.PUT("/me/phone", handlers.SetPhone)                              // Protected: set number for SMS notifications
+		api.PUT("/me/timezone", handlers.SetTimezone)                        // Protected: default time zone for schedules
+		api.POST("/me/telegram", handlers.LinkTelegram)                      // Protected: get a code to link a Telegram chat
+		api.DELETE("/me/telegram", handlers.UnlinkTelegram)                  // Protected: unlink Telegram
+		api.POST("/me/push-tokens", handlers.RegisterPushToken)              // Protected: register an app install for push
+		api.DELETE("/me/push-tokens/:token", handlers.DeletePushToken)       // Protected: forget an app install
+		api.GET("/me/notifications", handlers.GetNotificationPrefs)          // Protected: notification preferences
+		api.PUT("/me/notifications", handlers.UpdateNotificationPrefs)       // Protected: choose channels and quiet hours
+		api.GET("/schedules", handlers.ListSchedules)                        // Protected: list recurring runs
+		api.POST("/schedules", control, handlers.CreateSchedule)             // Protected: add a recurring run
+		api.GET("/schedules/upcoming", handlers.ListUpcomingRuns)            // Protected: calendar of planned runs
+		api.PUT("/schedules/:id", control, handlers.UpdateSchedule)          // Protected: replace a recurring run
+		api.DELETE("/schedules/:id", handlers.DeleteSchedule)                // Protected: delete a recurring run
+		api.GET("/schedules/:id/runs", handlers.ListScheduleRuns)            // Protected: run history of a schedule
+		api.POST("/schedules/:id/pause", handlers.PauseSchedule)             // Protected: skip runs until a time
+		api.DELETE("/schedules/:id/pause", control, handlers.ResumeSchedule) // Protected: end a pause early
+		api.POST("/schedules/:id/skip", handlers.SkipNextRun)                // Protected: skip just the next run
+		api.DELETE("/schedules/:id/skip", control, handlers.UndoSkip)        // Protected: restore a skipped run
+		api.GET("/rules", handlers.ListRules)                                // Protected: list sensor automation rules
+		api.POST("/rules", control, handlers.CreateRule)                     // Protected: add a rule
+		api.PUT("/rules/:id", control, handlers.UpdateRule)                  // Protected: replace a rule
+		api.DELETE("/rules/:id", handlers.DeleteRule)                        // Protected: delete a rule
+		api.GET("/rules/:id/runs", handlers.ListRuleRuns)                    // Protected: times a rule fired
+		api.GET("/org", handlers.GetOrganization)                            // Protected: the caller's organization and members
+		api.GET("/org/devices", handlers.ListDevices)                        // Protected: the organization's devices and their topics
+		api.GET("/org/devices/:id/telemetry", handlers.DeviceTelemetry)      // Protected: a device's stored readings, paged
+		api.GET("/me/history", handlers.History)                             // Protected: the caller's accepted motor requests, paged
+		api.POST("/invitations/:token/accept", handlers.AcceptInvitation)    // Protected: join an organization with the current account
+	}
+
+	orgAdmin := api.Group("/org", middleware.OrgAdminMiddleware()) // Org admins (and global admins) managing their own organization
+	{
+		orgAdmin.PUT("/users/:id", handlers.UpdateMember)                      // Change a member's role or daily limit
+		orgAdmin.DELETE("/users/:id", handlers.RemoveMember)                   // Move a member back to the default organization
+		orgAdmin.GET("/schedules", handlers.ListOrgSchedules)                  // Every member's schedules
+		orgAdmin.PUT("/schedules/:id/enabled", handlers.SetOrgScheduleEnabled) // Enable or disable a member's schedule
+		orgAdmin.DELETE("/schedules/:id", handlers.DeleteOrgSchedule)          // Delete a member's schedule
+		orgAdmin.POST("/devices", handlers.CreateDevice)                       // Register a device
+		orgAdmin.PUT("/devices/:id", handlers.UpdateDevice)                    // Set a device's pump ratings and tariffs
+		orgAdmin.DELETE("/devices/:id", handlers.DeleteDevice)                 // Remove a device and stop accepting its topics
+		orgAdmin.GET("/invitations", handlers.ListInvitations)                 // Pending invitations
+		orgAdmin.POST("/invitations", handlers.CreateInvitation)               // Invite someone by email
+		orgAdmin.DELETE("/invitations/:id", handlers.DeleteInvitation)         // Revoke a pending invitation
+		orgAdmin.GET("/export", handlers.ExportOrganization)                   // Download all of the organization's data
+		orgAdmin.GET("/usage/daily", handlers.DailyUsage)                      // Members' runs, energy and cost per day
+		orgAdmin.GET("/billing", handlers.GetBilling)                          // Plan and subscription status
+		orgAdmin.POST("/billing/checkout", handlers.CreateCheckout)            // Start a Stripe checkout for a plan
+		orgAdmin.POST("/billing/portal", handlers.CreateBillingPortal)         // Open the Stripe customer portal
+	}
+
+	r.StaticFS("/admin/ui", web.AdminUI()) // Admin dashboard (static; its API calls need an admin token)
+
+	admin := r.Group("/admin")                                                                                                        // Route group for admin-only endpoints
+	admin.Use(middleware.Timeout(cfg.AdminTimeout), middleware.AuthMiddleware(cfg), middleware.Audit(), middleware.AdminMiddleware()) // Require a valid JWT with the admin role; refused attempts are audited too
+	{
+		admin.GET("/status", statusTimeout, handlers.GetSystemStatus)        // Queue, quota, motor and shutdown state
+		admin.GET("/config/quota", handlers.GetQuotaConfig)                  // Motor quota, queue capacity and per-request limit in effect
+		admin.POST("/config/reload", handlers.ReloadConfig)                  // Re-read the env file, as SIGHUP
+		admin.PUT("/config/quota", handlers.SetQuotaConfig)                  // Change them without a redeploy
+		admin.POST("/shutdown", handlers.AdminForceShutdown)                 // Emergency shutdown
+		admin.POST("/restart", handlers.AdminRestart)                        // Clear emergency shutdown
+		admin.POST("/queue/pause", handlers.PauseQueue)                      // Stop dispatching new runs, keeping requests queued
+		admin.POST("/queue/resume", handlers.ResumeQueue)                    // Dispatch again
+		admin.POST("/devices/shutdown", handlers.AdminShutdownDevices)       // Shut down one device or a device group
+		admin.POST("/devices/restart", handlers.AdminRestartDevices)         // End a device or group shutdown
+		admin.POST("/motor/clear-fault", handlers.AdminClearFault)           // Return a faulted motor to OFF
+		admin.POST("/sessions/:id/stop", handlers.AdminStopSession)          // Switch off one running session and tell its owner
+		admin.POST("/jwt/rotate", handlers.RotateSigningKey)                 // New JWT secret; tokens signed before stay valid for a grace period
+		admin.GET("/motor/faults", handlers.ListFaults)                      // Recent motor faults
+		admin.GET("/anomalies", handlers.ListAnomalies)                      // Usage spikes, idle current draw, repeated ack timeouts
+		admin.GET("/motor/commands", handlers.ListPendingCommands)           // Commands awaiting an ack, stuck ones flagged
+		admin.GET("/jobs", handlers.GetJobs)                                 // Background jobs and run history
+		admin.GET("/audit", handlers.ListAuditLog)                           // Shutdowns, restarts and their approvals
+		admin.GET("/audit/shutdowns", handlers.ShutdownStats)                // Shutdowns per category
+		admin.GET("/audit/verify", handlers.VerifyAuditLog)                  // Check the audit log's hash chain
+		admin.GET("/maintenance", handlers.ListMaintenance)                  // Current and planned maintenance windows
+		admin.POST("/maintenance", handlers.CreateMaintenance)               // Plan a maintenance window
+		admin.DELETE("/maintenance/:id", handlers.DeleteMaintenance)         // Cancel or end a window
+		admin.GET("/organizations", handlers.ListOrganizations)              // Tenants with member counts
+		admin.POST("/organizations", handlers.CreateOrganization)            // Add a tenant
+		admin.PUT("/users/:id/organization", handlers.MoveUser)              // Move a user to another tenant
+		admin.PUT("/users/:id/quota", handlers.SetQuotaOverride)             // Give a user more or less motor time, for a while or for good
+		admin.DELETE("/users/:id/quota", handlers.DeleteQuotaOverride)       // End a user's quota override
+		admin.PUT("/users/:id/control", handlers.SetControlOverride)         // Let a user control motors from outside the allowed networks and geofence
+		admin.DELETE("/users/:id/control", handlers.DeleteControlOverride)   // End a user's control override
+		admin.PUT("/organizations/:id/quota", handlers.SetOrganizationQuota) // Set a tenant's shared daily pool
+		admin.GET("/plans", handlers.ListPlans)                              // Subscription plans and their limits
+		admin.PUT("/organizations/:id/plan", handlers.SetOrganizationPlan)   // Move a tenant to another plan
+		admin.GET("/usage", handlers.ExportUsage)                            // Monthly usage per tenant for invoicing (JSON or CSV)
+		admin.GET("/analytics", handlers.Analytics)                          // A run or telemetry metric grouped by chosen dimensions
+	}
+
+	srv := &http.Server{ // Explicit server so slow clients can't hold connections forever
+		Addr:              cfg.HTTPAddr,
+		Handler:           r,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	go func() {
+		if err := listen(srv, cfg); err != nil && !errors.Is(err, http.ErrServerClosed) { // Start the web server
+			log.Fatal("HTTP server error: ", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)                      // Wait for Ctrl+C or a service manager stop
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM) // Subscribe to termination signals
+	<-stop
+	log.Println("shutting down...")
+	shutdown(srv, jobs, tasks, motor, cfg.ShutdownTimeout)
+}
+
+func newSupervisor(motor *services.MotorService, elector *leader.Elector, notifiers []supervisor.Task) (*supervisor.Supervisor, error) { // Registers the supervised goroutines
+	s := supervisor.New()
+	err := s.Add(supervisor.Task{ // Dispatches queued motor requests while this replica is the leader
+		Name:       "motor-queue",
+		Run:        elector.Lead(motor.Run),
+		StallAfter: time.Minute,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.Add(supervisor.Task{ // Fails commands the device never confirmed
+		Name:       "command-watchdog",
+		Run:        elector.Lead(motor.Watch),
+		StallAfter: time.Minute,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.Add(supervisor.Task{ // Writes buffered sensor readings in batches
+		Name:       "telemetry-writer",
+		Run:        handlers.WriteTelemetry,
+		StallAfter: time.Minute,
+	})
+	if err != nil {
+		return nil, err
 	}
+	err = s.Add(supervisor.Task{ // Applies quota limits saved through other replicas
+		Name:       "settings-watch",
+		Run:        handlers.WatchSettings,
+		StallAfter: 5 * time.Minute,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.Add(supervisor.Task{ // Reload safe settings on SIGHUP
+		Name: "config-reload",
+		Run: func(ctx context.Context, beat func()) error {
+			return watchReload(ctx)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range notifiers {
+		if err := s.Add(t); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// newNotifiers registers each configured notification channel with the handlers and returns
+// the background tasks that deliver its queued messages, plus the admin alert watchers.
+func newNotifiers(cfg *config.Config, state store.State) ([]supervisor.Task, error) {
+	tasks := []supervisor.Task{{ // Alerts admins when this replica loses the broker
+		Name: "broker-watch",
+		Run:  handlers.WatchBroker(cfg.MQTTBroker, cfg.InstanceID, cfg.BrokerAlertAfter),
+	}}
+	if cfg.SMTPHost != "" { // Email
+		mailer := notify.NewMailer(notify.SMTPConfig{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.SMTPFrom,
+		}, 100)
+		handlers.UseNotifier(mailer)
+		handlers.UseMailer(mailer) // Invitation emails
+		tasks = append(tasks, supervisor.Task{Name: "mailer", Run: mailer.Run, StallAfter: 10 * time.Minute})
+	}
+	provider, err := notify.NewSMSProvider(notify.SMSOptions{ // SMS
+		Provider:         cfg.SMSProvider,
+		TwilioAccountSID: cfg.TwilioAccountSID,
+		TwilioAuthToken:  cfg.TwilioAuthToken,
+		TwilioFrom:       cfg.TwilioFrom,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if provider != nil {
+		texts := notify.NewSMSSender(provider, 100)
+		handlers.UseNotifier(texts)
+		tasks = append(tasks, supervisor.Task{Name: "sms", Run: texts.Run, StallAfter: 10 * time.Minute})
+	}
+	if cfg.WhatsAppToken != "" { // WhatsApp
+		wa := notify.NewWhatsAppSender(&notify.WhatsApp{
+			Token:            cfg.WhatsAppToken,
+			PhoneNumberID:    cfg.WhatsAppPhoneNumberID,
+			Template:         cfg.WhatsAppTemplate,
+			TemplateLanguage: cfg.WhatsAppTemplateLanguage,
+		}, 100)
+		handlers.UseNotifier(wa)
+		tasks = append(tasks, supervisor.Task{Name: "whatsapp", Run: wa.Run, StallAfter: 10 * time.Minute})
+	}
+	if cfg.TelegramBotToken != "" { // Telegram: outgoing queue plus one command poller across replicas
+		bot := notify.NewTelegramBot(&notify.Telegram{Token: cfg.TelegramBotToken}, 100, handlers.TelegramCommand)
+		poller := leader.New(state, "telegram-poll", cfg.InstanceID, cfg.LeaderLease) // Telegram allows one poller per bot
+		handlers.UseTelegram(bot)
+		handlers.UseNotifier(bot)
+		tasks = append(tasks,
+			supervisor.Task{Name: "telegram", Run: bot.Run, StallAfter: 10 * time.Minute},
+			supervisor.Task{Name: "telegram-poll", Run: poller.Lead(bot.Poll), StallAfter: time.Minute},
+		)
+	}
+	if cfg.FCMCredentialsFile != "" { // Push
+		key, err := os.ReadFile(cfg.FCMCredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		fcm, err := notify.NewFCM(key)
+		if err != nil {
+			return nil, err
+		}
+		events, err := notify.ParseEvents(cfg.PushEvents)
+		if err != nil {
+			return nil, err
+		}
+		pusher := notify.NewPusher(fcm, 500, events, handlers.ForgetPushToken)
+		handlers.UseNotifier(pusher)
+		tasks = append(tasks, supervisor.Task{Name: "push", Run: pusher.Run, StallAfter: 10 * time.Minute})
+	}
+	return tasks, nil
+}
+
+func newScheduler(cfg *config.Config, elector *leader.Elector) (*scheduler.Scheduler, error) { // Registers the built-in background jobs
+	s := scheduler.New(database.DB)
+	err := s.Add(scheduler.Job{ // Keep the job history table bounded
+		Name:   "prune-job-history",
+		Spec:   "@daily",
+		Jitter: 10 * time.Minute,
+		Run:    s.PruneHistory(time.Duration(cfg.JobHistoryDays) * 24 * time.Hour),
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.Add(scheduler.Job{ // Users' recurring motor runs
+		Name: "run-schedules",
+		Spec: "@every 1m",
+		Run: func(ctx context.Context) error {
+			if !elector.IsLeader() { // Queue each occurrence once
+				return nil
+			}
+			return handlers.RunSchedules(ctx)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.Add(scheduler.Job{ // Safety cutoff for motors switched on through the API
+		Name: "motor-cutoff",
+		Spec: "@every 1m",
+		Run: func(ctx context.Context) error {
+			if !elector.IsLeader() {
+				return nil
+			}
+			return handlers.CutoffManualRuns(ctx, cfg.MaxRuntime)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.Add(scheduler.Job{ // Ends shutdowns scheduled with an end time
+		Name: "expire-shutdown",
+		Spec: "@every 1m",
+		Run: func(ctx context.Context) error {
+			if !elector.IsLeader() { // Restart and notify once
+				return nil
+			}
+			return handlers.ExpireShutdown(ctx)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.Add(scheduler.Job{ // Opt-in activity digests
+		Name:   "send-digests",
+		Spec:   cfg.DigestSchedule,
+		Jitter: time.Minute,
+		Run: func(ctx context.Context) error {
+			if !elector.IsLeader() { // One replica sends, or users would get a copy per replica
+				return nil
+			}
+			return handlers.SendDigests(ctx)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.Add(scheduler.Job{ // Usage spikes and repeated ack timeouts
+		Name: "detect-anomalies",
+		Spec: "@every 10m",
+		Run: func(ctx context.Context) error {
+			if !elector.IsLeader() { // Flag and alert once
+				return nil
+			}
+			return handlers.DetectAnomalies(ctx)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.Add(scheduler.Job{ // Keep the telemetry table bounded
+		Name:   "prune-telemetry",
+		Spec:   "@daily",
+		Jitter: 10 * time.Minute,
+		Run: func(ctx context.Context) error {
+			if !elector.IsLeader() {
+				return nil
+			}
+			return handlers.PruneTelemetry(ctx)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = s.Add(scheduler.Job{ // Device counts for billing
+		Name: "meter-devices",
+		Spec: "@hourly",
+		Run: func(ctx context.Context) error {
+			if !elector.IsLeader() {
+				return nil
+			}
+			return handlers.MeterDevices(ctx)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BackupDir != "" { // Optional database backups
+		err = s.Add(scheduler.Job{
+			Name:   "backup-database",
+			Spec:   cfg.BackupSchedule,
+			Jitter: 5 * time.Minute,
+			Run: func(ctx context.Context) error {
+				return database.Backup(ctx, cfg.BackupDir, cfg.BackupKeep)
+			},
+		})
+	}
+	return s, err
+}
 
-	r.Run(":8080") // Start the web server on port 8080
+// listen serves plain HTTP, HTTPS with a configured cert/key, or HTTPS with Let's Encrypt
+// certificates obtained for ACME_DOMAIN.
+func listen(srv *http.Server, cfg *config.Config) error {
+	switch {
+	case cfg.ACMEDomain != "":
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEDomain), // Only request certs for our domain
+			Cache:      autocert.DirCache(cfg.ACMECacheDir),    // Persist certs across restarts
+			Email:      cfg.ACMEEmail,
+		}
+		srv.TLSConfig = m.TLSConfig() // Also answers TLS-ALPN-01 challenges
+		go func() {                   // HTTP-01 challenges, everything else redirected to HTTPS
+			if err := http.ListenAndServe(cfg.ACMEHTTPAddr, m.HTTPHandler(nil)); err != nil {
+				log.Printf("ACME HTTP listener: %v", err)
+			}
+		}()
+		log.Printf("listening on %s (HTTPS, ACME for %s)", cfg.HTTPAddr, cfg.ACMEDomain)
+		return srv.ListenAndServeTLS("", "")
+	case cfg.TLSCertFile != "":
+		log.Printf("listening on %s (HTTPS)", cfg.HTTPAddr)
+		return srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	default:
+		log.Printf("listening on %s", cfg.HTTPAddr)
+		return srv.ListenAndServe()
+	}
+}
+
+// shutdown stops the server in dependency order: no new requests, finish in-flight
+// handlers, stop the motor (OFF if running), save the queue, then close MQTT and the DB.
+func shutdown(srv *http.Server, jobs *scheduler.Scheduler, tasks *supervisor.Supervisor, motor *services.MotorService, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout) // Overall deadline
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil { // Stop accepting and drain in-flight requests
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	if err := tasks.Stop(ctx); err != nil { // Stop the queue processor (publishes OFF mid-session) and other goroutines
+		log.Printf("background tasks shutdown: %v", err)
+	}
+	if err := motor.Save(context.Background()); err != nil { // Persist pending requests and quota usage, even past the deadline
+		log.Printf("saving motor queue: %v", err)
+	}
+	if err := jobs.Stop(ctx); err != nil { // Cancel background jobs before the DB goes away
+		log.Printf("scheduler shutdown: %v", err)
+	}
+	if err := mqtt.StopPublishers(ctx); err != nil { // Send what is queued before disconnecting
+		log.Printf("MQTT publish queue shutdown: %v", err)
+	}
+	mqtt.Disconnect()                                                     // Flush and close the broker connection
+	if err := handlers.FlushTelemetry(context.Background()); err != nil { // Readings that arrived after the writer stopped, even past the deadline
+		log.Printf("writing telemetry: %v", err)
+	}
+	if err := database.Close(); err != nil { // Close the DB last
+		log.Printf("closing database: %v", err)
+	}
+	log.Println("shutdown complete")
+}
+
+// loadSecrets fetches secrets from the configured backend into the environment,
+// optionally starts the periodic refresh, and returns the config re-read with those values.
+func loadSecrets(cfg *config.Config, refresh bool) *config.Config {
+	provider, err := secrets.New(secrets.Options{
+		Backend:     cfg.SecretsBackend,
+		VaultAddr:   cfg.VaultAddr,
+		VaultToken:  cfg.VaultToken,
+		VaultPath:   cfg.VaultSecretPath,
+		AWSSecretID: cfg.AWSSecretID,
+	})
+	if err != nil {
+		log.Fatal("secrets backend error: ", err) // Misconfigured backend, refuse to start
+	}
+	if provider == nil { // No backend configured
+		return cfg
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secrets.FetchTimeout)
+	n, err := secrets.Apply(ctx, provider) // Initial fetch must succeed
+	cancel()
+	if err != nil {
+		log.Fatal("secrets fetch error: ", err)
+	}
+	log.Printf("loaded %d secrets from %s", n, provider.Name())
+	if refresh && cfg.SecretsRefresh > 0 { // Keep values fresh while running
+		go secrets.Refresh(context.Background(), provider, cfg.SecretsRefresh)
+	}
+	return config.Load() // Re-read so the fetched values take effect
+}
+
+func mqttCredentials() (string, string) { // Read broker credentials at (re)connect time
+	cfg := config.Load()
+	return cfg.MQTTUsername, cfg.MQTTPassword
+}
+
+// applyReloadable pushes the runtime-safe subset of the config into the running system.
+// DB path, broker address, JWT secret and notification channel credentials are
+// intentionally not touched here.
+func applyReloadable(ctx context.Context, cfg *config.Config, pushEvents map[string]bool) {
+	slog.SetLogLoggerLevel(config.ParseLogLevel(cfg.LogLevel))     // Update minimum log level
+	if err := handlers.UseLimits(ctx, limitsOf(cfg)); err != nil { // Update the quota, queue capacity and per-request limit
+		log.Printf("apply quota limits failed: %v", err)
+	}
+	handlers.UseUserQuota(cfg.UserQuota)                          // Update the default per-user limit
+	handlers.UseAuthRateLimit(cfg.AuthRateLimit)                  // Update the login and registration rate limit
+	handlers.UseNotifySettings(cfg.QuotaWarnPercents, pushEvents) // Update quota warning levels and pushed events
+}
+
+// reload reads the env file again and applies the runtime-safe settings, on SIGHUP and
+// POST /admin/config/reload. A config that doesn't validate leaves the running settings
+// alone. It returns a summary of what was applied.
+func reload(ctx context.Context) (string, error) {
+	if err := config.ReloadEnvFile(secrets.Owned); err != nil { // Pick up edits to the env file, but not over fetched secrets
+		return "", err
+	}
+	cfg := config.Load() // Re-read env vars
+	if err := cfg.Validate(); err != nil {
+		return "", err
+	}
+	pushEvents, err := notify.ParseEvents(cfg.PushEvents)
+	if err != nil {
+		return "", err
+	}
+	applyReloadable(ctx, cfg, pushEvents) // Apply without touching MQTT or the queue processor
+	return fmt.Sprintf("motor quota=%s user quota=%s queue capacity=%d max request=%s log level=%s auth rate limit=%d quota warnings=%v push events=%v",
+		cfg.MotorQuota, cfg.UserQuota, cfg.QueueCapacity, cfg.MaxRequest, cfg.LogLevel, cfg.AuthRateLimit, cfg.QuotaWarnPercents, cfg.PushEvents), nil
+}
+
+func limitsOf(cfg *config.Config) handlers.Limits { // Quota limits the environment sets
+	return handlers.Limits{MotorQuota: cfg.MotorQuota, QueueCapacity: cfg.QueueCapacity, MaxDuration: cfg.MaxRequest}
+}
+
+func watchReload(ctx context.Context) error { // Re-reads the env file each time the process receives SIGHUP
+	sighup := make(chan os.Signal, 1)     // Buffered so a signal isn't missed
+	signal.Notify(sighup, syscall.SIGHUP) // Subscribe to SIGHUP
+	defer signal.Stop(sighup)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sighup:
+		}
+		applied, err := reload(ctx)
+		if err != nil {
+			log.Printf("config reload failed: %v", err) // Keep running with the old values
+			continue
+		}
+		log.Printf("config reloaded: %s", applied)
+	}
 }
@@ -0,0 +1,104 @@
+// audit.go - Audit trail middleware for mutating API calls
+
+package middleware // Declares the package name
+
+import ( // Import required packages
+	"bytes"                    // Re-reading the body
+	"context"                  // For the write after the response
+	"encoding/json"            // Body summaries
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Audit log model
+	"io"                       // Reading the body
+	"log/slog"                 // Leveled logging
+	"net/http"                 // HTTP methods
+	"sort"                     // Stable summaries
+	"strings"                  // Redaction
+	"time"                     // Timestamps
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+const AuditRequest = "request" // Action of the entries Audit records
+
+const auditDetailMax = 512 // Size of AuditLog.Detail
+
+var auditRedact = []string{"password", "token", "secret", "key", "code"} // Body fields whose values never reach the audit log
+
+// Audit records every POST, PUT, PATCH and DELETE in the group in the audit log once the
+// handler is done: who (userID, so use it after AuthMiddleware), the route, a summary of
+// the request (path parameters and body fields, secrets redacted) and the response status.
+// Handlers still record the actions they know more about, e.g. a shutdown's category.
+func Audit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			c.Next()
+			return
+		}
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = io.ReadAll(c.Request.Body) // Already capped by BodyLimit
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		c.Next()
+		route := c.FullPath()
+		if route == "" { // No route matched
+			route = c.Request.URL.Path
+		}
+		entry := models.AuditLog{
+			UserID: c.GetUint("userID"),
+			Action: AuditRequest,
+			Method: c.Request.Method,
+			Route:  route,
+			Status: c.Writer.Status(),
+			Detail: requestSummary(c.Params, body),
+			At:     time.Now(),
+		}
+		ctx := context.WithoutCancel(c.Request.Context()) // Recorded even if the request timed out
+		if err := database.AppendAudit(ctx, &entry); err != nil {
+			slog.Error("record audit entry failed", "action", entry.Action, "route", entry.Route, "user_id", entry.UserID, "error", err)
+		}
+	}
+}
+
+// requestSummary describes a request for the audit log: its path parameters and the
+// fields of a JSON object body, with secret values redacted, cut to fit.
+func requestSummary(params gin.Params, body []byte) string {
+	var parts []string
+	for _, p := range params {
+		parts = append(parts, p.Key+"="+p.Value)
+	}
+	var fields map[string]any
+	if len(body) > 0 && json.Unmarshal(body, &fields) == nil {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			value, _ := json.Marshal(fields[k])
+			if redacted(k) {
+				value = []byte(`"[redacted]"`)
+			}
+			parts = append(parts, k+"="+string(value))
+		}
+	} else if len(body) > 0 {
+		parts = append(parts, "body not JSON")
+	}
+	summary := strings.Join(parts, " ")
+	if len(summary) > auditDetailMax {
+		summary = strings.ToValidUTF8(summary[:auditDetailMax-3], "") + "..."
+	}
+	return summary
+}
+
+func redacted(field string) bool { // Reports whether field's value is a secret
+	field = strings.ToLower(field)
+	for _, s := range auditRedact {
+		if strings.Contains(field, s) {
+			return true
+		}
+	}
+	return false
+}
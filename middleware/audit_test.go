@@ -0,0 +1,60 @@
+// audit_test.go - Tests for the audit trail middleware
+// Run with: go test ./...
+
+package middleware
+
+import (
+	"bytes"                    // Request bodies
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Audit log model
+	"net/http"                 // HTTP status codes
+	"net/http/httptest"        // HTTP test helpers
+	"testing"                  // Go's testing package
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite" // In-memory database
+	"gorm.io/gorm"
+)
+
+// TestAudit checks that mutating calls are recorded with their result and secrets redacted,
+// and that reads are not
+func TestAudit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.AuditLog{}))
+	database.DB = db
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("userID", uint(7)) }, Audit())
+	r.POST("/api/me/password", func(c *gin.Context) {
+		var in map[string]any
+		require.NoError(t, c.ShouldBindJSON(&in)) // The handler still gets the body
+		c.Status(http.StatusNoContent)
+	})
+	r.DELETE("/api/motor/schedule/:id", func(c *gin.Context) { c.Status(http.StatusNotFound) })
+	r.GET("/api/me", func(c *gin.Context) { c.Status(http.StatusOK) })
+	for _, call := range []struct{ method, path, body string }{
+		{"POST", "/api/me/password", `{"old_password":"hunter2","new_password":"hunter3","logout":true}`},
+		{"DELETE", "/api/motor/schedule/5", ""},
+		{"GET", "/api/me", ""},
+	} {
+		req, _ := http.NewRequest(call.method, call.path, bytes.NewBufferString(call.body))
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	var entries []models.AuditLog
+	require.NoError(t, db.Order("id").Find(&entries).Error)
+	require.Len(t, entries, 2)
+	assert.Equal(t, uint(7), entries[0].UserID)
+	assert.Equal(t, AuditRequest, entries[0].Action)
+	assert.Equal(t, "/api/me/password", entries[0].Route)
+	assert.Equal(t, http.StatusNoContent, entries[0].Status)
+	assert.Equal(t, `logout=true new_password="[redacted]" old_password="[redacted]"`, entries[0].Detail)
+	assert.Equal(t, "DELETE", entries[1].Method)
+	assert.Equal(t, "/api/motor/schedule/:id", entries[1].Route)
+	assert.Equal(t, http.StatusNotFound, entries[1].Status)
+	assert.Equal(t, "id=5", entries[1].Detail)
+}
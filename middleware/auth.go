@@ -3,7 +3,9 @@
 package middleware // Declares the package name
 
 import ( // Import required packages
+	"errors"                 // Retired keys
 	"go-mqtt-backend/config" // Project config
+	"go-mqtt-backend/models" // User model
 	"net/http"               // HTTP status codes
 	"strings"                // String operations
 
@@ -11,18 +13,31 @@ import ( // Import required packages
 	"github.com/golang-jwt/jwt/v5" // JWT library
 )
 
-func AuthMiddleware() gin.HandlerFunc { // Returns a Gin middleware function
+func AuthMiddleware(cfg *config.Config) gin.HandlerFunc { // Returns a Gin middleware verifying JWTs signed with cfg.JWTSecret or a key it was rotated to
+	return authenticate(cfg, false)
+}
+
+// PasswordChangeAuth is AuthMiddleware for changing the password: it also accepts the
+// tokens of users who must change theirs before they can do anything else.
+func PasswordChangeAuth(cfg *config.Config) gin.HandlerFunc {
+	return authenticate(cfg, true)
+}
+
+func authenticate(cfg *config.Config, passwordChange bool) gin.HandlerFunc {
 	return func(c *gin.Context) { // Middleware handler
-		header := c.GetHeader("Authorization")                     // Get Authorization header
-		if header == "" || !strings.HasPrefix(header, "Bearer ") { // If missing or invalid
+		tokenStr, ok := bearerToken(c) // Get the token
+		if !ok {                       // If missing or invalid
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid token"}) // Return 401
 			return
 		}
-		tokenStr := strings.TrimPrefix(header, "Bearer ")                               // Remove 'Bearer ' prefix
-		cfg := config.Load()                                                            // Load config for JWT secret
 		token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) { // Parse JWT
-			return []byte(cfg.JWTSecret), nil // Provide secret key
-		})
+			kid, _ := token.Header["kid"].(string)
+			key, ok := verificationKey(c.Request.Context(), kid, cfg.JWTSecret) // Key the token names, if still accepted
+			if !ok {
+				return nil, errors.New("signing key retired")
+			}
+			return key, nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 		if err != nil || !token.Valid { // If invalid
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"}) // Return 401
 			return
@@ -35,6 +50,10 @@ func AuthMiddleware() gin.HandlerFunc { // Returns a Gin middleware function
 				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid user ID in token"})
 				return
 			}
+			if mustChange, _ := claims["pwd_change"].(bool); mustChange && !passwordChange {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "password change required", "password_change_required": true})
+				return
+			}
 			c.Set("userID", uint(userIDFloat)) // or c.Set("userID", uint(userIDFloat))
 			c.Next()
 		} else {
@@ -44,3 +63,68 @@ func AuthMiddleware() gin.HandlerFunc { // Returns a Gin middleware function
 		c.Next() // Continue to next handler
 	}
 }
+
+// bearerToken returns the token from the Authorization header or, for a WebSocket upgrade
+// (browsers can't set headers on those), from "Sec-WebSocket-Protocol: bearer, <token>".
+func bearerToken(c *gin.Context) (string, bool) {
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer "), true
+	}
+	if !strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		return "", false
+	}
+	protocols := strings.Split(c.GetHeader("Sec-WebSocket-Protocol"), ",")
+	if len(protocols) != 2 || strings.TrimSpace(protocols[0]) != "bearer" {
+		return "", false
+	}
+	return strings.TrimSpace(protocols[1]), true
+}
+
+func AdminMiddleware() gin.HandlerFunc { // Returns a middleware allowing only admins (use after AuthMiddleware)
+	return func(c *gin.Context) {
+		userID, exists := c.Get("userID") // Set by AuthMiddleware
+		if !exists {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing user"})
+			return
+		}
+		user, err := LookupUser(c.Request.Context(), userID.(uint)) // Look up the current role
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+			return
+		}
+		if user.Role != models.RoleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// OrgAdminMiddleware allows org admins, and global admins, to manage their own organization
+// (use after TenantMiddleware, which scopes them to it).
+func OrgAdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := LookupUser(c.Request.Context(), c.MustGet("userID").(uint))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+			return
+		}
+		if user.Role != models.RoleOrgAdmin && user.Role != models.RoleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "organization admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func TenantMiddleware() gin.HandlerFunc { // Returns a middleware setting orgID to the caller's organization (use after AuthMiddleware)
+	return func(c *gin.Context) {
+		user, err := LookupUser(c.Request.Context(), c.MustGet("userID").(uint)) // Looked up (and invalidated on moves) so moving a user takes effect at once
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+			return
+		}
+		c.Set("orgID", user.OrganizationID)
+		c.Next()
+	}
+}
@@ -0,0 +1,97 @@
+// auth_test.go - Tests for the JWT authentication middleware
+// Run with: go test ./...
+
+package middleware
+
+import (
+	"go-mqtt-backend/config"   // Project config
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User model
+	"net/http"                 // HTTP status codes
+	"net/http/httptest"        // HTTP test helpers
+	"testing"                  // Go's testing package
+	"time"                     // For token expiry
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/golang-jwt/jwt/v5"       // JWT library
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite" // In-memory database
+	"gorm.io/gorm"
+)
+
+// signToken returns a token for user 7 signed with secret
+func signToken(secret string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": 7,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	s, _ := token.SignedString([]byte(secret))
+	return s
+}
+
+// TestAuthMiddlewareUsesInjectedSecret checks that tokens are verified against the injected
+// config rather than whatever JWT_SECRET the environment holds
+func TestAuthMiddlewareUsesInjectedSecret(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("JWT_SECRET", "env-secret") // Must be ignored
+	r := gin.New()
+	r.Use(AuthMiddleware(&config.Config{JWTSecret: "injected-secret"}))
+	r.GET("/me", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"user_id": c.GetUint("userID")}) })
+
+	for secret, want := range map[string]int{"injected-secret": http.StatusOK, "env-secret": http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+signToken(secret))
+		r.ServeHTTP(w, req)
+		assert.Equal(t, want, w.Code, secret)
+	}
+}
+
+// TestAuthMiddlewareWebSocketToken checks that a WebSocket upgrade may carry the token as
+// a subprotocol, and that other requests may not
+func TestAuthMiddlewareWebSocketToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(AuthMiddleware(&config.Config{JWTSecret: "secret"}))
+	r.GET("/api/live", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for upgrade, want := range map[string]int{"websocket": http.StatusOK, "": http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/live", nil)
+		req.Header.Set("Upgrade", upgrade)
+		req.Header.Set("Sec-WebSocket-Protocol", "bearer, "+signToken("secret"))
+		r.ServeHTTP(w, req)
+		assert.Equal(t, want, w.Code, upgrade)
+	}
+}
+
+// TestAdminMiddlewareCachesRole checks that a role change isn't seen until the cached entry
+// is invalidated
+func TestAdminMiddlewareCachesRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.User{}))
+	database.DB = db
+	UseUserCache(time.Minute)
+	defer UseUserCache(0)
+	user := models.User{Email: "a@example.com", Password: "x", Role: models.RoleAdmin}
+	require.NoError(t, db.Create(&user).Error)
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("userID", user.ID) }, AdminMiddleware())
+	r.GET("/admin", func(c *gin.Context) { c.Status(http.StatusOK) })
+	get := func() int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin", nil)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get())
+	require.NoError(t, db.Model(&user).Update("role", models.RoleUser).Error)
+	assert.Equal(t, http.StatusOK, get(), "still cached")
+	InvalidateUser(user.ID)
+	assert.Equal(t, http.StatusForbidden, get())
+}
@@ -0,0 +1,131 @@
+// gzip.go - Response compression middleware
+//
+// Responses are gzipped for clients that accept it once they pass a minimum size; smaller
+// ones aren't worth the CPU. The start of the body is held back until that size is reached
+// or the handler flushes, so the decision is made before the headers go out. Bodies that
+// are already compressed (zip archives, images) and WebSocket upgrades are left alone.
+
+package middleware // Declares the package name
+
+import ( // Import required packages
+	"bytes"         // Held-back start of the body
+	"compress/gzip" // Compression
+	"net/http"      // Headers
+	"strings"       // Header matching
+	"sync"          // Writer pool
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+var gzipPool = sync.Pool{New: func() any { // Compressors are reused; each holds a few hundred KiB
+	w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed) // The Pi's CPU matters more than the last few percent
+	return w
+}}
+
+var precompressed = []string{"application/zip", "application/gzip", "image/", "video/", "font/woff"} // Content types gzip can't shrink
+
+// Gzip compresses responses of at least minSize bytes for clients that send
+// Accept-Encoding: gzip. minSize <= 0 turns compression off.
+func Gzip(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if minSize <= 0 || !strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") || c.GetHeader("Upgrade") != "" {
+			c.Next()
+			return
+		}
+		w := &gzipWriter{ResponseWriter: c.Writer, minSize: minSize}
+		c.Writer = w
+		defer func() {
+			w.close()
+			c.Writer = w.ResponseWriter // Logging sees the bytes actually sent
+		}()
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		c.Next()
+	}
+}
+
+type gzipWriter struct { // Wraps the response, deciding on compression at minSize
+	gin.ResponseWriter
+	minSize int
+	buf     bytes.Buffer // Body held back until the decision
+	gz      *gzip.Writer // Set once compressing
+	decided bool
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		if w.buf.Len()+len(p) < w.minSize {
+			return w.buf.Write(p)
+		}
+		w.decide(true)
+		if err := w.flushBuf(); err != nil {
+			return 0, err
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) { return w.Write([]byte(s)) }
+
+func (w *gzipWriter) Written() bool { return w.buf.Len() > 0 || w.ResponseWriter.Written() } // Held-back bytes count
+
+func (w *gzipWriter) Flush() { // Streams commit to compression at their first flush
+	if !w.decided {
+		w.decide(w.buf.Len() > 0)
+		w.flushBuf()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *gzipWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter } // For http.ResponseController
+
+// decide compresses the rest of the response if big is set and its headers allow it.
+func (w *gzipWriter) decide(big bool) {
+	w.decided = true
+	h := w.Header()
+	if !big || h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" || w.Status() == http.StatusPartialContent {
+		return
+	}
+	ct := h.Get("Content-Type")
+	for _, p := range precompressed {
+		if strings.HasPrefix(ct, p) {
+			return
+		}
+	}
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	w.gz = gzipPool.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+}
+
+func (w *gzipWriter) flushBuf() error { // Sends the held-back bytes
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
+
+func (w *gzipWriter) close() { // Ends the response: a small body goes out as it is
+	if !w.decided {
+		w.decide(false)
+		w.flushBuf()
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		w.gz.Reset(nil)
+		gzipPool.Put(w.gz)
+		w.gz = nil
+	}
+}
@@ -0,0 +1,75 @@
+// gzip_test.go - Tests for the response compression middleware
+// Run with: go test ./...
+
+package middleware
+
+import (
+	"compress/gzip"     // For decoding the response
+	"io"                // Reading the body
+	"net/http"          // HTTP status codes
+	"net/http/httptest" // HTTP test helpers
+	"strings"           // Bodies
+	"testing"           // Go's testing package
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestGzip checks that large responses are compressed for clients that accept it, and
+// small, already compressed or unaccepted ones aren't
+func TestGzip(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	big := strings.Repeat("pump on, pump off\n", 200)
+	r := gin.New()
+	r.Use(Gzip(1024))
+	r.GET("/big", func(c *gin.Context) { c.String(http.StatusOK, big) })
+	r.GET("/small", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	r.GET("/zip", func(c *gin.Context) { c.Data(http.StatusOK, "application/zip", []byte(big)) })
+	r.GET("/stream", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		for i := 0; i < 3; i++ {
+			c.Writer.WriteString("row\n")
+			c.Writer.Flush()
+		}
+	})
+	get := func(path string, gz bool) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		if gz {
+			req.Header.Set("Accept-Encoding", "gzip, deflate")
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	unzip := func(w *httptest.ResponseRecorder) string {
+		zr, err := gzip.NewReader(w.Body)
+		require.NoError(t, err)
+		out, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		return string(out)
+	}
+
+	w := get("/big", true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Less(t, w.Body.Len(), len(big))
+	assert.Equal(t, big, unzip(w))
+
+	w = get("/big", false)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, big, w.Body.String())
+
+	w = get("/small", true)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "ok", w.Body.String())
+
+	w = get("/zip", true)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, big, w.Body.String())
+
+	w = get("/stream", true) // Compressed from the first flush
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "row\nrow\nrow\n", unzip(w))
+}
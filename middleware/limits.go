@@ -0,0 +1,20 @@
+// limits.go - Request size limiting middleware
+
+package middleware // Declares the package name
+
+import ( // Import required packages
+	"net/http" // HTTP helpers
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+func BodyLimit(maxBytes int64) gin.HandlerFunc { // Returns a middleware that caps the request body size
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > maxBytes { // Reject early when the client declares a large body
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body too large"})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes) // Enforce the cap while reading
+		c.Next()
+	}
+}
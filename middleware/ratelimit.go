@@ -0,0 +1,36 @@
+// ratelimit.go - Fixed-window rate limiting middleware
+
+package middleware // Declares the package name
+
+import ( // Import required packages
+	"go-mqtt-backend/store" // Shared rate limit counters
+	"log"                   // Logging
+	"net/http"              // HTTP status codes
+	"time"                  // For window length
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+// RateLimit allows at most limit() requests per client IP per window for the routes it
+// is attached to. Counters live in the shared state, so replicas enforce one limit. limit
+// is read on every request, so it can change at runtime, e.g. on a config reload.
+func RateLimit(state store.State, name string, limit func() int, window time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := limit()
+		if limit <= 0 { // Disabled
+			c.Next()
+			return
+		}
+		allowed, err := state.Allow(c.Request.Context(), name+":"+c.ClientIP(), limit, window)
+		if err != nil { // Fail open: a state backend hiccup shouldn't lock everyone out
+			log.Printf("rate limit check failed: %v", err)
+			c.Next()
+			return
+		}
+		if !allowed {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many requests, slow down"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,41 @@
+// recovery_test.go - Tests for the panic recovery middleware
+// Run with: go test ./...
+
+package middleware
+
+import (
+	"encoding/json"     // For decoding the response
+	"net/http"          // HTTP status codes
+	"net/http/httptest" // HTTP test helpers
+	"testing"           // Go's testing package
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+)
+
+type captureReporter struct{ reports []PanicReport } // Records reports instead of sending them
+
+func (r *captureReporter) Report(report PanicReport) { r.reports = append(r.reports, report) }
+
+// TestRecoveryReturnsErrorID checks that a panic becomes a 500 with an ID matching the report
+func TestRecoveryReturnsErrorID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	reporter := &captureReporter{}
+	r := gin.New()
+	r.Use(Recovery(reporter))
+	r.GET("/boom", func(c *gin.Context) { panic("kaboom") })
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/boom", nil)
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	var body map[string]string
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.NotEmpty(t, body["error_id"])
+	if assert.Len(t, reporter.reports, 1) {
+		assert.Equal(t, body["error_id"], reporter.reports[0].ErrorID)
+		assert.Equal(t, "kaboom", reporter.reports[0].Panic)
+		assert.Equal(t, "/boom", reporter.reports[0].Path)
+	}
+}
@@ -0,0 +1,46 @@
+// requestid.go - Request IDs for tracing an API call through to the devices
+//
+// Every request gets an ID: the X-Request-ID the caller (or a proxy in front) sent, if it
+// is a sensible one, a fresh random one otherwise. It is returned in the X-Request-ID
+// header, logged with the request, and carried in the request's context, so the motor
+// commands the call sends are tagged with it and the device's reports are logged with it.
+// A "pump didn't turn on" complaint quoting the header can be followed from the API call
+// to the firmware's response.
+
+package middleware // Declares the package name
+
+import ( // Import required packages
+	"fmt"                      // Log lines
+	"go-mqtt-backend/services" // Request ID context
+	"regexp"                   // ID validation
+	"time"                     // Log timestamps
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+const RequestIDHeader = "X-Request-ID" // Header the request ID is taken from and returned in
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`) // IDs safe to log and echo
+
+// RequestID gives each request its ID, as c.GetString("requestID") and in the request's
+// context (services.RequestID). Register it before Logger.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) { // Missing, or not something to pass on
+			id = newErrorID()
+		}
+		c.Set("requestID", id)
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(services.WithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+// Logger is gin's request log with each line ending in the request's ID.
+func Logger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(p gin.LogFormatterParams) string {
+		return fmt.Sprintf("[GIN] %s | %3d | %13v | %15s | %-7s %#v | request_id=%v\n%s",
+			p.TimeStamp.Format("2006/01/02 - 15:04:05"), p.StatusCode, p.Latency.Truncate(time.Microsecond), p.ClientIP, p.Method, p.Path, p.Keys["requestID"], p.ErrorMessage)
+	})
+}
@@ -0,0 +1,49 @@
+// requestid_test.go - Tests for the request ID middleware
+// Run with: go test ./...
+
+package middleware
+
+import (
+	"go-mqtt-backend/services" // Request ID context
+	"net/http"                 // HTTP status codes
+	"net/http/httptest"        // HTTP test helpers
+	"testing"                  // Go's testing package
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/stretchr/testify/assert" // For assertions
+)
+
+// TestRequestID checks that a caller's sensible X-Request-ID is kept, anything else is
+// replaced by a fresh one, and handlers see it in the context
+func TestRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(RequestID())
+	r.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("requestID")+" "+services.RequestID(c.Request.Context()))
+	})
+	get := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("proxy-7f3a.1")
+	assert.Equal(t, "proxy-7f3a.1", w.Header().Get(RequestIDHeader))
+	assert.Equal(t, "proxy-7f3a.1 proxy-7f3a.1", w.Body.String())
+
+	w = get("")
+	id := w.Header().Get(RequestIDHeader)
+	assert.Len(t, id, 16)
+	assert.Equal(t, id+" "+id, w.Body.String())
+	assert.NotEqual(t, id, get("").Header().Get(RequestIDHeader))
+
+	for _, bad := range []string{"has space", "line\nbreak", string(make([]byte, 65))} {
+		id := get(bad).Header().Get(RequestIDHeader)
+		assert.Len(t, id, 16, "replaces %q", bad)
+	}
+}
@@ -0,0 +1,142 @@
+// signingkeys.go - JWT signing keys and their rotation
+//
+// Tokens are signed with the newest key in signing_keys and name it in their "kid"
+// header. RotateSigningKey replaces it with a fresh random key; the keys it replaces are
+// still accepted for a grace period, so field workers stay signed in until their next
+// login. Before the first rotation JWT_SECRET signs, in tokens without a kid. Keys are
+// cached for signingKeysTTL, so other replicas start signing with a new key within that;
+// a token naming a key they haven't seen yet makes them look again at once.
+
+package middleware // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"crypto/rand"              // New secrets
+	"encoding/hex"             // Secret encoding
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Signing key model
+	"log/slog"                 // Leveled logging
+	"strconv"                  // Key IDs
+	"sync"                     // For mutex (thread safety)
+	"time"                     // Expiry
+
+	"gorm.io/gorm" // Transactions
+)
+
+const (
+	signingKeysTTL    = time.Minute // How long the loaded keys are trusted
+	signingKeysReload = time.Second // Least time between lookups for a key not loaded yet
+)
+
+var signingKeys = struct {
+	sync.Mutex
+	keys   []models.SigningKey // Accepted keys, newest first
+	loaded time.Time           // When keys was read (zero: never, or invalidated)
+}{}
+
+// loadSigningKeys returns the accepted keys, reading them again if they are older than
+// maxAge. A failed read keeps the keys read before.
+func loadSigningKeys(ctx context.Context, maxAge time.Duration) []models.SigningKey {
+	signingKeys.Lock()
+	defer signingKeys.Unlock()
+	now := time.Now()
+	if now.Sub(signingKeys.loaded) < maxAge || database.DB == nil {
+		return signingKeys.keys
+	}
+	var keys []models.SigningKey
+	err := database.DB.WithContext(ctx).Where("retires_at IS NULL OR retires_at > ?", now).Order("id DESC").Find(&keys).Error
+	signingKeys.loaded = now // Don't hammer a failing database
+	if err != nil {
+		slog.Error("load JWT signing keys failed", "error", err)
+		return signingKeys.keys
+	}
+	signingKeys.keys = keys
+	return keys
+}
+
+// SigningKey returns the key new tokens are signed with and its kid: the newest generated
+// key, or secret (JWT_SECRET) with an empty kid until the first rotation.
+func SigningKey(ctx context.Context, secret string) (string, []byte) {
+	for _, k := range loadSigningKeys(ctx, signingKeysTTL) {
+		if k.RetiresAt == nil {
+			return strconv.FormatUint(uint64(k.ID), 10), decodeKey(k, secret)
+		}
+	}
+	return "", []byte(secret)
+}
+
+// verificationKey returns the key a token naming kid was signed with, if it is still
+// accepted. An empty kid is JWT_SECRET (secret): accepted until it is rotated out and for
+// the grace period after.
+func verificationKey(ctx context.Context, kid, secret string) ([]byte, bool) {
+	if key, found, ok := findKey(loadSigningKeys(ctx, signingKeysTTL), kid, secret); found {
+		return key, ok
+	}
+	key, _, ok := findKey(loadSigningKeys(ctx, signingKeysReload), kid, secret) // Perhaps rotated on another replica
+	return key, ok
+}
+
+// findKey looks kid up in keys. found reports whether keys settle it, ok whether the key
+// is accepted.
+func findKey(keys []models.SigningKey, kid, secret string) (key []byte, found, ok bool) {
+	now := time.Now()
+	for _, k := range keys {
+		accepted := k.RetiresAt == nil || now.Before(*k.RetiresAt)
+		if kid == "" && k.Secret == "" {
+			return []byte(secret), true, accepted
+		}
+		if kid != "" && strconv.FormatUint(uint64(k.ID), 10) == kid {
+			return decodeKey(k, secret), true, accepted
+		}
+	}
+	if kid == "" {
+		return []byte(secret), len(keys) == 0, len(keys) == 0 // JWT_SECRET still signs
+	}
+	return nil, false, false
+}
+
+func decodeKey(k models.SigningKey, secret string) []byte { // The secret of k
+	if k.Secret == "" {
+		return []byte(secret)
+	}
+	key, _ := hex.DecodeString(k.Secret)
+	return key
+}
+
+// RotateSigningKey generates a new key to sign tokens with. Tokens signed with the keys
+// before it stay valid for grace (0 ends them at once, e.g. after a leak), but never
+// longer than they already would. It returns the new key and when the old ones retire.
+func RotateSigningKey(ctx context.Context, grace time.Duration) (models.SigningKey, time.Time, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return models.SigningKey{}, time.Time{}, err
+	}
+	now := time.Now()
+	retires := now.Add(grace)
+	key := models.SigningKey{Secret: hex.EncodeToString(secret), CreatedAt: now}
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var n int64
+		if err := tx.Model(&models.SigningKey{}).Count(&n).Error; err != nil {
+			return err
+		}
+		if n == 0 { // JWT_SECRET is rotated out for the first time
+			if err := tx.Create(&models.SigningKey{CreatedAt: now, RetiresAt: &retires}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&models.SigningKey{}).Where("retires_at IS NULL OR retires_at > ?", retires).Update("retires_at", retires).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("retires_at <= ?", now).Delete(&models.SigningKey{}).Error; err != nil { // No longer accepted
+			return err
+		}
+		return tx.Create(&key).Error
+	})
+	if err != nil {
+		return models.SigningKey{}, time.Time{}, err
+	}
+	signingKeys.Lock()
+	signingKeys.loaded = time.Time{} // Sign with it at once here
+	signingKeys.Unlock()
+	return key, retires, nil
+}
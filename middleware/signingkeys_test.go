@@ -0,0 +1,86 @@
+// signingkeys_test.go - Tests for JWT signing key rotation
+// Run with: go test ./...
+
+package middleware
+
+import (
+	"context"                  // For key lookups
+	"go-mqtt-backend/config"   // Project config
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // Signing key model
+	"net/http"                 // HTTP status codes
+	"net/http/httptest"        // HTTP test helpers
+	"strconv"                  // Key IDs
+	"testing"                  // Go's testing package
+	"time"                     // Grace periods
+
+	"github.com/gin-gonic/gin"           // Gin web framework
+	"github.com/golang-jwt/jwt/v5"       // JWT library
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite" // In-memory database
+	"gorm.io/gorm"
+)
+
+// TestRotateSigningKey checks that tokens signed before a rotation stay valid for the grace
+// period only, and that keys rotated elsewhere are picked up
+func TestRotateSigningKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.SigningKey{}))
+	database.DB = db
+	defer func() { signingKeys.keys, signingKeys.loaded = nil, time.Time{} }()
+	ctx := context.Background()
+	sign := func() string {
+		kid, key := SigningKey(ctx, "env-secret")
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": 7, "exp": time.Now().Add(time.Hour).Unix()})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		s, _ := token.SignedString(key)
+		return s
+	}
+	r := gin.New()
+	r.Use(AuthMiddleware(&config.Config{JWTSecret: "env-secret"}))
+	r.GET("/me", func(c *gin.Context) { c.Status(http.StatusOK) })
+	get := func(token string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	env := sign()
+	assert.Equal(t, signToken("env-secret"), env, "JWT_SECRET signs until the first rotation")
+	assert.Equal(t, http.StatusOK, get(env))
+
+	first, _, err := RotateSigningKey(ctx, time.Hour)
+	require.NoError(t, err)
+	rotated := sign()
+	assert.NotEqual(t, env, rotated)
+	assert.Equal(t, http.StatusOK, get(rotated))
+	assert.Equal(t, http.StatusOK, get(env), "within the grace period")
+
+	_, retires, err := RotateSigningKey(ctx, 0) // After a leak
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), retires, time.Second)
+	assert.Equal(t, http.StatusUnauthorized, get(env))
+	assert.Equal(t, http.StatusUnauthorized, get(rotated))
+	assert.Equal(t, http.StatusOK, get(sign()))
+	var n int64
+	db.Model(&models.SigningKey{}).Where("id = ?", first.ID).Count(&n)
+	assert.Zero(t, n, "retired keys are deleted")
+
+	other := models.SigningKey{Secret: "0123456789abcdef", CreatedAt: time.Now()} // Rotated on another replica
+	require.NoError(t, db.Create(&other).Error)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": 7, "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = strconv.FormatUint(uint64(other.ID), 10)
+	s, _ := token.SignedString([]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef})
+	time.Sleep(signingKeysReload)
+	assert.Equal(t, http.StatusOK, get(s))
+	token.Header["kid"] = "999"
+	s, _ = token.SignedString([]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef})
+	assert.Equal(t, http.StatusUnauthorized, get(s), "unknown key")
+}
@@ -0,0 +1,31 @@
+// timeout.go - Per-route request timeout middleware
+
+package middleware // Declares the package name
+
+import ( // Import required packages
+	"context"  // Request deadlines
+	"errors"   // For checking the context error
+	"net/http" // HTTP status codes
+	"time"     // For durations
+
+	"github.com/gin-gonic/gin" // Gin web framework
+)
+
+// Timeout gives every request in the group a context deadline. Handlers that pass
+// c.Request.Context() to the DB, Redis or MQTT calls are cancelled when it expires; if
+// the handler then hasn't written a response, the client gets a 504.
+func Timeout(d time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if d <= 0 { // Disabled
+			c.Next()
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), d)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx) // Nested groups get the shortest deadline
+		c.Next()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && !c.Writer.Written() {
+			c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"error": "request timed out"})
+		}
+	}
+}
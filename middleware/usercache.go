@@ -0,0 +1,90 @@
+// usercache.go - Short-lived cache of the user fields the auth middleware checks on every request
+//
+// AdminMiddleware, OrgAdminMiddleware and TenantMiddleware only need a user's role and
+// organization, so those are cached for USER_CACHE_TTL_SECONDS instead of read on every
+// request. Handlers that change a role or move a user call InvalidateUser, so the change
+// takes effect at once on this replica; other replicas (and create-admin, a separate
+// process) catch up when their entry expires.
+
+package middleware // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For DB lookups
+	"go-mqtt-backend/database" // Database connection
+	"go-mqtt-backend/models"   // User model
+	"sync"                     // For mutex (thread safety)
+	"time"                     // Expiry
+)
+
+type CachedUser struct { // What the auth middleware needs to know about a user
+	ID             uint
+	Role           string
+	OrganizationID uint
+}
+
+type cachedUser struct {
+	user    CachedUser
+	expires time.Time
+}
+
+var userCache = struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[uint]cachedUser
+	gen     uint64 // Bumped by every invalidation, so a lookup racing one isn't cached
+}{entries: map[uint]cachedUser{}}
+
+// UseUserCache sets how long looked-up users are trusted (0 disables the cache) and drops
+// whatever is cached.
+func UseUserCache(ttl time.Duration) {
+	userCache.Lock()
+	defer userCache.Unlock()
+	userCache.ttl = ttl
+	userCache.entries = map[uint]cachedUser{}
+}
+
+// LookupUser returns user id's role and organization, from the cache if it was looked up
+// within the TTL. A missing user isn't cached.
+func LookupUser(ctx context.Context, id uint) (CachedUser, error) {
+	now := time.Now()
+	userCache.Lock()
+	entry, ok := userCache.entries[id]
+	ttl, gen := userCache.ttl, userCache.gen
+	userCache.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.user, nil
+	}
+	var user models.User
+	if err := database.DB.WithContext(ctx).Select("id", "role", "organization_id").First(&user, id).Error; err != nil {
+		return CachedUser{}, err
+	}
+	cached := CachedUser{ID: user.ID, Role: user.Role, OrganizationID: user.OrganizationID}
+	if ttl > 0 {
+		userCache.Lock()
+		if userCache.gen == gen {
+			userCache.entries[id] = cachedUser{user: cached, expires: now.Add(ttl)}
+		}
+		userCache.Unlock()
+	}
+	return cached, nil
+}
+
+// InvalidateUser drops the cached entries for ids; call it after changing a user's role
+// or organization.
+func InvalidateUser(ids ...uint) {
+	userCache.Lock()
+	defer userCache.Unlock()
+	userCache.gen++
+	for _, id := range ids {
+		delete(userCache.entries, id)
+	}
+}
+
+// InvalidateUsers drops every cached user, e.g. after an update by a condition that
+// doesn't say which users it hit.
+func InvalidateUsers() {
+	userCache.Lock()
+	defer userCache.Unlock()
+	userCache.gen++
+	userCache.entries = map[uint]cachedUser{}
+}
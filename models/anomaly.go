@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+const ( // Kinds of anomaly
+	AnomalyUsageSpike  = "usage_spike"  // A user ran the motor far more than usual in the last day
+	AnomalyIdleDraw    = "idle_draw"    // A motor drew current with no session holding it
+	AnomalyAckTimeouts = "ack_timeouts" // A device failed to confirm commands again and again
+)
+
+// Anomaly is unusual usage flagged for admins to look into. The same kind is flagged at
+// most once a day for a user or motor.
+type Anomaly struct {
+	ID     uint      `gorm:"primaryKey"`     // Unique ID
+	Kind   string    `gorm:"size:32;index"`  // AnomalyUsageSpike, AnomalyIdleDraw or AnomalyAckTimeouts
+	UserID uint      `gorm:"index"`          // User it is about (0 for a motor)
+	Motor  string    `gorm:"size:160;index"` // Motor it is about: "motor" or "{org}/{device}" ("" for a user)
+	Detail string    `gorm:"size:512"`       // What was seen, e.g. "310 min in 24h, usually 45 min a day"
+	At     time.Time `gorm:"index"`          // When it was flagged
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// AuditLog records an admin action that changes what the system may do, such as an
+// emergency shutdown or a restart and who approved it, and every mutating API call
+// (Action "request", with Method, Route and Status).
+type AuditLog struct {
+	ID       uint      `gorm:"primaryKey"`     // Unique ID
+	UserID   uint      `gorm:"index"`          // Who did it (0 for the system itself, e.g. a scheduled end)
+	Action   string    `gorm:"size:64;index"`  // e.g. "shutdown", "restart_approved", "restart", "request"
+	Category string    `gorm:"size:32;index"`  // Shutdown category of shutdowns and restarts ("" for other actions)
+	Method   string    `gorm:"size:8"`         // HTTP method of a request
+	Route    string    `gorm:"size:128;index"` // Route of a request, e.g. "/api/motor/schedule/:id"
+	Status   int       // Response status of a request
+	Detail   string    `gorm:"size:512"` // What was done, e.g. the reason or a summary of the request
+	At       time.Time `gorm:"index"`    // When
+	PrevHash string    `gorm:"size:64"`  // Hash of the entry before it ("" for the first)
+	Hash     string    `gorm:"size:64"`  // Of this entry's content and PrevHash (see database.AppendAudit)
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// ControlOverride exempts one user from the deployment's control restrictions (allowed
+// networks and geofence) until it expires or is removed, e.g. for a farmer travelling
+// with the phone they run the pump from.
+type ControlOverride struct {
+	UserID    uint       `gorm:"primaryKey"` // User it is for
+	ExpiresAt *time.Time `gorm:"index"`      // When it lapses (nil: until removed)
+	Reason    string     `gorm:"size:255"`   // Why it was granted, e.g. "away at the market until Friday"
+	SetBy     uint       // Admin who set it
+	UpdatedAt time.Time  // When it was set
+}
+
+// Active reports whether the override applies at t.
+func (o ControlOverride) Active(t time.Time) bool {
+	return o.UserID != 0 && (o.ExpiresAt == nil || t.Before(*o.ExpiresAt))
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+const DailyTotalLayout = "2006-01-02" // Days are totalled in UTC
+
+// DailyTotal is what one user's accepted motor requests added up to on one day (UTC),
+// kept up to date as requests are logged so reports don't have to scan every activation.
+// Dry runs are not counted.
+type DailyTotal struct {
+	ID               uint      `gorm:"primaryKey"`                                            // Unique ID
+	OrganizationID   uint      `gorm:"uniqueIndex:idx_daily_org_day_user,priority:1"`         // Organization billed for the runs
+	Day              string    `gorm:"size:10;uniqueIndex:idx_daily_org_day_user,priority:2"` // "2006-01-02" in UTC
+	UserID           uint      `gorm:"uniqueIndex:idx_daily_org_day_user,priority:3"`         // User who requested them
+	Runs             int64     `gorm:"not null;default:0"`                                    // Accepted requests
+	RequestedSeconds int64     `gorm:"not null;default:0"`                                    // Motor time asked for
+	EnergyKWh        float64   `gorm:"column:energy_kwh;not null;default:0"`                  // Summed activation estimates
+	Liters           float64   `gorm:"not null;default:0"`
+	Cost             float64   `gorm:"not null;default:0"`
+	UpdatedAt        time.Time // Last change
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// Device is a gateway or controller registered to an organization. It publishes and
+// receives under the "{org slug}/{device name}/" MQTT namespace.
+type Device struct {
+	ID             uint       `gorm:"primaryKey"`                               // Unique ID
+	OrganizationID uint       `gorm:"uniqueIndex:idx_devices_org_name"`         // Owning tenant
+	Name           string     `gorm:"size:64;uniqueIndex:idx_devices_org_name"` // Topic segment, unique within the organization
+	LastSeenAt     *time.Time // Last accepted message from it (nil if never heard from)
+	CreatedAt      time.Time  // When it was registered
+	Group          string     `gorm:"column:group_name;size:64;index"` // Optional group for fleet actions, e.g. "north-field"
+
+	// Pump ratings and tariffs for cost estimates (0 when not a pump or unknown)
+	PowerKW      float64 `gorm:"column:power_kw"` // Power draw while running, in kW
+	FlowLPM      float64 `gorm:"column:flow_lpm"` // Water delivered, in liters per minute
+	EnergyTariff float64 // Price of a kWh
+	WaterTariff  float64 // Price of a cubic meter (1000 liters) of water
+
+	// Safety limits: a reading above one stops the motor and puts it in FAULT (0 for no limit)
+	MaxTempC    float64 `gorm:"column:max_temp_c"`    // Motor temperature, in °C
+	MaxCurrentA float64 `gorm:"column:max_current_a"` // Current draw, in amps
+
+	// Shutdown of this device alone: ON is refused while it is shut down, the rest of the fleet keeps running
+	ShutdownCategory string     `gorm:"size:32"` // Why it was shut down, in a word: maintenance, safety, weather or electrical
+	ShutdownReason   string     // Details
+	ShutdownSince    *time.Time // When it was shut down (nil when it isn't)
+	ShutdownUntil    *time.Time // When the shutdown ends by itself (nil: only by restart)
+}
+
+// ShutDown reports whether the device is shut down at now.
+func (d Device) ShutDown(now time.Time) bool {
+	return d.ShutdownSince != nil && (d.ShutdownUntil == nil || now.Before(*d.ShutdownUntil))
+}
@@ -4,8 +4,24 @@ import "time"
 
 type DeviceActivation struct {
 	ID        uint          `gorm:"primaryKey"`                                                       // Unique ID
-	UserID    uint          `gorm:"not null"`                                                         // Foreign key to users table
+	UserID    uint          `gorm:"not null;index:idx_activation_user_request,priority:1"`            // Foreign key to users table
 	User      User          `gorm:"foreignKey:UserID;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"` // Foreign key constraint
-	RequestAt time.Time     // When request was made
+	RequestAt time.Time     `gorm:"index:idx_activation_user_request,priority:2"`                     // When request was made
 	Duration  time.Duration // For how long the device was active
+	Simulated bool          `gorm:"default:false"` // Dry run: the motor was never really switched on
+	Note      string        `gorm:"size:140"`      // The user's label for the run (optional)
+
+	// How the run went, filled in once it has ended (empty while queued or running)
+	QueueID string        `gorm:"size:32;index"` // ID of the queued request, linking it to its session log
+	Outcome string        `gorm:"size:16"`       // How it ended, as in the session log, e.g. "finished" or "rejected"
+	Ran     time.Duration // How long the motor actually ran
+	EndedAt time.Time     // When it ended
+
+	// Estimates from the pump's ratings and tariffs at request time (zero when the
+	// requester's organization has no rated pump)
+	OrganizationID uint    `gorm:"index"`             // Organization billed for the run
+	DeviceID       *uint   `gorm:"index"`             // Pump the estimates are based on
+	EnergyKWh      float64 `gorm:"column:energy_kwh"` // Power rating × duration
+	Liters         float64 // Flow rate × duration
+	Cost           float64 // Energy and water at the pump's tariffs, in the organization's currency
 }
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Invitation lets someone join an organization, with or without an existing account, by
+// opening an emailed link. Only a hash of the link's token is stored.
+type Invitation struct {
+	ID             uint       `gorm:"primaryKey"`          // Unique ID
+	OrganizationID uint       `gorm:"index"`               // Organization they are invited to
+	Email          string     `gorm:"size:255;index"`      // Invitee, lowercased
+	Role           string     `gorm:"size:32;not null"`    // Role on joining: user or org_admin
+	TokenHash      string     `gorm:"size:64;uniqueIndex"` // SHA-256 of the link token, hex
+	InvitedBy      uint       // Org admin who sent it
+	ExpiresAt      time.Time  // Link stops working after this
+	AcceptedAt     *time.Time // When it was used (nil while pending)
+	CreatedAt      time.Time  // When it was sent
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// JobRun records one execution (or skipped execution) of a background job.
+type JobRun struct {
+	ID         uint      `gorm:"primaryKey"` // Unique ID
+	Job        string    `gorm:"index"`      // Job name
+	StartedAt  time.Time `gorm:"index"`      // When the run started
+	FinishedAt time.Time // When the run finished
+	Status     string    // "ok", "failed" or "skipped"
+	Error      string    // Error message for failed runs, reason for skipped ones
+}
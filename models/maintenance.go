@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// MaintenanceWindow is a planned period when the motor must not run. Motor requests are
+// rejected during it and scheduled runs wait until it ends.
+type MaintenanceWindow struct {
+	ID        uint      `gorm:"primaryKey"` // Unique ID
+	StartsAt  time.Time `gorm:"index"`      // Start of the window
+	EndsAt    time.Time `gorm:"index"`      // End of the window
+	Reason    string    `gorm:"size:255"`   // Shown to users, e.g. "pump replacement"
+	CreatedBy uint      // Admin who planned it
+	CreatedAt time.Time // When it was planned
+}
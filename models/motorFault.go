@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// MotorFault records a motor going into FAULT: reported by the device, a command it
+// didn't confirm or a sensor reading over the device's limit. The motor stays off until
+// an admin clears the fault.
+type MotorFault struct {
+	ID             uint       `gorm:"primaryKey"` // Unique ID
+	OrganizationID uint       `gorm:"index"`      // Tenant of the motor (the default organization for the shared motor)
+	Motor          string     `gorm:"size:160"`   // "motor" or "{org}/{device}"
+	Reason         string     `gorm:"size:255"`   // e.g. "motor_temperature 92.5 over the 80 limit"
+	At             time.Time  `gorm:"index"`      // When it went into FAULT
+	ClearedAt      *time.Time // When an admin cleared it (nil while active)
+	ClearedBy      *uint      // Admin who cleared it
+}
@@ -0,0 +1,60 @@
+package models
+
+import "time"
+
+// MotorQueueItem is a queued motor request saved when the server shuts down, so it can be
+// re-queued on the next start, or kept from the moment it is queued by the database queue.
+type MotorQueueItem struct {
+	ID        uint          `gorm:"primaryKey"`    // Unique ID (also preserves queue order)
+	QueueID   string        `gorm:"size:32;index"` // ID of the queued request, e.g. to cancel it
+	UserID    uint          // User who requested the run
+	RequestAt time.Time     // When request was made
+	Duration  time.Duration // How long to run the motor
+	Simulate  bool          // Dry run
+	Note      string        `gorm:"size:140"` // The user's label for the run
+	RequestID string        `gorm:"size:64"`  // X-Request-ID of the API call that queued it
+	Priority  string        `gorm:"size:8"`   // low, normal or high ("": normal)
+	ExpiresAt time.Time     // Skipped rather than run if it hasn't started by then (zero: never)
+	Round     int           `gorm:"default:0"` // Fair-share round within its priority (database queue only)
+}
+
+// ShutdownState keeps the emergency shutdown across restarts, so restarting the process
+// never silently cancels it. Only one row (ID 1) is used.
+type ShutdownState struct {
+	ID        uint      `gorm:"primaryKey"` // Always 1
+	Active    bool      // Whether the system is shut down
+	Category  string    `gorm:"size:32"`  // maintenance, safety, weather or electrical
+	Reason    string    `gorm:"size:255"` // Notes on why
+	Since     time.Time // When it was shut down
+	Until     time.Time // When it ends by itself (zero: only by restart)
+	UpdatedAt time.Time // When it was last set or cleared
+}
+
+// QueuePause keeps an admin's pause of queue dispatching across restarts and replicas.
+// Only one row (ID 1) is used.
+type QueuePause struct {
+	ID        uint      `gorm:"primaryKey"` // Always 1
+	Paused    bool      // Whether dispatching is paused
+	Reason    string    `gorm:"size:255"` // Notes on why
+	By        uint      // Admin who paused it
+	Since     time.Time // When it was paused
+	UpdatedAt time.Time // When it was last paused or resumed
+}
+
+// RunningSession is the queued run the motor is on for, saved when it starts and deleted
+// when it ends, so a run the process didn't see to the end because it crashed is found
+// on the next start. Only one row (ID 1) is used.
+type RunningSession struct {
+	ID        uint          `gorm:"primaryKey"` // Always 1
+	Motor     string        `gorm:"size:128"`   // Motor it runs ("motor" for the shared one)
+	QueueID   string        `gorm:"size:32"`    // ID the request had while queued
+	UserID    uint          // User who requested the run
+	RequestAt time.Time     // When the request was made
+	Duration  time.Duration // How long was asked for
+	Simulate  bool          // Dry run
+	Note      string        `gorm:"size:140"` // The user's label for the run
+	StartedAt time.Time     // When the motor was switched on for it
+	PartSince time.Time     // When the current stretch started (after StartedAt if resumed after a power outage)
+	Ran       time.Duration // Runtime before PartSince
+	Outages   int           // Power outages so far
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+const ( // Digest frequencies
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// NotificationPrefs is a user's choice of channels per event and their quiet hours.
+// Users without a row get the defaults.
+type NotificationPrefs struct {
+	UserID     uint                `gorm:"primaryKey"`      // Owner
+	Channels   map[string][]string `gorm:"serializer:json"` // Event name -> channels; missing events use the defaults
+	QuietStart string              // Start of quiet hours, "HH:MM" (empty disables quiet hours)
+	QuietEnd   string              // End of quiet hours, "HH:MM"; may be earlier than QuietStart (overnight)
+	Timezone   string              // IANA zone for quiet hours (empty means UTC)
+	Locale     string              `gorm:"size:16"` // Message language, e.g. "en" (empty means the default)
+	Digest     string              `gorm:"size:8"`  // DigestDaily, DigestWeekly or empty (no digest)
+	UpdatedAt  time.Time           // Last change
+}
@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+const DefaultOrganizationSlug = "default" // Organization existing and self-registered users join
+
+// Organization is a tenant, e.g. one farm. Users belong to exactly one; the data they own
+// (schedules, rules, runs and activations) is scoped to it through them.
+type Organization struct {
+	ID         uint          `gorm:"primaryKey"`        // Unique ID
+	Name       string        `gorm:"size:128;not null"` // Display name
+	Slug       string        `gorm:"size:64;unique"`    // Short unique name, e.g. "green-acres"
+	DailyQuota time.Duration // Motor time its members share per quota period (0 for no pool)
+	PlanID     uint          `gorm:"index"` // Subscription plan (0 is treated as free)
+	CreatedAt  time.Time     // When it was created
+
+	// Billing, synced from Stripe webhooks (empty for organizations an admin manages by hand)
+	BillingCustomerID  string     `gorm:"size:64;index"` // Stripe customer
+	SubscriptionID     string     `gorm:"size:64;index"` // Stripe subscription
+	SubscriptionStatus string     `gorm:"size:32"`       // Stripe status: active, past_due, canceled, ...
+	PastDueSince       *time.Time // When payments started failing (nil while paid up)
+	BillingSyncedAt    time.Time  // Creation time of the last webhook event applied, to skip stale ones
+}
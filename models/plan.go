@@ -0,0 +1,46 @@
+package models
+
+import ( // Import required packages
+	"strings" // Feature lists
+	"time"    // Quota durations
+)
+
+const ( // Subscription plans
+	PlanFree     = "free"
+	PlanStandard = "standard"
+	PlanPro      = "pro"
+)
+
+const ( // Premium features a plan can include
+	FeatureWeather      = "weather"       // Schedules that skip on rain
+	FeatureSunSchedules = "sun_schedules" // @sunrise/@sunset schedules
+	FeatureRules        = "rules"         // Sensor automation rules
+)
+
+// Plan is a subscription tier. It caps what an organization on it can use; a zero limit
+// means no limit beyond the deployment's own.
+type Plan struct {
+	ID           uint          `gorm:"primaryKey"`     // Unique ID
+	Name         string        `gorm:"size:32;unique"` // free, standard or pro
+	DailyQuota   time.Duration // Most motor time members share per quota period
+	MaxDevices   int           // Registered devices
+	MaxSchedules int           // Recurring schedules across all members
+	Features     string        `gorm:"size:255"` // Comma-separated premium features
+}
+
+// Has reports whether the plan includes a premium feature.
+func (p Plan) Has(feature string) bool {
+	for _, f := range strings.Split(p.Features, ",") {
+		if strings.TrimSpace(f) == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultPlans are created on first start; later edits to the plans table are kept.
+var DefaultPlans = []Plan{
+	{Name: PlanFree, DailyQuota: 30 * time.Minute, MaxDevices: 1, MaxSchedules: 3},
+	{Name: PlanStandard, MaxDevices: 5, MaxSchedules: 20, Features: FeatureWeather + "," + FeatureSunSchedules},
+	{Name: PlanPro, Features: FeatureWeather + "," + FeatureSunSchedules + "," + FeatureRules},
+}
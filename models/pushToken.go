@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// PushToken is an FCM registration token for one of a user's app installs.
+type PushToken struct {
+	ID        uint      `gorm:"primaryKey"`  // Unique ID
+	UserID    uint      `gorm:"index"`       // Owner
+	Token     string    `gorm:"uniqueIndex"` // FCM registration token
+	Platform  string    // "android", "ios" or "web"
+	CreatedAt time.Time // When the token was registered (or last re-registered)
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// QuotaOverride is a deployment admin's change to one user's motor time per quota period,
+// temporary or until removed. While it applies it takes the place of the limit their org
+// admin set and of their organization's pool; the motor's own quota still applies.
+type QuotaOverride struct {
+	UserID    uint          `gorm:"primaryKey"` // User it is for
+	Quota     time.Duration // Motor time per quota period (may be more or less than before)
+	ExpiresAt *time.Time    `gorm:"index"`    // When it lapses (nil: until removed)
+	Reason    string        `gorm:"size:255"` // Why it was granted, e.g. "planting week"
+	SetBy     uint          // Admin who set it
+	UpdatedAt time.Time     // When it was set
+}
+
+// Active reports whether the override applies at t.
+func (o QuotaOverride) Active(t time.Time) bool {
+	return o.UserID != 0 && (o.ExpiresAt == nil || t.Before(*o.ExpiresAt))
+}
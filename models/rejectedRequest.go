@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// RejectedRequest keeps a queued motor request that was dropped instead of run (rejected
+// at dispatch, expired or dropped by a shutdown) with why, so its owner can see what
+// became of it.
+type RejectedRequest struct {
+	ID         uint          `gorm:"primaryKey"`                                     // Unique ID
+	QueueID    string        `gorm:"size:32;index"`                                  // ID the request had while queued
+	UserID     uint          `gorm:"not null;index:idx_rejected_user_at,priority:1"` // User who requested the run
+	RequestAt  time.Time     // When the request was queued
+	Duration   time.Duration // Duration asked for
+	Simulated  bool          `gorm:"default:false"` // Dry run
+	Note       string        `gorm:"size:140"`      // The user's label for the run
+	Priority   string        `gorm:"size:8"`        // low, normal or high ("": normal)
+	ExpiresAt  time.Time     // When it would have expired (zero: never)
+	Outcome    string        `gorm:"size:16"` // "rejected" or "expired", as in the session log
+	Reason     string        // Why it was dropped
+	RejectedAt time.Time     `gorm:"index:idx_rejected_user_at,priority:2"` // When it was dropped
+}
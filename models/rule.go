@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// Rule runs the motor when a sensor reading meets a condition for long enough, e.g. "soil
+// moisture below 20% for 10 minutes: run 15 minutes, at most twice a day".
+type Rule struct {
+	ID        uint          `gorm:"primaryKey"`    // Unique ID
+	UserID    uint          `gorm:"index"`         // Owner; runs count against the normal quota
+	Name      string        `gorm:"size:64"`       // Label shown in apps
+	Metric    string        `gorm:"size:64;index"` // Sensor name (the telemetry topic after the prefix)
+	Operator  string        `gorm:"size:2"`        // "<", "<=", ">" or ">="
+	Threshold float64       // Value compared against
+	For       time.Duration // How long the condition must hold before the motor runs
+	Duration  time.Duration // Run length
+	MaxPerDay int           // Runs queued at most per 24 hours
+	Enabled   bool          // Disabled rules are kept but never fire
+	CreatedAt time.Time     // When the rule was created
+	UpdatedAt time.Time     // Last change
+}
+
+// RuleRun records one time a rule fired and whether the run was queued.
+type RuleRun struct {
+	ID     uint      `gorm:"primaryKey"` // Unique ID
+	RuleID uint      `gorm:"index"`      // Rule that fired
+	At     time.Time `gorm:"index"`      // When it fired
+	Value  float64   // Reading that completed the condition
+	Status string    // ScheduleRunQueued or ScheduleRunSkipped
+	Reason string    // Why the run was skipped
+}
@@ -0,0 +1,50 @@
+package models
+
+import "time"
+
+const ( // Schedule run statuses
+	ScheduleRunQueued  = "queued"  // Request was added to the motor queue
+	ScheduleRunSkipped = "skipped" // Not queued; see Reason
+)
+
+// Schedule is a user's recurring motor run, e.g. every day at 06:00 for 20 minutes.
+type Schedule struct {
+	ID              uint          `gorm:"primaryKey"` // Unique ID
+	UserID          uint          `gorm:"index"`      // Owner; runs count against the normal quota
+	Name            string        `gorm:"size:64"`    // Label shown in apps
+	Cron            string        // 5-field cron expression or descriptor, evaluated in Timezone, or a sunrise/sunset spec
+	Timezone        string        `gorm:"size:64"` // IANA zone (empty means server time, for schedules made before zones)
+	Duration        time.Duration // Run length
+	Enabled         bool          // Disabled schedules are kept but never run
+	RainSkipPercent int           // Skip a run when the rain chance is above this (0 turns it off)
+	CheckedAt       time.Time     // Occurrences up to this time have been handled
+	PausedUntil     *time.Time    // Occurrences before this are skipped (nil when not paused)
+	SkipAt          *time.Time    // One future occurrence the user skipped (already in the run history)
+	CreatedAt       time.Time     // When the schedule was created
+	UpdatedAt       time.Time     // Last change
+}
+
+// ScheduleRun records one occurrence of a schedule and whether it was queued.
+type ScheduleRun struct {
+	ID         uint      `gorm:"primaryKey"` // Unique ID
+	ScheduleID uint      `gorm:"index"`      // Schedule that fired
+	At         time.Time `gorm:"index"`      // Occurrence time
+	Status     string    // ScheduleRunQueued or ScheduleRunSkipped
+	Reason     string    // Why the run was skipped
+}
+
+const ( // Extra statuses of one-time scheduled requests
+	ScheduledPending   = "pending"   // Waiting for its start time
+	ScheduledCancelled = "cancelled" // Withdrawn by the user
+)
+
+// ScheduledRequest is a one-time motor run queued at StartAt, e.g. "tomorrow 05:30 for 15 minutes".
+type ScheduledRequest struct {
+	ID        uint          `gorm:"primaryKey"` // Unique ID
+	UserID    uint          `gorm:"index"`      // Owner
+	StartAt   time.Time     `gorm:"index"`      // When to queue the run
+	Duration  time.Duration // Run length
+	Status    string        `gorm:"index"` // ScheduledPending, ScheduleRunQueued, ScheduleRunSkipped or ScheduledCancelled
+	Reason    string        // Why the run was skipped
+	CreatedAt time.Time     // When it was requested
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// SessionLog records how a queued motor request ended, for digests and history.
+type SessionLog struct {
+	ID        uint          `gorm:"primaryKey"`    // Unique ID
+	QueueID   string        `gorm:"size:32;index"` // ID the request had while queued, so its status can still be looked up
+	UserID    uint          `gorm:"index"`         // User who requested the run
+	Outcome   string        // "finished", "interrupted", "safety_stopped", "power_lost", "stopped", "rejected", "cancelled" or "expired"
+	Requested time.Duration // Duration asked for
+	Ran       time.Duration // How long the motor actually ran (0 when rejected)
+	Reason    string        // Why a request was rejected or a run cut short
+	EndedAt   time.Time     `gorm:"index"`         // When the session ended or the request was rejected
+	Simulated bool          `gorm:"default:false"` // Dry run: no motor command was published
+	Outages   int           `gorm:"default:0"`     // Power outages during the run, resumed or not
+}
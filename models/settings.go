@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// Settings holds the quota limits an admin changed at runtime, which take the place of the
+// environment's. Only one row (ID 1) is used; a zero field keeps the environment's value.
+type Settings struct {
+	ID            uint          `gorm:"primaryKey"` // Always 1
+	MotorQuota    time.Duration // Max motor-on time per 24h
+	QueueCapacity int           // Max queued requests
+	MaxDuration   time.Duration // Longest run one request may ask for
+	UpdatedBy     uint          // Admin who last changed them
+	UpdatedAt     time.Time     // When they were last changed
+}
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// SigningKey is a secret JWTs are signed with, named in their "kid" header by its ID. The
+// newest key without RetiresAt signs new tokens; a rotated-out key is still accepted until
+// RetiresAt so signed-in users aren't all logged out at once. Until the first rotation the
+// JWT_SECRET from the environment signs, and a row with an empty Secret stands for it
+// once it has been rotated out.
+type SigningKey struct {
+	ID        uint       `gorm:"primaryKey"`
+	Secret    string     `gorm:"size:128"` // Hex-encoded; empty for JWT_SECRET
+	CreatedAt time.Time  // When it was generated
+	RetiresAt *time.Time `gorm:"index"` // When tokens signed with it stop being accepted (nil: signing key)
+}
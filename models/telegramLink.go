@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// TelegramLink is a one-time code a user sends to the bot to link their Telegram chat.
+type TelegramLink struct {
+	Code      string    `gorm:"primaryKey"` // Random code shown to the user
+	UserID    uint      `gorm:"index"`      // User the chat will be linked to
+	ExpiresAt time.Time // Codes are short-lived
+}
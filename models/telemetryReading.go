@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// TelemetryReading is one sensor reading as it arrived over MQTT. Readings are written in
+// batches, so the newest few seconds may not be stored yet.
+type TelemetryReading struct {
+	ID             uint      `gorm:"primaryKey"`                                   // Unique ID
+	OrganizationID uint      `gorm:"index:idx_telemetry_org_metric_at,priority:1"` // Organization the sensor belongs to
+	DeviceID       uint      `gorm:"index:idx_telemetry_device_at,priority:1"`     // Registered device (0: a shared sensor)
+	Metric         string    `gorm:"index:idx_telemetry_org_metric_at,priority:2"` // As rules see it, e.g. "pump-1/soil_moisture"
+	Value          float64   // Reading
+	At             time.Time `gorm:"index:idx_telemetry_org_metric_at,priority:3;index:idx_telemetry_device_at,priority:2;index"` // When it arrived
+}
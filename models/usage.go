@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// UsageRecord is what one organization used in one calendar month (UTC), the basis for
+// invoicing managed deployments. Counters grow as usage happens; Devices is the most
+// devices the organization had registered at once during the month.
+type UsageRecord struct {
+	ID             uint      `gorm:"primaryKey"`                             // Unique ID
+	OrganizationID uint      `gorm:"uniqueIndex:idx_usage_org_month"`        // Metered tenant
+	Month          string    `gorm:"size:7;uniqueIndex:idx_usage_org_month"` // "2006-01" in UTC
+	RuntimeSeconds int64     `gorm:"not null;default:0"`                     // Motor-on time of members' sessions
+	Sessions       int64     `gorm:"not null;default:0"`                     // Members' finished or interrupted sessions
+	MessagesIn     int64     `gorm:"not null;default:0"`                     // Telemetry accepted from its devices
+	MessagesOut    int64     `gorm:"not null;default:0"`                     // Commands published to its devices
+	Devices        int64     `gorm:"not null;default:0"`                     // Peak registered devices
+	UpdatedAt      time.Time // Last change
+}
@@ -2,8 +2,23 @@
 
 package models // Declares the package name
 
+import "time" // Quota durations
+
+const ( // User roles
+	RoleUser     = "user"      // Regular user (default)
+	RoleOrgAdmin = "org_admin" // Manages the members and schedules of their own organization
+	RoleAdmin    = "admin"     // Administrator of the whole deployment
+)
+
 type User struct { // User struct represents a user in the database
-	ID       uint   `gorm:"primaryKey"`      // Unique user ID (primary key)
-	Email    string `gorm:"unique;not null"` // User's email (must be unique, cannot be null)
-	Password string `gorm:"not null"`        // Hashed password (cannot be null)
+	ID                 uint          `gorm:"primaryKey"`              // Unique user ID (primary key)
+	Email              string        `gorm:"unique;not null"`         // User's email (must be unique, cannot be null)
+	Password           string        `gorm:"not null"`                // Hashed password (cannot be null)
+	Role               string        `gorm:"not null;default:'user'"` // User role ("user", "org_admin" or "admin")
+	Phone              string        `gorm:"size:32"`                 // E.164 number for SMS notifications (optional)
+	Timezone           string        `gorm:"size:64"`                 // IANA zone used as the default for schedules (optional)
+	TelegramChatID     int64         `gorm:"index"`                   // Linked Telegram chat (0 when not linked)
+	OrganizationID     uint          `gorm:"index"`                   // Tenant the user belongs to
+	DailyQuota         time.Duration // Own limit per quota period, set by an org admin (0 for none)
+	MustChangePassword bool          // Set for the admin created from ADMIN_PASSWORD; their tokens only change the password until they do
 }
@@ -3,13 +3,44 @@
 package mqtt // Declares the package name
 
 import ( // Import required packages
+	"context"               // For cancellable publishes
+	"errors"                // Publish timeouts
+	"go-mqtt-backend/chaos" // Injected publish failures
+	"sync"                  // Subscription list
+	"time"                  // Publish timeouts
+
 	mqtt "github.com/eclipse/paho.mqtt.golang" // MQTT library
 )
 
 var Client mqtt.Client // Global variable for the MQTT client
 
-func Connect(broker string) error { // Connects to the MQTT broker
-	opts := mqtt.NewClientOptions().AddBroker(broker)                    // Set broker address
+var ( // Subscriptions, renewed on every (re)connect since the broker forgets them
+	subsMu sync.Mutex
+	subs   = map[string]mqtt.MessageHandler{}
+)
+
+var injector *chaos.Injector // Fails publishes in chaos mode (nil: never)
+
+func UseChaos(i *chaos.Injector) { // Makes publishes fail at i's rate; call before publishing
+	injector = i
+}
+
+// CredentialsFunc returns the broker username and password. It is called on every
+// (re)connect, so rotated credentials are picked up without restarting.
+type CredentialsFunc func() (username, password string)
+
+func Connect(broker string, credentials CredentialsFunc) error { // Connects to the MQTT broker
+	opts := mqtt.NewClientOptions().AddBroker(broker) // Set broker address
+	if credentials != nil {                           // Authenticate if credentials are configured
+		opts.SetCredentialsProvider(mqtt.CredentialsProvider(credentials))
+	}
+	opts.SetOnConnectHandler(func(c mqtt.Client) { // Resubscribe after a reconnect
+		subsMu.Lock()
+		defer subsMu.Unlock()
+		for topic, handler := range subs {
+			c.Subscribe(topic, 0, handler)
+		}
+	})
 	Client = mqtt.NewClient(opts)                                        // Create new MQTT client
 	if token := Client.Connect(); token.Wait() && token.Error() != nil { // Try to connect
 		return token.Error() // Return error if connection fails
@@ -17,15 +48,71 @@ func Connect(broker string) error { // Connects to the MQTT broker
 	return nil // Success
 }
 
-func Subscribe(topic string, callback mqtt.MessageHandler) error { // Subscribe to a topic
-	if token := Client.Subscribe(topic, 0, callback); token.Wait() && token.Error() != nil { // Try to subscribe
+// Subscribe calls callback with the topic and payload of every message on topic (which
+// may contain wildcards), including after reconnects.
+func Subscribe(topic string, callback func(topic string, payload []byte)) error {
+	handler := func(_ mqtt.Client, msg mqtt.Message) { callback(msg.Topic(), msg.Payload()) }
+	subsMu.Lock()
+	subs[topic] = handler
+	subsMu.Unlock()
+	if token := Client.Subscribe(topic, 0, handler); token.Wait() && token.Error() != nil { // Try to subscribe
 		return token.Error() // Return error if fails
 	}
 	return nil // Success
 }
 
 func Publish(topic string, payload interface{}) error { // Publish a message to a topic
+	if err := injector.PublishError(topic); err != nil {
+		return err
+	}
 	token := Client.Publish(topic, 0, false, payload) // Publish message
 	token.Wait()                                      // Wait for publish to complete
 	return token.Error()                              // Return error if any
 }
+
+// PublishContext is Publish that gives up waiting for the broker when ctx is done.
+// Use it on request paths; safety-critical OFF commands should use Publish.
+func PublishContext(ctx context.Context, topic string, payload interface{}) error {
+	if err := injector.PublishError(topic); err != nil {
+		return err
+	}
+	token := Client.Publish(topic, 0, false, payload) // Publish message
+	select {
+	case <-token.Done(): // Broker acknowledged (or failed)
+		return token.Error()
+	case <-ctx.Done(): // Caller gave up
+		return ctx.Err()
+	}
+}
+
+// PublishAtLeastOnce publishes with QoS 1 and waits up to 10 seconds for the broker to
+// acknowledge it. The client keeps resending it until the broker has it, so use it for
+// commands that must arrive, like OFF.
+func PublishAtLeastOnce(topic string, payload interface{}) error {
+	if err := injector.PublishError(topic); err != nil {
+		return err
+	}
+	token := Client.Publish(topic, 1, false, payload)
+	if !token.WaitTimeout(10 * time.Second) {
+		return errors.New("no acknowledgement from the broker")
+	}
+	return token.Error()
+}
+
+type Publisher struct{} // The client as a motor service publisher: Publish and PublishAtLeastOnce
+
+func (Publisher) Publish(topic string, payload interface{}) error { return Publish(topic, payload) }
+
+func (Publisher) PublishAtLeastOnce(topic string, payload interface{}) error {
+	return PublishAtLeastOnce(topic, payload)
+}
+
+func IsConnected() bool { // Reports whether the broker connection is up
+	return Client != nil && Client.IsConnected()
+}
+
+func Disconnect() { // Disconnects from the broker, allowing in-flight messages to be sent
+	if Client != nil && Client.IsConnected() {
+		Client.Disconnect(250) // Wait up to 250ms for pending work
+	}
+}
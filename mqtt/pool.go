@@ -0,0 +1,123 @@
+// pool.go - Asynchronous publishes for messages nobody needs to wait on
+//
+// Motor commands are published on the caller's goroutine, because the motor state only
+// changes once the broker has them. Everything else can go through PublishAsync, which
+// hands the message to a small pool of workers and returns at once. Each topic always
+// maps to the same worker, so messages to one topic reach the broker in the order they
+// were queued; a full worker queue is reported to the caller instead of blocking it.
+
+package mqtt // Declares the package name
+
+import ( // Import required packages
+	"bytes"       // Payload types
+	"context"     // Draining on shutdown
+	"errors"      // Queue errors
+	"fmt"         // Payload errors
+	"hash/fnv"    // Topic to worker
+	"log/slog"    // Leveled logging
+	"sync"        // Workers
+	"sync/atomic" // Failure counter
+)
+
+var ErrPublishQueueFull = errors.New("publish queue is full") // PublishAsync couldn't queue the message
+
+type asyncPublish struct { // A queued message
+	topic   string
+	payload interface{}
+}
+
+var pool struct { // Workers started by StartPublishers
+	mu      sync.RWMutex
+	queues  []chan asyncPublish // One per worker
+	done    sync.WaitGroup
+	started bool
+	failed  atomic.Int64 // Publishes that failed in a worker
+}
+
+// StartPublishers starts workers goroutines that publish what PublishAsync queues, each
+// with room for queue messages.
+func StartPublishers(workers, queue int) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.started {
+		return
+	}
+	pool.queues = make([]chan asyncPublish, max(workers, 1))
+	for i := range pool.queues {
+		q := make(chan asyncPublish, max(queue, 1))
+		pool.queues[i] = q
+		pool.done.Add(1)
+		go func() {
+			defer pool.done.Done()
+			for msg := range q {
+				if err := Publish(msg.topic, msg.payload); err != nil {
+					pool.failed.Add(1)
+					slog.Error("async publish failed", "topic", msg.topic, "error", err)
+				}
+			}
+		}()
+	}
+	pool.started = true
+}
+
+// PublishAsync queues payload for topic and returns without waiting for the broker; a
+// failed publish is logged and counted. It returns ErrPublishQueueFull when the topic's
+// worker is backed up. Before StartPublishers and after StopPublishers it publishes
+// synchronously.
+func PublishAsync(topic string, payload interface{}) error {
+	switch payload.(type) { // What the client accepts; checked now since later nobody is waiting
+	case string, []byte, bytes.Buffer:
+	default:
+		return fmt.Errorf("payload must be a string or bytes, not %T", payload)
+	}
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	if !pool.started {
+		return Publish(topic, payload)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	select {
+	case pool.queues[h.Sum32()%uint32(len(pool.queues))] <- asyncPublish{topic, payload}:
+		return nil
+	default:
+		return ErrPublishQueueFull
+	}
+}
+
+// StopPublishers publishes everything queued and stops the workers, or gives up waiting
+// when ctx is done. Call it before Disconnect.
+func StopPublishers(ctx context.Context) error {
+	pool.mu.Lock()
+	if !pool.started {
+		pool.mu.Unlock()
+		return nil
+	}
+	for _, q := range pool.queues {
+		close(q)
+	}
+	pool.queues, pool.started = nil, false
+	pool.mu.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		pool.done.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PublishQueueStats reports the messages waiting in the pool and the publishes that have
+// failed in it, for metrics.
+func PublishQueueStats() (queued int, failed int64) {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	for _, q := range pool.queues {
+		queued += len(q)
+	}
+	return queued, pool.failed.Load()
+}
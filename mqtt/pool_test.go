@@ -0,0 +1,34 @@
+// pool_test.go - Tests for asynchronous publishes
+// Run with: go test ./...
+
+package mqtt
+
+import (
+	"context"               // Draining
+	"go-mqtt-backend/chaos" // Publishes that fail without a broker
+	"testing"               // Go's testing package
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestPublishAsync checks payload checks, the queue bound and that failures are counted
+// once the queue drains
+func TestPublishAsync(t *testing.T) {
+	UseChaos(chaos.New(chaos.Config{PublishFailRate: 1})) // Every publish fails before reaching the client
+	defer UseChaos(nil)
+
+	assert.ErrorContains(t, PublishAsync("farm/pump-1/lights", 42.0), "payload must be a string or bytes")
+	assert.ErrorIs(t, PublishAsync("farm/pump-1/lights", "on"), chaos.ErrInjected) // Not started: published at once
+
+	StartPublishers(1, 1)
+	var err error
+	for i := 0; i < 10000 && err == nil; i++ { // One worker with room for one message falls behind
+		err = PublishAsync("farm/pump-1/lights", "off")
+	}
+	assert.ErrorIs(t, err, ErrPublishQueueFull)
+	require.NoError(t, StopPublishers(context.Background()))
+	queued, failed := PublishQueueStats()
+	assert.Zero(t, queued)
+	assert.Positive(t, failed)
+}
@@ -0,0 +1,143 @@
+// email.go - SMTP email with templates and an async send queue with retries
+
+package notify // Declares the package name
+
+import ( // Import required packages
+	"bytes"         // Building messages
+	"context"       // For cancellation
+	"crypto/tls"    // Implicit TLS (port 465)
+	"embed"         // Built-in templates
+	"fmt"           // For error formatting
+	"net"           // Host/port joining
+	"net/smtp"      // SMTP client
+	"strings"       // Header handling
+	"text/template" // Email templates
+	"time"          // Retry backoff
+)
+
+type SMTPConfig struct { // SMTPConfig is where and as whom email is sent
+	Host     string // SMTP server host (empty disables email)
+	Port     int    // 587 for STARTTLS, 465 for implicit TLS, 25 for plain
+	Username string // Optional login
+	Password string // Optional password
+	From     string // Sender address
+}
+
+type Email struct { // Email is a plain-text message
+	To      []string
+	Subject string
+	Body    string
+}
+
+//go:embed templates/*.tmpl
+var templateFiles embed.FS // Built-in account emails: first line "Subject: ...", then the body
+
+var templates = template.Must(template.ParseFS(templateFiles, "templates/*.tmpl"))
+
+// Render builds an account email from a built-in template ("verification",
+// "password_reset", "invitation"). Event notifications use Templates instead.
+func Render(name string, to []string, data any) (Email, error) {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name+".tmpl", data); err != nil {
+		return Email{}, err
+	}
+	first, body, _ := strings.Cut(buf.String(), "\n")
+	subject, ok := strings.CutPrefix(first, "Subject: ")
+	if !ok {
+		return Email{}, fmt.Errorf("template %s: first line must be a Subject header", name)
+	}
+	return Email{To: to, Subject: subject, Body: strings.TrimSpace(body) + "\n"}, nil
+}
+
+type Mailer struct { // Mailer queues emails and sends them in the background
+	cfg SMTPConfig
+	box *outbox[Email]
+}
+
+func NewMailer(cfg SMTPConfig, queueSize int) *Mailer { // Creates a mailer; start Run to deliver
+	m := &Mailer{cfg: cfg}
+	m.box = newOutbox("email", queueSize, m.sendSMTP)
+	return m
+}
+
+// Send queues msg without blocking (ErrQueueFull at capacity). Delivery happens in Run.
+func (m *Mailer) Send(msg Email) error {
+	return m.box.push(msg)
+}
+
+func (m *Mailer) SendTemplate(name string, to []string, data any) error { // Renders a built-in template and queues it
+	msg, err := Render(name, to, data)
+	if err != nil {
+		return err
+	}
+	return m.Send(msg)
+}
+
+// Run delivers queued emails until ctx is cancelled, retrying each with exponential
+// backoff. It fits supervisor.Task.Run.
+func (m *Mailer) Run(ctx context.Context, beat func()) error {
+	return m.box.run(ctx, beat)
+}
+
+func (m *Mailer) sendSMTP(ctx context.Context, msg Email) error { // Delivers msg over SMTP (STARTTLS when offered, implicit TLS on 465)
+	addr := net.JoinHostPort(m.cfg.Host, fmt.Sprint(m.cfg.Port))
+	tlsConfig := &tls.Config{ServerName: m.cfg.Host}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if m.cfg.Port == 465 {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute)) // A stuck server must not block the queue forever
+	c, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && m.cfg.Port != 465 {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.cfg.From); err != nil {
+		return err
+	}
+	for _, to := range msg.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(m.format(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (m *Mailer) format(msg Email) []byte { // RFC 5322 message with CRLF line endings
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,64 @@
+// email_test.go - Tests for email templates and the retrying send queue
+// Run with: go test ./...
+
+package notify
+
+import (
+	"context" // For cancellation
+	"errors"  // For simulated failures
+	"sync"    // For guarding the fake sender
+	"testing" // Go's testing package
+	"time"    // For durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestRenderTemplates checks that every built-in account email renders with a subject
+func TestRenderTemplates(t *testing.T) {
+	cases := map[string]any{
+		"verification":   map[string]any{"Link": "https://example.com/verify?t=x"},
+		"password_reset": map[string]any{"Email": "a@example.com", "Link": "https://example.com/reset?t=x", "ExpiresIn": "1h"},
+		"invitation":     map[string]any{"Organization": "Green Acres", "InvitedBy": "b@example.com", "Role": "user", "Link": "https://example.com/invitations/x", "ExpiresIn": "7 days"},
+	}
+	for name, data := range cases {
+		msg, err := Render(name, []string{"a@example.com"}, data)
+		require.NoError(t, err, name)
+		assert.NotEmpty(t, msg.Subject, name)
+		assert.NotContains(t, msg.Body, "Subject:", name)
+	}
+}
+
+// TestMailerRetries checks that failed sends are retried and the queue rejects overflow
+func TestMailerRetries(t *testing.T) {
+	m := NewMailer(SMTPConfig{From: "noreply@example.com"}, 1)
+	m.box.backoff = time.Millisecond
+	var mu sync.Mutex
+	attempts := 0
+	sent := make(chan Email, 1)
+	m.box.send = func(ctx context.Context, msg Email) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if attempts++; attempts < 3 {
+			return errors.New("connection refused")
+		}
+		sent <- msg
+		return nil
+	}
+
+	require.NoError(t, m.Send(Email{To: []string{"a@example.com"}, Subject: "hi"}))
+	assert.ErrorIs(t, m.Send(Email{}), ErrQueueFull) // Capacity 1, worker not running yet
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx, func() {})
+	select {
+	case msg := <-sent:
+		assert.Equal(t, "hi", msg.Subject)
+	case <-time.After(time.Second):
+		t.Fatal("email not delivered")
+	}
+	mu.Lock()
+	assert.Equal(t, 3, attempts)
+	mu.Unlock()
+}
@@ -0,0 +1,68 @@
+// events.go - Names of the events users can be notified about and the channels used
+
+package notify // Declares the package name
+
+import ( // Import required packages
+	"fmt"     // For error formatting
+	"strings" // Normalising names
+)
+
+const ( // Notification events
+	EventSessionStarted     = "session_started"     // Motor switched on for the user's request
+	EventSessionFinished    = "session_finished"    // Run completed
+	EventSessionInterrupted = "session_interrupted" // Run cut short, including by the safety cutoff or an admin
+	EventRequestRejected    = "request_rejected"    // Queued request dropped at dispatch (quota, shutdown)
+	EventQuotaWarning       = "quota_warning"       // Daily allowance nearly or fully used
+	EventDeviceOffline      = "device_offline"      // Device stopped reporting
+	EventShutdown           = "shutdown"            // Emergency shutdown started or cleared
+	EventMaintenance        = "maintenance"         // Maintenance window planned or cancelled
+	EventAdminAlert         = "admin_alert"         // Something an admin must act on (shutdown, broker outage, safety cutoff)
+	EventDigest             = "digest"              // Opt-in daily or weekly activity summary
+	EventBilling            = "billing"             // Organization's subscription payment failed or its plan changed
+)
+
+const ( // Delivery channels
+	ChannelEmail    = "email"
+	ChannelSMS      = "sms"
+	ChannelWhatsApp = "whatsapp"
+	ChannelTelegram = "telegram"
+	ChannelPush     = "push"
+)
+
+// Channels lists every channel in a stable order.
+var Channels = []string{ChannelEmail, ChannelSMS, ChannelWhatsApp, ChannelTelegram, ChannelPush}
+
+// Events lists every event in a stable order.
+var Events = []string{
+	EventSessionStarted, EventSessionFinished, EventSessionInterrupted,
+	EventRequestRejected, EventQuotaWarning, EventDeviceOffline, EventShutdown, EventMaintenance, EventAdminAlert, EventDigest, EventBilling,
+}
+
+// ParseEvents turns a list of event names into a set, rejecting unknown names. An empty
+// list enables every event.
+func ParseEvents(names []string) (map[string]bool, error) {
+	set := make(map[string]bool, len(Events))
+	if len(names) == 0 {
+		names = Events
+	}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !IsEvent(name) {
+			return nil, fmt.Errorf("unknown notification event %q (want one of %s)", name, strings.Join(Events, ", "))
+		}
+		set[name] = true
+	}
+	return set, nil
+}
+
+func IsEvent(name string) bool   { return contains(Events, name) }   // Reports whether name is a known event
+func IsChannel(name string) bool { return contains(Channels, name) } // Reports whether name is a known channel
+
+func contains(list []string, name string) bool {
+	for _, e := range list {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
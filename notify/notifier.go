@@ -0,0 +1,90 @@
+// notifier.go - The channel interface and its email, SMS, WhatsApp, Telegram and push implementations
+
+package notify // Declares the package name
+
+import "errors" // Sentinel errors
+
+// ErrNoAddress is returned by Notify when the recipient hasn't set up the channel (no phone
+// number, no linked chat, ...). Callers can ignore it.
+var ErrNoAddress = errors.New("recipient has no address for this channel")
+
+type Recipient struct { // Recipient is where one user can be reached
+	UserID         uint
+	Email          string
+	Phone          string   // E.164
+	TelegramChatID int64    // 0 when not linked
+	PushTokens     []string // FCM registration tokens
+}
+
+type Message struct { // Message is a rendered notification
+	Event     string // Event name (see Events)
+	Title     string // Email subject / push title
+	Body      string // Short text for SMS, Telegram and push
+	EmailBody string // Longer email version (empty uses Body)
+}
+
+// Notifier delivers messages on one channel. Notify must only queue, never block on the
+// network. Adding a channel means implementing this and registering it at startup.
+type Notifier interface {
+	Channel() string // One of Channels
+	Notify(to Recipient, msg Message) error
+}
+
+func (m *Mailer) Channel() string { return ChannelEmail }
+
+func (m *Mailer) Notify(to Recipient, msg Message) error {
+	if to.Email == "" {
+		return ErrNoAddress
+	}
+	body := msg.EmailBody
+	if body == "" {
+		body = msg.Body
+	}
+	return m.Send(Email{To: []string{to.Email}, Subject: msg.Title, Body: body + "\n"})
+}
+
+func (s *SMSSender) Channel() string { return ChannelSMS }
+
+func (s *SMSSender) Notify(to Recipient, msg Message) error {
+	if to.Phone == "" {
+		return ErrNoAddress
+	}
+	return s.Send(to.Phone, msg.Body)
+}
+
+func (s *WhatsAppSender) Channel() string { return ChannelWhatsApp }
+
+func (s *WhatsAppSender) Notify(to Recipient, msg Message) error {
+	if to.Phone == "" {
+		return ErrNoAddress
+	}
+	return s.Send(to.Phone, msg.Body)
+}
+
+func (b *TelegramBot) Channel() string { return ChannelTelegram }
+
+func (b *TelegramBot) Notify(to Recipient, msg Message) error {
+	if to.TelegramChatID == 0 {
+		return ErrNoAddress
+	}
+	return b.Send(to.TelegramChatID, msg.Body)
+}
+
+func (p *Pusher) Channel() string { return ChannelPush }
+
+// Notify queues msg for every install of the recipient, unless the event is switched off
+// for push (PUSH_EVENTS).
+func (p *Pusher) Notify(to Recipient, msg Message) error {
+	if !p.pushes(msg.Event) {
+		return nil
+	}
+	if len(to.PushTokens) == 0 {
+		return ErrNoAddress
+	}
+	for _, token := range to.PushTokens {
+		if err := p.Send(Push{Token: token, Title: msg.Title, Body: msg.Body, Data: map[string]string{"event": msg.Event}}); err != nil {
+			return err // Queue is full; the rest would fail too
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// outbox.go - In-memory send queue with retries shared by the notification channels
+
+package notify // Declares the package name
+
+import ( // Import required packages
+	"context"  // For cancellation
+	"errors"   // Permanent error checks
+	"log/slog" // Leveled logging
+	"time"     // Retry backoff
+)
+
+var ErrQueueFull = errors.New("notification queue is full") // Returned when a channel's queue is at capacity
+
+type permanentError struct{ err error } // Wraps failures that retrying can't fix (bad number, rejected auth)
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error { return permanentError{err} } // Marks err as not worth retrying
+
+// outbox queues messages of type T and delivers them one at a time, retrying transient
+// failures with exponential backoff.
+type outbox[T any] struct {
+	name        string                                 // Channel name for logs
+	queue       chan T                                 // Pending messages
+	send        func(ctx context.Context, msg T) error // Delivers one message
+	maxAttempts int                                    // Tries per message before giving up
+	backoff     time.Duration                          // First retry delay; doubles after each failure
+}
+
+func newOutbox[T any](name string, size int, send func(ctx context.Context, msg T) error) *outbox[T] {
+	return &outbox[T]{name: name, queue: make(chan T, size), send: send, maxAttempts: 5, backoff: 2 * time.Second}
+}
+
+func (o *outbox[T]) push(msg T) error { // Queues msg without blocking
+	select {
+	case o.queue <- msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// run delivers queued messages until ctx is cancelled. It fits supervisor.Task.Run.
+func (o *outbox[T]) run(ctx context.Context, beat func()) error {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		beat()
+		select {
+		case <-ctx.Done():
+			if n := len(o.queue); n > 0 {
+				slog.Warn("notification queue not flushed at shutdown", "channel", o.name, "pending", n)
+			}
+			return nil
+		case <-ticker.C: // Report progress while idle
+		case msg := <-o.queue:
+			o.deliver(ctx, msg, beat)
+		}
+	}
+}
+
+func (o *outbox[T]) deliver(ctx context.Context, msg T, beat func()) { // Sends one message with retries
+	delay := o.backoff
+	for attempt := 1; ; attempt++ {
+		err := o.send(ctx, msg)
+		if err == nil {
+			slog.Debug("notification sent", "channel", o.name)
+			return
+		}
+		var perm permanentError
+		if errors.As(err, &perm) || attempt >= o.maxAttempts {
+			slog.Error("notification dropped", "channel", o.name, "attempts", attempt, "error", err)
+			return
+		}
+		slog.Warn("notification send failed, retrying", "channel", o.name, "attempt", attempt, "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		beat()
+		delay *= 2
+	}
+}
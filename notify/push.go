@@ -0,0 +1,230 @@
+// push.go - Push notifications through Firebase Cloud Messaging (HTTP v1 API)
+
+package notify // Declares the package name
+
+import ( // Import required packages
+	"bytes"         // Request bodies
+	"context"       // For cancellation
+	"crypto/rsa"    // Service account key
+	"encoding/json" // API payloads
+	"errors"        // Invalid token checks
+	"fmt"           // For error formatting
+	"io"            // Reading responses
+	"net/http"      // FCM and OAuth APIs
+	"net/url"       // Token request form
+	"strings"       // Request bodies
+	"sync"          // Access token cache
+	"time"          // Token expiry
+
+	"github.com/golang-jwt/jwt/v5" // Signs the OAuth assertion
+)
+
+// ErrInvalidToken is returned when FCM reports a device token as unregistered or malformed;
+// the token should be forgotten.
+var ErrInvalidToken = errors.New("invalid push token")
+
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+type FCM struct { // FCM sends messages with a Google service account
+	ProjectID   string
+	clientEmail string
+	key         *rsa.PrivateKey
+	tokenURI    string
+	BaseURL     string       // API root (empty uses https://fcm.googleapis.com)
+	Client      *http.Client // HTTP client (nil uses a 15s-timeout client)
+
+	mu          sync.Mutex // Guards the cached access token
+	accessToken string
+	expiry      time.Time
+}
+
+// NewFCM parses a service account key file (the JSON downloaded from the Firebase console).
+func NewFCM(serviceAccount []byte) (*FCM, error) {
+	var sa struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(serviceAccount, &sa); err != nil {
+		return nil, fmt.Errorf("fcm: parse service account: %w", err)
+	}
+	if sa.ProjectID == "" || sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return nil, errors.New("fcm: service account needs project_id, client_email and private_key")
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(sa.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("fcm: parse private key: %w", err)
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &FCM{ProjectID: sa.ProjectID, clientEmail: sa.ClientEmail, key: key, tokenURI: sa.TokenURI}, nil
+}
+
+func (f *FCM) client() *http.Client {
+	if f.Client != nil {
+		return f.Client
+	}
+	return &http.Client{Timeout: 15 * time.Second}
+}
+
+func (f *FCM) token(ctx context.Context) (string, error) { // OAuth access token, refreshed shortly before expiry
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.accessToken != "" && time.Until(f.expiry) > time.Minute {
+		return f.accessToken, nil
+	}
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   f.clientEmail,
+		"scope": fcmScope,
+		"aud":   f.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(f.key)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := f.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return "", fmt.Errorf("fcm: token request: HTTP %d: %s", resp.StatusCode, data)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("fcm: token response: %w", err)
+	}
+	f.accessToken, f.expiry = tok.AccessToken, now.Add(time.Duration(tok.ExpiresIn)*time.Second)
+	return f.accessToken, nil
+}
+
+type Push struct { // Push is one notification for one device token
+	Token string
+	Title string
+	Body  string
+	Data  map[string]string // Extra key/values for the app (e.g. "event")
+}
+
+// Send delivers one message. Unregistered or malformed tokens return an error wrapping
+// ErrInvalidToken.
+func (f *FCM) Send(ctx context.Context, p Push) error {
+	access, err := f.token(ctx)
+	if err != nil {
+		return err
+	}
+	base := f.BaseURL
+	if base == "" {
+		base = "https://fcm.googleapis.com"
+	}
+	body, _ := json.Marshal(map[string]any{"message": map[string]any{
+		"token":        p.Token,
+		"notification": map[string]string{"title": p.Title, "body": p.Body},
+		"data":         p.Data,
+	}})
+	endpoint := fmt.Sprintf("%s/v1/projects/%s/messages:send", base, url.PathEscape(f.ProjectID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+access)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.client().Do(req)
+	if err != nil {
+		return err // Network errors are worth retrying
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	var apiErr struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	json.Unmarshal(data, &apiErr)
+	code := apiErr.Error.Status
+	for _, d := range apiErr.Error.Details {
+		if d.ErrorCode != "" {
+			code = d.ErrorCode
+		}
+	}
+	err = fmt.Errorf("fcm: %s (%s, HTTP %d)", apiErr.Error.Message, code, resp.StatusCode)
+	switch {
+	case code == "UNREGISTERED" || resp.StatusCode == http.StatusNotFound:
+		return permanent(fmt.Errorf("%w: %v", ErrInvalidToken, err))
+	case resp.StatusCode == http.StatusUnauthorized: // Access token revoked early; fetch a new one on retry
+		f.mu.Lock()
+		f.accessToken = ""
+		f.mu.Unlock()
+		return err
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return err
+	default:
+		return permanent(err)
+	}
+}
+
+type Pusher struct { // Pusher queues push notifications and sends them in the background
+	fcm    *FCM
+	box    *outbox[Push]
+	mu     sync.Mutex      // Guards events
+	events map[string]bool // Events Notify pushes (nil means all)
+}
+
+// NewPusher creates a pusher; start Run to deliver. events limits which events Notify
+// pushes (nil for all). onInvalid (optional) is called with tokens FCM no longer accepts
+// so they can be deleted.
+func NewPusher(fcm *FCM, queueSize int, events map[string]bool, onInvalid func(token string)) *Pusher {
+	p := &Pusher{fcm: fcm, events: events}
+	p.box = newOutbox("push", queueSize, func(ctx context.Context, msg Push) error {
+		err := fcm.Send(ctx, msg)
+		if errors.Is(err, ErrInvalidToken) && onInvalid != nil {
+			onInvalid(msg.Token)
+		}
+		return err
+	})
+	return p
+}
+
+// SetEvents changes which events Notify pushes (nil for all), e.g. on a config reload.
+func (p *Pusher) SetEvents(events map[string]bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = events
+}
+
+func (p *Pusher) pushes(event string) bool { // Reports whether Notify pushes event
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.events == nil || p.events[event]
+}
+
+// Send queues a notification without blocking (ErrQueueFull at capacity). Delivery happens in Run.
+func (p *Pusher) Send(msg Push) error {
+	return p.box.push(msg)
+}
+
+// Run delivers queued notifications until ctx is cancelled, retrying transient failures.
+// It fits supervisor.Task.Run.
+func (p *Pusher) Run(ctx context.Context, beat func()) error {
+	return p.box.run(ctx, beat)
+}
@@ -0,0 +1,109 @@
+// push_test.go - Tests for FCM push delivery and event parsing
+// Run with: go test ./...
+
+package notify
+
+import (
+	"context"           // For cancellation
+	"crypto/rand"       // Test key
+	"crypto/rsa"        // Test key
+	"crypto/x509"       // PEM encoding
+	"encoding/json"     // Service account and payloads
+	"encoding/pem"      // PEM encoding
+	"net/http"          // HTTP handlers
+	"net/http/httptest" // Fake Google APIs
+	"sync/atomic"       // Counting token requests
+	"testing"           // Go's testing package
+	"time"              // For durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestFCMSend checks the OAuth exchange, message format, token caching and invalid tokens
+func TestFCMSend(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	var tokenCalls int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenCalls, 1)
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.FormValue("grant_type"))
+		assert.NotEmpty(t, r.FormValue("assertion"))
+		w.Write([]byte(`{"access_token":"ya29.test","expires_in":3600}`))
+	})
+	mux.HandleFunc("/v1/projects/farm-app/messages:send", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer ya29.test", r.Header.Get("Authorization"))
+		var body struct {
+			Message struct {
+				Token        string            `json:"token"`
+				Notification map[string]string `json:"notification"`
+				Data         map[string]string `json:"data"`
+			} `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Message.Token == "stale" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND","details":[{"errorCode":"UNREGISTERED"}]}}`))
+			return
+		}
+		assert.Equal(t, "Motor started", body.Message.Notification["title"])
+		assert.Equal(t, EventSessionStarted, body.Message.Data["event"])
+		w.Write([]byte(`{"name":"projects/farm-app/messages/1"}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	sa, _ := json.Marshal(map[string]string{
+		"project_id":   "farm-app",
+		"client_email": "push@farm-app.iam.gserviceaccount.com",
+		"private_key":  string(pemKey),
+		"token_uri":    srv.URL + "/token",
+	})
+	fcm, err := NewFCM(sa)
+	require.NoError(t, err)
+	fcm.BaseURL = srv.URL
+
+	msg := Push{Token: "good", Title: "Motor started", Data: map[string]string{"event": EventSessionStarted}}
+	require.NoError(t, fcm.Send(context.Background(), msg))
+	require.NoError(t, fcm.Send(context.Background(), msg))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tokenCalls)) // Access token cached
+
+	forgotten := make(chan string, 1)
+	pusher := NewPusher(fcm, 10, nil, func(token string) { forgotten <- token })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pusher.Run(ctx, func() {})
+	require.NoError(t, pusher.Send(Push{Token: "stale"}))
+	select {
+	case token := <-forgotten:
+		assert.Equal(t, "stale", token)
+	case <-time.After(time.Second):
+		t.Fatal("invalid token not reported")
+	}
+}
+
+// TestParseEvents checks the default set and unknown names
+func TestParseEvents(t *testing.T) {
+	all, err := ParseEvents(nil)
+	require.NoError(t, err)
+	assert.Len(t, all, len(Events))
+	some, err := ParseEvents([]string{" Shutdown", "session_started"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{EventShutdown: true, EventSessionStarted: true}, some)
+	_, err = ParseEvents([]string{"tea_time"})
+	assert.Error(t, err)
+}
+
+// TestPusherEvents checks that only the events set are pushed and that they can change
+// while running
+func TestPusherEvents(t *testing.T) {
+	pusher := NewPusher(nil, 10, map[string]bool{EventShutdown: true}, nil)
+	nobody := Recipient{} // No installs: a pushed event fails with ErrNoAddress
+	assert.NoError(t, pusher.Notify(nobody, Message{Event: EventSessionStarted}))
+	assert.ErrorIs(t, pusher.Notify(nobody, Message{Event: EventShutdown}), ErrNoAddress)
+
+	pusher.SetEvents(nil) // Every event, e.g. PUSH_EVENTS cleared on reload
+	assert.ErrorIs(t, pusher.Notify(nobody, Message{Event: EventSessionStarted}), ErrNoAddress)
+}
@@ -0,0 +1,121 @@
+// sms.go - SMS notifications behind a provider interface (Twilio first)
+
+package notify // Declares the package name
+
+import ( // Import required packages
+	"context"       // For cancellation
+	"encoding/json" // Provider error bodies
+	"fmt"           // For error formatting
+	"io"            // Reading responses
+	"net/http"      // Provider API
+	"net/url"       // Form encoding
+	"strings"       // Request bodies
+	"time"          // Client timeout
+)
+
+type SMSProvider interface { // SMSProvider delivers one text message
+	Name() string
+	SendSMS(ctx context.Context, to, body string) error
+}
+
+type SMSOptions struct { // SMSOptions selects and configures the provider
+	Provider         string // "twilio" or empty to disable SMS
+	TwilioAccountSID string // Twilio account SID
+	TwilioAuthToken  string // Twilio auth token
+	TwilioFrom       string // Sending number (E.164) or messaging service SID
+}
+
+func NewSMSProvider(opts SMSOptions) (SMSProvider, error) { // Builds the configured provider (nil if disabled)
+	switch opts.Provider {
+	case "":
+		return nil, nil
+	case "twilio":
+		if opts.TwilioAccountSID == "" || opts.TwilioAuthToken == "" || opts.TwilioFrom == "" {
+			return nil, fmt.Errorf("twilio: TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and TWILIO_FROM are required")
+		}
+		return &Twilio{AccountSID: opts.TwilioAccountSID, AuthToken: opts.TwilioAuthToken, From: opts.TwilioFrom}, nil
+	default:
+		return nil, fmt.Errorf("unknown SMS provider %q", opts.Provider)
+	}
+}
+
+type Twilio struct { // Twilio sends SMS through the Twilio Messages API
+	AccountSID string
+	AuthToken  string
+	From       string
+	BaseURL    string       // API root (empty uses https://api.twilio.com)
+	Client     *http.Client // HTTP client (nil uses a 15s-timeout client)
+}
+
+func (t *Twilio) Name() string { return "twilio" }
+
+func (t *Twilio) SendSMS(ctx context.Context, to, body string) error {
+	base, client := t.BaseURL, t.Client
+	if base == "" {
+		base = "https://api.twilio.com"
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 15 * time.Second}
+	}
+	form := url.Values{"To": {to}, "Body": {body}}
+	if strings.HasPrefix(t.From, "MG") { // Messaging service instead of a number
+		form.Set("MessagingServiceSid", t.From)
+	} else {
+		form.Set("From", t.From)
+	}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", base, url.PathEscape(t.AccountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err // Network errors are worth retrying
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	var apiErr struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	json.Unmarshal(data, &apiErr)
+	err = fmt.Errorf("twilio: %s (code %d, HTTP %d)", apiErr.Message, apiErr.Code, resp.StatusCode)
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return err
+	}
+	return permanent(err) // Bad number, bad credentials, ...: retrying won't help
+}
+
+type SMS struct { // SMS is a queued text message
+	To   string // E.164 number
+	Body string
+}
+
+type SMSSender struct { // SMSSender queues texts and sends them in the background
+	provider SMSProvider
+	box      *outbox[SMS]
+}
+
+func NewSMSSender(provider SMSProvider, queueSize int) *SMSSender { // Creates a sender; start Run to deliver
+	s := &SMSSender{provider: provider}
+	s.box = newOutbox("sms", queueSize, func(ctx context.Context, msg SMS) error {
+		return provider.SendSMS(ctx, msg.To, msg.Body)
+	})
+	return s
+}
+
+// Send queues a text without blocking (ErrQueueFull at capacity). Delivery happens in Run.
+func (s *SMSSender) Send(to, body string) error {
+	return s.box.push(SMS{To: to, Body: body})
+}
+
+// Run delivers queued texts until ctx is cancelled, retrying transient failures. It fits
+// supervisor.Task.Run.
+func (s *SMSSender) Run(ctx context.Context, beat func()) error {
+	return s.box.run(ctx, beat)
+}
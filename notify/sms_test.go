@@ -0,0 +1,62 @@
+// sms_test.go - Tests for the Twilio SMS provider and sender
+// Run with: go test ./...
+
+package notify
+
+import (
+	"context"           // For cancellation
+	"net/http"          // HTTP status codes
+	"net/http/httptest" // Fake Twilio API
+	"sync/atomic"       // For counting requests
+	"testing"           // Go's testing package
+	"time"              // For durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestTwilioSend checks the request format and that 4xx errors are not retried
+func TestTwilioSend(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		user, pass, _ := r.BasicAuth()
+		assert.Equal(t, "AC123", user)
+		assert.Equal(t, "token", pass)
+		assert.Equal(t, "/2010-04-01/Accounts/AC123/Messages.json", r.URL.Path)
+		if r.FormValue("To") == "+100" { // Invalid number
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":21211,"message":"Invalid 'To' Phone Number"}`))
+			return
+		}
+		assert.Equal(t, "+15550001111", r.FormValue("From"))
+		assert.Equal(t, "Motor started", r.FormValue("Body"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	provider := &Twilio{AccountSID: "AC123", AuthToken: "token", From: "+15550001111", BaseURL: srv.URL}
+	require.NoError(t, provider.SendSMS(context.Background(), "+15552223333", "Motor started"))
+	err := provider.SendSMS(context.Background(), "+100", "x")
+	assert.ErrorContains(t, err, "21211")
+
+	sender := NewSMSSender(provider, 10) // Permanent failures are dropped after one attempt
+	sender.box.backoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sender.Run(ctx, func() {})
+	require.NoError(t, sender.Send("+100", "x"))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+// TestNewSMSProvider checks provider selection and required settings
+func TestNewSMSProvider(t *testing.T) {
+	p, err := NewSMSProvider(SMSOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+	_, err = NewSMSProvider(SMSOptions{Provider: "twilio"})
+	assert.Error(t, err)
+	_, err = NewSMSProvider(SMSOptions{Provider: "pigeon"})
+	assert.Error(t, err)
+}
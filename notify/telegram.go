@@ -0,0 +1,153 @@
+// telegram.go - Telegram bot: queued outgoing messages and long-polled commands
+
+package notify // Declares the package name
+
+import ( // Import required packages
+	"bytes"         // Request bodies
+	"context"       // For cancellation
+	"encoding/json" // Bot API payloads
+	"errors"        // Context error checks
+	"fmt"           // For error formatting
+	"log/slog"      // Leveled logging
+	"net/http"      // Bot API
+	"time"          // Timeouts
+)
+
+type Telegram struct { // Telegram calls the Bot API for one bot token
+	Token   string
+	BaseURL string       // API root (empty uses https://api.telegram.org)
+	Client  *http.Client // HTTP client (nil uses http.DefaultClient; calls carry their own deadlines)
+}
+
+type TelegramUpdate struct { // TelegramUpdate is an incoming update; only text messages are used
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+func (t *Telegram) call(ctx context.Context, method string, params, result any) error { // POSTs params as JSON and decodes "result"
+	base, client := t.BaseURL, t.Client
+	if base == "" {
+		base = "https://api.telegram.org"
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/bot"+t.Token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err // Network errors are worth retrying
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		ErrorCode   int             `json:"error_code"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("telegram %s: HTTP %d: %w", method, resp.StatusCode, err)
+	}
+	if !reply.OK {
+		err := fmt.Errorf("telegram %s: %s (code %d)", method, reply.Description, reply.ErrorCode)
+		if reply.ErrorCode == http.StatusTooManyRequests || reply.ErrorCode >= 500 {
+			return err
+		}
+		return permanent(err) // Chat not found, bot blocked, bad token, ...
+	}
+	if result != nil {
+		return json.Unmarshal(reply.Result, result)
+	}
+	return nil
+}
+
+func (t *Telegram) SendMessage(ctx context.Context, chatID int64, text string) error { // Sends a plain-text message
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return t.call(ctx, "sendMessage", map[string]any{"chat_id": chatID, "text": text}, nil)
+}
+
+// GetUpdates long-polls for updates after offset, waiting up to wait for one to arrive.
+func (t *Telegram) GetUpdates(ctx context.Context, offset int64, wait time.Duration) ([]TelegramUpdate, error) {
+	ctx, cancel := context.WithTimeout(ctx, wait+10*time.Second)
+	defer cancel()
+	var updates []TelegramUpdate
+	params := map[string]any{"offset": offset, "timeout": int(wait.Seconds()), "allowed_updates": []string{"message"}}
+	err := t.call(ctx, "getUpdates", params, &updates)
+	return updates, err
+}
+
+// TelegramHandler answers a text message from a chat. An empty reply sends nothing.
+type TelegramHandler func(ctx context.Context, chatID int64, text string) string
+
+type telegramMessage struct {
+	ChatID int64
+	Text   string
+}
+
+type TelegramBot struct { // TelegramBot queues outgoing messages and answers commands
+	api    *Telegram
+	box    *outbox[telegramMessage]
+	handle TelegramHandler
+	wait   time.Duration // Long-poll timeout
+}
+
+func NewTelegramBot(api *Telegram, queueSize int, handle TelegramHandler) *TelegramBot { // Creates a bot; start Run and Poll
+	b := &TelegramBot{api: api, handle: handle, wait: 25 * time.Second}
+	b.box = newOutbox("telegram", queueSize, func(ctx context.Context, msg telegramMessage) error {
+		return api.SendMessage(ctx, msg.ChatID, msg.Text)
+	})
+	return b
+}
+
+// Send queues a message without blocking (ErrQueueFull at capacity). Delivery happens in Run.
+func (b *TelegramBot) Send(chatID int64, text string) error {
+	return b.box.push(telegramMessage{ChatID: chatID, Text: text})
+}
+
+// Run delivers queued messages until ctx is cancelled, retrying transient failures. It
+// fits supervisor.Task.Run.
+func (b *TelegramBot) Run(ctx context.Context, beat func()) error {
+	return b.box.run(ctx, beat)
+}
+
+// Poll receives commands until ctx is cancelled and queues the handler's replies. Telegram
+// allows only one poller per bot, so with several replicas run it under a leader lease.
+func (b *TelegramBot) Poll(ctx context.Context, beat func()) error {
+	var offset int64
+	for {
+		beat()
+		updates, err := b.api.GetUpdates(ctx, offset, b.wait)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("telegram poll: %w", err) // Let the supervisor back off and restart
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1 // Confirms the update on the next call
+			if u.Message == nil || u.Message.Text == "" {
+				continue
+			}
+			reply := b.handle(ctx, u.Message.Chat.ID, u.Message.Text)
+			if reply == "" {
+				continue
+			}
+			if err := b.Send(u.Message.Chat.ID, reply); err != nil {
+				slog.Error("telegram reply not queued", "chat_id", u.Message.Chat.ID, "error", err)
+			}
+		}
+	}
+}
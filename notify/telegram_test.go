@@ -0,0 +1,66 @@
+// telegram_test.go - Tests for the Telegram Bot API client and command polling
+// Run with: go test ./...
+
+package notify
+
+import (
+	"context"           // For cancellation
+	"encoding/json"     // Bot API payloads
+	"net/http"          // HTTP handlers
+	"net/http/httptest" // Fake Bot API
+	"strings"           // Path checks
+	"testing"           // Go's testing package
+	"time"              // For durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+)
+
+// TestTelegramPollAndReply checks that commands are handed to the handler and replies are sent
+func TestTelegramPollAndReply(t *testing.T) {
+	sent := make(chan map[string]any, 1)
+	polls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasPrefix(r.URL.Path, "/botTOKEN/"))
+		var params map[string]any
+		json.NewDecoder(r.Body).Decode(&params)
+		switch r.URL.Path {
+		case "/botTOKEN/getUpdates":
+			if polls++; polls == 1 {
+				w.Write([]byte(`{"ok":true,"result":[{"update_id":7,"message":{"chat":{"id":42},"text":"/status"}}]}`))
+				return
+			}
+			assert.Equal(t, float64(8), params["offset"]) // First update confirmed
+			w.Write([]byte(`{"ok":true,"result":[]}`))
+		case "/botTOKEN/sendMessage":
+			if params["chat_id"] == float64(13) { // Bot blocked by the user
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"ok":false,"error_code":403,"description":"Forbidden: bot was blocked by the user"}`))
+				return
+			}
+			sent <- params
+			w.Write([]byte(`{"ok":true,"result":{}}`))
+		}
+	}))
+	defer srv.Close()
+
+	api := &Telegram{Token: "TOKEN", BaseURL: srv.URL}
+	err := api.SendMessage(context.Background(), 13, "hi")
+	assert.ErrorContains(t, err, "blocked")
+	assert.ErrorAs(t, err, new(permanentError))
+
+	bot := NewTelegramBot(api, 10, func(ctx context.Context, chatID int64, text string) string {
+		return "status for " + text
+	})
+	bot.wait = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bot.Run(ctx, func() {})
+	go bot.Poll(ctx, func() {})
+	select {
+	case msg := <-sent:
+		assert.Equal(t, float64(42), msg["chat_id"])
+		assert.Equal(t, "status for /status", msg["text"])
+	case <-time.After(time.Second):
+		t.Fatal("reply not sent")
+	}
+}
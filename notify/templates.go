@@ -0,0 +1,106 @@
+// templates.go - Per-event, per-locale notification templates
+
+package notify // Declares the package name
+
+import ( // Import required packages
+	"bytes"         // Rendering
+	"embed"         // Built-in templates
+	"fmt"           // For error formatting
+	"io/fs"         // Template sources
+	"path"          // File names
+	"sort"          // Stable locale list
+	"strings"       // Trimming output
+	"text/template" // Template engine
+)
+
+// DefaultLocale is used when a user has no locale or a template is missing in theirs.
+const DefaultLocale = "en"
+
+//go:embed templates/events
+var eventFiles embed.FS // templates/events/<locale>/<name>.tmpl
+
+// Templates holds notification templates by locale and name. Each file defines a "title"
+// and a "body" block, and optionally an "email" block for a longer email version.
+type Templates struct {
+	sets map[string]map[string]*template.Template // locale -> name -> template
+}
+
+// DefaultTemplates are the built-in templates.
+var DefaultTemplates = mustLoadTemplates()
+
+func mustLoadTemplates() *Templates {
+	sub, err := fs.Sub(eventFiles, "templates/events")
+	if err != nil {
+		panic(err)
+	}
+	t, err := LoadTemplates(sub)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// LoadTemplates parses <locale>/<name>.tmpl files from fsys. Adding a locale is a matter of
+// adding a directory; missing templates fall back to DefaultLocale.
+func LoadTemplates(fsys fs.FS) (*Templates, error) {
+	files, err := fs.Glob(fsys, "*/*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	t := &Templates{sets: make(map[string]map[string]*template.Template)}
+	for _, file := range files {
+		locale, name := path.Dir(file), strings.TrimSuffix(path.Base(file), ".tmpl")
+		tmpl, err := template.New(name).ParseFS(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		if tmpl.Lookup("title") == nil || tmpl.Lookup("body") == nil {
+			return nil, fmt.Errorf("template %s: needs title and body blocks", file)
+		}
+		if t.sets[locale] == nil {
+			t.sets[locale] = make(map[string]*template.Template)
+		}
+		t.sets[locale][name] = tmpl
+	}
+	if t.sets[DefaultLocale] == nil {
+		return nil, fmt.Errorf("no %s templates", DefaultLocale)
+	}
+	return t, nil
+}
+
+func (t *Templates) Locales() []string { // Locales with at least one template
+	var locales []string
+	for l := range t.sets {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+func (t *Templates) HasLocale(locale string) bool { return t.sets[locale] != nil }
+
+// Render fills in template name for event in locale (falling back to DefaultLocale).
+func (t *Templates) Render(event, name, locale string, data any) (Message, error) {
+	tmpl := t.sets[locale][name]
+	if tmpl == nil {
+		tmpl = t.sets[DefaultLocale][name]
+	}
+	if tmpl == nil {
+		return Message{}, fmt.Errorf("no notification template %q", name)
+	}
+	msg := Message{Event: event}
+	for _, part := range []struct {
+		block string
+		dst   *string
+	}{{"title", &msg.Title}, {"body", &msg.Body}, {"email", &msg.EmailBody}} {
+		if tmpl.Lookup(part.block) == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&buf, part.block, data); err != nil {
+			return Message{}, err
+		}
+		*part.dst = strings.TrimSpace(buf.String())
+	}
+	return msg, nil
+}
@@ -0,0 +1,89 @@
+// templates_test.go - Tests for per-event, per-locale notification templates
+// Run with: go test ./...
+
+package notify
+
+import (
+	"testing"        // Go's testing package
+	"testing/fstest" // In-memory template files
+	"time"           // Template data
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestDefaultTemplatesRender checks that every built-in template renders a title and body
+func TestDefaultTemplatesRender(t *testing.T) {
+	now := time.Date(2024, 5, 1, 14, 30, 0, 0, time.UTC)
+	cases := map[string]map[string]any{
+		"session_started":        {"Minutes": 10},
+		"session_finished":       {"Minutes": 10, "Outages": 1},
+		"session_interrupted":    {},
+		"session_safety_stopped": {"RanMinutes": 30},
+		"session_stopped":        {"RanMinutes": 25, "Reason": "the south pump was left running"},
+		"session_power_lost":     {"Minutes": 20, "RanMinutes": 5, "Reason": "device restarted; 15 min refunded"},
+		"request_rejected":       {"Minutes": 10, "Reason": "daily quota reached"},
+		"request_expired":        {"Minutes": 10, "Reason": "expired at 2024-05-01T12:30:00Z"},
+		"quota_warning":          {"Percent": 80, "UsedMinutes": 96, "LimitMinutes": 120, "ResetsAt": now},
+		"shutdown":               {"Active": true, "Reason": "maintenance"},
+		"maintenance":            {"Cancelled": false, "StartsAt": now, "EndsAt": now.Add(3 * time.Hour), "Reason": "pump replacement"},
+		"shutdown_alert":         {"Active": true, "By": "admin@example.com", "At": now, "Reason": "maintenance", "Dropped": 2},
+		"shutdown_expired":       {"Active": false, "Expired": true, "At": now, "Since": now.Add(-2 * time.Hour), "Reason": "electrical work"},
+		"device_shutdown":        {"Active": true, "Organization": "Green Acres", "Devices": "pump-1, pump-2", "By": "admin@example.com", "At": now, "Reason": "faulty wiring", "Until": now.Add(time.Hour)},
+		"broker_down":            {"Instance": "pi-1", "Broker": "tcp://broker:1883", "Since": now, "For": 2 * time.Minute},
+		"motor_fault":            {"Motor": "motor", "Reason": "device did not confirm ON", "At": now},
+		"anomaly":                {"Kind": "usage_spike", "User": "farmer@example.com", "Detail": "310 min in the last 24h, usually 45 min a day", "At": now},
+		"broker_up":              {"Instance": "pi-1", "Broker": "tcp://broker:1883", "For": 3 * time.Minute},
+		"digest":                 {"Period": "daily", "From": now.Add(-24 * time.Hour), "To": now, "Runs": 2, "Interrupted": 1, "RuntimeMinutes": 25, "RejectedCount": 1, "Rejected": []map[string]any{{"At": now, "Minutes": 15, "Reason": "daily quota reached"}}, "Upcoming": []map[string]any{{"At": now, "Minutes": 20, "Name": "Morning"}}},
+	}
+	for name, data := range cases {
+		if name == "shutdown_expired" { // Same template, other branch
+			name = "shutdown_alert"
+		}
+		msg, err := DefaultTemplates.Render(EventAdminAlert, name, "en", data)
+		require.NoError(t, err, name)
+		assert.NotEmpty(t, msg.Title, name)
+		assert.NotEmpty(t, msg.Body, name)
+		assert.NotContains(t, msg.Body, "<no value>", name)
+		assert.Equal(t, EventAdminAlert, msg.Event)
+	}
+
+	msg, err := DefaultTemplates.Render(EventAdminAlert, "shutdown_alert", "en", cases["shutdown_alert"])
+	require.NoError(t, err)
+	assert.Contains(t, msg.EmailBody, "admin@example.com") // Email gets the longer version
+}
+
+// TestTemplatesLocaleFallback checks that missing locales and templates fall back to English
+func TestTemplatesLocaleFallback(t *testing.T) {
+	fsys := fstest.MapFS{
+		"en/hello.tmpl": {Data: []byte(`{{define "title"}}Hello{{end}}{{define "body"}}Hi {{.Name}}{{end}}`)},
+		"en/bye.tmpl":   {Data: []byte(`{{define "title"}}Bye{{end}}{{define "body"}}Bye {{.Name}}{{end}}`)},
+		"ur/hello.tmpl": {Data: []byte(`{{define "title"}}Salaam{{end}}{{define "body"}}Salaam {{.Name}}{{end}}`)},
+	}
+	tmpls, err := LoadTemplates(fsys)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"en", "ur"}, tmpls.Locales())
+	assert.True(t, tmpls.HasLocale("ur"))
+	assert.False(t, tmpls.HasLocale("fr"))
+
+	data := map[string]any{"Name": "Ali"}
+	msg, err := tmpls.Render("x", "hello", "ur", data)
+	require.NoError(t, err)
+	assert.Equal(t, "Salaam Ali", msg.Body)
+	msg, err = tmpls.Render("x", "bye", "ur", data) // Not translated yet
+	require.NoError(t, err)
+	assert.Equal(t, "Bye Ali", msg.Body)
+	msg, err = tmpls.Render("x", "hello", "", data)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", msg.Title)
+	_, err = tmpls.Render("x", "missing", "en", data)
+	assert.Error(t, err)
+}
+
+// TestLoadTemplatesRejectsIncomplete checks that templates need both blocks and an English set
+func TestLoadTemplatesRejectsIncomplete(t *testing.T) {
+	_, err := LoadTemplates(fstest.MapFS{"en/a.tmpl": {Data: []byte(`{{define "title"}}A{{end}}`)}})
+	assert.ErrorContains(t, err, "needs title and body")
+	_, err = LoadTemplates(fstest.MapFS{"ur/a.tmpl": {Data: []byte(`{{define "title"}}A{{end}}{{define "body"}}B{{end}}`)}})
+	assert.ErrorContains(t, err, "no en templates")
+}
@@ -0,0 +1,116 @@
+// whatsapp.go - WhatsApp notifications through the WhatsApp Business Cloud API
+
+package notify // Declares the package name
+
+import ( // Import required packages
+	"bytes"         // Request bodies
+	"context"       // For cancellation
+	"encoding/json" // API payloads
+	"fmt"           // For error formatting
+	"io"            // Reading responses
+	"net/http"      // Cloud API
+	"net/url"       // Path escaping
+	"strings"       // Number formatting
+	"time"          // Client timeout
+)
+
+// WhatsApp sends messages from a WhatsApp Business phone number. Free-form text is only
+// delivered inside the 24-hour window after the user last wrote to the business; set
+// Template to an approved template with one body parameter to reach users at any time.
+type WhatsApp struct {
+	Token            string       // Permanent access token of a system user
+	PhoneNumberID    string       // Sending phone number ID from the Meta app dashboard
+	Template         string       // Approved template name (empty sends plain text)
+	TemplateLanguage string       // Template language code (empty means "en")
+	BaseURL          string       // API root (empty uses https://graph.facebook.com/v21.0)
+	Client           *http.Client // HTTP client (nil uses a 15s-timeout client)
+}
+
+func (w *WhatsApp) SendMessage(ctx context.Context, to, body string) error { // Sends body to an E.164 number
+	base, client := w.BaseURL, w.Client
+	if base == "" {
+		base = "https://graph.facebook.com/v21.0"
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 15 * time.Second}
+	}
+	msg := map[string]any{
+		"messaging_product": "whatsapp",
+		"to":                strings.TrimPrefix(to, "+"), // The API wants digits only
+	}
+	if w.Template != "" {
+		lang := w.TemplateLanguage
+		if lang == "" {
+			lang = "en"
+		}
+		msg["type"] = "template"
+		msg["template"] = map[string]any{
+			"name":     w.Template,
+			"language": map[string]string{"code": lang},
+			"components": []any{map[string]any{
+				"type":       "body",
+				"parameters": []any{map[string]string{"type": "text", "text": body}},
+			}},
+		}
+	} else {
+		msg["type"] = "text"
+		msg["text"] = map[string]string{"body": body}
+	}
+	payload, _ := json.Marshal(msg)
+	endpoint := fmt.Sprintf("%s/%s/messages", base, url.PathEscape(w.PhoneNumberID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+w.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err // Network errors are worth retrying
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	var apiErr struct {
+		Error struct {
+			Message string `json:"message"`
+			Code    int    `json:"code"`
+		} `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	json.Unmarshal(data, &apiErr)
+	err = fmt.Errorf("whatsapp: %s (code %d, HTTP %d)", apiErr.Error.Message, apiErr.Error.Code, resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return err
+	case apiErr.Error.Code == 130429 || apiErr.Error.Code == 131056: // Throughput and per-pair rate limits
+		return err
+	default:
+		return permanent(err) // Not a WhatsApp user, outside the 24h window, bad token, ...
+	}
+}
+
+type WhatsAppSender struct { // WhatsAppSender queues WhatsApp messages and sends them in the background
+	api *WhatsApp
+	box *outbox[SMS]
+}
+
+func NewWhatsAppSender(api *WhatsApp, queueSize int) *WhatsAppSender { // Creates a sender; start Run to deliver
+	s := &WhatsAppSender{api: api}
+	s.box = newOutbox("whatsapp", queueSize, func(ctx context.Context, msg SMS) error {
+		return api.SendMessage(ctx, msg.To, msg.Body)
+	})
+	return s
+}
+
+// Send queues a message without blocking (ErrQueueFull at capacity). Delivery happens in Run.
+func (s *WhatsAppSender) Send(to, body string) error {
+	return s.box.push(SMS{To: to, Body: body})
+}
+
+// Run delivers queued messages until ctx is cancelled, retrying transient failures. It fits
+// supervisor.Task.Run.
+func (s *WhatsAppSender) Run(ctx context.Context, beat func()) error {
+	return s.box.run(ctx, beat)
+}
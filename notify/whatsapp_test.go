@@ -0,0 +1,67 @@
+// whatsapp_test.go - Tests for the WhatsApp Cloud API sender
+// Run with: go test ./...
+
+package notify
+
+import (
+	"context"           // For cancellation
+	"encoding/json"     // Request payloads
+	"net/http"          // HTTP status codes
+	"net/http/httptest" // Fake Cloud API
+	"testing"           // Go's testing package
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestWhatsAppSend checks text and template payloads and which errors are retried
+func TestWhatsAppSend(t *testing.T) {
+	var last map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/1234/messages", r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		last = nil
+		json.NewDecoder(r.Body).Decode(&last)
+		switch last["to"] {
+		case "100": // Outside the 24h window
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"Re-engagement message","code":131047}}`))
+		case "200": // Rate limited
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"Rate limit hit","code":130429}}`))
+		default:
+			w.Write([]byte(`{"messages":[{"id":"wamid.1"}]}`))
+		}
+	}))
+	defer srv.Close()
+
+	api := &WhatsApp{Token: "token", PhoneNumberID: "1234", BaseURL: srv.URL}
+	require.NoError(t, api.SendMessage(context.Background(), "+923001234567", "Motor started"))
+	assert.Equal(t, "923001234567", last["to"])
+	assert.Equal(t, "text", last["type"])
+	assert.Equal(t, map[string]any{"body": "Motor started"}, last["text"])
+
+	err := api.SendMessage(context.Background(), "+100", "x")
+	assert.ErrorContains(t, err, "131047")
+	assert.ErrorAs(t, err, &permanentError{})
+	err = api.SendMessage(context.Background(), "+200", "x")
+	assert.ErrorContains(t, err, "130429")
+	assert.NotErrorAs(t, err, &permanentError{})
+
+	api.Template = "motor_update"
+	require.NoError(t, api.SendMessage(context.Background(), "+923001234567", "Motor started"))
+	assert.Equal(t, "template", last["type"])
+	tmpl := last["template"].(map[string]any)
+	assert.Equal(t, "motor_update", tmpl["name"])
+	assert.Equal(t, map[string]any{"code": "en"}, tmpl["language"])
+	assert.Contains(t, tmpl["components"].([]any)[0].(map[string]any)["parameters"], map[string]any{"type": "text", "text": "Motor started"})
+}
+
+// TestWhatsAppNotify checks that users without a phone number are skipped
+func TestWhatsAppNotify(t *testing.T) {
+	sender := NewWhatsAppSender(&WhatsApp{}, 1)
+	assert.Equal(t, ChannelWhatsApp, sender.Channel())
+	assert.ErrorIs(t, sender.Notify(Recipient{UserID: 1}, Message{Body: "x"}), ErrNoAddress)
+	assert.NoError(t, sender.Notify(Recipient{UserID: 1, Phone: "+15550001111"}, Message{Body: "x"}))
+	assert.ErrorIs(t, sender.Notify(Recipient{UserID: 1, Phone: "+15550001111"}, Message{Body: "y"}), ErrQueueFull)
+}
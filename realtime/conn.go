@@ -0,0 +1,73 @@
+// conn.go - Serving a hub client over a WebSocket connection
+
+package realtime // Declares the package name
+
+import ( // Import required packages
+	"encoding/json" // Commands
+	"time"          // Deadlines and pings
+
+	"github.com/gorilla/websocket" // WebSocket protocol
+)
+
+const (
+	writeWait  = 10 * time.Second // Longest a single write may take
+	pongWait   = 60 * time.Second // Connection is dropped without a pong within this
+	pingPeriod = 50 * time.Second // Pings go out this often, within pongWait
+)
+
+type command struct { // What a client sends: {"subscribe": ["motor"]} or {"unsubscribe": [...]}
+	Subscribe   []string `json:"subscribe"`
+	Unsubscribe []string `json:"unsubscribe"`
+}
+
+// Serve writes c's events to conn and applies the subscription changes the client sends,
+// until either side closes the connection or the hub evicts c. It unregisters c and
+// closes conn before returning.
+func (h *Hub) Serve(conn *websocket.Conn, c *Client) {
+	defer conn.Close()
+	defer h.Unregister(c)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		read(conn, c)
+	}()
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case msg := <-c.send:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-closed: // Client went away
+			return
+		case <-c.evicted: // Fell behind
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too slow"), time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+func read(conn *websocket.Conn, c *Client) { // Applies subscription changes until the connection fails
+	conn.SetReadLimit(4096)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error { return conn.SetReadDeadline(time.Now().Add(pongWait)) })
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var cmd command
+		if json.Unmarshal(msg, &cmd) != nil {
+			continue // Not a command; ignored
+		}
+		c.Subscribe(cmd.Subscribe...)
+		c.Unsubscribe(cmd.Unsubscribe...)
+	}
+}
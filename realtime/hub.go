@@ -0,0 +1,133 @@
+// hub.go - Fan-out of live events to WebSocket clients
+//
+// Every client has its own bounded send buffer, filled by Publish without blocking and
+// drained by the client's own writer goroutine. A client whose buffer is full is evicted
+// (its connection is closed) rather than waited for, so one stalled dashboard can't hold
+// up delivery to everyone else. Clients only get the topics they subscribed to, and only
+// events for their own organization unless they may see all of them.
+
+package realtime // Declares the package name
+
+import ( // Import required packages
+	"encoding/json" // Event encoding
+	"log/slog"      // Leveled logging
+	"sync"          // For mutex (thread safety)
+	"sync/atomic"   // Eviction counter
+	"time"          // Event times
+)
+
+type Event struct { // A live update
+	Topic string    `json:"topic"` // What it is about, e.g. "motor", "sessions", "shutdown"
+	OrgID uint      `json:"-"`     // Organization it concerns (0: every organization)
+	Data  any       `json:"data"`
+	At    time.Time `json:"at"`
+}
+
+// Hub keeps track of the connected clients and fans events out to them.
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[*Client]struct{}
+	buffer  int          // Messages a client can fall behind by before it is evicted
+	evicted atomic.Int64 // Clients evicted for falling behind
+}
+
+func NewHub(buffer int) *Hub { // Creates a hub whose clients can each have buffer messages waiting
+	return &Hub{clients: map[*Client]struct{}{}, buffer: max(buffer, 1)}
+}
+
+// Client is one connection's view of the hub.
+type Client struct {
+	send    chan []byte   // Encoded events waiting to be written
+	evicted chan struct{} // Closed when the hub drops the client
+	once    sync.Once
+	orgID   uint
+	all     bool // Sees every organization's events (global admins)
+
+	mu     sync.Mutex
+	topics map[string]bool
+}
+
+// Register adds a client of organization orgID (every organization with all) subscribed
+// to topics.
+func (h *Hub) Register(orgID uint, all bool, topics ...string) *Client {
+	c := &Client{send: make(chan []byte, h.buffer), evicted: make(chan struct{}), orgID: orgID, all: all, topics: map[string]bool{}}
+	c.Subscribe(topics...)
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+	return c
+}
+
+// Unregister removes c; it gets no further events.
+func (h *Hub) Unregister(c *Client) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+	c.once.Do(func() { close(c.evicted) })
+}
+
+// Publish queues ev for every client subscribed to its topic that may see it, and evicts
+// the ones with no room left. It never blocks.
+func (h *Hub) Publish(ev Event) {
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("realtime event not sent", "topic", ev.Topic, "error", err)
+		return
+	}
+	var slow []*Client
+	h.mu.RLock()
+	for c := range h.clients {
+		if !c.wants(ev) {
+			continue
+		}
+		select {
+		case c.send <- msg:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	h.mu.RUnlock()
+	for _, c := range slow {
+		h.evicted.Add(1)
+		h.Unregister(c)
+	}
+}
+
+// Stats reports the connected clients and how many were evicted for falling behind.
+func (h *Hub) Stats() (clients int, evicted int64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients), h.evicted.Load()
+}
+
+func (c *Client) wants(ev Event) bool { // Reports whether ev is for c
+	if ev.OrgID != 0 && ev.OrgID != c.orgID && !c.all {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.topics[ev.Topic]
+}
+
+func (c *Client) Subscribe(topics ...string) { // Starts sending c events on topics
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range topics {
+		c.topics[t] = true
+	}
+}
+
+func (c *Client) Unsubscribe(topics ...string) { // Stops sending c events on topics
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range topics {
+		delete(c.topics, t)
+	}
+}
+
+func (c *Client) Send() <-chan []byte { return c.send } // Encoded events to write, in order
+
+func (c *Client) Evicted() <-chan struct{} { return c.evicted } // Closed once c is unregistered
@@ -0,0 +1,84 @@
+// hub_test.go - Tests for the live update hub
+// Run with: go test ./...
+
+package realtime
+
+import (
+	"encoding/json"     // Event decoding
+	"net/http"          // Test server
+	"net/http/httptest" // Test server
+	"strings"           // WebSocket URL
+	"testing"           // Go's testing package
+	"time"              // Read deadlines
+
+	"github.com/gorilla/websocket" // WebSocket client
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHubFanOut checks topic and organization filtering, and that a client that falls
+// behind is evicted without holding up the others
+func TestHubFanOut(t *testing.T) {
+	h := NewHub(2)
+	farm := h.Register(1, false, "motor")
+	other := h.Register(2, false, "motor", "sessions")
+	admin := h.Register(0, true, "motor")
+
+	h.Publish(Event{Topic: "motor", OrgID: 1, Data: "on"})
+	h.Publish(Event{Topic: "sessions", OrgID: 2, Data: "started"})
+	h.Publish(Event{Topic: "shutdown", Data: true}) // Nobody subscribed
+	assert.Len(t, farm.Send(), 1)
+	assert.Len(t, other.Send(), 1)
+	assert.Len(t, admin.Send(), 1)
+
+	<-admin.Send() // The admin keeps up; the farm's dashboard doesn't
+	h.Publish(Event{Topic: "motor", OrgID: 1, Data: "off"})
+	h.Publish(Event{Topic: "motor", OrgID: 1, Data: "on"})
+	select {
+	case <-farm.Evicted():
+	default:
+		t.Fatal("slow client not evicted")
+	}
+	assert.Len(t, admin.Send(), 2)
+	clients, evicted := h.Stats()
+	assert.Equal(t, 2, clients)
+	assert.Equal(t, int64(1), evicted)
+
+	other.Unsubscribe("sessions")
+	h.Publish(Event{Topic: "sessions", OrgID: 2})
+	assert.Len(t, other.Send(), 1)
+}
+
+// TestServe checks that events reach a WebSocket client and that it can subscribe to more
+// topics
+func TestServe(t *testing.T) {
+	h := NewHub(8)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		h.Serve(conn, h.Register(1, false, "motor"))
+	}))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool { n, _ := h.Stats(); return n == 1 }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, conn.WriteJSON(command{Subscribe: []string{"shutdown"}}))
+	time.Sleep(50 * time.Millisecond) // Let the subscription land
+	h.Publish(Event{Topic: "shutdown", Data: map[string]any{"active": true}})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	var ev struct {
+		Topic string         `json:"topic"`
+		Data  map[string]any `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(msg, &ev))
+	assert.Equal(t, "shutdown", ev.Topic)
+	assert.Equal(t, true, ev.Data["active"])
+
+	conn.Close()
+	assert.Eventually(t, func() bool { n, _ := h.Stats(); return n == 0 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,192 @@
+// scheduler.go - Cron-like background job scheduler with jitter, overlap protection and run history
+
+package scheduler // Declares the package name
+
+import ( // Import required packages
+	"context"                // For cancellation
+	"fmt"                    // For error formatting
+	"go-mqtt-backend/models" // JobRun model
+	"log"                    // Logging
+	"math/rand"              // Jitter
+	"sort"                   // Stable job listing
+	"sync"                   // For mutex (thread safety)
+	"time"                   // For time operations
+
+	"github.com/robfig/cron/v3" // Cron expression parsing
+	"gorm.io/gorm"              // Run history storage
+)
+
+type Job struct { // Job describes a recurring background task
+	Name   string                          // Unique job name
+	Spec   string                          // Cron expression ("0 3 * * *") or descriptor ("@every 1h", "@daily")
+	Jitter time.Duration                   // Random delay up to this long added to each run
+	Run    func(ctx context.Context) error // Work to do; ctx is cancelled on shutdown
+}
+
+type JobStatus struct { // JobStatus is a snapshot of a job for status endpoints
+	Name    string          `json:"name"`
+	Spec    string          `json:"spec"`
+	Running bool            `json:"running"`
+	NextRun time.Time       `json:"next_run"`
+	LastRun *models.JobRun  `json:"last_run,omitempty"`
+	History []models.JobRun `json:"history,omitempty"`
+}
+
+type entry struct { // entry is a registered job and its runtime state
+	job      Job           // Job definition
+	schedule cron.Schedule // Parsed spec
+	running  bool          // Whether a run is in progress
+	nextRun  time.Time     // When the next run is due
+	lastRun  *models.JobRun
+}
+
+type Scheduler struct { // Scheduler runs registered jobs until stopped
+	db      *gorm.DB          // Where run history is stored (nil disables history)
+	mu      sync.Mutex        // Mutex for thread safety
+	entries map[string]*entry // Jobs by name
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup // Tracks job loops and in-flight runs
+}
+
+var parser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor) // Standard 5-field cron
+
+func ParseSpec(spec string) (cron.Schedule, error) { // Parses a cron expression or descriptor
+	return parser.Parse(spec)
+}
+
+func New(db *gorm.DB) *Scheduler { // Creates a scheduler that records runs in db
+	return &Scheduler{db: db, entries: make(map[string]*entry)}
+}
+
+func (s *Scheduler) Add(job Job) error { // Registers a job; call before Start
+	sched, err := ParseSpec(job.Spec)
+	if err != nil {
+		return fmt.Errorf("job %s: invalid spec %q: %w", job.Name, job.Spec, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.entries[job.Name]; exists {
+		return fmt.Errorf("job %s already registered", job.Name)
+	}
+	s.entries[job.Name] = &entry{job: job, schedule: sched}
+	return nil
+}
+
+func (s *Scheduler) Start() { // Starts one timer loop per job
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		s.wg.Add(1)
+		go s.loop(ctx, e)
+	}
+}
+
+// Stop cancels pending timers and running jobs, then waits for them to return or for
+// ctx to expire.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	done := make(chan struct{})
+	go func() { s.wg.Wait(); close(done) }()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, e *entry) { // Waits for each due time and starts a run
+	defer s.wg.Done()
+	for {
+		next := e.schedule.Next(time.Now())
+		if e.job.Jitter > 0 { // Spread runs so jobs sharing a spec don't all fire at once
+			next = next.Add(time.Duration(rand.Int63n(int64(e.job.Jitter))))
+		}
+		s.mu.Lock()
+		e.nextRun = next
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.mu.Lock()
+		if e.running { // Overlap protection: previous run still going
+			s.mu.Unlock()
+			s.record(e, models.JobRun{Job: e.job.Name, StartedAt: time.Now(), FinishedAt: time.Now(), Status: "skipped", Error: "previous run still in progress"})
+			continue
+		}
+		e.running = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.run(ctx, e) // Run asynchronously so the timer keeps ticking for overlap detection
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, e *entry) { // Executes one run and records the result
+	defer s.wg.Done()
+	run := models.JobRun{Job: e.job.Name, StartedAt: time.Now(), Status: "ok"}
+	func() {
+		defer func() { // A panicking job must not take the scheduler down
+			if r := recover(); r != nil {
+				run.Status, run.Error = "failed", fmt.Sprintf("panic: %v", r)
+			}
+		}()
+		if err := e.job.Run(ctx); err != nil {
+			run.Status, run.Error = "failed", err.Error()
+		}
+	}()
+	run.FinishedAt = time.Now()
+	if run.Status == "failed" {
+		log.Printf("job %s failed: %s", e.job.Name, run.Error)
+	}
+	s.mu.Lock()
+	e.running = false
+	s.mu.Unlock()
+	s.record(e, run)
+}
+
+func (s *Scheduler) record(e *entry, run models.JobRun) { // Stores a run in the history
+	if s.db != nil {
+		if err := s.db.Create(&run).Error; err != nil {
+			log.Printf("job %s: saving run history failed: %v", e.job.Name, err)
+		}
+	}
+	s.mu.Lock()
+	e.lastRun = &run
+	s.mu.Unlock()
+}
+
+// Status returns every job with its next run and up to historyLimit recent runs.
+func (s *Scheduler) Status(historyLimit int) []JobStatus {
+	s.mu.Lock()
+	statuses := make([]JobStatus, 0, len(s.entries))
+	for _, e := range s.entries {
+		statuses = append(statuses, JobStatus{Name: e.job.Name, Spec: e.job.Spec, Running: e.running, NextRun: e.nextRun, LastRun: e.lastRun})
+	}
+	s.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	if s.db != nil && historyLimit > 0 {
+		for i := range statuses {
+			s.db.Where("job = ?", statuses[i].Name).Order("started_at desc").Limit(historyLimit).Find(&statuses[i].History)
+		}
+	}
+	return statuses
+}
+
+// PruneHistory deletes run history older than maxAge. It is itself registered as a job.
+func (s *Scheduler) PruneHistory(maxAge time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return s.db.WithContext(ctx).Where("started_at < ?", time.Now().Add(-maxAge)).Delete(&models.JobRun{}).Error
+	}
+}
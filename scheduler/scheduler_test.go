@@ -0,0 +1,112 @@
+// scheduler_test.go - Tests for the background job scheduler
+// Run with: go test ./...
+
+package scheduler
+
+import (
+	"context"     // For job functions
+	"sync/atomic" // For counting runs
+	"testing"     // Go's testing package
+	"time"        // For durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestAddRejectsBadSpecs checks spec validation and duplicate names
+func TestAddRejectsBadSpecs(t *testing.T) {
+	s := New(nil)
+	noop := func(ctx context.Context) error { return nil }
+	assert.Error(t, s.Add(Job{Name: "bad", Spec: "not a cron spec", Run: noop}))
+	require.NoError(t, s.Add(Job{Name: "ok", Spec: "*/5 * * * *", Run: noop}))
+	assert.Error(t, s.Add(Job{Name: "ok", Spec: "@daily", Run: noop})) // Duplicate name
+}
+
+// TestOverlapProtection checks that a slow job is skipped rather than run twice at once
+func TestOverlapProtection(t *testing.T) {
+	s := New(nil)
+	var running, maxRunning, runs int32
+	require.NoError(t, s.Add(Job{Name: "slow", Spec: "@every 1s", Run: func(ctx context.Context) error {
+		n := atomic.AddInt32(&running, 1)
+		if n > atomic.LoadInt32(&maxRunning) {
+			atomic.StoreInt32(&maxRunning, n)
+		}
+		atomic.AddInt32(&runs, 1)
+		select { // Outlast the next tick
+		case <-time.After(1500 * time.Millisecond):
+		case <-ctx.Done():
+		}
+		atomic.AddInt32(&running, -1)
+		return nil
+	}}))
+	s.Start()
+	time.Sleep(2500 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.Stop(ctx))
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxRunning)) // Never concurrent
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&runs), int32(1))
+	status := s.Status(0)
+	require.Len(t, status, 1)
+	require.NotNil(t, status[0].LastRun)
+}
+
+// TestParseSpecInDST checks that runs keep their wall-clock time across DST changes and happen once a day
+func TestParseSpecInDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	_, err = ParseSpecIn("CRON_TZ=UTC 0 6 * * *", ny)
+	assert.Error(t, err)
+
+	next := func(spec string, from time.Time, n int) []string {
+		sched, err := ParseSpecIn(spec, ny)
+		require.NoError(t, err)
+		var out []string
+		for i := 0; i < n; i++ {
+			from = sched.Next(from)
+			out = append(out, from.Format("01-02 15:04 MST"))
+		}
+		return out
+	}
+	spring := time.Date(2024, 3, 9, 12, 0, 0, 0, ny)
+	assert.Equal(t, []string{"03-09 18:00 EST", "03-10 18:00 EDT"}, next("0 18 * * *", spring, 2))
+	assert.Equal(t, []string{"03-10 03:30 EDT", "03-11 02:30 EDT"}, next("30 2 * * *", spring, 2)) // 02:30 doesn't exist on the 10th
+	fall := time.Date(2024, 11, 2, 12, 0, 0, 0, ny)
+	assert.Equal(t, []string{"11-03 01:30 EDT", "11-04 01:30 EST"}, next("30 1 * * *", fall, 2)) // 01:30 happens twice on the 3rd
+
+	every, err := ParseSpecIn("@every 90m", ny)
+	require.NoError(t, err)
+	assert.Equal(t, spring.Add(90*time.Minute), every.Next(spring))
+}
+
+// TestSolarSchedule checks sunrise/sunset times, offsets and days without a sunrise
+func TestSolarSchedule(t *testing.T) {
+	lahore, err := time.LoadLocation("Asia/Karachi")
+	require.NoError(t, err)
+	near := func(want, got time.Time) {
+		t.Helper()
+		assert.InDelta(t, 0, got.Sub(want).Minutes(), 3, "want %s, got %s", want, got.In(lahore))
+	}
+
+	from := time.Date(2024, 6, 21, 0, 0, 0, 0, lahore)
+	sunrise, err := ParseSolarSpec("@sunrise", 31.5204, 74.3587)
+	require.NoError(t, err)
+	near(time.Date(2024, 6, 21, 4, 59, 0, 0, lahore), sunrise.Next(from))
+	sunset, err := ParseSolarSpec("@sunset-30m", 31.5204, 74.3587)
+	require.NoError(t, err)
+	near(time.Date(2024, 6, 21, 18, 39, 0, 0, lahore), sunset.Next(from))
+	next := sunset.Next(sunset.Next(from))
+	near(time.Date(2024, 6, 22, 18, 39, 0, 0, lahore), next) // Once a day
+
+	tromso, err := ParseSolarSpec("@sunrise+1h", 69.65, 18.96) // Polar night until mid-January
+	require.NoError(t, err)
+	assert.Equal(t, time.January, tromso.Next(time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)).Month())
+
+	for _, bad := range []string{"@sunrise30m", "@sunset+tomorrow", "@sunset+13h", "0 6 * * *"} {
+		_, err := ParseSolarSpec(bad, 0, 0)
+		assert.Error(t, err, bad)
+	}
+	assert.True(t, IsSolarSpec("@sunset-30m"))
+	assert.False(t, IsSolarSpec("@daily"))
+}
@@ -0,0 +1,107 @@
+// solar.go - Daily schedules relative to sunrise or sunset at a location
+
+package scheduler // Declares the package name
+
+import ( // Import required packages
+	"fmt"     // For validation errors
+	"math"    // Solar position
+	"strings" // Spec parsing
+	"time"    // Event times
+
+	"github.com/robfig/cron/v3" // Schedule interface
+)
+
+const ( // Solar events a spec can refer to
+	Sunrise = "@sunrise"
+	Sunset  = "@sunset"
+)
+
+const maxSolarOffset = 12 * time.Hour // Beyond this the run drifts into the next event's day
+
+// solarSchedule fires once a day at sunrise or sunset plus an offset. Days when the sun
+// doesn't rise or set (polar night and midnight sun) have no run.
+type solarSchedule struct {
+	sunrise  bool          // Else sunset
+	offset   time.Duration // Added to the event time, e.g. -30m for half an hour before
+	lat, lon float64       // Degrees, north and east positive
+}
+
+// IsSolarSpec reports whether spec is a sunrise/sunset spec rather than a cron expression.
+func IsSolarSpec(spec string) bool {
+	return strings.HasPrefix(spec, Sunrise) || strings.HasPrefix(spec, Sunset)
+}
+
+// ParseSolarSpec parses "@sunrise" or "@sunset" optionally followed by a signed offset
+// ("@sunset-30m", "@sunrise+1h15m") for the location at lat, lon.
+func ParseSolarSpec(spec string, lat, lon float64) (cron.Schedule, error) {
+	s := solarSchedule{lat: lat, lon: lon}
+	var rest string
+	switch {
+	case strings.HasPrefix(spec, Sunrise):
+		s.sunrise, rest = true, strings.TrimPrefix(spec, Sunrise)
+	case strings.HasPrefix(spec, Sunset):
+		rest = strings.TrimPrefix(spec, Sunset)
+	default:
+		return nil, fmt.Errorf("%q is not a sunrise or sunset spec", spec)
+	}
+	if rest != "" {
+		if rest[0] != '+' && rest[0] != '-' {
+			return nil, fmt.Errorf("%q: expected + or - before the offset", spec)
+		}
+		offset, err := time.ParseDuration(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%q: bad offset: %w", spec, err)
+		}
+		if offset < -maxSolarOffset || offset > maxSolarOffset {
+			return nil, fmt.Errorf("%q: offset must be within %s", spec, maxSolarOffset)
+		}
+		s.offset = offset
+	}
+	return s, nil
+}
+
+func (s solarSchedule) Next(t time.Time) time.Time {
+	day := julianDay(t) - 1    // Yesterday's sunset can still be ahead with a positive offset
+	for i := 0; i < 400; i++ { // Polar nights last at most about half a year
+		rise, set, ok := sunEvents(day+float64(i), s.lat, s.lon)
+		if !ok {
+			continue
+		}
+		at := set
+		if s.sunrise {
+			at = rise
+		}
+		if at = at.Add(s.offset); at.After(t) {
+			return at
+		}
+	}
+	return time.Time{}
+}
+
+const j2000 = 2451545.0 // Julian date of 2000-01-01 12:00 UTC
+
+func julianDay(t time.Time) float64 { // Whole days since J2000 for t's UTC date
+	return math.Floor(float64(t.Unix())/86400 + 2440587.5 - j2000 + 0.5) // 2440587.5 is the Unix epoch
+}
+
+// sunEvents computes sunrise and sunset for day (days since J2000) with the sunrise
+// equation, accurate to about a minute. ok is false when the sun stays up or down all day.
+func sunEvents(day, lat, lon float64) (rise, set time.Time, ok bool) {
+	rad := math.Pi / 180
+	mean := day - lon/360                                    // Mean solar noon
+	anomaly := math.Mod(357.5291+0.98560028*mean, 360) * rad // Solar mean anomaly
+	center := 1.9148*math.Sin(anomaly) + 0.02*math.Sin(2*anomaly) + 0.0003*math.Sin(3*anomaly)
+	ecliptic := math.Mod(anomaly/rad+center+180+102.9372, 360) * rad // Ecliptic longitude
+	transit := j2000 + mean + 0.0053*math.Sin(anomaly) - 0.0069*math.Sin(2*ecliptic)
+	declination := math.Asin(math.Sin(ecliptic) * math.Sin(23.4397*rad))
+	cosHour := (math.Sin(-0.833*rad) - math.Sin(lat*rad)*math.Sin(declination)) / (math.Cos(lat*rad) * math.Cos(declination))
+	if cosHour < -1 || cosHour > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hour := math.Acos(cosHour) / rad / 360 // Half the day length, in days
+	return fromJulian(transit - hour), fromJulian(transit + hour), true
+}
+
+func fromJulian(jd float64) time.Time {
+	return time.Unix(int64(math.Round((jd-2440587.5)*86400)), 0).UTC()
+}
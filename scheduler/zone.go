@@ -0,0 +1,59 @@
+// zone.go - Cron schedules evaluated in a time zone, with predictable DST handling
+
+package scheduler // Declares the package name
+
+import ( // Import required packages
+	"errors"  // For validation errors
+	"strings" // Prefix checks
+	"time"    // Time zones
+
+	"github.com/robfig/cron/v3" // Cron schedules
+)
+
+// zonedSchedule runs a cron schedule on the wall clock of loc. Times skipped by a DST
+// jump forward run once, at the same offset after the jump (02:30 becomes 03:30); times
+// repeated when clocks go back run only the first time.
+type zonedSchedule struct {
+	inner cron.Schedule // Evaluated on wall-clock times expressed in UTC
+	loc   *time.Location
+}
+
+// ParseSpecIn parses a cron expression or descriptor to be evaluated in loc. "@every"
+// descriptors are plain intervals and ignore loc. Specs may not carry their own TZ= prefix.
+func ParseSpecIn(spec string, loc *time.Location) (cron.Schedule, error) {
+	if strings.HasPrefix(spec, "TZ=") || strings.HasPrefix(spec, "CRON_TZ=") {
+		return nil, errors.New("set the time zone separately, not with a TZ= prefix")
+	}
+	sched, err := ParseSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := sched.(cron.ConstantDelaySchedule); ok {
+		return sched, nil
+	}
+	return zonedSchedule{inner: sched, loc: loc}, nil
+}
+
+func (z zonedSchedule) Next(t time.Time) time.Time {
+	wall := wallClock(t.In(z.loc))
+	for i := 0; i < 4; i++ { // A wall time maps back to at most an hour or so before t
+		wall = z.inner.Next(wall)
+		if wall.IsZero() {
+			return wall
+		}
+		at := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, z.loc)
+		if !wallClock(at).Equal(wall) { // Skipped by a jump forward: use the offset from before the jump
+			_, before := at.Add(-3 * time.Hour).Zone()
+			_, after := at.Add(3 * time.Hour).Zone()
+			at = wall.Add(-time.Duration(min(before, after)) * time.Second).In(z.loc)
+		}
+		if at.After(t) {
+			return at
+		}
+	}
+	return time.Time{}
+}
+
+func wallClock(t time.Time) time.Time { // The same clock reading, in UTC (which has no DST)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
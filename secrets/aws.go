@@ -0,0 +1,47 @@
+// aws.go - AWS Secrets Manager secrets provider
+
+package secrets // Declares the package name
+
+import ( // Import required packages
+	"context"       // For request cancellation
+	"encoding/json" // The secret string is a JSON object
+	"fmt"           // For error formatting
+
+	"github.com/aws/aws-sdk-go-v2/aws"                    // AWS helpers
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"       // Default credential chain
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager" // Secrets Manager client
+)
+
+type secretValueGetter interface { // The Secrets Manager call awsProvider makes (a fake in tests)
+	GetSecretValue(ctx context.Context, in *secretsmanager.GetSecretValueInput, opts ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+type awsProvider struct { // awsProvider reads a JSON secret from Secrets Manager
+	client   secretValueGetter // API client
+	secretID string            // Secret name or ARN
+}
+
+func newAWSProvider(secretID string) (*awsProvider, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background()) // Region/credentials from env, profile or instance role
+	if err != nil {
+		return nil, err
+	}
+	return &awsProvider{client: secretsmanager.NewFromConfig(cfg), secretID: secretID}, nil
+}
+
+func (a *awsProvider) Name() string { return "aws" }
+
+func (a *awsProvider) Fetch(ctx context.Context) (map[string]string, error) {
+	out, err := a.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(a.secretID)})
+	if err != nil {
+		return nil, err
+	}
+	if out.SecretString == nil {
+		return nil, fmt.Errorf("secret %s has no string value", a.secretID)
+	}
+	var values map[string]string // Expect {"JWT_SECRET": "...", ...}
+	if err := json.Unmarshal([]byte(*out.SecretString), &values); err != nil {
+		return nil, fmt.Errorf("secret %s is not a JSON object of strings: %w", a.secretID, err)
+	}
+	return values, nil
+}
@@ -0,0 +1,98 @@
+// secrets.go - Loads sensitive settings from an external secrets backend
+
+package secrets // Declares the package name
+
+import ( // Import required packages
+	"context" // For request cancellation
+	"fmt"     // For error formatting
+	"log"     // Logging
+	"os"      // For exporting values into the environment
+	"sync"    // Guards the applied keys
+	"time"    // For refresh interval
+)
+
+// Provider fetches a flat KEY=VALUE map (e.g. {"JWT_SECRET": "..."}) from a backend.
+// Keys use the same names as the environment variables read by config.Load.
+type Provider interface {
+	Name() string                                         // Backend name for logging
+	Fetch(ctx context.Context) (map[string]string, error) // Read the current secret values
+}
+
+const FetchTimeout = 30 * time.Second // How long one fetch may take, so a backend that doesn't answer can't hang startup
+
+var (
+	owned   = map[string]bool{} // Keys Apply has set
+	ownedMu sync.Mutex          // Guards owned
+)
+
+type Options struct { // Options selects and configures the backend
+	Backend     string // "vault", "aws" or "" (disabled)
+	VaultAddr   string // Vault server address, e.g. https://vault:8200
+	VaultToken  string // Vault token
+	VaultPath   string // KV v2 path, e.g. secret/data/go-mqtt-backend
+	AWSSecretID string // Secrets Manager secret name or ARN
+}
+
+func New(opts Options) (Provider, error) { // New builds the provider for the configured backend
+	switch opts.Backend {
+	case "":
+		return nil, nil // Secrets backend disabled, plain env vars are used
+	case "vault":
+		if opts.VaultAddr == "" || opts.VaultToken == "" || opts.VaultPath == "" {
+			return nil, fmt.Errorf("vault backend requires VAULT_ADDR, VAULT_TOKEN and VAULT_SECRET_PATH")
+		}
+		return &vaultProvider{addr: opts.VaultAddr, token: opts.VaultToken, path: opts.VaultPath}, nil
+	case "aws":
+		if opts.AWSSecretID == "" {
+			return nil, fmt.Errorf("aws backend requires AWS_SECRET_ID")
+		}
+		return newAWSProvider(opts.AWSSecretID)
+	default:
+		return nil, fmt.Errorf("unknown secrets backend %q", opts.Backend)
+	}
+}
+
+// Apply fetches the secrets once and exports them into the process environment,
+// so the next config.Load picks them up. It returns the number of keys applied.
+func Apply(ctx context.Context, p Provider) (int, error) {
+	values, err := p.Fetch(ctx) // Read from the backend
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", p.Name(), err)
+	}
+	ownedMu.Lock()
+	defer ownedMu.Unlock()
+	for key, value := range values { // Export every key
+		if err := os.Setenv(key, value); err != nil {
+			return 0, err
+		}
+		owned[key] = true
+	}
+	return len(values), nil
+}
+
+// Owned reports whether key was set from the secrets backend, so an env file reload
+// leaves it alone.
+func Owned(key string) bool {
+	ownedMu.Lock()
+	defer ownedMu.Unlock()
+	return owned[key]
+}
+
+// Refresh re-applies the secrets every interval until ctx is cancelled. Failures are
+// logged and the previous values stay in effect.
+func Refresh(ctx context.Context, p Provider, interval time.Duration) {
+	ticker := time.NewTicker(interval) // Periodic timer
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fetchCtx, cancel := context.WithTimeout(ctx, FetchTimeout) // Don't hang on a slow backend
+			if _, err := Apply(fetchCtx, p); err != nil {
+				log.Printf("secrets refresh failed: %v", err) // Keep old values
+			}
+			cancel()
+		}
+	}
+}
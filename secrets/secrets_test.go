@@ -0,0 +1,125 @@
+// secrets_test.go - Tests for the Vault and AWS providers and the periodic refresh
+// Run with: go test ./...
+
+package secrets
+
+import (
+	"context"           // For fetches
+	"errors"            // Failing fetches
+	"net/http"          // Vault's HTTP API
+	"net/http/httptest" // Fake Vault server
+	"os"                // Exported values
+	"sync"              // Guards the fake provider
+	"testing"           // Go's testing package
+	"time"              // Refresh interval
+
+	"github.com/aws/aws-sdk-go-v2/aws"                    // AWS helpers
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager" // Secrets Manager types
+	"github.com/stretchr/testify/assert"                  // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestVaultFetch checks that a KV v2 response is flattened to strings and that an error
+// status fails the fetch
+func TestVaultFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		assert.Equal(t, "/v1/secret/data/app", r.URL.Path)
+		w.Write([]byte(`{"data":{"data":{"JWT_SECRET":"s3cret","MQTT_PORT":8883},"metadata":{"version":3}}}`))
+	}))
+	defer srv.Close()
+
+	p, err := New(Options{Backend: "vault", VaultAddr: srv.URL + "/", VaultToken: "token", VaultPath: "/secret/data/app"})
+	require.NoError(t, err)
+	values, err := p.Fetch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"JWT_SECRET": "s3cret", "MQTT_PORT": "8883"}, values)
+
+	p = &vaultProvider{addr: srv.URL, token: "wrong", path: "secret/data/app"}
+	_, err = p.Fetch(context.Background())
+	assert.ErrorContains(t, err, "403")
+
+	_, err = New(Options{Backend: "vault", VaultAddr: srv.URL})
+	assert.ErrorContains(t, err, "VAULT_TOKEN")
+}
+
+type fakeSecretsManager struct { // fakeSecretsManager answers GetSecretValue with a fixed secret
+	secret *string
+}
+
+func (f fakeSecretsManager) GetSecretValue(_ context.Context, in *secretsmanager.GetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	return &secretsmanager.GetSecretValueOutput{Name: in.SecretId, SecretString: f.secret}, nil
+}
+
+// TestAWSFetch checks that the secret string is read as a JSON object of strings, and
+// that a binary or malformed secret fails the fetch
+func TestAWSFetch(t *testing.T) {
+	fetch := func(secret *string) (map[string]string, error) {
+		p := &awsProvider{client: fakeSecretsManager{secret: secret}, secretID: "go-mqtt-backend"}
+		return p.Fetch(context.Background())
+	}
+	values, err := fetch(aws.String(`{"JWT_SECRET":"s3cret","MQTT_PASSWORD":"pw"}`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"JWT_SECRET": "s3cret", "MQTT_PASSWORD": "pw"}, values)
+
+	_, err = fetch(nil)
+	assert.ErrorContains(t, err, "no string value")
+	_, err = fetch(aws.String(`{"MQTT_PORT":8883}`))
+	assert.ErrorContains(t, err, "not a JSON object of strings")
+}
+
+type fakeProvider struct { // fakeProvider returns whatever values or error the test sets
+	mu     sync.Mutex
+	values map[string]string
+	err    error
+}
+
+func (f *fakeProvider) Name() string { return "fake" }
+
+func (f *fakeProvider) Fetch(context.Context) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.values, f.err
+}
+
+func (f *fakeProvider) set(values map[string]string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values, f.err = values, err
+}
+
+// TestRefresh checks that Refresh exports changed values, keeps the old ones when a fetch
+// fails and stops with its context
+func TestRefresh(t *testing.T) {
+	t.Setenv("SECRETS_TEST_KEY", "") // Restored after the test
+	p := &fakeProvider{values: map[string]string{"SECRETS_TEST_KEY": "v1"}}
+	n, err := Apply(context.Background(), p)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "v1", os.Getenv("SECRETS_TEST_KEY"))
+	assert.True(t, Owned("SECRETS_TEST_KEY"))
+	assert.False(t, Owned("SECRETS_TEST_OTHER"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Refresh(ctx, p, 5*time.Millisecond)
+		close(done)
+	}()
+	p.set(map[string]string{"SECRETS_TEST_KEY": "v2"}, nil)
+	assert.Eventually(t, func() bool { return os.Getenv("SECRETS_TEST_KEY") == "v2" }, time.Second, 5*time.Millisecond)
+
+	p.set(nil, errors.New("backend down"))
+	time.Sleep(20 * time.Millisecond) // A few failed refreshes
+	assert.Equal(t, "v2", os.Getenv("SECRETS_TEST_KEY"))
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Refresh did not stop with its context")
+	}
+}
@@ -0,0 +1,49 @@
+// vault.go - HashiCorp Vault (KV v2) secrets provider
+
+package secrets // Declares the package name
+
+import ( // Import required packages
+	"context"       // For request cancellation
+	"encoding/json" // For decoding the response
+	"fmt"           // For error formatting
+	"net/http"      // HTTP client
+	"strings"       // For building the URL
+)
+
+type vaultProvider struct { // vaultProvider reads a KV v2 secret over Vault's HTTP API
+	addr  string // Vault server address
+	token string // Vault token
+	path  string // Secret path (including the data/ segment for KV v2)
+}
+
+func (v *vaultProvider) Name() string { return "vault" }
+
+func (v *vaultProvider) Fetch(ctx context.Context) (map[string]string, error) {
+	url := strings.TrimRight(v.addr, "/") + "/v1/" + strings.TrimLeft(v.path, "/") // Build the read URL
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token) // Authenticate
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %s", resp.Status)
+	}
+	var body struct { // KV v2 nests the values under data.data
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(body.Data.Data))
+	for key, value := range body.Data.Data { // Flatten to strings
+		values[key] = fmt.Sprint(value)
+	}
+	return values, nil
+}
@@ -0,0 +1,124 @@
+// backpressure.go - Adaptive per-user enqueue limits while the queue is backed up
+//
+// One motor works through the queue a run at a time, so the backlog drains no faster than
+// its runs take. The service keeps the requests it accepted and the runs it completed in
+// the last hour and projects how long the queue would take to drain: queued requests
+// times the average run. While that exceeds BackpressureConfig.MaxDrain, each user may
+// only enqueue a few requests an hour, the fewer the longer the drain, and a refused
+// request gets a *BackpressureError saying why and when to retry. That spreads the motor
+// time over everyone asking for it instead of letting the queue fill up until it turns
+// everyone away with store.ErrQueueFull.
+
+package services // Declares the package name
+
+import ( // Import required packages
+	"context" // For cancellation
+	"fmt"     // Error messages
+	"sync"    // For mutex (thread safety)
+	"time"    // Rates and drain times
+)
+
+const flowWindow = time.Hour // Rates and per-user limits are per hour
+
+type BackpressureConfig struct { // When and how hard to limit users while the queue is backed up
+	MaxDrain  time.Duration // Projected drain time above which limits apply (0: never)
+	UserLimit int           // Requests per user per hour at MaxDrain; proportionally fewer beyond it, at least 1
+}
+
+type BackpressureStatus struct { // Queue flow as the limits see it
+	EnqueueRate float64       // Requests accepted per hour, over the last hour
+	ProcessRate float64       // Runs the motor gets through per hour at the average run time (0: no runs seen yet)
+	Drain       time.Duration // Projected time to work through the queue
+	UserLimit   int           // Requests each user may queue per hour (0: no limit)
+}
+
+// BackpressureError is returned by Enqueue when the queue is backed up and the user has
+// queued their share for the hour.
+type BackpressureError struct {
+	Drain      time.Duration // Projected time to work through the queue
+	Limit      int           // Requests per user per hour while it lasts
+	RetryAfter time.Duration // About when the user may try again
+}
+
+func (e *BackpressureError) Error() string {
+	return fmt.Sprintf("the motor queue is backed up (about %s to work through), so each user may queue %d requests per hour until it clears",
+		e.Drain.Round(time.Minute), e.Limit)
+}
+
+type flowEvent struct {
+	at time.Time
+	d  time.Duration // Requested or actual run time
+}
+
+type queueFlow struct { // Requests accepted and runs completed over the last flowWindow
+	mu        sync.Mutex
+	enqueued  []flowEvent
+	completed []flowEvent
+}
+
+func (f *queueFlow) record(events *[]flowEvent, at time.Time, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*events = append(trimFlow(*events, at), flowEvent{at, d})
+}
+
+func trimFlow(events []flowEvent, now time.Time) []flowEvent { // Drops events older than flowWindow
+	i := 0
+	for i < len(events) && now.Sub(events[i].at) > flowWindow {
+		i++
+	}
+	return events[i:]
+}
+
+// rates returns the requests accepted in the last hour and the average run: of the runs
+// completed in the last hour, or else of the requests accepted (0 when there were none).
+func (f *queueFlow) rates(now time.Time) (enqueued int, avgRun time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.enqueued, f.completed = trimFlow(f.enqueued, now), trimFlow(f.completed, now)
+	runs := f.completed
+	if len(runs) == 0 {
+		runs = f.enqueued
+	}
+	var total time.Duration
+	for _, e := range runs {
+		total += e.d
+	}
+	if len(runs) > 0 {
+		avgRun = total / time.Duration(len(runs))
+	}
+	return len(f.enqueued), avgRun
+}
+
+func (s *MotorService) backpressureStatus(queueLen int) BackpressureStatus { // Projects the drain time of queueLen requests
+	enqueued, avgRun := s.flow.rates(s.clock.Now())
+	st := BackpressureStatus{EnqueueRate: float64(enqueued) * float64(time.Hour) / float64(flowWindow), Drain: time.Duration(queueLen) * avgRun}
+	if avgRun > 0 {
+		st.ProcessRate = float64(time.Hour) / float64(avgRun)
+	}
+	if bp := s.backpressure; bp.MaxDrain > 0 && st.Drain > bp.MaxDrain {
+		st.UserLimit = max(int(float64(max(bp.UserLimit, 1))*float64(bp.MaxDrain)/float64(st.Drain)), 1)
+	}
+	return st
+}
+
+// admitUser counts a request by userID against their share of the hour while the queue
+// is backed up, and returns a *BackpressureError once it is used up.
+func (s *MotorService) admitUser(ctx context.Context, userID uint) error {
+	queueLen, err := s.queue.Len(ctx)
+	if err != nil {
+		return fmt.Errorf("read queue: %w", err)
+	}
+	st := s.backpressureStatus(queueLen)
+	if st.UserLimit == 0 {
+		return nil
+	}
+	ok, err := s.state.Allow(ctx, fmt.Sprintf("motor-enqueue:%d", userID), st.UserLimit, flowWindow)
+	if err != nil {
+		return fmt.Errorf("check enqueue limit: %w", err)
+	}
+	if !ok {
+		return &BackpressureError{Drain: st.Drain, Limit: st.UserLimit, RetryAfter: min(st.Drain-s.backpressure.MaxDrain, flowWindow)}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// backpressure_test.go - Tests for per-user enqueue limits while the queue is backed up
+// Run with: go test ./...
+
+package services
+
+import (
+	"context"               // For cancellation
+	"errors"                // For checking errors
+	"go-mqtt-backend/store" // In-memory backends
+	"testing"               // Go's testing package
+	"time"                  // For durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestBackpressure checks that limits only apply once the projected drain time is over
+// the threshold, tighten as it grows and are per user
+func TestBackpressure(t *testing.T) {
+	clock := &fakeClock{now: time.Now(), fire: make(chan time.Time)}
+	svc := NewMotorService(MotorDeps{
+		Queue:        store.NewMemoryQueue(20),
+		State:        store.NewMemoryState(),
+		Publisher:    &fakePublisher{},
+		Repo:         &fakeRepo{},
+		Clock:        clock,
+		Quota:        24 * time.Hour,
+		Backpressure: BackpressureConfig{MaxDrain: 30 * time.Minute, UserLimit: 4},
+	})
+	ctx := context.Background()
+
+	for user := uint(1); user <= 4; user++ { // Up to 30 minutes queued: no limits
+		require.NoError(t, svc.Enqueue(ctx, user, 10*time.Minute))
+	}
+	require.NoError(t, svc.Enqueue(ctx, 5, 10*time.Minute)) // 40 minutes: 3 an hour
+	require.NoError(t, svc.Enqueue(ctx, 5, 10*time.Minute)) // 50 minutes: 2 an hour
+	err := svc.Enqueue(ctx, 5, 10*time.Minute)              // 60 minutes: 2 an hour, used up
+	var bp *BackpressureError
+	require.True(t, errors.As(err, &bp))
+	assert.Equal(t, 60*time.Minute, bp.Drain)
+	assert.Equal(t, 2, bp.Limit)
+	assert.Equal(t, 30*time.Minute, bp.RetryAfter)
+	assert.Contains(t, err.Error(), "each user may queue 2 requests per hour")
+	require.NoError(t, svc.Enqueue(ctx, 6, 10*time.Minute)) // Someone else still gets a turn
+
+	st, err := svc.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, st.Backpressure.EnqueueRate)
+	assert.Equal(t, 6.0, st.Backpressure.ProcessRate)
+	assert.Equal(t, 70*time.Minute, st.Backpressure.Drain)
+	assert.Equal(t, 1, st.Backpressure.UserLimit)
+}
+
+// TestQueueFlowRates checks that completed runs set the average run once there are any,
+// and that events older than an hour are forgotten
+func TestQueueFlowRates(t *testing.T) {
+	var f queueFlow
+	now := time.Now()
+	n, avg := f.rates(now)
+	assert.Zero(t, n)
+	assert.Zero(t, avg)
+
+	f.record(&f.enqueued, now, 10*time.Minute)
+	f.record(&f.enqueued, now, 30*time.Minute)
+	n, avg = f.rates(now)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 20*time.Minute, avg)
+
+	f.record(&f.completed, now.Add(time.Minute), 5*time.Minute) // Runs cut short drain faster
+	_, avg = f.rates(now.Add(time.Minute))
+	assert.Equal(t, 5*time.Minute, avg)
+
+	n, avg = f.rates(now.Add(2 * time.Hour))
+	assert.Zero(t, n)
+	assert.Zero(t, avg)
+}
@@ -0,0 +1,45 @@
+// estop.go - The emergency stop button on site
+//
+// A physical button publishes "pressed" on EStopTopic. Every replica is subscribed, so
+// a press is handled once through the shared store: the motor is switched off and the
+// system shut down like an admin's emergency shutdown, in the safety category and
+// without an end, so only an admin restart brings it back. Releasing the button
+// ("released") restarts nothing.
+
+package services // Declares the package name
+
+import ( // Import required packages
+	"context"  // For cancellation
+	"log/slog" // Leveled logging
+	"strings"  // Payload parsing
+	"time"     // Dedup window
+)
+
+const EStopTopic = "motor/estop" // Topic the emergency stop button publishes "pressed" or "released" on
+
+const ( // Emergency stop button payloads
+	EStopPressed  = "pressed"
+	EStopReleased = "released"
+)
+
+const EStopReason = "emergency stop button pressed" // Notes of the shutdown a press causes
+
+const eStopWindow = 10 * time.Second // Presses within this long of a handled one are the same press, seen by another replica
+
+// EmergencyStop handles a message from the emergency stop button. Any payload other than
+// EStopReleased is a press: the system is shut down with ForceShutdown (ShutdownSafety,
+// EStopReason, no end). It reports whether this call shut it down; false for a release
+// or for a press another replica has already handled. If the shared store can't tell,
+// the press is handled here anyway: a second shutdown is harmless, a missed one is not.
+func (s *MotorService) EmergencyStop(ctx context.Context, payload string) (handled bool, dropped int, err error) {
+	if strings.EqualFold(strings.TrimSpace(payload), EStopReleased) {
+		return false, 0, nil
+	}
+	if first, err := s.state.Allow(ctx, "estop", 1, eStopWindow); err != nil {
+		slog.Error("emergency stop dedup failed", "error", err)
+	} else if !first {
+		return false, 0, nil
+	}
+	dropped, err = s.ForceShutdown(ctx, ShutdownSafety, EStopReason, time.Time{})
+	return true, dropped, err
+}
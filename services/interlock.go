@@ -0,0 +1,184 @@
+// interlock.go - One active session per motor, across every replica
+//
+// Before a motor is switched on, the session takes the motor's interlock: a lease in
+// the shared store held until the motor is switched off. A start while someone else
+// holds it waits in the queue (the shared motor) or is refused (tenant devices), even
+// when it comes from another replica. Leases expire a little after the session should
+// have ended, so an instance that dies mid-run doesn't lock the motor for good.
+
+package services // Declares the package name
+
+import ( // Import required packages
+	"context"  // For store calls
+	"fmt"      // Holder names and errors
+	"log/slog" // Leveled logging
+	"strconv"  // Holder parsing
+	"strings"  // Holder parsing
+	"time"     // Lease lengths
+)
+
+const ( // Who holds an interlock
+	InterlockQueue  = "queue"  // A queued request being dispatched
+	InterlockManual = "manual" // An "on" sent to a device through the API
+)
+
+const (
+	interlockMargin    = time.Minute    // How long a queue session's lease outlives its expected end
+	manualInterlockTTL = 12 * time.Hour // Lease of a manual ON that is never followed by OFF
+)
+
+type Interlock struct { // The session holding a motor
+	ID     string    `json:"id"`      // Identifies the session, e.g. for StopSession (set when read from the store)
+	Source string    `json:"source"`  // InterlockQueue or InterlockManual
+	UserID uint      `json:"user_id"` // Who started it
+	Since  time.Time `json:"since"`
+}
+
+func (l Interlock) holder() string { // Lease holder; unique per session so a second start never renews the first
+	return fmt.Sprintf("%s/%d/%d", l.Source, l.UserID, l.Since.UnixNano())
+}
+
+func parseInterlock(holder string) (Interlock, bool) {
+	parts := strings.Split(holder, "/")
+	if len(parts) != 3 {
+		return Interlock{}, false
+	}
+	user, err1 := strconv.ParseUint(parts[1], 10, 64)
+	since, err2 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return Interlock{}, false
+	}
+	return Interlock{ID: strconv.FormatInt(since, 36), Source: parts[0], UserID: uint(user), Since: time.Unix(0, since)}, true
+}
+
+func interlockLease(device string) string { return "interlock:" + device }
+
+type InterlockError struct { // Returned for a start while another session holds the motor
+	Device string
+	Holder Interlock
+}
+
+func (e *InterlockError) Error() string {
+	return fmt.Sprintf("motor %s is in use by a %s session of user %d since %s", e.Device, e.Holder.Source, e.Holder.UserID, e.Holder.Since.Format(time.RFC3339))
+}
+
+// lockMotor takes device's interlock for l until ttl has passed or it is released. It
+// returns an *InterlockError if another session holds it.
+func (s *MotorService) lockMotor(ctx context.Context, device string, l Interlock, ttl time.Duration) error {
+	ok, err := s.state.AcquireLease(ctx, interlockLease(device), l.holder(), ttl)
+	if err != nil {
+		return fmt.Errorf("take motor interlock: %w", err)
+	}
+	if !ok {
+		holder, _ := s.Interlock(ctx, device)
+		if holder == nil { // Released in between
+			return s.lockMotor(ctx, device, l, ttl)
+		}
+		return &InterlockError{Device: device, Holder: *holder}
+	}
+	return nil
+}
+
+// Interlock returns the session holding device's motor, nil if it is free.
+func (s *MotorService) Interlock(ctx context.Context, device string) (*Interlock, error) {
+	holder, err := s.state.LeaseHolder(ctx, interlockLease(device))
+	if err != nil || holder == "" {
+		return nil, err
+	}
+	l, ok := parseInterlock(holder)
+	if !ok {
+		return nil, fmt.Errorf("malformed interlock holder %q", holder)
+	}
+	return &l, nil
+}
+
+// Interlocks returns the held interlocks of the shared motor and every motor this
+// instance has commanded or heard from.
+func (s *MotorService) Interlocks(ctx context.Context) map[string]Interlock {
+	out := map[string]Interlock{}
+	devices := s.states.all()
+	devices[SharedMotor] = MotorStateInfo{}
+	for device := range devices {
+		if l, err := s.Interlock(ctx, device); err == nil && l != nil {
+			out[device] = *l
+		}
+	}
+	return out
+}
+
+// LockMotor takes a tenant device's interlock for a manual ON by userID. It returns an
+// *InterlockError while another session holds the motor; UnlockMotor releases it.
+func (s *MotorService) LockMotor(ctx context.Context, device string, userID uint) error {
+	return s.lockMotor(ctx, device, Interlock{Source: InterlockManual, UserID: userID, Since: s.clock.Now()}, manualInterlockTTL)
+}
+
+// UnlockMotor releases device's interlock, whoever holds it. Call it once OFF has been
+// sent: OFF ends any session.
+func (s *MotorService) UnlockMotor(ctx context.Context, device string) {
+	holder, err := s.state.LeaseHolder(ctx, interlockLease(device))
+	if err == nil && holder != "" {
+		err = s.state.ReleaseLease(ctx, interlockLease(device), holder)
+	}
+	if err != nil {
+		slog.Error("release motor interlock failed", "motor", device, "error", err)
+	}
+}
+
+// CutoffManual switches a tenant device's motor off ("{org}/{device}/motor/control") if a
+// manual session has held it for max or longer, and returns that session (nil if none
+// was cut off). The queue cuts off its own sessions in Run.
+func (s *MotorService) CutoffManual(ctx context.Context, device string, max time.Duration) (*Interlock, error) {
+	l, err := s.Interlock(ctx, device)
+	if err != nil || l == nil || l.Source != InterlockManual || s.clock.Now().Sub(l.Since) < max {
+		return nil, err
+	}
+	s.stopVerified(device, device+"/"+MotorTopic)
+	s.UnlockMotor(ctx, device)
+	return l, nil
+}
+
+// StopSession switches off the motor of the running session with id (an Interlock's ID,
+// as listed by Interlocks) because an admin asked to, and returns the motor and the
+// session. It returns ErrNoSession if no session has that ID. A queue session this
+// instance runs ends in Run as SessionStopped with reason; a manual session's interlock
+// is released here, and recording and reporting it is up to the caller.
+func (s *MotorService) StopSession(ctx context.Context, id, reason string) (string, Interlock, error) {
+	for device, l := range s.Interlocks(ctx) {
+		if l.ID != id {
+			continue
+		}
+		if device != SharedMotor {
+			s.StopMotor(ctx, device)
+			return device, l, nil
+		}
+		s.mu.Lock()
+		if s.current != nil && s.current.UserID == l.UserID && s.currentAt.Equal(l.Since) {
+			s.stopped = reason
+		}
+		s.mu.Unlock()
+		s.switchOff() // A session run by another replica ends there once the motor confirms OFF
+		return device, l, nil
+	}
+	return "", Interlock{}, ErrNoSession
+}
+
+const OwnerStopReason = "stopped by its owner" // Why a run StopRun stopped for its owner ended
+
+// StopRun switches off the queue's running session for userID: their own or, with admin,
+// anyone's. It returns ErrNoSession if the motor isn't on for such a session. The run ends
+// in Run as SessionStopped, with OwnerStopReason when its owner stopped it and reason
+// otherwise; only what it ran counts against the quota.
+func (s *MotorService) StopRun(ctx context.Context, userID uint, admin bool, reason string) (Interlock, error) {
+	l, err := s.Interlock(ctx, SharedMotor)
+	if err != nil {
+		return Interlock{}, fmt.Errorf("read interlock: %w", err)
+	}
+	if l == nil || l.Source != InterlockQueue || (l.UserID != userID && !admin) {
+		return Interlock{}, ErrNoSession
+	}
+	if l.UserID == userID {
+		reason = OwnerStopReason
+	}
+	_, stopped, err := s.StopSession(ctx, l.ID, reason)
+	return stopped, err
+}
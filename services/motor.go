@@ -0,0 +1,1077 @@
+// motor.go - Motor queue, quota and emergency shutdown logic
+//
+// MotorService owns everything the HTTP handlers used to keep in package-level
+// variables. It is built once in main with its dependencies, so tests can drive it
+// with an in-memory store, a fake publisher and a fake clock.
+
+package services // Declares the package name
+
+import ( // Import required packages
+	"context"                // For cancellation
+	"crypto/rand"            // Queue IDs
+	"encoding/hex"           // Queue IDs
+	"errors"                 // Sentinel errors
+	"fmt"                    // For error wrapping
+	"go-mqtt-backend/models" // DB models
+	"go-mqtt-backend/store"  // Queue and shared state backends
+	"log/slog"               // Leveled logging
+	"slices"                 // Queue lookups
+	"strconv"                // Approver IDs
+	"sync"                   // For mutex (thread safety)
+	"time"                   // For time operations
+)
+
+const MotorTopic = "motor/control" // Topic the device listens on for "on"/"off"
+
+var ( // Errors returned by MotorService
+	ErrQuotaExceeded  = errors.New("daily motor-on quota reached")
+	ErrNotShutDown    = errors.New("system is not shut down")
+	ErrSecondApprover = errors.New("restart must be confirmed by a different admin")
+	ErrNoSession      = errors.New("no running session with that ID")
+	ErrNotQueued      = errors.New("no queued request with that ID")
+	ErrRunning        = errors.New("request is already running")
+	ErrTooLong        = errors.New("requested duration is over the per-request limit")
+	ErrExpiry         = errors.New("expiry is not in the future")
+	ErrDuration       = errors.New("requested duration is not positive")
+)
+
+const ( // Shutdown categories
+	ShutdownMaintenance = "maintenance" // Planned work on the pump, pipes or backend
+	ShutdownSafety      = "safety"      // A hazard to people or equipment
+	ShutdownWeather     = "weather"     // Storms, flooding, frost
+	ShutdownElectrical  = "electrical"  // Power supply problems or electrical work
+)
+
+var ShutdownCategories = []string{ShutdownMaintenance, ShutdownSafety, ShutdownWeather, ShutdownElectrical} // Every category, for validation and reports
+
+type ShutdownError struct { // Returned by Enqueue while an emergency shutdown is active
+	Category string
+	Reason   string
+	Until    time.Time // Zero unless the shutdown ends by itself
+}
+
+func (e *ShutdownError) Error() string {
+	summary := store.Shutdown{Category: e.Category, Reason: e.Reason}.Summary()
+	if !e.Until.IsZero() {
+		return fmt.Sprintf("system is shut down until %s: %s", e.Until.Format(time.RFC3339), summary)
+	}
+	return "system is shut down: " + summary
+}
+
+type Publisher interface { // Publisher sends commands to the device (the MQTT client in production)
+	Publish(topic string, payload interface{}) error
+}
+
+type PublisherFunc func(topic string, payload interface{}) error // Adapts a function such as mqtt.Publish
+
+func (f PublisherFunc) Publish(topic string, payload interface{}) error { return f(topic, payload) }
+
+type ReliablePublisher interface { // A Publisher that can also wait for delivery to the broker (MQTT QoS 1); used for OFF
+	PublishAtLeastOnce(topic string, payload interface{}) error
+}
+
+type Clock interface { // Clock is the time source; swapped in tests
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+const ( // Session event kinds
+	SessionStarted     = "started"     // Motor switched on for a request
+	SessionFinished    = "finished"    // Ran for the full duration
+	SessionInterrupted = "interrupted" // Switched off early (shutdown, crash, lost leadership)
+	SessionRejected    = "rejected"    // Dropped instead of run (shutdown, quota or an error at dispatch); see Reason
+
+	SessionSafetyStopped = "safety_stopped" // Forced OFF after MaxRuntime of continuous running
+	SessionPowerLost     = "power_lost"     // The device lost power mid-run and the run was not resumed
+	SessionStopped       = "stopped"        // Switched off early by an admin or its owner (StopSession, StopRun); see Reason
+	SessionCancelled     = "cancelled"      // Taken out of the queue before it ran (Cancel); see Reason
+	SessionExpired       = "expired"        // Reached the front of the queue after its ExpiresAt, so never ran
+)
+
+type SessionEvent struct { // SessionEvent describes a change in the running session
+	Kind    string
+	Request store.MotorRequest
+	At      time.Time
+	Reason  string        // Why a request was rejected or a session interrupted
+	Ran     time.Duration // How long the motor was on (finished, interrupted, safety-stopped and power-lost sessions)
+	Outages int           // Power outages during the run
+}
+
+type QuotaEvent struct { // QuotaEvent reports that usage crossed a warning level
+	Percent int           // Level crossed (percent of the quota)
+	Used    time.Duration // Usage after the session that crossed it
+	Quota   time.Duration
+	ResetAt time.Time // When some of the usage is next given back
+}
+
+type MotorDeps struct { // Dependencies of a MotorService
+	Queue            store.Queue                                      // Pending requests
+	State            store.State                                      // Shutdown flag, leases and sequences
+	Publisher        Publisher                                        // Device commands
+	Repo             MotorRepository                                  // Activation log and restart snapshot
+	Clock            Clock                                            // Time source (nil uses the system clock)
+	Quota            time.Duration                                    // Max motor-on time per 24h
+	MaxDuration      time.Duration                                    // Longest run one request may ask for (0: no limit but the quota)
+	OnSession        func(SessionEvent)                               // Called on session start/end (optional; must not block)
+	OnQuota          func(QuotaEvent)                                 // Called when usage crosses a level in QuotaWarn (optional; must not block)
+	QuotaWarn        []int                                            // Warning levels in percent of the quota, e.g. 80 and 100
+	Hold             func(context.Context) string                     // Why queued requests must wait, e.g. a maintenance window; "" to dispatch (optional)
+	Admit            func(context.Context, store.MotorRequest) string // Why a request may not run, checked at dispatch before the quota; "" to run (optional)
+	Estimate         func(context.Context, *models.DeviceActivation)  // Fills in the pump and energy, water and cost estimates of an accepted request before it is logged (optional)
+	AckWait          time.Duration                                    // How long devices have to confirm ON/OFF on MotorStatusTopic (0: they don't confirm)
+	MaxRuntime       time.Duration                                    // Longest the motor may run continuously, whatever was requested and the quota left (0: no limit)
+	OnFault          func(motor string, st MotorStateInfo)            // Called when a motor goes into FAULT (optional; must not block)
+	OffRetry         time.Duration                                    // How often OFF is resent until the motor confirms it (default 5s)
+	OffTimeout       time.Duration                                    // How long OFF is resent before the motor is put in FAULT (default 1m)
+	RestartApproval  time.Duration                                    // How long a second admin has to confirm RequestRestart (0: one admin restarts)
+	Simulate         bool                                             // Dry-run mode: every request is simulated and no motor command reaches the Publisher
+	CorrectiveOff    bool                                             // Send OFF after an ON the watchdog failed, in case the motor started anyway
+	Sequence         bool                                             // Send commands as SequencedCommand JSON, for firmware with replay protection
+	HeartbeatTimeout time.Duration                                    // Silence from the shared motor's device that counts as a power outage mid-run (0: no heartbeats expected)
+	OutagePolicy     string                                           // OutageCancel (default) or OutageResume
+	ResumeWindow     time.Duration                                    // How long a run waits for its device to come back after an outage (default 10m)
+	CrashPolicy      string                                           // CrashStop (default) or CrashResume, for a run the process died in the middle of
+	Backpressure     BackpressureConfig                               // Per-user enqueue limits while the queue is backed up (zero: none)
+}
+
+type MotorSession struct { // MotorSession is the run currently holding the motor
+	Request   store.MotorRequest
+	StartedAt time.Time
+	Left      time.Duration // Motor time still to run; it doesn't count down while the device is without power
+}
+
+type MotorStatus struct { // MotorStatus is a snapshot for status endpoints
+	QueueLength   int
+	QueueCapacity int
+	Used          time.Duration  // Motor time used in the last QuotaWindow, the running session in full
+	Quota         time.Duration  // Current limit
+	ResetAt       time.Time      // When some of Used is next given back (zero: nothing used)
+	Current       *MotorSession  // nil when idle
+	Motor         MotorStateInfo // State of the shared motor
+	Interlock     *Interlock     // Session holding the shared motor, possibly on another replica (nil when free)
+	Shutdown      store.Shutdown
+	Simulating    bool // Dry-run mode for every request
+	Backpressure  BackpressureStatus
+	Queued        []store.MotorRequest // Waiting requests, next first
+}
+
+type MotorService struct { // MotorService dispatches queued motor requests within a daily quota
+	queue            store.Queue
+	state            store.State
+	publisher        Publisher
+	repo             MotorRepository
+	clock            Clock
+	onSession        func(SessionEvent)
+	onQuota          func(QuotaEvent)
+	quotaWarn        []int
+	hold             func(context.Context) string
+	admit            func(context.Context, store.MotorRequest) string
+	estimate         func(context.Context, *models.DeviceActivation)
+	states           *motorStates
+	ackWait          time.Duration
+	maxRuntime       time.Duration
+	offRetry         time.Duration
+	offTimeout       time.Duration
+	restartApproval  time.Duration
+	simulate         bool       // Dry-run mode for everything
+	sim              *simulator // Takes simulated commands instead of the publisher
+	correctiveOff    bool
+	sequence         bool // Commands carry sequence numbers
+	heartbeatTimeout time.Duration
+	outagePolicy     string
+	resumeWindow     time.Duration
+	crashPolicy      string
+	recovered        *sessionRun // Found by RecoverSession, for Run to finish
+	backpressure     BackpressureConfig
+	flow             queueFlow // Recent requests and runs, for backpressure
+
+	pollInterval time.Duration // How often Run reports progress while idle or running
+
+	mu        sync.Mutex    // Mutex for thread safety
+	quota     time.Duration // Max allowed per 24h
+	maxDur    time.Duration // Longest one request may ask for (0: no limit)
+	current   *store.MotorRequest
+	currentAt time.Time
+	stopped   string // Why the current session was stopped, once StopSession has switched it off
+}
+
+func NewMotorService(deps MotorDeps) *MotorService { // Creates a service from its dependencies
+	clock := deps.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	states := newMotorStates(deps.AckWait > 0)
+	states.onFault = deps.OnFault
+	offRetry, offTimeout := deps.OffRetry, deps.OffTimeout
+	if offRetry <= 0 {
+		offRetry = 5 * time.Second
+	}
+	if offTimeout <= 0 {
+		offTimeout = time.Minute
+	}
+	resumeWindow := deps.ResumeWindow
+	if resumeWindow <= 0 {
+		resumeWindow = 10 * time.Minute
+	}
+	return &MotorService{
+		queue:            deps.Queue,
+		state:            deps.State,
+		publisher:        deps.Publisher,
+		repo:             deps.Repo,
+		clock:            clock,
+		onSession:        deps.OnSession,
+		onQuota:          deps.OnQuota,
+		quotaWarn:        deps.QuotaWarn,
+		hold:             deps.Hold,
+		admit:            deps.Admit,
+		estimate:         deps.Estimate,
+		states:           states,
+		ackWait:          deps.AckWait,
+		maxRuntime:       deps.MaxRuntime,
+		offRetry:         offRetry,
+		offTimeout:       offTimeout,
+		restartApproval:  deps.RestartApproval,
+		simulate:         deps.Simulate,
+		sim:              newSimulator(states, clock, deps.AckWait),
+		correctiveOff:    deps.CorrectiveOff,
+		sequence:         deps.Sequence,
+		heartbeatTimeout: deps.HeartbeatTimeout,
+		outagePolicy:     deps.OutagePolicy,
+		resumeWindow:     resumeWindow,
+		crashPolicy:      deps.CrashPolicy,
+		backpressure:     deps.Backpressure,
+		pollInterval:     5 * time.Second,
+		quota:            deps.Quota,
+		maxDur:           deps.MaxDuration,
+	}
+}
+
+func (s *MotorService) SetQuota(quota time.Duration) { // Updates the daily quota at runtime (used by config reload)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quota = quota // Takes effect for the next enqueue/dispatch
+}
+
+func (s *MotorService) SetQuotaWarn(levels []int) { // Updates the quota warning levels at runtime (used by config reload)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quotaWarn = levels
+}
+
+func (s *MotorService) Quota() time.Duration { // Reads the daily quota under the lock
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.quota
+}
+
+func (s *MotorService) SetMaxDuration(d time.Duration) { // Updates the per-request limit at runtime (0: none)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxDur = d // Requests already queued keep their duration
+}
+
+func (s *MotorService) MaxDuration() time.Duration { // Reads the per-request limit under the lock
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxDur
+}
+
+// SetQueueCapacity changes how many requests may wait at once. Lowering it below what is
+// queued drops nothing; new requests are refused until the queue is back under it.
+func (s *MotorService) SetQueueCapacity(n int) { s.queue.SetCap(n) }
+
+// Enqueue validates and queues a motor-on request. It returns a *ShutdownError while
+// shut down, ErrTooLong if it asks for more than MaxDuration, ErrQuotaExceeded if the
+// request wouldn't fit in the quota, a
+// *BackpressureError when the queue is backed up and the user has queued their share, and
+// store.ErrQueueFull when the queue is at capacity.
+func (s *MotorService) Enqueue(ctx context.Context, userID uint, duration time.Duration) error {
+	_, err := s.EnqueueWith(ctx, userID, duration, EnqueueOptions{})
+	return err
+}
+
+// EnqueueDryRun is Enqueue for a simulated request: it is checked, queued, counted and
+// logged like any other, but its motor commands go to the simulator instead of MQTT.
+func (s *MotorService) EnqueueDryRun(ctx context.Context, userID uint, duration time.Duration) error {
+	_, err := s.EnqueueWith(ctx, userID, duration, EnqueueOptions{DryRun: true})
+	return err
+}
+
+type EnqueueOptions struct { // Optional details of a motor request
+	DryRun    bool      // Simulated even when the service isn't (see EnqueueDryRun)
+	Note      string    // The user's label for the run, kept with the request and its activation
+	Priority  string    // store.PriorityLow, PriorityNormal or PriorityHigh ("": normal); higher ones are dispatched first
+	ExpiresAt time.Time // Skipped rather than run if it hasn't started by then (zero: never)
+}
+
+// EnqueueWith is Enqueue with options. It returns the queued request's ID, for Cancel.
+// The request ID in ctx goes with the request, to tag its ON command. ErrExpiry if
+// ExpiresAt is set but not in the future.
+func (s *MotorService) EnqueueWith(ctx context.Context, userID uint, duration time.Duration, opts EnqueueOptions) (string, error) {
+	if duration <= 0 { // Would give quota back; the scheduler and rules call this directly
+		return "", ErrDuration
+	}
+	sd, err := s.state.GetShutdown(ctx) // Reject while an admin shutdown is active
+	if err != nil {
+		return "", fmt.Errorf("read shutdown state: %w", err)
+	}
+	if sd.Active {
+		return "", &ShutdownError{Category: sd.Category, Reason: sd.Reason, Until: sd.Until}
+	}
+	if max := s.MaxDuration(); max > 0 && duration > max {
+		return "", ErrTooLong
+	}
+	if !opts.ExpiresAt.IsZero() && !opts.ExpiresAt.After(s.clock.Now()) {
+		return "", ErrExpiry
+	}
+	used, _, err := s.usage(ctx) // Current quota usage
+	if err != nil {
+		return "", fmt.Errorf("read quota: %w", err)
+	}
+	if used+duration > s.Quota() {
+		return "", ErrQuotaExceeded
+	}
+	if err := s.admitUser(ctx, userID); err != nil {
+		return "", err
+	}
+	now := s.clock.Now()
+	simulate := opts.DryRun || s.simulate
+	id := newQueueID()
+	activation := &models.DeviceActivation{UserID: userID, RequestAt: now, Duration: duration, Simulated: simulate, Note: opts.Note, QueueID: id}
+	if s.estimate != nil {
+		s.estimate(ctx, activation)
+	}
+	if err := s.repo.LogActivation(ctx, activation); err != nil {
+		return "", fmt.Errorf("log request: %w", err)
+	}
+	if err := s.queue.Push(ctx, &store.MotorRequest{ID: id, UserID: userID, RequestAt: now, Duration: duration, Simulate: simulate, Note: opts.Note, RequestID: RequestID(ctx), Priority: opts.Priority, ExpiresAt: opts.ExpiresAt}); err != nil {
+		return "", err
+	}
+	s.flow.record(&s.flow.enqueued, now, duration)
+	return id, nil
+}
+
+func newQueueID() string { // Random ID of a queued request
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestMatcher matches the request id if it is userID's, or anyone's for userID 0.
+func requestMatcher(id string, userID uint) func(*store.MotorRequest) bool {
+	return func(req *store.MotorRequest) bool {
+		return req != nil && req.ID == id && (userID == 0 || req.UserID == userID)
+	}
+}
+
+// Cancel takes the queued request id out of the queue and records it as cancelled with
+// reason. Only userID's requests are found, unless userID is 0 (admins). It returns
+// ErrRunning for a request the motor is already on for and ErrNotQueued for one that
+// isn't queued.
+func (s *MotorService) Cancel(ctx context.Context, id string, userID uint, reason string) (store.MotorRequest, error) {
+	mine := requestMatcher(id, userID)
+	queued, err := s.queue.List(ctx)
+	if err != nil {
+		return store.MotorRequest{}, fmt.Errorf("list queue: %w", err)
+	}
+	if i := slices.IndexFunc(queued, mine); i >= 0 {
+		req, err := s.queue.Remove(ctx, id)
+		if err != nil {
+			return store.MotorRequest{}, fmt.Errorf("remove from queue: %w", err)
+		}
+		if req != nil {
+			s.emit(ctx, SessionCancelled, req, 0, reason)
+			return *req, nil
+		}
+	}
+	current, _, _, err := s.runningRequest(ctx) // Perhaps dispatched on another replica, or between List and Remove
+	if err != nil {
+		return store.MotorRequest{}, err
+	}
+	if mine(current) {
+		return store.MotorRequest{}, ErrRunning
+	}
+	return store.MotorRequest{}, ErrNotQueued
+}
+
+// Run dispatches queued motor requests until ctx is cancelled. It calls beat while idle
+// and while the motor runs so a supervisor can spot a stuck processor, and switches the
+// motor off on the way out whether that is shutdown, an error or a panic. While the Hold
+// dependency gives a reason, requests stay queued and nothing is dispatched.
+func (s *MotorService) Run(ctx context.Context, beat func()) error {
+	defer func() { // Never leave the motor running
+		s.mu.Lock()
+		req, startedAt := s.current, s.currentAt
+		s.mu.Unlock()
+		if req != nil {
+			s.switchOff() // While still current, so a simulated session is stopped by the simulator
+			s.mu.Lock()
+			s.current = nil
+			s.mu.Unlock()
+			s.unlockSession(context.WithoutCancel(ctx), req, startedAt)
+			s.clearRun(context.WithoutCancel(ctx)) // Ended here, not by a crash
+			slog.Warn("motor session interrupted", "user_id", req.UserID)
+			s.emit(context.WithoutCancel(ctx), SessionInterrupted, req, s.clock.Now().Sub(startedAt), "")
+		}
+	}()
+
+	held := false
+	for {
+		beat()
+		if run := s.takeRecovered(); run != nil { // The run that was on when the process last died
+			if !s.complete(ctx, run, beat) {
+				return nil
+			}
+			continue
+		}
+		if s.hold != nil { // Leave requests queued while held
+			if reason := s.hold(ctx); reason != "" {
+				if !held {
+					slog.Info("motor queue held", "reason", reason)
+					held = true
+				}
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(s.pollInterval):
+				}
+				continue
+			}
+			held = false
+		}
+		if reason := s.motorBusy(ctx); reason != "" { // Wait for the motor to settle, a fault to be cleared or another session to end
+			if !held {
+				slog.Info("motor queue held", "reason", reason)
+				held = true
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-s.states.wake:
+			case <-time.After(s.pollInterval):
+			}
+			continue
+		}
+		held = false
+		popCtx, cancel := context.WithTimeout(ctx, s.pollInterval) // Wake up regularly to report progress
+		req, err := s.queue.Pop(popCtx)                            // Next request in queue
+		cancel()
+		if ctx.Err() != nil { // Shutting down
+			return nil
+		}
+		if errors.Is(err, context.DeadlineExceeded) { // Nothing queued yet
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("motor queue pop: %w", err) // Let the supervisor back off and restart
+		}
+		if !s.start(ctx, req) {
+			continue
+		}
+		s.mu.Lock()
+		startedAt := s.currentAt
+		s.mu.Unlock()
+		run := &sessionRun{req: req, startedAt: startedAt, since: startedAt}
+		s.saveRun(ctx, run) // Found on the next start if the process dies mid-run
+		if !s.complete(ctx, run, beat) {
+			return nil // Shutting down mid-session; the deferred OFF runs
+		}
+	}
+}
+
+// complete waits out run, switches the motor off and reports how the run ended. It
+// returns false if ctx ended first, leaving the OFF to Run.
+func (s *MotorService) complete(ctx context.Context, run *sessionRun, beat func()) bool {
+	kind, reason := s.runSession(ctx, run, beat)
+	if ctx.Err() != nil {
+		return false
+	}
+	s.switchOff()
+	s.mu.Lock()
+	s.current = nil // Motor is idle again
+	s.mu.Unlock()
+	s.flow.record(&s.flow.completed, s.clock.Now(), run.ran)
+	s.unlockSession(ctx, run.req, run.startedAt)
+	s.clearRun(ctx)
+	if kind != SessionFinished {
+		slog.Warn("motor session cut short", "user_id", run.req.UserID, "outcome", kind, "reason", reason)
+	}
+	s.emitSession(ctx, SessionEvent{Kind: kind, Request: *run.req, Reason: reason, Ran: run.ran, Outages: run.outages})
+	return true
+}
+
+// switchOff sends OFF to the shared motor. OFF is allowed in every state.
+func (s *MotorService) switchOff() {
+	s.stopVerified(SharedMotor, MotorTopic)
+}
+
+// stopVerified sends OFF to motor on topic and, in the background, keeps resending it
+// every OffRetry until the motor confirms it has stopped (or, for devices that don't
+// confirm, until the broker has it). A motor still unconfirmed after OffTimeout is put
+// in FAULT, which alerts the admins. A single fire-and-forget OFF is not enough for a
+// safety action.
+func (s *MotorService) stopVerified(motor, topic string) {
+	pub := s.publisherFor(motor) // Resends go the same way, even once a simulated session is over
+	err := s.send(context.Background(), pub, motor, topic, CommandOff)
+	if err != nil {
+		slog.Error("motor OFF publish failed", "motor", motor, "error", err)
+	}
+	s.states.apply(motor, CommandOff, "", s.clock.Now())
+	deadline := s.clock.Now().Add(s.offTimeout)
+	go func() {
+		for attempt := 1; ; attempt++ {
+			if err == nil && s.states.get(motor).State != MotorStopping { // Confirmed, or already in FAULT
+				return
+			}
+			if !s.clock.Now().Before(deadline) {
+				reason := fmt.Sprintf("device did not confirm OFF after %d attempts", attempt)
+				if err != nil {
+					reason = fmt.Sprintf("OFF could not be delivered after %d attempts: %v", attempt, err)
+				}
+				s.states.apply(motor, AckFault, reason, s.clock.Now())
+				slog.Error("motor OFF unconfirmed", "motor", motor, "reason", reason)
+				return
+			}
+			time.Sleep(s.offRetry)
+			if s.states.get(motor).State != MotorStopping && err == nil {
+				return
+			}
+			if err = s.send(context.Background(), pub, motor, topic, CommandOff); err != nil {
+				slog.Error("motor OFF publish failed", "motor", motor, "attempt", attempt+1, "error", err)
+			}
+		}
+	}()
+}
+
+// publisherFor returns where motor's commands go: the simulator in dry-run mode or
+// during a simulated session on the shared motor, the real publisher otherwise.
+func (s *MotorService) publisherFor(motor string) Publisher {
+	if s.simulate {
+		return s.sim
+	}
+	if motor == SharedMotor {
+		s.mu.Lock()
+		simulated := s.current != nil && s.current.Simulate
+		s.mu.Unlock()
+		if simulated {
+			return s.sim
+		}
+	}
+	return s.publisher
+}
+
+// Simulating reports whether dry-run mode is on for every request.
+func (s *MotorService) Simulating() bool { return s.simulate }
+
+// SimulateCommand hands an "on" or "off" for a tenant device's motor ("{org}/{device}")
+// to the simulator instead of MQTT, tagged with the request ID in ctx; record it with
+// Commanded as usual.
+func (s *MotorService) SimulateCommand(ctx context.Context, device, command string) {
+	s.send(ctx, s.sim, device, device+"/"+MotorTopic, command)
+}
+
+// unlockSession releases the shared motor's interlock if req's session, started at
+// startedAt, still holds it.
+func (s *MotorService) unlockSession(ctx context.Context, req *store.MotorRequest, startedAt time.Time) {
+	l := Interlock{Source: InterlockQueue, UserID: req.UserID, Since: startedAt}
+	if err := s.state.ReleaseLease(ctx, interlockLease(SharedMotor), l.holder()); err != nil {
+		slog.Error("release motor interlock failed", "motor", SharedMotor, "error", err)
+	}
+}
+
+// motorBusy returns why the shared motor can't take a new session: it is still
+// confirming OFF, is in FAULT or another session holds its interlock. An OFF that isn't
+// confirmed in time is faulted by stopVerified.
+func (s *MotorService) motorBusy(ctx context.Context) string {
+	st := s.states.get(SharedMotor)
+	switch st.State {
+	case MotorOff:
+		if l, err := s.Interlock(ctx, SharedMotor); err == nil && l != nil { // E.g. a session still running on a replica that lost leadership
+			return (&InterlockError{Device: SharedMotor, Holder: *l}).Error()
+		}
+		return ""
+	case MotorFault:
+		return "motor fault: " + st.Reason
+	case MotorStopping:
+		return "waiting for the motor to confirm OFF"
+	}
+	s.switchOff() // On outside a session: never leave it running
+	return "motor was " + st.State + " outside a session"
+}
+
+// emit records how a request ended (ran is how long the motor was on) and tells the
+// listener about the change.
+func (s *MotorService) emit(ctx context.Context, kind string, req *store.MotorRequest, ran time.Duration, reason string) {
+	s.emitSession(ctx, SessionEvent{Kind: kind, Request: *req, Reason: reason, Ran: ran})
+}
+
+func (s *MotorService) emitSession(ctx context.Context, ev SessionEvent) { // Logs and reports ev, stamped now
+	ev.At = s.clock.Now()
+	if ev.Kind != SessionStarted {
+		req := ev.Request
+		entry := &models.SessionLog{QueueID: req.ID, UserID: req.UserID, Outcome: ev.Kind, Requested: req.Duration, Ran: ev.Ran, Reason: ev.Reason, EndedAt: ev.At, Simulated: req.Simulate, Outages: ev.Outages}
+		if err := s.repo.LogSession(ctx, entry); err != nil {
+			slog.Error("log motor session failed", "user_id", req.UserID, "outcome", ev.Kind, "error", err)
+		}
+	}
+	if ev.Kind == SessionRejected || ev.Kind == SessionExpired {
+		s.logRejected(ctx, &ev.Request, ev.Kind, ev.Reason)
+	}
+	if s.onSession != nil {
+		s.onSession(ev)
+	}
+}
+
+// logRejected keeps req, dropped instead of run, with why (kind is SessionRejected or
+// SessionExpired), so it never just vanishes from the queue.
+func (s *MotorService) logRejected(ctx context.Context, req *store.MotorRequest, kind, reason string) {
+	rej := &models.RejectedRequest{QueueID: req.ID, UserID: req.UserID, RequestAt: req.RequestAt, Duration: req.Duration, Simulated: req.Simulate, Note: req.Note, Priority: req.Priority, ExpiresAt: req.ExpiresAt, Outcome: kind, Reason: reason, RejectedAt: s.clock.Now()}
+	if err := s.repo.LogRejected(ctx, rej); err != nil {
+		slog.Error("log rejected request failed", "user_id", req.UserID, "reason", reason, "error", err)
+	}
+}
+
+func (s *MotorService) start(ctx context.Context, req *store.MotorRequest) bool { // Checks expiry, shutdown, hold and quota, then switches the motor on
+	if !req.ExpiresAt.IsZero() && !s.clock.Now().Before(req.ExpiresAt) { // Waited too long to be wanted
+		slog.Info("motor request skipped: expired", "user_id", req.UserID, "expires_at", req.ExpiresAt)
+		s.emit(ctx, SessionExpired, req, 0, "expired at "+req.ExpiresAt.Format(time.RFC3339))
+		return false
+	}
+	if sd, err := s.state.GetShutdown(ctx); err != nil || sd.Active { // System shut down by an admin
+		slog.Info("motor request skipped: system shut down", "user_id", req.UserID, "reason", sd.Summary(), "error", err)
+		if err != nil {
+			s.emit(ctx, SessionRejected, req, 0, "could not read the shutdown state")
+		} else {
+			s.emit(ctx, SessionRejected, req, 0, "system is shut down: "+sd.Summary())
+		}
+		return false
+	}
+	if s.hold != nil { // Held while Pop waited, e.g. paused by an admin: put it back for later
+		if reason := s.hold(ctx); reason != "" {
+			if err := s.queue.Requeue(ctx, req); err != nil {
+				slog.Error("motor request skipped: could not requeue while held", "user_id", req.UserID, "error", err)
+				s.emit(ctx, SessionRejected, req, 0, "could not put back in the queue while held")
+				return false
+			}
+			slog.Info("motor request held", "user_id", req.UserID, "reason", reason)
+			return false
+		}
+	}
+	if s.admit != nil { // Limits kept outside the service, e.g. an organization's pool
+		if reason := s.admit(ctx, *req); reason != "" {
+			slog.Info("motor request skipped: not admitted", "user_id", req.UserID, "reason", reason)
+			s.emit(ctx, SessionRejected, req, 0, reason)
+			return false
+		}
+	}
+	lock := Interlock{Source: InterlockQueue, UserID: req.UserID, Since: s.clock.Now()}
+	if err := s.lockMotor(ctx, SharedMotor, lock, req.Duration+s.ackWait+interlockMargin); err != nil { // Checked by motorBusy, so only a race gets here
+		slog.Error("motor request skipped", "user_id", req.UserID, "error", err)
+		reason := "could not lock the motor"
+		var ierr *InterlockError
+		if errors.As(err, &ierr) {
+			reason = err.Error()
+		}
+		s.emit(ctx, SessionRejected, req, 0, reason)
+		return false
+	}
+	used, _, err := s.usage(ctx) // Only this replica dispatches while it holds the interlock
+	if err != nil {
+		slog.Error("motor request skipped: quota check failed", "user_id", req.UserID, "error", err)
+		s.unlockSession(ctx, req, lock.Since)
+		s.emit(ctx, SessionRejected, req, 0, "could not check the quota")
+		return false
+	}
+	if used+req.Duration > s.Quota() {
+		slog.Info("motor request skipped: quota exceeded", "user_id", req.UserID, "duration", req.Duration)
+		s.unlockSession(ctx, req, lock.Since)
+		s.emit(ctx, SessionRejected, req, 0, "daily quota reached")
+		return false
+	}
+	if _, err := s.states.apply(SharedMotor, CommandOn, "", s.clock.Now()); err != nil { // Settled by motorBusy, so only a race gets here
+		slog.Error("motor request skipped", "user_id", req.UserID, "error", err)
+		s.unlockSession(ctx, req, lock.Since)
+		s.emit(ctx, SessionRejected, req, 0, err.Error())
+		return false
+	}
+	s.mu.Lock()
+	s.current, s.currentAt, s.stopped = req, lock.Since, "" // Track the running session
+	s.mu.Unlock()
+	slog.Info("motor request dispatched", "user_id", req.UserID, "duration", req.Duration, "priority", req.Priority, "request_id", req.RequestID)
+	if err := s.send(WithRequestID(ctx, req.RequestID), s.publisherFor(SharedMotor), SharedMotor, MotorTopic, CommandOn); err != nil { // Send ON command (to the simulator for a dry run)
+		slog.Error("motor ON publish failed", "request_id", req.RequestID, "error", err)
+	}
+	s.emit(ctx, SessionStarted, req, 0, "")
+	s.checkQuotaWarnings(ctx, req.Duration)
+	return true
+}
+
+// checkQuotaWarnings reports each warning level that the session just started pushed usage
+// past. A level fires again only once runs leaving the window have taken usage back below it.
+func (s *MotorService) checkQuotaWarnings(ctx context.Context, reserved time.Duration) {
+	s.mu.Lock()
+	levels := s.quotaWarn
+	s.mu.Unlock()
+	if s.onQuota == nil || len(levels) == 0 {
+		return
+	}
+	used, resetAt, err := s.usage(ctx)
+	if err != nil {
+		return
+	}
+	quota := s.Quota()
+	before := used - reserved
+	for _, pct := range levels {
+		level := quota * time.Duration(pct) / 100
+		if before < level && used >= level {
+			s.onQuota(QuotaEvent{Percent: pct, Used: used, Quota: quota, ResetAt: resetAt})
+		}
+	}
+}
+
+// wait waits out a session of length d that started at startedAt and returns how it
+// ended: SessionFinished, SessionInterrupted with a reason when the motor stops on its
+// own, faults or doesn't confirm ON, SessionStopped when an admin or its owner stops it
+// with StopSession, SessionSafetyStopped once it has run for
+// MaxRuntime, or SessionPowerLost when the device restarts or stops sending heartbeats. It returns early when ctx ends.
+func (s *MotorService) wait(ctx context.Context, d time.Duration, startedAt time.Time, beat func()) (kind, reason string) {
+	done := s.clock.After(d)
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		if reason, _ := s.outage(startedAt); reason != "" { // Before the OFF a boot leaves behind
+			return SessionPowerLost, reason
+		}
+		st := s.states.get(SharedMotor)
+		switch {
+		case st.State == MotorFault:
+			return SessionInterrupted, "motor fault: " + st.Reason
+		case st.State == MotorOff || st.State == MotorStopping: // Only this loop and StopSession switch it off during a session
+			s.mu.Lock()
+			stopped := s.stopped
+			s.mu.Unlock()
+			if stopped != "" {
+				return SessionStopped, stopped
+			}
+			return SessionInterrupted, "motor switched off"
+		case st.State == MotorStarting && s.clock.Now().Sub(st.Since) > s.ackWait:
+			st, _ = s.states.apply(SharedMotor, AckFault, "device did not confirm ON", s.clock.Now())
+			return SessionInterrupted, "motor fault: " + st.Reason
+		case s.maxRuntime > 0 && s.clock.Now().Sub(startedAt) >= s.maxRuntime: // Checked every poll, independent of the quota
+			return SessionSafetyStopped, fmt.Sprintf("safety cutoff: ran %s continuously", s.maxRuntime)
+		}
+		select {
+		case <-done:
+			return SessionFinished, ""
+		case <-ticker.C:
+			beat() // Still alive while the motor runs
+		case <-s.states.wake: // State changed
+		case <-ctx.Done():
+			return "", ""
+		}
+	}
+}
+
+func (s *MotorService) Status(ctx context.Context) (MotorStatus, error) { // Queue, quota, session and shutdown state
+	queueLen, err := s.queue.Len(ctx)
+	if err != nil {
+		return MotorStatus{}, fmt.Errorf("read queue: %w", err)
+	}
+	used, resetAt, err := s.usage(ctx)
+	if err != nil {
+		return MotorStatus{}, fmt.Errorf("read quota: %w", err)
+	}
+	sd, err := s.state.GetShutdown(ctx)
+	if err != nil {
+		return MotorStatus{}, fmt.Errorf("read shutdown state: %w", err)
+	}
+	st := MotorStatus{
+		QueueLength:   queueLen,
+		QueueCapacity: s.queue.Cap(),
+		Used:          used,
+		Quota:         s.Quota(),
+		ResetAt:       resetAt,
+		Shutdown:      sd,
+		Motor:         s.states.get(SharedMotor),
+		Simulating:    s.simulate,
+		Backpressure:  s.backpressureStatus(queueLen),
+	}
+	queued, err := s.queue.List(ctx)
+	if err != nil {
+		return MotorStatus{}, fmt.Errorf("list queue: %w", err)
+	}
+	for _, req := range queued {
+		st.Queued = append(st.Queued, *req)
+	}
+	if st.Interlock, err = s.Interlock(ctx, SharedMotor); err != nil {
+		return MotorStatus{}, fmt.Errorf("read interlock: %w", err)
+	}
+	s.mu.Lock()
+	if s.current != nil {
+		st.Current = &MotorSession{Request: *s.current, StartedAt: s.currentAt}
+	}
+	s.mu.Unlock()
+	if st.Current != nil {
+		if _, _, st.Current.Left, err = s.runningRequest(ctx); err != nil {
+			return MotorStatus{}, err
+		}
+	}
+	return st, nil
+}
+
+// ForceShutdown switches the motor off, records the shutdown (a category from
+// ShutdownCategories and optional notes) and drops every queued request. The OFF command is sent first and is never cancelled by ctx. A non-zero until
+// schedules the end of the shutdown (see ExpireShutdown); otherwise it lasts until Restart.
+func (s *MotorService) ForceShutdown(ctx context.Context, category, reason string, until time.Time) (int, error) {
+	s.switchOff() // Stop the motor first; the shutdown is recorded even if the publish fails
+	s.UnlockMotor(ctx, SharedMotor)
+	sd := store.Shutdown{Active: true, Category: category, Reason: reason, Since: s.clock.Now(), Until: until}
+	if err := s.state.SetShutdown(ctx, sd); err != nil {
+		return 0, fmt.Errorf("record shutdown: %w", err)
+	}
+	if err := s.repo.SaveShutdown(ctx, sd); err != nil { // Survives a restart of the process
+		return 0, fmt.Errorf("persist shutdown: %w", err)
+	}
+	s.dropRestartApproval(ctx)         // Approvals are for the shutdown they were given in
+	dropped, err := s.queue.Drain(ctx) // Drop everything still queued
+	if err != nil {
+		slog.Error("emergency shutdown: draining queue failed", "error", err)
+	}
+	for _, req := range dropped { // Shows up in the owners' digests and rejected requests
+		reason := "dropped by emergency shutdown: " + sd.Summary()
+		entry := &models.SessionLog{QueueID: req.ID, UserID: req.UserID, Outcome: SessionRejected, Requested: req.Duration, Reason: reason, EndedAt: s.clock.Now(), Simulated: req.Simulate}
+		if err := s.repo.LogSession(ctx, entry); err != nil {
+			slog.Error("log dropped request failed", "user_id", req.UserID, "error", err)
+		}
+		s.logRejected(ctx, req, SessionRejected, reason)
+	}
+	return len(dropped), nil
+}
+
+func (s *MotorService) Restart(ctx context.Context) error { // Clears an emergency shutdown (ErrNotShutDown if none)
+	sd, err := s.state.GetShutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("read shutdown state: %w", err)
+	}
+	if !sd.Active {
+		return ErrNotShutDown
+	}
+	if err := s.repo.SaveShutdown(ctx, store.Shutdown{}); err != nil { // Cleared in the database first, so a restart can't bring it back
+		return fmt.Errorf("persist shutdown: %w", err)
+	}
+	s.dropRestartApproval(ctx)
+	return s.state.SetShutdown(ctx, store.Shutdown{})
+}
+
+const restartApprovalLease = "restart-approval" // Held by the first admin approving a restart
+
+type RestartApproval struct { // Outcome of RequestRestart
+	Restarted bool      // Whether the system was restarted
+	FirstBy   uint      // Admin who approved first (the only one without two-person approval)
+	ExpiresAt time.Time // While pending: when the first approval lapses
+}
+
+// RequestRestart restarts the system for admin userID. With a RestartApproval window,
+// the first call only records the approval; a call by a different admin within the
+// window restarts, and the same admin again gets ErrSecondApprover. The approval is
+// kept in the shared store so the second admin may use any replica.
+func (s *MotorService) RequestRestart(ctx context.Context, userID uint) (RestartApproval, error) {
+	sd, err := s.state.GetShutdown(ctx)
+	if err != nil {
+		return RestartApproval{}, fmt.Errorf("read shutdown state: %w", err)
+	}
+	if !sd.Active {
+		return RestartApproval{}, ErrNotShutDown
+	}
+	if s.restartApproval <= 0 {
+		return RestartApproval{Restarted: true, FirstBy: userID}, s.Restart(ctx)
+	}
+	me := strconv.FormatUint(uint64(userID), 10)
+	holder, err := s.state.LeaseHolder(ctx, restartApprovalLease)
+	if err != nil {
+		return RestartApproval{}, fmt.Errorf("read restart approval: %w", err)
+	}
+	if holder == me {
+		return RestartApproval{FirstBy: userID}, ErrSecondApprover
+	}
+	if holder == "" { // First approval
+		ok, err := s.state.AcquireLease(ctx, restartApprovalLease, me, s.restartApproval)
+		if err != nil {
+			return RestartApproval{}, fmt.Errorf("record restart approval: %w", err)
+		}
+		if !ok { // Another admin approved in between
+			return s.RequestRestart(ctx, userID)
+		}
+		return RestartApproval{FirstBy: userID, ExpiresAt: s.clock.Now().Add(s.restartApproval)}, nil
+	}
+	first, _ := strconv.ParseUint(holder, 10, 64)
+	return RestartApproval{Restarted: true, FirstBy: uint(first)}, s.Restart(ctx) // Restart drops the approval
+}
+
+func (s *MotorService) dropRestartApproval(ctx context.Context) { // Forgets a pending restart approval
+	holder, err := s.state.LeaseHolder(ctx, restartApprovalLease)
+	if err == nil && holder != "" {
+		err = s.state.ReleaseLease(ctx, restartApprovalLease, holder)
+	}
+	if err != nil {
+		slog.Error("clear restart approval failed", "error", err)
+	}
+}
+
+// ExpireShutdown clears a scheduled shutdown whose end time has passed and returns it;
+// it returns false while no shutdown is due to end. Call it periodically from one replica.
+func (s *MotorService) ExpireShutdown(ctx context.Context) (store.Shutdown, bool, error) {
+	sd, err := s.state.GetShutdown(ctx)
+	if err != nil {
+		return store.Shutdown{}, false, fmt.Errorf("read shutdown state: %w", err)
+	}
+	if !sd.Active || sd.Until.IsZero() || s.clock.Now().Before(sd.Until) {
+		return sd, false, nil
+	}
+	if err := s.Restart(ctx); err != nil {
+		return sd, false, err
+	}
+	return sd, true, nil
+}
+
+// RestoreShutdown brings back the emergency shutdown recorded in the database, so a
+// restart never cancels it, and returns the resulting state. A shutdown found only in
+// a shared store is recorded in the database too: either one is enough to stay shut down.
+func (s *MotorService) RestoreShutdown(ctx context.Context) (store.Shutdown, error) {
+	saved, err := s.repo.LoadShutdown(ctx)
+	if err != nil {
+		return store.Shutdown{}, fmt.Errorf("load shutdown: %w", err)
+	}
+	current, err := s.state.GetShutdown(ctx)
+	if err != nil {
+		return store.Shutdown{}, fmt.Errorf("read shutdown state: %w", err)
+	}
+	switch {
+	case saved.Active && !current.Active:
+		return saved, s.state.SetShutdown(ctx, saved)
+	case current.Active && !saved.Active:
+		return current, s.repo.SaveShutdown(ctx, current)
+	}
+	return current, nil
+}
+
+// Save persists pending requests so they survive a restart. Call it after Run has
+// returned so nothing is dequeued concurrently. A Redis or database queue already
+// outlives the process, so there is nothing to save. Quota usage needs no saving: it is
+// worked out from the session log.
+func (s *MotorService) Save(ctx context.Context) error {
+	if s.queue.Persistent() {
+		return nil
+	}
+	reqs, err := s.queue.Drain(ctx) // Whatever is still queued
+	if err != nil {
+		return err
+	}
+	items := make([]models.MotorQueueItem, 0, len(reqs))
+	for _, req := range reqs {
+		items = append(items, models.MotorQueueItem{QueueID: req.ID, UserID: req.UserID, RequestAt: req.RequestAt, Duration: req.Duration, Simulate: req.Simulate, Note: req.Note, RequestID: req.RequestID, Priority: req.Priority, ExpiresAt: req.ExpiresAt})
+	}
+	return s.repo.SaveSnapshot(ctx, items)
+}
+
+// Restore re-queues requests saved by Save. Call it once at startup before Run.
+func (s *MotorService) Restore(ctx context.Context) (int, error) {
+	if s.queue.Persistent() { // Nothing was saved; with a database queue the rows are the queue itself
+		return 0, nil
+	}
+	items, err := s.repo.LoadSnapshot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items { // Re-queue in original order
+		req := &store.MotorRequest{ID: item.QueueID, UserID: item.UserID, RequestAt: item.RequestAt, Duration: item.Duration, Simulate: item.Simulate, Note: item.Note, RequestID: item.RequestID, Priority: item.Priority, ExpiresAt: item.ExpiresAt}
+		if err := s.queue.Push(ctx, req); err != nil {
+			return 0, err
+		}
+	}
+	if err := s.repo.ClearQueueSnapshot(ctx); err != nil { // Don't restore twice
+		return len(items), err
+	}
+	return len(items), nil
+}
+
+// MotorState returns the state of a motor: SharedMotor or a tenant device's "{org}/{device}".
+func (s *MotorService) MotorState(device string) MotorStateInfo { return s.states.get(device) }
+
+// MotorStates returns the state of every motor that has been commanded or reported.
+func (s *MotorService) MotorStates() map[string]MotorStateInfo { return s.states.all() }
+
+// CheckCommand reports whether an "on" or "off" command may be sent to a device's motor
+// now. It returns a *TransitionError if not, e.g. ON during a fault.
+func (s *MotorService) CheckCommand(device, command string) error {
+	return s.states.check(device, command)
+}
+
+// Commanded records that an "on" or "off" command was published to a device's motor.
+func (s *MotorService) Commanded(device, command string) (MotorStateInfo, error) {
+	return s.states.apply(device, command, "", s.clock.Now())
+}
+
+// Ack applies a status report ("on", "off", "fault[: detail]", "boot" or "alive") a device
+// published on MotorStatusTopic. A report nobody asked for, like ON while stopped, is a fault. A
+// sequenced report not newer than the last one is refused with a *StaleAckError. Reports
+// are logged with the request ID they echo, or else that of the last command.
+func (s *MotorService) Ack(device string, payload []byte) (MotorStateInfo, error) {
+	input, detail, seq, req := parseAck(payload)
+	if input == "" {
+		return s.states.get(device), fmt.Errorf("unknown motor status %q", payload)
+	}
+	if seq > 0 { // Sequenced report: a replay or a duplicate changes nothing
+		if err := s.states.acknowledge(device, seq); err != nil {
+			return s.states.get(device), err
+		}
+	}
+	s.states.report(device, input, s.clock.Now())
+	if input == Heartbeat {
+		return s.states.get(device), nil
+	}
+	if input == AckBoot && device != SharedMotor && s.states.get(device).State != MotorOff { // A manual session ends with the power; the queue handles its own in Run
+		slog.Warn("device restarted with its motor on", "motor", device)
+		s.UnlockMotor(context.Background(), device)
+	}
+	if req == "" { // Firmware that doesn't echo it
+		req = s.states.get(device).Req
+	}
+	st, err := s.states.apply(device, input, detail, s.clock.Now())
+	slog.Info("motor status report", "motor", device, "report", input, "state", st.State, "request_id", req)
+	return st, err
+}
+
+// ClearFault returns a motor in FAULT to OFF once an admin has checked it. It returns a
+// *TransitionError if the motor isn't in FAULT.
+func (s *MotorService) ClearFault(device string) error {
+	_, err := s.states.apply(device, ClearFault, "", s.clock.Now())
+	return err
+}
+
+// StopMotor switches a tenant device's motor ("{org}/{device}") off with a verified OFF
+// and releases its interlock, e.g. when the device is shut down.
+func (s *MotorService) StopMotor(ctx context.Context, device string) {
+	s.stopVerified(device, device+"/"+MotorTopic)
+	s.UnlockMotor(ctx, device)
+}
+
+// Trip stops a motor for a safety reason, such as a sensor reading over its limit, and
+// puts it in FAULT until an admin clears it. A queued session on the shared motor ends
+// as interrupted. It reports whether the motor was newly faulted.
+func (s *MotorService) Trip(ctx context.Context, device, reason string) bool {
+	wasFault := s.states.get(device).State == MotorFault
+	s.states.apply(device, AckFault, reason, s.clock.Now())
+	topic := MotorTopic
+	if device != SharedMotor {
+		topic = device + "/" + MotorTopic
+		s.UnlockMotor(ctx, device) // The queue releases the shared motor when its session ends
+	}
+	s.stopVerified(device, topic) // Resent until the broker has it; FAULT doesn't wait for the device
+	return !wasFault
+}
@@ -0,0 +1,1282 @@
+// motor_test.go - Tests for the motor queue, quota and shutdown logic
+// Run with: go test ./...
+
+package services
+
+import (
+	"context"                // For cancellation
+	"encoding/json"          // Command payloads
+	"errors"                 // For checking errors
+	"fmt"                    // Ack payloads
+	"go-mqtt-backend/models" // DB models
+	"go-mqtt-backend/store"  // In-memory backends
+	"sync"                   // For guarding fakes
+	"testing"                // Go's testing package
+	"time"                   // For durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+type fakePublisher struct { // Records published payloads
+	mu       sync.Mutex
+	payloads []string
+}
+
+func (p *fakePublisher) Publish(topic string, payload interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.payloads = append(p.payloads, payload.(string))
+	return nil
+}
+
+func (p *fakePublisher) sent() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.payloads...)
+}
+
+type fakeClock struct { // Sessions end when the test says so
+	mu   sync.Mutex
+	now  time.Time
+	fire chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time { return c.fire }
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type fakeRepo struct { // In-memory MotorRepository
+	mu          sync.Mutex // Run writes while tests and Status read
+	activations []models.DeviceActivation
+	sessions    []models.SessionLog
+	rejected    []models.RejectedRequest
+	items       []models.MotorQueueItem
+	shutdown    store.Shutdown
+	running     models.RunningSession
+}
+
+func (r *fakeRepo) LogActivation(ctx context.Context, a *models.DeviceActivation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.activations = append(r.activations, *a)
+	return nil
+}
+
+func (r *fakeRepo) LogSession(ctx context.Context, l *models.SessionLog) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions = append(r.sessions, *l)
+	return nil
+}
+
+func (r *fakeRepo) LogRejected(ctx context.Context, rej *models.RejectedRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rejected = append(r.rejected, *rej)
+	return nil
+}
+
+func (r *fakeRepo) RunsSince(ctx context.Context, since time.Time) ([]models.SessionLog, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var runs []models.SessionLog
+	for _, l := range r.sessions {
+		if !l.EndedAt.Before(since) && l.Requested > 0 && l.Ran > 0 {
+			runs = append(runs, l)
+		}
+	}
+	return runs, nil
+}
+
+func (r *fakeRepo) SaveSnapshot(ctx context.Context, items []models.MotorQueueItem) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items = items
+	return nil
+}
+
+func (r *fakeRepo) LoadSnapshot(ctx context.Context) ([]models.MotorQueueItem, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.items, nil
+}
+
+func (r *fakeRepo) SaveShutdown(ctx context.Context, sd store.Shutdown) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.shutdown = sd
+	return nil
+}
+
+func (r *fakeRepo) LoadShutdown(ctx context.Context) (store.Shutdown, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.shutdown, nil
+}
+
+func (r *fakeRepo) SaveRunning(ctx context.Context, run models.RunningSession) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run.ID = 1
+	r.running = run
+	return nil
+}
+
+func (r *fakeRepo) LoadRunning(ctx context.Context) (models.RunningSession, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.running, nil
+}
+
+func (r *fakeRepo) ClearRunning(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running = models.RunningSession{}
+	return nil
+}
+
+func (r *fakeRepo) ClearQueueSnapshot(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items = nil
+	return nil
+}
+
+// newTestService returns a service on in-memory backends with a one-hour quota
+func newTestService() (*MotorService, *fakePublisher, *fakeClock, *fakeRepo) {
+	pub := &fakePublisher{}
+	clock := &fakeClock{now: time.Now(), fire: make(chan time.Time)}
+	repo := &fakeRepo{}
+	svc := NewMotorService(MotorDeps{
+		Queue:     store.NewMemoryQueue(2),
+		State:     store.NewMemoryState(),
+		Publisher: pub,
+		Repo:      repo,
+		Clock:     clock,
+		Quota:     time.Hour,
+	})
+	svc.pollInterval = 10 * time.Millisecond
+	return svc, pub, clock, repo
+}
+
+// TestEnqueueChecks checks duration, quota, capacity and shutdown rejections
+func TestEnqueueChecks(t *testing.T) {
+	svc, _, _, repo := newTestService()
+	ctx := context.Background()
+
+	assert.ErrorIs(t, svc.Enqueue(ctx, 1, -time.Hour), ErrDuration) // Would give quota back
+	assert.ErrorIs(t, svc.Enqueue(ctx, 1, 0), ErrDuration)
+	assert.Empty(t, repo.activations)
+	assert.ErrorIs(t, svc.Enqueue(ctx, 1, 2*time.Hour), ErrQuotaExceeded)
+	require.NoError(t, svc.Enqueue(ctx, 1, 10*time.Minute))
+	require.NoError(t, svc.Enqueue(ctx, 2, 10*time.Minute))
+	assert.ErrorIs(t, svc.Enqueue(ctx, 3, 10*time.Minute), store.ErrQueueFull)
+	assert.Len(t, repo.activations, 3) // Logged before the push
+
+	dropped, err := svc.ForceShutdown(ctx, ShutdownMaintenance, "pump replacement", time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, dropped)
+	require.Len(t, repo.sessions, 2) // Dropped requests are logged as rejected
+	assert.Equal(t, "dropped by emergency shutdown: maintenance: pump replacement", repo.sessions[0].Reason)
+	require.Len(t, repo.rejected, 2)
+	assert.Equal(t, repo.sessions[0].Reason, repo.rejected[0].Reason)
+	var sdErr *ShutdownError
+	require.True(t, errors.As(svc.Enqueue(ctx, 1, time.Minute), &sdErr))
+	assert.Equal(t, ShutdownMaintenance, sdErr.Category)
+	assert.Equal(t, "pump replacement", sdErr.Reason)
+
+	require.NoError(t, svc.Restart(ctx))
+	assert.ErrorIs(t, svc.Restart(ctx), ErrNotShutDown)
+	assert.NoError(t, svc.Enqueue(ctx, 1, time.Minute))
+}
+
+// TestRuntimeLimits checks that the per-request limit and the queue capacity can be changed
+// while the service runs
+func TestRuntimeLimits(t *testing.T) {
+	svc, _, _, repo := newTestService()
+	ctx := context.Background()
+	svc.SetMaxDuration(15 * time.Minute)
+	assert.ErrorIs(t, svc.Enqueue(ctx, 1, 20*time.Minute), ErrTooLong)
+	assert.Empty(t, repo.activations) // Refused before it is logged
+	require.NoError(t, svc.Enqueue(ctx, 1, 15*time.Minute))
+	require.NoError(t, svc.Enqueue(ctx, 2, 10*time.Minute))
+	assert.ErrorIs(t, svc.Enqueue(ctx, 3, 10*time.Minute), store.ErrQueueFull)
+
+	svc.SetQueueCapacity(3)
+	svc.SetMaxDuration(0) // No limit but the quota
+	require.NoError(t, svc.Enqueue(ctx, 3, 30*time.Minute))
+	st, err := svc.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, st.QueueCapacity)
+	assert.Equal(t, 3, st.QueueLength)
+}
+
+// TestCancel checks that users can take their own queued requests out of the queue, admins
+// anyone's, and that a running request can't be cancelled
+func TestCancel(t *testing.T) {
+	svc, _, _, repo := newTestService()
+	ctx := context.Background()
+	first, err := svc.EnqueueWith(ctx, 1, 10*time.Minute, EnqueueOptions{})
+	require.NoError(t, err)
+	second, err := svc.EnqueueWith(ctx, 2, 10*time.Minute, EnqueueOptions{})
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	_, err = svc.Cancel(ctx, first, 2, "cancelled by user 2") // Not theirs
+	assert.ErrorIs(t, err, ErrNotQueued)
+	req, err := svc.Cancel(ctx, first, 1, "cancelled by user 1")
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), req.UserID)
+	_, err = svc.Cancel(ctx, first, 1, "cancelled by user 1") // Already gone
+	assert.ErrorIs(t, err, ErrNotQueued)
+	_, err = svc.Cancel(ctx, second, 0, "cancelled by user 9") // Admin
+	require.NoError(t, err)
+	n, _ := svc.queue.Len(ctx)
+	assert.Zero(t, n)
+	require.Len(t, repo.sessions, 2)
+	assert.Equal(t, SessionCancelled, repo.sessions[0].Outcome)
+	assert.Equal(t, "cancelled by user 1", repo.sessions[0].Reason)
+
+	repo.running = models.RunningSession{ID: 1, QueueID: "abc", UserID: 3} // Running, perhaps on another replica
+	_, err = svc.Cancel(ctx, "abc", 3, "")
+	assert.ErrorIs(t, err, ErrRunning)
+	_, err = svc.Cancel(ctx, "abc", 4, "")
+	assert.ErrorIs(t, err, ErrNotQueued)
+}
+
+// TestEstimate checks queue positions and estimated start and finish times, behind a
+// session running on another replica
+func TestEstimate(t *testing.T) {
+	svc, _, clock, repo := newTestService()
+	ctx := context.Background()
+	now := clock.Now()
+	first, err := svc.EnqueueWith(ctx, 1, 10*time.Minute, EnqueueOptions{})
+	require.NoError(t, err)
+	second, err := svc.EnqueueWith(ctx, 2, 20*time.Minute, EnqueueOptions{})
+	require.NoError(t, err)
+	repo.running = models.RunningSession{ID: 1, QueueID: "run", UserID: 3, Duration: 30 * time.Minute, StartedAt: now.Add(-10 * time.Minute), PartSince: now.Add(-10 * time.Minute)}
+
+	est, err := svc.Estimate(ctx, second, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, est.Position)
+	assert.Equal(t, 10*time.Minute, est.Ahead)
+	assert.Equal(t, 20*time.Minute, est.Current)
+	assert.Equal(t, now.Add(30*time.Minute), est.StartAt)
+	assert.Equal(t, now.Add(50*time.Minute), est.FinishAt)
+	assert.Empty(t, est.Held)
+
+	_, err = svc.Estimate(ctx, first, 2) // Not theirs
+	assert.ErrorIs(t, err, ErrNotQueued)
+	est, err = svc.Estimate(ctx, first, 0) // Admin
+	require.NoError(t, err)
+	assert.Equal(t, 1, est.Position)
+	est, err = svc.Estimate(ctx, "run", 3)
+	require.NoError(t, err)
+	assert.True(t, est.Running)
+	assert.Equal(t, now.Add(-10*time.Minute), est.StartAt)
+	assert.Equal(t, now.Add(20*time.Minute), est.FinishAt)
+
+	svc.hold = func(context.Context) string { return "maintenance" }
+	est, err = svc.Estimate(ctx, first, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "maintenance", est.Held)
+}
+
+// TestRunSwitchesMotor checks ON/OFF around a session and OFF when stopped mid-session
+func TestRunSwitchesMotor(t *testing.T) {
+	svc, pub, clock, _ := newTestService()
+	var mu sync.Mutex
+	var kinds []string
+	svc.onSession = func(ev SessionEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		kinds = append(kinds, ev.Kind)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- svc.Run(ctx, func() {}) }()
+
+	require.NoError(t, svc.Enqueue(ctx, 1, 30*time.Minute))
+	require.Eventually(t, func() bool { return len(pub.sent()) == 1 }, time.Second, 5*time.Millisecond)
+	st, err := svc.Status(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, st.Current)
+	assert.Equal(t, uint(1), st.Current.Request.UserID)
+	assert.Equal(t, 30*time.Minute, st.Current.Left) // The fake clock stands still
+	assert.Equal(t, 30*time.Minute, st.Used)
+
+	clock.fire <- time.Now() // Session ends
+	require.Eventually(t, func() bool { return len(pub.sent()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"on", "off"}, pub.sent())
+
+	require.NoError(t, svc.Enqueue(ctx, 2, 10*time.Minute)) // Interrupted by shutdown
+	require.Eventually(t, func() bool { return len(pub.sent()) == 3 }, time.Second, 5*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	assert.Equal(t, []string{"on", "off", "on", "off"}, pub.sent())
+	mu.Lock()
+	assert.Equal(t, []string{SessionStarted, SessionFinished, SessionStarted, SessionInterrupted}, kinds)
+	mu.Unlock()
+}
+
+// TestRunPanicSwitchesOff checks that a panic mid-session still switches the motor off
+// and records the run as interrupted before the panic reaches the supervisor
+func TestRunPanicSwitchesOff(t *testing.T) {
+	svc, pub, _, repo := newTestService()
+	svc.onSession = func(ev SessionEvent) {
+		if ev.Kind == SessionStarted {
+			panic("listener failed")
+		}
+	}
+	ctx := context.Background()
+	require.NoError(t, svc.Enqueue(ctx, 1, 30*time.Minute))
+	assert.PanicsWithValue(t, "listener failed", func() { svc.Run(ctx, func() {}) })
+
+	assert.Equal(t, []string{"on", "off"}, pub.sent())
+	require.Len(t, repo.sessions, 1)
+	assert.Equal(t, SessionInterrupted, repo.sessions[0].Outcome)
+	st, err := svc.Status(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, st.Current)
+}
+
+// TestRunRejectsOverQuota checks that a request that no longer fits at dispatch time is reported
+func TestRunRejectsOverQuota(t *testing.T) {
+	svc, pub, clock, repo := newTestService()
+	events := make(chan SessionEvent, 4)
+	svc.onSession = func(ev SessionEvent) { events <- ev }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	id, err := svc.EnqueueWith(ctx, 1, 40*time.Minute, EnqueueOptions{}) // Both fit when queued...
+	require.NoError(t, err)
+	require.NoError(t, svc.Enqueue(ctx, 2, 40*time.Minute))
+	go svc.Run(ctx, func() {})
+
+	assert.Equal(t, SessionStarted, (<-events).Kind)
+	clock.fire <- time.Now()
+	assert.Equal(t, SessionFinished, (<-events).Kind)
+	ev := <-events // ...but only one fits the hour
+	assert.Equal(t, SessionRejected, ev.Kind)
+	assert.Equal(t, uint(2), ev.Request.UserID)
+	assert.Equal(t, "daily quota reached", ev.Reason)
+	assert.Equal(t, []string{"on", "off"}, pub.sent())
+	require.Len(t, repo.sessions, 2) // Logged before the listener is told
+	assert.Equal(t, models.SessionLog{QueueID: id, UserID: 1, Outcome: SessionFinished, Requested: 40 * time.Minute, Ran: 40 * time.Minute, EndedAt: clock.now}, repo.sessions[0])
+	assert.Equal(t, SessionRejected, repo.sessions[1].Outcome)
+	assert.Zero(t, repo.sessions[1].Ran)
+	require.Len(t, repo.rejected, 1) // Kept whole, with why
+	assert.Equal(t, uint(2), repo.rejected[0].UserID)
+	assert.Equal(t, 40*time.Minute, repo.rejected[0].Duration)
+	assert.Equal(t, "daily quota reached", repo.rejected[0].Reason)
+}
+
+// TestRunExpires checks that a request still waiting at its ExpiresAt is skipped and
+// logged as expired rather than run
+func TestRunExpires(t *testing.T) {
+	svc, pub, clock, repo := newTestService()
+	events := make(chan SessionEvent, 4)
+	svc.onSession = func(ev SessionEvent) { events <- ev }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	expiresAt := clock.now.Add(30 * time.Minute)
+	_, err := svc.EnqueueWith(ctx, 1, 10*time.Minute, EnqueueOptions{ExpiresAt: clock.now})
+	assert.ErrorIs(t, err, ErrExpiry)
+	require.NoError(t, svc.Enqueue(ctx, 1, 40*time.Minute))
+	id, err := svc.EnqueueWith(ctx, 2, 10*time.Minute, EnqueueOptions{ExpiresAt: expiresAt}) // Still queued when the first run ends
+	require.NoError(t, err)
+	go svc.Run(ctx, func() {})
+
+	assert.Equal(t, SessionStarted, (<-events).Kind)
+	clock.advance(40 * time.Minute)
+	clock.fire <- time.Now()
+	assert.Equal(t, SessionFinished, (<-events).Kind)
+	ev := <-events
+	assert.Equal(t, SessionExpired, ev.Kind)
+	assert.Equal(t, id, ev.Request.ID)
+	assert.Equal(t, "expired at "+expiresAt.Format(time.RFC3339), ev.Reason)
+	assert.Equal(t, []string{"on", "off"}, pub.sent())
+	require.Len(t, repo.sessions, 2)
+	assert.Equal(t, models.SessionLog{QueueID: id, UserID: 2, Outcome: SessionExpired, Requested: 10 * time.Minute, Reason: ev.Reason, EndedAt: clock.Now()}, repo.sessions[1])
+	require.Len(t, repo.rejected, 1)
+	assert.Equal(t, SessionExpired, repo.rejected[0].Outcome)
+	assert.Equal(t, expiresAt, repo.rejected[0].ExpiresAt)
+}
+
+// TestRunHolds checks that nothing is dispatched while Hold gives a reason
+func TestRunHolds(t *testing.T) {
+	svc, pub, _, _ := newTestService()
+	var mu sync.Mutex
+	reason := "maintenance"
+	svc.hold = func(context.Context) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return reason
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, svc.Enqueue(ctx, 1, 10*time.Minute))
+	go svc.Run(ctx, func() {})
+
+	time.Sleep(50 * time.Millisecond) // Several polls
+	assert.Empty(t, pub.sent())
+	st, err := svc.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, st.QueueLength) // Still queued
+
+	mu.Lock()
+	reason = ""
+	mu.Unlock()
+	require.Eventually(t, func() bool { return len(pub.sent()) == 1 }, time.Second, 5*time.Millisecond)
+}
+
+// TestRunHoldsWhilePopping checks that a request queued after a hold begins, while Run
+// is already waiting in Pop, is put back rather than dispatched
+func TestRunHoldsWhilePopping(t *testing.T) {
+	svc, pub, _, repo := newTestService()
+	svc.pollInterval = 200 * time.Millisecond // Pop waits well past the enqueue
+	var mu sync.Mutex
+	reason := ""
+	checked := make(chan struct{}, 1)
+	svc.hold = func(context.Context) string {
+		select {
+		case checked <- struct{}{}:
+		default:
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return reason
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go svc.Run(ctx, func() {})
+	<-checked                         // Not held: on to Pop
+	time.Sleep(20 * time.Millisecond) // Waiting in Pop
+
+	mu.Lock()
+	reason = "queue paused by an admin"
+	mu.Unlock()
+	require.NoError(t, svc.Enqueue(ctx, 1, 10*time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, pub.sent())
+	st, err := svc.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, st.QueueLength) // Put back
+
+	mu.Lock()
+	reason = ""
+	mu.Unlock()
+	require.Eventually(t, func() bool { return len(pub.sent()) == 1 }, time.Second, 5*time.Millisecond)
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	assert.Empty(t, repo.rejected)
+}
+
+// TestRunAdmit checks that a request Admit turns down is rejected with its reason
+func TestRunAdmit(t *testing.T) {
+	svc, pub, _, repo := newTestService()
+	svc.admit = func(ctx context.Context, req store.MotorRequest) string {
+		if req.UserID == 2 {
+			return "organization pool reached"
+		}
+		return ""
+	}
+	events := make(chan SessionEvent, 4)
+	svc.onSession = func(ev SessionEvent) { events <- ev }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, svc.Enqueue(ctx, 2, 10*time.Minute))
+	go svc.Run(ctx, func() {})
+
+	ev := <-events
+	assert.Equal(t, SessionRejected, ev.Kind)
+	assert.Equal(t, "organization pool reached", ev.Reason)
+	assert.Empty(t, pub.sent())
+	st, err := svc.Status(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, st.Used) // Nothing reserved
+	assert.Equal(t, SessionRejected, repo.sessions[0].Outcome)
+}
+
+// TestQuotaWarnings checks that each warning level fires once, when usage first crosses it
+func TestQuotaWarnings(t *testing.T) {
+	svc, _, clock, _ := newTestService()
+	svc.quotaWarn = []int{50, 80, 100}
+	warnings := make(chan QuotaEvent, 4)
+	svc.onQuota = func(ev QuotaEvent) { warnings <- ev }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go svc.Run(ctx, func() {})
+
+	require.NoError(t, svc.Enqueue(ctx, 1, 20*time.Minute)) // 33%: nothing
+	clock.fire <- time.Now()
+	require.NoError(t, svc.Enqueue(ctx, 1, 20*time.Minute)) // 67%: crosses 50
+	clock.fire <- time.Now()
+	require.NoError(t, svc.Enqueue(ctx, 1, 20*time.Minute)) // 100%: crosses 80 and 100
+	clock.fire <- time.Now()
+
+	var levels []int
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-warnings:
+			levels = append(levels, ev.Percent)
+			assert.Equal(t, time.Hour, ev.Quota)
+		case <-time.After(time.Second):
+			t.Fatal("missing quota warning")
+		}
+	}
+	assert.Equal(t, []int{50, 80, 100}, levels)
+	assert.Empty(t, warnings)
+}
+
+// TestSaveAndRestore checks that queued requests and their notes survive a restart, and
+// that quota usage carries over from the session log
+func TestSaveAndRestore(t *testing.T) {
+	svc, _, clock, repo := newTestService()
+	ctx := context.Background()
+	require.NoError(t, svc.Enqueue(ctx, 1, 5*time.Minute))
+	_, err := svc.EnqueueWith(ctx, 2, 7*time.Minute, EnqueueOptions{Note: "filling tank for seedlings"})
+	require.NoError(t, err)
+	assert.Equal(t, "filling tank for seedlings", repo.activations[1].Note)
+	repo.sessions = append(repo.sessions, models.SessionLog{UserID: 3, Outcome: SessionFinished, Requested: 20 * time.Minute, Ran: 20 * time.Minute, EndedAt: clock.Now()})
+	require.NoError(t, svc.Save(ctx))
+
+	restarted := NewMotorService(MotorDeps{Queue: store.NewMemoryQueue(2), State: store.NewMemoryState(), Repo: repo, Clock: clock, Quota: time.Hour})
+	n, err := restarted.Restore(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Empty(t, repo.items) // Not restored twice
+	st, err := restarted.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, st.QueueLength)
+	assert.Equal(t, 20*time.Minute, st.Used)
+	require.Len(t, st.Queued, 2)
+	assert.Equal(t, uint(2), st.Queued[1].UserID)
+	assert.Equal(t, "filling tank for seedlings", st.Queued[1].Note)
+}
+
+// TestRollingQuota checks that a run counts what it ran against the quota until it ended
+// QuotaWindow ago, and that manual sessions and rejected requests don't count
+func TestRollingQuota(t *testing.T) {
+	svc, _, clock, repo := newTestService()
+	ctx := context.Background()
+	now := clock.Now()
+	repo.sessions = append(repo.sessions,
+		models.SessionLog{UserID: 1, Outcome: SessionFinished, Requested: time.Hour, Ran: time.Hour, EndedAt: now.Add(-25 * time.Hour)}, // Left the window
+		models.SessionLog{UserID: 1, Outcome: SessionFinished, Requested: 30 * time.Minute, Ran: 30 * time.Minute, EndedAt: now.Add(-23 * time.Hour)},
+		models.SessionLog{UserID: 2, Outcome: SessionPowerLost, Requested: 20 * time.Minute, Ran: 5 * time.Minute, EndedAt: now.Add(-time.Hour)},
+		models.SessionLog{UserID: 2, Outcome: SessionRejected, Requested: 20 * time.Minute, EndedAt: now},
+		models.SessionLog{UserID: 3, Outcome: SessionStopped, Ran: 40 * time.Minute, EndedAt: now}, // Manual session on a tenant device
+	)
+	st, err := svc.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 35*time.Minute, st.Used)
+	assert.Equal(t, now.Add(time.Hour), st.ResetAt)
+	assert.ErrorIs(t, svc.Enqueue(ctx, 1, 30*time.Minute), ErrQuotaExceeded)
+
+	clock.advance(time.Hour + time.Minute) // The 30-minute run leaves the window
+	require.NoError(t, svc.Enqueue(ctx, 1, 30*time.Minute))
+	st, err = svc.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, st.Used)
+	assert.Equal(t, now.Add(23*time.Hour), st.ResetAt)
+}
+
+type persistentQueue struct{ store.Queue } // A queue that outlives the process, like Redis
+
+func (persistentQueue) Persistent() bool { return true }
+
+// TestSaveWithPersistentQueue checks that a queue that outlives the process isn't drained
+// into the snapshot
+func TestSaveWithPersistentQueue(t *testing.T) {
+	_, _, clock, repo := newTestService()
+	ctx := context.Background()
+	queue := persistentQueue{store.NewMemoryQueue(2)}
+	svc := NewMotorService(MotorDeps{Queue: queue, State: store.NewMemoryState(), Repo: repo, Clock: clock, Quota: time.Hour})
+	require.NoError(t, svc.Enqueue(ctx, 1, 5*time.Minute))
+	repo.sessions = append(repo.sessions, models.SessionLog{UserID: 3, Outcome: SessionFinished, Requested: 20 * time.Minute, Ran: 20 * time.Minute, EndedAt: clock.Now()})
+	require.NoError(t, svc.Save(ctx))
+	assert.Empty(t, repo.items)
+	n, err := queue.Len(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	restarted := NewMotorService(MotorDeps{Queue: queue, State: store.NewMemoryState(), Repo: repo, Clock: clock, Quota: time.Hour})
+	n, err = restarted.Restore(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	st, err := restarted.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, st.QueueLength)
+	assert.Equal(t, 20*time.Minute, st.Used)
+}
+
+// TestRestoreShutdown checks that an emergency shutdown survives a restart and stays cleared once restarted
+func TestRestoreShutdown(t *testing.T) {
+	svc, _, clock, repo := newTestService()
+	ctx := context.Background()
+	_, err := svc.ForceShutdown(ctx, ShutdownWeather, "flooding", time.Time{})
+	require.NoError(t, err)
+
+	restarted := NewMotorService(MotorDeps{Queue: store.NewMemoryQueue(2), State: store.NewMemoryState(), Repo: repo, Clock: clock, Quota: time.Hour})
+	sd, err := restarted.RestoreShutdown(ctx)
+	require.NoError(t, err)
+	assert.True(t, sd.Active)
+	assert.Equal(t, "flooding", sd.Reason)
+	var sdErr *ShutdownError
+	require.True(t, errors.As(restarted.Enqueue(ctx, 1, time.Minute), &sdErr))
+
+	require.NoError(t, restarted.Restart(ctx))
+	again := NewMotorService(MotorDeps{Queue: store.NewMemoryQueue(2), State: store.NewMemoryState(), Repo: repo, Clock: clock, Quota: time.Hour})
+	sd, err = again.RestoreShutdown(ctx)
+	require.NoError(t, err)
+	assert.False(t, sd.Active)
+	assert.NoError(t, again.Enqueue(ctx, 1, time.Minute))
+}
+
+// TestExpireShutdown checks that a scheduled shutdown ends by itself and an open-ended one doesn't
+func TestExpireShutdown(t *testing.T) {
+	svc, _, clock, repo := newTestService()
+	ctx := context.Background()
+	_, err := svc.ForceShutdown(ctx, ShutdownElectrical, "rewiring", clock.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	var sdErr *ShutdownError
+	require.True(t, errors.As(svc.Enqueue(ctx, 1, time.Minute), &sdErr))
+	assert.Equal(t, clock.Now().Add(2*time.Hour), sdErr.Until)
+
+	clock.advance(time.Hour)
+	_, expired, err := svc.ExpireShutdown(ctx)
+	require.NoError(t, err)
+	assert.False(t, expired)
+
+	clock.advance(time.Hour)
+	sd, expired, err := svc.ExpireShutdown(ctx)
+	require.NoError(t, err)
+	assert.True(t, expired)
+	assert.Equal(t, ShutdownElectrical, sd.Category)
+	assert.Equal(t, "rewiring", sd.Reason)
+	assert.False(t, repo.shutdown.Active) // Cleared in the database too
+	assert.NoError(t, svc.Enqueue(ctx, 1, time.Minute))
+
+	_, err = svc.ForceShutdown(ctx, ShutdownWeather, "flooding", time.Time{})
+	require.NoError(t, err)
+	clock.advance(24 * time.Hour)
+	_, expired, err = svc.ExpireShutdown(ctx)
+	require.NoError(t, err)
+	assert.False(t, expired) // Only a restart ends it
+}
+
+// TestEmergencyStop checks that a button press shuts the system down once across replicas until a restart
+func TestEmergencyStop(t *testing.T) {
+	svc, pub, clock, repo := newTestService()
+	ctx := context.Background()
+	other := NewMotorService(MotorDeps{Queue: svc.queue, State: svc.state, Publisher: &fakePublisher{}, Repo: repo, Clock: clock, Quota: time.Hour}) // Another replica
+	require.NoError(t, svc.Enqueue(ctx, 1, time.Minute))
+
+	handled, dropped, err := svc.EmergencyStop(ctx, EStopReleased)
+	require.NoError(t, err)
+	assert.False(t, handled)
+	handled, dropped, err = svc.EmergencyStop(ctx, EStopPressed)
+	require.NoError(t, err)
+	assert.True(t, handled)
+	assert.Equal(t, 1, dropped)
+	assert.Equal(t, []string{CommandOff}, pub.sent())
+	handled, _, err = other.EmergencyStop(ctx, EStopPressed) // The same press, seen by the other replica
+	require.NoError(t, err)
+	assert.False(t, handled)
+
+	var sdErr *ShutdownError
+	require.True(t, errors.As(svc.Enqueue(ctx, 1, time.Minute), &sdErr))
+	assert.Equal(t, ShutdownSafety, sdErr.Category)
+	assert.Equal(t, EStopReason, sdErr.Reason)
+	assert.True(t, repo.shutdown.Active)
+	_, _, err = svc.EmergencyStop(ctx, EStopReleased)
+	require.NoError(t, err)
+	clock.advance(24 * time.Hour)
+	_, expired, err := svc.ExpireShutdown(ctx)
+	require.NoError(t, err)
+	assert.False(t, expired) // Only an admin restart ends it
+	assert.NoError(t, svc.Restart(ctx))
+}
+
+// TestRequestRestart checks that a restart needs two different admins when approval is on
+func TestRequestRestart(t *testing.T) {
+	svc, _, _, _ := newTestService()
+	ctx := context.Background()
+	_, err := svc.RequestRestart(ctx, 1)
+	assert.ErrorIs(t, err, ErrNotShutDown)
+
+	_, err = svc.ForceShutdown(ctx, ShutdownWeather, "flooding", time.Time{})
+	require.NoError(t, err)
+	approval, err := svc.RequestRestart(ctx, 1) // Off by default: one admin restarts
+	require.NoError(t, err)
+	assert.True(t, approval.Restarted)
+
+	svc.restartApproval = 10 * time.Minute
+	_, err = svc.ForceShutdown(ctx, ShutdownWeather, "flooding", time.Time{})
+	require.NoError(t, err)
+	approval, err = svc.RequestRestart(ctx, 1)
+	require.NoError(t, err)
+	assert.False(t, approval.Restarted)
+	_, err = svc.RequestRestart(ctx, 1)
+	assert.ErrorIs(t, err, ErrSecondApprover)
+	var sdErr *ShutdownError
+	require.True(t, errors.As(svc.Enqueue(ctx, 1, time.Minute), &sdErr)) // Still shut down
+
+	approval, err = svc.RequestRestart(ctx, 2)
+	require.NoError(t, err)
+	assert.True(t, approval.Restarted)
+	assert.Equal(t, uint(1), approval.FirstBy)
+	assert.NoError(t, svc.Enqueue(ctx, 1, time.Minute))
+
+	_, err = svc.ForceShutdown(ctx, ShutdownSafety, "again", time.Time{}) // Approvals don't carry over to the next shutdown
+	require.NoError(t, err)
+	approval, err = svc.RequestRestart(ctx, 2)
+	require.NoError(t, err)
+	assert.False(t, approval.Restarted)
+}
+
+// TestMotorStates checks the transitions of the motor state machine
+func TestMotorStates(t *testing.T) {
+	m := newMotorStates(true)
+	now := time.Now()
+	apply := func(input string) (MotorStateInfo, error) { return m.apply("farm/pump-1", input, "", now) }
+
+	assert.Equal(t, MotorOff, m.get("farm/pump-1").State) // Never seen
+	st, err := apply(CommandOn)
+	require.NoError(t, err)
+	assert.Equal(t, MotorStarting, st.State)
+	var terr *TransitionError
+	require.True(t, errors.As(m.check("farm/pump-1", CommandOn), &terr)) // Already starting
+	assert.Equal(t, MotorStarting, terr.State)
+	st, _ = apply(AckOn)
+	assert.Equal(t, MotorRunning, st.State)
+	st, _ = apply(CommandOff)
+	assert.Equal(t, MotorStopping, st.State)
+	st, _ = apply(AckOff)
+	assert.Equal(t, MotorOff, st.State)
+
+	st, err = apply(AckOn) // Running without being told to
+	require.NoError(t, err)
+	assert.Equal(t, MotorFault, st.State)
+	assert.Equal(t, "device reported on while OFF", st.Reason)
+	assert.Error(t, m.check("farm/pump-1", CommandOn))
+	assert.NoError(t, m.check("farm/pump-1", CommandOff)) // OFF is always allowed
+	st, _ = m.apply("farm/pump-1", AckFault, "overheated", now)
+	assert.Equal(t, "device reported on while OFF", st.Reason) // The first reason is kept
+	st, err = apply(ClearFault)
+	require.NoError(t, err)
+	assert.Equal(t, MotorOff, st.State)
+	_, err = apply(ClearFault)
+	assert.True(t, errors.As(err, &terr))
+
+	st, _ = newMotorStates(false).apply(SharedMotor, CommandOn, "", now) // Devices that don't confirm
+	assert.Equal(t, MotorRunning, st.State)
+
+	for payload, want := range map[string][2]string{"on": {AckOn, ""}, " OFF\n": {AckOff, ""}, "fault: overcurrent": {AckFault, "overcurrent"}, "42": {"", ""}} {
+		input, detail := ParseAck([]byte(payload))
+		assert.Equal(t, want, [2]string{input, detail}, payload)
+	}
+}
+
+// TestRunWaitsForAcks checks that the processor waits for the motor to confirm commands,
+// ends a session when the motor faults and holds the queue until the fault is cleared
+func TestRunWaitsForAcks(t *testing.T) {
+	svc, pub, clock, _ := newTestService()
+	svc.states, svc.ackWait = newMotorStates(true), time.Minute
+	events := make(chan SessionEvent, 8)
+	svc.onSession = func(ev SessionEvent) { events <- ev }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, svc.Enqueue(ctx, 1, 10*time.Minute))
+	require.NoError(t, svc.Enqueue(ctx, 2, 10*time.Minute))
+	go svc.Run(ctx, func() {})
+
+	assert.Equal(t, SessionStarted, (<-events).Kind)
+	assert.Equal(t, MotorStarting, svc.MotorState(SharedMotor).State)
+	_, err := svc.Ack(SharedMotor, []byte("on"))
+	require.NoError(t, err)
+	st, err := svc.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, MotorRunning, st.Motor.State)
+
+	clock.fire <- time.Now() // Session ends; the next one waits for OFF to be confirmed
+	assert.Equal(t, SessionFinished, (<-events).Kind)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"on", "off"}, pub.sent())
+	assert.Equal(t, MotorStopping, svc.MotorState(SharedMotor).State)
+	svc.Ack(SharedMotor, []byte("off"))
+	assert.Equal(t, SessionStarted, (<-events).Kind)
+
+	svc.Ack(SharedMotor, []byte("on"))
+	svc.Ack(SharedMotor, []byte("fault: overcurrent")) // Ends the session
+	ev := <-events
+	assert.Equal(t, SessionInterrupted, ev.Kind)
+	assert.Equal(t, "motor fault: overcurrent", ev.Reason)
+	assert.Equal(t, []string{"on", "off", "on", "off"}, pub.sent())
+
+	require.NoError(t, svc.Enqueue(ctx, 1, 10*time.Minute)) // Held until the fault is cleared
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, pub.sent(), 4)
+	require.NoError(t, svc.ClearFault(SharedMotor))
+	assert.Equal(t, SessionStarted, (<-events).Kind)
+
+	clock.advance(2 * time.Minute) // ON never confirmed
+	ev = <-events
+	assert.Equal(t, SessionInterrupted, ev.Kind)
+	assert.Equal(t, "motor fault: device did not confirm ON", ev.Reason)
+	assert.Equal(t, MotorFault, svc.MotorState(SharedMotor).State)
+	assert.Equal(t, []string{"on", "off", "on", "off", "on", "off"}, pub.sent())
+}
+
+// TestRunDryRun checks that a simulated session runs through acks and is logged without publishing
+func TestRunDryRun(t *testing.T) {
+	svc, pub, clock, repo := newTestService()
+	svc.states, svc.ackWait = newMotorStates(true), time.Minute
+	svc.sim = newSimulator(svc.states, clock, time.Minute)
+	svc.sim.delay = 10 * time.Millisecond
+	events := make(chan SessionEvent, 8)
+	svc.onSession = func(ev SessionEvent) { events <- ev }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, svc.EnqueueDryRun(ctx, 1, 10*time.Minute))
+	require.NoError(t, svc.Enqueue(ctx, 2, 10*time.Minute))
+	go svc.Run(ctx, func() {})
+
+	ev := <-events
+	assert.Equal(t, SessionStarted, ev.Kind)
+	assert.True(t, ev.Request.Simulate)
+	assert.Eventually(t, func() bool { return svc.MotorState(SharedMotor).State == MotorRunning }, time.Second, 5*time.Millisecond) // Confirmed by the simulator
+	clock.fire <- time.Now()
+	assert.Equal(t, SessionFinished, (<-events).Kind)
+	assert.Equal(t, SessionStarted, (<-events).Kind) // OFF confirmed by the simulator too
+	assert.Equal(t, []string{"on"}, pub.sent())      // Only the real session reached the publisher
+	require.NotEmpty(t, repo.sessions)
+	assert.True(t, repo.sessions[0].Simulated)
+	assert.True(t, repo.activations[0].Simulated)
+	assert.False(t, repo.activations[1].Simulated)
+}
+
+// TestCommandWatchdog checks that unconfirmed commands are failed and a failed ON is followed by OFF
+func TestCommandWatchdog(t *testing.T) {
+	svc, pub, clock, _ := newTestService()
+	svc.states, svc.ackWait, svc.correctiveOff = newMotorStates(true), 30*time.Second, true
+	var faults []string
+	svc.states.onFault = func(motor string, st MotorStateInfo) { faults = append(faults, motor+": "+st.Reason) }
+
+	svc.Commanded("farm/pump-1", CommandOn)
+	svc.Commanded("farm/pump-2", CommandOn)
+	clock.advance(10 * time.Second)
+	svc.Ack("farm/pump-2", []byte("on"))
+	pending := svc.PendingCommands()
+	require.Len(t, pending, 1)
+	assert.Equal(t, "farm/pump-1", pending[0].Motor)
+	assert.False(t, pending[0].Overdue)
+	assert.Empty(t, svc.CheckCommands(context.Background()))
+
+	clock.advance(30 * time.Second)
+	assert.True(t, svc.PendingCommands()[0].Overdue)
+	failed := svc.CheckCommands(context.Background())
+	require.Len(t, failed, 1)
+	assert.Equal(t, CommandOn, failed[0].Command)
+	assert.Equal(t, MotorFault, svc.MotorState("farm/pump-1").State)
+	assert.Equal(t, []string{"farm/pump-1: device did not confirm ON (watchdog)"}, faults)
+	assert.Equal(t, []string{"off"}, pub.sent()) // Corrective OFF
+	assert.Empty(t, svc.PendingCommands())
+	assert.Equal(t, MotorRunning, svc.MotorState("farm/pump-2").State)
+}
+
+// TestSequencedCommands checks that commands carry growing sequence numbers and that
+// replayed or duplicated acks are ignored
+func TestSequencedCommands(t *testing.T) {
+	svc, pub, _, _ := newTestService()
+	svc.states, svc.ackWait, svc.sequence = newMotorStates(true), time.Minute, true
+	ctx := context.Background()
+
+	payload, err := svc.CommandPayload(ctx, "farm/pump-1", CommandOn)
+	require.NoError(t, err)
+	cmd, first := ParseCommand(payload)
+	assert.Equal(t, CommandOn, cmd)
+	assert.Positive(t, first)
+	svc.Commanded("farm/pump-1", CommandOn)
+	st, err := svc.Ack("farm/pump-1", []byte(fmt.Sprintf(`{"state":"on","seq":%d}`, first)))
+	require.NoError(t, err)
+	assert.Equal(t, MotorRunning, st.State)
+	assert.Equal(t, first, st.AckSeq)
+
+	svc.StopMotor(ctx, "farm/pump-1")
+	require.Len(t, pub.sent(), 1)
+	cmd, second := ParseCommand(pub.sent()[0])
+	assert.Equal(t, CommandOff, cmd)
+	assert.Greater(t, second, first)
+
+	var stale *StaleAckError
+	_, err = svc.Ack("farm/pump-1", []byte(fmt.Sprintf(`{"state":"on","seq":%d}`, first))) // Replayed
+	assert.True(t, errors.As(err, &stale))
+	assert.Equal(t, MotorStopping, svc.MotorState("farm/pump-1").State)
+	st, err = svc.Ack("farm/pump-1", []byte(fmt.Sprintf(`{"state":"off","seq":%d}`, second)))
+	require.NoError(t, err)
+	assert.Equal(t, MotorOff, st.State)
+	_, err = svc.Ack("farm/pump-1", []byte(fmt.Sprintf(`{"state":"off","seq":%d}`, second))) // Duplicate
+	assert.True(t, errors.As(err, &stale))
+
+	input, detail, seq, req := parseAck([]byte(`{"state":"fault","detail":"dry run","seq":7,"req":"abc"}`))
+	assert.Equal(t, [4]any{AckFault, "dry run", uint64(7), "abc"}, [4]any{input, detail, seq, req})
+	cmd, seq = ParseCommand("off") // Unsequenced
+	assert.Equal(t, CommandOff, cmd)
+	assert.Zero(t, seq)
+}
+
+// TestCommandRequestID checks that commands sent for an API call carry its request ID,
+// and that the motor's state remembers it until a command without one
+func TestCommandRequestID(t *testing.T) {
+	svc, pub, _, _ := newTestService()
+	svc.states, svc.ackWait, svc.sequence = newMotorStates(true), time.Minute, true
+	ctx := WithRequestID(context.Background(), "req-42")
+	assert.Equal(t, "req-42", RequestID(ctx))
+	assert.Empty(t, RequestID(context.Background()))
+
+	payload, err := svc.CommandPayload(ctx, "farm/pump-1", CommandOn)
+	require.NoError(t, err)
+	var sent SequencedCommand
+	require.NoError(t, json.Unmarshal([]byte(payload.(string)), &sent))
+	assert.Equal(t, "req-42", sent.Req)
+	svc.Commanded("farm/pump-1", CommandOn)
+	st, err := svc.Ack("farm/pump-1", []byte(fmt.Sprintf(`{"state":"on","seq":%d}`, sent.Seq))) // Firmware that doesn't echo it
+	require.NoError(t, err)
+	assert.Equal(t, "req-42", st.Req)
+
+	svc.StopMotor(context.Background(), "farm/pump-1") // Nobody asked
+	sent = SequencedCommand{}
+	require.NoError(t, json.Unmarshal([]byte(pub.sent()[0]), &sent))
+	assert.Empty(t, sent.Req)
+	assert.Empty(t, svc.MotorState("farm/pump-1").Req)
+
+	svc.sequence = false // Bare commands stay bare
+	payload, err = svc.CommandPayload(ctx, "farm/pump-1", CommandOff)
+	require.NoError(t, err)
+	assert.Equal(t, CommandOff, payload)
+	assert.Equal(t, "req-42", svc.MotorState("farm/pump-1").Req)
+}
+
+// TestRunPowerOutage checks that a run whose device restarts or goes quiet is cancelled
+// with a refund, or resumed for the rest of its time under the resume policy
+func TestRunPowerOutage(t *testing.T) {
+	svc, pub, clock, repo := newTestService()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- svc.Run(ctx, func() {}) }()
+
+	require.NoError(t, svc.Enqueue(ctx, 1, 10*time.Minute)) // Cancelled when the device boots
+	require.Eventually(t, func() bool { return len(pub.sent()) == 1 }, time.Second, 5*time.Millisecond)
+	clock.advance(4 * time.Minute)
+	_, err := svc.Ack(SharedMotor, []byte("boot"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(pub.sent()) == 2 }, time.Second, 5*time.Millisecond)
+	st, err := svc.Status(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 4*time.Minute, st.Used) // The other 6 minutes were refunded
+
+	svc.outagePolicy = OutageResume
+	require.NoError(t, svc.Enqueue(ctx, 2, 10*time.Minute)) // Resumed after the boot
+	require.Eventually(t, func() bool { return len(pub.sent()) == 3 }, time.Second, 5*time.Millisecond)
+	clock.advance(2 * time.Minute)
+	svc.Ack(SharedMotor, []byte(`{"state":"boot"}`))
+	require.Eventually(t, func() bool { return len(pub.sent()) == 4 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, MotorRunning, svc.MotorState(SharedMotor).State)
+	clock.fire <- time.Now() // The rest of the run ends
+	require.Eventually(t, func() bool { return len(pub.sent()) == 5 }, time.Second, 5*time.Millisecond)
+
+	svc.outagePolicy, svc.heartbeatTimeout = OutageCancel, time.Minute
+	require.NoError(t, svc.Enqueue(ctx, 3, 10*time.Minute)) // Cancelled when heartbeats stop
+	require.Eventually(t, func() bool { return len(pub.sent()) == 6 }, time.Second, 5*time.Millisecond)
+	clock.advance(30 * time.Second)
+	svc.Ack(SharedMotor, []byte("alive"))
+	clock.advance(2 * time.Minute)
+	require.Eventually(t, func() bool { return len(pub.sent()) == 7 }, time.Second, 5*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	assert.Equal(t, []string{"on", "off", "on", "on", "off", "on", "off"}, pub.sent())
+	require.Len(t, repo.sessions, 3)
+	assert.Equal(t, models.SessionLog{UserID: 1, Outcome: SessionPowerLost, Requested: 10 * time.Minute, Ran: 4 * time.Minute, Reason: "device restarted; 6 min refunded", Outages: 1}, withoutTime(repo.sessions[0]))
+	assert.Equal(t, models.SessionLog{UserID: 2, Outcome: SessionFinished, Requested: 10 * time.Minute, Ran: 10 * time.Minute, Reason: "resumed after 1 power outage(s)", Outages: 1}, withoutTime(repo.sessions[1]))
+	assert.Equal(t, models.SessionLog{UserID: 3, Outcome: SessionPowerLost, Requested: 10 * time.Minute, Ran: 30 * time.Second, Reason: "no heartbeat for 2m0s; 9 min refunded", Outages: 1}, withoutTime(repo.sessions[2]))
+}
+
+func withoutTime(l models.SessionLog) models.SessionLog {
+	l.EndedAt, l.QueueID = time.Time{}, ""
+	return l
+} // What varies from run to run
+
+// TestRecoverSession checks that a run left behind by a crash is switched off by default,
+// and finished by Run under the resume policy
+func TestRecoverSession(t *testing.T) {
+	svc, pub, clock, repo := newTestService()
+	ctx := context.Background()
+	run, err := svc.RecoverSession(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, run) // Clean start
+
+	started := clock.Now().Add(-4 * time.Minute)
+	repo.running = models.RunningSession{ID: 1, Motor: SharedMotor, UserID: 1, Duration: 10 * time.Minute, StartedAt: started, PartSince: started}
+	run, err = svc.RecoverSession(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, run)
+	assert.False(t, run.Resumed)
+	assert.Equal(t, "backend restarted mid-run", run.Reason)
+	assert.Equal(t, []string{"off"}, pub.sent())
+	assert.Zero(t, repo.running.ID)
+	require.Len(t, repo.sessions, 1)
+	assert.Equal(t, SessionInterrupted, repo.sessions[0].Outcome)
+	assert.Equal(t, 4*time.Minute, repo.sessions[0].Ran)
+
+	svc.crashPolicy = CrashResume
+	repo.running = models.RunningSession{ID: 1, Motor: SharedMotor, UserID: 2, Duration: 10 * time.Minute, StartedAt: started, PartSince: started.Add(time.Minute), Ran: time.Minute, Outages: 1}
+	run, err = svc.RecoverSession(ctx)
+	require.NoError(t, err)
+	assert.True(t, run.Resumed)
+	assert.Equal(t, 6*time.Minute, run.Remaining)
+	assert.Equal(t, []string{"off", "on"}, pub.sent())
+	l, err := svc.Interlock(ctx, SharedMotor)
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), l.UserID)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- svc.Run(runCtx, func() {}) }()
+	clock.fire <- time.Now() // The 6 minutes left are up
+	require.Eventually(t, func() bool { return len(pub.sent()) == 3 }, time.Second, 5*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	assert.Zero(t, repo.running.ID)
+	require.Len(t, repo.sessions, 2)
+	assert.Equal(t, models.SessionLog{UserID: 2, Outcome: SessionFinished, Requested: 10 * time.Minute, Ran: 10 * time.Minute, Reason: "resumed after 1 power outage(s)", Outages: 1}, withoutTime(repo.sessions[1]))
+
+	repo.running = models.RunningSession{ID: 1, Motor: SharedMotor, UserID: 3, Duration: 2 * time.Minute, StartedAt: started, PartSince: started}
+	run, err = svc.RecoverSession(ctx) // Should have ended already
+	require.NoError(t, err)
+	assert.False(t, run.Resumed)
+	assert.Equal(t, "backend restarted after the run should have ended", run.Reason)
+	assert.Equal(t, 2*time.Minute, repo.sessions[2].Ran)
+}
+
+// TestRunInterlock checks that the queue waits while another session holds the motor and
+// that a device can only have one manual session
+func TestRunInterlock(t *testing.T) {
+	svc, pub, clock, _ := newTestService()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, svc.LockMotor(ctx, SharedMotor, 9)) // E.g. a session on a replica that lost leadership
+	require.NoError(t, svc.Enqueue(ctx, 1, 10*time.Minute))
+	go svc.Run(ctx, func() {})
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, pub.sent())
+	st, err := svc.Status(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, st.Interlock)
+	assert.Equal(t, InterlockManual, st.Interlock.Source)
+	assert.Equal(t, uint(9), st.Interlock.UserID)
+	assert.True(t, clock.Now().Equal(st.Interlock.Since))
+
+	svc.UnlockMotor(ctx, SharedMotor)
+	require.Eventually(t, func() bool { return len(pub.sent()) == 1 }, time.Second, 5*time.Millisecond)
+	st, _ = svc.Status(ctx)
+	require.NotNil(t, st.Interlock)
+	assert.Equal(t, InterlockQueue, st.Interlock.Source)
+	var ierr *InterlockError
+	require.True(t, errors.As(svc.LockMotor(ctx, SharedMotor, 9), &ierr))
+	assert.Equal(t, uint(1), ierr.Holder.UserID)
+
+	clock.fire <- time.Now() // Session ends and releases the motor
+	require.Eventually(t, func() bool { return len(pub.sent()) == 2 }, time.Second, 5*time.Millisecond)
+	require.Eventually(t, func() bool { st, _ = svc.Status(ctx); return st.Interlock == nil }, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, svc.LockMotor(ctx, "farm/pump-1", 2))
+	clock.advance(time.Second)
+	assert.True(t, errors.As(svc.LockMotor(ctx, "farm/pump-1", 2), &ierr), "a second ON by the same user is refused too")
+	svc.Commanded("farm/pump-1", CommandOn)
+	assert.Contains(t, svc.Interlocks(ctx), "farm/pump-1")
+	svc.UnlockMotor(ctx, "farm/pump-1")
+	assert.NoError(t, svc.LockMotor(ctx, "farm/pump-1", 3))
+}
+
+// TestRunSafetyCutoff checks that a run is forced OFF after MaxRuntime whatever was requested
+func TestRunSafetyCutoff(t *testing.T) {
+	svc, pub, clock, repo := newTestService()
+	svc.maxRuntime = 30 * time.Minute
+	events := make(chan SessionEvent, 4)
+	svc.onSession = func(ev SessionEvent) { events <- ev }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, svc.Enqueue(ctx, 1, 45*time.Minute))
+	go svc.Run(ctx, func() {})
+
+	assert.Equal(t, SessionStarted, (<-events).Kind)
+	clock.advance(30 * time.Minute)
+	ev := <-events
+	assert.Equal(t, SessionSafetyStopped, ev.Kind)
+	assert.Equal(t, "safety cutoff: ran 30m0s continuously", ev.Reason)
+	assert.Equal(t, 30*time.Minute, ev.Ran)
+	assert.Equal(t, []string{"on", "off"}, pub.sent())
+	assert.Equal(t, SessionSafetyStopped, repo.sessions[0].Outcome)
+
+	require.NoError(t, svc.LockMotor(ctx, "farm/pump-1", 2)) // Switched on through the API
+	l, err := svc.CutoffManual(ctx, "farm/pump-1", 30*time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, l) // Not yet
+	clock.advance(30 * time.Minute)
+	l, err = svc.CutoffManual(ctx, "farm/pump-1", 30*time.Minute)
+	require.NoError(t, err)
+	require.NotNil(t, l)
+	assert.Equal(t, uint(2), l.UserID)
+	assert.Equal(t, "off", pub.sent()[2])
+	l, _ = svc.Interlock(ctx, "farm/pump-1")
+	assert.Nil(t, l)
+}
+
+// TestTrip checks that a safety trip ends the running session and reports the fault once
+func TestTrip(t *testing.T) {
+	svc, pub, _, _ := newTestService()
+	var faults []string
+	svc.states.onFault = func(motor string, st MotorStateInfo) { faults = append(faults, motor+": "+st.Reason) }
+	events := make(chan SessionEvent, 4)
+	svc.onSession = func(ev SessionEvent) { events <- ev }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, svc.Enqueue(ctx, 1, 10*time.Minute))
+	go svc.Run(ctx, func() {})
+
+	assert.Equal(t, SessionStarted, (<-events).Kind)
+	assert.True(t, svc.Trip(ctx, SharedMotor, "motor_temperature 95 over the 80 limit"))
+	ev := <-events
+	assert.Equal(t, SessionInterrupted, ev.Kind)
+	assert.Equal(t, "motor fault: motor_temperature 95 over the 80 limit", ev.Reason)
+	assert.False(t, svc.Trip(ctx, SharedMotor, "motor_temperature 96 over the 80 limit")) // Already in FAULT
+	assert.Equal(t, []string{"motor: motor_temperature 95 over the 80 limit"}, faults)
+	assert.Equal(t, "off", pub.sent()[1])
+}
+
+// TestStopSession checks that an admin can stop a queued or manual session by its ID
+func TestStopSession(t *testing.T) {
+	svc, pub, clock, repo := newTestService()
+	events := make(chan SessionEvent, 4)
+	svc.onSession = func(ev SessionEvent) { events <- ev }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, svc.Enqueue(ctx, 1, 30*time.Minute))
+	go svc.Run(ctx, func() {})
+
+	assert.Equal(t, SessionStarted, (<-events).Kind)
+	_, _, err := svc.StopSession(ctx, "nope", "left running")
+	assert.ErrorIs(t, err, ErrNoSession)
+	l := svc.Interlocks(ctx)[SharedMotor]
+	require.NotEmpty(t, l.ID)
+	clock.advance(10 * time.Minute)
+	motor, stopped, err := svc.StopSession(ctx, l.ID, "left running")
+	require.NoError(t, err)
+	assert.Equal(t, SharedMotor, motor)
+	assert.Equal(t, uint(1), stopped.UserID)
+	ev := <-events
+	assert.Equal(t, SessionStopped, ev.Kind)
+	assert.Equal(t, "left running", ev.Reason)
+	assert.Equal(t, 10*time.Minute, ev.Ran)
+	assert.Equal(t, SessionStopped, repo.sessions[0].Outcome)
+	assert.Equal(t, "off", pub.sent()[1])
+
+	require.NoError(t, svc.LockMotor(ctx, "farm/pump-1", 2)) // Switched on through the API
+	svc.Commanded("farm/pump-1", CommandOn)
+	l = svc.Interlocks(ctx)["farm/pump-1"]
+	motor, stopped, err = svc.StopSession(ctx, l.ID, "south pump left running")
+	require.NoError(t, err)
+	assert.Equal(t, "farm/pump-1", motor)
+	assert.Equal(t, InterlockManual, stopped.Source)
+	sent := pub.sent()
+	assert.Equal(t, "off", sent[len(sent)-1])
+	held, _ := svc.Interlock(ctx, "farm/pump-1")
+	assert.Nil(t, held)
+}
+
+// TestStopRun checks that only its owner, or an admin, can stop the queue's running
+// session and that it records what ran
+func TestStopRun(t *testing.T) {
+	svc, pub, clock, repo := newTestService()
+	events := make(chan SessionEvent, 4)
+	svc.onSession = func(ev SessionEvent) { events <- ev }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := svc.StopRun(ctx, 1, true, "")
+	assert.ErrorIs(t, err, ErrNoSession) // Nothing running
+	require.NoError(t, svc.Enqueue(ctx, 1, 30*time.Minute))
+	require.NoError(t, svc.Enqueue(ctx, 2, 10*time.Minute))
+	go svc.Run(ctx, func() {})
+
+	assert.Equal(t, SessionStarted, (<-events).Kind)
+	_, err = svc.StopRun(ctx, 2, false, "")
+	assert.ErrorIs(t, err, ErrNoSession) // Not theirs
+	clock.advance(12 * time.Minute)
+	stopped, err := svc.StopRun(ctx, 1, false, "ignored")
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), stopped.UserID)
+	ev := <-events
+	assert.Equal(t, SessionStopped, ev.Kind)
+	assert.Equal(t, OwnerStopReason, ev.Reason)
+	assert.Equal(t, 12*time.Minute, ev.Ran)
+	assert.Equal(t, 12*time.Minute, repo.sessions[0].Ran) // The rest is given back
+
+	ev = <-events // The next request runs
+	assert.Equal(t, SessionStarted, ev.Kind)
+	_, err = svc.StopRun(ctx, 1, true, "pump needs checking") // An admin stopping someone else's
+	require.NoError(t, err)
+	ev = <-events
+	assert.Equal(t, SessionStopped, ev.Kind)
+	assert.Equal(t, "pump needs checking", ev.Reason)
+	sent := pub.sent()
+	assert.Equal(t, "off", sent[len(sent)-1])
+}
+
+// TestVerifiedOff checks that OFF is resent until the motor confirms it and faulted when it never does
+func TestVerifiedOff(t *testing.T) {
+	svc, pub, clock, _ := newTestService()
+	svc.states, svc.ackWait, svc.offRetry = newMotorStates(true), time.Minute, 5*time.Millisecond
+	faults := make(chan string, 2)
+	svc.states.onFault = func(motor string, st MotorStateInfo) { faults <- motor + ": " + st.Reason }
+	offs := func() int {
+		n := 0
+		for _, p := range pub.sent() {
+			if p == "off" {
+				n++
+			}
+		}
+		return n
+	}
+
+	svc.Commanded(SharedMotor, CommandOn)
+	svc.Ack(SharedMotor, []byte("on"))
+	svc.switchOff()
+	require.Eventually(t, func() bool { return offs() >= 3 }, time.Second, 5*time.Millisecond) // Resent while unconfirmed
+	svc.Ack(SharedMotor, []byte("off"))
+	time.Sleep(20 * time.Millisecond)
+	n := offs()
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, n, offs(), "no more resends once confirmed")
+	assert.Equal(t, MotorOff, svc.MotorState(SharedMotor).State)
+
+	svc.Commanded("farm/pump-1", CommandOn)
+	svc.Ack("farm/pump-1", []byte("on"))
+	svc.stopVerified("farm/pump-1", "farm/pump-1/motor/control")
+	clock.advance(2 * time.Minute) // Never confirmed
+	assert.Contains(t, <-faults, "farm/pump-1: device did not confirm OFF after")
+	assert.Equal(t, MotorFault, svc.MotorState("farm/pump-1").State)
+}
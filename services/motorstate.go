@@ -0,0 +1,274 @@
+// motorstate.go - Motor state machine: OFF, STARTING, RUNNING, STOPPING and FAULT per device
+//
+// Commands the backend sends and acknowledgements devices publish on the status topic
+// move a motor between states. Commands that make no sense in the current state (ON
+// while a run is in progress, anything but OFF during a fault) are refused, and
+// acknowledgements nobody asked for put the motor in FAULT.
+
+package services // Declares the package name
+
+import ( // Import required packages
+	"encoding/json" // Sequenced acks
+	"fmt"           // For error formatting
+	"strings"       // Ack payloads
+	"sync"          // For mutex (thread safety)
+	"time"          // State times
+)
+
+const ( // Motor states
+	MotorOff      = "OFF"      // Stopped and confirmed
+	MotorStarting = "STARTING" // ON sent, waiting for the device to confirm
+	MotorRunning  = "RUNNING"  // Running and confirmed
+	MotorStopping = "STOPPING" // OFF sent, waiting for the device to confirm
+	MotorFault    = "FAULT"    // Something is wrong; only OFF is sent until an admin clears it
+)
+
+const ( // Inputs of the state machine
+	CommandOn  = "on"      // ON command published
+	CommandOff = "off"     // OFF command published
+	AckOn      = "ack_on"  // Device reports it is running
+	AckOff     = "ack_off" // Device reports it is stopped
+	AckFault   = "fault"   // Device reports a fault
+	AckBoot    = "boot"    // Device restarted, e.g. after a power cut; its motor is off
+	Heartbeat  = "alive"   // Device is up; changes no state
+	ClearFault = "clear"   // Admin cleared a fault
+)
+
+const MotorStatusTopic = "motor/status" // Topic devices report "on", "off", "fault[: detail]", "boot" or "alive" on
+
+const SharedMotor = "motor" // State key of the shared motor driven by the queue (tenant devices use "{org}/{device}")
+
+// motorTransitions lists the valid inputs of each state. OFF is valid everywhere, so
+// the motor can always be told to stop.
+var motorTransitions = map[string]map[string]string{
+	MotorOff:      {CommandOn: MotorStarting, CommandOff: MotorOff, AckOff: MotorOff, AckFault: MotorFault, AckBoot: MotorOff},
+	MotorStarting: {AckOn: MotorRunning, CommandOff: MotorStopping, AckOff: MotorOff, AckFault: MotorFault, AckBoot: MotorOff},
+	MotorRunning:  {AckOn: MotorRunning, CommandOff: MotorStopping, AckOff: MotorOff, AckFault: MotorFault, AckBoot: MotorOff},
+	MotorStopping: {AckOff: MotorOff, CommandOff: MotorStopping, AckFault: MotorFault, AckBoot: MotorOff},
+	MotorFault:    {CommandOff: MotorFault, AckOff: MotorFault, AckFault: MotorFault, AckBoot: MotorFault, ClearFault: MotorOff},
+}
+
+type MotorStateInfo struct { // A device's motor state
+	State  string    `json:"state"`
+	Since  time.Time `json:"since"`                // When it entered the state
+	Reason string    `json:"reason,omitempty"`     // Why it is in FAULT
+	AckSeq uint64    `json:"ack_seq,omitempty"`    // Sequence number of the last report, with sequenced commands
+	Req    string    `json:"request_id,omitempty"` // Request ID of the API call behind the last command, if any
+}
+
+type TransitionError struct { // Returned for a command the motor's state doesn't allow
+	Device string
+	State  string
+	Input  string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("motor %s is %s; %q is not allowed", e.Device, e.State, e.Input)
+}
+
+// ParseAck turns a status payload into a state machine input: "on", "off" or "fault",
+// optionally followed by ": detail", "boot" or "alive". It returns "" for anything else.
+func ParseAck(payload []byte) (input, detail string) {
+	input, detail, _, _ = parseAck(payload)
+	return input, detail
+}
+
+// parseAck is ParseAck that also accepts {"state":"on","detail":"...","seq":N,"req":"..."},
+// the report of devices that sequence commands, and returns its seq (0 if none) and the
+// request ID it echoes ("" if none).
+func parseAck(payload []byte) (input, detail string, seq uint64, req string) {
+	text := strings.TrimSpace(string(payload))
+	if strings.HasPrefix(text, "{") {
+		var report struct {
+			State  string `json:"state"`
+			Detail string `json:"detail"`
+			Seq    uint64 `json:"seq"`
+			Req    string `json:"req"`
+		}
+		if json.Unmarshal(payload, &report) != nil {
+			return "", "", 0, ""
+		}
+		text, seq, req = report.State, report.Seq, report.Req
+		if report.Detail != "" {
+			text += ":" + report.Detail
+		}
+	}
+	word, detail, _ := strings.Cut(text, ":")
+	switch strings.ToLower(strings.TrimSpace(word)) {
+	case "on":
+		return AckOn, "", seq, req
+	case "off":
+		return AckOff, "", seq, req
+	case "fault":
+		return AckFault, strings.TrimSpace(detail), seq, req
+	case "boot":
+		return AckBoot, "", seq, req
+	case "alive":
+		return Heartbeat, "", seq, req
+	}
+	return "", "", 0, ""
+}
+
+type motorStates struct { // State of every motor the backend has commanded or heard from
+	mu      sync.Mutex
+	devices map[string]MotorStateInfo
+	acked   map[string]uint64                      // Last acknowledged sequence number by device
+	reqs    map[string]string                      // Request ID of the last command by device
+	heard   map[string]time.Time                   // Last status report by device
+	booted  map[string]time.Time                   // Last boot announcement by device
+	confirm bool                                   // Whether devices acknowledge commands; otherwise a command is assumed to take effect
+	wake    chan struct{}                          // Signalled on every change, for the queue processor
+	onFault func(device string, st MotorStateInfo) // Called outside the lock when a motor goes into FAULT (optional)
+}
+
+func newMotorStates(confirm bool) *motorStates {
+	return &motorStates{devices: map[string]MotorStateInfo{}, acked: map[string]uint64{}, reqs: map[string]string{}, heard: map[string]time.Time{}, booted: map[string]time.Time{}, confirm: confirm, wake: make(chan struct{}, 1)}
+}
+
+func (m *motorStates) get(device string) MotorStateInfo { // Devices never seen are OFF
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.getLocked(device)
+}
+
+func (m *motorStates) getLocked(device string) MotorStateInfo {
+	st, ok := m.devices[device]
+	if !ok {
+		st = MotorStateInfo{State: MotorOff}
+	}
+	st.AckSeq, st.Req = m.acked[device], m.reqs[device]
+	return st
+}
+
+func (m *motorStates) all() map[string]MotorStateInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]MotorStateInfo, len(m.devices))
+	for k := range m.devices {
+		out[k] = m.getLocked(k)
+	}
+	return out
+}
+
+// acknowledge records seq as device's last acknowledged sequence number. It returns a
+// *StaleAckError, and records nothing, unless seq is larger than the last one.
+func (m *motorStates) acknowledge(device string, seq uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if last := m.acked[device]; seq <= last {
+		return &StaleAckError{Device: device, Seq: seq, Last: last}
+	}
+	m.acked[device] = seq
+	return nil
+}
+
+// requested records req as the request ID of the last command to device ("" for one no
+// API call caused).
+func (m *motorStates) requested(device, req string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if req == "" {
+		delete(m.reqs, device)
+	} else {
+		m.reqs[device] = req
+	}
+}
+
+// report records that device published a status report (input) at at.
+func (m *motorStates) report(device, input string, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.heard[device] = at
+	if input == AckBoot {
+		m.booted[device] = at
+	}
+}
+
+// lastReport returns when device last reported anything and last announced a boot
+// (zero if never).
+func (m *motorStates) lastReport(device string) (heard, booted time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.heard[device], m.booted[device]
+}
+
+// check reports whether command is allowed for device now, without applying it.
+func (m *motorStates) check(device, command string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.getLocked(device)
+	if _, ok := motorTransitions[st.State][command]; !ok {
+		return &TransitionError{Device: device, State: st.State, Input: command}
+	}
+	return nil
+}
+
+// apply feeds input to device's machine. Invalid commands and clears return a
+// *TransitionError and change nothing; unexpected acknowledgements move the motor to
+// FAULT, since the device is doing something it wasn't told to.
+func (m *motorStates) apply(device, input, reason string, at time.Time) (MotorStateInfo, error) {
+	st, changed, err := m.applyLocked(device, input, reason, at)
+	if changed && st.State == MotorFault && m.onFault != nil {
+		m.onFault(device, st)
+	}
+	return st, err
+}
+
+// faultIfUnchanged puts device in FAULT for reason if it is still in the state seen in
+// was (same state, same since), so an ack that arrives in between wins. It reports
+// whether the motor was faulted.
+func (m *motorStates) faultIfUnchanged(device string, was MotorStateInfo, reason string, at time.Time) bool {
+	m.mu.Lock()
+	st := m.getLocked(device)
+	if st.State != was.State || !st.Since.Equal(was.Since) || st.State == MotorFault {
+		m.mu.Unlock()
+		return false
+	}
+	st = MotorStateInfo{State: MotorFault, Since: at, Reason: reason, AckSeq: m.acked[device], Req: m.reqs[device]}
+	m.devices[device] = st
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+	m.mu.Unlock()
+	if m.onFault != nil {
+		m.onFault(device, st)
+	}
+	return true
+}
+
+func (m *motorStates) applyLocked(device, input, reason string, at time.Time) (MotorStateInfo, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.getLocked(device)
+	next, ok := motorTransitions[st.State][input]
+	switch {
+	case !ok && (input == AckOn || input == AckOff):
+		next, reason = MotorFault, fmt.Sprintf("device reported %s while %s", strings.TrimPrefix(input, "ack_"), st.State)
+	case !ok:
+		return st, false, &TransitionError{Device: device, State: st.State, Input: input}
+	case !m.confirm && next == MotorStarting: // Nobody will confirm
+		next = MotorRunning
+	case !m.confirm && next == MotorStopping:
+		next = MotorOff
+	}
+	if next == MotorFault && st.State == MotorFault {
+		return st, false, nil // Keep the first reason
+	}
+	if next == st.State {
+		return st, false, nil
+	}
+	if next == MotorFault && reason == "" {
+		reason = "device reported a fault"
+	}
+	if next != MotorFault {
+		reason = ""
+	}
+	st = MotorStateInfo{State: next, Since: at, Reason: reason, AckSeq: m.acked[device], Req: m.reqs[device]}
+	m.devices[device] = st
+	select {
+	case m.wake <- struct{}{}:
+	default: // Already signalled
+	}
+	return st, true, nil
+}
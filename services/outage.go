@@ -0,0 +1,136 @@
+// outage.go - Power outages in the middle of a queued run
+//
+// A device that loses power comes back with its motor off. The backend notices either
+// from the "boot" the device announces on its status topic when it starts, or, for
+// devices that publish "alive" regularly, from a heartbeat gap. The session then ends as
+// power_lost with the unused minutes given back to the quota, or, with the resume
+// policy, waits for the device to come back and runs the minutes that were left.
+
+package services // Declares the package name
+
+import ( // Import required packages
+	"context"               // For cancellation
+	"fmt"                   // Reasons
+	"go-mqtt-backend/store" // Queued requests
+	"log/slog"              // Leveled logging
+	"time"                  // Durations
+)
+
+const ( // What happens to a run when its device loses power
+	OutageCancel = "cancel" // End it and refund the unused time
+	OutageResume = "resume" // Switch the motor back on for the rest once the device is back
+)
+
+// outage reports whether the shared motor lost power since a run (or what's left of it)
+// started at since: why, and from when its runtime stops counting.
+func (s *MotorService) outage(since time.Time) (reason string, at time.Time) {
+	if s.publisherFor(SharedMotor) == Publisher(s.sim) { // The simulator neither boots nor sends heartbeats
+		return "", time.Time{}
+	}
+	heard, booted := s.states.lastReport(SharedMotor)
+	if booted.After(since) {
+		return "device restarted", booted
+	}
+	if s.heartbeatTimeout <= 0 {
+		return "", time.Time{}
+	}
+	if heard.Before(since) {
+		heard = since
+	}
+	if gap := s.clock.Now().Sub(heard); gap > s.heartbeatTimeout {
+		return fmt.Sprintf("no heartbeat for %s", gap.Round(time.Second)), heard
+	}
+	return "", time.Time{}
+}
+
+// runSession waits out run and returns how it ended, adding up its runtime and power
+// outages in run. After an outage the run is resumed if the policy says so; otherwise it
+// ends as SessionPowerLost and the time it didn't use is given back to the quota.
+func (s *MotorService) runSession(ctx context.Context, run *sessionRun, beat func()) (kind, reason string) {
+	req := run.req
+	for {
+		remaining := req.Duration - run.ran
+		kind, reason = s.wait(ctx, remaining, run.since, beat)
+		if kind != SessionPowerLost {
+			if kind == SessionFinished {
+				run.ran = req.Duration
+				if run.outages > 0 {
+					reason = fmt.Sprintf("resumed after %d power outage(s)", run.outages)
+				}
+			} else {
+				run.ran += s.clock.Now().Sub(run.since)
+			}
+			return kind, reason
+		}
+		_, lostAt := s.outage(run.since)
+		run.ran += max(lostAt.Sub(run.since), 0)
+		remaining = req.Duration - run.ran
+		run.outages++
+		slog.Warn("motor lost power mid-run", "user_id", req.UserID, "reason", reason, "ran", run.ran, "remaining", remaining)
+		if s.outagePolicy == OutageResume && remaining > 0 {
+			why := s.resume(ctx, req, run.startedAt, run.since, remaining, beat)
+			if ctx.Err() != nil {
+				return "", ""
+			}
+			if why == "" {
+				run.since = s.clock.Now()
+				s.saveRun(ctx, run)
+				continue
+			}
+			reason += "; not resumed: " + why
+		}
+		reason += fmt.Sprintf("; %d min refunded", int(remaining.Minutes())) // Only what ran counts against the quota
+		return SessionPowerLost, reason
+	}
+}
+
+// resume waits up to the resume window for the shared motor's device to be back and
+// switches the motor on again for remaining. since is when the part of the run that lost
+// power started. It returns why the run can't be resumed, "" once it is.
+func (s *MotorService) resume(ctx context.Context, req *store.MotorRequest, startedAt, since time.Time, remaining time.Duration, beat func()) string {
+	lost := s.clock.Now()
+	deadline := lost.Add(s.resumeWindow)
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		if heard, booted := s.states.lastReport(SharedMotor); heard.After(lost) || booted.After(since) {
+			break // Reporting again, or already up: a boot is the device coming back
+		}
+		if !s.clock.Now().Before(deadline) {
+			return fmt.Sprintf("device not back within %s", s.resumeWindow)
+		}
+		beat()
+		select {
+		case <-ctx.Done():
+			return "shutting down"
+		case <-s.states.wake:
+		case <-ticker.C:
+		}
+	}
+	if sd, err := s.state.GetShutdown(ctx); err != nil || sd.Active {
+		return "system is shut down"
+	}
+	if s.hold != nil {
+		if why := s.hold(ctx); why != "" {
+			return why
+		}
+	}
+	lock := Interlock{Source: InterlockQueue, UserID: req.UserID, Since: startedAt} // Same holder, so this renews the lease
+	if err := s.lockMotor(ctx, SharedMotor, lock, remaining+s.ackWait+interlockMargin); err != nil {
+		return err.Error()
+	}
+	switch st := s.states.get(SharedMotor); st.State {
+	case MotorRunning: // Only the network dropped out; the motor kept going
+	case MotorOff:
+		if _, err := s.states.apply(SharedMotor, CommandOn, "", s.clock.Now()); err != nil {
+			return err.Error()
+		}
+		if err := s.send(WithRequestID(ctx, req.RequestID), s.publisherFor(SharedMotor), SharedMotor, MotorTopic, CommandOn); err != nil {
+			slog.Error("motor ON publish failed", "error", err)
+		}
+	default:
+		return "motor is " + st.State
+	}
+	slog.Info("motor run resumed after power outage", "user_id", req.UserID, "remaining", remaining)
+	return ""
+}
@@ -0,0 +1,81 @@
+// position.go - Where a queued request stands and when it should run
+//
+// The motor works through the queue one run at a time, each taking about what was asked
+// for, so a request starts once the running session's time is up and the requests ahead
+// of it have had theirs. The estimate is no better than that: runs cut short, a hold or
+// a request jumping the queue with a higher priority all move it.
+
+package services // Declares the package name
+
+import ( // Import required packages
+	"context"               // For store calls
+	"fmt"                   // For error wrapping
+	"go-mqtt-backend/store" // Queued requests
+	"slices"                // Queue lookups
+	"time"                  // Estimates
+)
+
+type QueueEstimate struct { // Where a request stands, from Estimate
+	Request  store.MotorRequest
+	Running  bool          // The motor is on for it: Position is 0 and StartAt when it started
+	Position int           // 1-based place in the queue
+	Ahead    time.Duration // Runtime asked for by the requests ahead of it
+	Current  time.Duration // Left of the session running now (0: none, or the request's own)
+	StartAt  time.Time     // When it is expected to start
+	FinishAt time.Time     // When it is expected to finish
+	Held     string        // Why nothing is dispatched now ("" if it is); the estimate assumes that ends at once
+}
+
+// Estimate returns where the request id stands and when it should start and finish.
+// Only userID's requests are found, unless userID is 0 (admins); ErrNotQueued if it is
+// neither queued nor running.
+func (s *MotorService) Estimate(ctx context.Context, id string, userID uint) (QueueEstimate, error) {
+	mine := requestMatcher(id, userID)
+	now := s.clock.Now()
+	current, startedAt, left, err := s.runningRequest(ctx)
+	if err != nil {
+		return QueueEstimate{}, err
+	}
+	if mine(current) {
+		return QueueEstimate{Request: *current, Running: true, StartAt: startedAt, FinishAt: now.Add(left)}, nil
+	}
+	queued, err := s.queue.List(ctx)
+	if err != nil {
+		return QueueEstimate{}, fmt.Errorf("list queue: %w", err)
+	}
+	i := slices.IndexFunc(queued, mine)
+	if i < 0 {
+		return QueueEstimate{}, ErrNotQueued
+	}
+	est := QueueEstimate{Request: *queued[i], Position: i + 1, Current: left}
+	for _, req := range queued[:i] {
+		est.Ahead += req.Duration
+	}
+	est.StartAt = now.Add(est.Current + est.Ahead)
+	est.FinishAt = est.StartAt.Add(est.Request.Duration)
+	if est.Held, err = s.heldReason(ctx); err != nil {
+		return QueueEstimate{}, err
+	}
+	return est, nil
+}
+
+// heldReason returns why the queue isn't dispatching right now ("" if it is): a shutdown,
+// a hold such as a maintenance window, or the motor in FAULT.
+func (s *MotorService) heldReason(ctx context.Context) (string, error) {
+	sd, err := s.state.GetShutdown(ctx)
+	if err != nil {
+		return "", fmt.Errorf("read shutdown state: %w", err)
+	}
+	if sd.Active {
+		return "system is shut down: " + sd.Summary(), nil
+	}
+	if s.hold != nil {
+		if reason := s.hold(ctx); reason != "" {
+			return reason, nil
+		}
+	}
+	if st := s.states.get(SharedMotor); st.State == MotorFault {
+		return "motor fault: " + st.Reason, nil
+	}
+	return "", nil
+}
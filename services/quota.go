@@ -0,0 +1,45 @@
+// quota.go - Motor time used in the rolling quota window
+//
+// The quota is motor-on time in the last QuotaWindow rather than in a fixed period that
+// resets, so no boundary lets a whole day's quota be run just before it and another just
+// after. Usage is worked out from the session log whenever it is needed: how long the motor
+// actually ran for each queued run that ended in the window, plus the full time asked for
+// by the run on now. A run cut short only counts what it ran, and a run's time is given
+// back once it ended QuotaWindow ago. Being in the database, usage survives restarts and
+// is the same on every replica.
+
+package services // Declares the package name
+
+import ( // Import required packages
+	"context" // For cancellation
+	"fmt"     // For error wrapping
+	"time"    // Durations
+)
+
+const QuotaWindow = 24 * time.Hour // How far back motor time counts against the quota
+
+// usage returns the motor time counted against the quota now and when some of it is next
+// given back: when the oldest run counted leaves the window (zero if nothing counts).
+func (s *MotorService) usage(ctx context.Context) (used time.Duration, freesAt time.Time, err error) {
+	runs, err := s.repo.RunsSince(ctx, s.clock.Now().Add(-QuotaWindow))
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("load recent runs: %w", err)
+	}
+	for _, run := range runs {
+		used += run.Ran
+	}
+	if len(runs) > 0 {
+		freesAt = runs[0].EndedAt.Add(QuotaWindow)
+	}
+	current, startedAt, _, err := s.runningRequest(ctx)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if current != nil { // Counts in full until it ends
+		used += current.Duration
+		if freesAt.IsZero() {
+			freesAt = startedAt.Add(current.Duration + QuotaWindow)
+		}
+	}
+	return used, freesAt, nil
+}
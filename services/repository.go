@@ -0,0 +1,121 @@
+// repository.go - Persistence used by the motor service
+
+package services // Declares the package name
+
+import ( // Import required packages
+	"context"                  // For cancellation
+	"go-mqtt-backend/database" // Daily totals
+	"go-mqtt-backend/models"   // DB models
+	"go-mqtt-backend/store"    // Shutdown state
+	"time"                     // Quota window
+
+	"gorm.io/gorm" // GORM ORM
+)
+
+// MotorRepository stores activation and session history, the queue snapshot and the
+// emergency shutdown and running session kept across restarts.
+type MotorRepository interface {
+	LogActivation(ctx context.Context, a *models.DeviceActivation) error         // Record an accepted request and add it to the daily totals
+	LogSession(ctx context.Context, l *models.SessionLog) error                  // Record how a request ended, also on its activation
+	LogRejected(ctx context.Context, r *models.RejectedRequest) error            // Keep a request that was dropped instead of run
+	RunsSince(ctx context.Context, since time.Time) ([]models.SessionLog, error) // Queued runs the motor was on for that ended at or after since, oldest first
+	SaveSnapshot(ctx context.Context, items []models.MotorQueueItem) error       // Replace the saved queue
+	LoadSnapshot(ctx context.Context) ([]models.MotorQueueItem, error)           // Saved queue (oldest first)
+	ClearQueueSnapshot(ctx context.Context) error                                // Forget saved queue items once re-queued
+	SaveShutdown(ctx context.Context, sd store.Shutdown) error                   // Record the emergency shutdown (or its end)
+	LoadShutdown(ctx context.Context) (store.Shutdown, error)                    // Last recorded shutdown (inactive if none)
+	SaveRunning(ctx context.Context, r models.RunningSession) error              // Record the run the motor is on for
+	LoadRunning(ctx context.Context) (models.RunningSession, error)              // Recorded run (ID 0 if none)
+	ClearRunning(ctx context.Context) error                                      // Forget the run once it has ended
+}
+
+type GormMotorRepository struct { // GormMotorRepository implements MotorRepository on the application database
+	db *gorm.DB
+}
+
+func NewGormMotorRepository(db *gorm.DB) *GormMotorRepository { // Creates a repository backed by db
+	return &GormMotorRepository{db: db}
+}
+
+func (r *GormMotorRepository) LogActivation(ctx context.Context, a *models.DeviceActivation) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(a).Error; err != nil {
+			return err
+		}
+		return database.AddDailyTotal(tx, a)
+	})
+}
+
+func (r *GormMotorRepository) LogSession(ctx context.Context, l *models.SessionLog) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(l).Error; err != nil {
+			return err
+		}
+		if l.QueueID == "" { // Not a queued request, e.g. a manual session
+			return nil
+		}
+		return tx.Model(&models.DeviceActivation{}).Where("queue_id = ? AND outcome = ''", l.QueueID).
+			Updates(map[string]any{"outcome": l.Outcome, "ran": l.Ran, "ended_at": l.EndedAt}).Error
+	})
+}
+
+func (r *GormMotorRepository) LogRejected(ctx context.Context, rej *models.RejectedRequest) error {
+	return r.db.WithContext(ctx).Create(rej).Error
+}
+
+// RunsSince leaves out manual sessions on tenant devices (nothing requested) and requests
+// that never switched the motor on.
+func (r *GormMotorRepository) RunsSince(ctx context.Context, since time.Time) ([]models.SessionLog, error) {
+	var runs []models.SessionLog
+	err := r.db.WithContext(ctx).Where("ended_at >= ? AND requested > 0 AND ran > 0", since).Order("ended_at").Find(&runs).Error
+	return runs, err
+}
+
+func (r *GormMotorRepository) SaveSnapshot(ctx context.Context, items []models.MotorQueueItem) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&models.MotorQueueItem{}).Error; err != nil { // Replace any previous snapshot
+			return err
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		return tx.Create(&items).Error
+	})
+}
+
+func (r *GormMotorRepository) LoadSnapshot(ctx context.Context) ([]models.MotorQueueItem, error) {
+	var items []models.MotorQueueItem
+	err := r.db.WithContext(ctx).Order("id").Find(&items).Error
+	return items, err
+}
+
+func (r *GormMotorRepository) ClearQueueSnapshot(ctx context.Context) error {
+	return r.db.WithContext(ctx).Where("1 = 1").Delete(&models.MotorQueueItem{}).Error
+}
+
+func (r *GormMotorRepository) SaveShutdown(ctx context.Context, sd store.Shutdown) error {
+	return r.db.WithContext(ctx).Save(&models.ShutdownState{ID: 1, Active: sd.Active, Category: sd.Category, Reason: sd.Reason, Since: sd.Since, Until: sd.Until}).Error // Upsert the single row
+}
+
+func (r *GormMotorRepository) LoadShutdown(ctx context.Context) (store.Shutdown, error) {
+	var row models.ShutdownState
+	if err := r.db.WithContext(ctx).Limit(1).Find(&row, 1).Error; err != nil { // Missing row is not an error
+		return store.Shutdown{}, err
+	}
+	return store.Shutdown{Active: row.Active, Category: row.Category, Reason: row.Reason, Since: row.Since, Until: row.Until}, nil
+}
+
+func (r *GormMotorRepository) SaveRunning(ctx context.Context, run models.RunningSession) error {
+	run.ID = 1                                    // Single row
+	return r.db.WithContext(ctx).Save(&run).Error // Upsert
+}
+
+func (r *GormMotorRepository) LoadRunning(ctx context.Context) (models.RunningSession, error) {
+	var run models.RunningSession
+	err := r.db.WithContext(ctx).Limit(1).Find(&run, 1).Error // Missing row is not an error
+	return run, err
+}
+
+func (r *GormMotorRepository) ClearRunning(ctx context.Context) error {
+	return r.db.WithContext(ctx).Delete(&models.RunningSession{}, 1).Error
+}
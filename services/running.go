@@ -0,0 +1,156 @@
+// running.go - The run the motor was on for when the process died
+//
+// Run records each queued run in the repository when the motor is switched on and
+// deletes it when the run ends, including on a clean shutdown. A record still there at
+// startup means the process died mid-run and nobody is going to switch the motor off.
+// RecoverSession settles it: by default the motor is switched off and the run recorded
+// as interrupted; with the resume policy Run takes the run back over and switches the
+// motor off when the time that was left is up.
+
+package services // Declares the package name
+
+import ( // Import required packages
+	"context"                // For cancellation
+	"fmt"                    // For error wrapping
+	"go-mqtt-backend/models" // Running session record
+	"go-mqtt-backend/store"  // Queued requests
+	"log/slog"               // Leveled logging
+	"time"                   // Durations
+)
+
+const ( // What happens at startup to a run the process died in the middle of
+	CrashStop   = "stop"   // Switch the motor off and record the run as interrupted
+	CrashResume = "resume" // Let Run see the run to its end
+)
+
+type sessionRun struct { // Progress of the run the motor is on for
+	req       *store.MotorRequest
+	startedAt time.Time     // When the motor was switched on for it (the interlock's Since)
+	since     time.Time     // When the current stretch started: startedAt, or when it was last resumed
+	ran       time.Duration // Runtime before since
+	outages   int           // Power outages so far
+}
+
+type RecoveredSession struct { // A run found at startup
+	Request   store.MotorRequest
+	StartedAt time.Time
+	Remaining time.Duration // Left to run when it was found
+	Resumed   bool          // Handed to Run; otherwise switched off and recorded as interrupted
+	Reason    string        // Why it was not resumed
+}
+
+func (s *MotorService) saveRun(ctx context.Context, run *sessionRun) {
+	row := models.RunningSession{
+		Motor: SharedMotor, QueueID: run.req.ID, UserID: run.req.UserID, RequestAt: run.req.RequestAt, Duration: run.req.Duration, Simulate: run.req.Simulate, Note: run.req.Note,
+		StartedAt: run.startedAt, PartSince: run.since, Ran: run.ran, Outages: run.outages,
+	}
+	if err := s.repo.SaveRunning(ctx, row); err != nil {
+		slog.Error("record running motor session failed", "user_id", run.req.UserID, "error", err)
+	}
+}
+
+func recordedRequest(row models.RunningSession) *store.MotorRequest { // The request a running session record is for
+	return &store.MotorRequest{ID: row.QueueID, UserID: row.UserID, RequestAt: row.RequestAt, Duration: row.Duration, Simulate: row.Simulate, Note: row.Note}
+}
+
+// runningRequest returns the request the shared motor is on for, whichever replica runs
+// it, when it started and how long it has left (nil if the motor is idle).
+func (s *MotorService) runningRequest(ctx context.Context) (*store.MotorRequest, time.Time, time.Duration, error) {
+	now := s.clock.Now()
+	row, err := s.repo.LoadRunning(ctx)
+	if err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("load running session: %w", err)
+	}
+	if row.ID != 0 {
+		ran := min(row.Ran+now.Sub(row.PartSince), row.Duration)
+		return recordedRequest(row), row.StartedAt, row.Duration - ran, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		return nil, time.Time{}, 0, nil
+	}
+	req := *s.current // Started but not recorded yet
+	return &req, s.currentAt, max(s.currentAt.Add(req.Duration).Sub(now), 0), nil
+}
+
+func (s *MotorService) clearRun(ctx context.Context) {
+	if err := s.repo.ClearRunning(ctx); err != nil {
+		slog.Error("clear running motor session failed", "error", err)
+	}
+}
+
+func (s *MotorService) takeRecovered() *sessionRun { // The run RecoverSession handed to Run, once
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run := s.recovered
+	s.recovered = nil
+	return run
+}
+
+// RecoverSession settles a run the process died in the middle of; it returns nil if
+// there was none. Call it once at startup, after RestoreShutdown and before Run. The run
+// is resumed only with the resume policy, while time is left and nothing stops it (a
+// shutdown, a hold or another session on the motor); otherwise the motor is switched
+// off and the run recorded as interrupted for the time up to now.
+func (s *MotorService) RecoverSession(ctx context.Context) (*RecoveredSession, error) {
+	row, err := s.repo.LoadRunning(ctx)
+	if err != nil || row.ID == 0 {
+		return nil, err
+	}
+	req := recordedRequest(row)
+	now := s.clock.Now()
+	ran := min(row.Ran+now.Sub(row.PartSince), row.Duration)
+	out := &RecoveredSession{Request: *req, StartedAt: row.StartedAt, Remaining: row.Duration - ran}
+
+	lock := Interlock{Source: InterlockQueue, UserID: req.UserID, Since: row.StartedAt}
+	holder, err := s.Interlock(ctx, SharedMotor)
+	if err != nil {
+		return nil, err
+	}
+	ours := holder == nil || holder.holder() == lock.holder()
+	switch {
+	case !ours:
+		out.Reason = "another session holds the motor" // Taken over elsewhere; its motor is left alone
+	case s.crashPolicy != CrashResume:
+		out.Reason = "backend restarted mid-run"
+	case out.Remaining <= 0:
+		out.Reason = "backend restarted after the run should have ended"
+	default:
+		if sd, err := s.state.GetShutdown(ctx); err != nil {
+			return nil, err
+		} else if sd.Active {
+			out.Reason = "system is shut down: " + sd.Summary()
+		} else if s.hold != nil {
+			out.Reason = s.hold(ctx)
+		}
+	}
+	if out.Reason == "" {
+		if err := s.lockMotor(ctx, SharedMotor, lock, out.Remaining+s.ackWait+interlockMargin); err != nil {
+			out.Reason = err.Error()
+		}
+	}
+	if out.Reason == "" {
+		run := &sessionRun{req: req, startedAt: row.StartedAt, since: now, ran: ran, outages: row.Outages}
+		s.mu.Lock()
+		s.current, s.currentAt, s.recovered, s.stopped = req, row.StartedAt, run, ""
+		s.mu.Unlock()
+		s.states.apply(SharedMotor, CommandOn, "", now) // The motor should still be on; ON again in case it isn't
+		if err := s.send(WithRequestID(ctx, req.RequestID), s.publisherFor(SharedMotor), SharedMotor, MotorTopic, CommandOn); err != nil {
+			slog.Error("motor ON publish failed", "error", err)
+		}
+		s.saveRun(ctx, run)
+		out.Resumed = true
+		return out, nil
+	}
+
+	if ours {
+		if !req.Simulate { // A dry run never reached the motor
+			s.switchOff()
+		}
+		s.unlockSession(ctx, req, row.StartedAt)
+	}
+	s.clearRun(ctx)
+	s.emitSession(ctx, SessionEvent{Kind: SessionInterrupted, Request: *req, Reason: out.Reason, Ran: ran, Outages: row.Outages})
+	return out, nil
+}
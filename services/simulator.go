@@ -0,0 +1,63 @@
+// simulator.go - Dry runs: motor commands that never reach MQTT
+//
+// A simulated session goes through the same queue, quota, interlock and state machine
+// as a real one, but its commands are handed to the simulator instead of the broker. The
+// simulator plays the device: when devices are expected to confirm commands, it reports
+// "on" or "off" on the motor's behalf a moment later, so acks are exercised too.
+
+package services // Declares the package name
+
+import ( // Import required packages
+	"log/slog" // Leveled logging
+	"strings"  // Topic parsing
+	"time"     // Ack delay
+)
+
+const simulatedAckDelay = 500 * time.Millisecond // How long the simulated device takes to confirm
+
+type simulator struct { // Publisher standing in for the broker and the device
+	states *motorStates
+	clock  Clock
+	delay  time.Duration
+}
+
+func newSimulator(states *motorStates, clock Clock, ackWait time.Duration) *simulator {
+	delay := simulatedAckDelay
+	if ackWait > 0 && delay > ackWait/2 { // Well inside the ack window
+		delay = ackWait / 2
+	}
+	return &simulator{states: states, clock: clock, delay: delay}
+}
+
+// Publish logs the command and, for devices that confirm, acknowledges "on" and "off"
+// after a short delay. Nothing is sent to MQTT.
+func (sim *simulator) Publish(topic string, payload interface{}) error {
+	cmd, seq := ParseCommand(payload)
+	device := SharedMotor
+	if topic != MotorTopic {
+		device = strings.TrimSuffix(topic, "/"+MotorTopic)
+	}
+	slog.Info("simulated motor command", "motor", device, "topic", topic, "payload", payload)
+	var ack string
+	switch cmd {
+	case CommandOn:
+		ack = AckOn
+	case CommandOff:
+		ack = AckOff
+	}
+	if ack == "" || !sim.states.confirm {
+		return nil
+	}
+	go func() {
+		time.Sleep(sim.delay)
+		if seq > 0 && sim.states.acknowledge(device, seq) != nil { // Echoes the seq like sequencing firmware
+			return
+		}
+		sim.states.apply(device, ack, "", sim.clock.Now()) // A stale ack, e.g. after a fault, is refused like a real one
+	}()
+	return nil
+}
+
+func (sim *simulator) PublishAtLeastOnce(topic string, payload interface{}) error {
+	return sim.Publish(topic, payload)
+}
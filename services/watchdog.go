@@ -0,0 +1,118 @@
+// watchdog.go - Commands that were never acknowledged
+//
+// When devices confirm commands, every motor in STARTING or STOPPING has a command
+// outstanding. The watchdog sweeps them: an ON not confirmed within AckWait, or an OFF
+// not confirmed long after stopVerified should have given up, fails. The motor goes
+// into FAULT, which records the fault and alerts the admins through OnFault, and a
+// failed ON is followed by a corrective OFF in case the motor started after all.
+
+package services // Declares the package name
+
+import ( // Import required packages
+	"context"  // For cancellation
+	"log/slog" // Leveled logging
+	"sort"     // Stable listing
+	"time"     // Timeouts
+)
+
+const watchdogInterval = 5 * time.Second // How often outstanding commands are checked
+
+type PendingCommand struct { // A command still waiting for the device to confirm it
+	Motor   string        `json:"motor"`   // SharedMotor or "{org}/{device}"
+	Command string        `json:"command"` // CommandOn or CommandOff
+	SentAt  time.Time     `json:"sent_at"`
+	Age     time.Duration `json:"age"`
+	Overdue bool          `json:"overdue"` // Past its timeout: the watchdog fails it on its next sweep
+}
+
+// commandTimeout is how long a command may stay unconfirmed. OFF is resent by
+// stopVerified until OffTimeout, so it gets that plus the ack wait.
+func (s *MotorService) commandTimeout(command string) time.Duration {
+	if command == CommandOff {
+		return s.offTimeout + s.ackWait
+	}
+	return s.ackWait
+}
+
+// PendingCommands returns the commands waiting for a device to confirm them, oldest
+// first. It is empty when devices don't confirm commands.
+func (s *MotorService) PendingCommands() []PendingCommand {
+	now := s.clock.Now()
+	var out []PendingCommand
+	for motor, st := range s.states.all() {
+		var cmd string
+		switch st.State {
+		case MotorStarting:
+			cmd = CommandOn
+		case MotorStopping:
+			cmd = CommandOff
+		default:
+			continue
+		}
+		age := now.Sub(st.Since)
+		out = append(out, PendingCommand{Motor: motor, Command: cmd, SentAt: st.Since, Age: age, Overdue: age > s.commandTimeout(cmd)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SentAt.Before(out[j].SentAt) })
+	return out
+}
+
+// CheckCommands fails every overdue command and returns them, releasing the interlock
+// of a tenant device whose ON failed. The queue's own session is left to Run, which
+// handles an unconfirmed ON itself.
+func (s *MotorService) CheckCommands(ctx context.Context) []PendingCommand {
+	var failed []PendingCommand
+	for _, p := range s.PendingCommands() {
+		if !p.Overdue {
+			continue
+		}
+		if p.Motor == SharedMotor && p.Command == CommandOn {
+			s.mu.Lock()
+			inSession := s.current != nil
+			s.mu.Unlock()
+			if inSession {
+				continue
+			}
+		}
+		state, name := MotorStarting, "ON"
+		if p.Command == CommandOff {
+			state, name = MotorStopping, "OFF"
+		}
+		was := MotorStateInfo{State: state, Since: p.SentAt}
+		if !s.states.faultIfUnchanged(p.Motor, was, "device did not confirm "+name+" (watchdog)", s.clock.Now()) { // Confirmed in the meantime
+			continue
+		}
+		slog.Error("motor command unconfirmed", "motor", p.Motor, "command", p.Command, "age", p.Age)
+		if p.Command == CommandOn && s.correctiveOff { // It may have started without saying so
+			topic := MotorTopic
+			if p.Motor != SharedMotor {
+				topic = p.Motor + "/" + MotorTopic
+			}
+			if err := s.send(ctx, s.publisherFor(p.Motor), p.Motor, topic, CommandOff); err != nil {
+				slog.Error("corrective motor OFF failed", "motor", p.Motor, "error", err)
+			}
+		}
+		if p.Command == CommandOn && p.Motor != SharedMotor { // That manual session is over
+			s.UnlockMotor(ctx, p.Motor)
+		}
+		failed = append(failed, p)
+	}
+	return failed
+}
+
+// Watch runs CheckCommands every few seconds until ctx is cancelled. Run it on the
+// queue leader only, so corrective OFFs are sent once.
+func (s *MotorService) Watch(ctx context.Context, beat func()) error {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		beat()
+		if s.ackWait > 0 {
+			s.CheckCommands(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// database.go - Database implementation of Queue, so pending requests survive a crash
+//
+// The memory queue is only saved on a graceful shutdown, so a crash or a kill loses every
+// pending request. This backend keeps each request as a row of motor_queue_items (the
+// table the shutdown snapshot uses) from the moment it is queued until it is popped. Pop
+// waits for a push in this process and otherwise looks again every databasePoll, for
+// requests queued by other processes sharing the database.
+
+package store // Declares the package name
+
+import ( // Import required packages
+	"cmp"                    // Default capacity
+	"context"                // For cancellation
+	"go-mqtt-backend/models" // Queue item model
+	"sync/atomic"            // Capacity changes at runtime
+	"time"                   // For polling
+
+	"gorm.io/gorm" // GORM ORM
+)
+
+var databasePoll = time.Second // How often a waiting Pop looks for requests queued elsewhere
+
+const databaseOrder = "CASE priority WHEN 'high' THEN 0 WHEN 'low' THEN 2 ELSE 1 END, round, id" // Dispatch order: as priorityRank, then fair round
+
+type databaseQueue struct { // databaseQueue keeps requests as MotorQueueItem rows
+	db       *gorm.DB
+	capacity atomic.Int64
+	ready    chan struct{} // Signalled when a request is pushed
+}
+
+// NewDatabaseQueue creates a queue kept in db's motor_queue_items table with the given
+// capacity. The table must exist (database.Migrate creates it).
+func NewDatabaseQueue(db *gorm.DB, capacity int) Queue {
+	if capacity <= 0 {
+		capacity = 100 // Default capacity
+	}
+	q := &databaseQueue{db: db, ready: make(chan struct{}, 1)}
+	q.capacity.Store(int64(capacity))
+	return q
+}
+
+func toItem(req *MotorRequest) models.MotorQueueItem { // The row req is kept as
+	return models.MotorQueueItem{QueueID: req.ID, UserID: req.UserID, RequestAt: req.RequestAt, Duration: req.Duration, Simulate: req.Simulate, Note: req.Note, RequestID: req.RequestID, Priority: req.Priority, ExpiresAt: req.ExpiresAt, Round: req.Round}
+}
+
+func fromItem(item models.MotorQueueItem) *MotorRequest { // The request a row holds
+	return &MotorRequest{ID: item.QueueID, UserID: item.UserID, RequestAt: item.RequestAt, Duration: item.Duration, Simulate: item.Simulate, Note: item.Note, RequestID: item.RequestID, Priority: item.Priority, ExpiresAt: item.ExpiresAt, Round: item.Round}
+}
+
+func (q *databaseQueue) Push(ctx context.Context, req *MotorRequest) error {
+	err := q.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error { // Count, place and insert as one write
+		var queued []models.MotorQueueItem
+		if err := tx.Select("user_id", "priority", "round").Find(&queued).Error; err != nil {
+			return err
+		}
+		if int64(len(queued)) >= q.capacity.Load() {
+			return ErrQueueFull
+		}
+		var same []*MotorRequest // Queued at req's priority
+		for _, item := range queued {
+			if priorityRank(item.Priority) == priorityRank(req.Priority) {
+				same = append(same, fromItem(item))
+			}
+		}
+		req.Round = fairRound(same, req.UserID)
+		item := toItem(req)
+		return tx.Create(&item).Error
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case q.ready <- struct{}{}:
+	default: // Already signalled
+	}
+	return nil
+}
+
+func (q *databaseQueue) Pop(ctx context.Context) (*MotorRequest, error) {
+	for {
+		var item models.MotorQueueItem
+		err := q.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error { // Read and delete the next as one write
+			if err := tx.Order(databaseOrder).Limit(1).Find(&item).Error; err != nil {
+				return err
+			}
+			if item.ID == 0 {
+				return nil
+			}
+			return tx.Delete(&item).Error
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if item.ID != 0 {
+			req := fromItem(item)
+			req.row = item.ID
+			return req, nil
+		}
+		timer := time.NewTimer(databasePoll)
+		select {
+		case <-q.ready:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+func (q *databaseQueue) Requeue(ctx context.Context, req *MotorRequest) error {
+	item := toItem(req)
+	item.ID = req.row // Its place in the queue again (0: behind the rest of its round)
+	if err := q.db.WithContext(ctx).Create(&item).Error; err != nil {
+		return err
+	}
+	select {
+	case q.ready <- struct{}{}:
+	default: // Already signalled
+	}
+	return nil
+}
+
+func (q *databaseQueue) Drain(ctx context.Context) ([]*MotorRequest, error) {
+	var items []models.MotorQueueItem
+	err := q.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error { // Read and clear atomically
+		if err := tx.Order(databaseOrder).Find(&items).Error; err != nil {
+			return err
+		}
+		return tx.Where("1 = 1").Delete(&models.MotorQueueItem{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]*MotorRequest, 0, len(items))
+	for _, item := range items {
+		reqs = append(reqs, fromItem(item))
+	}
+	return reqs, nil
+}
+
+func (q *databaseQueue) List(ctx context.Context) ([]*MotorRequest, error) {
+	var items []models.MotorQueueItem
+	if err := q.db.WithContext(ctx).Order(databaseOrder).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	reqs := make([]*MotorRequest, 0, len(items))
+	for _, item := range items {
+		reqs = append(reqs, fromItem(item))
+	}
+	return reqs, nil
+}
+
+func (q *databaseQueue) Remove(ctx context.Context, id string) (*MotorRequest, error) {
+	var item models.MotorQueueItem
+	err := q.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("queue_id = ?", id).Limit(1).Find(&item).Error; err != nil || item.ID == 0 {
+			return err
+		}
+		return tx.Delete(&item).Error
+	})
+	if err != nil || item.ID == 0 {
+		return nil, err
+	}
+	return fromItem(item), nil
+}
+
+func (q *databaseQueue) Len(ctx context.Context) (int, error) {
+	var n int64
+	err := q.db.WithContext(ctx).Model(&models.MotorQueueItem{}).Count(&n).Error
+	return int(n), err
+}
+
+func (q *databaseQueue) Cap() int { return int(q.capacity.Load()) }
+
+func (q *databaseQueue) SetCap(n int) { q.capacity.Store(int64(cmp.Or(max(n, 0), 100))) } // Default capacity, as NewDatabaseQueue
+
+func (q *databaseQueue) Persistent() bool { return true }
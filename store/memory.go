@@ -0,0 +1,236 @@
+// memory.go - In-process implementation of Queue and State
+
+package store // Declares the package name
+
+import ( // Import required packages
+	"cmp"     // Default capacity
+	"context" // For cancellation
+	"slices"  // Priority inserts
+	"sync"    // For mutex (thread safety)
+	"time"    // For time operations
+)
+
+type memoryQueue struct { // memoryQueue is a slice guarded by a mutex
+	mu       sync.Mutex
+	items    []*MotorRequest // Queued requests, next first
+	capacity int
+	ready    chan struct{} // Signalled when a request is pushed
+}
+
+func NewMemoryQueue(capacity int) Queue { // Creates an in-memory queue with the given capacity
+	if capacity <= 0 {
+		capacity = 100 // Default capacity
+	}
+	return &memoryQueue{capacity: capacity, ready: make(chan struct{}, 1)}
+}
+
+func (q *memoryQueue) Push(ctx context.Context, req *MotorRequest) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) >= q.capacity {
+		return ErrQueueFull // Don't block the HTTP handler
+	}
+	rank := priorityRank(req.Priority)
+	var same []*MotorRequest // Queued at req's priority
+	for _, item := range q.items {
+		if priorityRank(item.Priority) == rank {
+			same = append(same, item)
+		}
+	}
+	req.Round = fairRound(same, req.UserID)
+	i := len(q.items)
+	for i > 0 && (priorityRank(q.items[i-1].Priority) > rank || priorityRank(q.items[i-1].Priority) == rank && q.items[i-1].Round > req.Round) { // Ahead of lower priorities and later rounds
+		i--
+	}
+	q.items = slices.Insert(q.items, i, req)
+	q.signal()
+	return nil
+}
+
+func (q *memoryQueue) Requeue(ctx context.Context, req *MotorRequest) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	rank := priorityRank(req.Priority)
+	i := 0
+	for i < len(q.items) && priorityRank(q.items[i].Priority) < rank { // Behind higher priorities only
+		i++
+	}
+	q.items = slices.Insert(q.items, i, req)
+	q.signal()
+	return nil
+}
+
+func (q *memoryQueue) signal() { // Wakes a waiting Pop; the mutex must be held
+	select {
+	case q.ready <- struct{}{}:
+	default: // Already signalled
+	}
+}
+
+func (q *memoryQueue) Pop(ctx context.Context) (*MotorRequest, error) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			req := q.items[0]
+			q.items[0] = nil
+			q.items = q.items[1:]
+			if len(q.items) > 0 {
+				q.signal() // For the next waiting Pop
+			}
+			q.mu.Unlock()
+			return req, nil
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *memoryQueue) Drain(ctx context.Context) ([]*MotorRequest, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	reqs := q.items
+	q.items = nil
+	return reqs, nil
+}
+
+func (q *memoryQueue) List(ctx context.Context) ([]*MotorRequest, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	reqs := make([]*MotorRequest, len(q.items))
+	for i, req := range q.items {
+		copied := *req // Callers can't change what is queued
+		reqs[i] = &copied
+	}
+	return reqs, nil
+}
+
+func (q *memoryQueue) Remove(ctx context.Context, id string) (*MotorRequest, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, req := range q.items {
+		if req.ID == id {
+			q.items = slices.Delete(q.items, i, i+1)
+			return req, nil
+		}
+	}
+	return nil, nil
+}
+
+func (q *memoryQueue) Len(ctx context.Context) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items), nil
+}
+
+func (q *memoryQueue) Cap() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.capacity
+}
+
+func (q *memoryQueue) SetCap(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.capacity = cmp.Or(max(n, 0), 100) // Default capacity, as NewMemoryQueue
+}
+
+func (q *memoryQueue) Persistent() bool { return false }
+
+type memoryState struct { // memoryState holds counters in process memory
+	mu       sync.Mutex           // Mutex for thread safety
+	shutdown Shutdown             // Emergency shutdown state
+	windows  map[string]rateCount // Rate limit counters by key
+	leases   map[string]lease     // Leases by name
+	seqs     map[string]uint64    // Last sequence numbers by name
+}
+
+type lease struct { // A held lease
+	holder  string    // Who owns it
+	expires time.Time // When it lapses unless renewed
+}
+
+type rateCount struct { // Hits in one fixed window
+	count int       // Hits so far
+	ends  time.Time // When the window ends
+}
+
+func NewMemoryState() State { // Creates an empty in-memory state
+	return &memoryState{windows: make(map[string]rateCount), leases: make(map[string]lease), seqs: make(map[string]uint64)}
+}
+
+func (s *memoryState) GetShutdown(ctx context.Context) (Shutdown, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown, nil
+}
+
+func (s *memoryState) SetShutdown(ctx context.Context, sd Shutdown) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shutdown = sd
+	return nil
+}
+
+func (s *memoryState) Allow(ctx context.Context, key string, limit int, window time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	w := s.windows[key]
+	if now.After(w.ends) { // Start a new window
+		w = rateCount{ends: now.Add(window)}
+		for k, old := range s.windows { // Drop expired windows so the map doesn't grow forever
+			if now.After(old.ends) {
+				delete(s.windows, k)
+			}
+		}
+	}
+	w.count++
+	s.windows[key] = w
+	return w.count <= limit, nil
+}
+
+func (s *memoryState) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if l, ok := s.leases[name]; ok && l.holder != holder && now.Before(l.expires) { // Someone else holds it
+		return false, nil
+	}
+	s.leases[name] = lease{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (s *memoryState) ReleaseLease(ctx context.Context, name, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leases[name].holder == holder {
+		delete(s.leases, name)
+	}
+	return nil
+}
+
+func (s *memoryState) LeaseHolder(ctx context.Context, name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.leases[name]; ok && time.Now().Before(l.expires) {
+		return l.holder, nil
+	}
+	return "", nil
+}
+
+func (s *memoryState) Shared() bool { return false }
+
+func (s *memoryState) NextSequence(ctx context.Context, name string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.seqs[name] + 1
+	if now := uint64(time.Now().UnixMilli()); now > n {
+		n = now
+	}
+	s.seqs[name] = n
+	return n, nil
+}
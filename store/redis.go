@@ -0,0 +1,317 @@
+// redis.go - Redis implementation of Queue and State for multi-instance deployments
+
+package store // Declares the package name
+
+import ( // Import required packages
+	"cmp"           // Default capacity
+	"context"       // For cancellation
+	"encoding/json" // Queue items are stored as JSON
+	"errors"        // For redis.Nil checks
+	"sync/atomic"   // Capacity changes at runtime
+	"time"          // For time operations
+
+	"github.com/redis/go-redis/v9" // Redis client
+)
+
+type redisBackend struct { // redisBackend implements both Queue and State
+	rdb      *redis.Client // Redis client
+	prefix   string        // Key prefix
+	capacity atomic.Int64  // Max queued requests
+}
+
+func newRedis(opts Options) (*redisBackend, error) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:                  opts.RedisAddr,
+		Password:              opts.RedisPassword,
+		DB:                    opts.RedisDB,
+		ContextTimeoutEnabled: true, // Let ctx cancel blocking pops on shutdown
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil { // Fail fast at startup
+		return nil, err
+	}
+	capacity := opts.QueueCapacity
+	if capacity <= 0 {
+		capacity = 100 // Default capacity
+	}
+	b := &redisBackend{rdb: rdb, prefix: opts.RedisPrefix}
+	b.capacity.Store(int64(capacity))
+	return b, nil
+}
+
+func (b *redisBackend) key(name string) string { return b.prefix + name } // Namespaced key
+
+// --- Queue ---
+
+// queueKey is the list holding requests of priority p. Normal ones keep the key the queue
+// had before priorities, so requests queued by an older version are still dispatched.
+func (b *redisBackend) queueKey(p string) string {
+	switch priorityRank(p) {
+	case 0:
+		return b.key("queue:high")
+	case 2:
+		return b.key("queue:low")
+	}
+	return b.key("queue")
+}
+
+func (b *redisBackend) queueKeys() []string { // Every queue list, in dispatch order
+	keys := make([]string, len(priorities))
+	for i, p := range priorities {
+		keys[i] = b.queueKey(p)
+	}
+	return keys
+}
+
+// pushScript queues ARGV[1], a request of user ARGV[3], in KEYS[1] only if the lists in
+// the other keys together are below capacity ARGV[2], so replicas can't overfill the
+// queue. Like fairRound, it places the request in its fair round, before the first request
+// of a later round, and adds the round to it. It returns the round, or -1 when full.
+var pushScript = redis.NewScript(`
+local n = 0
+for i = 2, #KEYS do n = n + redis.call('LLEN', KEYS[i]) end
+if n >= tonumber(ARGV[2]) then return -1 end
+local items = redis.call('LRANGE', KEYS[1], 0, -1)
+local rounds = {}
+local round, mine = nil, -1
+for i, data in ipairs(items) do
+  local req = cjson.decode(data)
+  rounds[i] = req.round or 0
+  if round == nil or rounds[i] < round then round = rounds[i] end
+  if req.user_id == tonumber(ARGV[3]) and rounds[i] > mine then mine = rounds[i] end
+end
+round = math.max(round or 0, mine + 1)
+local data = ARGV[1]
+if round > 0 then data = string.sub(data, 1, -2) .. ',"round":' .. round .. '}' end
+for i, r in ipairs(rounds) do
+  if r > round then
+    redis.call('LINSERT', KEYS[1], 'BEFORE', items[i], data)
+    return round
+  end
+end
+redis.call('RPUSH', KEYS[1], data)
+return round`)
+
+func (b *redisBackend) Push(ctx context.Context, req *MotorRequest) error {
+	unplaced := *req
+	unplaced.Round = 0 // Left out of the JSON; the script adds it
+	data, err := json.Marshal(&unplaced)
+	if err != nil {
+		return err
+	}
+	round, err := pushScript.Run(ctx, b.rdb, append([]string{b.queueKey(req.Priority)}, b.queueKeys()...), data, b.capacity.Load(), req.UserID).Int()
+	if err != nil {
+		return err
+	}
+	if round < 0 {
+		return ErrQueueFull
+	}
+	req.Round = round
+	return nil
+}
+
+func (b *redisBackend) Requeue(ctx context.Context, req *MotorRequest) error {
+	data, err := json.Marshal(req) // With its round
+	if err != nil {
+		return err
+	}
+	return b.rdb.LPush(ctx, b.queueKey(req.Priority), data).Err()
+}
+
+func (b *redisBackend) Pop(ctx context.Context) (*MotorRequest, error) {
+	for {
+		res, err := b.rdb.BLPop(ctx, 5*time.Second, b.queueKeys()...).Result() // Short timeout so ctx is checked regularly; keys in priority order
+		if errors.Is(err, redis.Nil) {                                         // Timed out, nothing queued
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		var req MotorRequest
+		if err := json.Unmarshal([]byte(res[1]), &req); err != nil { // res[0] is the key
+			return nil, err
+		}
+		return &req, nil
+	}
+}
+
+// readQueue reads every queue list in one transaction, next request first, and deletes
+// them too if clear is set.
+func (b *redisBackend) readQueue(ctx context.Context, clear bool) ([]*MotorRequest, error) {
+	keys := b.queueKeys()
+	lists := make([]*redis.StringSliceCmd, len(keys))
+	_, err := b.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error { // Read (and clear) atomically
+		for i, key := range keys {
+			lists[i] = pipe.LRange(ctx, key, 0, -1)
+		}
+		if clear {
+			pipe.Del(ctx, keys...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	reqs := []*MotorRequest{}
+	for _, list := range lists {
+		for _, data := range list.Val() {
+			var req MotorRequest
+			if err := json.Unmarshal([]byte(data), &req); err != nil {
+				return reqs, err
+			}
+			reqs = append(reqs, &req)
+		}
+	}
+	return reqs, nil
+}
+
+func (b *redisBackend) Drain(ctx context.Context) ([]*MotorRequest, error) {
+	return b.readQueue(ctx, true)
+}
+
+func (b *redisBackend) List(ctx context.Context) ([]*MotorRequest, error) {
+	return b.readQueue(ctx, false)
+}
+
+// removeScript takes the request whose id is ARGV[1] out of whichever list in KEYS holds
+// it and returns it (nil if none does).
+var removeScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+  for _, data in ipairs(redis.call('LRANGE', key, 0, -1)) do
+    if cjson.decode(data).id == ARGV[1] then
+      redis.call('LREM', key, 1, data)
+      return data
+    end
+  end
+end
+return false`)
+
+func (b *redisBackend) Remove(ctx context.Context, id string) (*MotorRequest, error) {
+	data, err := removeScript.Run(ctx, b.rdb, b.queueKeys(), id).Text()
+	if errors.Is(err, redis.Nil) { // Not queued
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var req MotorRequest
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (b *redisBackend) Len(ctx context.Context) (int, error) {
+	keys := b.queueKeys()
+	lens := make([]*redis.IntCmd, len(keys))
+	_, err := b.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			lens[i] = pipe.LLen(ctx, key)
+		}
+		return nil
+	})
+	n := 0
+	for _, l := range lens {
+		n += int(l.Val())
+	}
+	return n, err
+}
+
+func (b *redisBackend) Cap() int { return int(b.capacity.Load()) }
+
+func (b *redisBackend) SetCap(n int) { b.capacity.Store(int64(cmp.Or(max(n, 0), 100))) } // Default capacity, as newRedis
+
+func (b *redisBackend) Persistent() bool { return true }
+
+// --- State ---
+
+func (b *redisBackend) GetShutdown(ctx context.Context) (Shutdown, error) {
+	var sd Shutdown
+	data, err := b.rdb.Get(ctx, b.key("shutdown")).Bytes()
+	if errors.Is(err, redis.Nil) { // Never shut down
+		return sd, nil
+	}
+	if err != nil {
+		return sd, err
+	}
+	err = json.Unmarshal(data, &sd)
+	return sd, err
+}
+
+func (b *redisBackend) SetShutdown(ctx context.Context, sd Shutdown) error {
+	data, err := json.Marshal(sd)
+	if err != nil {
+		return err
+	}
+	return b.rdb.Set(ctx, b.key("shutdown"), data, 0).Err()
+}
+
+// allowScript counts a hit and starts the window's expiry on the first one.
+var allowScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return n`)
+
+func (b *redisBackend) Allow(ctx context.Context, key string, limit int, window time.Duration) (bool, error) {
+	n, err := allowScript.Run(ctx, b.rdb, []string{b.key("ratelimit:" + key)}, window.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return n <= limit, nil
+}
+
+// acquireScript sets the lease if it's free and extends it if ARGV[1] already holds it.
+var acquireScript = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if not cur then
+  redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+  return 1
+end
+if cur == ARGV[1] then
+  redis.call('PEXPIRE', KEYS[1], ARGV[2])
+  return 1
+end
+return 0`)
+
+// releaseScript deletes the lease only if ARGV[1] holds it, so a late release can't drop a successor's lease.
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('DEL', KEYS[1]) end
+return 0`)
+
+func (b *redisBackend) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	ok, err := acquireScript.Run(ctx, b.rdb, []string{b.key("lease:" + name)}, holder, ttl.Milliseconds()).Int()
+	return ok == 1, err
+}
+
+func (b *redisBackend) ReleaseLease(ctx context.Context, name, holder string) error {
+	return releaseScript.Run(ctx, b.rdb, []string{b.key("lease:" + name)}, holder).Err()
+}
+
+func (b *redisBackend) LeaseHolder(ctx context.Context, name string) (string, error) {
+	holder, err := b.rdb.Get(ctx, b.key("lease:"+name)).Result()
+	if errors.Is(err, redis.Nil) { // Nobody holds it
+		return "", nil
+	}
+	return holder, err
+}
+
+// sequenceScript stores and returns max(current + 1, ARGV[1]).
+var sequenceScript = redis.NewScript(`
+local n = tonumber(redis.call('GET', KEYS[1]) or '0') + 1
+if tonumber(ARGV[1]) > n then n = tonumber(ARGV[1]) end
+redis.call('SET', KEYS[1], string.format('%d', n))
+return n`)
+
+func (b *redisBackend) NextSequence(ctx context.Context, name string) (uint64, error) {
+	n, err := sequenceScript.Run(ctx, b.rdb, []string{b.key("seq:" + name)}, time.Now().UnixMilli()).Int64()
+	return uint64(n), err
+}
+
+func (b *redisBackend) Shared() bool { return true }
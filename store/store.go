@@ -0,0 +1,189 @@
+// store.go - Shared runtime state (queue, quota, shutdown, rate limits) behind interfaces
+//
+// The in-memory backend keeps everything in the process, which is fine for a single
+// instance. The Redis backend lets several replicas behind a load balancer share the
+// same queue and counters. The queue alone can also be kept in the database, so pending
+// requests survive a crash without Redis.
+
+package store // Declares the package name
+
+import ( // Import required packages
+	"context" // For cancellation
+	"errors"  // Sentinel errors
+	"fmt"     // For error formatting
+	"time"    // For durations
+
+	"gorm.io/gorm" // Database queue backend
+)
+
+var ErrQueueFull = errors.New("motor queue is full") // Returned by Push when the queue is at capacity
+
+type MotorRequest struct { // A queued motor-on request
+	ID        string        `json:"id,omitempty"`         // Identifies the request while it is queued, e.g. to cancel it
+	UserID    uint          `json:"user_id"`              // User who requested the run
+	RequestAt time.Time     `json:"request_at"`           // Time of request
+	Duration  time.Duration `json:"duration"`             // How long to turn on
+	Simulate  bool          `json:"simulate,omitempty"`   // Dry run: the motor is never really switched
+	Note      string        `json:"note,omitempty"`       // The user's label for the run, e.g. "filling tank for seedlings"
+	RequestID string        `json:"request_id,omitempty"` // X-Request-ID of the API call that queued it, sent with its ON command
+	Priority  string        `json:"priority,omitempty"`   // PriorityLow, PriorityNormal or PriorityHigh ("": normal)
+	ExpiresAt time.Time     `json:"expires_at,omitzero"`  // Skipped rather than run if it hasn't started by then (zero: never)
+	Round     int           `json:"round,omitempty"`      // Fair-share round within its priority, set by Push (see fairRound)
+	row       uint          // Database queue row it was popped from, so Requeue puts it back in place
+}
+
+const ( // Priorities of a queued request: higher ones are dispatched first, taking turns between users within one
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high" // Urgent runs, e.g. watering livestock
+)
+
+var priorities = []string{PriorityHigh, PriorityNormal, PriorityLow} // In dispatch order
+
+// priorityRank orders priorities for dispatch, lowest rank first. Anything but high or low
+// is normal.
+func priorityRank(p string) int {
+	switch p {
+	case PriorityHigh:
+		return 0
+	case PriorityLow:
+		return 2
+	}
+	return 1
+}
+
+// fairRound returns the round a request of userID is queued in, given the rounds and
+// users of the requests already queued at its priority. It is one round after that user's
+// last, but no earlier than the oldest round still queued, so within a priority everyone
+// waiting gets a turn before anyone's next request, however many they queue, and a
+// newcomer doesn't jump ahead of requests that have waited longer.
+func fairRound(queued []*MotorRequest, userID uint) int {
+	round, mine := 0, -1
+	for i, q := range queued {
+		if i == 0 || q.Round < round {
+			round = q.Round
+		}
+		if q.UserID == userID {
+			mine = max(mine, q.Round)
+		}
+	}
+	return max(round, mine+1)
+}
+
+type Shutdown struct { // Emergency shutdown state
+	Active   bool      `json:"active"`   // Whether the system is shut down
+	Category string    `json:"category"` // Why, in a word: maintenance, safety, weather or electrical
+	Reason   string    `json:"reason"`   // Notes on why (optional)
+	Since    time.Time `json:"since"`    // When it was shut down
+	Until    time.Time `json:"until"`    // When it ends by itself; zero until an admin restarts
+}
+
+// Summary is the category followed by the notes, e.g. "safety: pump leaking", for messages.
+func (s Shutdown) Summary() string {
+	switch {
+	case s.Category == "":
+		return s.Reason
+	case s.Reason == "":
+		return s.Category
+	}
+	return s.Category + ": " + s.Reason
+}
+
+type Queue interface { // Pending motor requests, highest priority first; within a priority by round (users take turns), then oldest first
+	Push(ctx context.Context, req *MotorRequest) error            // Queue in req's fair round (setting req.Round) behind higher priorities; ErrQueueFull at capacity
+	Pop(ctx context.Context) (*MotorRequest, error)               // Block until a request is available or ctx is done
+	Requeue(ctx context.Context, req *MotorRequest) error         // Put back a request Pop just returned, next again within its priority, even at capacity
+	Drain(ctx context.Context) ([]*MotorRequest, error)           // Remove and return everything queued, next first
+	List(ctx context.Context) ([]*MotorRequest, error)            // Everything queued, next first, left in place
+	Remove(ctx context.Context, id string) (*MotorRequest, error) // Take the request with ID id out of the queue (nil if it isn't queued)
+	Len(ctx context.Context) (int, error)                         // Number of queued requests
+	Cap() int                                                     // Maximum number of queued requests
+	SetCap(n int)                                                 // Change the capacity (0: the default); requests queued beyond it stay queued
+	Persistent() bool                                             // True when queued requests outlive the process (no need to save them on shutdown)
+}
+
+type State interface { // Shutdown flag, rate limits, leases and sequences
+	GetShutdown(ctx context.Context) (Shutdown, error) // Current shutdown state
+	SetShutdown(ctx context.Context, s Shutdown) error // Replace shutdown state
+
+	// Allow counts one hit for key in a fixed window and reports whether it is within limit.
+	Allow(ctx context.Context, key string, limit int, window time.Duration) (bool, error)
+
+	// AcquireLease takes the named lease for holder, or renews it if holder already has
+	// it, for ttl. It reports whether holder owns the lease afterwards.
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	ReleaseLease(ctx context.Context, name, holder string) error  // Give the lease up early if holder owns it
+	LeaseHolder(ctx context.Context, name string) (string, error) // Current owner ("" if none)
+
+	// NextSequence returns a number larger than any it returned for name before: the
+	// previous one plus one, or the current Unix time in milliseconds if that is larger,
+	// so numbers keep growing across restarts even when the state doesn't survive them.
+	NextSequence(ctx context.Context, name string) (uint64, error)
+
+	Shared() bool // True when state outlives the process (no need to save it on shutdown)
+}
+
+type Options struct { // Options selects and configures the backend
+	Backend       string   // "memory" (default) or "redis"
+	QueueBackend  string   // Backend of the queue alone: "memory", "redis" or "database" (default: "redis" with Redis state, else "database" given DB)
+	QueueCapacity int      // Max queued requests
+	DB            *gorm.DB // Database of the "database" queue backend
+	RedisAddr     string   // host:port
+	RedisPassword string   // Optional password
+	RedisDB       int      // Database number
+	RedisPrefix   string   // Key prefix, so several deployments can share a server
+}
+
+// New builds the state and queue for the configured backends. With both on Redis they
+// share one client.
+func New(opts Options) (State, Queue, error) {
+	var rb *redisBackend
+	useRedis := func() (*redisBackend, error) { // Connects on first use
+		if rb != nil {
+			return rb, nil
+		}
+		var err error
+		rb, err = newRedis(opts)
+		return rb, err
+	}
+	var state State
+	switch opts.Backend {
+	case "", "memory":
+		state = NewMemoryState()
+	case "redis":
+		b, err := useRedis()
+		if err != nil {
+			return nil, nil, err
+		}
+		state = b
+	default:
+		return nil, nil, fmt.Errorf("unknown state backend %q", opts.Backend)
+	}
+	backend := opts.QueueBackend
+	switch {
+	case backend != "":
+	case opts.Backend == "redis":
+		backend = "redis"
+	case opts.DB != nil: // With in-memory state, keep the queue in the database so it survives a crash
+		backend = "database"
+	default:
+		backend = "memory"
+	}
+	switch backend {
+	case "", "memory":
+		return state, NewMemoryQueue(opts.QueueCapacity), nil
+	case "redis":
+		b, err := useRedis()
+		if err != nil {
+			return nil, nil, err
+		}
+		return state, b, nil
+	case "database":
+		if opts.DB == nil {
+			return nil, nil, errors.New("database queue backend needs a database")
+		}
+		return state, NewDatabaseQueue(opts.DB, opts.QueueCapacity), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown queue backend %q", backend)
+	}
+}
@@ -0,0 +1,352 @@
+// store_test.go - Tests shared by the memory, Redis and database backends
+// Run with: go test ./...
+
+package store
+
+import (
+	"context"                // For calls
+	"go-mqtt-backend/models" // Queue item model
+	"path/filepath"          // Test database path
+	"testing"                // Go's testing package
+	"time"                   // For durations
+
+	"github.com/alicebob/miniredis/v2"   // In-process Redis for tests
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite" // Database queue tests
+	"gorm.io/gorm"
+)
+
+// testDB opens a fresh SQLite database with the queue table
+func testDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "queue.db")), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1) // One writer, as database.Open sets up
+	t.Cleanup(func() { sqlDB.Close() })
+	require.NoError(t, db.AutoMigrate(&models.MotorQueueItem{}))
+	return db
+}
+
+// backends returns a fresh memory, Redis (miniredis) and database (memory state, SQLite
+// queue) backend
+func backends(t *testing.T) map[string]func() (State, Queue) {
+	return map[string]func() (State, Queue){
+		"memory": func() (State, Queue) { return NewMemoryState(), NewMemoryQueue(2) },
+		"redis": func() (State, Queue) {
+			mr := miniredis.RunT(t)
+			state, queue, err := New(Options{Backend: "redis", RedisAddr: mr.Addr(), QueueCapacity: 2, RedisPrefix: "test:"})
+			require.NoError(t, err)
+			return state, queue
+		},
+		"database": func() (State, Queue) {
+			state, queue, err := New(Options{QueueBackend: "database", DB: testDB(t), QueueCapacity: 2})
+			require.NoError(t, err)
+			return state, queue
+		},
+	}
+}
+
+// TestQueueBackend checks that the queue can live in Redis while the rest of the state
+// stays in memory, and that replicas then share it
+func TestQueueBackend(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	opts := Options{Backend: "memory", QueueBackend: "redis", RedisAddr: mr.Addr(), QueueCapacity: 2, RedisPrefix: "test:"}
+	state, queue, err := New(opts)
+	require.NoError(t, err)
+	assert.False(t, state.Shared())
+	assert.True(t, queue.Persistent())
+	require.NoError(t, queue.Push(ctx, &MotorRequest{UserID: 1, Duration: time.Minute}))
+
+	_, other, err := New(opts) // Another replica, or the same one after a restart
+	require.NoError(t, err)
+	req, err := other.Pop(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), req.UserID)
+
+	_, _, err = New(Options{QueueBackend: "kafka"})
+	assert.ErrorContains(t, err, "unknown queue backend")
+}
+
+// TestDatabaseQueue checks that a database queue keeps its requests across a restart and
+// picks up requests queued by another process
+func TestDatabaseQueue(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	queue := NewDatabaseQueue(db, 2)
+	assert.True(t, queue.Persistent())
+	require.NoError(t, queue.Push(ctx, &MotorRequest{UserID: 1, Duration: time.Minute, RequestID: "req-1"}))
+
+	restarted := NewDatabaseQueue(db, 2) // Same database after a crash
+	req, err := restarted.Pop(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), req.UserID)
+	assert.Equal(t, "req-1", req.RequestID)
+
+	old := databasePoll
+	databasePoll = 10 * time.Millisecond
+	t.Cleanup(func() { databasePoll = old })
+	popped := make(chan *MotorRequest, 1)
+	go func() {
+		req, _ := restarted.Pop(ctx) // Waits: nothing is queued
+		popped <- req
+	}()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, queue.Push(ctx, &MotorRequest{UserID: 2})) // Pushed by another process: no signal
+	select {
+	case req := <-popped:
+		assert.Equal(t, uint(2), req.UserID)
+	case <-time.After(time.Second):
+		t.Fatal("Pop did not pick up a request queued elsewhere")
+	}
+
+	_, _, err = New(Options{QueueBackend: "database"})
+	assert.ErrorContains(t, err, "needs a database")
+
+	_, byDefault, err := New(Options{Backend: "memory", DB: db}) // In-memory state keeps the queue in the database
+	require.NoError(t, err)
+	assert.True(t, byDefault.Persistent())
+	_, inMemory, err := New(Options{Backend: "memory", QueueBackend: "memory", DB: db})
+	require.NoError(t, err)
+	assert.False(t, inMemory.Persistent())
+}
+
+// TestQueue checks FIFO order, capacity and changing it, removal and draining
+func TestQueue(t *testing.T) {
+	ctx := context.Background()
+	for name, newBackend := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			_, q := newBackend()
+			require.NoError(t, q.Push(ctx, &MotorRequest{ID: "a", UserID: 1, Duration: time.Minute}))
+			require.NoError(t, q.Push(ctx, &MotorRequest{ID: "b", UserID: 2, Duration: time.Minute, Note: "seedlings"}))
+			assert.ErrorIs(t, q.Push(ctx, &MotorRequest{UserID: 3}), ErrQueueFull) // Capacity is 2
+			q.SetCap(3)
+			assert.Equal(t, 3, q.Cap())
+			require.NoError(t, q.Push(ctx, &MotorRequest{ID: "x", UserID: 3}))
+			q.SetCap(2) // Below what is queued: nothing more fits, nothing is dropped
+			assert.ErrorIs(t, q.Push(ctx, &MotorRequest{UserID: 4}), ErrQueueFull)
+			removed, err := q.Remove(ctx, "x")
+			require.NoError(t, err)
+			require.NotNil(t, removed)
+
+			n, err := q.Len(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 2, n)
+			listed, err := q.List(ctx) // Left in place
+			require.NoError(t, err)
+			require.Len(t, listed, 2)
+			assert.Equal(t, uint(1), listed[0].UserID)
+			assert.Equal(t, uint(2), listed[1].UserID)
+
+			req, err := q.Pop(ctx) // Oldest first
+			require.NoError(t, err)
+			assert.Equal(t, uint(1), req.UserID)
+			assert.Equal(t, "a", req.ID)
+			require.NoError(t, q.Push(ctx, &MotorRequest{ID: "c", UserID: 3}))
+			removed, err = q.Remove(ctx, "c")
+			require.NoError(t, err)
+			require.NotNil(t, removed)
+			assert.Equal(t, uint(3), removed.UserID)
+			removed, err = q.Remove(ctx, "c") // No longer queued
+			require.NoError(t, err)
+			assert.Nil(t, removed)
+
+			rest, err := q.Drain(ctx)
+			require.NoError(t, err)
+			require.Len(t, rest, 1)
+			assert.Equal(t, uint(2), rest[0].UserID)
+			assert.Equal(t, "seedlings", rest[0].Note)
+
+			popCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond) // Empty queue blocks until ctx ends
+			defer cancel()
+			_, err = q.Pop(popCtx)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// TestQueuePriority checks that higher priorities are dispatched first and that each
+// priority keeps its own order
+func TestQueuePriority(t *testing.T) {
+	ctx := context.Background()
+	for name, newBackend := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			_, q := newBackend()
+			require.NoError(t, q.Push(ctx, &MotorRequest{UserID: 1, Priority: PriorityLow}))
+			require.NoError(t, q.Push(ctx, &MotorRequest{UserID: 2, Priority: PriorityHigh})) // Jumps ahead
+			assert.ErrorIs(t, q.Push(ctx, &MotorRequest{UserID: 3, Priority: PriorityHigh}), ErrQueueFull)
+			listed, err := q.List(ctx)
+			require.NoError(t, err)
+			require.Len(t, listed, 2)
+			assert.Equal(t, uint(2), listed[0].UserID)
+			assert.Equal(t, uint(1), listed[1].UserID)
+
+			req, err := q.Pop(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, uint(2), req.UserID)
+			assert.Equal(t, PriorityHigh, req.Priority)
+			require.NoError(t, q.Push(ctx, &MotorRequest{UserID: 4})) // Normal: ahead of low
+			rest, err := q.Drain(ctx)
+			require.NoError(t, err)
+			require.Len(t, rest, 2)
+			assert.Equal(t, uint(4), rest[0].UserID)
+			assert.Equal(t, uint(1), rest[1].UserID)
+		})
+	}
+}
+
+// TestQueueFairness checks that users take turns within a priority, however many
+// requests they queue, and that a newcomer waits for the round in progress
+func TestQueueFairness(t *testing.T) {
+	ctx := context.Background()
+	for name, newBackend := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			_, q := newBackend()
+			q.SetCap(10)
+			push := func(id string, userID uint, priority string) {
+				t.Helper()
+				require.NoError(t, q.Push(ctx, &MotorRequest{ID: id, UserID: userID, Priority: priority}))
+			}
+			ids := func() []string {
+				t.Helper()
+				listed, err := q.List(ctx)
+				require.NoError(t, err)
+				out := make([]string, len(listed))
+				for i, req := range listed {
+					out[i] = req.ID
+				}
+				return out
+			}
+			pop := func() string {
+				t.Helper()
+				req, err := q.Pop(ctx)
+				require.NoError(t, err)
+				return req.ID
+			}
+			push("a1", 1, "")
+			push("a2", 1, "")
+			push("a3", 1, "")
+			push("b1", 2, "")
+			push("c1", 3, PriorityNormal)
+			push("c2", 3, "")
+			assert.Equal(t, []string{"a1", "b1", "c1", "a2", "c2", "a3"}, ids())
+
+			assert.Equal(t, "a1", pop())
+			assert.Equal(t, "b1", pop())
+			push("d1", 4, "") // Gets a turn in the round still going
+			push("a4", 1, PriorityHigh)
+			assert.Equal(t, []string{"a4", "c1", "d1", "a2", "c2", "a3"}, ids())
+			assert.Equal(t, "a4", pop())
+			assert.Equal(t, "c1", pop())
+			assert.Equal(t, "d1", pop())
+			push("e1", 5, "") // Behind those that waited longer
+			assert.Equal(t, []string{"a2", "c2", "e1", "a3"}, ids())
+		})
+	}
+}
+
+// TestQueueRequeue checks that a popped request put back is next again within its
+// priority, even with the queue full
+func TestQueueRequeue(t *testing.T) {
+	ctx := context.Background()
+	for name, newBackend := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			_, q := newBackend()
+			q.SetCap(3)
+			for _, req := range []*MotorRequest{{ID: "a1", UserID: 1}, {ID: "a2", UserID: 1}, {ID: "b1", UserID: 2}} {
+				require.NoError(t, q.Push(ctx, req))
+			}
+			req, err := q.Pop(ctx)
+			require.NoError(t, err)
+			require.Equal(t, "a1", req.ID)
+			require.NoError(t, q.Push(ctx, &MotorRequest{ID: "h1", UserID: 3, Priority: PriorityHigh})) // Full again
+			require.NoError(t, q.Requeue(ctx, req))
+
+			listed, err := q.List(ctx)
+			require.NoError(t, err)
+			ids := make([]string, len(listed))
+			for i, req := range listed {
+				ids[i] = req.ID
+			}
+			assert.Equal(t, []string{"h1", "a1", "b1", "a2"}, ids)
+		})
+	}
+}
+
+// TestState checks shutdown state and rate limiting
+func TestState(t *testing.T) {
+	ctx := context.Background()
+	for name, newBackend := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			s, _ := newBackend()
+			require.NoError(t, s.SetShutdown(ctx, Shutdown{Active: true, Reason: "storm"}))
+			sd, err := s.GetShutdown(ctx)
+			require.NoError(t, err)
+			assert.True(t, sd.Active)
+			assert.Equal(t, "storm", sd.Reason)
+
+			for i := 0; i < 3; i++ {
+				allowed, err := s.Allow(ctx, "login:1.2.3.4", 3, time.Minute)
+				require.NoError(t, err)
+				assert.True(t, allowed)
+			}
+			allowed, err := s.Allow(ctx, "login:1.2.3.4", 3, time.Minute) // Fourth hit in the window
+			require.NoError(t, err)
+			assert.False(t, allowed)
+		})
+	}
+}
+
+// TestLease checks that only one holder owns a lease until it is released
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	for name, newBackend := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			s, _ := newBackend()
+			ok, err := s.AcquireLease(ctx, "motor", "a", time.Minute)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = s.AcquireLease(ctx, "motor", "b", time.Minute) // Held by a
+			require.NoError(t, err)
+			assert.False(t, ok)
+			ok, err = s.AcquireLease(ctx, "motor", "a", time.Minute) // Renewal
+			require.NoError(t, err)
+			assert.True(t, ok)
+			holder, err := s.LeaseHolder(ctx, "motor")
+			require.NoError(t, err)
+			assert.Equal(t, "a", holder)
+
+			require.NoError(t, s.ReleaseLease(ctx, "motor", "b")) // Not b's to release
+			holder, _ = s.LeaseHolder(ctx, "motor")
+			assert.Equal(t, "a", holder)
+			require.NoError(t, s.ReleaseLease(ctx, "motor", "a"))
+			ok, err = s.AcquireLease(ctx, "motor", "b", time.Minute)
+			require.NoError(t, err)
+			assert.True(t, ok)
+		})
+	}
+}
+
+// TestNextSequence checks that sequence numbers grow per name and start at the clock
+func TestNextSequence(t *testing.T) {
+	ctx := context.Background()
+	for name, newBackend := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			s, _ := newBackend()
+			before := uint64(time.Now().UnixMilli())
+			first, err := s.NextSequence(ctx, "pump")
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, first, before) // Survives a restart that loses the counter
+			for i := 0; i < 3; i++ {
+				n, err := s.NextSequence(ctx, "pump")
+				require.NoError(t, err)
+				assert.Greater(t, n, first)
+				first = n
+			}
+			other, err := s.NextSequence(ctx, "fan")
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, other, before)
+		})
+	}
+}
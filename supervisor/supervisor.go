@@ -0,0 +1,268 @@
+// supervisor.go - Restarts crashed or stalled background goroutines and reports their health
+
+package supervisor // Declares the package name
+
+import ( // Import required packages
+	"context"       // For cancellation
+	"fmt"           // For error formatting
+	"io"            // Metrics output
+	"log"           // Logging
+	"runtime/debug" // Stack traces for panics
+	"sort"          // Stable task listing
+	"sync"          // For mutex (thread safety)
+	"time"          // For time operations
+)
+
+type Task struct { // Task describes a long-lived goroutine to keep running
+	Name string // Unique task name
+	// Run does the work until ctx is cancelled. It should call beat regularly (also while
+	// idle) when StallAfter is set. Returning nil means the task is finished for good;
+	// returning an error or panicking gets it restarted with backoff.
+	Run        func(ctx context.Context, beat func()) error
+	StallAfter time.Duration // Restart the task if beat isn't called for this long (0 disables)
+}
+
+const ( // Task states
+	StateRunning = "running" // Run is executing
+	StateBackoff = "backoff" // Crashed or stalled, waiting to restart
+	StateDone    = "done"    // Returned nil, not restarted
+	StateStopped = "stopped" // Supervisor stopped
+)
+
+type TaskStatus struct { // TaskStatus is a snapshot of a task for health endpoints
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Healthy   bool      `json:"healthy"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"last_error,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	LastBeat  time.Time `json:"last_beat"`
+}
+
+type task struct { // task is a registered task and its runtime state
+	Task
+	state     string
+	restarts  int
+	lastError string
+	startedAt time.Time
+	lastBeat  time.Time
+}
+
+type Supervisor struct { // Supervisor runs registered tasks until stopped
+	mu     sync.Mutex       // Mutex for thread safety
+	tasks  map[string]*task // Tasks by name
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // Tracks task loops
+
+	minBackoff time.Duration // First restart delay
+	maxBackoff time.Duration // Restart delay cap
+	resetAfter time.Duration // A run lasting this long resets the backoff
+}
+
+func New() *Supervisor { // Creates a supervisor with 1s..30s restart backoff
+	return &Supervisor{
+		tasks:      make(map[string]*task),
+		minBackoff: time.Second,
+		maxBackoff: 30 * time.Second,
+		resetAfter: time.Minute,
+	}
+}
+
+func (s *Supervisor) Add(t Task) error { // Registers a task; call before Start
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.tasks[t.Name]; exists {
+		return fmt.Errorf("task %s already registered", t.Name)
+	}
+	s.tasks[t.Name] = &task{Task: t}
+	return nil
+}
+
+func (s *Supervisor) Start() { // Starts every registered task
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tasks {
+		s.wg.Add(1)
+		go s.loop(ctx, t)
+	}
+}
+
+// Stop cancels all tasks and waits for them to return or for ctx to expire.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	if s.cancel == nil { // Never started
+		return nil
+	}
+	s.cancel()
+	done := make(chan struct{})
+	go func() { s.wg.Wait(); close(done) }()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Supervisor) loop(ctx context.Context, t *task) { // Runs t, restarting it until it finishes or ctx ends
+	defer s.wg.Done()
+	backoff := s.minBackoff
+	for {
+		started := time.Now()
+		err := s.run(ctx, t)
+		if ctx.Err() != nil {
+			s.setState(t, StateStopped)
+			return
+		}
+		if err == nil {
+			log.Printf("task %s finished", t.Name)
+			s.setState(t, StateDone)
+			return
+		}
+		if time.Since(started) >= s.resetAfter { // Ran fine for a while, so this is a fresh failure
+			backoff = s.minBackoff
+		}
+		s.mu.Lock()
+		t.state, t.lastError = StateBackoff, err.Error()
+		t.restarts++
+		s.mu.Unlock()
+		log.Printf("task %s failed, restarting in %s: %v", t.Name, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			s.setState(t, StateStopped)
+			return
+		}
+		backoff = min(backoff*2, s.maxBackoff)
+	}
+}
+
+// run executes one attempt of t, converting panics into errors and cancelling the
+// attempt if it stops calling beat for longer than StallAfter.
+func (s *Supervisor) run(ctx context.Context, t *task) (err error) {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	now := time.Now()
+	s.mu.Lock()
+	t.state, t.startedAt, t.lastBeat = StateRunning, now, now
+	s.mu.Unlock()
+	beat := func() {
+		s.mu.Lock()
+		t.lastBeat = time.Now()
+		s.mu.Unlock()
+	}
+
+	stalled := make(chan time.Duration, 1) // Set by the watchdog before it cancels the run
+	if t.StallAfter > 0 {
+		go s.watch(runCtx, t, cancel, stalled)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("task %s panicked: %v\n%s", t.Name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+		select {
+		case idle := <-stalled: // Report the stall rather than the cancellation it caused
+			err = fmt.Errorf("stalled: no heartbeat for %s", idle.Round(time.Second))
+		default:
+		}
+	}()
+	return t.Run(runCtx, beat)
+}
+
+func (s *Supervisor) watch(ctx context.Context, t *task, cancel context.CancelFunc, stalled chan<- time.Duration) { // Stall watchdog for one run
+	ticker := time.NewTicker(t.StallAfter / 4) // Check often enough to catch a stall soon after it happens
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			idle := time.Since(t.lastBeat)
+			s.mu.Unlock()
+			if idle > t.StallAfter {
+				log.Printf("task %s stalled (no heartbeat for %s), cancelling", t.Name, idle.Round(time.Second))
+				stalled <- idle
+				cancel() // The task must honour ctx for the restart to happen
+				return
+			}
+		}
+	}
+}
+
+func (s *Supervisor) setState(t *task, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.state = state
+}
+
+func (s *Supervisor) Status() []TaskStatus { // Snapshot of every task, sorted by name
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]TaskStatus, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		out = append(out, TaskStatus{
+			Name:      t.Name,
+			State:     t.state,
+			Healthy:   t.healthy(),
+			Restarts:  t.restarts,
+			LastError: t.lastError,
+			StartedAt: t.startedAt,
+			LastBeat:  t.lastBeat,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (s *Supervisor) Healthy() bool { // Reports whether every task is running (or finished cleanly)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tasks {
+		if !t.healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *task) healthy() bool { // Caller holds the lock
+	switch t.state {
+	case StateRunning:
+		return t.StallAfter == 0 || time.Since(t.lastBeat) <= t.StallAfter
+	case StateDone:
+		return true
+	}
+	return false
+}
+
+// WriteMetrics writes task health in the Prometheus text exposition format.
+func (s *Supervisor) WriteMetrics(w io.Writer) {
+	status := s.Status()
+	fmt.Fprintln(w, "# HELP supervisor_task_up Whether a supervised task is healthy (1) or not (0).")
+	fmt.Fprintln(w, "# TYPE supervisor_task_up gauge")
+	for _, t := range status {
+		up := 0
+		if t.Healthy {
+			up = 1
+		}
+		fmt.Fprintf(w, "supervisor_task_up{task=%q} %d\n", t.Name, up)
+	}
+	fmt.Fprintln(w, "# HELP supervisor_task_restarts_total Times a supervised task was restarted after a crash or stall.")
+	fmt.Fprintln(w, "# TYPE supervisor_task_restarts_total counter")
+	for _, t := range status {
+		fmt.Fprintf(w, "supervisor_task_restarts_total{task=%q} %d\n", t.Name, t.Restarts)
+	}
+	fmt.Fprintln(w, "# HELP supervisor_task_heartbeat_age_seconds Seconds since a supervised task last reported progress.")
+	fmt.Fprintln(w, "# TYPE supervisor_task_heartbeat_age_seconds gauge")
+	for _, t := range status {
+		if !t.LastBeat.IsZero() {
+			fmt.Fprintf(w, "supervisor_task_heartbeat_age_seconds{task=%q} %.0f\n", t.Name, time.Since(t.LastBeat).Seconds())
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// supervisor_test.go - Tests for the goroutine supervisor
+// Run with: go test ./...
+
+package supervisor
+
+import (
+	"context"     // For task functions
+	"errors"      // For task failures
+	"strings"     // For checking metrics output
+	"sync/atomic" // For counting runs
+	"testing"     // Go's testing package
+	"time"        // For durations
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// fastSupervisor returns a supervisor with millisecond backoff so restarts are quick to observe
+func fastSupervisor() *Supervisor {
+	s := New()
+	s.minBackoff, s.maxBackoff = 10*time.Millisecond, 50*time.Millisecond
+	return s
+}
+
+// stop stops s and fails the test if tasks don't return promptly
+func stop(t *testing.T, s *Supervisor) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.Stop(ctx))
+}
+
+// TestRestartsOnPanicAndError checks that crashing tasks are restarted and counted
+func TestRestartsOnPanicAndError(t *testing.T) {
+	s := fastSupervisor()
+	var runs int32
+	require.NoError(t, s.Add(Task{Name: "flaky", Run: func(ctx context.Context, beat func()) error {
+		switch atomic.AddInt32(&runs, 1) {
+		case 1:
+			panic("boom")
+		case 2:
+			return errors.New("broken")
+		}
+		<-ctx.Done() // Third attempt stays up
+		return nil
+	}}))
+	assert.Error(t, s.Add(Task{Name: "flaky"})) // Duplicate name
+
+	s.Start()
+	require.Eventually(t, s.Healthy, time.Second, 5*time.Millisecond)
+	status := s.Status()
+	require.Len(t, status, 1)
+	assert.Equal(t, StateRunning, status[0].State)
+	assert.Equal(t, 2, status[0].Restarts)
+	assert.Equal(t, "broken", status[0].LastError)
+
+	stop(t, s)
+	assert.Equal(t, StateStopped, s.Status()[0].State)
+	assert.False(t, s.Healthy())
+}
+
+// TestStallDetection checks that a task that stops calling beat is cancelled and restarted
+func TestStallDetection(t *testing.T) {
+	s := fastSupervisor()
+	var runs int32
+	require.NoError(t, s.Add(Task{Name: "stuck", StallAfter: 40 * time.Millisecond, Run: func(ctx context.Context, beat func()) error {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			<-ctx.Done() // Never beats; only the watchdog gets us out
+			return ctx.Err()
+		}
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				beat()
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}}))
+	s.Start()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&runs) >= 2 }, time.Second, 5*time.Millisecond)
+	require.Eventually(t, s.Healthy, time.Second, 5*time.Millisecond)
+	status := s.Status()[0]
+	assert.Equal(t, 1, status.Restarts)
+	assert.Contains(t, status.LastError, "stalled")
+	stop(t, s)
+}
+
+// TestFinishedTaskAndMetrics checks that a task returning nil is not restarted and metrics are written
+func TestFinishedTaskAndMetrics(t *testing.T) {
+	s := fastSupervisor()
+	var runs int32
+	require.NoError(t, s.Add(Task{Name: "once", Run: func(ctx context.Context, beat func()) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}}))
+	s.Start()
+	require.Eventually(t, func() bool { return s.Status()[0].State == StateDone }, time.Second, 5*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&runs))
+	assert.True(t, s.Healthy())
+
+	var out strings.Builder
+	s.WriteMetrics(&out)
+	assert.Contains(t, out.String(), `supervisor_task_up{task="once"} 1`)
+	assert.Contains(t, out.String(), `supervisor_task_restarts_total{task="once"} 0`)
+	stop(t, s)
+}
@@ -0,0 +1,116 @@
+// weather.go - Rain forecasts for skipping irrigation (OpenWeatherMap first)
+
+package weather // Declares the package name
+
+import ( // Import required packages
+	"context"       // For cancellation
+	"encoding/json" // API payloads
+	"errors"        // Missing forecast checks
+	"fmt"           // For error formatting
+	"io"            // Reading responses
+	"net/http"      // Forecast API
+	"net/url"       // Query encoding
+	"strconv"       // Coordinates in the query
+	"sync"          // Forecast cache
+	"time"          // Forecast slots
+)
+
+// ErrNoForecast is returned when the forecast doesn't reach the asked-for time.
+var ErrNoForecast = errors.New("no forecast for that time")
+
+type Forecaster interface { // Forecaster predicts rain at the site
+	// RainChance returns the highest chance of rain (0-100) forecast between from and to.
+	RainChance(ctx context.Context, from, to time.Time) (int, error)
+}
+
+const slotLength = 3 * time.Hour // OpenWeatherMap forecast step
+
+type OpenWeatherMap struct { // OpenWeatherMap reads the free 5 day / 3 hour forecast
+	APIKey   string
+	Lat, Lon float64       // Site coordinates
+	CacheFor time.Duration // How long one forecast is reused (0 uses 30 minutes; the forecast updates every 3 hours)
+	BaseURL  string        // API root (empty uses https://api.openweathermap.org)
+	Client   *http.Client  // HTTP client (nil uses a 15s-timeout client)
+
+	mu      sync.Mutex // Guards the cached forecast
+	slots   []slot
+	fetched time.Time
+}
+
+type slot struct { // One forecast step
+	At  time.Time
+	Pop float64 // Probability of precipitation, 0-1
+}
+
+func (o *OpenWeatherMap) RainChance(ctx context.Context, from, to time.Time) (int, error) {
+	slots, err := o.forecast(ctx)
+	if err != nil {
+		return 0, err
+	}
+	chance, found := 0.0, false
+	for _, s := range slots {
+		if s.At.Add(slotLength).After(from) && s.At.Before(to) {
+			chance, found = max(chance, s.Pop), true
+		}
+	}
+	if !found {
+		return 0, ErrNoForecast
+	}
+	return int(chance*100 + 0.5), nil
+}
+
+func (o *OpenWeatherMap) forecast(ctx context.Context) ([]slot, error) { // Cached forecast, refetched when stale
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ttl := o.CacheFor
+	if ttl == 0 {
+		ttl = 30 * time.Minute
+	}
+	if o.slots != nil && time.Since(o.fetched) < ttl {
+		return o.slots, nil
+	}
+	base, client := o.BaseURL, o.Client
+	if base == "" {
+		base = "https://api.openweathermap.org"
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 15 * time.Second}
+	}
+	query := url.Values{
+		"lat":   {strconv.FormatFloat(o.Lat, 'f', -1, 64)},
+		"lon":   {strconv.FormatFloat(o.Lon, 'f', -1, 64)},
+		"appid": {o.APIKey},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/data/2.5/forecast?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("openweathermap: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &apiErr)
+		return nil, fmt.Errorf("openweathermap: %s (HTTP %d)", apiErr.Message, resp.StatusCode)
+	}
+	var body struct {
+		List []struct {
+			Dt  int64   `json:"dt"`
+			Pop float64 `json:"pop"`
+		} `json:"list"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("openweathermap: forecast response: %w", err)
+	}
+	slots := make([]slot, len(body.List))
+	for i, s := range body.List {
+		slots[i] = slot{At: time.Unix(s.Dt, 0), Pop: s.Pop}
+	}
+	o.slots, o.fetched = slots, time.Now()
+	return slots, nil
+}
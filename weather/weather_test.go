@@ -0,0 +1,50 @@
+// weather_test.go - Tests for the OpenWeatherMap forecaster
+// Run with: go test ./...
+
+package weather
+
+import (
+	"context"           // For cancellation
+	"fmt"               // Fake responses
+	"net/http"          // HTTP status codes
+	"net/http/httptest" // Fake forecast API
+	"testing"           // Go's testing package
+	"time"              // Forecast slots
+
+	"github.com/stretchr/testify/assert" // For assertions
+	"github.com/stretchr/testify/require"
+)
+
+// TestOpenWeatherMapRainChance checks slot selection, caching and API errors
+func TestOpenWeatherMapRainChance(t *testing.T) {
+	start := time.Date(2030, 6, 1, 0, 0, 0, 0, time.UTC)
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "/data/2.5/forecast", r.URL.Path)
+		assert.Equal(t, "31.52", r.URL.Query().Get("lat"))
+		if r.URL.Query().Get("appid") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"cod":401,"message":"Invalid API key"}`))
+			return
+		}
+		fmt.Fprintf(w, `{"cod":"200","list":[{"dt":%d,"pop":0.1},{"dt":%d,"pop":0.75},{"dt":%d,"pop":0.2}]}`,
+			start.Unix(), start.Add(3*time.Hour).Unix(), start.Add(6*time.Hour).Unix())
+	}))
+	defer srv.Close()
+
+	owm := &OpenWeatherMap{APIKey: "key", Lat: 31.52, Lon: 74.35, BaseURL: srv.URL}
+	chance, err := owm.RainChance(context.Background(), start.Add(time.Hour), start.Add(2*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 10, chance) // Only the first slot
+	chance, err = owm.RainChance(context.Background(), start.Add(time.Hour), start.Add(7*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 75, chance) // Highest of all three
+	_, err = owm.RainChance(context.Background(), start.Add(48*time.Hour), start.Add(50*time.Hour))
+	assert.ErrorIs(t, err, ErrNoForecast)
+	assert.Equal(t, 1, calls) // Cached
+
+	bad := &OpenWeatherMap{APIKey: "wrong", Lat: 31.52, BaseURL: srv.URL}
+	_, err = bad.RainChance(context.Background(), start, start.Add(time.Hour))
+	assert.ErrorContains(t, err, "Invalid API key")
+}
@@ -0,0 +1,139 @@
+// app.js - Admin dashboard logic. Talks to the regular JSON API with the admin's JWT.
+(function () {
+  "use strict";
+
+  var TOKEN_KEY = "adminToken";
+  var REFRESH_MS = 5000;
+  var timer = null;
+  var sessionID = null; // Interlock ID of the running session
+
+  function $(id) { return document.getElementById(id); }
+
+  function token() { return localStorage.getItem(TOKEN_KEY); }
+
+  function api(method, path, body) {
+    var opts = { method: method, headers: { "Authorization": "Bearer " + token() } };
+    if (body) {
+      opts.headers["Content-Type"] = "application/json";
+      opts.body = JSON.stringify(body);
+    }
+    return fetch(path, opts).then(function (res) {
+      return res.json().catch(function () { return {}; }).then(function (data) {
+        if (res.status === 401 || res.status === 403) { logout(); }
+        if (!res.ok) { throw new Error(data.error || res.statusText); }
+        return data;
+      });
+    });
+  }
+
+  function showError(err) {
+    var el = $("error");
+    el.textContent = err ? err.message : "";
+    el.hidden = !err;
+  }
+
+  function minutes(n) { return Math.round(n) + " min"; }
+
+  function time(iso) { return iso ? new Date(iso).toLocaleTimeString() : "–"; }
+
+  function render(s) {
+    var m = s.motor;
+    $("motor-state").textContent = m.running ? "Running" : "Off";
+    $("motor-state").className = "big " + (m.running ? "on" : "off");
+    $("motor-detail").textContent = m.running
+      ? "User " + m.user_id + ", " + time(m.started_at) + " → " + time(m.ends_at) + (m.note ? " · " + m.note : "")
+      : "";
+    sessionID = m.running && m.interlock ? m.interlock.id : null;
+    $("stop-session").hidden = !sessionID;
+
+    $("queue-length").textContent = s.queue_length;
+    $("queue-detail").textContent = "of " + s.queue_capacity + " slots";
+    var list = $("queue-list");
+    list.textContent = "";
+    (s.queue || []).forEach(function (r) {
+      var li = document.createElement("li");
+      li.textContent = "User " + r.user_id + ", " + minutes(r.duration_min) + (r.note ? " · " + r.note : "");
+      list.appendChild(li);
+    });
+
+    var q = s.quota;
+    $("quota-used").textContent = minutes(q.used_minutes) + " / " + minutes(q.limit_minutes);
+    $("quota-bar").style.width = Math.min(100, 100 * q.used_minutes / (q.limit_minutes || 1)) + "%";
+    $("quota-detail").textContent = "Resets at " + time(q.resets_at);
+
+    $("device-state").textContent = s.device.mqtt_connected ? "Broker connected" : "Broker disconnected";
+    $("device-state").className = "big " + (s.device.mqtt_connected ? "on" : "alert");
+
+    var sd = s.shutdown;
+    $("shutdown-state").textContent = sd.active
+      ? "Shut down since " + time(sd.since) + ": " + sd.reason
+      : "System operating normally.";
+    $("shutdown-state").className = sd.active ? "alert" : "";
+    $("shutdown-form").hidden = sd.active;
+    $("restart").hidden = !sd.active;
+
+    $("updated").textContent = new Date().toLocaleTimeString();
+  }
+
+  function refresh() {
+    api("GET", "/admin/status").then(function (s) { showError(null); render(s); }).catch(showError);
+  }
+
+  function showDashboard() {
+    $("login-view").hidden = true;
+    $("dashboard").hidden = false;
+    $("logout").hidden = false;
+    refresh();
+    timer = setInterval(refresh, REFRESH_MS);
+  }
+
+  function logout() {
+    localStorage.removeItem(TOKEN_KEY);
+    clearInterval(timer);
+    $("dashboard").hidden = true;
+    $("logout").hidden = true;
+    $("login-view").hidden = false;
+  }
+
+  $("login-form").addEventListener("submit", function (e) {
+    e.preventDefault();
+    var f = e.target;
+    fetch("/login", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ email: f.email.value, password: f.password.value })
+    }).then(function (res) { return res.json(); }).then(function (data) {
+      if (!data.token) { throw new Error(data.error || "login failed"); }
+      localStorage.setItem(TOKEN_KEY, data.token);
+      if (!data.password_change_required) { return data; }
+      var next = prompt("Choose a new password (at least 8 characters) before continuing.");
+      if (!next) { throw new Error("password change required"); }
+      return api("PUT", "/api/me/password", { current_password: f.password.value, new_password: next });
+    }).then(function (data) {
+      localStorage.setItem(TOKEN_KEY, data.token);
+      f.reset();
+      showDashboard();
+    }).catch(function (err) { localStorage.removeItem(TOKEN_KEY); alert(err.message); });
+  });
+
+  $("shutdown-form").addEventListener("submit", function (e) {
+    e.preventDefault();
+    var reason = e.target.reason.value;
+    if (!confirm("Shut down the motor and drop all queued requests?")) { return; }
+    api("POST", "/admin/shutdown", { reason: reason }).then(function () { e.target.reset(); refresh(); }).catch(showError);
+  });
+
+  $("stop-session").addEventListener("click", function () {
+    var reason = prompt("Why stop this run? The user will be told.");
+    if (!reason || !sessionID) { return; }
+    api("POST", "/admin/sessions/" + sessionID + "/stop", { reason: reason }).then(refresh).catch(showError);
+  });
+
+  $("restart").addEventListener("click", function () {
+    api("POST", "/admin/restart").then(refresh).catch(showError);
+  });
+
+  $("logout").addEventListener("click", logout);
+
+  if (token()) { showDashboard(); } else { logout(); }
+})();
@@ -0,0 +1,20 @@
+// web.go - Embedded static files for the admin dashboard
+
+package web // Declares the package name
+
+import ( // Import required packages
+	"embed"    // go:embed support
+	"io/fs"    // Sub-filesystem
+	"net/http" // http.FileSystem
+)
+
+//go:embed admin
+var adminFiles embed.FS // Dashboard HTML/JS/CSS compiled into the binary
+
+func AdminUI() http.FileSystem { // Returns the dashboard files rooted at the admin directory
+	sub, err := fs.Sub(adminFiles, "admin") // Strip the directory prefix
+	if err != nil {
+		panic(err) // Only possible if the embed directive is wrong
+	}
+	return http.FS(sub)
+}